@@ -0,0 +1,166 @@
+/*
+the public API of the database, for programs that import it.
+
+the engine is split into packages by layer: btree, btree_iter and freelist
+for the pages, kv and transactions for the file, under internal/ since
+their APIs follow the engine; table for the schemas and rows, ql for the
+SQL. most programs only need the table layer, so its types are
+re-exported here with the constants they take, and Open returns a DB that
+is ready to use.
+
+	db, err := adidb.Open("app.db", nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	tx := adidb.DBTX{}
+	db.Begin(&tx)
+	rec := (&adidb.Record{}).AddInt64("id", 1).AddStr("name", []byte("a"))
+	if _, err := tx.Insert("users", rec); err != nil {
+		db.Abort(&tx)
+		return err
+	}
+	return db.Commit(&tx)
+*/
+package adidb
+
+import (
+	"errors"
+
+	"github.com/Adit0507/AdiDB/internal/btree"
+	"github.com/Adit0507/AdiDB/internal/btree_iter"
+	"github.com/Adit0507/AdiDB/internal/kv"
+	"github.com/Adit0507/AdiDB/internal/transactions"
+	"github.com/Adit0507/AdiDB/ql"
+	"github.com/Adit0507/AdiDB/table"
+)
+
+type (
+	DB          = table.DB
+	DBTX        = table.DBTX
+	TableDef    = table.TableDef
+	Record      = table.Record
+	Value       = table.Value
+	Scanner     = table.Scanner
+	DBUpdateReq = table.DBUpdateReq
+	Batch       = table.Batch
+	Savepoint   = table.Savepoint
+	Check       = table.Check
+	ForeignKey  = table.ForeignKey
+	Validator   = table.Validator
+	DBStats     = table.DBStats
+	Cond        = table.Cond
+	Plan        = table.Plan
+	MapOptions  = table.MapOptions
+	Rows        = ql.Rows
+	Compressor  = kv.Compressor
+	Metrics     = kv.Metrics
+	// implementations of Compressor and Metrics
+	FlateCompressor  = kv.FlateCompressor
+	Counters         = kv.Counters
+	CountersSnapshot = kv.CountersSnapshot
+	OpStats          = kv.OpStats
+	Metric           = kv.Metric
+	Op               = kv.Op
+)
+
+// the events of Metrics.Count and the operations of Metrics.Time
+const (
+	METRIC_PAGE_READ   = kv.METRIC_PAGE_READ
+	METRIC_PAGE_WRITE  = kv.METRIC_PAGE_WRITE
+	METRIC_PAGE_REUSE  = kv.METRIC_PAGE_REUSE
+	METRIC_PAGE_APPEND = kv.METRIC_PAGE_APPEND
+	METRIC_SPLIT       = kv.METRIC_SPLIT
+	METRIC_MERGE       = kv.METRIC_MERGE
+	METRIC_COMMIT      = kv.METRIC_COMMIT
+	METRIC_FSYNC       = kv.METRIC_FSYNC
+	METRIC_PREFETCH    = kv.METRIC_PREFETCH
+	METRIC_MAX         = kv.METRIC_MAX
+	KV_OP_GET          = kv.KV_OP_GET
+	KV_OP_UPDATE       = kv.KV_OP_UPDATE
+	KV_OP_SCAN         = kv.KV_OP_SCAN
+	KV_OP_MAX          = kv.KV_OP_MAX
+)
+
+// column types of TableDef.Types and Value.Type
+const (
+	TYPE_BYTES     = table.TYPE_BYTES
+	TYPE_INT64     = table.TYPE_INT64
+	TYPE_NULL      = table.TYPE_NULL
+	TYPE_FLOAT64   = table.TYPE_FLOAT64
+	TYPE_BOOL      = table.TYPE_BOOL
+	TYPE_TIMESTAMP = table.TYPE_TIMESTAMP
+	TYPE_JSON      = table.TYPE_JSON
+)
+
+// collations of TableDef.Collations
+const (
+	COLLATE_BINARY = table.COLLATE_BINARY
+	COLLATE_NOCASE = table.COLLATE_NOCASE
+	COLLATE_CUSTOM = table.COLLATE_CUSTOM
+)
+
+// the comparisons of Scanner.Cmp1 and Scanner.Cmp2, and of Cond.Op
+const (
+	COND_EQ = table.COND_EQ
+	CMP_GE  = btree_iter.CMP_GE
+	CMP_GT  = btree_iter.CMP_GT
+	CMP_LT  = btree_iter.CMP_LT
+	CMP_LE  = btree_iter.CMP_LE
+)
+
+// DBUpdateReq.Mode
+const (
+	MODE_UPSERT      = btree.MODE_UPSERT
+	MODE_UPDATE_ONLY = btree.MODE_UPDATE_ONLY
+	MODE_INSERT_ONLY = btree.MODE_INSERT_ONLY
+)
+
+var (
+	ErrTableNotFound   = table.ErrTableNotFound
+	ErrTableExists     = table.ErrTableExists
+	ErrRecordExists    = table.ErrRecordExists
+	ErrRecordNotFound  = table.ErrRecordNotFound
+	ErrBadRange        = table.ErrBadRange
+	ErrCorrupt         = table.ErrCorrupt
+	ErrUniqueViolation = table.ErrUniqueViolation
+	ErrConstraint      = table.ErrConstraint
+	ErrForeignKey      = table.ErrForeignKey
+	ErrConflict        = table.ErrConflict
+	ErrMemoryBudget    = table.ErrMemoryBudget
+	ErrNullValue       = table.ErrNullValue
+	ErrInvalidJSON     = table.ErrInvalidJSON
+	// a commit conflicts with a concurrent one; the TX can be retried
+	ErrTxConflict = transactions.ErrorConflict
+	ErrReadOnly   = transactions.ErrReadOnly
+	ErrChecksum   = kv.ErrChecksum
+	ErrBadFile    = kv.ErrBadFile
+	// the file is not a database, or needs a later version of the engine
+	ErrNotADatabase       = kv.ErrNotADatabase
+	ErrVersionTooNew      = kv.ErrVersionTooNew
+	ErrUnsupportedFeature = kv.ErrUnsupportedFeature
+	// the version of BeginReadAt is older than DB.History
+	ErrHistoryGone = kv.ErrHistoryGone
+	// another DB has the file open for writing; see Options.LockTimeout
+	ErrLocked = kv.ErrLocked
+)
+
+// the options of Open, as the fields of DB with the same names; the zero
+// value is the default for each
+type Options = table.Options
+
+// open or create the file at `path`. `opts` may be nil for the defaults.
+// the DB must be closed.
+func Open(path string, opts *Options) (*DB, error) {
+	if path == "" {
+		return nil, errors.New("adidb.Open: no path")
+	}
+	db := &DB{Path: path}
+	if opts != nil {
+		db.Options = *opts
+	}
+	if err := db.Open(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
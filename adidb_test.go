@@ -0,0 +1,56 @@
+package adidb
+
+import (
+	"os"
+	"testing"
+
+	is "github.com/stretchr/testify/require"
+)
+
+func TestOpen(t *testing.T) {
+	os.Remove("adidb.db")
+	defer os.Remove("adidb.db")
+	_, err := Open("", nil)
+	is.Error(t, err)
+
+	db, err := Open("adidb.db", &Options{CacheSize: 1 << 20, GroupLimit: 10})
+	is.Nil(t, err)
+	is.Equal(t, 10, db.GroupLimit)
+	tx := DBTX{}
+	db.Begin(&tx)
+	is.Nil(t, tx.TableNew(&TableDef{
+		Name:    "users",
+		Cols:    []string{"id", "name"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"id"}},
+	}))
+	for i := int64(1); i <= 3; i++ {
+		_, err := tx.Insert("users", (&Record{}).AddInt64("id", i).AddStr("name", []byte("u")))
+		is.Nil(t, err)
+	}
+	is.Nil(t, db.Commit(&tx))
+	db.Close()
+
+	// the defaults, and the re-exported constants and errors
+	db, err = Open("adidb.db", nil)
+	is.Nil(t, err)
+	defer db.Close()
+	db.BeginRead(&tx)
+	defer db.Abort(&tx)
+	sc := Scanner{
+		Cmp1: CMP_GT, Cmp2: CMP_LE,
+		Key1: *(&Record{}).AddInt64("id", 1),
+		Key2: *(&Record{}).AddInt64("id", 3),
+	}
+	is.Nil(t, tx.Scan("users", &sc))
+	n := 0
+	for ; sc.Valid(); sc.Next() {
+		n++
+	}
+	is.Equal(t, 2, n)
+	_, err = tx.Insert("none", &Record{})
+	is.ErrorIs(t, err, ErrTableNotFound)
+	rec := (&Record{}).AddInt64("id", 4).AddStr("name", []byte("u"))
+	_, err = tx.Set("users", &DBUpdateReq{Record: *rec, Mode: MODE_INSERT_ONLY})
+	is.ErrorIs(t, err, ErrReadOnly)
+}
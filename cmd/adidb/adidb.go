@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/Adit0507/AdiDB/table"
+)
+
+// adidb -shell <path>: commands on stdin, results on stdout
+func main() {
+	shell := flag.Bool("shell", false, "read SQL and dot-commands from stdin")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s -shell <path>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	path := flag.Arg(0)
+	if path != "" {
+		flag.CommandLine.Parse(flag.Args()[1:]) // the flags after the path
+	}
+	if path == "" || flag.NArg() > 0 || !*shell {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	db := &table.DB{Path: path}
+	if err := db.Open(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	sh := &Shell{DB: db, Out: os.Stdout, Prompt: isTerminal(os.Stdin)}
+	err := sh.Run(os.Stdin)
+	if serr := db.Sync(); err == nil {
+		err = serr
+	}
+	db.Close()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// print the prompts only for a human
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
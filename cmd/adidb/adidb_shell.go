@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Adit0507/AdiDB/ql"
+	"github.com/Adit0507/AdiDB/table"
+)
+
+/*
+the interactive shell. a line starting with a dot is a command:
+	.tables            the user tables
+	.schema <table>    the TableDef, as JSON
+	.stats             the file and the row counts
+	.dump <file>       DB.Dump to a file
+	.check             DB.Check
+	.fullscan on|off   let UPDATE and DELETE scan whole tables
+	.help, .quit
+anything else is SQL, up to a `;` at the end of a line: SELECT goes to
+DB.Query, the writes to DB.Exec. the rows are printed as aligned columns.
+a BYTES value is printed as is if it's printable UTF-8, quoted if it's
+UTF-8 with control characters, and as x'hex' otherwise, so a row never
+breaks the terminal or the columns.
+
+an error is printed and the shell goes on; a parse error points at its
+position. the end of the input ends the shell.
+*/
+
+type Shell struct {
+	DB     *table.DB
+	Out    io.Writer
+	Prompt bool // print the prompts
+
+	opts ql.ExecOptions
+}
+
+const (
+	PROMPT      = "adidb> "
+	PROMPT_MORE = "   ...> "
+)
+
+var errQuit = errors.New("quit")
+
+// read and run the commands until the end of `in`
+func (sh *Shell) Run(in io.Reader) error {
+	sc := bufio.NewScanner(in)
+	sc.Buffer(nil, 1<<24)
+	sql := []string{}
+	for {
+		if sh.Prompt {
+			if len(sql) == 0 {
+				io.WriteString(sh.Out, PROMPT)
+			} else {
+				io.WriteString(sh.Out, PROMPT_MORE)
+			}
+		}
+		if !sc.Scan() {
+			break
+		}
+		line := strings.TrimSpace(sc.Text())
+		switch {
+		case line == "" && len(sql) == 0:
+			continue
+		case strings.HasPrefix(line, ".") && len(sql) == 0:
+			err := sh.command(strings.Fields(line))
+			if err == errQuit {
+				return nil
+			}
+			sh.report("", err)
+			continue
+		}
+		sql = append(sql, line)
+		if strings.HasSuffix(line, ";") {
+			stmt := strings.Join(sql, " ")
+			sh.report(stmt, sh.sql(stmt))
+			sql = sql[:0]
+		}
+	}
+	if sh.Prompt {
+		io.WriteString(sh.Out, "\n")
+	}
+	if len(sql) > 0 { // without the `;`
+		stmt := strings.Join(sql, " ")
+		sh.report(stmt, sh.sql(stmt))
+	}
+	return sc.Err()
+}
+
+func (sh *Shell) report(stmt string, err error) {
+	if err == nil {
+		return
+	}
+	perr := (*ql.ParseError)(nil)
+	if errors.As(err, &perr) {
+		fmt.Fprintf(sh.Out, "%s\n%s^\n", stmt, strings.Repeat(" ", utf8.RuneCountInString(stmt[:perr.Pos])))
+	}
+	fmt.Fprintf(sh.Out, "error: %v\n", err)
+}
+
+func (sh *Shell) command(args []string) error {
+	nargs := map[string]int{
+		".tables": 1, ".schema": 2, ".stats": 1, ".dump": 2, ".check": 1,
+		".pages": 1, ".fullscan": 2, ".help": 1, ".quit": 1, ".exit": 1,
+	}
+	if n, ok := nargs[args[0]]; !ok {
+		return fmt.Errorf("unknown command: %s; see .help", args[0])
+	} else if len(args) != n {
+		return fmt.Errorf("usage: %s", shellUsage[args[0]])
+	}
+
+	switch args[0] {
+	case ".tables":
+		tx := table.DBTX{}
+		sh.DB.BeginRead(&tx)
+		names, err := tx.ListTables()
+		sh.DB.Abort(&tx)
+		for _, name := range names {
+			fmt.Fprintln(sh.Out, name)
+		}
+		return err
+	case ".schema":
+		tx := table.DBTX{}
+		sh.DB.BeginRead(&tx)
+		tdef, err := tx.GetTableDef(args[1])
+		sh.DB.Abort(&tx)
+		if err != nil {
+			return err
+		}
+		tdef.Prefixes = nil
+		out, err := json.MarshalIndent(tdef, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(sh.Out, "%s\n", out)
+	case ".stats":
+		return sh.stats()
+	case ".dump":
+		return shellDump(sh.DB, args[1])
+	case ".check":
+		if err := sh.DB.Check(); err != nil {
+			return err
+		}
+		fmt.Fprintln(sh.Out, "ok")
+	case ".pages":
+		return sh.DB.DebugDump(sh.Out, table.DumpOptions{})
+	case ".fullscan":
+		if args[1] != "on" && args[1] != "off" {
+			return fmt.Errorf("usage: %s", shellUsage[args[0]])
+		}
+		sh.opts.AllowFullScan = args[1] == "on"
+	case ".help":
+		names := []string{}
+		for name := range shellUsage {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintln(sh.Out, shellUsage[name])
+		}
+	default:
+		return errQuit
+	}
+	return nil
+}
+
+var shellUsage = map[string]string{
+	".tables":   ".tables            list the tables",
+	".schema":   ".schema <table>    show the schema of a table",
+	".stats":    ".stats             show the file and table statistics",
+	".dump":     ".dump <file>       write the tables to a file as JSON lines",
+	".check":    ".check             verify the file",
+	".pages":    ".pages             print the pages of the file and their keys",
+	".fullscan": ".fullscan on|off   let UPDATE and DELETE scan whole tables",
+	".help":     ".help              show this",
+	".quit":     ".quit              exit; so does the end of the input",
+	".exit":     ".exit              exit",
+}
+
+func (sh *Shell) stats() error {
+	stats, err := sh.DB.Stats()
+	if err != nil {
+		return err
+	}
+	kv := stats.KV
+	tw := tabwriter.NewWriter(sh.Out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "file\t%d bytes\n", kv.FileSize)
+	fmt.Fprintf(tw, "pages\t%d of %d bytes, %d free\n", kv.Pages, kv.PageSize, kv.FreePages)
+	fmt.Fprintf(tw, "tree\theight %d, %d nodes, %d leaves, %d overflow\n",
+		kv.Height, kv.NodePages, kv.LeafPages, kv.OverflowPages)
+	names := []string{}
+	for name := range stats.Tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		t := stats.Tables[name]
+		fmt.Fprintf(tw, "table %s\t%d rows, %d bytes\n", name, t.Rows, t.Bytes)
+	}
+	return tw.Flush()
+}
+
+// the dump is synced, so it's complete when this returns
+func shellDump(db *table.DB, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = db.Dump(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (sh *Shell) sql(stmt string) error {
+	word, _, _ := strings.Cut(strings.TrimLeft(stmt, " \t"), " ")
+	if !strings.EqualFold(word, "select") {
+		n, err := sh.DB.ExecWith(stmt, sh.opts)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(sh.Out, "%d rows affected\n", n)
+		return nil
+	}
+
+	rows, err := sh.DB.Query(stmt)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	tw := tabwriter.NewWriter(sh.Out, 0, 0, 2, ' ', 0)
+	cols := rows.Columns()
+	fmt.Fprintln(tw, strings.Join(cols, "\t"))
+	dashes := make([]string, len(cols))
+	for i, col := range cols {
+		dashes[i] = strings.Repeat("-", utf8.RuneCountInString(col))
+	}
+	fmt.Fprintln(tw, strings.Join(dashes, "\t"))
+	n := 0
+	cells := make([]string, len(cols))
+	for ; rows.Next(); n++ {
+		rec := table.Record{}
+		if err := rows.Scan(&rec); err != nil {
+			return err
+		}
+		for i := range rec.Vals {
+			cells[i] = shellValue(&rec.Vals[i])
+		}
+		fmt.Fprintln(tw, strings.Join(cells, "\t"))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	fmt.Fprintf(sh.Out, "(%d rows)\n", n)
+	return nil
+}
+
+// a value in a cell; see the top
+func shellValue(v *table.Value) string {
+	switch v.Type {
+	case table.TYPE_NULL:
+		return "NULL"
+	case table.TYPE_INT64:
+		return strconv.FormatInt(v.I64, 10)
+	case table.TYPE_BOOL:
+		return strconv.FormatBool(v.I64 != 0)
+	case table.TYPE_FLOAT64:
+		return strconv.FormatFloat(v.F64, 'g', -1, 64)
+	case table.TYPE_TIMESTAMP:
+		return v.Time().Format(time.RFC3339Nano)
+	case table.TYPE_JSON:
+		return string(v.Str)
+	case table.TYPE_BYTES:
+		s := string(v.Str)
+		switch {
+		case !utf8.ValidString(s):
+			return "x'" + hex.EncodeToString(v.Str) + "'"
+		case strings.IndexFunc(s, func(r rune) bool { return !strconv.IsPrint(r) }) >= 0,
+			strings.HasPrefix(s, `"`), strings.HasPrefix(s, "x'"), s == "NULL":
+			return strconv.Quote(s)
+		default:
+			return s
+		}
+	default:
+		return fmt.Sprintf("?%d", v.Type)
+	}
+}
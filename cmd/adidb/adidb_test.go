@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Adit0507/AdiDB/table"
+	is "github.com/stretchr/testify/require"
+)
+
+func TestShell(t *testing.T) {
+	os.Remove("sh.db")
+	os.Remove("sh.dump")
+	db := &table.DB{Path: "sh.db"}
+	is.Nil(t, db.Open())
+	defer os.Remove("sh.db")
+	defer os.Remove("sh.dump")
+	defer db.Close()
+
+	tx := table.DBTX{}
+	db.Begin(&tx)
+	is.Nil(t, tx.TableNew(&table.TableDef{
+		Name:     "users",
+		Cols:     []string{"id", "name", "score"},
+		Types:    []uint32{table.TYPE_INT64, table.TYPE_BYTES, table.TYPE_INT64},
+		Indexes:  [][]string{{"id"}, {"name"}},
+		Nullable: []bool{false, false, true},
+	}))
+	is.Nil(t, db.Commit(&tx))
+
+	run := func(script string) string {
+		out := bytes.Buffer{}
+		sh := &Shell{DB: db, Out: &out}
+		is.Nil(t, sh.Run(strings.NewReader(script)))
+		return out.String()
+	}
+
+	is.Equal(t, "users\n", run(".tables\n"))
+	is.Contains(t, run(".schema users"), `"Name": "users"`)
+	is.Equal(t, "3 rows affected\n", run(`
+		INSERT INTO users (id, name, score)
+		VALUES (1, 'ann', 10), (2, 'bo\tb', NULL),
+			(3, '\xff\x00', 7);
+	`))
+
+	// aligned, with the binary values escaped
+	is.Equal(t, strings.Join([]string{
+		"id  name     score",
+		"--  ----     -----",
+		"1   ann      10",
+		`2   "bo\tb"  NULL`,
+		"3   x'ff00'  7",
+		"(3 rows)",
+		"",
+	}, "\n"), run("SELECT id, name, score FROM users;"))
+	is.Equal(t, "n\n-\n(0 rows)\n", run("select name as n from users where id > 5"))
+
+	// errors don't end the shell
+	out := run(".nope\nSELECT * FRM users;\n.schema\nUPDATE users SET score = 1;\nSELECT id FROM users WHERE id = 1;\n")
+	is.Equal(t, strings.Join([]string{
+		"error: unknown command: .nope; see .help",
+		"SELECT * FRM users;",
+		"         ^",
+		"error: expect `FROM` table at position 9",
+		"error: usage: .schema <table>    show the schema of a table",
+		"error: the WHERE scans the whole table; see ExecOptions.AllowFullScan",
+		"id", "--", "1", "(1 rows)",
+		"",
+	}, "\n"), out)
+	is.Equal(t, "3 rows affected\n", run(".fullscan on\nUPDATE users SET score = 1;\n"))
+
+	out = run(".check\n.stats\n.dump sh.dump\n.quit\n.tables\n")
+	is.True(t, strings.HasPrefix(out, "ok\nfile"), out)
+	is.Contains(t, out, "table users  3 rows")
+	is.NotContains(t, out, "\nusers\n")
+	dump, err := os.ReadFile("sh.dump")
+	is.Nil(t, err)
+	is.True(t, bytes.HasPrefix(dump, []byte(`{"dump":"AdiDB"`)))
+
+	// prompts, and a statement without the `;` at the end
+	is.Equal(t, PROMPT+PROMPT_MORE+PROMPT_MORE+"\n3 rows affected\n", func() string {
+		out := bytes.Buffer{}
+		sh := &Shell{DB: db, Out: &out, Prompt: true}
+		is.Nil(t, sh.Run(strings.NewReader("DELETE FROM users\nWHERE id >= 1")))
+		return out.String()
+	}())
+}
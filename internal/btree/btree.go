@@ -4,12 +4,17 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"slices"
 )
 
 const HEADER = 4
-const BTREE_PAGE_SIZE = 4096
+const BTREE_PAGE_SIZE = 4096 // the default; see BTree.size
+const BTREE_MIN_PAGE_SIZE = 4096
+const BTREE_MAX_PAGE_SIZE = 32768 // an oversized node still fits in 16-bit offsets
+const BTREE_PAGE_RESERVED = 32    // the end of each page is for the checksum or encryption
+const BTREE_NODE_SIZE = BTREE_PAGE_SIZE - BTREE_PAGE_RESERVED
 const BTREE_MAX_KEY_SIZE = 1000
-const BTREE_MAX_VAL_SIZE = 3000
+const BTREE_MAX_VAL_SIZE = 3000 // larger values go to overflow pages
 
 func assert(cond bool) {
 	if !cond {
@@ -19,7 +24,7 @@ func assert(cond bool) {
 
 func init() {
 	node1max := HEADER + 8 + 2 + 4 + BTREE_MAX_KEY_SIZE + BTREE_MAX_VAL_SIZE
-	assert(node1max <= BTREE_PAGE_SIZE)
+	assert(node1max <= BTREE_NODE_SIZE)
 }
 
 // in memory data type
@@ -27,9 +32,27 @@ type BNode []byte
 
 type BTree struct {
 	root uint64
+	size int                 // page size in bytes; 0 for BTREE_PAGE_SIZE
 	get  func(uint64) []byte // dereferecne a pointer -- reads a page from disk
 	new  func([]byte) uint64 //alocates & writes a new page
 	del  func(uint64)        //delocate page
+	// hints pages that a scan reads next; nil for none. see BIter.SetPrefetch
+	prefetch func(ptrs []uint64)
+	// nodes split and merged by updates, for metrics; see KV.Metrics
+	Splits uint64
+	Merges uint64
+}
+
+func (tree *BTree) pageSize() int {
+	if tree.size == 0 {
+		return BTREE_PAGE_SIZE
+	}
+	return tree.size
+}
+
+// the usable part of a page
+func (tree *BTree) nodeSize() uint16 {
+	return uint16(tree.pageSize() - BTREE_PAGE_RESERVED)
 }
 
 const (
@@ -38,7 +61,7 @@ const (
 )
 
 func (node BNode) btype() uint16 {
-	return binary.LittleEndian.Uint16(node[0:2])
+	return binary.LittleEndian.Uint16(node[0:2]) &^ BNODE_PREFIX
 }
 
 func (node BNode) nkeys() uint16 {
@@ -53,13 +76,13 @@ func (node BNode) setHeader(btype uint16, nkeys uint16) {
 // pointers
 func (node BNode) getPtr(idx uint16) uint64 {
 	assert(idx < node.nkeys())
-	pos := HEADER + 8*idx
+	pos := node.hdrSize() + 8*idx
 	return binary.LittleEndian.Uint64(node[pos:])
 }
 
 func (node BNode) setPtr(idx uint16, val uint64) {
 	assert(idx < node.nkeys())
-	pos := HEADER + 8*idx
+	pos := node.hdrSize() + 8*idx
 	binary.LittleEndian.PutUint64(node[pos:], val)
 }
 
@@ -67,7 +90,7 @@ func (node BNode) setPtr(idx uint16, val uint64) {
 func offsetPos(node BNode, idx uint16) uint16 {
 	assert(1 <= idx && idx <= node.nkeys())
 
-	return HEADER + 8*node.nkeys() + 2*(idx-1)
+	return node.hdrSize() + 8*node.nkeys() + 2*(idx-1)
 }
 
 func (node BNode) getOffset(idx uint16) uint16 {
@@ -85,21 +108,32 @@ func (node BNode) setOffset(idx uint16, offset uint16) {
 func (node BNode) kvPos(idx uint16) uint16 {
 	assert(idx <= node.nkeys())
 
-	return HEADER + 8*node.nkeys() + 2*node.nkeys() + node.getOffset(idx)
+	return node.hdrSize() + 8*node.nkeys() + 2*node.nkeys() + node.getOffset(idx)
 }
 
+// the full key; see btree_prefix.go
 func (node BNode) getKey(idx uint16) []byte {
+	key := node.rawKey(idx)
+	if prefix := node.prefix(); len(prefix) > 0 {
+		return slices.Concat(prefix, key)
+	}
+	return key
+}
+
+// the stored key, without the node prefix
+func (node BNode) rawKey(idx uint16) []byte {
 	assert(idx < node.nkeys())
 	pos := node.kvPos(idx)
 	klen := binary.LittleEndian.Uint16(node[pos:])
 
 	return node[pos+4:][:klen]
 }
+// the stored value, which is a pointer record for overflow values
 func (node BNode) getVal(idx uint16) []byte {
 	assert(idx < node.nkeys())
 	pos := node.kvPos(idx)
 	klen := binary.LittleEndian.Uint16(node[pos+0:])
-	vlen := binary.LittleEndian.Uint16(node[pos+2:])
+	vlen := binary.LittleEndian.Uint16(node[pos+2:]) &^ VLEN_OVERFLOW
 	return node[pos+4+klen:][:vlen]
 }
 
@@ -110,9 +144,20 @@ func (node BNode) nbytes() uint16 {
 func nodeLookupLE(node BNode, key []byte) uint16 {
 	nkeys := node.nkeys()
 	found := uint16(0)
+	if prefix := node.prefix(); len(prefix) > 0 {
+		// a key without the prefix is before or after all keys
+		n := min(len(key), len(prefix))
+		switch cmp := bytes.Compare(key[:n], prefix[:n]); {
+		case cmp > 0:
+			return nkeys - 1
+		case cmp < 0 || n < len(prefix):
+			return 0
+		}
+		key = key[n:]
+	}
 
 	for i := uint16(1); i < nkeys; i++ {
-		cmp := bytes.Compare(node.getKey(i), key)
+		cmp := bytes.Compare(node.rawKey(i), key)
 		if cmp <= 0 {
 			found = i
 		}
@@ -125,15 +170,22 @@ func nodeLookupLE(node BNode, key []byte) uint16 {
 
 // copies a KV pair
 func nodeAppendKV(new BNode, idx uint16, ptr uint64, key []byte, val []byte) {
+	nodeAppendKV2(new, idx, ptr, nil, key, val)
+}
+
+// copies a KV pair whose stored key is in 2 parts
+func nodeAppendKV2(new BNode, idx uint16, ptr uint64, key1 []byte, key2 []byte, val []byte) {
 	new.setPtr(idx, ptr)
 
+	klen := uint16(len(key1) + len(key2))
 	pos := new.kvPos(idx)
-	binary.LittleEndian.PutUint16(new[pos+0:], uint16(len(key)))
+	binary.LittleEndian.PutUint16(new[pos+0:], klen)
 	binary.LittleEndian.PutUint16(new[pos+2:], uint16(len(val)))
-	copy(new[pos+4:], key)
-	copy(new[pos+4+uint16(len(key)):], val)
+	copy(new[pos+4:], key1)
+	copy(new[pos+4+uint16(len(key1)):], key2)
+	copy(new[pos+4+klen:], val)
 
-	new.setOffset(idx+1, new.getOffset(idx)+4+uint16((len(key)+len(val))))
+	new.setOffset(idx+1, new.getOffset(idx)+4+klen+uint16(len(val)))
 }
 
 // copies multiple KV's into posiiton from old node
@@ -144,8 +196,18 @@ func nodeAppendRange(new BNode, old BNode, dstNew uint16, srcOld uint16, n uint1
 		return
 	}
 
+	// the keys are rewritten for a different prefix
+	if plen := len(new.prefix()); plen > 0 || len(old.prefix()) > 0 {
+		for i := uint16(0); i < n; i++ {
+			key1, key2 := keyParts(old, srcOld+i, plen)
+			nodeAppendKV2(new, dstNew+i, old.getPtr(srcOld+i), key1, key2, old.getVal(srcOld+i))
+			new.setOverflow(dstNew+i, old.isOverflow(srcOld+i))
+		}
+		return
+	}
+
 	for i := uint16(0); i < n; i++ {
-		new.setPtr(dstNew+i, old.getPtr(srcOld+1))
+		new.setPtr(dstNew+i, old.getPtr(srcOld+i))
 	}
 
 	dstBegin := new.getOffset(dstNew)
@@ -184,7 +246,7 @@ func nodeReplaceKid1ptr(new BNode, old BNode, idx uint16, ptr uint64) {
 func nodeReplaceKidN(tree *BTree, new BNode, old BNode, idx uint16, kids ...BNode) {
 	inc := uint16(len(kids))
 	if inc == 1 && bytes.Equal(kids[0].getKey(0), old.getKey(idx)) {
-		nodeReplaceKid1ptr(new, old, idx, tree.new(kids[0]))
+		nodeReplaceKid1ptr(new, old, idx, tree.newNode(kids[0]))
 		return
 	}
 
@@ -192,64 +254,53 @@ func nodeReplaceKidN(tree *BTree, new BNode, old BNode, idx uint16, kids ...BNod
 	nodeAppendRange(new, old, 0, 0, idx)
 
 	for i, node := range kids {
-		nodeAppendKV(new, idx+uint16(i), tree.new(node), node.getKey(0), nil)
+		nodeAppendKV(new, idx+uint16(i), tree.newNode(node), node.getKey(0), nil)
 	}
 	nodeAppendRange(new, old, idx+inc, idx+1, old.nkeys()-(idx+1))
 }
 
-// split a big node into 2
-func nodeSplit2(left BNode, right BNode, old BNode) {
-	assert(old.nkeys() >= 2)
-
-	nleft := old.nkeys() / 2
-
-	left_bytes := func() uint16 {
-		return HEADER + 8*nleft + 2*nleft + old.getOffset(nleft)
+// a balanced split of KVs [lo, hi) into 2 nodes; false if they don't fit
+func nodeSplit2(tree *BTree, old BNode, lo uint16, hi uint16) (uint16, bool) {
+	// the longest left node, and the longest right node
+	left, right := lo+1, hi-1
+	for left+1 < hi && nodeRangeFits(tree, old, lo, left+1) {
+		left++
 	}
-
-	for left_bytes() > BTREE_PAGE_SIZE {
-		nleft--
+	for right-1 > lo && nodeRangeFits(tree, old, right-1, hi) {
+		right--
 	}
-	assert(nleft >= 1)
-
-	right_bytes := func() uint16 {
-		return old.nbytes() - left_bytes() + HEADER
-	}
-	for right_bytes() > BTREE_PAGE_SIZE {
-		nleft++
+	if !nodeRangeFits(tree, old, lo, left) || !nodeRangeFits(tree, old, right, hi) ||
+		right > left {
+		return 0, false
 	}
-	assert(nleft < old.nkeys())
-	nright := old.nkeys() - nleft
-
-	left.setHeader(old.btype(), nleft)
-	right.setHeader(old.btype(), nright)
-	nodeAppendRange(left, old, 0, 0, nleft)
-	nodeAppendRange(right, old, 0, nleft, nright)
-
-	assert(right.nbytes() <= BTREE_PAGE_SIZE)
+	return min(max((lo+hi)/2, right), left), true
 }
 
-// splits an oversized node
-func nodeSplit3(old BNode) (uint16, [3]BNode) {
-	if old.nbytes() <= BTREE_PAGE_SIZE {
-		old = old[:BTREE_PAGE_SIZE]
-		return 1, [3]BNode{old} //wont split
+// splits an oversized node. the sizes are of the compacted nodes, so a
+// node can be split in 3 by a key that doesn't share the prefix.
+func nodeSplit3(tree *BTree, old BNode) (uint16, [3]BNode) {
+	n := old.nkeys()
+	if nodeRangeFits(tree, old, 0, n) {
+		return 1, [3]BNode{nodeCompact(tree, old, 0, n)} //wont split
 	}
 
-	left := BNode(make([]byte, 2*BTREE_PAGE_SIZE))
-	right := BNode(make([]byte, BTREE_PAGE_SIZE))
-	nodeSplit2(left, right, old)
-
-	if left.nbytes() <= BTREE_PAGE_SIZE {
-		left = left[:BTREE_PAGE_SIZE]
+	tree.Splits++
+	if mid, ok := nodeSplit2(tree, old, 0, n); ok {
+		left := nodeCompact(tree, old, 0, mid)
+		right := nodeCompact(tree, old, mid, n)
 		return 2, [3]BNode{left, right}
 	}
 
-	mostLeft := BNode(make([]byte, BTREE_PAGE_SIZE))
-	middle := BNode(make([]byte, BTREE_PAGE_SIZE))
-	nodeSplit2(mostLeft, middle, left)
-	assert(mostLeft.nbytes() <= BTREE_PAGE_SIZE)
-
+	// the longest left node, then the rest in 2
+	first := uint16(1)
+	for nodeRangeFits(tree, old, 0, first+1) {
+		first++
+	}
+	mid, ok := nodeSplit2(tree, old, first, n)
+	assert(ok)
+	mostLeft := nodeCompact(tree, old, 0, first)
+	middle := nodeCompact(tree, old, first, mid)
+	right := nodeCompact(tree, old, mid, n)
 	return 3, [3]BNode{mostLeft, middle, right}
 }
 
@@ -277,20 +328,30 @@ type DeleteReq struct {
 
 // tree insertion- inserts a KV into a node
 func treeInsert(req *UpdateReq, node BNode) BNode {
-	new := BNode(make([]byte, 2*BTREE_PAGE_SIZE))
+	new := nodeBuf(req.tree, node)
 
 	idx := nodeLookupLE(node, req.Key)
 	switch node.btype() {
 	case BNODE_LEAF:
 		if bytes.Equal(req.Key, node.getKey(idx)) {
+			if bytes.Equal(req.Val, nodeGetVal(req.tree, node, idx)) {
+				return BNode{} // nothing changed
+			}
+			if node.isOverflow(idx) {
+				overflowFree(req.tree, node.getVal(idx))
+			}
 			// updating the key
-			leafUpdate(new, node, idx, req.Key, req.Val)
+			val, overflow := leafVal(req.tree, req.Val)
+			leafUpdate(new, node, idx, req.Key, val)
+			new.setOverflow(idx, overflow)
 		} else {
-			leafInsert(new, node, idx+1, req.Key, req.Val)
+			val, overflow := leafVal(req.tree, req.Val)
+			leafInsert(new, node, idx+1, req.Key, val)
+			new.setOverflow(idx+1, overflow)
 		}
 
 	case BNODE_NODE:
-		nodeInsert(req, new, node, idx)
+		return nodeInsert(req, new, node, idx)
 	default:
 		panic("bad node!")
 	}
@@ -308,7 +369,7 @@ func nodeInsert(req *UpdateReq, new BNode, node BNode, idx uint16) BNode {
 		return BNode{}
 	}
 
-	nsplit, split := nodeSplit3(updated)
+	nsplit, split := nodeSplit3(req.tree, updated)
 	// deallocate kid node
 	req.tree.del(kptr)
 	nodeReplaceKidN(req.tree, new, node, idx, split[:nsplit]...)
@@ -316,17 +377,21 @@ func nodeInsert(req *UpdateReq, new BNode, node BNode, idx uint16) BNode {
 	return new
 }
 
+var (
+	ErrEmptyKey   = errors.New("empty key")
+	ErrKeyTooLong = errors.New("key too long")
+	ErrKeyExists  = errors.New("key exists") // for a bulk load
+)
+
 func checkLimit(key []byte, val []byte) error {
 	if len(key) == 0 {
-		return errors.New("empty key")
+		return ErrEmptyKey
 	}
 
 	if len(key) > BTREE_MAX_KEY_SIZE {
-		return errors.New("key too long")
-	}
-	if len(key) > BTREE_MAX_VAL_SIZE {
-		return errors.New("value too long")
+		return ErrKeyTooLong
 	}
+	// values of any size can be stored in overflow pages
 
 	return nil
 }
@@ -347,29 +412,39 @@ func leafDelete(new BNode, old BNode, idx uint16) {
 }
 
 // mergin 2 nodes into 1
-func nodeMerge(new BNode, left BNode, right BNode) {
+func nodeMerge(tree *BTree, new BNode, left BNode, right BNode) {
+	tree.Merges++
 	new.setHeader(left.btype(), left.nkeys()+right.nkeys())
 	nodeAppendRange(new, left, 0, 0, left.nkeys())
 	nodeAppendRange(new, right, left.nkeys(), 0, right.nkeys())
-	assert(new.nbytes() <= BTREE_PAGE_SIZE)
+	assert(nodeRangeFits(tree, new, 0, new.nkeys()))
+}
+
+// the 2 nodes fit in 1 when compacted
+func mergeFits(tree *BTree, left BNode, right BNode) bool {
+	_, raw1 := nodeRangeSize(left, 0, left.nkeys())
+	_, raw2 := nodeRangeSize(right, 0, right.nkeys())
+	n := int(left.nkeys() + right.nkeys())
+	raw := raw1 + raw2 - HEADER
+	p := lcpLen(left.getKey(0), right.getKey(right.nkeys()-1))
+	size := min(raw, raw+2+p-n*p)
+	return size <= int(tree.nodeSize()) && raw <= BTREE_MAX_RAW_SIZE
 }
 
 func shouldMerge(tree *BTree, node BNode, idx uint16, updated BNode) (int, BNode) {
-	if updated.nbytes() > BTREE_PAGE_SIZE/4 {
+	if size, _ := nodeRangeSize(updated, 0, updated.nkeys()); size > int(tree.nodeSize())/4 {
 		return 0, BNode{}
 	}
 	if idx > 0 {
 		sibling := BNode(tree.get(node.getPtr(idx - 1)))
-		merged := sibling.nbytes() + updated.nbytes() - HEADER
-		if merged <= BTREE_PAGE_SIZE {
+		if updated.nkeys() == 0 || mergeFits(tree, sibling, updated) {
 			return -1, sibling //left
 		}
 	}
 
 	if idx+1 < node.nkeys() {
 		sibling := BNode(tree.get(node.getPtr(idx + 1)))
-		merged := sibling.nbytes() + updated.nbytes() - HEADER
-		if merged <= BTREE_PAGE_SIZE {
+		if updated.nkeys() == 0 || mergeFits(tree, updated, sibling) {
 			return +1, sibling // right
 		}
 	}
@@ -386,8 +461,11 @@ func treeDelete(req *DeleteReq, node BNode) BNode {
 			return BNode{} // not found
 		}
 		// delete the key in the leaf
-		req.Old = node.getVal(idx)
-		new := BNode(make([]byte, BTREE_PAGE_SIZE))
+		req.Old = nodeGetVal(req.tree, node, idx)
+		if node.isOverflow(idx) {
+			overflowFree(req.tree, node.getVal(idx))
+		}
+		new := nodeBuf(req.tree, node)
 		leafDelete(new, node, idx)
 		return new
 	case BNODE_NODE:
@@ -407,26 +485,28 @@ func nodeDelete(req *DeleteReq, node BNode, idx uint16) BNode {
 	}
 	tree.del(kptr)
 
-	new := BNode(make([]byte, BTREE_PAGE_SIZE))
+	new := nodeBuf(tree, node)
 
 	mergeDir, sibling := shouldMerge(tree, node, idx, updated)
 	switch {
 	case mergeDir < 0:
-		merged := BNode(make([]byte, BTREE_PAGE_SIZE))
-		nodeMerge(merged, sibling, updated)
+		merged := nodeBuf(tree, sibling, updated)
+		nodeMerge(tree, merged, sibling, updated)
 		tree.del(node.getPtr(idx - 1))
-		nodeReplace2Kid(new, node, idx-1, tree.new(merged), merged.getKey(0))
+		nodeReplace2Kid(new, node, idx-1, tree.newNode(merged), merged.getKey(0))
 	case mergeDir > 0:
-		merged := BNode(make([]byte, BTREE_PAGE_SIZE))
-		nodeMerge(merged, updated, sibling)
+		merged := nodeBuf(tree, updated, sibling)
+		nodeMerge(tree, merged, updated, sibling)
 		tree.del(node.getPtr(idx + 1))
-		nodeReplace2Kid(new, node, idx, tree.new(merged), merged.getKey(0))
+		nodeReplace2Kid(new, node, idx, tree.newNode(merged), merged.getKey(0))
 
 	case mergeDir == 0 && updated.nkeys() == 0:
 		assert(node.nkeys() == 1 && idx == 0)
 		new.setHeader(BNODE_NODE, 0)
 	case mergeDir == 0 && updated.nkeys() > 0: // no merge
-		nodeReplaceKidN(tree, new, node, idx, updated)
+		// a new 1st key may not share the prefix
+		nsplit, split := nodeSplit3(tree, updated)
+		nodeReplaceKidN(tree, new, node, idx, split[:nsplit]...)
 	}
 
 	return new
@@ -443,12 +523,14 @@ func (tree *BTree) Update(req *UpdateReq) (bool, error) {
 
 	if tree.root == 0 {
 		// create first node
-		root := BNode(make([]byte, BTREE_PAGE_SIZE))
+		root := BNode(make([]byte, tree.pageSize()))
 		root.setHeader(BNODE_LEAF, 2)
 
+		val, overflow := leafVal(tree, req.Val)
 		nodeAppendKV(root, 0, 0, nil, nil)
-		nodeAppendKV(root, 1, 0, req.Key, req.Val)
-		tree.root = tree.new(root)
+		nodeAppendKV(root, 1, 0, req.Key, val)
+		root.setOverflow(1, overflow)
+		tree.root = tree.newNode(root)
 		req.Added = true
 		req.Updated = true
 		return true, nil
@@ -460,21 +542,25 @@ func (tree *BTree) Update(req *UpdateReq) (bool, error) {
 		return false, nil
 	}
 
-	nsplit, split := nodeSplit3(updated)
 	tree.del(tree.root)
+	treeNewRoot(tree, updated)
+	return true, nil
+}
+
+// replace the root with an updated node, which may be split
+func treeNewRoot(tree *BTree, updated BNode) {
+	nsplit, split := nodeSplit3(tree, updated)
 	if nsplit > 1 {
-		root := BNode(make([]byte, BTREE_PAGE_SIZE))
+		root := BNode(make([]byte, tree.pageSize()))
 		root.setHeader(BNODE_NODE, nsplit)
 		for i, knode := range split[:nsplit] {
-			ptr, key := tree.new(knode), knode.getKey(0)
+			ptr, key := tree.newNode(knode), knode.getKey(0)
 			nodeAppendKV(root, uint16(i), ptr, key, nil)
 		}
-		tree.root = tree.new(root)
+		tree.root = tree.newNode(root)
 	} else {
-		tree.root = tree.new(split[0])
+		tree.root = tree.newNode(split[0])
 	}
-
-	return true, nil
 }
 
 func (tree *BTree) Delete(req *DeleteReq) (bool, error) {
@@ -496,7 +582,7 @@ func (tree *BTree) Delete(req *DeleteReq) (bool, error) {
 	if updated.btype() == BNODE_NODE && updated.nkeys() == 1 {
 		tree.root = updated.getPtr(0)
 	} else {
-		tree.root = tree.new(updated)
+		treeNewRoot(tree, updated)
 	}
 
 	return true, nil
@@ -506,8 +592,8 @@ func nodeGetKey(tree *BTree, node BNode, key []byte) ([]byte, bool) {
 	idx := nodeLookupLE(node, key)
 	switch node.btype() {
 	case BNODE_LEAF:
-		if bytes.Equal(key, node.getKey(idx)) {
-			return node.getVal(idx), true
+		if node.keyEqual(idx, key) {
+			return nodeGetVal(tree, node, idx), true
 		} else {
 			return nil, false
 		}
@@ -0,0 +1,147 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+)
+
+/*
+a bulk load builds the tree bottom-up instead of inserting key by key.
+the KVs are appended to the leaves from left to right, and a node is
+finished when it reaches the fill factor. a finished node adds its first
+key to the unfinished node of the level above, so each level is a sorted
+stream of KVs like the leaves. every page is written once.
+
+the existing KVs are merged with the input, so the whole tree is
+rewritten; it pays off for inputs that are large compared to the tree.
+*/
+
+const BTREE_BULK_FILL = 90 // percent of a node filled by a bulk load
+
+type bulkKV struct {
+	ptr      uint64
+	key      []byte
+	val      []byte
+	overflow bool // the value is a pointer record
+}
+
+type bulkBuilder struct {
+	tree   *BTree
+	limit  int        // node size at the fill factor
+	levels [][]bulkKV // the unfinished node of each level, leaves first
+	sizes  []int      // of the unfinished nodes without the prefix
+}
+
+func (b *bulkBuilder) add(level int, kv bulkKV) {
+	if level == len(b.levels) {
+		b.levels = append(b.levels, nil)
+		b.sizes = append(b.sizes, HEADER)
+	}
+	size := 8 + 2 + 4 + len(kv.key) + len(kv.val)
+	if kvs := b.levels[level]; len(kvs) > 0 {
+		// the compacted size; see nodeRangeSize
+		n, raw := len(kvs)+1, b.sizes[level]+size
+		p := lcpLen(kvs[0].key, kv.key)
+		if min(raw, raw+2+p-n*p) > b.limit || raw > BTREE_MAX_RAW_SIZE {
+			b.flush(level)
+		}
+	}
+	b.levels[level] = append(b.levels[level], kv)
+	b.sizes[level] += size
+}
+
+// finish the node of a level
+func (b *bulkBuilder) flush(level int) {
+	kvs := b.levels[level]
+	node := BNode(make([]byte, max(b.sizes[level], b.tree.pageSize())))
+	if level == 0 {
+		node.setHeader(BNODE_LEAF, uint16(len(kvs)))
+	} else {
+		node.setHeader(BNODE_NODE, uint16(len(kvs)))
+	}
+	for i, kv := range kvs {
+		nodeAppendKV(node, uint16(i), kv.ptr, kv.key, kv.val)
+		node.setOverflow(uint16(i), kv.overflow)
+	}
+	b.levels[level], b.sizes[level] = nil, HEADER
+	b.add(level+1, bulkKV{ptr: b.tree.newNode(node), key: kvs[0].key})
+}
+
+// finish all levels. returns the root.
+func (b *bulkBuilder) finish() uint64 {
+	for level := 0; ; level++ {
+		if level > 0 && len(b.levels[level]) == 1 && level == len(b.levels)-1 {
+			return b.levels[level][0].ptr // a single node below
+		}
+		b.flush(level)
+	}
+}
+
+// merge KVs in strictly ascending order into the tree. keys must not exist
+// yet. returns the number of added keys. the tree is partly rebuilt on
+// error, so the caller discards the updates.
+func treeBulkLoad(tree *BTree, next func() ([]byte, []byte, bool)) (int, error) {
+	b := &bulkBuilder{tree: tree, limit: int(tree.nodeSize()) * BTREE_BULK_FILL / 100}
+	count := 0
+	var prev []byte
+	key, val, ok := next()
+	// add the input before `stop`; nil for all
+	input := func(stop []byte) error {
+		for ; ok && (stop == nil || bytes.Compare(key, stop) < 0); key, val, ok = next() {
+			if err := checkLimit(key, val); err != nil {
+				return err
+			}
+			if prev != nil && bytes.Compare(prev, key) >= 0 {
+				return errors.New("keys are not in ascending order")
+			}
+			prev = slices.Clone(key)
+			ref, overflow := leafVal(tree, val)
+			b.add(0, bulkKV{key: prev, val: slices.Clone(ref), overflow: overflow})
+			count++
+		}
+		if ok && bytes.Equal(key, stop) {
+			return ErrKeyExists
+		}
+		return nil
+	}
+
+	if tree.root == 0 {
+		b.add(0, bulkKV{key: []byte{}}) // the dummy empty key
+	} else if err := bulkMerge(tree, b, tree.root, input); err != nil {
+		return count, err
+	}
+	if err := input(nil); err != nil {
+		return count, err
+	}
+	if tree.root != 0 || count > 0 {
+		tree.root = b.finish()
+	}
+	return count, nil
+}
+
+// copy the old KVs in order and free the old nodes. overflow pages are kept.
+func bulkMerge(tree *BTree, b *bulkBuilder, ptr uint64, input func([]byte) error) error {
+	node := BNode(tree.get(ptr))
+	for i := uint16(0); i < node.nkeys(); i++ {
+		if node.btype() == BNODE_NODE {
+			if err := bulkMerge(tree, b, node.getPtr(i), input); err != nil {
+				return err
+			}
+			continue
+		}
+		key := node.getKey(i)
+		if len(key) > 0 { // the dummy empty key is the first
+			if err := input(key); err != nil {
+				return err
+			}
+		}
+		b.add(0, bulkKV{
+			key:      slices.Clone(key),
+			val:      slices.Clone(node.getVal(i)),
+			overflow: node.isOverflow(i),
+		})
+	}
+	tree.del(ptr)
+	return nil
+}
@@ -0,0 +1,58 @@
+package btree
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// check the layout of a node read from a page, so that the node
+// accessors stay within the page. key ordering is left to the caller.
+func nodeCheck(tree *BTree, node BNode) error {
+	size := int(tree.nodeSize())
+	btype := node.btype()
+	if btype != BNODE_NODE && btype != BNODE_LEAF {
+		return fmt.Errorf("bad node type: %d", btype)
+	}
+	nkeys := int(node.nkeys())
+	if nkeys == 0 {
+		return fmt.Errorf("empty node")
+	}
+	hdr := HEADER
+	if binary.LittleEndian.Uint16(node[0:2])&BNODE_PREFIX != 0 {
+		hdr += 2 + int(binary.LittleEndian.Uint16(node[4:6]))
+	}
+	base := hdr + 10*nkeys // pointers and offsets
+	if base > size {
+		return fmt.Errorf("too many keys: %d", nkeys)
+	}
+
+	pos := base
+	for i := 0; i <= nkeys; i++ {
+		if base+int(node.getOffset(uint16(i))) != pos {
+			return fmt.Errorf("bad offset: %d", i)
+		}
+		if i == nkeys {
+			break
+		}
+		if pos+4 > size {
+			return fmt.Errorf("KV out of the page: %d", i)
+		}
+		klen := int(binary.LittleEndian.Uint16(node[pos:]))
+		vlen := binary.LittleEndian.Uint16(node[pos+2:])
+		switch {
+		case btype == BNODE_NODE && vlen != 0:
+			return fmt.Errorf("value in an internal node: %d", i)
+		case vlen&VLEN_OVERFLOW != 0 && vlen != VLEN_OVERFLOW|16:
+			return fmt.Errorf("bad overflow record: %d", i)
+		}
+		pos += 4 + klen + int(vlen&^VLEN_OVERFLOW)
+		if pos > size {
+			return fmt.Errorf("KV out of the page: %d", i)
+		}
+	}
+	// the node is expanded in memory
+	if _, raw := nodeRangeSize(node, 0, uint16(nkeys)); raw > BTREE_MAX_RAW_SIZE {
+		return fmt.Errorf("keys too long without the prefix")
+	}
+	return nil
+}
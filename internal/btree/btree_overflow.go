@@ -0,0 +1,85 @@
+package btree
+
+import "encoding/binary"
+
+/*
+values larger than BTREE_MAX_VAL_SIZE are stored in a chain of pages.
+the leaf holds a pointer record instead and flags it in the value length.
+
+pointer record: | size | first page |
+                |  8B  |     8B     |
+
+overflow page:  | next | data... |
+                |  8B  |         |
+*/
+const VLEN_OVERFLOW = 1 << 15 // page offsets never use the top bit
+
+// the data in an overflow page
+func (tree *BTree) overflowSize() int {
+	return int(tree.nodeSize()) - 8
+}
+
+func (node BNode) isOverflow(idx uint16) bool {
+	assert(idx < node.nkeys())
+	pos := node.kvPos(idx)
+	return binary.LittleEndian.Uint16(node[pos+2:])&VLEN_OVERFLOW != 0
+}
+
+func (node BNode) setOverflow(idx uint16, overflow bool) {
+	if overflow {
+		pos := node.kvPos(idx)
+		vlen := binary.LittleEndian.Uint16(node[pos+2:])
+		binary.LittleEndian.PutUint16(node[pos+2:], vlen|VLEN_OVERFLOW)
+	}
+}
+
+// the value to store in a leaf; spills large values to overflow pages
+func leafVal(tree *BTree, val []byte) ([]byte, bool) {
+	if len(val) <= BTREE_MAX_VAL_SIZE {
+		return val, false
+	}
+
+	// written backwards so that each page knows the next one
+	next := uint64(0)
+	data := tree.overflowSize()
+	npages := (len(val) + data - 1) / data
+	for i := npages - 1; i >= 0; i-- {
+		page := make([]byte, tree.pageSize())
+		binary.LittleEndian.PutUint64(page[0:8], next)
+		copy(page[8:8+data], val[i*data:])
+		next = tree.new(page)
+	}
+
+	ref := make([]byte, 16)
+	binary.LittleEndian.PutUint64(ref[0:8], uint64(len(val)))
+	binary.LittleEndian.PutUint64(ref[8:16], next)
+	return ref, true
+}
+
+// the full value of a leaf KV
+func nodeGetVal(tree *BTree, node BNode, idx uint16) []byte {
+	if !node.isOverflow(idx) {
+		return node.getVal(idx)
+	}
+
+	ref := node.getVal(idx)
+	size := binary.LittleEndian.Uint64(ref[0:8])
+	val := make([]byte, 0, size)
+	for ptr := binary.LittleEndian.Uint64(ref[8:16]); ptr != 0; {
+		page := tree.get(ptr)
+		n := min(size-uint64(len(val)), uint64(tree.overflowSize()))
+		val = append(val, page[8:8+n]...)
+		ptr = binary.LittleEndian.Uint64(page[0:8])
+	}
+	assert(uint64(len(val)) == size)
+	return val
+}
+
+// return the overflow pages of a pointer record to the tree
+func overflowFree(tree *BTree, ref []byte) {
+	for ptr := binary.LittleEndian.Uint64(ref[8:16]); ptr != 0; {
+		next := binary.LittleEndian.Uint64(tree.get(ptr)[0:8])
+		tree.del(ptr)
+		ptr = next
+	}
+}
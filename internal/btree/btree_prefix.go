@@ -0,0 +1,123 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+/*
+key prefix compression. the common prefix of the keys in a node is stored
+once after the header, and the KVs only hold the rest of the keys:
+| type | nkeys | plen | prefix | pointers | offsets | KVs |
+|  2B  |   2B  |  2B  |        |
+the layout is flagged by BNODE_PREFIX in the type, so nodes without it
+are read as before.
+
+nodes are built without the prefix in memory, and compacted when they are
+allocated by BTree.newNode. a node is split by its compacted size, so a
+page holds more keys that share a prefix. the size without the prefix is
+still bounded by BTREE_MAX_RAW_SIZE to keep the 16-bit offsets in memory.
+*/
+
+const BNODE_PREFIX = 0x8000 // a flag in the node type
+
+// a node in memory, without the prefix, plus a new KV or 2 internal keys
+const BTREE_MAX_RAW_SIZE = 60000
+
+// the stored prefix; nil without BNODE_PREFIX
+func (node BNode) prefix() []byte {
+	if binary.LittleEndian.Uint16(node[0:2])&BNODE_PREFIX == 0 {
+		return nil
+	}
+	plen := binary.LittleEndian.Uint16(node[4:6])
+	return node[6:][:plen]
+}
+
+// the full key equals `key`, without building it like getKey
+func (node BNode) keyEqual(idx uint16, key []byte) bool {
+	prefix := node.prefix()
+	return bytes.HasPrefix(key, prefix) && bytes.Equal(key[len(prefix):], node.rawKey(idx))
+}
+
+// must be called after setHeader and before adding KVs
+func (node BNode) setPrefix(prefix []byte) {
+	btype := binary.LittleEndian.Uint16(node[0:2])
+	binary.LittleEndian.PutUint16(node[0:2], btype|BNODE_PREFIX)
+	binary.LittleEndian.PutUint16(node[4:6], uint16(len(prefix)))
+	copy(node[6:], prefix)
+}
+
+// the header and the prefix
+func (node BNode) hdrSize() uint16 {
+	if binary.LittleEndian.Uint16(node[0:2])&BNODE_PREFIX == 0 {
+		return HEADER
+	}
+	return HEADER + 2 + binary.LittleEndian.Uint16(node[4:6])
+}
+
+// the length of the common prefix
+func lcpLen(a []byte, b []byte) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// the key of a KV without the first `skip` bytes, as 2 parts
+func keyParts(node BNode, idx uint16, skip int) ([]byte, []byte) {
+	prefix, key := node.prefix(), node.rawKey(idx)
+	if skip >= len(prefix) {
+		return nil, key[skip-len(prefix):]
+	}
+	return prefix[skip:], key
+}
+
+// the size of KVs [lo, hi) as a compacted node, and without the prefix.
+// the prefix is only used if it's smaller.
+func nodeRangeSize(node BNode, lo uint16, hi uint16) (size int, raw int) {
+	n := int(hi - lo)
+	plen := len(node.prefix())
+	raw = HEADER + 10*n + int(node.getOffset(hi)-node.getOffset(lo)) + n*plen
+	if n < 2 {
+		return raw, raw
+	}
+	p := plen + lcpLen(node.rawKey(lo), node.rawKey(hi-1))
+	return min(raw, raw+2+p-n*p), raw
+}
+
+// the KVs [lo, hi) can be a node
+func nodeRangeFits(tree *BTree, node BNode, lo uint16, hi uint16) bool {
+	size, raw := nodeRangeSize(node, lo, hi)
+	return size <= int(tree.nodeSize()) && raw <= BTREE_MAX_RAW_SIZE
+}
+
+// a page with the KVs [lo, hi), with the prefix if it's smaller
+func nodeCompact(tree *BTree, node BNode, lo uint16, hi uint16) BNode {
+	size, raw := nodeRangeSize(node, lo, hi)
+	new := BNode(make([]byte, tree.pageSize()))
+	new.setHeader(node.btype(), hi-lo)
+	if size < raw {
+		first, last := node.getKey(lo), node.getKey(hi-1)
+		new.setPrefix(first[:lcpLen(first, last)])
+	}
+	nodeAppendRange(new, node, 0, lo, hi-lo)
+	assert(new.nbytes() <= tree.nodeSize())
+	return new
+}
+
+// allocate a tree node; see nodeCompact
+func (tree *BTree) newNode(node BNode) uint64 {
+	return tree.new(nodeCompact(tree, node, 0, node.nkeys()))
+}
+
+// a buffer for a node built from `nodes` in memory,
+// with room for a new KV or 2 internal keys
+func nodeBuf(tree *BTree, nodes ...BNode) BNode {
+	size := BTREE_PAGE_SIZE
+	for _, node := range nodes {
+		_, raw := nodeRangeSize(node, 0, node.nkeys())
+		size += raw
+	}
+	return BNode(make([]byte, max(size, tree.pageSize())))
+}
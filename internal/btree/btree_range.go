@@ -0,0 +1,179 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+)
+
+/*
+deleting a range of keys. a subtree whose keys are all in the range is cut
+off whole: its pages are freed as they are, so it's read once instead of
+rewritten for each key. only the nodes on the 2 edges of the range are
+rewritten, and an edge node that becomes small is merged with a neighbour
+as in a deletion. the root is replaced by its only kid while it has one.
+*/
+
+// delete the keys in [start, end). `start` is not empty, so the dummy key
+// stays. returns the number of keys deleted.
+func (tree *BTree) DeleteRange(start []byte, end []byte) (int, error) {
+	if len(start) == 0 || bytes.Compare(start, end) >= 0 {
+		return 0, errors.New("bad key range")
+	}
+	if tree.root == 0 {
+		return 0, nil
+	}
+
+	count := 0
+	updated := treeDeleteRange(tree, tree.get(tree.root), start, end, nil, &count)
+	if len(updated) == 0 {
+		return 0, nil
+	}
+	tree.del(tree.root)
+	if updated.btype() == BNODE_LEAF || updated.nkeys() > 1 {
+		treeNewRoot(tree, updated)
+		return count, nil
+	}
+	// the dummy key is left, so the node isn't empty
+	assert(updated.nkeys() == 1)
+	root := updated.getPtr(0)
+	for node := BNode(tree.get(root)); node.btype() == BNODE_NODE && node.nkeys() == 1; node = tree.get(root) {
+		kid := node.getPtr(0)
+		tree.del(root)
+		root = kid
+	}
+	tree.root = root
+	return count, nil
+}
+
+// the node without the keys in [start, end); an empty BNode if it doesn't
+// change. `hi` is the end of the keys of the node, nil for the last one.
+func treeDeleteRange(tree *BTree, node BNode, start []byte, end []byte, hi []byte, count *int) BNode {
+	if node.btype() == BNODE_LEAF {
+		lo, stop := keyIndexGE(node, start), keyIndexGE(node, end)
+		if lo == stop {
+			return BNode{}
+		}
+		for i := lo; i < stop; i++ {
+			if node.isOverflow(i) {
+				overflowFree(tree, node.getVal(i))
+			}
+		}
+		*count += int(stop - lo)
+		new := nodeBuf(tree, node)
+		new.setHeader(BNODE_LEAF, node.nkeys()-(stop-lo))
+		nodeAppendRange(new, node, 0, 0, lo)
+		nodeAppendRange(new, node, lo, stop, node.nkeys()-stop)
+		return new
+	}
+
+	// the kids that are left; `node` is set for a rewritten one
+	type kid struct {
+		ptr  uint64
+		key  []byte
+		node BNode
+	}
+	kids := []kid{}
+	changed := false
+	for i := uint16(0); i < node.nkeys(); i++ {
+		ptr, klo, khi := node.getPtr(i), node.getKey(i), hi
+		if i+1 < node.nkeys() {
+			khi = node.getKey(i + 1)
+		}
+		switch {
+		case (khi != nil && bytes.Compare(khi, start) <= 0) || bytes.Compare(klo, end) >= 0:
+			kids = append(kids, kid{ptr: ptr, key: klo}) // outside
+		case bytes.Compare(klo, start) >= 0 && khi != nil && bytes.Compare(khi, end) <= 0:
+			*count += treeFree(tree, ptr) // inside
+			changed = true
+		default:
+			updated := treeDeleteRange(tree, tree.get(ptr), start, end, khi, count)
+			if len(updated) == 0 {
+				kids = append(kids, kid{ptr: ptr, key: klo})
+				continue
+			}
+			tree.del(ptr)
+			changed = true
+			if updated.nkeys() > 0 {
+				kids = append(kids, kid{key: updated.getKey(0), node: updated})
+			}
+		}
+	}
+	if !changed {
+		return BNode{}
+	}
+
+	// merge the small rewritten kids with a neighbour
+	for i := 0; i < len(kids); i++ {
+		cur := kids[i].node
+		if cur == nil || i == 0 {
+			continue
+		}
+		if size, _ := nodeRangeSize(cur, 0, cur.nkeys()); size > int(tree.nodeSize())/4 {
+			continue
+		}
+		left := kids[i-1].node
+		if left == nil {
+			left = tree.get(kids[i-1].ptr)
+		}
+		if !mergeFits(tree, left, cur) {
+			continue
+		}
+		merged := nodeBuf(tree, left, cur)
+		nodeMerge(tree, merged, left, cur)
+		if kids[i-1].node == nil {
+			tree.del(kids[i-1].ptr)
+		}
+		kids[i-1] = kid{key: merged.getKey(0), node: merged}
+		kids = append(kids[:i], kids[i+1:]...)
+		i--
+	}
+
+	// the rewritten kids are written, and may be split like in a deletion
+	ptrs, keys := []uint64{}, [][]byte{}
+	size := HEADER
+	for _, k := range kids {
+		if k.node == nil {
+			ptrs, keys = append(ptrs, k.ptr), append(keys, k.key)
+			size += 8 + 2 + 4 + len(k.key)
+			continue
+		}
+		nsplit, split := nodeSplit3(tree, k.node)
+		for _, s := range split[:nsplit] {
+			ptrs, keys = append(ptrs, tree.newNode(s)), append(keys, s.getKey(0))
+			size += 8 + 2 + 4 + len(s.getKey(0))
+		}
+	}
+	new := BNode(make([]byte, max(size, tree.pageSize())))
+	new.setHeader(BNODE_NODE, uint16(len(ptrs)))
+	for i := range ptrs {
+		nodeAppendKV(new, uint16(i), ptrs[i], keys[i], nil)
+	}
+	return new
+}
+
+// the first key of a leaf that is not less than `key`
+func keyIndexGE(node BNode, key []byte) uint16 {
+	idx := nodeLookupLE(node, key)
+	if bytes.Compare(node.getKey(idx), key) < 0 {
+		idx++
+	}
+	return idx
+}
+
+// free the pages of a subtree. returns the number of keys.
+func treeFree(tree *BTree, ptr uint64) int {
+	node := BNode(tree.get(ptr))
+	count := 0
+	for i := uint16(0); i < node.nkeys(); i++ {
+		if node.btype() == BNODE_NODE {
+			count += treeFree(tree, node.getPtr(i))
+		} else if node.isOverflow(i) {
+			overflowFree(tree, node.getVal(i))
+		}
+	}
+	if node.btype() == BNODE_LEAF {
+		count = int(node.nkeys())
+	}
+	tree.del(ptr)
+	return count
+}
@@ -0,0 +1,53 @@
+package btree
+
+import (
+	"encoding/binary"
+	"slices"
+)
+
+// copy the pages selected by `move` to newly allocated pages. a node
+// pointing to a copied page is copied too, and an overflow chain is
+// rewritten as a whole. returns the new pointer of the subtree.
+func treeRelocate(tree *BTree, ptr uint64, move func(uint64) bool) uint64 {
+	node := BNode(tree.get(ptr))
+	new := BNode(nil) // copied on the 1st change
+	for i := uint16(0); i < node.nkeys(); i++ {
+		switch {
+		case node.btype() == BNODE_NODE:
+			kid := node.getPtr(i)
+			if moved := treeRelocate(tree, kid, move); moved != kid {
+				if new == nil {
+					new = slices.Clone(node)
+				}
+				new.setPtr(i, moved)
+			}
+		case node.isOverflow(i) && overflowMoves(tree, node.getVal(i), move):
+			val := nodeGetVal(tree, node, i)
+			overflowFree(tree, node.getVal(i))
+			ref, _ := leafVal(tree, val)
+			if new == nil {
+				new = slices.Clone(node)
+			}
+			copy(new.getVal(i), ref) // the same size
+		}
+	}
+	if new == nil && !move(ptr) {
+		return ptr
+	}
+	if new == nil {
+		new = slices.Clone(node)
+	}
+	tree.del(ptr)
+	return tree.new(new)
+}
+
+// any page of an overflow chain is selected by `move`
+func overflowMoves(tree *BTree, ref []byte, move func(uint64) bool) bool {
+	for ptr := binary.LittleEndian.Uint64(ref[8:16]); ptr != 0; {
+		if move(ptr) {
+			return true
+		}
+		ptr = binary.LittleEndian.Uint64(tree.get(ptr)[0:8])
+	}
+	return false
+}
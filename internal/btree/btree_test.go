@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"math/rand"
 	"sort"
+	"strings"
 	"testing"
 	"unsafe"
 
@@ -26,7 +27,7 @@ func newC() *C {
 				return node
 			},
 			new: func(node []byte) uint64 {
-				assert(BNode(node).nbytes() <= BTREE_PAGE_SIZE)
+				assert(BNode(node).nbytes() <= BTREE_NODE_SIZE)
 				ptr := uint64(uintptr(unsafe.Pointer(&node[0])))
 				assert(pages[ptr] == nil)
 				pages[ptr] = node
@@ -253,3 +254,181 @@ func TestBTreeIncLength(t *testing.T) {
 		c.verify(t)
 	}
 }
+
+// the input of treeBulkLoad
+func bulkInput(keys []string, vals []string) func() ([]byte, []byte, bool) {
+	i := 0
+	return func() ([]byte, []byte, bool) {
+		if i >= len(keys) {
+			return nil, nil, false
+		}
+		i++
+		return []byte(keys[i-1]), []byte(vals[i-1]), true
+	}
+}
+
+func TestBTreeBulkLoad(t *testing.T) {
+	// into an empty tree
+	c := newC()
+	keys, vals := []string{}, []string{}
+	for i := 0; i < 20000; i++ {
+		keys = append(keys, fmt.Sprintf("key%08d", i*2))
+		vals = append(vals, fmt.Sprintf("vvv%d", fmix32(uint32(i))))
+		c.ref[keys[i]] = vals[i]
+	}
+	n, err := treeBulkLoad(&c.tree, bulkInput(keys, vals))
+	is.Nil(t, err)
+	is.Equal(t, len(keys), n)
+	c.verify(t)
+	// fewer pages than incremental inserts
+	d := newC()
+	for i := range keys {
+		d.add(keys[i], vals[i])
+	}
+	is.Less(t, len(c.pages), len(d.pages))
+
+	// merge with the existing keys; the old nodes are freed
+	keys, vals = keys[:0], vals[:0]
+	for i := 0; i < 25000; i++ {
+		keys = append(keys, fmt.Sprintf("key%08d", i*2+1))
+		vals = append(vals, fmt.Sprintf("www%d", i))
+		c.ref[keys[i]] = vals[i]
+	}
+	n, err = treeBulkLoad(&c.tree, bulkInput(keys, vals))
+	is.Nil(t, err)
+	is.Equal(t, len(keys), n)
+	c.verify(t)
+
+	// still works with incremental updates
+	c.add("key", "v")
+	c.del("key00000004")
+	c.verify(t)
+
+	// empty input
+	n, err = treeBulkLoad(&c.tree, bulkInput(nil, nil))
+	is.Nil(t, err)
+	is.Equal(t, 0, n)
+	c.verify(t)
+	e := newC()
+	n, err = treeBulkLoad(&e.tree, bulkInput(nil, nil))
+	is.Nil(t, err)
+	is.Equal(t, 0, n)
+	is.Equal(t, uint64(0), e.tree.root)
+
+	// bad inputs
+	for _, bad := range [][]string{
+		{"a", "c", "b"},
+		{"a", "a"},
+		{"a", "key00000002"}, // exists
+		{""},
+		{strings.Repeat("x", BTREE_MAX_KEY_SIZE+1)},
+	} {
+		f := newC()
+		f.add("key00000002", "v")
+		_, err = treeBulkLoad(&f.tree, bulkInput(bad, make([]string, len(bad))))
+		is.NotNil(t, err, bad)
+	}
+}
+
+func (c *C) depth() int {
+	depth := 1
+	for node := BNode(c.tree.get(c.tree.root)); node.btype() == BNODE_NODE; depth++ {
+		node = c.tree.get(node.getPtr(0))
+	}
+	return depth
+}
+
+func TestBTreePrefix(t *testing.T) {
+	// the same key sizes, with the long part first or last
+	pad := strings.Repeat("x", 200)
+	long, short := newC(), newC()
+	for i := 0; i < 20000; i++ {
+		id := fmt.Sprintf("%08d", fmix32(uint32(i)))
+		long.add(pad+id, "v")
+		short.add(id+pad, "v")
+	}
+	long.verify(t)
+	short.verify(t)
+	is.Less(t, long.depth(), short.depth())
+	is.Less(t, len(long.pages)*5, len(short.pages))
+	prefixed := 0
+	for _, node := range long.pages {
+		if len(node.prefix()) >= len(pad) {
+			prefixed++
+		}
+	}
+	is.Greater(t, prefixed, len(long.pages)/2)
+
+	// keys with and without a shared prefix are mixed in nodes
+	c := newC()
+	prefixes := []string{pad, pad + "y", "p", strings.Repeat("z", 900)}
+	for i := 0; i < 30000; i++ {
+		h := fmix32(uint32(i))
+		key := fmt.Sprintf("%s%d", prefixes[h%4], h%5000)
+		if h%3 == 0 {
+			c.del(key)
+		} else {
+			c.add(key, strings.Repeat("v", int(h%300)))
+		}
+		if i%1000 == 999 {
+			c.verify(t)
+		}
+	}
+	c.verify(t)
+	for key := range c.ref {
+		c.del(key)
+	}
+	c.verify(t)
+	is.Equal(t, 1, len(c.pages))
+}
+
+func TestBTreeDeleteRange(t *testing.T) {
+	c := newC()
+	for i := 0; i < 20000; i++ {
+		c.add(fmt.Sprintf("key%08d", fmix32(uint32(i))%100000), fmt.Sprintf("vvv%d", i))
+	}
+	c.verify(t)
+	// the keys of the reference in [start, end)
+	drop := func(start string, end string) int {
+		n := 0
+		for k := range c.ref {
+			if start <= k && k < end {
+				delete(c.ref, k)
+				n++
+			}
+		}
+		return n
+	}
+
+	for _, r := range [][2]string{
+		{"key00001000", "key00002000"},  // within a few leaves
+		{"key00010000", "key00060000"},  // whole subtrees
+		{"key00060000", "key00060000x"}, // a single key at most
+		{"key00070000", "z"},            // to the end
+		{"a", "b"},                      // nothing
+	} {
+		want := drop(r[0], r[1])
+		n, err := c.tree.DeleteRange([]byte(r[0]), []byte(r[1]))
+		is.Nil(t, err)
+		is.Equal(t, want, n, r)
+		c.verify(t)
+	}
+
+	// still works with incremental updates
+	c.add("key00015000", "v")
+	c.del("key00000004")
+	c.verify(t)
+
+	// every page is freed but the one of the dummy key
+	n, err := c.tree.DeleteRange([]byte("k"), []byte("z"))
+	is.Nil(t, err)
+	is.Equal(t, len(c.ref), n)
+	c.ref = map[string]string{}
+	c.verify(t)
+	is.Equal(t, 1, len(c.pages))
+
+	_, err = c.tree.DeleteRange(nil, []byte("z"))
+	is.NotNil(t, err)
+	_, err = c.tree.DeleteRange([]byte("b"), []byte("a"))
+	is.NotNil(t, err)
+}
@@ -0,0 +1,259 @@
+package btree_iter
+
+import (
+	"bytes"
+	"github.com/Adit0507/AdiDB/internal/btree"
+)
+
+type BIter struct {
+	tree *btree.BTree
+	path []btree.BNode
+	pos  []uint16
+	key  []byte // the full key of the position, once it's known
+	// the full keys of nodes with a prefix are copied in it. it's only
+	// appended to, so that the keys stay valid after the iterator moves.
+	keys []byte
+	// readahead of the leaves; see SetPrefetch
+	ahead   int
+	after   int
+	leaves  int  // leaves moved to
+	hinted  int  // the farthest leaf of the parent hinted
+	hinting bool // `hinted` is set for the current parent
+	ptrs    []uint64
+}
+
+// full keys are copied in chunks of this size
+const ITER_KEYS_CHUNK = 4096
+
+// movin backward & forward
+func (iter *BIter) Next() {
+	iter.key = nil
+	iterNext(iter, len(iter.path)-1)
+}
+
+func iterIsFirst(iter *BIter) bool {
+	for _, pos := range iter.pos {
+		if pos != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func iterPrev(iter *BIter, level int) {
+	if iter.pos[level] > 0 {
+		iter.pos[level]-- //move within node
+	} else if level > 0 {
+		iterPrev(iter, level-1) //move to sibling noe
+	} else {
+		panic("unreachable")
+	}
+
+	if level+1 < len(iter.pos) {
+		node := iter.path[level]
+		kid := BNode(iter.tree.get(node.getPtr(iter.pos[level])))
+		iter.path[level+1] = kid
+		iter.pos[level+1] = kid.nkeys() - 1
+		iterMoved(iter, level, -1)
+	}
+}
+
+func (iter *BIter) Prev() {
+	iter.key = nil
+	if !iterIsFirst(iter) {
+		iterPrev(iter, len(iter.path)-1)
+	}
+}
+
+// false if moved past the last key
+func iterNext(iter *BIter, level int) bool {
+	if iter.pos[level]+1 < iter.path[level].nkeys() {
+		iter.pos[level]++ //move within node
+	} else if level > 0 {
+		if !iterNext(iter, level-1) { //move to sibling node
+			return false // the levels below must not reset the position
+		}
+	} else {
+		iter.pos[len(iter.pos)-1]++ //past last key
+		return false
+	}
+	if level+1 < len(iter.pos) { //update child node
+		node := iter.path[level]
+		kid := btree.BNode(iter.tree.get(node.getPtr(iter.pos[level])))
+		iter.path[level+1] = kid
+		iter.pos[level+1] = 0
+		iterMoved(iter, level, +1)
+	}
+	return true
+}
+
+// read ahead the next `ahead` leaves in the direction of the iterator once
+// it has moved to `after` leaves, so that a point query or a short range
+// doesn't. only the leaves of the current parent node are hinted, each one
+// once. the hints go to the prefetch function of the tree, if any.
+func (iter *BIter) SetPrefetch(ahead int, after int) {
+	iter.ahead, iter.after, iter.leaves = ahead, after, 0
+	iter.hinting = false
+}
+
+// the node at `level`+1 was replaced while moving in `dir`
+func iterMoved(iter *BIter, level int, dir int) {
+	if iter.ahead <= 0 || iter.tree.prefetch == nil {
+		return
+	}
+	if level+2 == len(iter.pos) {
+		iter.hinting = false // a new parent
+		return
+	}
+	if level+1 != len(iter.pos)-1 {
+		return
+	}
+	if iter.leaves++; iter.leaves < iter.after {
+		return
+	}
+	node, pos := iter.path[level], int(iter.pos[level])
+	from := pos + dir
+	if iter.hinting && (iter.hinted-from)*dir >= 0 {
+		from = iter.hinted + dir
+	}
+	iter.ptrs = iter.ptrs[:0]
+	for p := from; (p-pos)*dir <= iter.ahead && p >= 0 && p < int(node.nkeys()); p += dir {
+		iter.ptrs = append(iter.ptrs, node.getPtr(uint16(p)))
+		iter.hinted, iter.hinting = p, true
+	}
+	if len(iter.ptrs) > 0 {
+		iter.tree.prefetch(iter.ptrs)
+	}
+}
+
+// find closest position that is less or equal to input key
+func (tree BTreeWrap) SeekLE(key []byte) *BIter {
+	iter := &BIter{tree: tree}
+	for ptr := tree.root; ptr != 0; {
+		node := (tree.get(ptr))
+		idx := nodeLookupLE(node, key)
+		iter.path = append(iter.path, node)
+		iter.pos = append(iter.pos, idx)
+		ptr = node.getPtr(idx)
+	}
+	return iter
+}
+
+// the position of the last key; the sentinel key for an empty tree
+func (tree BTreeWrap) SeekLast() *BIter {
+	iter := &BIter{tree: tree}
+	for ptr := tree.root; ptr != 0; {
+		node := btree.BNode(tree.get(ptr))
+		idx := node.nkeys() - 1
+		iter.path = append(iter.path, node)
+		iter.pos = append(iter.pos, idx)
+		ptr = node.getPtr(idx)
+	}
+	return iter
+}
+
+func assert(cond bool) {
+	if !cond {
+		panic("assertion failure")
+	}
+}
+
+// get current KV pair
+func (iter *BIter) Deref() ([]byte, []byte) {
+	assert(iter.Valid())
+	last := len(iter.path) - 1
+	node := iter.path[last]
+	pos := iter.pos[last]
+
+	return iter.Key(), nodeGetVal(iter.tree, node, pos)
+}
+
+// the current key, without reading an overflow value
+func (iter *BIter) Key() []byte {
+	assert(iter.Valid())
+	last := len(iter.path) - 1
+	if iter.key == nil {
+		iter.key = iterKey(iter, iter.path[last], iter.pos[last])
+	}
+	return iter.key
+}
+
+// the full key, without an allocation for each one
+func iterKey(iter *BIter, node btree.BNode, pos uint16) []byte {
+	prefix, key := node.prefix(), node.rawKey(pos)
+	if len(prefix) == 0 {
+		return key
+	}
+	n := len(prefix) + len(key)
+	if cap(iter.keys)-len(iter.keys) < n {
+		iter.keys = make([]byte, 0, max(ITER_KEYS_CHUNK, n))
+	}
+	start := len(iter.keys)
+	iter.keys = append(append(iter.keys, prefix...), key...)
+	return iter.keys[start:len(iter.keys):len(iter.keys)]
+}
+
+func iterIsEnd(iter *BIter) bool {
+	last := len(iter.path) - 1
+	return last < 0 || iter.pos[last] >= uint16(iter.path[last].nkeys)
+}
+
+// precondition of Dref()
+func (iter *BIter) Valid() bool {
+	return !(iterIsFirst(iter) || iterIsEnd(iter))
+}
+
+const (
+	CMP_GE = +3 // >=
+	CMP_GT = +2 // >
+	CMP_LT = -2 // <
+	CMP_LE = -3 // <=
+)
+
+func cmpOk(key []byte, cmp int, ref []byte) bool {
+	r := bytes.Compare(key, ref)
+
+	switch cmp {
+	case CMP_GE:
+		return r >= 0
+
+	case CMP_GT:
+		return r > 0
+	case CMP_LE:
+		return r <= 0
+	case CMP_LT:
+		return r < 0
+	default:
+		panic("what>")
+	}
+}
+
+type BTreeWrap struct{
+	*btree.BTree
+}
+
+func (tree BTreeWrap) Seek(key []byte, cmp int) *BIter {
+	iter := tree.SeekLE(key)
+	assert(iterIsFirst(iter) || !iterIsEnd(iter))
+	if cmp != CMP_LE {
+		cur := []byte(nil)
+		if !iterIsFirst(iter) {
+			cur, _ = iter.Deref()
+		}
+
+		if len(key) == 0 || !cmpOk(cur, cmp, key) {
+			if cmp > 0 {
+				iter.Next()
+			} else {
+				iter.Prev()
+			}
+		}
+	}
+
+	if iter.Valid() {
+		cur, _ := iter.Deref()
+		assert(cmpOk(cur, cmp, key))
+	}
+
+	return iter
+}
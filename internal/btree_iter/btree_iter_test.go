@@ -14,7 +14,7 @@ func TestBTreeIter(t *testing.T) {
 		is.False(t, iter.Valid())
 	}
 
-	sizes := []int{5, 2500}
+	sizes := []int{5, 2500, 50000} // 1, 2 and 3 levels
 	for _, sz := range sizes {
 		c := newC()
 
@@ -2,15 +2,24 @@ package freelist
 
 import (
 	"encoding/binary"
-	"github.com/Adit0507/AdiDB/btree"
+	"github.com/Adit0507/AdiDB/internal/btree"
 )
 
 // node format:
 // |next| pointers | unused
+// each pointer is followed by the version of the commit that freed it.
 type LNode []byte
 
+/*
+a page freed by the commit of version v is still used by the snapshots of
+older versions. an item is only popped if its version is not after maxVer,
+the oldest version in use by a reader (see txFinalize), so the free pages
+pile up while a snapshot is open and are reused after it ends. the items
+added by the current update are not popped either, since they are at or
+after maxSeq.
+*/
+
 const FREE_LIST_HEADER = 8
-const FREE_LIST_CAP = (btree.BTREE_PAGE_SIZE - FREE_LIST_HEADER) / 8
 
 func assert(cond bool) {
 	if !cond {
@@ -31,13 +40,15 @@ func (node LNode) getPtr(idx int) (uint64, uint64) {
 	return binary.LittleEndian.Uint64(node[offset:]), binary.LittleEndian.Uint64(node[offset+8:])
 }
 func (node LNode) setPtr(idx int, ptr uint64, version uint64) {
-	assert(idx < FREE_LIST_CAP)
+	assert(FREE_LIST_HEADER+16*(idx+1) <= len(node)-btree.BTREE_PAGE_RESERVED)
 	offset := FREE_LIST_HEADER + 16*idx
 	binary.LittleEndian.PutUint64(node[offset+0:], ptr)
 	binary.LittleEndian.PutUint64(node[offset+8:], version)
 }
 
 type FreeList struct {
+	// page size in bytes; 0 for btree.BTREE_PAGE_SIZE
+	size int
 	// read a page
 	get func(uint64) []byte
 	// updating an existing page
@@ -56,10 +67,26 @@ type FreeList struct {
 	maxSeq uint64 // saved tailSeq to prevnt consuming newly added items
 	maxVer uint64 //oldest reader version
 	curVer uint64 //version no. when commiting
+
+	// panic on a page freed twice; see freelist_check.go
+	Guard bool
+	guard *flGuard
+}
+
+func (fl *FreeList) pageSize() int {
+	if fl.size == 0 {
+		return btree.BTREE_PAGE_SIZE
+	}
+	return fl.size
+}
+
+// items in a node
+func (fl *FreeList) capacity() int {
+	return (fl.pageSize() - btree.BTREE_PAGE_RESERVED - FREE_LIST_HEADER) / 16
 }
 
-func seq2idx(seq uint64) int {
-	return int(seq % FREE_LIST_CAP)
+func seq2idx(fl *FreeList, seq uint64) int {
+	return int(seq % uint64(fl.capacity()))
 }
 
 func versionBefore(a, b uint64) bool {
@@ -74,10 +101,13 @@ func (fl *FreeList) SetMaxVer(maxVer uint64) {
 
 // get 1 item form list head
 func (fl *FreeList) PopHead() uint64 {
+	guardSync(fl)
 	ptr, head := flPop(fl)
 	if head != 0 {
-		fl.PushTail(head)
+		guardAdd(fl, head, GUARD_ITEM)
+		flPush(fl, head)
 	}
+	guardSave(fl)
 
 	return ptr
 }
@@ -88,17 +118,25 @@ func (fl *FreeList) check() {
 }
 
 func (fl *FreeList) PushTail(ptr uint64) {
+	guardSync(fl)
+	guardAdd(fl, ptr, GUARD_ITEM)
+	flPush(fl, ptr)
+	guardSave(fl)
+}
+
+func flPush(fl *FreeList, ptr uint64) {
 	fl.check()
 	// addin to tail node
-	LNode(fl.set(fl.tailPage)).setPtr(seq2idx(fl.tailSeq), ptr, fl.curVer)
+	LNode(fl.set(fl.tailPage)).setPtr(seq2idx(fl, fl.tailSeq), ptr, fl.curVer)
 	fl.tailSeq++
 
-	if seq2idx(fl.tailSeq) == 0 {
+	if seq2idx(fl, fl.tailSeq) == 0 {
 		next, head := flPop(fl)
 		if next == 0 {
 			// allocate new node by appending
-			next = fl.new(make([]byte, btree.BTREE_PAGE_SIZE))
+			next = fl.new(make([]byte, fl.pageSize()))
 		}
+		guardAdd(fl, next, GUARD_NODE)
 
 		// link to new tail node
 		LNode(fl.set(fl.tailPage)).setNext(next)
@@ -106,12 +144,29 @@ func (fl *FreeList) PushTail(ptr uint64) {
 
 		// add head node if its removed
 		if head != 0 {
+			guardAdd(fl, head, GUARD_ITEM)
 			LNode(fl.set(fl.tailPage)).setPtr(0, head, fl.curVer)
 			fl.tailSeq++
 		}
 	}
 }
 
+// visit the nodes of the list and the items in them, from head to tail
+func flWalk(fl *FreeList, node func(ptr uint64), item func(ptr uint64, version uint64)) {
+	ptr := fl.headPage
+	node(ptr)
+	for seq := fl.headSeq; seq != fl.tailSeq; {
+		lnode := LNode(fl.get(ptr))
+		p, version := lnode.getPtr(seq2idx(fl, seq))
+		item(p, version)
+		seq++
+		if seq2idx(fl, seq) == 0 {
+			ptr = lnode.getNext()
+			node(ptr)
+		}
+	}
+}
+
 // rmeove 1 item from head node & remove head node if empty
 func flPop(fl *FreeList) (ptr uint64, head uint64) {
 	fl.check()
@@ -120,16 +175,24 @@ func flPop(fl *FreeList) (ptr uint64, head uint64) {
 	}
 
 	node := LNode(fl.get(fl.headPage))
-	ptr, version := node.getPtr(seq2idx(fl.headSeq))
+	ptr, version := node.getPtr(seq2idx(fl, fl.headSeq))
 	if versionBefore(fl.maxVer, version) {
 		return 0, 0
 	}
 	fl.headSeq++
+	guardDel(fl, ptr)
 
-	if seq2idx(fl.headSeq) == 0 {
+	if seq2idx(fl, fl.headSeq) == 0 {
 		head, fl.headPage = fl.headPage, node.getNext()
 		assert(fl.headPage != 0)
+		guardDel(fl, head)
 	}
 
 	return
 }
+
+// the number of items and list nodes, from the head and tail positions
+func (fl *FreeList) Size() (items uint64, nodes uint64) {
+	n := uint64(fl.capacity())
+	return fl.tailSeq - fl.headSeq, fl.tailSeq/n - fl.headSeq/n + 1
+}
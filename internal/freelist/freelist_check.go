@@ -0,0 +1,114 @@
+package freelist
+
+import "fmt"
+
+/*
+a page in the free list twice is handed out twice, so 2 tree nodes end up
+sharing a page. Check verifies a list with a bitmap of the pages, and the
+guard catches a double free when it happens.
+
+the guard keeps every page of the list in memory. the list is reset by
+reverting a failed update or by rebuilding it, which is detected by the
+list position, and the pages are collected again by walking the list.
+*/
+
+// the pages of the list in the guard
+const (
+	GUARD_ITEM = 1
+	GUARD_NODE = 2
+)
+
+type flGuard struct {
+	pages map[uint64]uint8 // GUARD_*
+	pos   [4]uint64        // head and tail of the list for the pages
+}
+
+func (fl *FreeList) pos() [4]uint64 {
+	return [4]uint64{fl.headPage, fl.headSeq, fl.tailPage, fl.tailSeq}
+}
+
+// collect the pages if the list was changed by others
+func guardSync(fl *FreeList) {
+	if !fl.Guard || (fl.guard != nil && fl.guard.pos == fl.pos()) {
+		return
+	}
+	fl.guard = &flGuard{pages: map[uint64]uint8{}}
+	flWalk(fl,
+		func(ptr uint64) { guardAdd(fl, ptr, GUARD_NODE) },
+		func(ptr uint64, _ uint64) { guardAdd(fl, ptr, GUARD_ITEM) })
+}
+
+func guardSave(fl *FreeList) {
+	if fl.guard != nil {
+		fl.guard.pos = fl.pos()
+	}
+}
+
+func guardAdd(fl *FreeList, ptr uint64, kind uint8) {
+	if fl.guard == nil {
+		return
+	}
+	switch fl.guard.pages[ptr] {
+	case GUARD_ITEM:
+		panic(fmt.Sprintf("free list: page %d is already free", ptr))
+	case GUARD_NODE:
+		panic(fmt.Sprintf("free list: page %d is a list node", ptr))
+	}
+	if ptr == 0 {
+		panic("free list: page 0 is the meta page")
+	}
+	fl.guard.pages[ptr] = kind
+}
+
+func guardDel(fl *FreeList, ptr uint64) {
+	if fl.guard != nil {
+		delete(fl.guard.pages, ptr)
+	}
+}
+
+// verify the list nodes from head to tail and the items in them: every
+// page is in [1, totalPages) and appears once.
+func (fl *FreeList) Check(totalPages uint64) error {
+	seen := make([]uint64, (totalPages+63)/64)
+	mark := func(ptr uint64, what string) error {
+		if ptr == 0 || ptr >= totalPages {
+			return fmt.Errorf("%s: page %d out of range", what, ptr)
+		}
+		if seen[ptr/64]&(1<<(ptr%64)) != 0 {
+			return fmt.Errorf("%s: page %d is in the list twice", what, ptr)
+		}
+		seen[ptr/64] |= 1 << (ptr % 64)
+		return nil
+	}
+	if fl.tailSeq-fl.headSeq >= totalPages {
+		return fmt.Errorf("bad list size: %d", fl.tailSeq-fl.headSeq)
+	}
+
+	ptr, seq := fl.headPage, fl.headSeq
+	for {
+		if err := mark(ptr, "list node"); err != nil {
+			return err
+		}
+		node := LNode(fl.get(ptr))
+		for ; seq != fl.tailSeq; seq++ {
+			item, _ := node.getPtr(seq2idx(fl, seq))
+			if err := mark(item, fmt.Sprintf("list node %d", ptr)); err != nil {
+				return err
+			}
+			if seq2idx(fl, seq+1) == 0 {
+				seq++
+				break
+			}
+		}
+		if ptr == fl.tailPage {
+			if seq != fl.tailSeq {
+				return fmt.Errorf("list node %d: the tail is not the last node", ptr)
+			}
+			return nil
+		}
+		if seq == fl.tailSeq && seq2idx(fl, seq) != 0 {
+			return fmt.Errorf("list node %d: items end before the tail node", ptr)
+		}
+		ptr = node.getNext()
+	}
+}
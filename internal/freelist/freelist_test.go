@@ -1,9 +1,11 @@
 package freelist
 
 import (
+	"fmt"
 	"slices"
 	"testing"
-	"github.com/Adit0507/AdiDB/btree"
+	"github.com/Adit0507/AdiDB/internal/btree"
+	is "github.com/stretchr/testify/require"
 )
 
 type L struct {
@@ -47,10 +49,10 @@ func flDump(free *FreeList) (list []uint64, nodes []uint64) {
 	for seq := free.headSeq; seq != free.tailSeq; {
 		assert(ptr != 0)
 		node := LNode(free.get(ptr))
-		item, _ := node.getPtr(seq2idx(seq))
+		item, _ := node.getPtr(seq2idx(free, seq))
 		list = append(list, item)
 		seq++
-		if seq2idx(seq) == 0 {
+		if seq2idx(free, seq) == 0 {
 			ptr = node.getNext()
 			nodes = append(nodes, ptr)
 		}
@@ -89,6 +91,8 @@ func (l *L) verify() {
 	}
 	// dump all pointers from the free list
 	list, nodes := flDump(&l.free)
+	items, nnodes := l.free.Size()
+	assert(items == uint64(len(list)) && nnodes == uint64(len(nodes)))
 
 	// any pointer is either in the free list, a list node, or removed.
 	assert(len(l.pages) == len(list)+len(nodes)+len(l.removed))
@@ -165,3 +169,73 @@ func TestFreeListRandom(t *testing.T) {
 		l.verify()
 	}
 }
+
+func TestFreeListCheck(t *testing.T) {
+	l := newL()
+	for i := 0; i < 2000; i++ {
+		l.push(10000 + uint64(i))
+	}
+	total := uint64(20000)
+	is.Nil(t, l.free.Check(total))
+	is.ErrorContains(t, l.free.Check(10100), "out of range")
+
+	// a duplicate item
+	_, nodes := flDump(&l.free)
+	node := LNode(l.pages[nodes[1]])
+	item, version := node.getPtr(0)
+	node.setPtr(1, item, version)
+	is.ErrorContains(t, l.free.Check(total), fmt.Sprintf("page %d is in the list twice", item))
+	node.setPtr(1, item+1, version)
+	is.Nil(t, l.free.Check(total))
+
+	// a broken link
+	next := node.getNext()
+	node.setNext(nodes[0])
+	is.ErrorContains(t, l.free.Check(total), fmt.Sprintf("page %d is in the list twice", nodes[0]))
+	node.setNext(0)
+	is.ErrorContains(t, l.free.Check(total), "page 0 out of range")
+	node.setNext(next)
+	is.Nil(t, l.free.Check(total))
+}
+
+func TestFreeListGuard(t *testing.T) {
+	l := newL()
+	l.free.Guard = true
+	for i := 0; i < 1000; i++ {
+		l.push(10000 + uint64(i))
+	}
+	is.PanicsWithValue(t, "free list: page 10005 is already free", func() {
+		l.free.PushTail(10005)
+	})
+	_, nodes := flDump(&l.free)
+	is.Panics(t, func() { l.free.PushTail(nodes[1]) })
+
+	// popped pages can be freed again
+	l.free.SetMaxVer(0)
+	ptr := l.pop()
+	is.NotZero(t, ptr)
+	l.free.PushTail(ptr)
+	l.removed = l.removed[:len(l.removed)-1]
+	l.verify()
+
+	// the list is reset by others
+	l.free.headPage, l.free.headSeq = l.free.tailPage, l.free.tailSeq
+	l.free.PushTail(ptr)
+	is.Panics(t, func() { l.free.PushTail(ptr) })
+
+	// no false alarms
+	for N := 0; N < 100; N++ {
+		l := newL()
+		l.free.Guard = true
+		for i := 0; i < 2000; i++ {
+			ptr := uint64(10000 + fmix32(uint32(N*2000+i)))
+			if ptr%2 == 0 && l.pages[ptr] == nil {
+				l.push(ptr)
+			} else {
+				l.free.SetMaxVer(0)
+				l.pop()
+			}
+		}
+		l.verify()
+	}
+}
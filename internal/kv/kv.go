@@ -0,0 +1,580 @@
+package kv
+
+// go:build (linux && 386) || (darwin && !cgo)
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log/slog"
+	"math/bits"
+	"sync"
+	"time"
+
+	"github.com/Adit0507/AdiDB/internal/btree"
+	"github.com/Adit0507/AdiDB/internal/freelist"
+)
+
+type KV struct {
+	Path  string
+	Fsync func(int) error // overridable; for testing
+	// write-ahead log mode; see kv_wal.go
+	WAL           bool
+	WALCheckpoint int   // commits between checkpoints; 0 for the default
+	WALMaxSize    int64 // log size in bytes that triggers a checkpoint
+	// commits are not persistent until Sync or Close. a crash loses
+	// recent commits but leaves a consistent older version.
+	NoSync bool
+	// a 32-byte key to encrypt a new file, and to open an encrypted file;
+	// see kv_crypt.go. not supported with WAL and Changes.
+	Key []byte
+	// keep the updates of each commit for ChangesSince; see kv_changes.go
+	Changes bool
+	// compress the pages of a new file; see kv_compress.go. an existing
+	// file keeps its own method.
+	Compression Compressor
+	// the page size of a new file in bytes, a power of 2 between
+	// btree.BTREE_MIN_PAGE_SIZE and btree.BTREE_MAX_PAGE_SIZE; 0 for the
+	// default. an existing file keeps its own size; a different value fails.
+	PageSize int
+	// bytes of decoded pages to keep in memory; 0 for no cache.
+	// see kv_cache.go and KV.CacheStats.
+	CacheSize int64
+	// open an existing file without modifying it; writes fail with
+	// ErrReadOnly. the WAL is not replayed, so updates after the last
+	// checkpoint are not seen. it takes a shared lock, so this works while
+	// a writer has the file open; see kv_lock.go.
+	ReadOnly bool
+	// how long Open waits for another writer to close the file before it
+	// fails with ErrLocked; 0 to fail at once
+	LockTimeout time.Duration
+	// combine the value of a key with a delta of KVTX.Merge. `old` is nil
+	// for a missing key; nil is returned to leave the key missing.
+	Merge func(key []byte, old []byte, delta []byte) []byte
+	// panic when a page is freed twice; see FreeList.Guard. every free
+	// page is kept in memory, so it's meant for debugging.
+	GuardFree bool
+	// the file growth in bytes; see kv_grow.go. 0 for page by page.
+	InitialSize int64   // the least size of the file
+	GrowChunk   int64   // extend the file by at least this much
+	GrowFactor  float64 // or by this fraction of its size, if it's more
+	// reserve the disk space when the file is extended; only on Linux
+	Fallocate bool
+	// instrumentation; see kv_metrics.go. nil for none.
+	Metrics Metrics
+	// notable events; see kv_log.go. nil for none.
+	Logger *slog.Logger
+	// with a Logger, operations that take this long are logged; 0 for none
+	SlowOp time.Duration
+	// the number of earlier versions kept for BeginReadAt, up to
+	// HISTORY_MAX; see kv_history.go. their pages are not reused.
+	History int
+	// internals
+	fd   int
+	tree btree.BTree
+	free freelist.FreeList
+	mmap struct {
+		total  int      // mmap size, can be larger than the file size
+		chunks [][]byte // multiple mmaps, can be non-continuous
+	}
+	page struct {
+		size    int               // page size in bytes
+		flushed uint64            // database size in number of pages
+		nappend uint64            // number of pages to be appended
+		updates map[uint64][]byte // pending updates, including appended pages
+		file    int64             // the file size, including unused space
+		grows   uint64            // times the file was extended
+	}
+	failed bool // Did the last update fail?
+	// concurrency control
+	mutex   sync.Mutex    // serialize TX methods
+	version uint64        // monotonic version number
+	ongoing []uint64      // version numbers of concurrent TXs
+	history []CommittedTX // chanages keys; for detecting conflicts
+	metaVer uint64        // version in the meta page on disk
+	hist    []histEntry   // roots of earlier versions; see kv_history.go
+	format  uint64        // FORMAT_*
+	// encryption
+	aead     cipher.AEAD
+	keyCheck []byte // in the meta page
+	compress Compressor
+	cache    pageCache
+	wal      walState
+	changes  changesState
+}
+
+type CommittedTX struct {
+	version uint64
+	writes  []KeyRange // sorted
+}
+
+// `BTree.get`, read a page.
+func (db *KV) pageRead(ptr uint64) []byte {
+	assert(ptr < db.page.flushed+db.page.nappend)
+	if node, ok := db.page.updates[ptr]; ok {
+		return node // pending update
+	}
+	return mmapReadChecked(db, ptr, db.mmap.chunks)
+}
+
+// nil for a page past the chunks; see pageReadRaw
+func mmapRead(ptr uint64, size int, chunks [][]byte) []byte {
+	start := uint64(0)
+	for _, chunk := range chunks {
+		end := start + uint64(len(chunk)/size)
+		if ptr < end {
+			offset := uint64(size) * (ptr - start)
+			return chunk[offset : offset+uint64(size)]
+		}
+		start = end
+	}
+	return nil
+}
+
+func assert(cond bool) {
+	if !cond {
+		panic("assertion failure")
+	}
+}
+
+// `BTree.new`, allocate a new page.
+func (db *KV) pageAlloc(node []byte) uint64 {
+	assert(len(node) == db.page.size)
+	if ptr := db.free.PopHead(); ptr != 0 { // try the free list
+		assert(db.page.updates[ptr] == nil)
+		cacheDel(db, ptr)
+		db.page.updates[ptr] = node
+		metricCount(db, METRIC_PAGE_REUSE, 1)
+		return ptr
+	}
+	return db.pageAppend(node) // append
+}
+
+// `FreeList.new`, append a new page.
+func (db *KV) pageAppend(node []byte) uint64 {
+	assert(len(node) == db.page.size)
+	ptr := db.page.flushed + db.page.nappend
+	db.page.nappend++
+	assert(db.page.updates[ptr] == nil)
+	cacheDel(db, ptr)
+	db.page.updates[ptr] = node
+	metricCount(db, METRIC_PAGE_APPEND, 1)
+	return ptr
+}
+
+// `FreeList.set`, update an existing page.
+func (db *KV) pageWrite(ptr uint64) []byte {
+	assert(ptr < db.page.flushed+db.page.nappend)
+	if node, ok := db.page.updates[ptr]; ok {
+		return node // pending update
+	}
+	// initialize from the file
+	node := make([]byte, db.page.size)
+	if !(ptr == 1 && db.page.flushed == 2) {
+		// special case: page 1 doesn't exist after creating an empty DB
+		copy(node, mmapReadChecked(db, ptr, db.mmap.chunks))
+	}
+	cacheDel(db, ptr)
+	db.page.updates[ptr] = node
+	return node
+}
+
+// open or create a DB file
+func (db *KV) Open() error {
+	if db.Fsync == nil {
+		db.Fsync = fileSync
+	}
+	var err error
+	var fsize int64
+	db.page.updates = map[uint64][]byte{}
+	// B+tree callbacks
+	db.tree.get = db.pageRead
+	db.tree.new = db.pageAlloc
+	db.tree.del = db.free.PushTail
+	// free list callbacks
+	db.free.get = db.pageRead
+	db.free.new = db.freeAppend
+	db.free.set = db.pageWrite
+	db.free.Guard = db.GuardFree
+	// the log files are not encrypted
+	if db.Key != nil && (db.WAL || db.Changes) {
+		return errors.New("KV.Open: encryption doesn't support WAL or Changes")
+	}
+	if db.PageSize != 0 && (db.PageSize&(db.PageSize-1) != 0 ||
+		db.PageSize < btree.BTREE_MIN_PAGE_SIZE || db.PageSize > btree.BTREE_MAX_PAGE_SIZE) {
+		return fmt.Errorf("KV.Open: bad page size: %d", db.PageSize)
+	}
+	if db.History < 0 || db.History > HISTORY_MAX {
+		return fmt.Errorf("KV.Open: bad history: %d", db.History)
+	}
+	if db.ReadOnly && (db.WAL || db.Changes) {
+		return errors.New("KV.Open: read-only mode doesn't support WAL or Changes")
+	}
+	if err = cryptInit(db); err != nil {
+		return fmt.Errorf("KV.Open: %w", err)
+	}
+	// open or create the DB file
+	if db.ReadOnly {
+		if db.fd, err = fileOpenRead(db.Path); err != nil {
+			return fmt.Errorf("KV.Open: open file: %w", err)
+		}
+	} else if db.fd, err = createFileSync(db.Path); err != nil {
+		return err
+	}
+	// before reading, since a writer may be creating the file
+	if err = fileLock(db); err != nil {
+		goto fail
+	}
+	// get the file size
+	if fsize, err = fileLen(db.fd); err != nil {
+		goto fail
+	}
+	db.page.file = fsize
+	// create the initial mmap
+	if err = extendMmap(db, int(fsize)); err != nil {
+		goto fail
+	}
+	// read the meta page
+	if err = readRoot(db, fsize); err != nil {
+		goto fail
+	}
+	cacheInit(db)
+	// the change log is recovered with the WAL
+	if err = changesOpen(db); err != nil {
+		goto fail
+	}
+	// recover from the log
+	if !db.ReadOnly {
+		if err = walOpen(db); err != nil {
+			goto fail
+		}
+	}
+	// catch a corrupted file early
+	if db.tree.root != 0 {
+		if err = verifyRootPath(db); err != nil {
+			goto fail
+		}
+	}
+	logAt(db, slog.LevelInfo, "file opened", "path", db.Path, "created", fsize == 0,
+		"size", fsize, "pages", db.page.flushed, "page_size", db.page.size,
+		"version", db.version)
+	return nil
+	// error
+fail:
+	logAt(db, slog.LevelError, "open failed", "path", db.Path, "err", err)
+	db.Close()
+	return fmt.Errorf("KV.Open: %w", err)
+}
+
+const DB_SIG = "BuildYourOwnDB12"
+
+/*
+the 1st page stores the root pointer and other auxiliary data.
+| sig | root | page_used | head_page | head_seq | tail_page | tail_seq | ver | format | crc32c | key_check | history |
+| 16B |  8B  |     8B    |     8B    |    8B    |     8B    |    8B    |  8B |   8B   |   4B   |    16B    |   ...   |
+the format and the checksum are 0 in older files. the 2nd byte of the format
+is the compression method, the 3rd byte is the page size as a shift of
+btree.BTREE_MIN_PAGE_SIZE, and the high 4 bytes are the features; see
+kv_header.go. the key check value is only in encrypted files.
+the history is the ring of KV.History; see kv_history.go.
+*/
+func loadMeta(db *KV, data []byte) {
+	db.tree.root = binary.LittleEndian.Uint64(data[16:24])
+	db.page.flushed = binary.LittleEndian.Uint64(data[24:32])
+	db.free.headPage = binary.LittleEndian.Uint64(data[32:40])
+	db.free.headSeq = binary.LittleEndian.Uint64(data[40:48])
+	db.free.tailPage = binary.LittleEndian.Uint64(data[48:56])
+	db.free.tailSeq = binary.LittleEndian.Uint64(data[56:64])
+	db.version = binary.LittleEndian.Uint64(data[64:72])
+	historyLoad(db, data)
+}
+
+func saveMeta(db *KV) []byte {
+	var data [108 + 16*HISTORY_MAX]byte
+	copy(data[:16], []byte(DB_SIG))
+	binary.LittleEndian.PutUint64(data[16:24], db.tree.root)
+	binary.LittleEndian.PutUint64(data[24:32], db.page.flushed)
+	binary.LittleEndian.PutUint64(data[32:40], db.free.headPage)
+	binary.LittleEndian.PutUint64(data[40:48], db.free.headSeq)
+	binary.LittleEndian.PutUint64(data[48:56], db.free.tailPage)
+	binary.LittleEndian.PutUint64(data[56:64], db.free.tailSeq)
+	binary.LittleEndian.PutUint64(data[64:72], db.version)
+	format, method := db.format, byte(COMPRESS_NONE)
+	if db.compress != nil {
+		method = db.compress.ID()
+	}
+	format |= uint64(method) << 8
+	shift := bits.TrailingZeros(uint(db.page.size / btree.BTREE_MIN_PAGE_SIZE))
+	format |= uint64(shift) << 16
+	format |= uint64(headerFeatures(db.format, method)) << 32
+	binary.LittleEndian.PutUint64(data[72:80], format)
+	if db.format >= FORMAT_CHECKSUM {
+		sum := crc32.Checksum(data[:80], castagnoli)
+		binary.LittleEndian.PutUint32(data[80:84], sum)
+	}
+	copy(data[84:100], db.keyCheck)
+	historySave(db, data[:])
+	return data[:]
+}
+
+// not a file of this format, or a damaged meta page
+var ErrBadFile = errors.New("bad file")
+
+func readRoot(db *KV, fileSize int64) error {
+	if fileSize == 0 { // empty file
+		pageSizeInit(db, db.PageSize)
+		// reserve 2 pages: the meta page and a free list node
+		db.page.flushed = 2
+		// add an initial node to the free list so it's never empty
+		db.free.headPage = 1 // the 2nd page
+		db.free.tailPage = 1
+		db.format = FORMAT_CHECKSUM
+		if db.aead != nil {
+			db.format = FORMAT_ENCRYPTED
+		}
+		db.compress = db.Compression
+		pageInitFree(db)
+		return nil // the meta page will be written in the 1st update
+	}
+	// read the page
+	data, err := fileHead(db)
+	if err != nil {
+		return fmt.Errorf("read meta page: %w", err)
+	}
+	method, shift, err := headerCheck(db, data)
+	if err != nil {
+		return err
+	}
+	// pages of the smallest size at least
+	if fileSize%btree.BTREE_MIN_PAGE_SIZE != 0 {
+		return fmt.Errorf("%w: not a multiple of pages", ErrBadFile)
+	}
+	loadMeta(db, data)
+	db.metaVer = db.version
+	size := btree.BTREE_MIN_PAGE_SIZE << min(shift, 16)
+	if size > btree.BTREE_MAX_PAGE_SIZE || fileSize%int64(size) != 0 {
+		return fmt.Errorf("%w: bad page size: %d", ErrBadFile, size)
+	}
+	if db.PageSize != 0 && db.PageSize != size {
+		return fmt.Errorf("the page size is %d, not %d", size, db.PageSize)
+	}
+	pageSizeInit(db, size)
+	// pointers are within range?
+	maxpages := uint64(fileSize / int64(size))
+	bad := !(0 < db.page.flushed && db.page.flushed <= maxpages)
+	bad = bad || !(0 < db.tree.root && db.tree.root < db.page.flushed)
+	bad = bad || !(0 < db.free.headPage && db.free.headPage < db.page.flushed)
+	bad = bad || !(0 < db.free.tailPage && db.free.tailPage < db.page.flushed)
+	if bad {
+		return fmt.Errorf("%w: bad meta page", ErrBadFile)
+	}
+	// initialize the free list; the kept versions are still in use
+	historyCheck(db)
+	db.free.SetMaxVer(historyMinVer(db, db.version))
+	if err := compressInit(db, method); err != nil {
+		return err
+	}
+	return cryptCheck(db, data[84:100])
+}
+
+// update the meta page. it must be atomic.
+func updateRoot(db *KV) error {
+	// the change log is not behind the meta page
+	if err := changesSync(db); err != nil {
+		return err
+	}
+	// NOTE: atomic?
+	if err := filePwrite(db.fd, saveMeta(db), 0); err != nil {
+		return fmt.Errorf("write meta page: %w", err)
+	}
+	return nil
+}
+
+// extend the mmap by adding new mappings. without mapPastEOF, only the
+// chunks that the file of `size` covers are mapped; see kv_file.go.
+func extendMmap(db *KV, size int) error {
+	if !mapAvailable {
+		return nil
+	}
+	for size > db.mmap.total {
+		alloc := max(db.mmap.total, 64<<20) // double the current address space
+		if mapPastEOF {
+			for db.mmap.total+alloc < size {
+				alloc *= 2 // still not enough?
+			}
+		} else if db.mmap.total+alloc > size {
+			return nil // the tail is read from the file
+		}
+		chunk, err := fileMap(db.fd, int64(db.mmap.total), alloc)
+		if err != nil {
+			return fmt.Errorf("mmap: %w", err)
+		}
+		db.mmap.total += alloc
+		db.mmap.chunks = append(db.mmap.chunks, chunk)
+	}
+	return nil
+}
+
+func updateFile(db *KV) error {
+	// 1. Write new nodes.
+	if err := writePages(db); err != nil {
+		return err
+	}
+	// 2. `fsync` to enforce the order between 1 and 3.
+	if err := fsyncCounted(db, db.fd); err != nil {
+		return err
+	}
+	// 3. Update the root pointer atomically.
+	if err := updateRoot(db); err != nil {
+		return err
+	}
+	// 4. `fsync` to make everything persistent.
+	if err := fsyncCounted(db, db.fd); err != nil {
+		return err
+	}
+	return nil
+}
+
+func updateOrRevert(db *KV, meta []byte) error {
+	// ensure the on-disk meta page matches the in-memory one after an error
+	if db.failed {
+		logAt(db, slog.LevelWarn, "rewriting the meta page after a failed update",
+			"path", db.Path, "version", db.version)
+		if err := filePwrite(db.fd, meta, 0); err != nil {
+			return fmt.Errorf("rewrite meta page: %w", err)
+		}
+		if err := fsyncCounted(db, db.fd); err != nil {
+			return err
+		}
+		db.failed = false
+	}
+	// 2-phase update
+	err := updateFile(db)
+	if err == nil {
+		db.metaVer = db.version
+	}
+	// revert on error
+	if err != nil {
+		// the on-disk meta page is in an unknown state.
+		// mark it to be rewritten on later recovery.
+		db.failed = true
+		// in-memory states are reverted immediately to allow reads
+		loadMeta(db, meta)
+		// discard temporaries
+		pageDiscard(db)
+		logAt(db, slog.LevelError, "update failed", "path", db.Path,
+			"version", db.version, "err", err)
+	}
+	return err
+}
+
+// the page size of the file for the B+tree and the free list
+func pageSizeInit(db *KV, size int) {
+	if size == 0 {
+		size = btree.BTREE_PAGE_SIZE
+	}
+	db.page.size, db.tree.size, db.free.size = size, size, size
+}
+
+// the initial free list node of a new file is written in the 1st update,
+// so it gets a checksum like any other page.
+func pageInitFree(db *KV) {
+	db.page.updates[1] = make([]byte, db.page.size)
+}
+
+// discard the pages of a failed update
+func pageDiscard(db *KV) {
+	db.page.nappend = 0
+	db.page.updates = map[uint64][]byte{}
+	if db.metaVer == 0 {
+		pageInitFree(db) // nothing is on disk yet
+	}
+}
+
+func writePages(db *KV) error {
+	size := (db.page.flushed + db.page.nappend) * uint64(db.page.size)
+	if err := growFile(db, int64(size)); err != nil {
+		return err
+	}
+	// write data pages to the file
+	for ptr, node := range db.page.updates {
+		cacheDel(db, ptr)
+		node = pageEncode(db, ptr, node)
+		offset := int64(ptr) * int64(db.page.size)
+		if err := filePwrite(db.fd, node, offset); err != nil {
+			return err
+		}
+		if err := pagePunch(db, node, offset); err != nil {
+			return err
+		}
+	}
+	metricCount(db, METRIC_PAGE_WRITE, uint64(len(db.page.updates)))
+	// extend the mmap if needed, once the file covers it
+	if err := extendMmap(db, int(size)); err != nil {
+		return err
+	}
+	// discard in-memory data
+	db.page.flushed += db.page.nappend
+	db.page.nappend = 0
+	db.page.updates = map[uint64][]byte{}
+	return nil
+}
+
+// a commit in NoSync mode. the new pages are written, but the meta page
+// is not updated until Sync, so the tree on disk stays consistent.
+func writeNoSync(db *KV, meta []byte) error {
+	err := writePages(db)
+	if err == nil && db.metaVer == 0 {
+		err = walSyncMain(db) // a new file has no meta page yet
+	}
+	if err != nil {
+		loadMeta(db, meta)
+		pageDiscard(db)
+	}
+	return err
+}
+
+// an exclusive lock on the file between processes, held until `unlock`.
+// it's advisory: it only keeps out another LockFile, for a sequence of
+// transactions that must not run in two processes at once (DB.Migrate).
+func (db *KV) LockFile() (unlock func(), err error) {
+	unlock, err = lockFileWait(db.fd)
+	if err != nil {
+		return nil, fmt.Errorf("lock file: %w", err)
+	}
+	return unlock, nil
+}
+
+// make all commits persistent
+func (db *KV) Sync() error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	return syncLocked(db)
+}
+
+// `Sync` with the lock held
+func syncLocked(db *KV) error {
+	if db.metaVer == db.version {
+		return nil
+	}
+	if db.wal.open {
+		return walCheckpoint(db)
+	}
+	return walSyncMain(db)
+}
+
+// cleanups
+func (db *KV) Close() {
+	walClose(db)
+	if db.NoSync && db.fd > 0 && db.metaVer != db.version {
+		_ = db.Sync()
+	}
+	changesClose(db)
+	for _, chunk := range db.mmap.chunks {
+		err := fileUnmap(chunk)
+		assert(err == nil)
+	}
+	_ = fileClose(db.fd)
+}
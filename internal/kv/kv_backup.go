@@ -0,0 +1,213 @@
+package kv
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+
+	"github.com/Adit0507/AdiDB/internal/btree"
+)
+
+/*
+online backup. a read-only transaction pins the latest version so that its
+pages are not reused, then the tree is copied without holding the lock.
+
+the copy is written sequentially. pages are numbered breadth-first, so the
+new pointer of a page is known before its parent is written. the copy has
+an empty free list and no unused pages:
+| meta | free list node | root | ... |
+
+the copy stops with ctx.Err() if the context is cancelled; the context
+is checked per page.
+*/
+
+// a page, or an overflow chain, to be copied
+type backupItem struct {
+	ptr   uint64 // in the source
+	to    uint64 // in the copy
+	count uint64 // the pages of an overflow chain; 0 for a node
+}
+
+// copy a compact version of the file to `w`. commits are not blocked,
+// and the copy doesn't include the commits after the call.
+func (db *KV) BackupTo(w io.Writer) error {
+	return db.BackupToCtx(context.Background(), w)
+}
+
+func (db *KV) BackupToCtx(ctx context.Context, w io.Writer) error {
+	tx := KVTX{}
+	db.BeginRead(&tx)
+	defer db.Abort(&tx)
+
+	// the page count in the meta page
+	npages, err := backupCopy(ctx, &tx.snapshot, nil)
+	if err != nil {
+		return err
+	}
+	out := KV{version: tx.version, format: db.format, keyCheck: db.keyCheck, compress: db.compress}
+	out.page.size = db.page.size
+	if tx.snapshot.root != 0 {
+		out.tree.root = 2
+	}
+	out.page.flushed = npages
+	out.free.headPage, out.free.tailPage = 1, 1
+
+	ptr := uint64(1) // pages are written in order
+	write := func(page []byte) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		_, err := w.Write(pageEncode(db, ptr, page))
+		ptr++
+		return err
+	}
+	meta := make([]byte, db.page.size)
+	copy(meta, saveMeta(&out))
+	if _, err := w.Write(meta); err != nil {
+		return err
+	}
+	if err := write(make([]byte, db.page.size)); err != nil {
+		return err
+	}
+	_, err = backupCopy(ctx, &tx.snapshot, write)
+	return err
+}
+
+// copy the tree breadth-first; only count the pages if `write` is nil.
+// returns the page count of the copy.
+func backupCopy(ctx context.Context, tree *btree.BTree, write func(page []byte) error) (next uint64, err error) {
+	defer checksumRecover(&err)
+	next = 2 // after the meta page and the free list node
+	if tree.root == 0 {
+		return next, nil
+	}
+	queue := []backupItem{{ptr: tree.root}}
+	next++
+	for len(queue) > 0 {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		item := queue[0]
+		queue = queue[1:]
+		if item.count > 0 {
+			if err := backupOverflow(tree, item, write); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		node := btree.BNode(tree.get(item.ptr))
+		new := btree.BNode(nil)
+		if write != nil {
+			new = slices.Clone(node)
+		}
+		for i := uint16(0); i < node.nkeys(); i++ {
+			switch {
+			case node.btype() == btree.BNODE_NODE:
+				queue = append(queue, backupItem{ptr: node.getPtr(i)})
+				if new != nil {
+					new.setPtr(i, next)
+				}
+				next++
+			case node.isOverflow(i):
+				ref := node.getVal(i)
+				size := binary.LittleEndian.Uint64(ref[0:8])
+				data := uint64(tree.overflowSize())
+				count := (size + data - 1) / data
+				first := binary.LittleEndian.Uint64(ref[8:16])
+				queue = append(queue, backupItem{ptr: first, to: next, count: count})
+				if new != nil {
+					binary.LittleEndian.PutUint64(new.getVal(i)[8:16], next)
+				}
+				next += count
+			}
+		}
+		if write != nil {
+			if err := write(new); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return next, nil
+}
+
+// the pages of an overflow chain are numbered consecutively
+func backupOverflow(tree *btree.BTree, item backupItem, write func(page []byte) error) error {
+	if write == nil {
+		return nil // counted by the caller
+	}
+	ptr := item.ptr
+	for i := uint64(0); i < item.count; i++ {
+		if ptr == 0 {
+			return fmt.Errorf("overflow chain at page %d is too short", item.ptr)
+		}
+		page := slices.Clone(tree.get(ptr))
+		ptr = binary.LittleEndian.Uint64(page[0:8])
+		next := uint64(0)
+		if i+1 < item.count {
+			next = item.to + i + 1
+		}
+		binary.LittleEndian.PutUint64(page[0:8], next)
+		if err := write(page); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write a compact copy to a new file; see BackupTo. the file is written
+// under a temporary name and renamed once it's complete.
+func (db *KV) Backup(file string) error {
+	return db.BackupCtx(context.Background(), file)
+}
+
+// Backup that stops with ctx.Err(), without the file
+func (db *KV) BackupCtx(ctx context.Context, file string) error {
+	tmp := file + ".tmp"
+	fp, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("KV.Backup: %w", err)
+	}
+	defer os.Remove(tmp) // left after an error
+	w := bufio.NewWriterSize(fp, 1<<20)
+	err = db.BackupToCtx(ctx, w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = fsyncCounted(db, int(fp.Fd()))
+	}
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		// the logs of an older file are not for the copy
+		err = backupRemoveLogs(file)
+	}
+	if err == nil {
+		err = os.Rename(tmp, file)
+	}
+	if err == nil {
+		err = syncDir(db, path.Dir(file))
+	}
+	if err != nil {
+		return fmt.Errorf("KV.Backup: %w", err)
+	}
+	return nil
+}
+
+func backupRemoveLogs(file string) error {
+	old := KV{Path: file}
+	for _, log := range []string{walPath(&old), changesPath(&old)} {
+		if err := os.Remove(log); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package kv
+
+import (
+	"errors"
+	"io"
+	"slices"
+)
+
+// pending pages written during a bulk load, so the memory use is bounded
+const BULK_FLUSH_PAGES = 4096
+
+// add KVs in strictly ascending key order that don't exist yet. the tree
+// is rebuilt bottom-up, so this is much faster than transactions for a
+// large input; see btree_bulk.go. writers wait for it, readers keep their
+// snapshots. `next` returns io.EOF at the end; other errors abort the load.
+// returns the number of added keys. not supported with Changes.
+func (db *KV) BulkLoad(next func() (key []byte, val []byte, err error)) (int, error) {
+	if db.ReadOnly {
+		return 0, ErrReadOnly
+	}
+	if db.Changes {
+		return 0, errors.New("KV.BulkLoad: not supported with Changes")
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	// the file must have the latest version
+	if db.wal.err != nil {
+		return 0, db.wal.err
+	}
+	if err := syncLocked(db); err != nil {
+		return 0, err
+	}
+
+	// the keyspace written, for conflicts with ongoing transactions
+	var first, last []byte
+	var inputErr error
+	input := func() ([]byte, []byte, bool) {
+		key, val, err := next()
+		if err != nil {
+			if err != io.EOF {
+				inputErr = err
+			}
+			return nil, nil, false
+		}
+		if first == nil {
+			first = slices.Clone(key)
+		}
+		last = append(last[:0], key...)
+		return key, val, true
+	}
+
+	meta, root := saveMeta(db), db.tree.root
+	db.free.curVer = db.version + 1
+	count, err := bulkUpdate(db, input)
+	if err == nil {
+		err = inputErr
+	}
+	if err != nil || count == 0 {
+		loadMeta(db, meta)
+		pageDiscard(db)
+		return 0, err
+	}
+	historyAdd(db, root)
+	db.version++
+	if err := updateOrRevert(db, meta); err != nil {
+		return 0, err
+	}
+	if len(db.ongoing) > 0 {
+		writes := []KeyRange{{first, last}}
+		db.history = append(db.history, CommittedTX{db.version, writes})
+	}
+	return count, nil
+}
+
+// rebuild the tree in pending updates, which are written as they pile up
+func bulkUpdate(db *KV, next func() ([]byte, []byte, bool)) (count int, err error) {
+	defer checksumRecover(&err)
+	var flushErr error
+	db.tree.new = func(node []byte) uint64 {
+		ptr := db.pageAlloc(node)
+		if flushErr == nil && len(db.page.updates) >= BULK_FLUSH_PAGES {
+			flushErr = writePages(db)
+		}
+		return ptr
+	}
+	defer func() { db.tree.new = db.pageAlloc }()
+
+	count, err = treeBulkLoad(&db.tree, next)
+	if err == nil {
+		err = flushErr
+	}
+	return count, err
+}
@@ -0,0 +1,134 @@
+package kv
+
+import (
+	"container/list"
+	"slices"
+	"sync"
+)
+
+/*
+a LRU cache of pages read from the file; see KV.CacheSize.
+
+the pages are decoded, so a hit skips the checksum, the decryption and the
+decompression. a page in the file only changes when it's reused after being
+freed, and it's not reused while a reader can see it. so an entry is dropped
+when the page is allocated or updated, and again when it's written, and the
+pages past the end are dropped when the file is truncated.
+*/
+
+type pageCache struct {
+	mu     sync.Mutex // readers don't hold KV.mutex
+	max    int        // in pages; 0 for no cache
+	lru    *list.List // of *cacheItem, the most recent first
+	items  map[uint64]*list.Element
+	hits   uint64
+	misses uint64
+}
+
+type cacheItem struct {
+	ptr  uint64
+	page []byte
+}
+
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+	Pages  int   // cached pages
+	Bytes  int64 // of the cached pages
+}
+
+// called after the page size is known
+func cacheInit(db *KV) {
+	c := &db.cache
+	c.max = int(db.CacheSize / int64(db.page.size))
+	c.lru = list.New()
+	c.items = map[uint64]*list.Element{}
+}
+
+func cacheGet(db *KV, ptr uint64) []byte {
+	c := &db.cache
+	if c.max == 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem := c.items[ptr]
+	if elem == nil {
+		c.misses++
+		return nil
+	}
+	c.hits++
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*cacheItem).page
+}
+
+// cacheGet without counting a hit or a miss
+func cacheHas(db *KV, ptr uint64) bool {
+	c := &db.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.items[ptr] != nil
+}
+
+// add a page read from the file. the page is copied; it may be in the mmap.
+func cachePut(db *KV, ptr uint64, page []byte) {
+	c := &db.cache
+	if c.max == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.items[ptr] != nil {
+		return // by a concurrent reader
+	}
+	c.items[ptr] = c.lru.PushFront(&cacheItem{ptr: ptr, page: slices.Clone(page)})
+	for c.lru.Len() > c.max {
+		item := c.lru.Remove(c.lru.Back()).(*cacheItem)
+		delete(c.items, item.ptr)
+	}
+}
+
+// drop a page that will be changed
+func cacheDel(db *KV, ptr uint64) {
+	c := &db.cache
+	if c.max == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem := c.items[ptr]; elem != nil {
+		c.lru.Remove(elem)
+		delete(c.items, ptr)
+	}
+}
+
+// drop the pages from `end` on
+func cacheTruncate(db *KV, end uint64) {
+	c := &db.cache
+	if c.max == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for ptr, elem := range c.items {
+		if ptr >= end {
+			c.lru.Remove(elem)
+			delete(c.items, ptr)
+		}
+	}
+}
+
+func (db *KV) CacheStats() CacheStats {
+	c := &db.cache
+	if c.max == 0 {
+		return CacheStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{
+		Hits:   c.hits,
+		Misses: c.misses,
+		Pages:  c.lru.Len(),
+		Bytes:  int64(c.lru.Len()) * int64(db.page.size),
+	}
+}
@@ -0,0 +1,274 @@
+package kv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+/*
+change log for incremental backups; see KV.Changes.
+
+the sequence number of a commit is the version in its meta page. the
+updates of each commit are appended to the log, in the form of a WAL record.
+the log is fsynced before the meta page is updated, so it's never behind
+the file. records past the meta page are dropped on open, and the WAL
+replay adds them back.
+
+log file:
+| base | record | record | ... |
+|  8B  |
+record:
+| crc32 | len | seq | op | klen | vlen | key | val | op | ... |
+|  4B   | 4B  | 8B  | 1B |  4B  |  4B  | ... | ... |
+
+`base` is the sequence before the 1st record. the crc covers the sequence
+and the updates. a commit that only moves pages (Vacuum) has an empty record.
+
+ChangesSince output:
+| CHANGES_SIG | seq | record | record | ... |
+|     16B     | 8B  |
+*/
+
+const CHANGES_SIG = "AdiDBChanges0001"
+
+var ErrChangesGone = errors.New("changes are not kept")
+
+type changesState struct {
+	fp    *os.File
+	base  uint64 // the sequence before the 1st record
+	size  int64  // of the records up to the last commit
+	dirty bool   // not fsynced
+}
+
+func changesPath(db *KV) string {
+	return db.Path + "-changes"
+}
+
+// the next record, io.EOF at the end
+func changesNext(r io.Reader) (seq uint64, rec []byte, err error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	size := int64(binary.LittleEndian.Uint32(hdr[4:8]))
+	if size < 8 {
+		return 0, nil, errors.New("bad change record")
+	}
+	// not trusting `size` until the data is there
+	buf := bytes.NewBuffer(hdr[:])
+	if _, err := io.CopyN(buf, r, size-8); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	rec = buf.Bytes()
+	if crc32.ChecksumIEEE(rec[8:]) != binary.LittleEndian.Uint32(rec[0:4]) {
+		return 0, nil, errors.New("bad change record")
+	}
+	return binary.LittleEndian.Uint64(rec[8:16]), rec, nil
+}
+
+// open the log and drop the records after the meta page. a log that
+// doesn't reach the meta page, because commits were made without it,
+// is started over.
+func changesOpen(db *KV) error {
+	if !db.Changes {
+		return nil
+	}
+	fd, err := createFileSync(changesPath(db))
+	if err != nil {
+		return err
+	}
+	fp := os.NewFile(uintptr(fd), changesPath(db))
+	db.changes.fp = fp
+	finfo, err := fp.Stat()
+	if err != nil {
+		return fmt.Errorf("stat change log: %w", err)
+	}
+
+	db.changes.base, db.changes.size = db.version, 0
+	var hdr [8]byte
+	if _, err := fp.ReadAt(hdr[:], 0); err == nil {
+		r := bufio.NewReader(io.NewSectionReader(fp, 8, finfo.Size()-8))
+		base := binary.LittleEndian.Uint64(hdr[:])
+		seq, size := base, int64(8)
+		for seq < db.version {
+			next, rec, err := changesNext(r)
+			if err != nil || next != seq+1 {
+				break
+			}
+			seq, size = next, size+int64(len(rec))
+		}
+		if seq == db.version {
+			db.changes.base, db.changes.size = base, size
+		}
+	}
+	if db.changes.size == 0 {
+		binary.LittleEndian.PutUint64(hdr[:], db.version)
+		if _, err := fp.WriteAt(hdr[:], 0); err != nil {
+			return fmt.Errorf("write change log: %w", err)
+		}
+		db.changes.size = 8
+	}
+	if err := fp.Truncate(db.changes.size); err != nil {
+		return fmt.Errorf("truncate change log: %w", err)
+	}
+	return fsyncCounted(db, fd)
+}
+
+// append the record of the commit `db.version`. the caller restores
+// `db.changes.size` if the commit fails.
+func changesAppend(db *KV, ops []byte) error {
+	if db.changes.fp == nil {
+		return nil
+	}
+	rec := make([]byte, 16, 16+len(ops))
+	binary.LittleEndian.PutUint64(rec[8:16], db.version)
+	rec = append(rec, ops...)
+	binary.LittleEndian.PutUint32(rec[4:8], uint32(len(rec)-8))
+	binary.LittleEndian.PutUint32(rec[0:4], crc32.ChecksumIEEE(rec[8:]))
+	if _, err := db.changes.fp.WriteAt(rec, db.changes.size); err != nil {
+		return fmt.Errorf("write change log: %w", err)
+	}
+	db.changes.size += int64(len(rec))
+	db.changes.dirty = true
+	return nil
+}
+
+// called before the meta page is updated
+func changesSync(db *KV) error {
+	if db.changes.fp == nil || !db.changes.dirty {
+		return nil
+	}
+	if err := fsyncCounted(db, int(db.changes.fp.Fd())); err != nil {
+		return err
+	}
+	db.changes.dirty = false
+	return nil
+}
+
+func changesClose(db *KV) {
+	if db.changes.fp != nil {
+		_ = db.changes.fp.Close()
+		db.changes.fp = nil
+	}
+}
+
+// the sequence number of the last commit
+func (db *KV) Seq() uint64 {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	return db.version
+}
+
+// write the updates of the commits after `seq`, which is the Seq of a copy
+// of this file, such as a backup. commits are not blocked.
+func (db *KV) ChangesSince(seq uint64, w io.Writer) error {
+	db.mutex.Lock()
+	fp, base, size, version := db.changes.fp, db.changes.base, db.changes.size, db.version
+	db.mutex.Unlock()
+	switch {
+	case fp == nil:
+		return fmt.Errorf("%w: the change log is disabled", ErrChangesGone)
+	case seq < base:
+		return fmt.Errorf("%w: the change log starts after %d", ErrChangesGone, base)
+	case seq > version:
+		return fmt.Errorf("sequence %d is not committed", seq)
+	}
+
+	hdr := make([]byte, 24)
+	copy(hdr, CHANGES_SIG)
+	binary.LittleEndian.PutUint64(hdr[16:24], seq)
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	// the records up to `size` are not changed by later commits
+	r := bufio.NewReader(io.NewSectionReader(fp, 8, size-8))
+	for {
+		next, rec, err := changesNext(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read change log: %w", err)
+		}
+		if next <= seq {
+			continue
+		}
+		if _, err := w.Write(rec); err != nil {
+			return err
+		}
+	}
+}
+
+// the sequence in the header of the output of ChangesSince
+func changesStart(r io.Reader) (uint64, error) {
+	hdr := make([]byte, 24)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return 0, fmt.Errorf("read changes: %w", err)
+	}
+	if string(hdr[:16]) != CHANGES_SIG {
+		return 0, errors.New("bad change stream")
+	}
+	return binary.LittleEndian.Uint64(hdr[16:24]), nil
+}
+
+// replay the output of ChangesSince, a transaction per commit
+func (db *KV) ApplyChanges(r io.Reader) error {
+	br := bufio.NewReader(r)
+	prev, err := changesStart(br)
+	if err != nil {
+		return err
+	}
+	for {
+		seq, rec, err := changesNext(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read changes: %w", err)
+		}
+		if seq <= prev {
+			return errors.New("bad change stream")
+		}
+		prev = seq
+		if err := changesApply(db, rec[16:]); err != nil {
+			return err
+		}
+	}
+}
+
+func changesApply(db *KV, ops []byte) error {
+	tx := KVTX{}
+	db.Begin(&tx)
+	if err := changesApplyTX(&tx, ops); err != nil {
+		db.Abort(&tx)
+		return err
+	}
+	return db.Commit(&tx)
+}
+
+// the updates of a change record in a transaction
+func changesApplyTX(tx *KVTX, ops []byte) error {
+	return walScan(ops, func(op byte, key []byte, val []byte) error {
+		var err error
+		switch op {
+		case WAL_DEL:
+			_, err = tx.Del(&DeleteReq{Key: key})
+		case WAL_SET:
+			_, err = tx.Set(key, val)
+		case WAL_DEL_RANGE:
+			err = tx.DeleteRange(key, val)
+		default:
+			err = errors.New("bad change record")
+		}
+		return err
+	})
+}
@@ -0,0 +1,233 @@
+package kv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/Adit0507/AdiDB/internal/btree"
+)
+
+/*
+integrity check. every page of the file must be used exactly once, either
+by the tree (nodes and overflow pages), by the free list (its nodes) or as
+a free list item. the walk keeps 2 bits per page and the current tree path,
+so memory is bounded regardless of the file size.
+*/
+
+const CHECK_MAX_ERRORS = 100 // problems reported by Check
+
+type checker struct {
+	db      *KV
+	live    []uint64 // bitmap of pages used by the tree or the free list
+	free    []uint64 // bitmap of free list items
+	errs    []error
+	dropped int // problems over CHECK_MAX_ERRORS
+	depth   int // of the leaves, -1 before the 1st leaf
+	rows    func(key []byte, val []byte) error
+}
+
+func (c *checker) fail(format string, args ...any) {
+	c.failAt(nil, format, args...)
+}
+
+// a problem with more context for the log, such as the key
+func (c *checker) failAt(attrs []any, format string, args ...any) {
+	if len(c.errs) < CHECK_MAX_ERRORS {
+		err := fmt.Errorf(format, args...)
+		c.errs = append(c.errs, err)
+		logAt(c.db, slog.LevelError, "check failed", append(attrs, "err", err)...)
+	} else {
+		c.dropped++
+	}
+}
+
+func bitGet(bits []uint64, ptr uint64) bool {
+	return bits[ptr/64]&(1<<(ptr%64)) != 0
+}
+
+func bitSet(bits []uint64, ptr uint64) {
+	bits[ptr/64] |= 1 << (ptr % 64)
+}
+
+// claim a page for the tree or the free list. false if it can't be used.
+func (c *checker) mark(ptr uint64, what string, free bool) bool {
+	if ptr == 0 || ptr >= c.db.page.flushed {
+		c.fail("%s: page %d out of range", what, ptr)
+		return false
+	}
+	switch {
+	case bitGet(c.live, ptr) && free, bitGet(c.free, ptr) && !free:
+		c.fail("%s: page %d is both used and free", what, ptr)
+		return false
+	case bitGet(c.live, ptr) || bitGet(c.free, ptr):
+		c.fail("%s: page %d is referenced twice", what, ptr)
+		return false
+	}
+	if free {
+		bitSet(c.free, ptr)
+	} else {
+		bitSet(c.live, ptr)
+	}
+	return true
+}
+
+func (c *checker) read(ptr uint64) (page []byte, err error) {
+	defer checksumRecover(&err)
+	return c.db.pageRead(ptr), nil
+}
+
+// check a subtree whose keys are in [lo, hi); no upper bound if hi is nil
+func (c *checker) node(ptr uint64, lo []byte, hi []byte, depth int) {
+	page, err := c.read(ptr)
+	if err != nil {
+		c.fail("tree: %w", err)
+		return
+	}
+	node := btree.BNode(page)
+	if err := nodeCheck(&c.db.tree, node); err != nil {
+		c.fail("tree: page %d: %w", ptr, err)
+		return
+	}
+
+	nkeys := node.nkeys()
+	for i := uint16(0); i < nkeys; i++ {
+		key := node.getKey(i)
+		switch {
+		case i == 0 && depth > 0 && !bytes.Equal(key, lo):
+			c.fail("tree: page %d: the 1st key differs from the parent key", ptr)
+		case i > 0 && bytes.Compare(node.getKey(i-1), key) >= 0:
+			c.fail("tree: page %d: key %d is out of order", ptr, i)
+		case hi != nil && bytes.Compare(key, hi) >= 0:
+			c.fail("tree: page %d: key %d is after the next parent key", ptr, i)
+		}
+	}
+
+	if node.btype() == btree.BNODE_LEAF {
+		if c.depth < 0 {
+			c.depth = depth
+		} else if c.depth != depth {
+			c.fail("tree: page %d: leaf at depth %d, expected %d", ptr, depth, c.depth)
+		}
+		for i := uint16(0); i < nkeys; i++ {
+			c.leafKV(ptr, node, i)
+		}
+		return
+	}
+
+	for i := uint16(0); i < nkeys; i++ {
+		kid := node.getPtr(i)
+		if !c.mark(kid, fmt.Sprintf("tree: page %d", ptr), false) {
+			continue
+		}
+		kidHi := hi
+		if i+1 < nkeys {
+			kidHi = node.getKey(i + 1)
+		}
+		c.node(kid, node.getKey(i), kidHi, depth+1)
+	}
+}
+
+// check a leaf KV, including its overflow pages, and pass it to `rows`
+func (c *checker) leafKV(ptr uint64, node btree.BNode, idx uint16) {
+	key, val := node.getKey(idx), node.getVal(idx)
+	if len(key) == 0 {
+		return // the sentinel key
+	}
+	attrs := []any(nil) // for the log
+	if c.db.Logger != nil {
+		attrs = append([]any{"page", ptr}, logKey(key)...)
+	}
+	if node.isOverflow(idx) {
+		size := binary.LittleEndian.Uint64(val[0:8])
+		data := uint64(c.db.tree.overflowSize())
+		npages := (size + data - 1) / data
+		what := fmt.Sprintf("tree: page %d: overflow value %d", ptr, idx)
+		full := []byte(nil)
+		n := uint64(0)
+		for next := binary.LittleEndian.Uint64(val[8:16]); next != 0; n++ {
+			if n >= npages || !c.mark(next, what, false) {
+				c.failAt(attrs, "%s: the chain is too long", what)
+				return
+			}
+			page, err := c.read(next)
+			if err != nil {
+				c.failAt(attrs, "%s: %w", what, err)
+				return
+			}
+			if c.rows != nil {
+				m := min(size-uint64(len(full)), data)
+				full = append(full, page[8:8+m]...)
+			}
+			next = binary.LittleEndian.Uint64(page[0:8])
+		}
+		if n != npages {
+			c.failAt(attrs, "%s: %d pages, expected %d", what, n, npages)
+			return
+		}
+		val = full
+	}
+	if c.rows != nil {
+		if err := c.rows(key, val); err != nil {
+			c.failAt(attrs, "key %q: %w", key, err)
+		}
+	}
+}
+
+// the free list nodes and items, after the list itself is verified
+func (c *checker) freeList() {
+	fl := &c.db.free
+	err := func() (err error) {
+		defer checksumRecover(&err)
+		return fl.Check(c.db.page.flushed)
+	}()
+	if err != nil {
+		c.fail("free list: %w", err)
+		return
+	}
+	flWalk(fl, func(ptr uint64) {
+		c.mark(ptr, "free list", false)
+	}, func(item uint64, _ uint64) {
+		c.mark(item, "free list", true)
+	})
+}
+
+// verify the whole file. `rows`, if not nil, is called on each KV to
+// check the data. all problems found are returned, up to CHECK_MAX_ERRORS.
+// commits wait for the check.
+func (db *KV) Check(rows func(key []byte, val []byte) error) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	words := (db.page.flushed + 63) / 64
+	c := &checker{
+		db:    db,
+		live:  make([]uint64, words),
+		free:  make([]uint64, words),
+		depth: -1,
+		rows:  rows,
+	}
+	if db.tree.root != 0 && c.mark(db.tree.root, "tree root", false) {
+		c.node(db.tree.root, nil, nil, 0)
+	}
+	c.freeList()
+
+	leaked, first := 0, uint64(0)
+	for ptr := uint64(1); ptr < db.page.flushed; ptr++ {
+		if !bitGet(c.live, ptr) && !bitGet(c.free, ptr) {
+			if leaked == 0 {
+				first = ptr
+			}
+			leaked++
+		}
+	}
+	if leaked > 0 {
+		c.fail("%d pages are not reachable, the first is page %d", leaked, first)
+	}
+	if c.dropped > 0 {
+		c.errs = append(c.errs, fmt.Errorf("and %d more problems", c.dropped))
+	}
+	return errors.Join(c.errs...)
+}
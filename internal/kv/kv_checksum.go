@@ -0,0 +1,92 @@
+package kv
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/Adit0507/AdiDB/internal/btree"
+)
+
+/*
+page checksums, from FORMAT_CHECKSUM on. the last 4 bytes of a page
+(in btree.BTREE_PAGE_RESERVED) hold the CRC32C of the rest of the page.
+they are set when pages are written and verified when read from the file.
+files of the older format are neither verified nor given checksums.
+encrypted files use the GCM tag instead; see kv_crypt.go.
+*/
+const (
+	FORMAT_NONE      = 0
+	FORMAT_CHECKSUM  = 1
+	FORMAT_ENCRYPTED = 2
+)
+
+const PAGE_CHECKSUM = 4 // at the end of a page
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+var ErrChecksum = errors.New("bad page checksum")
+
+type ChecksumError struct {
+	Page uint64
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("bad page checksum: page %d", e.Page)
+}
+
+func (e *ChecksumError) Unwrap() error {
+	return ErrChecksum
+}
+
+func pageSetChecksum(page []byte) {
+	end := len(page) - PAGE_CHECKSUM
+	sum := crc32.Checksum(page[:end], castagnoli)
+	binary.LittleEndian.PutUint32(page[end:], sum)
+}
+
+// the B+tree callbacks can't return errors, so a bad page panics with
+// a *ChecksumError, which is turned back into an error by checksumRecover.
+func pageVerify(ptr uint64, page []byte) []byte {
+	end := len(page) - PAGE_CHECKSUM
+	sum := crc32.Checksum(page[:end], castagnoli)
+	if sum != binary.LittleEndian.Uint32(page[end:]) {
+		panic(&ChecksumError{Page: ptr})
+	}
+	return page
+}
+
+// read a page from the cache or the file, verify it and decrypt it
+func mmapReadChecked(db *KV, ptr uint64, chunks [][]byte) []byte {
+	if page := cacheGet(db, ptr); page != nil {
+		return page
+	}
+	page := pageDecode(db, ptr, pageReadRaw(db, ptr, chunks))
+	metricCount(db, METRIC_PAGE_READ, 1)
+	cachePut(db, ptr, page)
+	return page
+}
+
+// usage: defer checksumRecover(&err)
+func checksumRecover(err *error) {
+	if r := recover(); r != nil {
+		ce, ok := r.(*ChecksumError)
+		if !ok {
+			panic(r)
+		}
+		*err = ce
+	}
+}
+
+// verify the pages from the root to the leftmost leaf
+func verifyRootPath(db *KV) (err error) {
+	defer checksumRecover(&err)
+	for ptr := db.tree.root; ; {
+		node := btree.BNode(db.pageRead(ptr))
+		if node.btype() == btree.BNODE_LEAF {
+			return nil
+		}
+		ptr = node.getPtr(0)
+	}
+}
@@ -0,0 +1,153 @@
+package kv
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/Adit0507/AdiDB/internal/btree"
+)
+
+/*
+page compression; see KV.Compression.
+
+the page content, without btree.BTREE_PAGE_RESERVED, is compressed when
+it's written and decompressed when it's read. the slot is still a page; the
+compressed data is followed by zeros. a 4-byte header after the content
+holds the compressed size, or 0 for a page that doesn't shrink and is
+stored raw:
+| data | zeros | size | checksum or encryption |
+|   content    |  4B  |
+
+only leaf pages are compressed; the keys of internal nodes are short and
+there are few of them. the zeros after the compressed data are punched out
+of the file where they cover whole disk blocks (pagePunch), so the disk
+space shrinks with pages larger than a block, while the file keeps its
+size. the zeros of an encrypted page are encrypted, so they stay.
+
+the compression method is a part of the format in the meta page, so pages
+of a file are never decoded by another method.
+*/
+
+// the unit of the holes punched in the file
+const PUNCH_BLOCK = 4096
+
+// compression methods recorded in the file
+const (
+	COMPRESS_NONE  = 0
+	COMPRESS_FLATE = 1
+)
+
+// a compression method. implementations must be safe for concurrent use.
+type Compressor interface {
+	ID() byte                                          // recorded in the file; not 0
+	Compress(dst []byte, src []byte) []byte            // append to dst
+	Decompress(dst []byte, src []byte) ([]byte, error) // append to dst
+}
+
+// DEFLATE from the standard library
+type FlateCompressor struct {
+	writers sync.Pool
+	readers sync.Pool
+}
+
+func (c *FlateCompressor) ID() byte {
+	return COMPRESS_FLATE
+}
+
+func (c *FlateCompressor) Compress(dst []byte, src []byte) []byte {
+	buf := bytes.NewBuffer(dst)
+	w, _ := c.writers.Get().(*flate.Writer)
+	if w == nil {
+		w, _ = flate.NewWriter(buf, flate.BestSpeed)
+	} else {
+		w.Reset(buf)
+	}
+	_, _ = w.Write(src) // writing to a buffer doesn't fail
+	_ = w.Close()
+	c.writers.Put(w)
+	return buf.Bytes()
+}
+
+func (c *FlateCompressor) Decompress(dst []byte, src []byte) ([]byte, error) {
+	r, _ := c.readers.Get().(io.ReadCloser)
+	if r == nil {
+		r = flate.NewReader(bytes.NewReader(src))
+	} else if err := r.(flate.Resetter).Reset(bytes.NewReader(src), nil); err != nil {
+		return nil, err
+	}
+	defer c.readers.Put(r)
+	buf := bytes.NewBuffer(dst)
+	_, err := io.Copy(buf, r)
+	return buf.Bytes(), err
+}
+
+// the method of a file, from the format in the meta page
+func compressInit(db *KV, id byte) error {
+	switch {
+	case id == COMPRESS_NONE:
+		db.compress = nil // KV.Compression only applies to new files
+	case db.Compression != nil && db.Compression.ID() == id:
+		db.compress = db.Compression
+	case db.Compression == nil && id == COMPRESS_FLATE:
+		db.compress = &FlateCompressor{}
+	default:
+		return fmt.Errorf("%w: compression method %d", ErrUnsupportedFeature, id)
+	}
+	return nil
+}
+
+// a new page if it's a leaf that shrinks, otherwise the raw page with a 0
+// header
+func pageCompress(db *KV, page []byte) []byte {
+	hdr := len(page) - btree.BTREE_PAGE_RESERVED
+	binary.LittleEndian.PutUint32(page[hdr:], 0)
+	if btree.BNode(page).btype() != btree.BNODE_LEAF {
+		return page
+	}
+	out := db.compress.Compress(make([]byte, 0, len(page)), page[:hdr])
+	if len(out) >= hdr {
+		return page
+	}
+	size := len(out)
+	out = out[:len(page)]
+	clear(out[size:])
+	binary.LittleEndian.PutUint32(out[hdr:], uint32(size))
+	return out
+}
+
+// free the disk blocks of the zeros after the compressed data of a page
+// written at `offset`
+func pagePunch(db *KV, page []byte, offset int64) error {
+	if db.compress == nil || db.format == FORMAT_ENCRYPTED {
+		return nil
+	}
+	hdr := len(page) - btree.BTREE_PAGE_RESERVED
+	size := int(binary.LittleEndian.Uint32(page[hdr:]))
+	start := (size + PUNCH_BLOCK - 1) / PUNCH_BLOCK * PUNCH_BLOCK
+	end := hdr / PUNCH_BLOCK * PUNCH_BLOCK
+	if size == 0 || start >= end {
+		return nil
+	}
+	return punchHole(db.fd, offset+int64(start), int64(end-start))
+}
+
+// panics with a *ChecksumError like pageVerify
+func pageDecompress(db *KV, ptr uint64, page []byte) []byte {
+	hdr := len(page) - btree.BTREE_PAGE_RESERVED
+	size := int(binary.LittleEndian.Uint32(page[hdr:]))
+	if size == 0 {
+		return page // raw
+	}
+	if size >= hdr {
+		panic(&ChecksumError{Page: ptr})
+	}
+	out, err := db.compress.Decompress(make([]byte, 0, len(page)), page[:size])
+	if err != nil || len(out) != hdr {
+		panic(&ChecksumError{Page: ptr})
+	}
+	return out[:len(page)]
+}
@@ -0,0 +1,125 @@
+package kv
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+/*
+encryption at rest, from FORMAT_ENCRYPTED on; see KV.Key.
+
+each page is encrypted with AES-GCM under a random nonce, with the page
+number as the additional data, so a page can't be moved to another place.
+the GCM tag replaces the checksum:
+| ciphertext | tag | nonce |
+|            | 16B |  12B  |
+the ciphertext includes the compression header, and the tag and the nonce
+are in btree.BTREE_PAGE_RESERVED.
+
+the meta page is not encrypted. it holds a key check value, the tag of an
+empty message, so a wrong key is reported by Open.
+*/
+
+const (
+	CRYPT_KEY_SIZE = 32 // AES-256
+	CRYPT_TAIL     = 28 // the tag and the nonce at the end of a page
+)
+
+var ErrBadKey = errors.New("bad encryption key")
+
+// the nonce of the key check value; page nonces are random
+var cryptCheckNonce = make([]byte, 12)
+
+// set up the cipher from KV.Key
+func cryptInit(db *KV) error {
+	if db.Key == nil {
+		return nil
+	}
+	if len(db.Key) != CRYPT_KEY_SIZE {
+		return fmt.Errorf("%w: %d bytes, expected %d", ErrBadKey, len(db.Key), CRYPT_KEY_SIZE)
+	}
+	block, err := aes.NewCipher(db.Key)
+	if err != nil {
+		return err
+	}
+	if db.aead, err = cipher.NewGCM(block); err != nil {
+		return err
+	}
+	db.keyCheck = db.aead.Seal(nil, cryptCheckNonce, nil, []byte(DB_SIG))
+	return nil
+}
+
+// compare the key with the key check value in the meta page
+func cryptCheck(db *KV, keyCheck []byte) error {
+	switch {
+	case db.format == FORMAT_ENCRYPTED && db.aead == nil:
+		return fmt.Errorf("%w: the file is encrypted", ErrBadKey)
+	case db.format != FORMAT_ENCRYPTED && db.aead != nil:
+		return fmt.Errorf("%w: the file is not encrypted", ErrBadKey)
+	case db.aead != nil && subtle.ConstantTimeCompare(keyCheck, db.keyCheck) != 1:
+		return ErrBadKey
+	}
+	return nil
+}
+
+func pageEncrypt(aead cipher.AEAD, ptr uint64, page []byte) []byte {
+	var ad [8]byte
+	binary.LittleEndian.PutUint64(ad[:], ptr)
+	out := make([]byte, len(page))
+	data := len(page) - CRYPT_TAIL
+	nonce := out[data+16:]
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err) // never fails
+	}
+	aead.Seal(out[:0], nonce, page[:data], ad[:])
+	return out
+}
+
+// panics with a *ChecksumError like pageVerify
+func pageDecrypt(aead cipher.AEAD, ptr uint64, page []byte) []byte {
+	var ad [8]byte
+	binary.LittleEndian.PutUint64(ad[:], ptr)
+	out := make([]byte, len(page))
+	data := len(page) - CRYPT_TAIL
+	nonce := page[data+16:]
+	if _, err := aead.Open(out[:0], nonce, page[:data+16], ad[:]); err != nil {
+		panic(&ChecksumError{Page: ptr})
+	}
+	return out
+}
+
+// prepare a page to be written: compress it, then set the checksum or encrypt it
+func pageEncode(db *KV, ptr uint64, page []byte) []byte {
+	if db.compress != nil {
+		page = pageCompress(db, page)
+	}
+	switch db.format {
+	case FORMAT_CHECKSUM:
+		pageSetChecksum(page)
+	case FORMAT_ENCRYPTED:
+		page = pageEncrypt(db.aead, ptr, page)
+	}
+	return page
+}
+
+// the reverse of pageEncode
+func pageDecode(db *KV, ptr uint64, page []byte) []byte {
+	if db.Logger != nil {
+		defer logChecksum(db, ptr)
+	}
+	switch db.format {
+	case FORMAT_CHECKSUM:
+		pageVerify(ptr, page)
+	case FORMAT_ENCRYPTED:
+		page = pageDecrypt(db.aead, ptr, page)
+	}
+	if db.compress != nil {
+		page = pageDecompress(db, ptr, page)
+	}
+	return page
+}
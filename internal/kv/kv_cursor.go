@@ -0,0 +1,149 @@
+package kv
+
+import (
+	"bytes"
+
+	"github.com/Adit0507/AdiDB/internal/btree_iter"
+)
+
+/*
+raw cursor over the keys of the file, for tools below the table layer:
+checkers, debugging, and scans of a key prefix such as the 4-byte prefix
+of a table. like a backup, it holds a read-only transaction, so it reads
+the version at the time it was opened and its pages are not reused until
+Close. keys and values stay valid until then.
+
+a cursor is either on a key or invalid. First, Last, Seek and SeekPrefix
+position it; Next and Prev move it by one key. moving past either end,
+Prev from the first key or Next from the last, makes it invalid, and it
+stays invalid until the next seek: Next and Prev do nothing then.
+SeekPrefix bounds the cursor to the keys with the prefix, so a move out of
+them is the same as moving past an end. the other seeks remove the bound.
+*/
+
+type Cursor struct {
+	tx     *KVTX
+	db     *KV
+	iter   *btree_iter.BIter // nil for an empty tree
+	prefix []byte            // the bound of SeekPrefix
+	valid  bool
+	err    error // a corrupted page; the cursor stays invalid
+}
+
+// a cursor over the latest version; it must be closed
+func (db *KV) Cursor() *Cursor {
+	c := &Cursor{tx: &KVTX{}, db: db}
+	db.BeginRead(c.tx)
+	return c
+}
+
+func (c *Cursor) Close() {
+	if !c.tx.done {
+		c.db.Abort(c.tx)
+	}
+	c.iter, c.valid = nil, false
+}
+
+// position it with `seek`, nil for an empty tree
+func cursorSeek(c *Cursor, prefix []byte, seek func() *btree_iter.BIter) {
+	c.iter, c.prefix, c.valid = nil, prefix, false
+	if c.err != nil {
+		return
+	}
+	defer checksumRecover(&c.err)
+	if c.tx.snapshot.root != 0 {
+		c.iter = seek()
+		cursorCheck(c)
+	}
+}
+
+// the position is on a key in the bound
+func cursorCheck(c *Cursor) {
+	c.valid = c.iter.Valid()
+	if c.valid && c.prefix != nil {
+		c.valid = bytes.HasPrefix(c.iter.Key(), c.prefix)
+	}
+}
+
+// the first key
+func (c *Cursor) First() {
+	cursorSeek(c, nil, func() *btree_iter.BIter {
+		return c.tx.snapshot.Seek(nil, btree_iter.CMP_GT)
+	})
+}
+
+// the last key
+func (c *Cursor) Last() {
+	cursorSeek(c, nil, func() *btree_iter.BIter {
+		return c.tx.snapshot.SeekLast()
+	})
+}
+
+// the closest key that compares with `key` by `cmp`, a btree_iter.CMP_*.
+// CMP_GE and CMP_GT find the smallest such key, CMP_LE and CMP_LT the
+// largest.
+func (c *Cursor) Seek(key []byte, cmp int) {
+	cursorSeek(c, nil, func() *btree_iter.BIter {
+		return c.tx.snapshot.Seek(key, cmp)
+	})
+}
+
+// the first key with the prefix; the cursor is bounded to them
+func (c *Cursor) SeekPrefix(prefix []byte) {
+	prefix = bytes.Clone(prefix)
+	if prefix == nil {
+		prefix = []byte{}
+	}
+	cursorSeek(c, prefix, func() *btree_iter.BIter {
+		return c.tx.snapshot.Seek(prefix, btree_iter.CMP_GE)
+	})
+}
+
+func (c *Cursor) Next() {
+	if !c.valid {
+		return
+	}
+	defer checksumRecover(&c.err)
+	c.valid = false
+	c.iter.Next()
+	cursorCheck(c)
+}
+
+func (c *Cursor) Prev() {
+	if !c.valid {
+		return
+	}
+	defer checksumRecover(&c.err)
+	c.valid = false
+	c.iter.Prev()
+	cursorCheck(c)
+}
+
+// on a key
+func (c *Cursor) Valid() bool {
+	return c.valid
+}
+
+// the current key; nil if not valid
+func (c *Cursor) Key() []byte {
+	if !c.valid {
+		return nil
+	}
+	return c.iter.Key()
+}
+
+// the current value; nil if not valid
+func (c *Cursor) Val() (val []byte) {
+	if !c.valid {
+		return nil
+	}
+	defer func() { c.valid = c.err == nil }()
+	defer checksumRecover(&c.err)
+	_, val = c.iter.Deref()
+	return val
+}
+
+// the error of a corrupted page, after which the cursor is invalid
+func (c *Cursor) Err() error {
+	return c.err
+}
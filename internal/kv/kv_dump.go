@@ -0,0 +1,223 @@
+package kv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"github.com/Adit0507/AdiDB/internal/btree"
+)
+
+/*
+a human readable dump of the file for debugging, the companion of Check:
+the pages of the tree with their keys, and the free list.
+
+the tree is the snapshot of a read-only transaction, so the dump runs
+beside the writers, and its pages are not reused until it ends. the free
+list is not part of a snapshot; its pages are collected when the
+transaction begins, with the lock held, so they are of the same version.
+commits only wait for that.
+
+a dump doesn't trust the file. a page is checked before it's decoded and
+a page pointer before it's followed, and a bad or repeated page is printed
+as such and skipped, so a corrupt file shows what's left of it instead of
+failing.
+*/
+
+type KVDumpOptions struct {
+	// only the pages with keys starting with it, such as a table prefix;
+	// nil for all
+	Prefix []byte
+	// a description of a leaf key, such as its decoded values; nil for
+	// none. called for keys of any kind, including bad ones.
+	Key func(key []byte) string
+}
+
+type dumper struct {
+	w     io.Writer
+	err   error // of the writer
+	tree  *btree.BTree
+	pages uint64   // in the snapshot
+	seen  []uint64 // bitmap of the pages printed
+	opts  KVDumpOptions
+	end   []byte // after the keys of the prefix; nil for no limit
+}
+
+// the free list of the latest version
+type dumpFree struct {
+	headPage uint64
+	headSeq  uint64
+	tailPage uint64
+	tailSeq  uint64
+	nodes    []uint64
+	items    []uint64
+	err      error // where the walk stopped
+}
+
+func (d *dumper) printf(format string, args ...any) {
+	if d.err == nil {
+		_, d.err = fmt.Fprintf(d.w, format, args...)
+	}
+}
+
+// write the pages of the tree and the free list to `w`; see the top. an
+// error is from the writer; the problems of the file are in the dump.
+func (db *KV) DebugDump(w io.Writer, opts KVDumpOptions) error {
+	tx := KVTX{}
+	db.mutex.Lock()
+	txBegin(db, &tx)
+	tx.readOnly = true
+	pages := db.page.flushed
+	free := dumpFreeList(db)
+	db.mutex.Unlock()
+	defer db.Abort(&tx)
+
+	d := &dumper{
+		w: w, tree: &tx.snapshot, pages: pages, opts: opts,
+		seen: make([]uint64, (pages+63)/64),
+	}
+	if len(opts.Prefix) > 0 {
+		d.end = prefixEnd(opts.Prefix)
+	}
+	d.printf("version %d, page size %d, %d pages, root %d\n",
+		tx.version, db.page.size, pages, tx.snapshot.root)
+	if tx.snapshot.root != 0 {
+		d.node(tx.snapshot.root, 0)
+	}
+	d.freeList(free)
+	return d.err
+}
+
+// the keys after all the keys starting with `prefix`; nil for no limit
+func prefixEnd(prefix []byte) []byte {
+	end := bytes.Clone(prefix)
+	for len(end) > 0 && end[len(end)-1] == 0xff {
+		end = end[:len(end)-1]
+	}
+	if len(end) == 0 {
+		return nil
+	}
+	end[len(end)-1]++
+	return end
+}
+
+// a page of the snapshot, or why it can't be read
+func (d *dumper) read(ptr uint64) (page []byte, err error) {
+	if ptr == 0 || ptr >= d.pages {
+		return nil, fmt.Errorf("out of range")
+	}
+	if bitGet(d.seen, ptr) {
+		return nil, fmt.Errorf("already printed")
+	}
+	bitSet(d.seen, ptr)
+	defer checksumRecover(&err)
+	return d.tree.get(ptr), nil
+}
+
+// the subtree at `ptr`, whose keys may start with the prefix
+func (d *dumper) node(ptr uint64, depth int) {
+	indent := fmt.Sprintf("%*s", 2*depth, "")
+	page, err := d.read(ptr)
+	if err == nil {
+		err = nodeCheck(d.tree, btree.BNode(page))
+	}
+	if err != nil {
+		d.printf("%spage %d: BAD: %v\n", indent, ptr, err)
+		return
+	}
+	node := btree.BNode(page)
+	nkeys := node.nkeys()
+	if node.btype() == btree.BNODE_LEAF {
+		d.printf("%spage %d: leaf, %d keys\n", indent, ptr, nkeys)
+		for i := uint16(0); i < nkeys && d.err == nil; i++ {
+			d.leafKV(indent, node, i)
+		}
+		return
+	}
+
+	d.printf("%spage %d: node, %d keys\n", indent, ptr, nkeys)
+	for i := uint16(0); i < nkeys && d.err == nil; i++ {
+		// the kid has the keys in [key i, key i+1)
+		if i+1 < nkeys && bytes.Compare(node.getKey(i+1), d.opts.Prefix) <= 0 {
+			continue
+		}
+		if d.end != nil && bytes.Compare(node.getKey(i), d.end) >= 0 {
+			break
+		}
+		d.printf("%s  key %d: %x -> page %d\n", indent, i, node.getKey(i), node.getPtr(i))
+		d.node(node.getPtr(i), depth+1)
+	}
+}
+
+func (d *dumper) leafKV(indent string, node btree.BNode, idx uint16) {
+	key, val := node.getKey(idx), node.getVal(idx)
+	if !bytes.HasPrefix(key, d.opts.Prefix) {
+		return
+	}
+	d.printf("%s  key %d: %s", indent, idx, hex.EncodeToString(key))
+	if len(key) == 0 {
+		d.printf(" (sentinel)")
+	} else if d.opts.Key != nil {
+		d.printf(" %s", d.opts.Key(key))
+	}
+	if node.isOverflow(idx) {
+		size := binary.LittleEndian.Uint64(val[0:8])
+		first := binary.LittleEndian.Uint64(val[8:16])
+		d.printf(", value %d bytes in overflow pages from %d\n", size, first)
+	} else {
+		d.printf(", value %d bytes\n", len(val))
+	}
+}
+
+// collect the free list with the lock held. the walk stops at a node out
+// of the file.
+func dumpFreeList(db *KV) (f dumpFree) {
+	fl := &db.free
+	f.headPage, f.headSeq, f.tailPage, f.tailSeq = fl.headPage, fl.headSeq, fl.tailPage, fl.tailSeq
+	if fl.tailSeq-fl.headSeq >= db.page.flushed {
+		f.err = fmt.Errorf("bad list size: %d", fl.tailSeq-fl.headSeq)
+		return f
+	}
+	defer checksumRecover(&f.err)
+	ptr := fl.headPage
+	f.nodes = append(f.nodes, ptr)
+	for seq := fl.headSeq; seq != fl.tailSeq; {
+		if ptr == 0 || ptr >= db.page.flushed {
+			f.err = fmt.Errorf("list node %d: out of range", ptr)
+			return f
+		}
+		node := LNode(fl.get(ptr))
+		item, _ := node.getPtr(seq2idx(fl, seq))
+		f.items = append(f.items, item)
+		seq++
+		if seq2idx(fl, seq) == 0 {
+			ptr = node.getNext()
+			f.nodes = append(f.nodes, ptr)
+		}
+	}
+	return f
+}
+
+func (d *dumper) freeList(f dumpFree) {
+	d.printf("free list: head page %d seq %d, tail page %d seq %d\n",
+		f.headPage, f.headSeq, f.tailPage, f.tailSeq)
+	d.printf("  nodes:%s\n", dumpPtrs(f.nodes, d.pages))
+	d.printf("  free pages:%s\n", dumpPtrs(f.items, d.pages))
+	if f.err != nil {
+		d.printf("  BAD: %v\n", f.err)
+	}
+}
+
+// page numbers, the bad ones marked
+func dumpPtrs(ptrs []uint64, pages uint64) string {
+	out := []byte(nil)
+	for _, ptr := range ptrs {
+		out = fmt.Appendf(out, " %d", ptr)
+		if ptr == 0 || ptr >= pages {
+			out = append(out, "(out of range)"...)
+		}
+	}
+	return string(out)
+}
@@ -0,0 +1,65 @@
+package kv
+
+import "github.com/Adit0507/AdiDB/internal/btree"
+
+/*
+the file operations of the platforms. an open file is an int: the fd on
+Unix and the HANDLE on Windows, so KV.Fsync has the same type everywhere.
+each platform file has:
+- createFileSync, fileOpenRead, fileClose and fileLen.
+- filePread and filePwrite at an offset; a read past the end of the file
+  gives zeros, like the mmap.
+- fileSync, the default KV.Fsync, and fileTruncate.
+- fileMap and fileUnmap for a read-only mapping; mapAvailable and
+  mapPastEOF say what they can do.
+- lockRange and lockFileWait; see kv_lock.go.
+- syncDir, for a file created or renamed in a directory.
+
+Unix (kv_file_unix.go) maps the file with mmap in chunks that go past the
+end of the file, so a chunk covers the file as it grows; see extendMmap.
+
+Windows (kv_file_windows.go) maps views with CreateFileMapping and
+MapViewOfFile, but a read-only view can't go past the end of the file.
+so a chunk is only mapped once the file covers all of it, and the pages
+of the tail after the last chunk are read with ReadFile into a new buffer
+(pageReadFile), which the page cache keeps with KV.CacheSize. the views
+are read-only and the pages are written with WriteFile, so a flush is
+FlushFileBuffers of the handle, as fsync is. a file can't be truncated
+below a view, so Vacuum only reclaims the space after the mapped part.
+
+elsewhere (kv_file_other.go), the file is an *os.File behind an int,
+nothing is mapped, every page is read with ReadAt, and there are no
+locks.
+
+the order of the writes doesn't depend on the platform: the pages are
+written and synced before the meta page is written and synced, as in
+updateFile.
+*/
+
+// a page as it's stored, from the chunks of a snapshot or from the file
+func pageReadRaw(db *KV, ptr uint64, chunks [][]byte) []byte {
+	if page := mmapRead(ptr, db.page.size, chunks); page != nil {
+		return page
+	}
+	return pageReadFile(db, ptr)
+}
+
+// a page past the mapped part of the file; see the top. the B+tree
+// callbacks can't return errors, so a page that can't be read is
+// reported as a bad one.
+func pageReadFile(db *KV, ptr uint64) []byte {
+	page := make([]byte, db.page.size)
+	if err := filePread(db.fd, page, int64(ptr)*int64(db.page.size)); err != nil {
+		panic(&ChecksumError{Page: ptr})
+	}
+	return page
+}
+
+// the meta page at the start of the file
+func fileHead(db *KV) ([]byte, error) {
+	if len(db.mmap.chunks) > 0 {
+		return db.mmap.chunks[0], nil
+	}
+	data := make([]byte, btree.BTREE_MIN_PAGE_SIZE)
+	return data, filePread(db.fd, data, 0)
+}
@@ -0,0 +1,144 @@
+//go:build !unix && !windows
+
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// see kv_file.go
+const (
+	mapAvailable = false
+	mapPastEOF   = false
+)
+
+// the open files by their int, which is not a small one, so it's not
+// mistaken for an fd of the platform (see fileSync)
+var otherFiles = struct {
+	sync.Mutex
+	next  int
+	files map[int]*os.File
+}{next: 1 << 20, files: map[int]*os.File{}}
+
+func otherFile(fd int) (*os.File, error) {
+	otherFiles.Lock()
+	defer otherFiles.Unlock()
+	if fp := otherFiles.files[fd]; fp != nil {
+		return fp, nil
+	}
+	return nil, os.ErrClosed
+}
+
+func otherOpen(file string, flags int) (int, error) {
+	fp, err := os.OpenFile(file, flags, 0o644)
+	if err != nil {
+		return -1, err
+	}
+	otherFiles.Lock()
+	defer otherFiles.Unlock()
+	fd := otherFiles.next
+	otherFiles.next++
+	otherFiles.files[fd] = fp
+	return fd, nil
+}
+
+// open or create a file; the directory is not synced
+func createFileSync(file string) (int, error) {
+	fd, err := otherOpen(file, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		return -1, fmt.Errorf("open file: %w", err)
+	}
+	return fd, nil
+}
+
+func fileOpenRead(file string) (int, error) {
+	return otherOpen(file, os.O_RDONLY)
+}
+
+func fileClose(fd int) error {
+	otherFiles.Lock()
+	fp := otherFiles.files[fd]
+	delete(otherFiles.files, fd)
+	otherFiles.Unlock()
+	if fp == nil {
+		return os.ErrClosed
+	}
+	return fp.Close()
+}
+
+func fileLen(fd int) (int64, error) {
+	fp, err := otherFile(fd)
+	if err != nil {
+		return 0, err
+	}
+	finfo, err := fp.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return finfo.Size(), nil
+}
+
+func filePread(fd int, data []byte, offset int64) error {
+	fp, err := otherFile(fd)
+	if err != nil {
+		return err
+	}
+	n, err := fp.ReadAt(data, offset)
+	if errors.Is(err, io.EOF) {
+		clear(data[n:]) // past the end
+		return nil
+	}
+	return err
+}
+
+func filePwrite(fd int, data []byte, offset int64) error {
+	fp, err := otherFile(fd)
+	if err != nil {
+		return err
+	}
+	_, err = fp.WriteAt(data, offset)
+	return err
+}
+
+// a file that is not of this registry, such as the temporary file of
+// KV.Backup, is not synced
+func fileSync(fd int) error {
+	fp, err := otherFile(fd)
+	if err != nil {
+		return nil
+	}
+	return fp.Sync()
+}
+
+func fileTruncate(fd int, size int64) error {
+	fp, err := otherFile(fd)
+	if err != nil {
+		return err
+	}
+	return fp.Truncate(size)
+}
+
+func fileMap(fd int, offset int64, size int) ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func fileUnmap(chunk []byte) error {
+	return errors.ErrUnsupported
+}
+
+// no locks
+func lockRange(fd int, exclusive bool, start int64) error {
+	return nil
+}
+
+func lockFileWait(fd int) (unlock func(), err error) {
+	return func() {}, nil
+}
+
+func syncDir(db *KV, dir string) error {
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package kv
+
+import "testing"
+
+// not known; see kv_file_unix_test.go
+func diskUsage(t testing.TB, path string) (int64, bool) {
+	return 0, false
+}
@@ -0,0 +1,117 @@
+//go:build unix
+
+package kv
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// see kv_file.go
+const (
+	mapAvailable = true
+	mapPastEOF   = true
+)
+
+// open or create a file and fsync the directory
+func createFileSync(file string) (int, error) {
+	// obtain the directory fd
+	flags := os.O_RDONLY | syscall.O_DIRECTORY
+	dirfd, err := syscall.Open(path.Dir(file), flags, 0o644)
+	if err != nil {
+		return -1, fmt.Errorf("open directory: %w", err)
+	}
+	defer syscall.Close(dirfd)
+	// open or create the file
+	flags = os.O_RDWR | os.O_CREATE
+	fd, err := unix.Openat(dirfd, path.Base(file), flags, 0o644)
+	if err != nil {
+		return -1, fmt.Errorf("open file: %w", err)
+	}
+	// fsync the directory
+	err = syscall.Fsync(dirfd)
+	if err != nil { // may leave an empty file
+		_ = syscall.Close(fd)
+		return -1, fmt.Errorf("fsync directory: %w", err)
+	}
+	// done
+	return fd, nil
+}
+
+func fileOpenRead(file string) (int, error) {
+	return syscall.Open(file, os.O_RDONLY, 0)
+}
+
+func fileClose(fd int) error {
+	return syscall.Close(fd)
+}
+
+func fileLen(fd int) (int64, error) {
+	finfo := syscall.Stat_t{}
+	if err := syscall.Fstat(fd, &finfo); err != nil {
+		return 0, err
+	}
+	return finfo.Size, nil
+}
+
+func filePread(fd int, data []byte, offset int64) error {
+	for len(data) > 0 {
+		n, err := unix.Pread(fd, data, offset)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			clear(data) // past the end
+			return nil
+		}
+		data, offset = data[n:], offset+int64(n)
+	}
+	return nil
+}
+
+func filePwrite(fd int, data []byte, offset int64) error {
+	_, err := unix.Pwrite(fd, data, offset)
+	return err
+}
+
+func fileSync(fd int) error {
+	return syscall.Fsync(fd)
+}
+
+func fileTruncate(fd int, size int64) error {
+	return syscall.Ftruncate(fd, size)
+}
+
+// a read-only shared mapping; it may go past the end of the file
+func fileMap(fd int, offset int64, size int) ([]byte, error) {
+	return syscall.Mmap(fd, offset, size, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func fileUnmap(chunk []byte) error {
+	return syscall.Munmap(chunk)
+}
+
+// an exclusive flock of the whole file, waiting for it; see KV.LockFile
+func lockFileWait(fd int) (unlock func(), err error) {
+	if err := unix.Flock(fd, unix.LOCK_EX); err != nil {
+		return nil, err
+	}
+	return func() { unix.Flock(fd, unix.LOCK_UN) }, nil
+}
+
+// make a rename persistent
+func syncDir(db *KV, dir string) error {
+	dirfd, err := syscall.Open(dir, os.O_RDONLY|syscall.O_DIRECTORY, 0o644)
+	if err != nil {
+		return fmt.Errorf("open directory: %w", err)
+	}
+	defer syscall.Close(dirfd)
+	if err := fsyncCounted(db, dirfd); err != nil {
+		return fmt.Errorf("fsync directory: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package kv
+
+import (
+	"syscall"
+	"testing"
+
+	is "github.com/stretchr/testify/require"
+)
+
+// the disk space allocated to a file
+func diskUsage(t testing.TB, path string) (int64, bool) {
+	finfo := syscall.Stat_t{}
+	is.Nil(t, syscall.Stat(path, &finfo))
+	return finfo.Blocks * 512, true
+}
@@ -0,0 +1,159 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// see kv_file.go
+const (
+	mapAvailable = true
+	mapPastEOF   = false
+)
+
+// the locks of kv_lock.go are at lockBase + LOCK_WRITER or LOCK_READER,
+// and the one of KV.LockFile after them. a lock on Windows keeps the
+// other handles from the bytes, so they are far past the pages.
+const (
+	lockBase     = 1 << 40
+	lockFileByte = LOCK_READER + 1
+)
+
+// open or create a file. a directory can't be synced; NTFS logs the new
+// name itself.
+func createFileSync(file string) (int, error) {
+	fd, err := fileOpen(file, windows.GENERIC_READ|windows.GENERIC_WRITE, windows.OPEN_ALWAYS)
+	if err != nil {
+		return -1, fmt.Errorf("open file: %w", err)
+	}
+	return fd, nil
+}
+
+func fileOpenRead(file string) (int, error) {
+	return fileOpen(file, windows.GENERIC_READ, windows.OPEN_EXISTING)
+}
+
+func fileOpen(file string, access uint32, mode uint32) (int, error) {
+	name, err := windows.UTF16PtrFromString(file)
+	if err != nil {
+		return -1, err
+	}
+	// shared like a Unix file, so it can be renamed and removed while open
+	share := uint32(windows.FILE_SHARE_READ | windows.FILE_SHARE_WRITE | windows.FILE_SHARE_DELETE)
+	h, err := windows.CreateFile(name, access, share, nil, mode, windows.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		return -1, err
+	}
+	return int(h), nil
+}
+
+func fileClose(fd int) error {
+	return windows.CloseHandle(windows.Handle(fd))
+}
+
+func fileLen(fd int) (int64, error) {
+	info := windows.ByHandleFileInformation{}
+	if err := windows.GetFileInformationByHandle(windows.Handle(fd), &info); err != nil {
+		return 0, err
+	}
+	return int64(info.FileSizeHigh)<<32 | int64(info.FileSizeLow), nil
+}
+
+// the position of a read or a write; the file pointer is not used, so
+// the reads of the readers don't race with each other
+func fileOffset(offset int64) *windows.Overlapped {
+	return &windows.Overlapped{Offset: uint32(offset), OffsetHigh: uint32(offset >> 32)}
+}
+
+func filePread(fd int, data []byte, offset int64) error {
+	for len(data) > 0 {
+		n := uint32(0)
+		err := windows.ReadFile(windows.Handle(fd), data, &n, fileOffset(offset))
+		if errors.Is(err, windows.ERROR_HANDLE_EOF) || (err == nil && n == 0) {
+			clear(data) // past the end
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		data, offset = data[n:], offset+int64(n)
+	}
+	return nil
+}
+
+func filePwrite(fd int, data []byte, offset int64) error {
+	for len(data) > 0 {
+		n := uint32(0)
+		err := windows.WriteFile(windows.Handle(fd), data, &n, fileOffset(offset))
+		if err != nil {
+			return err
+		}
+		data, offset = data[n:], offset+int64(n)
+	}
+	return nil
+}
+
+// the views are read-only, so there's nothing to FlushViewOfFile
+func fileSync(fd int) error {
+	return windows.FlushFileBuffers(windows.Handle(fd))
+}
+
+// without the file pointer, like the reads
+func fileTruncate(fd int, size int64) error {
+	return windows.SetFileInformationByHandle(windows.Handle(fd),
+		windows.FileEndOfFileInfo, (*byte)(unsafe.Pointer(&size)), uint32(unsafe.Sizeof(size)))
+}
+
+// a read-only view, within the file. the view keeps the mapping object,
+// so its handle is closed at once.
+func fileMap(fd int, offset int64, size int) ([]byte, error) {
+	end := offset + int64(size)
+	m, err := windows.CreateFileMapping(windows.Handle(fd), nil, windows.PAGE_READONLY,
+		uint32(end>>32), uint32(end), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer windows.CloseHandle(m)
+	addr, err := windows.MapViewOfFile(m, windows.FILE_MAP_READ,
+		uint32(offset>>32), uint32(offset), uintptr(size))
+	if err != nil {
+		return nil, err
+	}
+	// the address is of the view, not of Go memory
+	return unsafe.Slice(*(**byte)(unsafe.Pointer(&addr)), size), nil
+}
+
+func fileUnmap(chunk []byte) error {
+	return windows.UnmapViewOfFile(uintptr(unsafe.Pointer(&chunk[0])))
+}
+
+// a lock on a byte of the handle; fails with errLockBusy if it's taken
+func lockRange(fd int, exclusive bool, start int64) error {
+	flags := uint32(windows.LOCKFILE_FAIL_IMMEDIATELY)
+	if exclusive {
+		flags |= windows.LOCKFILE_EXCLUSIVE_LOCK
+	}
+	err := windows.LockFileEx(windows.Handle(fd), flags, 0, 1, 0, fileOffset(lockBase+start))
+	if errors.Is(err, windows.ERROR_LOCK_VIOLATION) {
+		return errLockBusy
+	}
+	return err
+}
+
+// an exclusive lock of lockFileByte, waiting for it; see KV.LockFile
+func lockFileWait(fd int) (unlock func(), err error) {
+	h := windows.Handle(fd)
+	err = windows.LockFileEx(h, windows.LOCKFILE_EXCLUSIVE_LOCK, 0, 1, 0, fileOffset(lockBase+lockFileByte))
+	if err != nil {
+		return nil, err
+	}
+	return func() { windows.UnlockFileEx(h, 0, 1, 0, fileOffset(lockBase+lockFileByte)) }, nil
+}
+
+// a rename is persistent without it; see createFileSync
+func syncDir(db *KV, dir string) error {
+	return nil
+}
@@ -0,0 +1,42 @@
+package kv
+
+import "fmt"
+
+/*
+file growth. by default, the file grows as pages are written past its end.
+with KV.InitialSize, KV.GrowChunk or KV.GrowFactor, it's extended ahead of
+the writes in larger steps instead, and with KV.Fallocate the disk space is
+reserved as well, so later writes don't allocate blocks.
+
+the pages in use are still the page count in the meta page; the space after
+them is unused, and it's truncated by Vacuum. Open only requires the file
+size to be a multiple of the page size, so the extended size is rounded up.
+*/
+
+// make room for the file to be `need` bytes
+func growFile(db *KV, need int64) error {
+	if need <= db.page.file {
+		return nil
+	}
+	db.page.grows++
+	if db.InitialSize <= 0 && db.GrowChunk <= 0 && db.GrowFactor <= 0 && !db.Fallocate {
+		db.page.file = need // by the writes
+		return nil
+	}
+
+	size := max(need, db.InitialSize, db.page.file+db.GrowChunk,
+		db.page.file+int64(float64(db.page.file)*db.GrowFactor))
+	page := int64(db.page.size)
+	size = (size + page - 1) / page * page
+	var err error
+	if db.Fallocate {
+		err = fallocate(db.fd, size)
+	} else {
+		err = fileTruncate(db.fd, size)
+	}
+	if err != nil {
+		return fmt.Errorf("grow file: %w", err)
+	}
+	db.page.file = size
+	return nil
+}
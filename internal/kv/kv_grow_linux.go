@@ -0,0 +1,18 @@
+package kv
+
+import "golang.org/x/sys/unix"
+
+// extend the file to `size` bytes with the disk space allocated
+func fallocate(fd int, size int64) error {
+	return unix.Fallocate(fd, 0, 0, size)
+}
+
+// free the disk space of a range of the file, which then reads as zeros.
+// a file system without holes keeps the zeros.
+func punchHole(fd int, offset int64, size int64) error {
+	err := unix.Fallocate(fd, unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, offset, size)
+	if err == unix.EOPNOTSUPP {
+		return nil
+	}
+	return err
+}
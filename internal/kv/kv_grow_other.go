@@ -0,0 +1,13 @@
+//go:build !linux
+
+package kv
+
+// no fallocate; the file is only extended
+func fallocate(fd int, size int64) error {
+	return fileTruncate(fd, size)
+}
+
+// no holes; the zeros are written and stay allocated
+func punchHole(fd int, offset int64, size int64) error {
+	return nil
+}
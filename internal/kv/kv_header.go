@@ -0,0 +1,88 @@
+package kv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+/*
+the header of the file is the start of the meta page: the signature, then
+the format word after the pointers (see loadMeta):
+
+| version | compression | page_shift | unused | features |
+|    1B   |      1B     |     1B     |   1B   |    4B    |
+
+the version is FORMAT_*, the layout of the pages. the features are the
+FEATURE_* a reader must support to use the file; a build refuses a file with
+a feature it doesn't know instead of misreading it. they repeat what the
+other fields say, and must agree with them.
+
+files written before the features have 0 there. they are opened as before,
+with the features taken from the other fields, and the next update of the
+meta page writes them, so the file is migrated by its first commit.
+*/
+
+// KV.Open rejects a file that needs a feature this build doesn't know
+const (
+	FEATURE_CHECKSUM   = 1 << 0 // page checksums; FORMAT_CHECKSUM
+	FEATURE_ENCRYPTED  = 1 << 1 // FORMAT_ENCRYPTED; see kv_crypt.go
+	FEATURE_COMPRESSED = 1 << 2 // a compression method; see kv_compress.go
+	FEATURE_KNOWN      = FEATURE_CHECKSUM | FEATURE_ENCRYPTED | FEATURE_COMPRESSED
+)
+
+var (
+	// the file doesn't start with DB_SIG
+	ErrNotADatabase = fmt.Errorf("%w: not a database", ErrBadFile)
+	// the file has a later FORMAT_* than this build
+	ErrVersionTooNew = errors.New("the file format is too new")
+	// the file uses a feature or a method this build doesn't support
+	ErrUnsupportedFeature = errors.New("unsupported feature")
+)
+
+// the features of the file, from the fields of the meta page
+func headerFeatures(format uint64, method byte) uint32 {
+	features := uint32(0)
+	switch format {
+	case FORMAT_CHECKSUM:
+		features |= FEATURE_CHECKSUM
+	case FORMAT_ENCRYPTED:
+		features |= FEATURE_ENCRYPTED
+	}
+	if method != COMPRESS_NONE {
+		features |= FEATURE_COMPRESSED
+	}
+	return features
+}
+
+// verify the header of the meta page; sets KV.format. the signature and
+// the version come first, since a later version may checksum differently.
+func headerCheck(db *KV, data []byte) (method byte, shift byte, err error) {
+	if !bytes.Equal([]byte(DB_SIG), data[:16]) {
+		return 0, 0, ErrNotADatabase
+	}
+	word := binary.LittleEndian.Uint64(data[72:80])
+	db.format = word & 0xff
+	method, shift = byte(word>>8), byte(word>>16)
+	features := uint32(word >> 32)
+	switch db.format {
+	case FORMAT_NONE:
+	case FORMAT_CHECKSUM, FORMAT_ENCRYPTED:
+		sum := crc32.Checksum(data[:80], castagnoli)
+		if sum != binary.LittleEndian.Uint32(data[80:84]) {
+			return 0, 0, fmt.Errorf("%w: bad meta page", ErrBadFile)
+		}
+	default:
+		return 0, 0, fmt.Errorf("%w: %d, expected at most %d",
+			ErrVersionTooNew, db.format, FORMAT_ENCRYPTED)
+	}
+	if extra := features &^ FEATURE_KNOWN; extra != 0 {
+		return 0, 0, fmt.Errorf("%w: flags 0x%x", ErrUnsupportedFeature, extra)
+	}
+	if features != 0 && features != headerFeatures(db.format, method) {
+		return 0, 0, fmt.Errorf("%w: the features don't match the format", ErrBadFile)
+	}
+	return method, shift, nil
+}
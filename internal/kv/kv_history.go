@@ -0,0 +1,123 @@
+package kv
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+/*
+reading the tree as of an earlier commit. with KV.History, a commit that
+changes the tree keeps the root it replaces with its version, the Seq of
+that commit, in a ring of the latest ones. the ring follows the fields of
+the meta page:
+
+| ... | key_check | count | crc32c | version | root | version | root | ... |
+|     |    16B    |   4B  |   4B   |    8B   |  8B  |    8B   |  8B  | ... |
+
+a ring that fails its checksum is dropped, so a damaged ring or an older
+file only loses the history. the pages of a kept tree are freed by later
+commits, but the free list doesn't reuse them while the oldest version in
+the ring is kept, like a reader of that version (see txFinalize). so the
+file holds the space of every kept tree, and Vacuum doesn't move pages
+while there is history.
+
+in WAL mode the ring is persisted with the meta page at each checkpoint,
+so the commits after it are not kept across a restart.
+*/
+
+// the most versions that KV.History keeps; limited by the meta page
+const HISTORY_MAX = 128
+
+// the version is older than the history kept by KV.History
+var ErrHistoryGone = errors.New("the version is no longer kept")
+
+type histEntry struct {
+	version uint64
+	root    uint64
+}
+
+// the ring in the meta page, oldest first
+func historyLoad(db *KV, data []byte) {
+	db.hist = db.hist[:0]
+	count := int(binary.LittleEndian.Uint32(data[100:104]))
+	if count == 0 || count > HISTORY_MAX {
+		return
+	}
+	ring := data[108 : 108+16*count]
+	if crc32.Checksum(ring, castagnoli) != binary.LittleEndian.Uint32(data[104:108]) {
+		return
+	}
+	for i := 0; i < count; i++ {
+		db.hist = append(db.hist, histEntry{
+			version: binary.LittleEndian.Uint64(ring[16*i:]),
+			root:    binary.LittleEndian.Uint64(ring[16*i+8:]),
+		})
+	}
+}
+
+func historySave(db *KV, data []byte) {
+	ring := data[108:108]
+	for _, h := range db.hist {
+		ring = binary.LittleEndian.AppendUint64(ring, h.version)
+		ring = binary.LittleEndian.AppendUint64(ring, h.root)
+	}
+	binary.LittleEndian.PutUint32(data[100:104], uint32(len(db.hist)))
+	binary.LittleEndian.PutUint32(data[104:108], crc32.Checksum(ring, castagnoli))
+}
+
+// keep the tree of the current version, whose root was `root` before
+// the commit replaced it. called before the version is increased.
+func historyAdd(db *KV, root uint64) {
+	if db.History > 0 && root != 0 {
+		db.hist = append(db.hist, histEntry{db.version, root})
+	}
+	historyTrim(db)
+}
+
+// drop the versions that KV.History doesn't keep
+func historyTrim(db *KV) {
+	keep := min(max(db.History, 0), HISTORY_MAX)
+	if len(db.hist) > keep {
+		db.hist = append(db.hist[:0], db.hist[len(db.hist)-keep:]...)
+	}
+}
+
+// drop the entries of a ring that don't fit the meta page it was read from
+func historyCheck(db *KV) {
+	valid := db.hist[:0]
+	for _, h := range db.hist {
+		if 0 < h.root && h.root < db.page.flushed && versionBefore(h.version, db.version) &&
+			(len(valid) == 0 || versionBefore(valid[len(valid)-1].version, h.version)) {
+			valid = append(valid, h)
+		}
+	}
+	db.hist = valid
+	historyTrim(db)
+}
+
+// the older of `minVer` and the oldest version in the history
+func historyMinVer(db *KV, minVer uint64) uint64 {
+	if len(db.hist) > 0 && versionBefore(db.hist[0].version, minVer) {
+		return db.hist[0].version
+	}
+	return minVer
+}
+
+// the root of a version in the history, or of the current version
+func historyRoot(db *KV, version uint64) (uint64, bool) {
+	if version == db.version {
+		return db.tree.root, true
+	}
+	for _, h := range db.hist {
+		if h.version == version {
+			return h.root, true
+		}
+	}
+	return 0, false
+}
+
+// the Seq of the last commit, for BeginReadAt
+func (db *KV) CurrentSeq() uint64 {
+	return db.Seq()
+}
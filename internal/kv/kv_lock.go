@@ -0,0 +1,63 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+/*
+KV.Open locks the file so that a second process can't write it too, which
+would corrupt it. the locks are advisory byte-range locks on the file:
+
+| writer | reader |
+|   1B   |   1B   |
+
+a writer takes an exclusive lock on the 1st byte, a read-only open a shared
+lock on the 2nd one. so there is one writer at a time, and readers don't
+conflict with it. the locks are for byte ranges, not for the data there,
+and are held until the file is closed, which is also how a failed Open
+releases them.
+
+on Linux the locks belong to the open file, so a second Open in the same
+process is refused too (see kv_lock_linux.go). on the other Unixes they
+are POSIX locks, which belong to the process: only other processes are
+kept out. on Windows, LockFileEx takes the same ranges of the handle, so a
+second Open is refused as on Linux. its locks are mandatory, so they are
+at lockBase, past any data (see kv_file_windows.go). the platforms
+without locks (kv_file_other.go) don't protect the file.
+*/
+
+// KV.Open: another KV has the file open for writing
+var ErrLocked = errors.New("the file is locked by another writer")
+
+// the byte of each lock
+const (
+	LOCK_WRITER = 0
+	LOCK_READER = 1
+)
+
+// lockRange: the lock is taken by another open
+var errLockBusy = errors.New("lock busy")
+
+// take the lock of the open, waiting up to KV.LockTimeout
+func fileLock(db *KV) error {
+	exclusive, start := true, int64(LOCK_WRITER)
+	if db.ReadOnly {
+		exclusive, start = false, LOCK_READER
+	}
+	deadline := time.Now().Add(db.LockTimeout)
+	for {
+		err := lockRange(db.fd, exclusive, start)
+		if err != errLockBusy {
+			if err != nil {
+				return fmt.Errorf("lock file: %w", err)
+			}
+			return nil
+		}
+		if !time.Now().Before(deadline) {
+			return ErrLocked
+		}
+		time.Sleep(min(10*time.Millisecond, time.Until(deadline)))
+	}
+}
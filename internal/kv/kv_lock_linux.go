@@ -0,0 +1,21 @@
+package kv
+
+import (
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// a lock on a byte of the open file; fails with errLockBusy if it's taken
+func lockRange(fd int, exclusive bool, start int64) error {
+	typ := int16(unix.F_RDLCK)
+	if exclusive {
+		typ = unix.F_WRLCK
+	}
+	lk := unix.Flock_t{Type: typ, Whence: 0, Start: start, Len: 1}
+	err := unix.FcntlFlock(uintptr(fd), unix.F_OFD_SETLK, &lk)
+	if errors.Is(err, unix.EAGAIN) {
+		return errLockBusy
+	}
+	return err
+}
@@ -0,0 +1,24 @@
+//go:build unix && !linux
+
+package kv
+
+import (
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// a lock on a byte of the file for the process; fails with errLockBusy if
+// it's taken, which is EAGAIN or EACCES
+func lockRange(fd int, exclusive bool, start int64) error {
+	typ := int16(unix.F_RDLCK)
+	if exclusive {
+		typ = unix.F_WRLCK
+	}
+	lk := unix.Flock_t{Type: typ, Whence: 0, Start: start, Len: 1}
+	err := unix.FcntlFlock(uintptr(fd), unix.F_SETLK, &lk)
+	if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EACCES) {
+		return errLockBusy
+	}
+	return err
+}
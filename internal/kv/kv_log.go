@@ -0,0 +1,60 @@
+package kv
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"log/slog"
+	"time"
+)
+
+/*
+logging of notable events; see KV.Logger.
+
+	Info:  the file is opened, checkpoints, vacuum
+	Warn:  recovery on Open, slow operations (KV.SlowOp)
+	Error: failed updates, bad page checksums, problems found by Check
+	Debug: the free list grows
+
+events are rare, except checksum failures and slow operations, which are
+only checked for with a logger. with no logger, a log call is a nil check.
+*/
+
+func logAt(db *KV, level slog.Level, msg string, args ...any) {
+	if db.Logger != nil {
+		db.Logger.Log(context.Background(), level, msg, args...)
+	}
+}
+
+// log an operation since `start` if it took KV.SlowOp or longer
+func logSlow(db *KV, op string, start time.Time) {
+	if elapsed := time.Since(start); elapsed >= db.SlowOp {
+		logAt(db, slog.LevelWarn, "slow operation", "op", op, "elapsed", elapsed)
+	}
+}
+
+// usage: defer logChecksum(db, ptr). the panic of a bad page goes on.
+func logChecksum(db *KV, ptr uint64) {
+	if r := recover(); r != nil {
+		if _, ok := r.(*ChecksumError); ok {
+			logAt(db, slog.LevelError, "bad page checksum", "path", db.Path, "page", ptr)
+		}
+		panic(r)
+	}
+}
+
+// the position of a key for the log: the hex key, and the table prefix
+func logKey(key []byte) []any {
+	args := []any{"key", hex.EncodeToString(key)}
+	if len(key) >= 4 {
+		args = append(args, "prefix", binary.BigEndian.Uint32(key))
+	}
+	return args
+}
+
+// `FreeList.new`, append a new free list node
+func (db *KV) freeAppend(node []byte) uint64 {
+	ptr := db.pageAppend(node)
+	logAt(db, slog.LevelDebug, "free list grows", "page", ptr)
+	return ptr
+}
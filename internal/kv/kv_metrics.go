@@ -0,0 +1,119 @@
+package kv
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+/*
+instrumentation hooks; see KV.Metrics. the engine reports counts of events
+and the latencies of KVTX operations to a Metrics, which may export them
+elsewhere. with no Metrics, a report is a nil check and the clock is not
+read. readers report concurrently with each other and with the writer, so
+an implementation must be safe for concurrent use.
+
+Counters is a built-in implementation with atomic counters. an adapter to
+Prometheus, with one counter per metric and one histogram per operation, as
+re-exported by the adidb package:
+
+	type promMetrics struct {
+		counts [adidb.METRIC_MAX]prometheus.Counter
+		times  [adidb.KV_OP_MAX]prometheus.Observer
+	}
+
+	func (m *promMetrics) Count(metric adidb.Metric, n uint64) {
+		m.counts[metric].Add(float64(n))
+	}
+
+	func (m *promMetrics) Time(op adidb.Op, d time.Duration) {
+		m.times[op].Observe(d.Seconds())
+	}
+*/
+
+type Metric int
+
+const (
+	METRIC_PAGE_READ   Metric = iota // pages read from the file, not the cache
+	METRIC_PAGE_WRITE                // pages written to the file, not the WAL
+	METRIC_PAGE_REUSE                // pages allocated from the free list
+	METRIC_PAGE_APPEND               // pages allocated at the end of the file
+	METRIC_SPLIT                     // nodes split by updates
+	METRIC_MERGE                     // nodes merged with a sibling by deletes
+	METRIC_COMMIT                    // commits that changed the tree
+	METRIC_FSYNC                     // calls of KV.Fsync
+	METRIC_PREFETCH                  // pages read ahead by scans; see kv_prefetch.go
+	METRIC_MAX
+)
+
+type Op int
+
+const (
+	KV_OP_GET    Op = iota // KVTX.Get
+	KV_OP_UPDATE           // KVTX.Update, without the commit
+	KV_OP_SCAN             // KVTX.Seek, the setup of a range scan
+	KV_OP_MAX
+)
+
+func (op Op) String() string {
+	return [KV_OP_MAX]string{"get", "update", "scan"}[op]
+}
+
+type Metrics interface {
+	// `n` more events of `metric`
+	Count(metric Metric, n uint64)
+	// an operation took `d`
+	Time(op Op, d time.Duration)
+}
+
+func metricCount(db *KV, metric Metric, n uint64) {
+	if db.Metrics != nil && n > 0 {
+		db.Metrics.Count(metric, n)
+	}
+}
+
+// `KV.Fsync`, counted
+func fsyncCounted(db *KV, fd int) error {
+	metricCount(db, METRIC_FSYNC, 1)
+	return db.Fsync(fd)
+}
+
+// a Metrics with atomic counters
+type Counters struct {
+	counts [METRIC_MAX]atomic.Uint64
+	ops    [KV_OP_MAX]struct {
+		count atomic.Uint64
+		nanos atomic.Int64
+	}
+}
+
+type CountersSnapshot struct {
+	Counts [METRIC_MAX]uint64 // by Metric
+	Ops    [KV_OP_MAX]OpStats // by Op
+}
+
+type OpStats struct {
+	Count uint64
+	Total time.Duration
+}
+
+func (c *Counters) Count(metric Metric, n uint64) {
+	c.counts[metric].Add(n)
+}
+
+func (c *Counters) Time(op Op, d time.Duration) {
+	c.ops[op].count.Add(1)
+	c.ops[op].nanos.Add(int64(d))
+}
+
+// the current values. each counter is read atomically, but not all of
+// them at once.
+func (c *Counters) Snapshot() (snap CountersSnapshot) {
+	for i := range c.counts {
+		snap.Counts[i] = c.counts[i].Load()
+	}
+	for i := range c.ops {
+		snap.Ops[i].Count = c.ops[i].count.Load()
+		snap.Ops[i].Total = time.Duration(c.ops[i].nanos.Load())
+	}
+	return snap
+}
@@ -0,0 +1,62 @@
+package kv
+
+import "sync"
+
+/*
+readahead for range scans. a BIter moving forward or backward through the
+leaves of the snapshot hints the next leaves of the parent node in its
+direction (see BIter.SetPrefetch), so that the reads of a long scan overlap
+with the work on the rows instead of waiting for the disk one page at a
+time.
+
+the pages are in the mmap, so a hint is madvise(MADV_WILLNEED) on them,
+which starts the reads in the kernel and returns; there's no readahead on
+platforms without it, or for the pages after the mapped part of the file
+(see kv_file.go). with a page cache (KV.CacheSize), the pages are also
+read and decoded into the cache by a goroutine, which skips the checksum,
+the decryption and the decompression of the scan itself.
+
+a loading goroutine belongs to its transaction, which waits for it before
+it ends, so the pages it reads are not reused while it reads them. a bad
+page is left for the scan to report.
+*/
+
+// read the pages of a snapshot ahead; `wg` is waited for by its transaction
+func pagePrefetch(db *KV, ptrs []uint64, chunks [][]byte, wg *sync.WaitGroup) {
+	size := db.page.size
+	for _, ptr := range ptrs {
+		if page := mmapRead(ptr, size, chunks); page != nil {
+			madviseWillNeed(page)
+		}
+	}
+	metricCount(db, METRIC_PREFETCH, uint64(len(ptrs)))
+	if db.cache.max == 0 {
+		return
+	}
+	ptrs = append([]uint64(nil), ptrs...) // reused by the iterator
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for _, ptr := range ptrs {
+			if !cacheHas(db, ptr) && !prefetchLoad(db, ptr, chunks) {
+				return
+			}
+		}
+	}()
+}
+
+// false for a bad page
+func prefetchLoad(db *KV, ptr uint64, chunks [][]byte) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, bad := r.(*ChecksumError); !bad {
+				panic(r)
+			}
+			ok = false
+		}
+	}()
+	page := pageDecode(db, ptr, pageReadRaw(db, ptr, chunks))
+	metricCount(db, METRIC_PAGE_READ, 1)
+	cachePut(db, ptr, page)
+	return true
+}
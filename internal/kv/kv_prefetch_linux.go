@@ -0,0 +1,8 @@
+package kv
+
+import "golang.org/x/sys/unix"
+
+// start reading the pages of `b` in the background; it's only a hint
+func madviseWillNeed(b []byte) {
+	_ = unix.Madvise(b, unix.MADV_WILLNEED)
+}
@@ -0,0 +1,6 @@
+//go:build !linux
+
+package kv
+
+// no readahead
+func madviseWillNeed(b []byte) {}
@@ -0,0 +1,81 @@
+package kv
+
+import (
+	"fmt"
+
+	"github.com/Adit0507/AdiDB/internal/btree"
+)
+
+/*
+file and tree statistics. the page counts come from the free list positions
+and a walk of the internal nodes, which are a small part of the tree; the
+leaves are counted from their parents and never read. the remaining pages
+are overflow pages, since every page is used by either the tree or the
+free list (see Check).
+*/
+
+type KVStats struct {
+	FileSize      int64  // bytes, including the space not used yet
+	UsedSize      int64  // bytes of the pages in use
+	PageSize      int    // bytes
+	Pages         uint64 // in use, including the meta page and free pages
+	FreePages     uint64 // free list items
+	ListPages     uint64 // free list nodes
+	Height        int    // of the tree; 0 for an empty tree
+	NodePages     uint64 // internal nodes
+	LeafPages     uint64
+	OverflowPages uint64
+	Grows         uint64 // times the file was extended since Open
+	Mmaps         int    // mappings of the file
+	Cache         CacheStats
+}
+
+// statistics of the latest version. commits wait for it.
+func (db *KV) Stats() (stats KVStats, err error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if stats.FileSize, err = fileLen(db.fd); err != nil {
+		return KVStats{}, fmt.Errorf("stat: %w", err)
+	}
+	stats.PageSize = db.page.size
+	stats.Pages = db.page.flushed
+	stats.UsedSize = int64(db.page.flushed) * int64(db.page.size)
+	stats.Grows = db.page.grows
+	stats.Mmaps = len(db.mmap.chunks)
+	stats.FreePages, stats.ListPages = db.free.Size()
+	stats.Cache = db.CacheStats()
+
+	defer checksumRecover(&err)
+	if db.tree.root != 0 {
+		// the leftmost path
+		stats.Height = 1
+		for node := btree.BNode(db.pageRead(db.tree.root)); node.btype() == btree.BNODE_NODE; {
+			node = db.pageRead(node.getPtr(0))
+			stats.Height++
+		}
+		if stats.Height == 1 {
+			stats.LeafPages = 1
+		} else {
+			statsNode(db, &stats, db.tree.root, 1)
+		}
+	}
+	used := 1 + stats.FreePages + stats.ListPages + stats.NodePages + stats.LeafPages
+	if used < stats.Pages {
+		stats.OverflowPages = stats.Pages - used
+	}
+	return stats, nil
+}
+
+// count an internal node at `depth` and the nodes below it
+func statsNode(db *KV, stats *KVStats, ptr uint64, depth int) {
+	node := btree.BNode(db.pageRead(ptr))
+	stats.NodePages++
+	if depth+1 == stats.Height {
+		stats.LeafPages += uint64(node.nkeys())
+		return
+	}
+	for i := uint16(0); i < node.nkeys(); i++ {
+		statsNode(db, stats, node.getPtr(i), depth+1)
+	}
+}
@@ -0,0 +1,2315 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"maps"
+	"math/rand"
+	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Adit0507/AdiDB/internal/btree"
+	"github.com/Adit0507/AdiDB/internal/btree_iter"
+	is "github.com/stretchr/testify/require"
+)
+
+type D struct {
+	db  KV
+	ref map[string]string
+}
+
+func nofsync(int) error {
+	return nil
+}
+
+func newD() *D {
+	os.Remove("test.db")
+	os.Remove("test.db-wal")
+	os.Remove("test.db-changes")
+
+	d := &D{}
+	d.ref = map[string]string{}
+	d.db.Path = "test.db"
+	d.db.Fsync = nofsync // faster
+	err := d.db.Open()
+	assert(err == nil)
+	return d
+}
+
+func (d *D) reopen() {
+	d.db.Close()
+	d.db = KV{
+		Path: d.db.Path, Fsync: d.db.Fsync, Changes: d.db.Changes, Key: d.db.Key,
+		Compression: d.db.Compression, PageSize: d.db.PageSize, CacheSize: d.db.CacheSize,
+	}
+	err := d.db.Open()
+	assert(err == nil)
+}
+
+func (d *D) dispose() {
+	d.db.Close()
+	os.Remove("test.db")
+	os.Remove("test.db-wal")
+	os.Remove("test.db-changes")
+}
+
+func (d *D) add(key string, val string) {
+	tx := KVTX{}
+	d.db.Begin(&tx)
+	_, err := tx.Set([]byte(key), []byte(val))
+	assert(err == nil)
+	err = d.db.Commit(&tx)
+	assert(err == nil)
+	d.ref[key] = val
+}
+
+func (d *D) del(key string) bool {
+	delete(d.ref, key)
+	tx := KVTX{}
+	d.db.Begin(&tx)
+	deleted, err := tx.Del(&DeleteReq{Key: []byte(key)})
+	assert(err == nil)
+	err = d.db.Commit(&tx)
+	assert(err == nil)
+	return deleted
+}
+
+func (d *D) dump() ([]string, []string) {
+	keys := []string{}
+	vals := []string{}
+
+	var nodeDump func(uint64)
+	nodeDump = func(ptr uint64) {
+		node := BNode(d.db.tree.get(ptr))
+		nkeys := node.nkeys()
+		if node.btype() == BNODE_LEAF {
+			for i := uint16(0); i < nkeys; i++ {
+				keys = append(keys, string(node.getKey(i)))
+				vals = append(vals, string(nodeGetVal(&d.db.tree, node, i)))
+			}
+		} else {
+			for i := uint16(0); i < nkeys; i++ {
+				ptr := node.getPtr(i)
+				nodeDump(ptr)
+			}
+		}
+	}
+
+	nodeDump(d.db.tree.root)
+	assert(keys[0] == "")
+	assert(vals[0] == "")
+	return keys[1:], vals[1:]
+}
+
+func (d *D) verify(t *testing.T) {
+	// KV data
+	keys, vals := d.dump()
+	// reference data
+	rkeys, rvals := []string{}, []string{}
+	for k, v := range d.ref {
+		rkeys = append(rkeys, k)
+		rvals = append(rvals, v)
+	}
+	is.Equal(t, len(rkeys), len(keys))
+	sort.Stable(sortIF{
+		len:  len(rkeys),
+		less: func(i, j int) bool { return rkeys[i] < rkeys[j] },
+		swap: func(i, j int) {
+			k, v := rkeys[i], rvals[i]
+			rkeys[i], rvals[i] = rkeys[j], rvals[j]
+			rkeys[j], rvals[j] = k, v
+		},
+	})
+	// compare with the reference
+	is.Equal(t, rkeys, keys)
+	is.Equal(t, rvals, vals)
+
+	// track visited pages
+	pages := make([]uint8, d.db.page.flushed)
+	pages[0] = 1
+	pages[d.db.tree.root] = 1
+	// verify node structures
+	var nodeVerify func(BNode)
+	nodeVerify = func(node BNode) {
+		nkeys := node.nkeys()
+		assert(nkeys >= 1)
+		if node.btype() == BNODE_LEAF {
+			for i := uint16(0); i < nkeys; i++ {
+				if !node.isOverflow(i) {
+					continue
+				}
+				ref := node.getVal(i)
+				for ptr := binary.LittleEndian.Uint64(ref[8:]); ptr != 0; {
+					is.Zero(t, pages[ptr])
+					pages[ptr] = 1 // overflow page
+					ptr = binary.LittleEndian.Uint64(d.db.tree.get(ptr))
+				}
+			}
+			return
+		}
+		for i := uint16(0); i < nkeys; i++ {
+			ptr := node.getPtr(i)
+			is.Zero(t, pages[ptr])
+			pages[ptr] = 1 // tree node
+			key := node.getKey(i)
+			kid := BNode(d.db.tree.get(node.getPtr(i)))
+			is.Equal(t, key, kid.getKey(0))
+			nodeVerify(kid)
+		}
+	}
+
+	nodeVerify(d.db.tree.get(d.db.tree.root))
+
+	// free list
+	list, nodes := flDump(&d.db.free)
+	for _, ptr := range nodes {
+		is.Zero(t, pages[ptr])
+		pages[ptr] = 2 // free list node
+	}
+	for _, ptr := range list {
+		is.Zero(t, pages[ptr])
+		pages[ptr] = 3 // free list content
+	}
+	for _, flag := range pages {
+		is.NotZero(t, flag) // every page is accounted for
+	}
+	is.Nil(t, d.db.Check(nil))
+}
+
+func funcTestKVBasic(t *testing.T, reopen bool) {
+	c := newD()
+	defer c.dispose()
+
+	c.add("k", "v")
+	c.verify(t)
+
+	// insert
+	for i := 0; i < 25000; i++ {
+		key := fmt.Sprintf("key%d", fmix32(uint32(i)))
+		val := fmt.Sprintf("vvv%d", fmix32(uint32(-i)))
+		c.add(key, val)
+		if i < 2000 {
+			c.verify(t)
+		}
+	}
+	c.verify(t)
+	if reopen {
+		c.reopen()
+		c.verify(t)
+	}
+	t.Log("insertion done")
+
+	// del
+	for i := 2000; i < 25000; i++ {
+		key := fmt.Sprintf("key%d", fmix32(uint32(i)))
+		is.True(t, c.del(key))
+	}
+	c.verify(t)
+	if reopen {
+		c.reopen()
+		c.verify(t)
+	}
+	t.Log("deletion done")
+
+	// overwrite
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key%d", fmix32(uint32(i)))
+		val := fmt.Sprintf("vvv%d", fmix32(uint32(+i)))
+		c.add(key, val)
+		c.verify(t)
+	}
+
+	is.False(t, c.del("kk"))
+
+	// remove all
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key%d", fmix32(uint32(i)))
+		is.True(t, c.del(key))
+		c.verify(t)
+	}
+	if reopen {
+		c.reopen()
+		c.verify(t)
+	}
+
+	c.add("k", "v2")
+	c.verify(t)
+	c.del("k")
+	c.verify(t)
+}
+
+func TestKVBasic(t *testing.T) {
+	funcTestKVBasic(t, false)
+	funcTestKVBasic(t, true)
+}
+
+func fsyncErr(errlist ...int) func(int) error {
+	return func(int) error {
+		fail := errlist[0]
+		errlist = errlist[1:]
+		if fail != 0 {
+			return fmt.Errorf("fsync error!")
+		} else {
+			return nil
+		}
+	}
+}
+
+func TestKVFsyncErr(t *testing.T) {
+	c := newD()
+	defer c.dispose()
+
+	set := func(key []byte, val []byte) error {
+		tx := KVTX{}
+		c.db.Begin(&tx)
+		tx.Set(key, val)
+		return c.db.Commit(&tx)
+	}
+	get := func(key []byte) ([]byte, bool) {
+		tx := KVTX{}
+		c.db.Begin(&tx)
+		val, ok := tx.Get(key)
+		c.db.Abort(&tx)
+		return val, ok
+	}
+
+	err := set([]byte("k"), []byte("1"))
+	assert(err == nil)
+	val, ok := get([]byte("k"))
+	assert(ok && string(val) == "1")
+
+	c.db.Fsync = fsyncErr(1)
+	err = set([]byte("k"), []byte("2"))
+	assert(err != nil)
+	val, ok = get([]byte("k"))
+	assert(ok && string(val) == "1")
+
+	c.db.Fsync = nofsync
+	err = set([]byte("k"), []byte("3"))
+	assert(err == nil)
+	val, ok = get([]byte("k"))
+	assert(ok && string(val) == "3")
+
+	c.db.Fsync = fsyncErr(0, 1)
+	err = set([]byte("k"), []byte("4"))
+	assert(err != nil)
+	val, ok = get([]byte("k"))
+	assert(ok && string(val) == "3")
+
+	c.db.Fsync = nofsync
+	err = set([]byte("k"), []byte("5"))
+	assert(err == nil)
+	val, ok = get([]byte("k"))
+	assert(ok && string(val) == "5")
+
+	c.db.Fsync = fsyncErr(0, 1)
+	err = set([]byte("k"), []byte("6"))
+	assert(err != nil)
+	val, ok = get([]byte("k"))
+	assert(ok && string(val) == "5")
+}
+
+func TestKVRandLength(t *testing.T) {
+	c := newD()
+	defer c.dispose()
+
+	for i := 0; i < 2000; i++ {
+		klen := fmix32(uint32(2*i+0)) % BTREE_MAX_KEY_SIZE
+		vlen := fmix32(uint32(2*i+1)) % BTREE_MAX_VAL_SIZE
+		if klen == 0 {
+			continue
+		}
+
+		key := make([]byte, klen)
+		rand.Read(key)
+		val := make([]byte, vlen)
+		// rand.Read(val)
+		c.add(string(key), string(val))
+		c.verify(t)
+	}
+}
+
+func TestKVIncLength(t *testing.T) {
+	for l := 1; l < BTREE_MAX_KEY_SIZE+BTREE_MAX_VAL_SIZE; l++ {
+		c := newD()
+
+		klen := l
+		if klen > BTREE_MAX_KEY_SIZE {
+			klen = BTREE_MAX_KEY_SIZE
+		}
+		vlen := l - klen
+		key := make([]byte, klen)
+		val := make([]byte, vlen)
+
+		factor := BTREE_PAGE_SIZE / l
+		size := factor * factor * 2
+		if size > 4000 {
+			size = 4000
+		}
+		if size < 10 {
+			size = 10
+		}
+		for i := 0; i < size; i++ {
+			rand.Read(key)
+			c.add(string(key), string(val))
+		}
+		c.verify(t)
+
+		c.dispose()
+	}
+}
+
+func fileSize(path string) int64 {
+	finfo, err := os.Stat(path)
+	assert(err == nil)
+	return finfo.Size()
+}
+
+// test the free list: file size do not increase under various operations
+func TestKVFileSize(t *testing.T) {
+	c := newD()
+	fill := func(seed int) {
+		for i := 0; i < 2000; i++ {
+			key := fmt.Sprintf("key%d", fmix32(uint32(i)))
+			val := fmt.Sprintf("vvv%010d", fmix32(uint32(seed*2000+i)))
+			c.add(key, val)
+		}
+	}
+	fill(0)
+	fill(1)
+	size := fileSize(c.db.Path)
+
+	// update the same key
+	fill(2)
+	assert(size == fileSize(c.db.Path))
+
+	// remove everything
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key%d", fmix32(uint32(i)))
+		c.del(key)
+	}
+	assert(size == fileSize(c.db.Path))
+
+	// add them back
+	fill(3)
+	assert(size == fileSize(c.db.Path))
+}
+
+func TestKVVacuum(t *testing.T) {
+	d := newD()
+	defer d.dispose()
+	for i := 0; i < 3000; i++ {
+		d.add(fmt.Sprintf("k%04d", i), fmt.Sprintf("%0200d", i))
+	}
+	d.add("big1", string(make([]byte, 20000))) // overflow pages
+	d.add("k9999", string(make([]byte, 20000)))
+
+	// a reader keeps its snapshot
+	reader := KVTX{}
+	d.db.BeginRead(&reader)
+	for i := 0; i < 3000; i++ {
+		if i%10 != 0 {
+			d.del(fmt.Sprintf("k%04d", i))
+		}
+	}
+	size := fileSize(d.db.Path)
+	reclaimed, err := d.db.Vacuum()
+	is.Nil(t, err)
+	is.Equal(t, size-fileSize(d.db.Path), reclaimed)
+	d.verify(t)
+	for i := 0; i < 3000; i++ {
+		val, ok := reader.Get([]byte(fmt.Sprintf("k%04d", i)))
+		is.True(t, ok)
+		is.Equal(t, fmt.Sprintf("%0200d", i), string(val))
+	}
+	d.db.Abort(&reader)
+
+	// the tree is moved once there are no readers
+	size = fileSize(d.db.Path)
+	reclaimed, err = d.db.Vacuum()
+	is.Nil(t, err)
+	is.Equal(t, size-fileSize(d.db.Path), reclaimed)
+	is.Less(t, fileSize(d.db.Path), size/3)
+	d.verify(t)
+	d.reopen()
+	d.verify(t)
+
+	// pages freed by the last vacuum can be reused now
+	size = fileSize(d.db.Path)
+	reclaimed, err = d.db.Vacuum()
+	is.Nil(t, err)
+	is.Equal(t, size-fileSize(d.db.Path), reclaimed)
+	is.Less(t, reclaimed, size/10)
+	d.verify(t)
+
+	// still usable
+	for i := 0; i < 3000; i += 2 {
+		d.add(fmt.Sprintf("k%04d", i), "new")
+	}
+	d.reopen()
+	d.verify(t)
+}
+
+// close the files without a checkpoint or Sync, as if the process was killed
+func kvCrash(db *KV) {
+	if db.wal.open {
+		_ = fileClose(db.wal.fd)
+	}
+	if db.changes.fp != nil {
+		_ = db.changes.fp.Close()
+	}
+	for _, chunk := range db.mmap.chunks {
+		_ = fileUnmap(chunk)
+	}
+	_ = fileClose(db.fd)
+}
+
+func TestKVWAL(t *testing.T) {
+	c := newD()
+	defer c.dispose()
+	defer os.Remove("test2.db")
+	open := func() {
+		c.db = KV{Path: c.db.Path, Fsync: nofsync, WAL: true, WALCheckpoint: 100}
+		is.Nil(t, c.db.Open())
+	}
+	c.db.Close()
+	open()
+
+	for i := 0; i < 250; i++ {
+		c.add(fmt.Sprintf("key%d", fmix32(uint32(i))), fmt.Sprint(i))
+	}
+	c.verify(t)
+	// checkpoints after the 1st commit to the new file, then every 100
+	is.Equal(t, 49, c.db.wal.commits)
+
+	// the process is killed after the log fsync
+	kvCrash(&c.db)
+
+	// the main file only has the last checkpoint
+	data, err := os.ReadFile(c.db.Path)
+	is.Nil(t, err)
+	is.Nil(t, os.WriteFile("test2.db", data, 0o644))
+	d := D{db: KV{Path: "test2.db", Fsync: nofsync}}
+	is.Nil(t, d.db.Open())
+	keys, _ := d.dump()
+	is.Equal(t, 201, len(keys))
+	d.db.Close()
+
+	// replay the log
+	open()
+	c.verify(t)
+	is.Zero(t, fileSize(walPath(&c.db))) // checkpointed
+
+	// a torn write at the end of the log
+	c.add("a", "1")
+	c.add("b", "2")
+	is.True(t, c.del("a"))
+	kvCrash(&c.db)
+	size := fileSize(walPath(&c.db))
+	is.Nil(t, os.Truncate(walPath(&c.db), size-1))
+	c.ref["a"] = "1"
+	open()
+	c.verify(t)
+
+	// a normal close checkpoints
+	c.add("c", "3")
+	c.db.Close()
+	is.Zero(t, fileSize(walPath(&c.db)))
+	c.db = KV{Path: c.db.Path, Fsync: nofsync}
+	is.Nil(t, c.db.Open())
+	c.verify(t)
+	_, err = os.Stat(walPath(&c.db))
+	is.True(t, os.IsNotExist(err)) // removed without WAL mode
+}
+
+func TestKVWALGroupCommit(t *testing.T) {
+	c := newD()
+	defer c.dispose()
+	fsyncs := atomic.Int64{}
+	c.db.Close()
+	c.db = KV{Path: c.db.Path, WAL: true, Fsync: func(int) error {
+		fsyncs.Add(1)
+		time.Sleep(time.Millisecond)
+		return nil
+	}}
+	is.Nil(t, c.db.Open())
+	fsyncs.Store(0)
+
+	const ng, nc = 8, 50
+	wg := sync.WaitGroup{}
+	for g := 0; g < ng; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < nc; i++ {
+				tx := KVTX{}
+				c.db.Begin(&tx)
+				_, err := tx.Set([]byte(fmt.Sprintf("k%d-%d", g, i)), []byte("v"))
+				assert(err == nil)
+				assert(c.db.Commit(&tx) == nil)
+			}
+		}()
+	}
+	wg.Wait()
+	is.Less(t, fsyncs.Load(), int64(ng*nc)) // shared by concurrent commits
+
+	for g := 0; g < ng; g++ {
+		for i := 0; i < nc; i++ {
+			c.ref[fmt.Sprintf("k%d-%d", g, i)] = "v"
+		}
+	}
+	kvCrash(&c.db)
+	c.db = KV{Path: c.db.Path, Fsync: nofsync, WAL: true}
+	is.Nil(t, c.db.Open())
+	c.verify(t)
+}
+
+func TestKVNoSync(t *testing.T) {
+	c := newD()
+	defer c.dispose()
+	fsyncs := 0
+	c.db.Close()
+	c.db = KV{Path: c.db.Path, NoSync: true, Fsync: func(int) error {
+		fsyncs++
+		return nil
+	}}
+	is.Nil(t, c.db.Open())
+
+	for i := 0; i < 1000; i++ {
+		c.add(fmt.Sprintf("key%d", fmix32(uint32(i))), fmt.Sprint(i))
+	}
+	c.verify(t)
+	is.Equal(t, 2, fsyncs) // the meta page of the new file
+	is.Nil(t, c.db.Sync())
+	synced := maps.Clone(c.ref)
+
+	// overwrite and delete after the sync
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%d", fmix32(uint32(i)))
+		if i%2 == 0 {
+			c.add(key, "new")
+		} else {
+			c.del(key)
+		}
+	}
+	c.verify(t)
+
+	// a crash rolls back to the synced version
+	kvCrash(&c.db)
+	c.db = KV{Path: c.db.Path, NoSync: true, Fsync: nofsync}
+	is.Nil(t, c.db.Open())
+	c.ref = synced
+	c.verify(t)
+
+	// Close syncs
+	c.add("k", "v")
+	c.db.Close()
+	c.db = KV{Path: c.db.Path, Fsync: nofsync}
+	is.Nil(t, c.db.Open())
+	c.verify(t)
+}
+
+// flip a byte of a page in the file
+func flipByte(t *testing.T, path string, ptr uint64, off int) {
+	fp, err := os.OpenFile(path, os.O_RDWR, 0)
+	is.Nil(t, err)
+	defer fp.Close()
+	b := []byte{0}
+	pos := int64(ptr)*btree.BTREE_PAGE_SIZE + int64(off)
+	_, err = fp.ReadAt(b, pos)
+	is.Nil(t, err)
+	b[0] ^= 0xff
+	_, err = fp.WriteAt(b, pos)
+	is.Nil(t, err)
+}
+
+func TestKVChecksum(t *testing.T) {
+	d := newD()
+	defer d.dispose()
+	for i := 0; i < 1000; i++ {
+		d.add(fmt.Sprintf("k%04d", i), string(make([]byte, 200)))
+	}
+	// the rightmost leaf is not on the path verified by Open
+	root := d.db.tree.root
+	leaf := root
+	for {
+		node := btree.BNode(d.db.pageRead(leaf))
+		if node.btype() == btree.BNODE_LEAF {
+			break
+		}
+		leaf = node.getPtr(node.nkeys() - 1)
+	}
+	is.NotEqual(t, root, leaf)
+	d.db.Close()
+
+	// a bad root is reported by Open
+	flipByte(t, d.db.Path, root, 100)
+	d.db = KV{Path: d.db.Path, Fsync: nofsync}
+	err := d.db.Open()
+	ce := &ChecksumError{}
+	is.ErrorAs(t, err, &ce)
+	is.ErrorIs(t, err, ErrChecksum)
+	is.Equal(t, root, ce.Page)
+	flipByte(t, d.db.Path, root, 100)
+
+	// other pages when they are used
+	flipByte(t, d.db.Path, leaf, 100)
+	d.db = KV{Path: d.db.Path, Fsync: nofsync}
+	is.Nil(t, d.db.Open())
+	tx := KVTX{}
+	d.db.Begin(&tx)
+	_, err = tx.Del(&DeleteReq{Key: []byte("k0999")})
+	is.ErrorAs(t, err, &ce)
+	is.Equal(t, leaf, ce.Page)
+	_, err = tx.Set([]byte("k0000"), []byte("new"))
+	is.Nil(t, err)
+	d.db.Abort(&tx)
+	flipByte(t, d.db.Path, leaf, 100)
+	d.reopen()
+	d.verify(t)
+
+	// a failed commit leaves nothing behind
+	flipByte(t, d.db.Path, leaf, 100)
+	d.reopen()
+	tx2 := KVTX{}
+	d.db.Begin(&tx2)
+	_, err = tx2.Set([]byte("k0000"), []byte("new"))
+	is.Nil(t, err)
+	d.db.tree.get = func(ptr uint64) []byte {
+		return mmapReadChecked(&d.db, leaf, d.db.mmap.chunks)
+	}
+	is.ErrorIs(t, d.db.Commit(&tx2), ErrChecksum)
+	d.db.tree.get = d.db.pageRead
+	flipByte(t, d.db.Path, leaf, 100)
+	d.reopen()
+	d.verify(t)
+}
+
+func TestKVChecksumOldFormat(t *testing.T) {
+	d := newD()
+	defer d.dispose()
+	d.db.format = FORMAT_NONE // as if created by an older version
+	for i := 0; i < 100; i++ {
+		d.add(fmt.Sprintf("k%04d", i), fmt.Sprintf("v%d", i))
+	}
+	d.reopen()
+	is.Equal(t, uint64(FORMAT_NONE), d.db.format)
+
+	// not verified
+	flipByte(t, d.db.Path, d.db.tree.root, btree.BTREE_PAGE_SIZE-PAGE_CHECKSUM)
+	d.reopen()
+	d.verify(t)
+	d.add("k", "v")
+	d.reopen()
+	is.Equal(t, uint64(FORMAT_NONE), d.db.format)
+	d.verify(t)
+}
+
+// change the meta page of a closed file and fix its checksum
+func editMeta(t *testing.T, path string, edit func(meta []byte)) {
+	fp, err := os.OpenFile(path, os.O_RDWR, 0)
+	is.Nil(t, err)
+	defer fp.Close()
+	meta := make([]byte, 100)
+	_, err = fp.ReadAt(meta, 0)
+	is.Nil(t, err)
+	edit(meta)
+	if meta[72] != FORMAT_NONE {
+		binary.LittleEndian.PutUint32(meta[80:84], crc32.Checksum(meta[:80], castagnoli))
+	}
+	_, err = fp.WriteAt(meta, 0)
+	is.Nil(t, err)
+}
+
+func TestKVHeader(t *testing.T) {
+	d := newD()
+	defer d.dispose()
+	for i := 0; i < 100; i++ {
+		d.add(fmt.Sprintf("k%04d", i), fmt.Sprintf("v%d", i))
+	}
+	d.db.Close()
+	data, err := os.ReadFile(d.db.Path)
+	is.Nil(t, err)
+	features := func() uint32 {
+		meta := make([]byte, 80)
+		fp, err := os.Open(d.db.Path)
+		is.Nil(t, err)
+		defer fp.Close()
+		_, err = fp.ReadAt(meta, 0)
+		is.Nil(t, err)
+		return binary.LittleEndian.Uint32(meta[76:80])
+	}
+	is.Equal(t, uint32(FEATURE_CHECKSUM), features())
+	open := func() error {
+		db := KV{Path: d.db.Path, Fsync: nofsync}
+		err := db.Open()
+		if err == nil {
+			db.Close()
+		}
+		return err
+	}
+	restore := func() {
+		is.Nil(t, os.WriteFile(d.db.Path, data, 0o644))
+	}
+
+	// not a database
+	for _, bad := range [][]byte{[]byte("hello"), make([]byte, 8192)} {
+		is.Nil(t, os.WriteFile(d.db.Path, bad, 0o644))
+		err := open()
+		is.ErrorIs(t, err, ErrNotADatabase)
+		is.ErrorIs(t, err, ErrBadFile)
+	}
+	// a later format
+	restore()
+	editMeta(t, d.db.Path, func(meta []byte) { meta[72] = FORMAT_ENCRYPTED + 1 })
+	is.ErrorIs(t, open(), ErrVersionTooNew)
+	// an unknown feature
+	restore()
+	editMeta(t, d.db.Path, func(meta []byte) { meta[79] |= 0x80 })
+	is.ErrorIs(t, open(), ErrUnsupportedFeature)
+	// an unknown compression method
+	restore()
+	editMeta(t, d.db.Path, func(meta []byte) {
+		meta[73] = 99
+		meta[76] |= FEATURE_COMPRESSED
+	})
+	is.ErrorIs(t, open(), ErrUnsupportedFeature)
+	// the features disagree with the format
+	restore()
+	editMeta(t, d.db.Path, func(meta []byte) { meta[76] = FEATURE_ENCRYPTED })
+	err = open()
+	is.ErrorIs(t, err, ErrBadFile)
+	is.NotErrorIs(t, err, ErrNotADatabase)
+
+	// a file from before the features is migrated by a commit
+	restore()
+	editMeta(t, d.db.Path, func(meta []byte) { clear(meta[76:80]) })
+	d.db = KV{Path: d.db.Path, Fsync: nofsync}
+	is.Nil(t, d.db.Open())
+	d.verify(t)
+	is.Zero(t, features())
+	d.add("k", "v")
+	is.Equal(t, uint32(FEATURE_CHECKSUM), features())
+	d.reopen()
+	d.verify(t)
+}
+
+func TestKVCheck(t *testing.T) {
+	d := newD()
+	defer d.dispose()
+	for i := 0; i < 1000; i++ {
+		d.add(fmt.Sprintf("k%04d", i), string(make([]byte, 200)))
+	}
+	for i := 0; i < 1000; i += 3 {
+		d.del(fmt.Sprintf("k%04d", i))
+	}
+	d.add("big", string(make([]byte, 10000))) // overflow pages
+	rows := 0
+	is.Nil(t, d.db.Check(func(key []byte, val []byte) error {
+		is.Equal(t, d.ref[string(key)], string(val))
+		rows++
+		return nil
+	}))
+	is.Equal(t, len(d.ref), rows)
+
+	// reported problems are collected
+	err := d.db.Check(func(key []byte, val []byte) error {
+		return fmt.Errorf("bad row")
+	})
+	is.ErrorContains(t, err, "bad row")
+	is.ErrorContains(t, err, fmt.Sprintf("and %d more problems", len(d.ref)-CHECK_MAX_ERRORS))
+
+	// a live page in the free list
+	root := BNode(d.db.pageRead(d.db.tree.root))
+	leaf := root.getPtr(root.nkeys() - 1)
+	d.db.free.PushTail(leaf)
+	is.ErrorContains(t, d.db.Check(nil), fmt.Sprintf("page %d is both used and free", leaf))
+	d.reopen() // discard it
+	is.Nil(t, d.db.Check(nil))
+
+	// keys out of order; the page is rewritten with a valid checksum
+	d.db.Close()
+	fp, err := os.OpenFile(d.db.Path, os.O_RDWR, 0)
+	is.Nil(t, err)
+	page := make([]byte, btree.BTREE_PAGE_SIZE)
+	_, err = fp.ReadAt(page, int64(leaf)*btree.BTREE_PAGE_SIZE)
+	is.Nil(t, err)
+	node := BNode(page)
+	copy(node.rawKey(node.nkeys()-1), "\x00") // after the node prefix
+	pageSetChecksum(page)
+	_, err = fp.WriteAt(page, int64(leaf)*btree.BTREE_PAGE_SIZE)
+	is.Nil(t, err)
+	is.Nil(t, fp.Close())
+	d.db = KV{Path: d.db.Path, Fsync: nofsync}
+	is.Nil(t, d.db.Open())
+	is.ErrorContains(t, d.db.Check(nil), fmt.Sprintf("page %d: key %d is out of order", leaf, node.nkeys()-1))
+}
+
+// pauses the 1st write until `resume` is closed
+type pausedWriter struct {
+	w       io.Writer
+	started chan struct{}
+	resume  chan struct{}
+}
+
+func (pw *pausedWriter) Write(data []byte) (int, error) {
+	if pw.started != nil {
+		close(pw.started)
+		pw.started = nil
+		<-pw.resume
+	}
+	return pw.w.Write(data)
+}
+
+func TestKVBackup(t *testing.T) {
+	d := newD()
+	defer d.dispose()
+	defer os.Remove("backup.db")
+	for i := 0; i < 2000; i++ {
+		d.add(fmt.Sprintf("k%04d", i), fmt.Sprintf("%0200d", i))
+	}
+	d.add("big", string(make([]byte, 20000))) // overflow pages
+	for i := 0; i < 2000; i += 3 {
+		d.del(fmt.Sprintf("k%04d", i))
+	}
+	ref := maps.Clone(d.ref)
+
+	fp, err := os.Create("backup.db")
+	is.Nil(t, err)
+	pw := &pausedWriter{w: fp, started: make(chan struct{}), resume: make(chan struct{})}
+	started := pw.started
+	done := make(chan error)
+	go func() { done <- d.db.BackupTo(pw) }()
+
+	// commits are not blocked by the backup
+	<-started
+	for i := 0; i < 2000; i += 2 {
+		d.add(fmt.Sprintf("k%04d", i), "new")
+	}
+	d.add("big", "small")
+	close(pw.resume)
+	for i := 0; ; i++ {
+		select {
+		case err = <-done:
+		default:
+			d.add(fmt.Sprintf("n%06d", i), string(make([]byte, 300)))
+			continue
+		}
+		break
+	}
+	is.Nil(t, err)
+	is.Nil(t, fp.Close())
+	d.verify(t)
+
+	// the copy has the version before the call
+	copied := &D{db: KV{Path: "backup.db", Fsync: nofsync}, ref: ref}
+	is.Nil(t, copied.db.Open())
+	copied.verify(t)
+	copied.add("k0000", "v") // usable
+	copied.reopen()
+	copied.verify(t)
+	copied.db.Close()
+
+	// to a file; compacted
+	for i := 0; i < 2000; i++ {
+		d.del(fmt.Sprintf("k%04d", i))
+	}
+	is.Nil(t, d.db.Backup("backup.db"))
+	is.Less(t, fileSize("backup.db"), fileSize(d.db.Path)/2)
+	copied = &D{db: KV{Path: "backup.db", Fsync: nofsync}, ref: maps.Clone(d.ref)}
+	is.Nil(t, copied.db.Open())
+	copied.verify(t)
+	copied.db.Close()
+}
+
+func TestKVChanges(t *testing.T) {
+	d := newD()
+	defer d.dispose()
+	defer os.Remove("backup.db")
+	d.db.Close()
+	d.db = KV{Path: d.db.Path, Fsync: nofsync, Changes: true}
+	is.Nil(t, d.db.Open())
+	for i := 0; i < 500; i++ {
+		d.add(fmt.Sprintf("k%04d", i), fmt.Sprintf("%0100d", i))
+	}
+
+	// a copy at `seq`
+	is.Nil(t, d.db.Backup("backup.db"))
+	seq := d.db.Seq()
+	copied := &D{db: KV{Path: "backup.db", Fsync: nofsync}}
+	is.Nil(t, copied.db.Open())
+	defer copied.db.Close()
+	is.Equal(t, seq, copied.db.Seq())
+
+	for i := 0; i < 500; i += 2 {
+		d.del(fmt.Sprintf("k%04d", i))
+	}
+	d.add("big", string(make([]byte, 10000))) // overflow pages
+	_, err := d.db.Vacuum()                   // an empty record
+	is.Nil(t, err)
+	d.reopen() // the log is kept
+	for i := 0; i < 500; i += 3 {
+		d.add(fmt.Sprintf("k%04d", i), "new")
+	}
+
+	// replay onto the copy
+	buf := bytes.Buffer{}
+	is.Nil(t, d.db.ChangesSince(seq, &buf))
+	is.Nil(t, copied.db.ApplyChanges(&buf))
+	copied.ref = maps.Clone(d.ref)
+	copied.verify(t)
+	// nothing after the latest commit
+	buf.Reset()
+	is.Nil(t, d.db.ChangesSince(d.db.Seq(), &buf))
+	is.Equal(t, 24, buf.Len())
+	is.Nil(t, copied.db.ApplyChanges(&buf))
+	copied.verify(t)
+	is.Error(t, copied.db.ApplyChanges(bytes.NewReader(make([]byte, 24))))
+
+	// commits replayed from the WAL are logged again
+	seq = d.db.Seq()
+	d.db.Close()
+	d.db = KV{Path: d.db.Path, Fsync: nofsync, Changes: true, WAL: true}
+	is.Nil(t, d.db.Open())
+	for i := 1; i < 500; i += 3 {
+		d.add(fmt.Sprintf("k%04d", i), "wal")
+	}
+	kvCrash(&d.db)
+	d.db = KV{Path: d.db.Path, Fsync: nofsync, Changes: true}
+	is.Nil(t, d.db.Open())
+	d.verify(t)
+	buf.Reset()
+	is.Nil(t, d.db.ChangesSince(seq, &buf))
+	is.Nil(t, copied.db.ApplyChanges(&buf))
+	copied.ref = maps.Clone(d.ref)
+	copied.verify(t)
+
+	// commits without the log
+	d.db.Changes = false
+	d.reopen()
+	d.add("k0000", "unlogged")
+	d.db.Changes = true
+	d.reopen()
+	err = d.db.ChangesSince(seq, &buf)
+	is.ErrorIs(t, err, ErrChangesGone)
+}
+
+func TestKVEncrypt(t *testing.T) {
+	d := newD()
+	defer d.dispose()
+	defer os.Remove("backup.db")
+	key := make([]byte, CRYPT_KEY_SIZE)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	d.db.Close()
+	os.Remove(d.db.Path)
+	d.db = KV{Path: d.db.Path, Fsync: nofsync, Key: key}
+	is.Nil(t, d.db.Open())
+	for i := 0; i < 1000; i++ {
+		d.add(fmt.Sprintf("secret%04d", i), fmt.Sprintf("plaintext%04d", i))
+	}
+	d.add("big", strings.Repeat("plaintext", 2000)) // overflow pages
+	for i := 0; i < 1000; i += 3 {
+		d.del(fmt.Sprintf("secret%04d", i))
+	}
+	d.reopen()
+	d.verify(t)
+	is.Equal(t, uint64(FORMAT_ENCRYPTED), d.db.format)
+
+	data, err := os.ReadFile(d.db.Path)
+	is.Nil(t, err)
+	is.False(t, bytes.Contains(data, []byte("secret")))
+	is.False(t, bytes.Contains(data, []byte("plaintext")))
+
+	// a wrong key or no key
+	d.db.Close()
+	for _, bad := range [][]byte{nil, make([]byte, CRYPT_KEY_SIZE), key[:16]} {
+		db := KV{Path: d.db.Path, Fsync: nofsync, Key: bad}
+		is.ErrorIs(t, db.Open(), ErrBadKey)
+	}
+	d.db = KV{Path: d.db.Path, Fsync: nofsync, Key: key}
+	is.Nil(t, d.db.Open())
+	d.verify(t)
+
+	// a page that doesn't decrypt
+	root := d.db.tree.root
+	d.db.Close()
+	flipByte(t, d.db.Path, root, 100)
+	d.db = KV{Path: d.db.Path, Fsync: nofsync, Key: key}
+	is.ErrorIs(t, d.db.Open(), ErrChecksum)
+	flipByte(t, d.db.Path, root, 100)
+	d.db = KV{Path: d.db.Path, Fsync: nofsync, Key: key}
+	is.Nil(t, d.db.Open())
+
+	// a page can't be moved to another place
+	node := BNode(d.db.pageRead(root))
+	leaf := node.getPtr(node.nkeys() - 1) // not verified by Open
+	d.db.Close()
+	fp, err := os.OpenFile(d.db.Path, os.O_RDWR, 0)
+	is.Nil(t, err)
+	page := make([]byte, btree.BTREE_PAGE_SIZE)
+	_, err = fp.ReadAt(page, int64(root)*btree.BTREE_PAGE_SIZE)
+	is.Nil(t, err)
+	_, err = fp.WriteAt(page, int64(leaf)*btree.BTREE_PAGE_SIZE)
+	is.Nil(t, err)
+	is.Nil(t, fp.Close())
+	d.db = KV{Path: d.db.Path, Fsync: nofsync, Key: key}
+	is.Nil(t, d.db.Open())
+	is.ErrorIs(t, d.db.Check(nil), ErrChecksum)
+	d.db.Close()
+	os.Remove(d.db.Path)
+
+	// a backup is encrypted with the same key
+	d.db = KV{Path: d.db.Path, Fsync: nofsync, Key: key}
+	is.Nil(t, d.db.Open())
+	for k, v := range d.ref {
+		d.add(k, v)
+	}
+	is.Nil(t, d.db.Backup("backup.db"))
+	copied := &D{db: KV{Path: "backup.db", Fsync: nofsync, Key: key}, ref: d.ref}
+	is.Nil(t, copied.db.Open())
+	copied.verify(t)
+	copied.db.Close()
+
+	// the key is only for encrypted files
+	plain := KV{Path: "backup.db", Fsync: nofsync}
+	is.ErrorIs(t, plain.Open(), ErrBadKey)
+	os.Remove("backup.db")
+	plain = KV{Path: "backup.db", Fsync: nofsync}
+	is.Nil(t, plain.Open())
+	tx := KVTX{}
+	plain.Begin(&tx)
+	_, err = tx.Set([]byte("k"), []byte("v"))
+	is.Nil(t, err)
+	is.Nil(t, plain.Commit(&tx))
+	plain.Close()
+	plain = KV{Path: "backup.db", Fsync: nofsync, Key: key}
+	is.ErrorIs(t, plain.Open(), ErrBadKey)
+}
+
+func TestKVReadOnly(t *testing.T) {
+	d := newD()
+	defer d.dispose()
+	for i := 0; i < 2000; i++ {
+		d.add(fmt.Sprintf("k%04d", i), fmt.Sprintf("v%d", i))
+	}
+	d.db.Close()
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	is.Nil(t, os.Chtimes(d.db.Path, past, past))
+	data, err := os.ReadFile(d.db.Path)
+	is.Nil(t, err)
+
+	// a writer and a reader at the same time
+	d.db = KV{Path: d.db.Path, Fsync: nofsync}
+	is.Nil(t, d.db.Open())
+	reader := &D{db: KV{Path: d.db.Path, ReadOnly: true}, ref: maps.Clone(d.ref)}
+	is.Nil(t, reader.db.Open())
+	reader.verify(t)
+	is.Nil(t, reader.db.Check(nil))
+
+	tx := KVTX{}
+	reader.db.Begin(&tx)
+	_, err = tx.Set([]byte("k"), []byte("v"))
+	is.ErrorIs(t, err, ErrReadOnly)
+	_, err = tx.Del(&DeleteReq{Key: []byte("k0000")})
+	is.ErrorIs(t, err, ErrReadOnly)
+	is.Nil(t, reader.db.Commit(&tx))
+	_, err = reader.db.Vacuum()
+	is.ErrorIs(t, err, ErrReadOnly)
+	is.Nil(t, reader.db.Sync())
+	reader.db.Close()
+	d.db.Close()
+
+	finfo, err := os.Stat(d.db.Path)
+	is.Nil(t, err)
+	is.True(t, past.Equal(finfo.ModTime()))
+	after, err := os.ReadFile(d.db.Path)
+	is.Nil(t, err)
+	is.True(t, bytes.Equal(data, after))
+
+	// the file is not created
+	missing := KV{Path: "missing.db", ReadOnly: true}
+	is.NotNil(t, missing.Open())
+	_, err = os.Stat("missing.db")
+	is.True(t, os.IsNotExist(err))
+	bad := KV{Path: d.db.Path, ReadOnly: true, WAL: true}
+	is.NotNil(t, bad.Open())
+	d.db = KV{Path: d.db.Path, ReadOnly: true}
+	is.Nil(t, d.db.Open())
+}
+
+func TestKVLock(t *testing.T) {
+	if path := os.Getenv("TEST_KV_LOCK"); path != "" {
+		// the child process of the test
+		db := KV{Path: path, Fsync: nofsync}
+		if errors.Is(db.Open(), ErrLocked) {
+			os.Exit(3)
+		}
+		os.Exit(0)
+	}
+	d := newD()
+	defer d.dispose()
+	d.add("k", "v")
+
+	// another process
+	cmd := exec.Command(os.Args[0], "-test.run=^TestKVLock$")
+	cmd.Env = append(os.Environ(), "TEST_KV_LOCK="+d.db.Path)
+	err := cmd.Run()
+	exit := &exec.ExitError{}
+	is.ErrorAs(t, err, &exit)
+	is.Equal(t, 3, exit.ExitCode())
+
+	// readers don't conflict with the writer or with each other
+	readers := []*KV{}
+	for i := 0; i < 2; i++ {
+		reader := &KV{Path: d.db.Path, ReadOnly: true}
+		is.Nil(t, reader.Open())
+		readers = append(readers, reader)
+	}
+	for _, reader := range readers {
+		reader.Close()
+	}
+	if runtime.GOOS != "linux" && runtime.GOOS != "windows" {
+		return // the locks belong to the process
+	}
+
+	// a second writer in the process
+	second := KV{Path: d.db.Path, Fsync: nofsync}
+	is.ErrorIs(t, second.Open(), ErrLocked)
+	second = KV{Path: d.db.Path, Fsync: nofsync, LockTimeout: 50 * time.Millisecond}
+	start := time.Now()
+	is.ErrorIs(t, second.Open(), ErrLocked)
+	is.True(t, time.Since(start) >= 50*time.Millisecond)
+
+	// waits for the writer to close the file
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		d.db.Close()
+	}()
+	second = KV{Path: d.db.Path, Fsync: nofsync, LockTimeout: 10 * time.Second}
+	is.Nil(t, second.Open())
+	second.Close()
+
+	// a failed Open releases the lock
+	wrong := KV{Path: d.db.Path, Fsync: nofsync, Key: bytes.Repeat([]byte("k"), 32)}
+	is.ErrorIs(t, wrong.Open(), ErrBadKey)
+	d.db = KV{Path: d.db.Path, Fsync: nofsync}
+	is.Nil(t, d.db.Open())
+	d.verify(t)
+}
+
+func TestKVPageSize(t *testing.T) {
+	for _, size := range []int{4096, 8192, 16384, 32768} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			d := newD()
+			defer d.dispose()
+			d.db.Close()
+			os.Remove(d.db.Path)
+			d.db = KV{Path: d.db.Path, Fsync: nofsync, PageSize: size}
+			is.Nil(t, d.db.Open())
+			for i := 0; i < 3000; i++ {
+				d.add(fmt.Sprintf("k%05d", i), fmt.Sprintf("%0*d", i%200, i))
+			}
+			d.add("big", strings.Repeat("overflow", 10000))
+			for i := 0; i < 3000; i += 2 {
+				d.del(fmt.Sprintf("k%05d", i))
+			}
+			d.reopen()
+			d.verify(t)
+			is.Nil(t, d.db.Check(nil))
+			is.Equal(t, size, d.db.page.size)
+			is.Zero(t, fileSize(d.db.Path)%int64(size))
+
+			// the size is in the file
+			d.db.Close()
+			d.db = KV{Path: d.db.Path, Fsync: nofsync}
+			is.Nil(t, d.db.Open())
+			is.Equal(t, size, d.db.page.size)
+			d.verify(t)
+			d.db.Close()
+			other := 2 * size
+			if other > btree.BTREE_MAX_PAGE_SIZE {
+				other = btree.BTREE_MIN_PAGE_SIZE
+			}
+			wrong := KV{Path: d.db.Path, Fsync: nofsync, PageSize: other}
+			is.NotNil(t, wrong.Open())
+			d.db = KV{Path: d.db.Path, Fsync: nofsync, PageSize: size}
+			is.Nil(t, d.db.Open())
+		})
+	}
+
+	// with checksums, compression and encryption
+	d := newD()
+	defer d.dispose()
+	d.db.Close()
+	os.Remove(d.db.Path)
+	key := make([]byte, CRYPT_KEY_SIZE)
+	d.db = KV{Path: d.db.Path, Fsync: nofsync, PageSize: 16384, Key: key, Compression: &FlateCompressor{}}
+	is.Nil(t, d.db.Open())
+	for i := 0; i < 2000; i++ {
+		d.add(fmt.Sprintf("k%05d", i), strings.Repeat("v", i%100))
+	}
+	d.reopen()
+	d.verify(t)
+	is.Nil(t, d.db.Check(nil))
+
+	for _, bad := range []int{1000, 2048, 6144, 65536} {
+		db := KV{Path: "bad.db", PageSize: bad}
+		is.NotNil(t, db.Open())
+	}
+	_, err := os.Stat("bad.db")
+	is.True(t, os.IsNotExist(err))
+}
+
+func TestKVCache(t *testing.T) {
+	d := newD()
+	defer d.dispose()
+	d.db.Close()
+	d.db = KV{Path: d.db.Path, Fsync: nofsync, CacheSize: 16 * btree.BTREE_PAGE_SIZE}
+	is.Nil(t, d.db.Open())
+
+	// readers check values against their snapshots while pages are reused
+	type reader struct {
+		tx  KVTX
+		ref map[string]string
+	}
+	readers := []*reader{}
+	check := func(r *reader) {
+		for k, v := range r.ref {
+			val, ok := r.tx.Get([]byte(k))
+			is.True(t, ok)
+			is.Equal(t, v, string(val))
+		}
+	}
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		tx := KVTX{}
+		d.db.Begin(&tx)
+		updates := map[string]string{}
+		for j := 0; j < 20; j++ {
+			key := fmt.Sprintf("k%04d", rng.Intn(1000))
+			if rng.Intn(4) == 0 {
+				_, err := tx.Del(&DeleteReq{Key: []byte(key)})
+				is.Nil(t, err)
+				updates[key] = ""
+			} else {
+				val := fmt.Sprintf("%s:%d:%s", key, i, strings.Repeat("x", rng.Intn(300)))
+				_, err := tx.Set([]byte(key), []byte(val))
+				is.Nil(t, err)
+				updates[key] = val
+			}
+		}
+		is.Nil(t, d.db.Commit(&tx))
+		for k, v := range updates {
+			if v == "" {
+				delete(d.ref, k)
+			} else {
+				d.ref[k] = v
+			}
+		}
+
+		if i%10 == 0 {
+			r := &reader{ref: maps.Clone(d.ref)}
+			d.db.BeginRead(&r.tx)
+			readers = append(readers, r)
+		}
+		if len(readers) > 3 {
+			check(readers[0])
+			d.db.Abort(&readers[0].tx)
+			readers = readers[1:]
+		}
+		if i%20 == 0 {
+			d.verify(t)
+		}
+	}
+	for _, r := range readers {
+		check(r)
+		d.db.Abort(&r.tx)
+	}
+	d.verify(t)
+	stats := d.db.CacheStats()
+	is.Greater(t, stats.Hits, uint64(0))
+	is.Greater(t, stats.Misses, uint64(0))
+	is.LessOrEqual(t, stats.Pages, 16)
+	is.Equal(t, int64(stats.Pages)*btree.BTREE_PAGE_SIZE, stats.Bytes)
+
+	// concurrent readers; a value always starts with its key
+	var wg sync.WaitGroup
+	var stop atomic.Bool
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed))
+			for !stop.Load() {
+				tx := KVTX{}
+				d.db.BeginRead(&tx)
+				for j := 0; j < 50; j++ {
+					key := fmt.Sprintf("k%04d", rng.Intn(1000))
+					if val, ok := tx.Get([]byte(key)); ok && !strings.HasPrefix(string(val), key+":") {
+						t.Errorf("%s: %.20q", key, val)
+					}
+				}
+				d.db.Abort(&tx)
+			}
+		}(int64(w))
+	}
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("k%04d", rng.Intn(1000))
+		d.add(key, fmt.Sprintf("%s:%d", key, i))
+	}
+	stop.Store(true)
+	wg.Wait()
+	d.verify(t)
+
+	// truncated pages are dropped
+	for k := range d.ref {
+		if rng.Intn(10) != 0 {
+			d.del(k)
+		}
+	}
+	_, err := d.db.Vacuum()
+	is.Nil(t, err)
+	d.verify(t)
+	is.Nil(t, d.db.Check(nil))
+	d.reopen()
+	d.verify(t)
+}
+
+type otherCompressor struct{ FlateCompressor }
+
+func (c *otherCompressor) ID() byte { return 7 }
+
+func TestKVCompress(t *testing.T) {
+	d := newD()
+	defer d.dispose()
+	defer os.Remove("backup.db")
+	d.db.Close()
+	os.Remove(d.db.Path)
+	d.db = KV{Path: d.db.Path, Fsync: nofsync, Compression: &FlateCompressor{}}
+	is.Nil(t, d.db.Open())
+	for i := 0; i < 2000; i++ {
+		d.add(fmt.Sprintf("key%06d", i), strings.Repeat("value", i%50))
+	}
+	d.add("big", strings.Repeat("overflow", 2000)) // overflow pages
+	for i := 0; i < 2000; i += 3 {
+		d.del(fmt.Sprintf("key%06d", i))
+	}
+	d.reopen()
+	d.verify(t)
+	is.Nil(t, d.db.Check(nil))
+	is.Equal(t, uint64(FORMAT_CHECKSUM), d.db.format)
+
+	// most pages are compressed
+	data, err := os.ReadFile(d.db.Path)
+	is.Nil(t, err)
+	compressed := 0
+	for off := 2 * btree.BTREE_PAGE_SIZE; off < len(data); off += btree.BTREE_PAGE_SIZE {
+		if binary.LittleEndian.Uint32(data[off+btree.BTREE_NODE_SIZE:]) != 0 {
+			compressed++
+		}
+	}
+	is.Greater(t, compressed, len(data)/btree.BTREE_PAGE_SIZE/2)
+	root := int(d.db.tree.root) * btree.BTREE_PAGE_SIZE
+	is.Zero(t, binary.LittleEndian.Uint32(data[root+btree.BTREE_NODE_SIZE:])) // not a leaf
+
+	// the method is in the file
+	d.db.Close()
+	d.db = KV{Path: d.db.Path, Fsync: nofsync}
+	is.Nil(t, d.db.Open())
+	d.verify(t)
+	d.add("more", "data")
+	d.db.Close()
+	other := KV{Path: d.db.Path, Fsync: nofsync, Compression: &otherCompressor{}}
+	is.NotNil(t, other.Open())
+
+	// a corrupted compressed page
+	d.db = KV{Path: d.db.Path, Fsync: nofsync}
+	is.Nil(t, d.db.Open())
+	ptr := d.db.tree.root
+	d.db.Close()
+	flipByte(t, d.db.Path, ptr, 10)
+	d.db = KV{Path: d.db.Path, Fsync: nofsync}
+	is.ErrorIs(t, d.db.Open(), ErrChecksum)
+	flipByte(t, d.db.Path, ptr, 10)
+
+	// a backup is compressed the same way
+	d.db = KV{Path: d.db.Path, Fsync: nofsync}
+	is.Nil(t, d.db.Open())
+	is.Nil(t, d.db.Backup("backup.db"))
+	copied := &D{db: KV{Path: "backup.db", Fsync: nofsync}, ref: d.ref}
+	is.Nil(t, copied.db.Open())
+	is.NotNil(t, copied.db.compress)
+	copied.verify(t)
+	copied.db.Close()
+
+	// the option doesn't apply to an existing uncompressed file
+	os.Remove("backup.db")
+	plain := &D{db: KV{Path: "backup.db", Fsync: nofsync}, ref: map[string]string{}}
+	is.Nil(t, plain.db.Open())
+	plain.add("k", "v")
+	plain.db.Close()
+	plain.db = KV{Path: "backup.db", Fsync: nofsync, Compression: &FlateCompressor{}}
+	is.Nil(t, plain.db.Open())
+	is.Nil(t, plain.db.compress)
+	plain.verify(t)
+	plain.db.Close()
+
+	// with encryption
+	os.Remove("backup.db")
+	key := make([]byte, CRYPT_KEY_SIZE)
+	both := &D{db: KV{Path: "backup.db", Fsync: nofsync, Key: key, Compression: &FlateCompressor{}}, ref: map[string]string{}}
+	is.Nil(t, both.db.Open())
+	for i := 0; i < 1000; i++ {
+		both.add(fmt.Sprintf("key%06d", i), strings.Repeat("secret", i%20))
+	}
+	both.reopen()
+	both.verify(t)
+	is.Nil(t, both.db.Check(nil))
+	both.db.Close()
+
+	// the zeros of pages larger than a disk block are holes
+	os.Remove("backup.db")
+	large := &D{db: KV{Path: "backup.db", Fsync: nofsync, PageSize: 16384, Compression: &FlateCompressor{}}, ref: map[string]string{}}
+	is.Nil(t, large.db.Open())
+	for i := 0; i < 2000; i++ {
+		large.add(fmt.Sprintf("key%06d", i), strings.Repeat("value", 10))
+	}
+	large.reopen()
+	large.verify(t)
+	if used, ok := diskUsage(t, large.db.Path); ok {
+		is.Less(t, used, fileSize(large.db.Path))
+	}
+	large.db.Close()
+}
+
+func BenchmarkKVInsert(b *testing.B) {
+	for _, nosync := range []bool{false, true} {
+		b.Run(fmt.Sprintf("NoSync=%v", nosync), func(b *testing.B) {
+			c := newD()
+			defer c.dispose()
+			c.db.Close()
+			c.db = KV{Path: c.db.Path, NoSync: nosync}
+			is.Nil(b, c.db.Open())
+			for i := 0; i < b.N; i++ {
+				c.add(fmt.Sprintf("key%d", i), "val")
+			}
+		})
+	}
+}
+
+// the disk space of compressed pages against the file size, and the read speed
+func BenchmarkKVCompress(b *testing.B) {
+	for _, size := range []int{btree.BTREE_PAGE_SIZE, 16384} {
+		for _, c := range []Compressor{nil, &FlateCompressor{}} {
+			name := "none"
+			if c != nil {
+				name = "flate"
+			}
+			b.Run(fmt.Sprintf("%s/page=%d", name, size), func(b *testing.B) {
+				d := newD()
+				defer d.dispose()
+				d.db.Close()
+				os.Remove(d.db.Path)
+				d.db = KV{Path: d.db.Path, Fsync: nofsync, PageSize: size, Compression: c}
+				is.Nil(b, d.db.Open())
+				for i := 0; i < 20; i++ {
+					tx := KVTX{}
+					d.db.Begin(&tx)
+					for j := 0; j < 500; j++ {
+						key := fmt.Sprintf("user:%08d:profile", i*500+j)
+						val := fmt.Sprintf(`{"name":"user %d","email":"user%d@example.com","active":true}`, j, j)
+						_, err := tx.Set([]byte(key), []byte(val))
+						is.Nil(b, err)
+					}
+					is.Nil(b, d.db.Commit(&tx))
+				}
+				reader := KVTX{}
+				d.db.BeginRead(&reader)
+				defer d.db.Abort(&reader)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					key := fmt.Sprintf("user:%08d:profile", i%10000)
+					_, ok := reader.Get([]byte(key))
+					is.True(b, ok)
+				}
+				b.StopTimer()
+				// the disk space against the size; the holes only show in the former
+				if used, ok := diskUsage(b, d.db.Path); ok {
+					b.ReportMetric(float64(used), "disk-bytes")
+				}
+				b.ReportMetric(float64(fileSize(d.db.Path)), "file-bytes")
+			})
+		}
+	}
+}
+
+// sequential inserts; the file is extended page by page or in 64 MB chunks
+func BenchmarkKVGrow(b *testing.B) {
+	for _, chunk := range []int64{0, 64 << 20} {
+		b.Run(fmt.Sprintf("chunk=%d", chunk), func(b *testing.B) {
+			d := newD()
+			defer d.dispose()
+			d.db.Close()
+			os.Remove(d.db.Path)
+			d.db = KV{Path: d.db.Path, Fsync: nofsync, GrowChunk: chunk}
+			is.Nil(b, d.db.Open())
+			for i := 0; i < b.N; i++ {
+				d.add(fmt.Sprintf("key%010d", i), strings.Repeat("v", 100))
+			}
+			b.StopTimer()
+			stats, err := d.db.Stats()
+			is.Nil(b, err)
+			b.ReportMetric(float64(stats.Grows), "grows")
+			b.ReportMetric(float64(stats.Mmaps), "mmaps")
+		})
+	}
+}
+
+func TestKVGrow(t *testing.T) {
+	d := newD()
+	defer d.dispose()
+	insert := func(n int) {
+		tx := KVTX{}
+		d.db.Begin(&tx)
+		for i := 0; i < n; i++ {
+			key := fmt.Sprintf("k%06d", len(d.ref))
+			_, err := tx.Set([]byte(key), []byte(strings.Repeat("v", 100)))
+			is.Nil(t, err)
+			d.ref[key] = strings.Repeat("v", 100)
+		}
+		is.Nil(t, d.db.Commit(&tx))
+	}
+	open := func(db KV) {
+		d.db.Close()
+		db.Path, db.Fsync = d.db.Path, nofsync
+		d.db = db
+		is.Nil(t, d.db.Open())
+	}
+
+	// page by page
+	for i := 0; i < 20; i++ {
+		insert(100)
+	}
+	stats, err := d.db.Stats()
+	is.Nil(t, err)
+	is.Equal(t, stats.UsedSize, stats.FileSize)
+	is.Greater(t, stats.Grows, uint64(10))
+
+	// an initial size, then in chunks
+	d.db.Close()
+	os.Remove(d.db.Path)
+	d.ref = map[string]string{}
+	d.db = KV{Path: d.db.Path, Fsync: nofsync, InitialSize: 1 << 20, GrowChunk: 256 << 10}
+	is.Nil(t, d.db.Open())
+	insert(1)
+	stats, err = d.db.Stats()
+	is.Nil(t, err)
+	is.Equal(t, int64(1<<20), stats.FileSize)
+	is.Equal(t, fileSize(d.db.Path), stats.FileSize)
+	is.Less(t, stats.UsedSize, stats.FileSize)
+	for i := 0; i < 20; i++ {
+		insert(500)
+	}
+	stats, err = d.db.Stats()
+	is.Nil(t, err)
+	is.Greater(t, stats.FileSize, int64(1<<20))
+	is.Less(t, stats.Grows, uint64(8))
+	is.Zero(t, (stats.FileSize-1<<20)%(256<<10))
+	is.Less(t, stats.UsedSize, stats.FileSize)
+
+	// the unused space is not mistaken for pages
+	open(KV{})
+	d.verify(t)
+	is.Nil(t, d.db.Check(nil))
+	stats, err = d.db.Stats()
+	is.Nil(t, err)
+	is.Equal(t, fileSize(d.db.Path), stats.FileSize)
+	is.Less(t, stats.UsedSize, stats.FileSize)
+
+	// by a fraction of the size, with the space allocated
+	open(KV{GrowFactor: 0.5, Fallocate: true})
+	before := stats.FileSize
+	for stats.FileSize == before {
+		insert(100)
+		stats, err = d.db.Stats()
+		is.Nil(t, err)
+	}
+	is.GreaterOrEqual(t, stats.FileSize, before+before/2)
+	if used, ok := diskUsage(t, d.db.Path); ok {
+		is.GreaterOrEqual(t, used, stats.FileSize)
+	}
+
+	// truncated by vacuum
+	reclaimed, err := d.db.Vacuum()
+	is.Nil(t, err)
+	is.Greater(t, reclaimed, int64(0))
+	stats, err = d.db.Stats()
+	is.Nil(t, err)
+	is.Equal(t, stats.UsedSize, stats.FileSize)
+	d.reopen()
+	d.verify(t)
+}
+
+func TestKVBulkLoad(t *testing.T) {
+	d := newD()
+	defer d.dispose()
+	for i := 0; i < 1000; i += 2 {
+		d.add(fmt.Sprintf("k%05d", i), "old")
+	}
+
+	// a reader keeps its snapshot; a writer of the loaded range conflicts
+	reader := KVTX{}
+	d.db.BeginRead(&reader)
+	writer := KVTX{}
+	d.db.Begin(&writer)
+	_, err := writer.Set([]byte("k00001"), []byte("w"))
+	is.Nil(t, err)
+	other := KVTX{}
+	d.db.Begin(&other)
+	_, err = other.Set([]byte("z"), []byte("w"))
+	is.Nil(t, err)
+
+	// large values spill to overflow pages; enough pages for a partial write
+	keys, vals := []string{}, []string{}
+	for i := 1; i < 6000; i += 2 {
+		keys = append(keys, fmt.Sprintf("k%05d", i))
+		vals = append(vals, strings.Repeat(fmt.Sprint(i), 1+i%7*1000))
+	}
+	i := 0
+	next := func() ([]byte, []byte, error) {
+		if i >= len(keys) {
+			return nil, nil, io.EOF
+		}
+		i++
+		return []byte(keys[i-1]), []byte(vals[i-1]), nil
+	}
+	n, err := d.db.BulkLoad(next)
+	is.Nil(t, err)
+	is.Equal(t, len(keys), n)
+	for i := range keys {
+		d.ref[keys[i]] = vals[i]
+	}
+	d.verify(t)
+
+	_, ok := reader.Get([]byte("k00001"))
+	is.False(t, ok)
+	d.db.Abort(&reader)
+	is.Equal(t, ErrorConflict, d.db.Commit(&writer))
+	is.Nil(t, d.db.Commit(&other))
+	d.ref["z"] = "w"
+	d.reopen()
+	d.verify(t)
+
+	// bad input; nothing is changed
+	for _, bad := range [][]string{{"a", "c", "b"}, {"a", "k00002"}, {"a", ""}} {
+		i := 0
+		_, err := d.db.BulkLoad(func() ([]byte, []byte, error) {
+			if i >= len(bad) {
+				return nil, nil, io.EOF
+			}
+			i++
+			return []byte(bad[i-1]), []byte("v"), nil
+		})
+		is.NotNil(t, err)
+		d.verify(t)
+	}
+	// an input error
+	errInput := fmt.Errorf("input")
+	i = 0
+	_, err = d.db.BulkLoad(func() ([]byte, []byte, error) {
+		if i++; i > 100 {
+			return nil, nil, errInput
+		}
+		return []byte(fmt.Sprintf("x%05d", i)), []byte("v"), nil
+	})
+	is.Equal(t, errInput, err)
+	d.verify(t)
+	d.add("k99999", "new")
+	d.reopen()
+	d.verify(t)
+
+	// empty input
+	n, err = d.db.BulkLoad(func() ([]byte, []byte, error) { return nil, nil, io.EOF })
+	is.Nil(t, err)
+	is.Zero(t, n)
+	d.verify(t)
+}
+
+func TestKVStats(t *testing.T) {
+	d := newD()
+	defer d.dispose()
+	stats, err := d.db.Stats()
+	is.Nil(t, err)
+	is.Equal(t, 0, stats.Height)
+
+	for i := 0; i < 3000; i++ {
+		d.add(fmt.Sprintf("k%05d", fmix32(uint32(i))%100000), strings.Repeat("v", i%500))
+	}
+	d.add("big", string(make([]byte, 20000))) // overflow pages
+	for i := 0; i < 1000; i++ {
+		d.del(fmt.Sprintf("k%05d", fmix32(uint32(i))%100000))
+	}
+	d.verify(t)
+
+	// count the pages by reading all of them
+	nodes, leaves, overflow, height := uint64(0), uint64(0), uint64(0), 0
+	var walk func(ptr uint64, depth int)
+	walk = func(ptr uint64, depth int) {
+		node := BNode(d.db.tree.get(ptr))
+		if node.btype() == BNODE_NODE {
+			nodes++
+			for i := uint16(0); i < node.nkeys(); i++ {
+				walk(node.getPtr(i), depth+1)
+			}
+			return
+		}
+		leaves, height = leaves+1, depth
+		for i := uint16(0); i < node.nkeys(); i++ {
+			if node.isOverflow(i) {
+				ref := node.getVal(i)
+				for p := binary.LittleEndian.Uint64(ref[8:]); p != 0; overflow++ {
+					p = binary.LittleEndian.Uint64(d.db.tree.get(p))
+				}
+			}
+		}
+	}
+	walk(d.db.tree.root, 1)
+	list, lnodes := flDump(&d.db.free)
+
+	stats, err = d.db.Stats()
+	is.Nil(t, err)
+	is.Equal(t, fileSize(d.db.Path), stats.FileSize)
+	is.Equal(t, d.db.page.flushed, stats.Pages)
+	is.Equal(t, uint64(len(list)), stats.FreePages)
+	is.Equal(t, uint64(len(lnodes)), stats.ListPages)
+	is.Equal(t, height, stats.Height)
+	is.Greater(t, height, 1)
+	is.Equal(t, nodes, stats.NodePages)
+	is.Equal(t, leaves, stats.LeafPages)
+	is.Equal(t, overflow, stats.OverflowPages)
+	is.NotZero(t, overflow)
+}
+
+func TestKVFreeListCheck(t *testing.T) {
+	d := newD()
+	defer d.dispose()
+	d.db.Close()
+	d.db = KV{Path: d.db.Path, Fsync: nofsync, GuardFree: true}
+	is.Nil(t, d.db.Open())
+	for i := 0; i < 1000; i++ {
+		d.add(fmt.Sprintf("k%04d", i), string(make([]byte, 200)))
+	}
+	for i := 0; i < 1000; i += 2 {
+		d.del(fmt.Sprintf("k%04d", i))
+	}
+	_, err := d.db.Vacuum()
+	is.Nil(t, err)
+	d.add("big", string(make([]byte, 10000))) // overflow pages
+	d.verify(t)
+
+	// a double free is caught by the guard
+	list, nodes := flDump(&d.db.free)
+	is.GreaterOrEqual(t, len(list), 2)
+	is.PanicsWithValue(t, fmt.Sprintf("free list: page %d is already free", list[0]), func() {
+		d.db.free.PushTail(list[0])
+	})
+	is.Panics(t, func() { d.db.free.PushTail(nodes[0]) })
+	d.reopen()
+	d.verify(t)
+
+	// a duplicate item in a list node; the page is rewritten with a valid checksum
+	d.db.Close()
+	fp, err := os.OpenFile(d.db.Path, os.O_RDWR, 0)
+	is.Nil(t, err)
+	page := make([]byte, btree.BTREE_PAGE_SIZE)
+	_, err = fp.ReadAt(page, int64(nodes[0])*btree.BTREE_PAGE_SIZE)
+	is.Nil(t, err)
+	fl := &d.db.free
+	item, version := LNode(page).getPtr(seq2idx(fl, fl.headSeq))
+	LNode(page).setPtr(seq2idx(fl, fl.headSeq+1), item, version)
+	pageSetChecksum(page)
+	_, err = fp.WriteAt(page, int64(nodes[0])*btree.BTREE_PAGE_SIZE)
+	is.Nil(t, err)
+	is.Nil(t, fp.Close())
+	d.db = KV{Path: d.db.Path, Fsync: nofsync}
+	is.Nil(t, d.db.Open())
+	err = d.db.Check(nil)
+	is.ErrorContains(t, err, fmt.Sprintf("free list: list node %d: page %d is in the list twice", nodes[0], item))
+}
+
+// a context that is cancelled after `n` calls of Err
+type kvCancelAfter struct {
+	context.Context
+	n int
+}
+
+func (ctx *kvCancelAfter) Err() error {
+	if ctx.n--; ctx.n < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestKVContext(t *testing.T) {
+	d := newD()
+	defer d.dispose()
+	defer os.Remove("backup.db")
+	for i := 0; i < 3000; i++ {
+		d.add(fmt.Sprintf("k%04d", i), fmt.Sprintf("%0200d", i))
+	}
+	d.add("big", string(make([]byte, 20000)))
+	for i := 0; i < 3000; i++ {
+		if i%10 != 0 {
+			d.del(fmt.Sprintf("k%04d", i))
+		}
+	}
+
+	// the backup stops at a page
+	for _, n := range []int{0, 1, 2, 10} {
+		ctx := &kvCancelAfter{Context: context.Background(), n: n}
+		out := bytes.Buffer{}
+		is.ErrorIs(t, d.db.BackupToCtx(ctx, &out), context.Canceled, n)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	is.ErrorIs(t, d.db.BackupCtx(ctx, "backup.db"), context.Canceled)
+	_, err := os.Stat("backup.db")
+	is.True(t, os.IsNotExist(err))
+
+	// a vacuum stopped while the tree is walked or moved changes nothing,
+	// until it's given enough checks to finish
+	size := fileSize(d.db.Path)
+	reclaimed := int64(0)
+	for n := 0; ; n++ {
+		ctx := &kvCancelAfter{Context: context.Background(), n: n}
+		if reclaimed, err = d.db.VacuumCtx(ctx); err == nil {
+			break
+		}
+		is.ErrorIs(t, err, context.Canceled, n)
+		is.Equal(t, size, fileSize(d.db.Path))
+		if n%10 == 0 {
+			d.verify(t)
+		}
+	}
+	is.Less(t, fileSize(d.db.Path), size/3)
+	is.Equal(t, size-fileSize(d.db.Path), reclaimed)
+	d.verify(t)
+	d.reopen()
+	d.verify(t)
+}
+
+func TestKVCursor(t *testing.T) {
+	d := newD()
+	defer d.dispose()
+
+	// nothing to walk in an empty file
+	c := d.db.Cursor()
+	for _, seek := range []func(){c.First, c.Last, func() { c.Seek([]byte("a"), btree_iter.CMP_GE) }} {
+		seek()
+		is.False(t, c.Valid())
+		c.Next()
+		c.Prev()
+		is.False(t, c.Valid())
+		is.Nil(t, c.Key())
+		is.Nil(t, c.Val())
+	}
+	c.Close()
+
+	tx := KVTX{}
+	d.db.Begin(&tx)
+	for i := 0; i < 2000; i++ {
+		key, val := fmt.Sprintf("k%04d", i), fmt.Sprintf("v%d", i)
+		_, err := tx.Set([]byte(key), []byte(val))
+		is.Nil(t, err)
+		d.ref[key] = val
+	}
+	is.Nil(t, d.db.Commit(&tx))
+	d.add("a", "1")
+	d.add("big", string(make([]byte, 20000))) // overflow
+	d.add("z", "2")
+	keys := []string{}
+	for key := range d.ref {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	c = d.db.Cursor()
+	defer c.Close()
+	// a commit after the cursor is opened is not seen
+	d.add("b", "3")
+
+	// both ways across the leaves
+	got := []string{}
+	for c.First(); c.Valid(); c.Next() {
+		is.Equal(t, d.ref[string(c.Key())], string(c.Val()))
+		got = append(got, string(c.Key()))
+	}
+	is.Equal(t, keys, got)
+	got = got[:0]
+	for c.Last(); c.Valid(); c.Prev() {
+		got = append(got, string(c.Key()))
+	}
+	slices.Reverse(got)
+	is.Equal(t, keys, got)
+
+	// moving past an end leaves it invalid until the next seek
+	c.First()
+	is.Equal(t, "a", string(c.Key()))
+	c.Prev()
+	is.False(t, c.Valid())
+	c.Next()
+	is.False(t, c.Valid())
+	c.Last()
+	is.Equal(t, "z", string(c.Key()))
+	c.Next()
+	is.False(t, c.Valid())
+	c.Prev()
+	is.False(t, c.Valid())
+
+	seeks := []struct {
+		key  string
+		cmp  int
+		want string // "" for none
+	}{
+		{"k0100", btree_iter.CMP_GE, "k0100"},
+		{"k0100", btree_iter.CMP_GT, "k0101"},
+		{"k0100", btree_iter.CMP_LE, "k0100"},
+		{"k0100", btree_iter.CMP_LT, "k0099"},
+		{"k01000", btree_iter.CMP_LE, "k0100"},
+		{"k01000", btree_iter.CMP_GE, "k0101"},
+		{"", btree_iter.CMP_GE, "a"},
+		{"a", btree_iter.CMP_LT, ""},
+		{"0", btree_iter.CMP_LE, ""},
+		{"z", btree_iter.CMP_GT, ""},
+		{"zz", btree_iter.CMP_LE, "z"},
+	}
+	for _, s := range seeks {
+		c.Seek([]byte(s.key), s.cmp)
+		is.Equal(t, s.want != "", c.Valid(), s)
+		is.Equal(t, s.want, string(c.Key()), s)
+	}
+
+	// bounded to the prefix
+	c.SeekPrefix([]byte("k19"))
+	got = got[:0]
+	for ; c.Valid(); c.Next() {
+		got = append(got, string(c.Key()))
+	}
+	is.Equal(t, 100, len(got))
+	is.Equal(t, "k1900", got[0])
+	is.Equal(t, "k1999", got[99])
+	c.SeekPrefix([]byte("k19"))
+	c.Prev()
+	is.False(t, c.Valid())
+	c.SeekPrefix([]byte("k3"))
+	is.False(t, c.Valid())
+	c.SeekPrefix(nil)
+	is.Equal(t, "a", string(c.Key()))
+	is.Nil(t, c.Err())
+
+	c.Close()
+	c.Close()
+	is.False(t, c.Valid())
+}
+
+func TestKVMetrics(t *testing.T) {
+	d := newD()
+	defer d.dispose()
+	d.db.Close()
+	m := &Counters{}
+	d.db = KV{Path: d.db.Path, Fsync: nofsync, Metrics: m}
+	is.Nil(t, d.db.Open())
+
+	// inserts only; every split adds nodes to the tree
+	for i := 0; i < 20; i++ {
+		tx := KVTX{}
+		d.db.Begin(&tx)
+		for j := 0; j < 100; j++ {
+			key := fmt.Sprintf("k%04d", j*20+i)
+			_, err := tx.Set([]byte(key), []byte(strings.Repeat("v", 100)))
+			is.Nil(t, err)
+		}
+		is.Nil(t, d.db.Commit(&tx))
+	}
+	snap := m.Snapshot()
+	stats, err := d.db.Stats()
+	is.Nil(t, err)
+	is.Equal(t, uint64(20), snap.Counts[METRIC_COMMIT])
+	is.Equal(t, uint64(40), snap.Counts[METRIC_FSYNC]) // 2 for each commit
+	is.Equal(t, uint64(0), snap.Counts[METRIC_MERGE])
+	// a split in k nodes adds k-1 nodes, and a new root for the root
+	splits, added := snap.Counts[METRIC_SPLIT], stats.NodePages+stats.LeafPages-1
+	is.LessOrEqual(t, splits+uint64(stats.Height-1), added)
+	is.LessOrEqual(t, added, 2*splits+uint64(stats.Height-1))
+	// freed pages are reused by later commits
+	is.Greater(t, snap.Counts[METRIC_PAGE_REUSE], uint64(0))
+	alloc := snap.Counts[METRIC_PAGE_REUSE] + snap.Counts[METRIC_PAGE_APPEND]
+	is.Equal(t, stats.Pages-2, snap.Counts[METRIC_PAGE_APPEND])
+	is.GreaterOrEqual(t, snap.Counts[METRIC_PAGE_WRITE], alloc)
+	is.Equal(t, uint64(2000), snap.Ops[KV_OP_UPDATE].Count)
+	is.Equal(t, uint64(0), snap.Ops[KV_OP_GET].Count) // not by updates
+
+	// deletes merge nodes
+	tx := KVTX{}
+	d.db.Begin(&tx)
+	for i := 0; i < 1900; i++ {
+		_, err := tx.Del(&DeleteReq{Key: []byte(fmt.Sprintf("k%04d", i))})
+		is.Nil(t, err)
+	}
+	is.Nil(t, d.db.Commit(&tx))
+	snap = m.Snapshot()
+	is.Greater(t, snap.Counts[METRIC_MERGE], uint64(0))
+	is.Equal(t, uint64(21), snap.Counts[METRIC_COMMIT])
+
+	// reads of the file and latencies
+	reads := snap.Counts[METRIC_PAGE_READ]
+	d.db.BeginRead(&tx)
+	for i := 1900; i < 2000; i++ {
+		_, ok := tx.Get([]byte(fmt.Sprintf("k%04d", i)))
+		is.True(t, ok)
+	}
+	iter := tx.Seek([]byte("k"), btree_iter.CMP_GE, []byte("l"), btree_iter.CMP_LT)
+	is.True(t, iter.Valid())
+	d.db.Abort(&tx)
+	snap = m.Snapshot()
+	is.Greater(t, snap.Counts[METRIC_PAGE_READ], reads)
+	is.Equal(t, uint64(100), snap.Ops[KV_OP_GET].Count)
+	is.Equal(t, uint64(1), snap.Ops[KV_OP_SCAN].Count)
+	is.Greater(t, snap.Ops[KV_OP_GET].Total, time.Duration(0))
+}
+
+func TestKVPrefetch(t *testing.T) {
+	d := newD()
+	defer d.dispose()
+	d.db.Close()
+	m := &Counters{}
+	d.db = KV{Path: d.db.Path, Fsync: nofsync, Metrics: m, CacheSize: 64 * btree.BTREE_PAGE_SIZE}
+	is.Nil(t, d.db.Open())
+	tx := KVTX{}
+	d.db.Begin(&tx)
+	for i := 0; i < 2000; i++ {
+		_, err := tx.Set([]byte(fmt.Sprintf("k%04d", i)), []byte(strings.Repeat("v", 100)))
+		is.Nil(t, err)
+	}
+	is.Nil(t, d.db.Commit(&tx))
+	scan := func(key []byte, cmp1 int, end []byte, cmp2 int, ahead int, after int) int {
+		d.db.BeginRead(&tx)
+		defer d.db.Abort(&tx)
+		iter := tx.Seek(key, cmp1, end, cmp2).(*CombinedIterator)
+		iter.Prefetch(ahead, after)
+		n := 0
+		for ; iter.Valid(); iter.Next() {
+			n++
+		}
+		return n
+	}
+	prefetched := func() uint64 { return m.Snapshot().Counts[METRIC_PREFETCH] }
+
+	// a range within a leaf, and a scan without readahead
+	is.Equal(t, 3, scan([]byte("k0100"), btree_iter.CMP_GE, []byte("k0102"), btree_iter.CMP_LE, 8, 2))
+	is.Equal(t, 2000, scan([]byte("k"), btree_iter.CMP_GE, []byte("l"), btree_iter.CMP_LT, 0, 0))
+	is.Equal(t, uint64(0), prefetched())
+
+	// each leaf is hinted once in either direction, and goes to the cache
+	stats, err := d.db.Stats()
+	is.Nil(t, err)
+	is.Equal(t, 2000, scan([]byte("k"), btree_iter.CMP_GE, []byte("l"), btree_iter.CMP_LT, 4, 2))
+	forward := prefetched()
+	is.Greater(t, forward, uint64(0))
+	is.Less(t, forward, stats.LeafPages)
+	is.Greater(t, d.db.CacheStats().Pages, 0)
+	is.Equal(t, 2000, scan([]byte("l"), btree_iter.CMP_LT, []byte("k"), btree_iter.CMP_GE, 4, 2))
+	is.Greater(t, prefetched(), forward)
+	is.LessOrEqual(t, prefetched()-forward, stats.LeafPages)
+}
+
+func TestKVLogger(t *testing.T) {
+	d := newD()
+	defer d.dispose()
+	d.db.Close()
+	os.Remove(d.db.Path)
+	out := &bytes.Buffer{}
+	logger := slog.New(slog.NewTextHandler(out, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	open := func(wal bool) {
+		out.Reset()
+		d.db = KV{Path: d.db.Path, Fsync: nofsync, WAL: wal, Logger: logger}
+		is.Nil(t, d.db.Open())
+	}
+	open(true)
+	is.Contains(t, out.String(), `msg="file opened" path=test.db created=true size=0`)
+
+	// a reader keeps the freed pages, so the free list grows
+	reader := KVTX{}
+	d.db.BeginRead(&reader)
+	for i := 0; i < 1000; i++ {
+		d.add(fmt.Sprintf("k%04d", i), string(make([]byte, 200)))
+	}
+	d.db.Abort(&reader)
+	is.Contains(t, out.String(), `msg="free list grows" page=`)
+	is.Contains(t, out.String(), `msg=checkpoint path=test.db commits=`)
+
+	// recovery from the log
+	kvCrash(&d.db)
+	open(true)
+	is.Contains(t, out.String(), `msg="recovered from the log" path=test.db-wal records=`)
+	is.Contains(t, out.String(), "created=false")
+	d.db.Close()
+
+	// the rightmost leaf is not on the path verified by Open
+	open(false)
+	leaf := d.db.tree.root
+	for node := BNode(d.db.pageRead(leaf)); node.btype() == btree.BNODE_NODE; {
+		leaf = node.getPtr(node.nkeys() - 1)
+		node = d.db.pageRead(leaf)
+	}
+	d.db.Close()
+	flipByte(t, d.db.Path, leaf, 100)
+	open(false)
+	_, ok := func() (val []byte, ok bool) {
+		defer func() { recover() }()
+		tx := KVTX{}
+		d.db.BeginRead(&tx)
+		defer d.db.Abort(&tx)
+		return tx.Get([]byte("k0999"))
+	}()
+	is.False(t, ok)
+	is.Contains(t, out.String(), fmt.Sprintf(`msg="bad page checksum" path=test.db page=%d`, leaf))
+	is.Error(t, d.db.Check(nil))
+	is.Contains(t, out.String(), fmt.Sprintf(`msg="check failed" err="tree: bad page checksum: page %d"`, leaf))
+	d.db.Close()
+	flipByte(t, d.db.Path, leaf, 100)
+
+	// a bad row with its position
+	open(false)
+	key := []byte("k0005")
+	is.Error(t, d.db.Check(func(k []byte, val []byte) error {
+		if bytes.Equal(k, key) {
+			return errors.New("bad row")
+		}
+		return nil
+	}))
+	is.Regexp(t, fmt.Sprintf(`msg="check failed" page=\d+ key=%x prefix=%d err=`,
+		key, binary.BigEndian.Uint32(key)), out.String())
+
+	// slow operations
+	d.db.SlowOp = time.Nanosecond
+	out.Reset()
+	tx := KVTX{}
+	d.db.Begin(&tx)
+	_, ok = tx.Get(key)
+	is.True(t, ok)
+	_, err := tx.Set(key, []byte("v"))
+	is.Nil(t, err)
+	is.Nil(t, d.db.Commit(&tx))
+	is.Contains(t, out.String(), `msg="slow operation" op=get elapsed=`)
+	is.Contains(t, out.String(), `msg="slow operation" op=update elapsed=`)
+	is.Contains(t, out.String(), `msg="slow operation" op=commit elapsed=`)
+	d.db.SlowOp = time.Hour
+	out.Reset()
+	d.add("k", "v")
+	is.NotContains(t, out.String(), "slow operation")
+}
+
+func TestKVDebugDump(t *testing.T) {
+	d := newD()
+	defer d.dispose()
+	for i := 0; i < 1000; i++ {
+		d.add(fmt.Sprintf("k%04d", i), string(make([]byte, 200)))
+	}
+	d.add("big", string(make([]byte, btree.BTREE_MAX_VAL_SIZE+1)))
+	for i := 0; i < 100; i++ {
+		d.del(fmt.Sprintf("k%04d", i))
+	}
+
+	out := &bytes.Buffer{}
+	is.Nil(t, d.db.DebugDump(out, KVDumpOptions{}))
+	dump := out.String()
+	is.True(t, strings.Contains(dump, fmt.Sprintf("root %d", d.db.tree.root)))
+	is.True(t, strings.Contains(dump, ": leaf, "))
+	is.True(t, strings.Contains(dump, hex.EncodeToString([]byte("k0500"))+", value 200 bytes"))
+	is.True(t, strings.Contains(dump, fmt.Sprintf("value %d bytes in overflow pages", btree.BTREE_MAX_VAL_SIZE+1)))
+	is.True(t, strings.Contains(dump, "free list: head page"))
+	is.False(t, strings.Contains(dump, "BAD"))
+
+	// a prefix
+	out.Reset()
+	is.Nil(t, d.db.DebugDump(out, KVDumpOptions{Prefix: []byte("k05"), Key: func(key []byte) string {
+		return "<" + string(key) + ">"
+	}}))
+	dump = out.String()
+	is.True(t, strings.Contains(dump, "<k0500>"))
+	is.True(t, strings.Contains(dump, "<k0599>"))
+	is.False(t, strings.Contains(dump, "<k0600>"))
+	is.False(t, strings.Contains(dump, "<big>"))
+
+	// the rightmost leaf is corrupt
+	leaf := d.db.tree.root
+	for {
+		node := btree.BNode(d.db.pageRead(leaf))
+		if node.btype() == btree.BNODE_LEAF {
+			break
+		}
+		leaf = node.getPtr(node.nkeys() - 1)
+	}
+	d.db.Close()
+	flipByte(t, d.db.Path, leaf, 100)
+	d.db = KV{Path: d.db.Path, Fsync: nofsync}
+	is.Nil(t, d.db.Open())
+	out.Reset()
+	is.Nil(t, d.db.DebugDump(out, KVDumpOptions{}))
+	dump = out.String()
+	is.True(t, strings.Contains(dump, fmt.Sprintf("page %d: BAD: bad page checksum", leaf)))
+	is.True(t, strings.Contains(dump, hex.EncodeToString([]byte("k0500"))))
+	is.True(t, strings.Contains(dump, "free list: head page"))
+}
+
+func TestKVFileLayer(t *testing.T) {
+	d := newD()
+	defer d.dispose()
+	for i := 0; i < 1000; i++ {
+		d.add(fmt.Sprintf("k%04d", i), fmt.Sprintf("v%d", i))
+	}
+	flen, err := fileLen(d.db.fd)
+	is.Nil(t, err)
+	is.Equal(t, fileSize(d.db.Path), flen)
+
+	// a page past the chunks is read from the file
+	ptr, size := d.db.tree.root, d.db.page.size
+	is.Nil(t, mmapRead(ptr, size, nil))
+	if mapAvailable {
+		is.Equal(t, mmapRead(ptr, size, d.db.mmap.chunks), pageReadRaw(&d.db, ptr, nil))
+	}
+	node := btree.BNode(pageDecode(&d.db, ptr, pageReadRaw(&d.db, ptr, nil)))
+	is.Equal(t, btree.BNode(d.db.pageRead(ptr)), node)
+	head, err := fileHead(&d.db)
+	is.Nil(t, err)
+	is.Equal(t, []byte(DB_SIG), head[:16])
+
+	// zeros past the end
+	end := fileSize(d.db.Path)
+	data := bytes.Repeat([]byte("x"), 100)
+	is.Nil(t, filePread(d.db.fd, data, end-10))
+	is.Equal(t, make([]byte, 90), data[10:])
+	is.Nil(t, filePread(d.db.fd, data, end+int64(size)))
+	is.Equal(t, make([]byte, 100), data)
+
+	d.reopen()
+	d.verify(t)
+}
@@ -0,0 +1,269 @@
+package kv
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/Adit0507/AdiDB/internal/btree"
+)
+
+/*
+vacuum moves the tree pages at the end of the file to free pages at the
+front, rebuilds the free list, and truncates the file.
+
+until the meta page is updated, the file on disk still uses the old tree
+and the old free list nodes, so new pages only go to free pages that are
+not used by a reader either. the old free list nodes and the moved pages
+are garbage after the update, so they are truncated or freed then.
+
+readers use the tree pages of their versions, so the tree is not moved
+while there are transactions or kept versions (see kv_history.go); only
+the free pages at the end are reclaimed.
+
+the space after the last page, left by the growth of the file (see
+kv_grow.go), is truncated as well, even if no page is moved.
+
+a cancelled context is checked per page while the tree is walked and
+moved; the pending updates are dropped then, so the file is unchanged.
+*/
+
+// page kinds for vacuum
+const (
+	VACUUM_KEEP  = 0 // stays in place: the meta page, or used by a reader
+	VACUUM_TREE  = 1 // used by the tree
+	VACUUM_AVAIL = 2 // a free page that can be reused
+	VACUUM_OLD   = 3 // unused after the update
+)
+
+// shrink the file. writers wait for it, readers keep their snapshots.
+// returns the number of bytes reclaimed.
+func (db *KV) Vacuum() (int64, error) {
+	return db.VacuumCtx(context.Background())
+}
+
+// Vacuum that stops with ctx.Err(); see the top
+func (db *KV) VacuumCtx(ctx context.Context) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if db.ReadOnly {
+		return 0, ErrReadOnly
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	// the file must have the latest version
+	if db.wal.err != nil {
+		return 0, db.wal.err
+	}
+	if err := syncLocked(db); err != nil {
+		return 0, err
+	}
+	fsize, err := fileLen(db.fd)
+	if err != nil {
+		return 0, fmt.Errorf("stat: %w", err)
+	}
+
+	// the oldest version in use, like txFinalize
+	minVer := db.version
+	for _, other := range db.ongoing {
+		if versionBefore(other, minVer) {
+			minVer = other
+		}
+	}
+	minVer = historyMinVer(db, minVer)
+	pinned := len(db.ongoing) > 0 || len(db.hist) > 0
+
+	start, pages := time.Now(), db.page.flushed
+	logAt(db, slog.LevelInfo, "vacuum started", "path", db.Path, "pages", pages,
+		"readers", len(db.ongoing))
+	meta, root := saveMeta(db), db.tree.root
+	db.free.curVer = db.version + 1
+	ok, err := vacuumUpdate(ctx, db, minVer, pinned)
+	if err != nil || !ok {
+		loadMeta(db, meta)
+		pageDiscard(db)
+	}
+	if err != nil {
+		logAt(db, slog.LevelWarn, "vacuum stopped", "path", db.Path, "err", err)
+		return 0, err
+	}
+	if ok {
+		historyAdd(db, root)
+		db.version++
+		end := db.changes.size
+		if err := changesAppend(db, nil); err != nil { // keeps the sequence
+			loadMeta(db, meta)
+			pageDiscard(db)
+			return 0, err
+		}
+		if err := updateOrRevert(db, meta); err != nil {
+			db.changes.size = end
+			return 0, err
+		}
+		db.free.SetMaxVer(minVer)
+	}
+
+	size := int64(db.page.flushed) * int64(db.page.size)
+	if !mapPastEOF {
+		size = max(size, int64(db.mmap.total)) // not below a view
+	}
+	if size >= fsize {
+		logAt(db, slog.LevelInfo, "vacuum done", "path", db.Path, "reclaimed", 0)
+		return 0, nil
+	}
+	// pages past the end are not used; a failure here is harmless
+	cacheTruncate(db, db.page.flushed)
+	if err := fileTruncate(db.fd, size); err != nil {
+		return 0, fmt.Errorf("truncate: %w", err)
+	}
+	db.page.file = size
+	if err := fsyncCounted(db, db.fd); err != nil {
+		return 0, err
+	}
+	logAt(db, slog.LevelInfo, "vacuum done", "path", db.Path, "pages", pages,
+		"new_pages", db.page.flushed, "reclaimed", fsize-size,
+		"elapsed", time.Since(start))
+	return fsize - size, nil
+}
+
+// move the tree and rebuild the free list in pending updates.
+// false if the file would not shrink.
+func vacuumUpdate(ctx context.Context, db *KV, minVer uint64, pinned bool) (ok bool, err error) {
+	defer checksumRecover(&err)
+	defer func() {
+		db.tree.new, db.tree.del = db.pageAlloc, db.free.PushTail
+		db.free.new = db.freeAppend
+	}()
+
+	n := db.page.flushed
+	kind := make([]byte, n)
+	versions := map[uint64]uint64{} // of the free list items
+	avail := 0
+	flWalk(&db.free, func(ptr uint64) {
+		kind[ptr] = VACUUM_OLD
+	}, func(ptr uint64, version uint64) {
+		versions[ptr] = version
+		if !versionBefore(minVer, version) {
+			kind[ptr] = VACUUM_AVAIL
+			avail++
+		}
+	})
+	internal := 0
+	if db.tree.root != 0 {
+		if internal, err = vacuumMark(ctx, db, kind, db.tree.root); err != nil {
+			return false, err
+		}
+	}
+
+	// the smallest end that leaves room below it for the moved pages,
+	// the copied internal nodes and the free list nodes
+	extra := internal + int(n)/db.free.capacity() + 2
+	end, moved := n, 0
+	for ; end > 1; end-- {
+		switch kind[end-1] {
+		case VACUUM_TREE:
+			moved++
+		case VACUUM_AVAIL:
+			avail--
+		}
+		if kind[end-1] == VACUUM_KEEP || (kind[end-1] == VACUUM_TREE && pinned) ||
+			avail < moved+extra {
+			break
+		}
+	}
+
+	// allocate from the front. `limit` keeps off the pages being freed.
+	next, limit := uint64(1), n
+	alloc := func(node []byte) uint64 {
+		for ; next < limit && kind[next] != VACUUM_AVAIL; next++ {
+		}
+		if next >= limit {
+			return db.pageAppend(node)
+		}
+		kind[next] = VACUUM_TREE
+		db.page.updates[next] = node
+		return next
+	}
+
+	// move the tree
+	if !pinned && db.tree.root != 0 {
+		db.tree.new = alloc
+		db.tree.del = func(ptr uint64) { kind[ptr] = VACUUM_OLD }
+		db.tree.root = treeRelocate(&db.tree, db.tree.root, func(ptr uint64) bool {
+			return ptr >= end && ctx.Err() == nil
+		})
+		if err := ctx.Err(); err != nil {
+			return false, err // a partial move
+		}
+	}
+
+	// drop the unused pages at the end
+	end = n
+	for db.page.nappend == 0 && end > 1 &&
+		(kind[end-1] == VACUUM_AVAIL || kind[end-1] == VACUUM_OLD) {
+		end--
+	}
+	if db.page.nappend == 0 {
+		db.page.flushed = end
+	}
+
+	// a new free list with the free pages before the end.
+	// items are added from the back while nodes are allocated from the front.
+	limit = end
+	db.free.new = alloc
+	head := alloc(make([]byte, db.page.size))
+	db.free.headPage, db.free.headSeq = head, 0
+	db.free.tailPage, db.free.tailSeq = head, 0
+	db.free.maxSeq = 0
+	curVer := db.free.curVer
+	for ptr := end - 1; ptr > 0; ptr-- {
+		limit = ptr
+		version, ok := versions[ptr]
+		switch {
+		case kind[ptr] == VACUUM_OLD:
+			version = curVer
+		case kind[ptr] == VACUUM_AVAIL, kind[ptr] == VACUUM_KEEP && ok:
+		default:
+			continue
+		}
+		db.free.curVer = version
+		db.free.PushTail(ptr)
+	}
+	db.free.curVer = curVer
+	return db.page.flushed+db.page.nappend < n, nil
+}
+
+// mark the pages of a subtree. returns the number of internal nodes.
+func vacuumMark(ctx context.Context, db *KV, kind []byte, ptr uint64) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	kind[ptr] = VACUUM_TREE
+	node := btree.BNode(db.pageRead(ptr))
+	if node.btype() == btree.BNODE_LEAF {
+		for i := uint16(0); i < node.nkeys(); i++ {
+			if !node.isOverflow(i) {
+				continue
+			}
+			ref := node.getVal(i)
+			for p := binary.LittleEndian.Uint64(ref[8:16]); p != 0; {
+				kind[p] = VACUUM_TREE
+				p = binary.LittleEndian.Uint64(db.pageRead(p)[0:8])
+			}
+		}
+		return 0, nil
+	}
+	count := 1
+	for i := uint16(0); i < node.nkeys(); i++ {
+		n, err := vacuumMark(ctx, db, kind, node.getPtr(i))
+		if err != nil {
+			return 0, err
+		}
+		count += n
+	}
+	return count, nil
+}
@@ -0,0 +1,284 @@
+package kv
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+write-ahead log mode.
+
+a commit appends its updates to the log and fsyncs only the log. the new
+tree pages are written to the main file without fsync, but the meta page
+keeps pointing to the last checkpoint, so they are not used by recovery.
+a checkpoint fsyncs the main file, updates the meta page and empties the log.
+
+pages freed after the last checkpoint are still used by the checkpointed
+tree, so they are not reused until the next checkpoint.
+
+log record:
+| crc32 | len | op | klen | vlen | key | val | op | ... |
+|  4B   | 4B  | 1B |  4B  |  4B  | ... | ... |
+a WAL_DEL_RANGE has the start of the range as the key and the end as
+the value; see KVTX.DeleteRange.
+*/
+
+const (
+	WAL_DEL       = byte(1)
+	WAL_SET       = byte(2)
+	WAL_DEL_RANGE = byte(3) // the keys in [key, val)
+
+	WAL_CHECKPOINT = 1000     // default commits between checkpoints
+	WAL_MAX_SIZE   = 64 << 20 // default log size that triggers a checkpoint
+)
+
+type walState struct {
+	fd      int
+	open    bool
+	size    int64 // log file size
+	commits int   // since the last checkpoint
+	err     error // a failed log fsync; the DB must be reopened
+	// group commit: log positions only grow, even when the log is emptied
+	written atomic.Uint64
+	synced  atomic.Uint64
+	syncMu  sync.Mutex // serialize log fsyncs
+}
+
+func walPath(db *KV) string {
+	return db.Path + "-wal"
+}
+
+// append an update to a log record
+func walAppend(rec []byte, op byte, key []byte, val []byte) []byte {
+	if len(rec) == 0 {
+		rec = make([]byte, 8) // header
+	}
+	rec = append(rec, op)
+	rec = binary.LittleEndian.AppendUint32(rec, uint32(len(key)))
+	rec = binary.LittleEndian.AppendUint32(rec, uint32(len(val)))
+	rec = append(rec, key...)
+	return append(rec, val...)
+}
+
+// the next complete record in the log, nil at the end or a torn write
+func walNext(data []byte) (rec []byte, rest []byte) {
+	if len(data) < 8 {
+		return nil, nil
+	}
+	size := uint64(binary.LittleEndian.Uint32(data[4:8]))
+	if uint64(len(data)-8) < size {
+		return nil, nil
+	}
+	rec = data[8 : 8+size]
+	if crc32.ChecksumIEEE(rec) != binary.LittleEndian.Uint32(data[0:4]) {
+		return nil, nil
+	}
+	return rec, data[8+size:]
+}
+
+// call `fn` on each update of a log record
+func walScan(rec []byte, fn func(op byte, key []byte, val []byte) error) error {
+	for len(rec) > 0 {
+		if len(rec) < 9 {
+			return errors.New("bad log record")
+		}
+		op := rec[0]
+		klen := uint64(binary.LittleEndian.Uint32(rec[1:5]))
+		vlen := uint64(binary.LittleEndian.Uint32(rec[5:9]))
+		if uint64(len(rec)-9) < klen+vlen {
+			return errors.New("bad log record")
+		}
+		key, val := rec[9:9+klen], rec[9+klen:9+klen+vlen]
+		rec = rec[9+klen+vlen:]
+		if err := fn(op, key, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apply a log record to the tree
+func walApply(db *KV, rec []byte) error {
+	return walScan(rec, func(op byte, key []byte, val []byte) error {
+		var err error
+		switch op {
+		case WAL_DEL:
+			_, err = db.tree.Delete(&DeleteReq{Key: key})
+		case WAL_SET:
+			_, err = db.tree.Update(&UpdateReq{Key: key, Val: val})
+		case WAL_DEL_RANGE:
+			_, err = db.tree.DeleteRange(key, val)
+		default:
+			err = errors.New("bad log record")
+		}
+		return err
+	})
+}
+
+// replay the log left by a crash and make it a checkpoint.
+// the log is kept open in WAL mode and removed otherwise.
+func walOpen(db *KV) error {
+	data, err := os.ReadFile(walPath(db))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("read log: %w", err)
+	}
+
+	replayed := 0
+	for rec, rest := walNext(data); rec != nil; rec, rest = walNext(rest) {
+		db.free.curVer = db.version + 1
+		if err := walApply(db, rec); err != nil {
+			return err
+		}
+		db.version++
+		if err := changesAppend(db, rec); err != nil {
+			return err
+		}
+		// pages freed by the replay are not reused, so they can be written now
+		if err := writePages(db); err != nil {
+			return err
+		}
+		replayed++
+	}
+	if replayed > 0 {
+		if err := walSyncMain(db); err != nil {
+			return err
+		}
+		db.free.SetMaxVer(historyMinVer(db, db.version))
+		logAt(db, slog.LevelWarn, "recovered from the log", "path", walPath(db),
+			"records", replayed, "version", db.version)
+	}
+	db.metaVer = db.version
+
+	if !db.WAL {
+		if data != nil {
+			if err := os.Remove(walPath(db)); err != nil {
+				return fmt.Errorf("remove log: %w", err)
+			}
+		}
+		return nil
+	}
+	if db.wal.fd, err = createFileSync(walPath(db)); err != nil {
+		return err
+	}
+	db.wal.open = true
+	if err := fileTruncate(db.wal.fd, 0); err != nil {
+		return fmt.Errorf("truncate log: %w", err)
+	}
+	return fsyncCounted(db, db.wal.fd)
+}
+
+// make the pages written by commits persistent and point the meta page to them
+func walSyncMain(db *KV) error {
+	if err := fsyncCounted(db, db.fd); err != nil {
+		return err
+	}
+	if err := updateRoot(db); err != nil {
+		return err
+	}
+	if err := fsyncCounted(db, db.fd); err != nil {
+		return err
+	}
+	db.metaVer = db.version
+	return nil
+}
+
+// write the tree to the main file and empty the log
+func walCheckpoint(db *KV) error {
+	start, size, commits := time.Now(), db.wal.size, db.wal.commits
+	if err := walSyncMain(db); err != nil {
+		return err
+	}
+	// the log is still complete if this fails; replaying it again is harmless
+	if err := fileTruncate(db.wal.fd, 0); err != nil {
+		return fmt.Errorf("truncate log: %w", err)
+	}
+	if err := fsyncCounted(db, db.wal.fd); err != nil {
+		return err
+	}
+	db.wal.size, db.wal.commits = 0, 0
+	db.wal.synced.Store(db.wal.written.Load())
+	logAt(db, slog.LevelInfo, "checkpoint", "path", db.Path, "commits", commits,
+		"log_size", size, "elapsed", time.Since(start))
+	return nil
+}
+
+// a commit in WAL mode. the record is written but not fsynced;
+// the returned position is passed to walSync.
+func walCommit(db *KV, meta []byte, rec []byte) (uint64, error) {
+	err := db.wal.err
+	if err == nil {
+		err = writePages(db)
+	}
+	if err == nil {
+		binary.LittleEndian.PutUint32(rec[4:8], uint32(len(rec)-8))
+		binary.LittleEndian.PutUint32(rec[0:4], crc32.ChecksumIEEE(rec[8:]))
+		err = filePwrite(db.wal.fd, rec, db.wal.size)
+	}
+	if err != nil {
+		// the same as updateOrRevert; the written pages are unused
+		loadMeta(db, meta)
+		pageDiscard(db)
+		return 0, err
+	}
+
+	db.wal.size += int64(len(rec))
+	db.wal.commits++
+	lsn := db.wal.written.Add(uint64(len(rec)))
+
+	limit, maxSize := db.WALCheckpoint, db.WALMaxSize
+	if limit <= 0 {
+		limit = WAL_CHECKPOINT
+	}
+	if maxSize <= 0 {
+		maxSize = WAL_MAX_SIZE
+	}
+	// a new file has no meta page to recover from yet
+	if db.metaVer == 0 || db.wal.commits >= limit || db.wal.size >= maxSize {
+		// the commit is durable by the log anyway; retried later on error
+		_ = walCheckpoint(db)
+	}
+	return lsn, nil
+}
+
+// wait for the log to be persistent up to `lsn`. called without the lock,
+// so a single fsync covers the records of concurrent commits.
+func walSync(db *KV, lsn uint64) error {
+	db.wal.syncMu.Lock()
+	defer db.wal.syncMu.Unlock()
+	if db.wal.synced.Load() >= lsn {
+		return nil // by another commit or a checkpoint
+	}
+
+	written := db.wal.written.Load()
+	if err := fsyncCounted(db, db.wal.fd); err != nil {
+		// what's in memory may not be in the log, stop further commits
+		db.mutex.Lock()
+		db.wal.err = fmt.Errorf("log fsync failed: %w", err)
+		db.mutex.Unlock()
+		logAt(db, slog.LevelError, "log fsync failed", "path", walPath(db), "err", err)
+		return err
+	}
+	if db.wal.synced.Load() < written {
+		db.wal.synced.Store(written)
+	}
+	return nil
+}
+
+// checkpoint and close the log
+func walClose(db *KV) {
+	if !db.wal.open {
+		return
+	}
+	if db.wal.err == nil {
+		_ = walCheckpoint(db) // replayed on the next open on error
+	}
+	_ = fileClose(db.wal.fd)
+	db.wal.open = false
+}
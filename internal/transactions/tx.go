@@ -0,0 +1,742 @@
+package transactions
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"runtime"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/Adit0507/AdiDB/internal/btree"
+	"github.com/Adit0507/AdiDB/internal/btree_iter"
+	"github.com/Adit0507/AdiDB/internal/kv"
+)
+
+type KVTX struct {
+	snapshot btree.BTree // read-only snapshot(copy on wrrite)
+	version  uint64
+	// local updates are held in an memory B+tree
+	pending btree.BTree     //captured KV updates
+	// the ranges of DeleteRange, [start, stop); applied before `pending`
+	cuts []KeyRange
+	reads   []KeyRange //list of involved interval of keys for dtecting conflicts
+	// cheks for conflict even if update changes nothing
+	updateAttempted bool
+	done            bool
+	readOnly        bool
+	merge           func(key []byte, old []byte, delta []byte) []byte // KV.Merge
+	// latencies go to KV.Metrics, and slow operations to KV.Logger
+	timed bool
+	db    *kv.KV
+	// called with the Seq of the commit if it changes the tree, before
+	// the next commit; it runs with the KV locked and must not block
+	onCommit func(seq uint64)
+	// the readahead of scans into the page cache; see kv_prefetch.go
+	prefetching *sync.WaitGroup
+}
+
+// start <=key <=stop
+type KeyRange struct {
+	start []byte
+	stop  []byte
+}
+
+type TXSave struct {
+	root uint64
+	cuts int
+}
+
+func (tx *KVTX) Save(save *TXSave) {
+	save.root = tx.pending.root
+	save.cuts = len(tx.cuts)
+}
+
+// the pending tree is copy-on-write, so restoring the root discards
+// later updates. reads are kept since they may have affected the updates.
+func (tx *KVTX) Revert(save *TXSave) {
+	tx.pending.root = save.root
+	tx.cuts = tx.cuts[:save.cuts]
+}
+
+const (
+	FLAG_DELETED = byte(1)
+	FLAG_UPDATED = byte(2)
+	FLAG_MERGED  = byte(3) // a delta for KV.Merge
+	FLAG_STAMPED = byte(4) // the key takes the commit version; see SetStamped
+)
+
+func assert(cond bool) {
+	if !cond{
+		panic("assetion failure")
+	}
+}
+
+// begin a transaction
+func (kv *kv.KV) Begin(tx *KVTX) {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	txBegin(kv, tx)
+}
+
+// `Begin` with the lock held
+func txBegin(kv *KVWrap, tx *KVTX) {
+	tx.snapshot.root = kv.tree.root
+	tx.snapshot.size = kv.tree.size
+	chunks := kv.mmap.chunks
+	tx.snapshot.get = func(ptr uint64) []byte { return mmapReadChecked(kv, ptr, chunks) }
+	// not a reference to `tx`, which has a finalizer
+	wg := &sync.WaitGroup{}
+	tx.prefetching = wg
+	tx.snapshot.prefetch = func(ptrs []uint64) { pagePrefetch(kv, ptrs, chunks, wg) }
+	tx.version = kv.version
+	tx.readOnly = kv.ReadOnly
+	tx.merge = kv.Merge
+	tx.timed = kv.Metrics != nil || (kv.Logger != nil && kv.SlowOp > 0)
+	tx.db = kv
+
+	// in memeory tree to caputre updaets
+	pages := [][]byte(nil)
+	tx.pending.get = func(ptr uint64) []byte { return pages[ptr-1] }
+	tx.pending.new = func(b []byte) uint64 {
+		pages = append(pages, b)
+		return uint64(len(pages))
+	}
+	tx.pending.del = func(uint64) {}
+	// keepin track of concurrent TXs
+	kv.ongoing = append(kv.ongoing, tx.version)
+	runtime.SetFinalizer(tx, func(tx *KVTX) { assert(tx.done) })
+}
+
+// begin a transaction that only reads its snapshot. pages of the
+// snapshot are not reused until it ends with Abort or Commit.
+func (kv *kv.KV) BeginRead(tx *KVTX) {
+	kv.Begin(tx)
+	tx.readOnly = true
+}
+
+// BeginRead on the tree of an earlier version, the Seq of its commit, which
+// is kept by KV.History. it fails with ErrHistoryGone if the version is no
+// longer kept; once begun, its pages are not reused until it ends.
+func (kv *kv.KV) BeginReadAt(tx *KVTX, version uint64) error {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	root, ok := historyRoot(kv, version)
+	if !ok {
+		return ErrHistoryGone
+	}
+	txBegin(kv, tx)
+	tx.snapshot.root, tx.version = root, version
+	kv.ongoing[len(kv.ongoing)-1] = version
+	tx.readOnly = true
+	return nil
+}
+
+// rollback on error
+func (kv *kv.KV) Commit(tx *KVTX) error {
+	if kv.Logger != nil && kv.SlowOp > 0 {
+		defer logSlow(kv, "commit", time.Now())
+	}
+	lsn, err := kvCommit(kv, tx)
+	if err != nil || lsn == 0 {
+		return err
+	}
+	// wait for the log without the lock so that concurrent commits
+	// share an fsync (group commit)
+	return walSync(kv, lsn)
+}
+
+// returns the log position to wait for in WAL mode
+func kvCommit(kv *KVWrap, tx *KVTX) (lsn uint64, err error) {
+	assert(!tx.done)
+	tx.done = true
+	tx.prefetching.Wait()
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	defer txFinalize(kv, tx)
+
+	// check conflicts
+	if tx.updateAttempted && detectConflicts(kv, tx) {
+		return 0, ErrorConflict
+	}
+
+	// save meta page
+	meta, root := saveMeta(kv), kv.tree.root
+	// a corrupted page; discard the partial update
+	defer func() {
+		if errors.Is(err, ErrChecksum) {
+			loadMeta(kv, meta)
+			pageDiscard(kv)
+		}
+	}()
+	defer checksumRecover(&err)
+	kv.free.curVer = kv.version + 1 //transfer current updates to current tree
+	splits, merges := kv.tree.Splits, kv.tree.Merges
+	writes := []KeyRange(nil)
+	log := []byte(nil) // WAL record
+	// the ranges first; the updates after them are kept
+	for _, cut := range tx.cuts {
+		n, err := kv.tree.DeleteRange(cut.start, cut.stop)
+		assert(err == nil) // checked by DeleteRange
+		if n > 0 && (kv.WAL || kv.Changes) {
+			log = walAppend(log, WAL_DEL_RANGE, cut.start, cut.stop)
+		}
+		if n > 0 && len(kv.ongoing) > 1 {
+			writes = append(writes, cut)
+		}
+	}
+	for iter := tx.pending.Seek(nil, btree_iter.CMP_GT); iter.Valid(); iter.Next() {
+		modified := false
+		key, val := iter.Deref()
+		oldVal, isOld := txSnapshotGet(tx, key)
+		switch val[0] {
+		case FLAG_DELETED:
+			modified = isOld
+			deleted, err := kv.tree.Delete(&DeleteReq{Key: key})
+			assert(err == nil)          // can only fail by length limit
+			assert(deleted == modified) // assured by conflict detection
+			if modified && (kv.WAL || kv.Changes) {
+				log = walAppend(log, WAL_DEL, key, nil)
+			}
+
+		case FLAG_UPDATED:
+			modified = (!isOld || !bytes.Equal(oldVal, val[1:]))
+			updated, err := kv.tree.Update(&UpdateReq{Key: key, Val: val[1:]})
+			assert(err == nil)
+			assert(updated == modified)
+			if modified && (kv.WAL || kv.Changes) {
+				log = walAppend(log, WAL_SET, key, val[1:])
+			}
+
+		case FLAG_MERGED:
+			// applied to the latest value instead of the snapshot
+			cur, isCur := kv.tree.Get(key)
+			if !isCur {
+				cur = nil
+			}
+			merged := kv.Merge(key, cur, val[1:])
+			modified = merged != nil && (!isCur || !bytes.Equal(cur, merged))
+			if !modified {
+				break
+			}
+			updated, err := kv.tree.Update(&UpdateReq{Key: key, Val: merged})
+			assert(err == nil)
+			assert(updated)
+			if kv.WAL || kv.Changes {
+				log = walAppend(log, WAL_SET, key, merged)
+			}
+
+		case FLAG_STAMPED:
+			// the version of this commit; the root changes with the key
+			off := int(binary.LittleEndian.Uint16(val[1:3]))
+			key = slices.Clone(key)
+			stamp := binary.BigEndian.Uint64(key[off:]) + kv.version + 1
+			binary.BigEndian.PutUint64(key[off:], stamp)
+			updated, err := kv.tree.Update(&UpdateReq{Key: key, Val: val[3:]})
+			assert(err == nil)
+			modified = updated
+			if modified && (kv.WAL || kv.Changes) {
+				log = walAppend(log, WAL_SET, key, val[3:])
+			}
+
+		default:
+			panic("unreachable")
+		}
+
+		if modified && len(kv.ongoing) > 1 {
+			writes = append(writes, KeyRange{key, key})
+		}
+	}
+
+	metricCount(kv, METRIC_SPLIT, kv.tree.Splits-splits)
+	metricCount(kv, METRIC_MERGE, kv.tree.Merges-merges)
+
+	// commitin update
+	if root != kv.tree.root {
+		historyAdd(kv, root)
+		kv.version++
+		ops, end := log, kv.changes.size
+		if len(ops) > 0 {
+			ops = ops[8:] // without the header
+		}
+		if err = changesAppend(kv, ops); err != nil {
+			loadMeta(kv, meta)
+			pageDiscard(kv)
+			return 0, err
+		}
+		if kv.WAL {
+			lsn, err = walCommit(kv, meta, log)
+		} else if kv.NoSync {
+			err = writeNoSync(kv, meta)
+		} else {
+			err = updateOrRevert(kv, meta)
+		}
+		if err != nil {
+			kv.changes.size = end
+			return 0, err
+		}
+		metricCount(kv, METRIC_COMMIT, 1)
+		if tx.onCommit != nil {
+			tx.onCommit(kv.version)
+		}
+	}
+
+	if len(writes) > 0 {
+		slices.SortFunc(writes, func(r1, r2 KeyRange) int {
+			return bytes.Compare(r1.start, r2.start)
+		})
+		kv.history = append(kv.history, CommittedTX{kv.version, writes})
+	}
+	return lsn, nil
+}
+
+type KVWrap struct{
+	*kv.KV
+}
+
+// end transaction
+func (kv KVWrap) Abort(tx *KVTX) {
+	assert(!tx.done)
+	tx.done = true
+	tx.prefetching.Wait()
+
+	kv.mutex.Lock()
+	txFinalize(kv, tx)
+	kv.mutex.Unlock()
+}
+
+var ErrorConflict = errors.New("cannot commit due to conflict")
+
+var ErrReadOnly = errors.New("write in a read-only transaction or database")
+
+func detectConflicts(kv KVWrap, tx *KVTX) bool {
+	slices.SortFunc(tx.reads, func(r1, r2 KeyRange) int {
+		return bytes.Compare(r1.start, r2.start)
+	})
+
+	for i := len(kv.history) - 1; i >= 0; i-- {
+		if !versionBefore(tx.version, kv.history[i].version) {
+			break
+		}
+		if sortedRangesOverlap(tx.reads, kv.history[i].writes) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func sortedRangesOverlap(s1, s2 []KeyRange) bool {
+	for len(s1) > 0 && len(s2) > 0 {
+		if bytes.Compare(s1[0].stop, s2[0].start) < 0 {
+			s1 = s1[1:]
+		} else if bytes.Compare(s2[0].stop, s1[0].start) < 0 {
+			s2 = s2[1:]
+		} else {
+			return true
+		}
+	}
+
+	return false
+}
+
+// routines when exiting a transacion
+func txFinalize(kv *KVWrap, tx *KVTX) {
+	idx := slices.Index(kv.ongoing, tx.version)
+	last := len(kv.ongoing) - 1
+	kv.ongoing[idx], kv.ongoing = kv.ongoing[last], kv.ongoing[:last]
+
+	// oldest in use version
+	minVer := kv.version
+	for _, other := range kv.ongoing {
+		if versionBefore(other, minVer) {
+			minVer = other
+		}
+	}
+
+	// the tree on disk uses the pages freed after it (WAL or NoSync)
+	if versionBefore(kv.metaVer, minVer) {
+		minVer = kv.metaVer
+	}
+	// and so do the versions kept for BeginReadAt
+	minVer = historyMinVer(kv, minVer)
+	// release free list
+	kv.free.SetMaxVer(minVer)
+
+	for idx = 0; idx < len(kv.history); idx++ {
+		if versionBefore(minVer, kv.history[idx].version) {
+			break
+		}
+	}
+
+	kv.history = kv.history[idx:]
+}
+
+// KV interfaces
+type KVIter interface {
+	Deref() (key []byte, val []byte)
+	Valid() bool
+	Next()
+}
+
+// combines pending updates and the snapshot
+type CombinedIterator struct {
+	top *btree_iter.BIter //kvtx pending
+	bot *btree_iter.BIter //kvtx snapshot
+	dir int    //+1 for greater or greater than, -1 for less or less than
+
+	//end of range
+	cmp int
+	end []byte
+	// KVTX.DeleteRange; hides the snapshot
+	cuts []KeyRange
+
+	merge func(key []byte, old []byte, delta []byte) []byte // KV.Merge
+}
+
+func (iter *CombinedIterator) Deref() ([]byte, []byte) {
+	var k1, k2, v1, v2 []byte
+	top, bot := iter.top.Valid(), iter.bot.Valid()
+	assert(top || bot)
+	if top {
+		k1, v1 = iter.top.Deref()
+	}
+	if bot {
+		k2, v2 = iter.bot.Deref()
+	}
+
+	// usin min/max key of the two
+	if top && bot && bytes.Compare(k1, k2) == +iter.dir {
+		return k2, v2
+	}
+	if top && v1[0] == FLAG_MERGED {
+		return k1, iterMerged(iter)
+	}
+	if top {
+		return k1, v1[1:]
+	} else {
+		return k2, v2
+	}
+}
+
+// the value of a merge delta at the top; nil for a missing key
+func iterMerged(iter *CombinedIterator) []byte {
+	k1, v1 := iter.top.Deref()
+	var old []byte
+	if iter.bot.Valid() {
+		if k2, v2 := iter.bot.Deref(); bytes.Equal(k1, k2) && !cutsHave(iter.cuts, k2) {
+			old = v2
+		}
+	}
+	return iter.merge(k1, old, v1[1:])
+}
+
+func (iter *CombinedIterator) Valid() bool {
+	if iter.top.Valid() || iter.bot.Valid() {
+		key, _ := iter.Deref()
+		return cmpOk(key, iter.cmp, iter.end)
+	}
+
+	return false
+}
+
+func (iter *CombinedIterator) Next() {
+	iterStep(iter)
+	iterSkipDeleted(iter)
+}
+
+// read ahead the leaves of the snapshot; see BIter.SetPrefetch. the
+// pending updates are in memory.
+func (iter *CombinedIterator) Prefetch(ahead int, after int) {
+	iter.bot.SetPrefetch(ahead, after)
+}
+
+// keys deleted in this TX hide the snapshot, and so do the ranges of
+// DeleteRange. stamped keys are not known before the commit, so they are
+// skipped too.
+func iterSkipDeleted(iter *CombinedIterator) {
+	for iter.top.Valid() || iter.bot.Valid() {
+		top, bot := iter.top.Valid(), iter.bot.Valid()
+		var k1, k2, v1 []byte
+		if top {
+			k1, v1 = iter.top.Deref()
+		}
+		if bot {
+			k2, _ = iter.bot.Deref()
+		}
+		if bot && (!top || bytes.Compare(k1, k2) == +iter.dir) {
+			// the snapshot key comes first
+			if !cutsHave(iter.cuts, k2) {
+				return
+			}
+		} else if v1[0] == FLAG_UPDATED || (v1[0] == FLAG_MERGED && iterMerged(iter) != nil) {
+			return
+		}
+		iterStep(iter)
+	}
+}
+
+func iterStep(iter *CombinedIterator) {
+	top, bot := iter.top.Valid(), iter.bot.Valid()
+	if top && bot {
+		k1, _ := iter.top.Deref()
+		k2, _ := iter.bot.Deref()
+
+		switch bytes.Compare(k1, k2) {
+		case -iter.dir:
+			top, bot = true, false
+		case +iter.dir:
+			top, bot = false, true
+		case 0: // equal; move both
+		}
+	}
+
+	assert(top || bot)
+	if top {
+		if iter.dir > 0 {
+			iter.top.Next()
+		} else {
+			iter.top.Prev()
+		}
+	}
+
+	if bot {
+		if iter.dir > 0 {
+			iter.bot.Next()
+		} else {
+			iter.bot.Prev()
+		}
+	}
+
+}
+
+func cmp2Dir(cmp int) int {
+	if cmp > 0 {
+		return +1
+	} else {
+		return -1
+	}
+}
+
+// range query combines captured updates with snapshots
+func (tx *KVTX) Seek(key1 []byte, cmp1 int, key2 []byte, cmp2 int) KVIter {
+	if tx.timed {
+		defer txTime(tx, kv.KV_OP_SCAN, time.Now())
+	}
+	assert(cmp2Dir(cmp1) != cmp2Dir(cmp2))
+	lo, hi := key1, key2
+	if cmp2Dir(cmp1) < 0 {
+		lo, hi = hi, lo
+	}
+	tx.reads = append(tx.reads, KeyRange{lo, hi})
+
+	iter := &CombinedIterator{
+		top: tx.pending.Seek(key1, cmp1),
+		bot: tx.snapshot.Seek(key1, cmp1),
+		dir: cmp2Dir(cmp1),
+		cmp: cmp2,
+		end: key2,
+
+		cuts:  tx.cuts,
+		merge: tx.merge,
+	}
+	iterSkipDeleted(iter)
+	return iter
+}
+
+func (tx *KVTX) Update(req *UpdateReq) (ok bool, err error) {
+	if tx.readOnly {
+		return false, ErrReadOnly
+	}
+	tx.updateAttempted = true
+	if tx.timed {
+		defer txTime(tx, kv.KV_OP_UPDATE, time.Now())
+	}
+	defer checksumRecover(&err)
+
+	// the old value is returned even if it's not replaced; nil if missing
+	old, exists := txGet(tx, req.Key)
+	req.Old = old
+	if req.Mode == btree.MODE_UPDATE_ONLY && !exists {
+		return false, nil
+	}
+	if req.Mode == btree.MODE_INSERT_ONLY && exists {
+		return false, nil
+	}
+	if exists && bytes.Equal(old, req.Val) {
+		return false, nil
+	}
+
+	flaggedVal := append([]byte{FLAG_UPDATED}, req.Val...)
+	_, err = tx.pending.Update(&UpdateReq{Key: req.Key, Val: flaggedVal})
+	if err != nil {
+		return false, err
+	}
+
+	req.Added = !exists
+	req.Updated = true
+
+	return true, nil
+}
+
+func (tx *KVTX) Del(req *DeleteReq) (ok bool, err error) {
+	if tx.readOnly {
+		return false, ErrReadOnly
+	}
+	tx.updateAttempted = true
+	defer checksumRecover(&err)
+	exists := false
+	if req.Old, exists = txGet(tx, req.Key); !exists {
+		return false, nil
+	}
+
+	return tx.pending.Update(&UpdateReq{Key: req.Key, Val: []byte{FLAG_DELETED}})
+}
+
+// combine `delta` into the value of `key` with KV.Merge. it's applied to the
+// latest value on commit, so unlike a read followed by an update, it doesn't
+// conflict with concurrent writes of the key. the deltas of a TX are combined
+// with each other first, so KV.Merge must be associative.
+func (tx *KVTX) Merge(key []byte, delta []byte) (err error) {
+	if tx.readOnly {
+		return ErrReadOnly
+	}
+	assert(tx.merge != nil)
+	tx.updateAttempted = true
+	defer checksumRecover(&err)
+
+	val, ok := tx.pending.Get(key)
+	switch {
+	case !ok:
+		val = append([]byte{FLAG_MERGED}, delta...)
+	case val[0] == FLAG_MERGED:
+		val = append([]byte{FLAG_MERGED}, tx.merge(key, val[1:], delta)...)
+	default: // the value is known in this TX
+		var old []byte
+		if val[0] == FLAG_UPDATED {
+			old = val[1:]
+		}
+		if merged := tx.merge(key, old, delta); merged != nil {
+			val = append([]byte{FLAG_UPDATED}, merged...)
+		} else {
+			val = []byte{FLAG_DELETED}
+		}
+	}
+	_, err = tx.pending.Update(&UpdateReq{Key: key, Val: val})
+	return err
+}
+
+// set a key that is completed on commit: the commit version is added to the
+// big-endian uint64 at `key[off:]`, so keys are ordered by commit. the keys
+// of a TX must differ before that. the key is not visible in this TX.
+func (tx *KVTX) SetStamped(key []byte, off int, val []byte) (err error) {
+	if tx.readOnly {
+		return ErrReadOnly
+	}
+	assert(off >= 0 && off+8 <= len(key) && off <= math.MaxUint16)
+	tx.updateAttempted = true
+	defer checksumRecover(&err)
+
+	flaggedVal := make([]byte, 3, 3+len(val))
+	flaggedVal[0] = FLAG_STAMPED
+	binary.LittleEndian.PutUint16(flaggedVal[1:3], uint16(off))
+	flaggedVal = append(flaggedVal, val...)
+	_, err = tx.pending.Update(&UpdateReq{Key: key, Val: flaggedVal})
+	return err
+}
+
+func (tx *KVTX) Set(key []byte, val []byte) (bool, error) {
+	return tx.Update(&UpdateReq{Key: key, Val: val})
+}
+
+// point query combines captured updates with snapshots
+func (tx *KVTX) Get(key []byte) ([]byte, bool) {
+	if tx.timed {
+		defer txTime(tx, kv.KV_OP_GET, time.Now())
+	}
+	return txGet(tx, key)
+}
+
+// `KVTX.Get` without the latency
+func txGet(tx *KVTX, key []byte) ([]byte, bool) {
+	tx.reads = append(tx.reads, KeyRange{key, key})
+	val, ok := tx.pending.Get(key)
+
+	switch {
+	case ok && val[0] == FLAG_UPDATED: //updated in this tx
+		return val[1:], true
+	case ok && val[0] == FLAG_DELETED: //deleted in this TX
+		return nil, false
+	case ok && val[0] == FLAG_MERGED: // merged with the snapshot
+		old, _ := txSnapshotGet(tx, key)
+		merged := tx.merge(key, old, val[1:])
+		return merged, merged != nil
+	case ok && val[0] == FLAG_STAMPED: // not known yet
+		return txSnapshotGet(tx, key)
+	case !ok:
+		return txSnapshotGet(tx, key)
+
+	default:
+		panic("unreachable")
+	}
+}
+
+// point reads of sorted `keys` with one forward iterator. it steps with
+// Next to a key right after the one it's at, and seeks to the others, so
+// sparse keys don't walk the rows between them. only the keys are
+// recorded as reads. `fn` is called for each key found, in order.
+func (tx *KVTX) GetSorted(keys [][]byte, fn func(i int, key []byte, val []byte) error) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	if tx.timed {
+		defer txTime(tx, kv.KV_OP_SCAN, time.Now())
+	}
+	end := keys[len(keys)-1]
+	var iter *CombinedIterator
+	before := func(key []byte) bool {
+		k, _ := iter.Deref()
+		return bytes.Compare(k, key) < 0
+	}
+	for i, key := range keys {
+		tx.reads = append(tx.reads, KeyRange{key, key})
+		if iter != nil && iter.Valid() && before(key) {
+			iter.Next() // the adjacent key
+		}
+		if iter == nil || (iter.Valid() && before(key)) {
+			iter = &CombinedIterator{
+				top: tx.pending.Seek(key, btree_iter.CMP_GE),
+				bot: tx.snapshot.Seek(key, btree_iter.CMP_GE),
+				dir: +1,
+				cmp: btree_iter.CMP_LE,
+				end: end,
+
+				cuts:  tx.cuts,
+				merge: tx.merge,
+			}
+			iterSkipDeleted(iter)
+		}
+		// past the end, or at a larger key: missing
+		if !iter.Valid() {
+			continue
+		}
+		if k, v := iter.Deref(); bytes.Equal(k, key) {
+			if err := fn(i, k, v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// report the latency of an operation since `start`
+func txTime(tx *KVTX, op kv.Op, start time.Time) {
+	if tx.db.Metrics != nil {
+		tx.db.Metrics.Time(op, time.Since(start))
+	}
+	if tx.db.Logger != nil && tx.db.SlowOp > 0 {
+		logSlow(tx.db, op.String(), start)
+	}
+}
@@ -0,0 +1,69 @@
+package transactions
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+
+	"github.com/Adit0507/AdiDB/internal/btree_iter"
+)
+
+/*
+deleting a range of keys without a delete per key. the range is kept
+aside from the pending updates and applied first on commit by
+BTree.DeleteRange, which frees the subtrees in the range whole. the
+snapshot keys in the range are hidden from the TX at once, and the
+updates after the DeleteRange are applied after it.
+
+the range is also a read, so a concurrent write in it conflicts instead
+of being deleted unseen. the commit logs it as a single WAL_DEL_RANGE.
+*/
+
+// delete the keys in [start, end); see the top
+func (tx *KVTX) DeleteRange(start []byte, end []byte) (err error) {
+	if tx.readOnly {
+		return ErrReadOnly
+	}
+	if len(start) == 0 || bytes.Compare(start, end) >= 0 {
+		return errors.New("bad key range")
+	}
+	tx.updateAttempted = true
+	defer checksumRecover(&err)
+
+	// the earlier updates in the range are dropped
+	keys := [][]byte{}
+	for iter := tx.pending.Seek(start, btree_iter.CMP_GE); iter.Valid(); iter.Next() {
+		key, _ := iter.Deref()
+		if bytes.Compare(key, end) >= 0 {
+			break
+		}
+		keys = append(keys, slices.Clone(key))
+	}
+	for _, key := range keys {
+		if _, err := tx.pending.Delete(&DeleteReq{Key: key}); err != nil {
+			return err
+		}
+	}
+	cut := KeyRange{slices.Clone(start), slices.Clone(end)}
+	tx.reads = append(tx.reads, cut)
+	tx.cuts = append(tx.cuts, cut)
+	return nil
+}
+
+// the key is in a range of DeleteRange
+func cutsHave(cuts []KeyRange, key []byte) bool {
+	for _, cut := range cuts {
+		if bytes.Compare(cut.start, key) <= 0 && bytes.Compare(key, cut.stop) < 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// the snapshot without the ranges of DeleteRange
+func txSnapshotGet(tx *KVTX, key []byte) ([]byte, bool) {
+	if cutsHave(tx.cuts, key) {
+		return nil, false
+	}
+	return tx.snapshot.Get(key)
+}
@@ -0,0 +1,449 @@
+package transactions
+
+import (
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"sort"
+	"testing"
+
+	"github.com/Adit0507/AdiDB/internal/btree_iter"
+	is "github.com/stretchr/testify/require"
+)
+
+func TestKVTXSequential(t *testing.T) {
+	d := newD()
+
+	d.add("k1", "v1")
+
+	tx := KVTX{}
+	d.db.Begin(&tx)
+
+	tx.Update(&UpdateReq{Key: []byte("k1"), Val: []byte("xxx")})
+	tx.Update(&UpdateReq{Key: []byte("k2"), Val: []byte("xxx")})
+
+	val, ok := tx.Get([]byte("k1"))
+	is.True(t, ok)
+	is.Equal(t, []byte("xxx"), val)
+	val, ok = tx.Get([]byte("k2"))
+	is.True(t, ok)
+	is.Equal(t, []byte("xxx"), val)
+
+	d.db.Abort(&tx)
+
+	d.verify(t)
+
+	d.reopen()
+	d.verify(t)
+	{
+		tx := KVTX{}
+		d.db.Begin(&tx)
+		_, ok = tx.Get([]byte("k2"))
+		is.False(t, ok)
+		d.db.Abort(&tx)
+	}
+
+	d.dispose()
+}
+
+func TestKVTXInterleave(t *testing.T) {
+	d := newD()
+
+	{
+		tx1, tx2 := KVTX{}, KVTX{}
+		d.db.Begin(&tx1)
+		d.db.Begin(&tx2)
+		tx1.Set([]byte("k1"), []byte("v1"))
+		tx2.Set([]byte("k2"), []byte("v2"))
+
+		val, ok := tx1.Get([]byte("k1"))
+		assert(ok && string(val) == "v1") // read uncomitted write
+		val, ok = tx2.Get([]byte("k2"))
+		assert(ok && string(val) == "v2")
+
+		err := d.db.Commit(&tx1)
+		assert(err == nil)
+
+		err = d.db.Commit(&tx2)
+		assert(err == nil)
+		assert(len(d.db.ongoing)+len(d.db.history) == 0)
+	}
+
+	{
+		tx1, tx2 := KVTX{}, KVTX{}
+		d.db.Begin(&tx1)
+		d.db.Begin(&tx2)
+		tx1.Set([]byte("k1"), []byte("v2"))
+		err := d.db.Commit(&tx1)
+		assert(err == nil)
+
+		val, ok := tx2.Get([]byte("k1"))
+		assert(ok && string(val) == "v1") // isolation
+
+		err = d.db.Commit(&tx2)
+		assert(err == nil) // read-only
+		assert(len(d.db.ongoing)+len(d.db.history) == 0)
+	}
+
+	{
+		tx1, tx2 := KVTX{}, KVTX{}
+		d.db.Begin(&tx1)
+		d.db.Begin(&tx2)
+		tx1.Set([]byte("k1"), []byte("v3"))
+		err := d.db.Commit(&tx1)
+		assert(err == nil)
+
+		val, ok := tx2.Get([]byte("k1"))
+		assert(ok && string(val) == "v2")
+		tx2.Set([]byte("k2"), val)
+
+		err = d.db.Commit(&tx2)
+		assert(err == ErrorConflict) // read conflict
+		assert(len(d.db.ongoing)+len(d.db.history) == 0)
+	}
+
+	{
+		tx1, tx2 := KVTX{}, KVTX{}
+		d.db.Begin(&tx1)
+		d.db.Begin(&tx2)
+		tx1.Set([]byte("k3"), []byte("v1"))
+		tx2.Del(&DeleteReq{Key: []byte("k3")})
+		err := d.db.Commit(&tx1)
+		assert(err == nil)
+		err = d.db.Commit(&tx2)
+		assert(err == ErrorConflict) // write conflict
+		assert(len(d.db.ongoing)+len(d.db.history) == 0)
+	}
+
+	{
+		d.add("k4", "v1")
+		tx1, tx2 := KVTX{}, KVTX{}
+		d.db.Begin(&tx1)
+		d.db.Begin(&tx2)
+		tx1.Set([]byte("k4"), []byte("v2"))
+		tx2.Del(&DeleteReq{Key: []byte("k4")})
+		err := d.db.Commit(&tx2)
+		assert(err == nil)
+		err = d.db.Commit(&tx1)
+		assert(err == ErrorConflict) // write conflict
+		assert(len(d.db.ongoing)+len(d.db.history) == 0)
+	}
+
+	{
+		tx1, tx2 := KVTX{}, KVTX{}
+		d.db.Begin(&tx1)
+		d.db.Begin(&tx2)
+		tx1.Set([]byte("k5"), []byte("v2"))
+		tx2.Del(&DeleteReq{Key: []byte("k5")})
+		err := d.db.Commit(&tx2) // no write
+		assert(err == nil)
+		err = d.db.Commit(&tx1)
+		assert(err == nil) // no conflict
+		assert(len(d.db.ongoing)+len(d.db.history) == 0)
+	}
+
+	{
+		tx1, tx2 := KVTX{}, KVTX{}
+		d.db.Begin(&tx1)
+		d.add("k6", "v1") // 3rd TX
+		d.add("k7", "v1")
+
+		d.db.Begin(&tx2)
+		tx2.Set([]byte("k6"), []byte("v2"))
+		err := d.db.Commit(&tx2) // no conflict
+		assert(err == nil)
+
+		_, ok := tx1.Get([]byte("k7"))
+		assert(!ok)
+		tx1.Set([]byte("k8"), []byte("v3"))
+		err = d.db.Commit(&tx1) // read conflict
+		assert(err == ErrorConflict)
+		assert(len(d.db.ongoing)+len(d.db.history) == 0)
+	}
+
+	d.dispose()
+}
+
+func TestKVTXRand(t *testing.T) {
+	d := newD()
+	order := []uint32{}
+	funcs := []func(){}
+
+	N := uint32(50_000)
+	for i := uint32(0); i < N; i++ {
+		tx := KVTX{}
+		key, val := fmt.Sprintf("k%v", i), fmt.Sprintf("v%v", i)
+		funcs = append(funcs, func() { d.db.Begin(&tx) })
+		funcs = append(funcs, func() { tx.Set([]byte(key), []byte(val)) })
+		funcs = append(funcs, func() {
+			err := d.db.Commit(&tx)
+			assert(err == nil)
+		})
+
+		nums := []uint32{fmix32(3*i + 0), fmix32(3*i + 1), fmix32(3*i + 2)}
+		slices.Sort(nums)
+		order = append(order, nums...)
+	}
+	sort.Sort(sortIF{
+		len:  int(N),
+		less: func(i, j int) bool { return order[i] < order[j] },
+		swap: func(i, j int) {
+			order[i], order[j] = order[j], order[i]
+			funcs[i], funcs[j] = funcs[j], funcs[i]
+		},
+	})
+
+	for _, f := range funcs {
+		f()
+	}
+	assert(len(d.db.ongoing)+len(d.db.history) == 0)
+
+	d.dispose()
+}
+
+// a counter for KV.Merge; the keys starting with "n" are not created
+func mergeSum(key []byte, old []byte, delta []byte) []byte {
+	if old == nil && key[0] == 'n' {
+		return nil
+	}
+	sum := binary.LittleEndian.Uint64(delta)
+	if old != nil {
+		sum += binary.LittleEndian.Uint64(old)
+	}
+	return binary.LittleEndian.AppendUint64(nil, sum)
+}
+
+func u64(v uint64) []byte {
+	return binary.LittleEndian.AppendUint64(nil, v)
+}
+
+func TestKVTXMerge(t *testing.T) {
+	d := newD()
+	d.db.Merge = mergeSum
+
+	// concurrent merges don't conflict
+	tx1, tx2 := KVTX{}, KVTX{}
+	d.db.Begin(&tx1)
+	d.db.Begin(&tx2)
+	is.Nil(t, tx1.Merge([]byte("c"), u64(1)))
+	is.Nil(t, tx1.Merge([]byte("c"), u64(2)))
+	is.Nil(t, tx2.Merge([]byte("c"), u64(4)))
+	val, ok := tx1.Get([]byte("c"))
+	is.True(t, ok)
+	is.Equal(t, u64(3), val)
+	is.Nil(t, d.db.Commit(&tx1))
+	is.Nil(t, d.db.Commit(&tx2))
+	d.ref["c"] = string(u64(7))
+	d.verify(t)
+
+	// merged into the snapshot, and seen by iterators
+	tx := KVTX{}
+	d.db.Begin(&tx)
+	is.Nil(t, tx.Merge([]byte("c"), u64(1)))
+	is.Nil(t, tx.Merge([]byte("n"), u64(1))) // not created
+	keys, vals := []string{}, [][]byte{}
+	for iter := tx.Seek(nil, btree_iter.CMP_GT, []byte("z"), btree_iter.CMP_LT); iter.Valid(); iter.Next() {
+		key, val := iter.Deref()
+		keys, vals = append(keys, string(key)), append(vals, val)
+	}
+	is.Equal(t, []string{"c"}, keys)
+	is.Equal(t, [][]byte{u64(8)}, vals)
+	_, ok = tx.Get([]byte("n"))
+	is.False(t, ok)
+
+	// reverted with the other updates
+	save := TXSave{}
+	tx.Save(&save)
+	is.Nil(t, tx.Merge([]byte("c"), u64(100)))
+	tx.Revert(&save)
+	is.Nil(t, d.db.Commit(&tx))
+	d.ref["c"] = string(u64(8))
+	d.verify(t)
+
+	// after an update or a delete in the same TX
+	tx5 := KVTX{}
+	d.db.Begin(&tx5)
+	tx5.Set([]byte("a"), u64(10))
+	is.Nil(t, tx5.Merge([]byte("a"), u64(1)))
+	tx5.Del(&DeleteReq{Key: []byte("c")})
+	is.Nil(t, tx5.Merge([]byte("c"), u64(5)))
+	is.Nil(t, d.db.Commit(&tx5))
+	d.ref["a"], d.ref["c"] = string(u64(11)), string(u64(5))
+	d.verify(t)
+
+	// a read of the key still conflicts
+	tx3, tx4 := KVTX{}, KVTX{}
+	d.db.Begin(&tx3)
+	d.db.Begin(&tx4)
+	tx3.Get([]byte("a"))
+	is.Nil(t, tx3.Merge([]byte("a"), u64(1)))
+	is.Nil(t, tx4.Merge([]byte("a"), u64(1)))
+	is.Nil(t, d.db.Commit(&tx4))
+	is.Equal(t, ErrorConflict, d.db.Commit(&tx3))
+	d.ref["a"] = string(u64(12))
+	d.verify(t)
+
+	d.dispose()
+}
+
+func TestKVTXSetStamped(t *testing.T) {
+	d := newD()
+	defer d.dispose()
+	d.add("a", "1")
+	stamped := func(seq uint64, suffix string) string {
+		return "log" + string(binary.BigEndian.AppendUint64(nil, seq)) + suffix
+	}
+
+	// the same key in concurrent TXs gets the version of each commit
+	tx1, tx2 := KVTX{}, KVTX{}
+	d.db.Begin(&tx1)
+	d.db.Begin(&tx2)
+	is.Nil(t, tx1.SetStamped([]byte(stamped(0, "x")), 3, []byte("v1")))
+	is.Nil(t, tx1.SetStamped([]byte(stamped(0, "y")), 3, []byte("v2")))
+	is.Nil(t, tx2.SetStamped([]byte(stamped(0, "x")), 3, []byte("v3")))
+
+	is.Nil(t, d.db.Commit(&tx2))
+	seq2 := d.db.Seq()
+	is.Nil(t, d.db.Commit(&tx1))
+	seq1 := d.db.Seq()
+	is.Equal(t, seq2+1, seq1)
+	d.ref[stamped(seq2, "x")] = "v3"
+	d.ref[stamped(seq1, "x")] = "v1"
+	d.ref[stamped(seq1, "y")] = "v2"
+	d.verify(t)
+
+	// reverted with the other updates, and added to a base value
+	tx3 := KVTX{}
+	d.db.Begin(&tx3)
+	save := TXSave{}
+	tx3.Save(&save)
+	is.Nil(t, tx3.SetStamped([]byte(stamped(0, "z")), 3, []byte("v4")))
+	tx3.Revert(&save)
+	is.Nil(t, tx3.SetStamped([]byte(stamped(100, "z")), 3, []byte("v5")))
+
+	// not visible before the commit
+	_, ok := tx3.Get([]byte(stamped(100, "z")))
+	is.False(t, ok)
+	keys := []string{}
+	for iter := tx3.Seek([]byte("log"), btree_iter.CMP_GE, []byte("z"), btree_iter.CMP_LT); iter.Valid(); iter.Next() {
+		key, _ := iter.Deref()
+		keys = append(keys, string(key[len(key)-1:]))
+	}
+	is.Equal(t, []string{"x", "x", "y"}, keys) // in commit order
+	is.Nil(t, d.db.Commit(&tx3))
+	d.ref[stamped(100+d.db.Seq(), "z")] = "v5"
+	d.verify(t)
+
+	d.reopen()
+	d.verify(t)
+
+	// read-only
+	tx4 := KVTX{}
+	d.db.BeginRead(&tx4)
+	is.ErrorIs(t, tx4.SetStamped([]byte(stamped(0, "w")), 3, nil), ErrReadOnly)
+	d.db.Abort(&tx4)
+}
+
+func TestKVTXDeleteRange(t *testing.T) {
+	d := newD()
+	defer d.dispose()
+	for i := 0; i < 2000; i++ {
+		d.add(fmt.Sprintf("k%04d", i), fmt.Sprintf("v%d", i))
+	}
+	// the keys of a TX in [start, end)
+	keys := func(tx *KVTX, start string, end string) []string {
+		out := []string{}
+		for iter := tx.Seek([]byte(start), btree_iter.CMP_GE, []byte(end), btree_iter.CMP_LT); iter.Valid(); iter.Next() {
+			key, _ := iter.Deref()
+			out = append(out, string(key))
+		}
+		return out
+	}
+
+	// hidden at once; the updates before are dropped, the later ones kept
+	tx := KVTX{}
+	d.db.Begin(&tx)
+	tx.Set([]byte("k0500"), []byte("x"))
+	is.Nil(t, tx.DeleteRange([]byte("k0100"), []byte("k1000")))
+	tx.Set([]byte("k0200"), []byte("y"))
+	_, ok := tx.Get([]byte("k0500"))
+	is.False(t, ok)
+	is.Equal(t, []string{"k0099", "k0200", "k1000"}, keys(&tx, "k0099", "k1001"))
+	is.Equal(t, []string{"k1000", "k0200", "k0099"}, func() []string {
+		out := []string{}
+		iter := tx.Seek([]byte("k1000"), btree_iter.CMP_LE, []byte("k0099"), btree_iter.CMP_GE)
+		for ; iter.Valid(); iter.Next() {
+			key, _ := iter.Deref()
+			out = append(out, string(key))
+		}
+		return out
+	}())
+
+	// reverted with the other updates
+	save := TXSave{}
+	tx.Save(&save)
+	is.Nil(t, tx.DeleteRange([]byte("k1500"), []byte("k1600")))
+	tx.Revert(&save)
+	_, ok = tx.Get([]byte("k1550"))
+	is.True(t, ok)
+	is.Nil(t, d.db.Commit(&tx))
+	for i := 100; i < 1000; i++ {
+		delete(d.ref, fmt.Sprintf("k%04d", i))
+	}
+	d.ref["k0200"] = "y"
+	d.verify(t)
+	d.reopen()
+	d.verify(t)
+
+	// a concurrent write in the range conflicts
+	tx1, tx2 := KVTX{}, KVTX{}
+	d.db.Begin(&tx1)
+	d.db.Begin(&tx2)
+	is.Nil(t, tx1.DeleteRange([]byte("k1000"), []byte("k1100")))
+	tx2.Set([]byte("k1050"), []byte("z"))
+	is.Nil(t, d.db.Commit(&tx2))
+	is.Equal(t, ErrorConflict, d.db.Commit(&tx1))
+	d.ref["k1050"] = "z"
+	d.verify(t)
+
+	tx3 := KVTX{}
+	d.db.BeginRead(&tx3)
+	is.ErrorIs(t, tx3.DeleteRange([]byte("a"), []byte("b")), ErrReadOnly)
+	d.db.Abort(&tx3)
+}
+
+// pages freed after a snapshot are reused only after it ends
+func TestKVTXSnapshotReuse(t *testing.T) {
+	d := newD()
+	defer d.dispose()
+	churn := func(seed int) {
+		for i := 0; i < 2000; i++ {
+			key := fmt.Sprintf("k%03d", fmix32(uint32(i))%300)
+			d.add(key, fmt.Sprintf("%d:%0400d", seed, i))
+		}
+	}
+	churn(0)
+	size := fileSize(d.db.Path)
+
+	reader := KVTX{}
+	d.db.BeginRead(&reader)
+	ref := map[string]string{}
+	for k, v := range d.ref {
+		ref[k] = v
+	}
+	churn(1)
+	held := fileSize(d.db.Path)
+	is.Greater(t, held, size) // the old pages are kept
+	for k, v := range ref {
+		val, ok := reader.Get([]byte(k))
+		is.True(t, ok)
+		is.Equal(t, v, string(val))
+	}
+	d.db.Abort(&reader)
+
+	// the file stops growing
+	churn(2)
+	churn(3)
+	is.Equal(t, held, fileSize(d.db.Path))
+	d.verify(t)
+}
@@ -1,343 +0,0 @@
-package kv
-
-// go:build (linux && 386) || (darwin && !cgo)
-
-import (
-	"bytes"
-	"encoding/binary"
-	"errors"
-	"fmt"
-	"os"
-	"path"
-	"sync"
-	"syscall"
-
-	"github.com/Adit0507/AdiDB/btree"
-	"github.com/Adit0507/AdiDB/freelist"
-	"golang.org/x/sys/unix"
-)
-
-type KV struct {
-	Path  string
-	Fsync func(int) error // overridable; for testing
-	// internals
-	fd   int
-	tree btree.BTree
-	free freelist.FreeList
-	mmap struct {
-		total  int      // mmap size, can be larger than the file size
-		chunks [][]byte // multiple mmaps, can be non-continuous
-	}
-	page struct {
-		flushed uint64            // database size in number of pages
-		nappend uint64            // number of pages to be appended
-		updates map[uint64][]byte // pending updates, including appended pages
-	}
-	failed bool // Did the last update fail?
-	// concurrency control
-	mutex   sync.Mutex    // serialize TX methods
-	version uint64        // monotonic version number
-	ongoing []uint64      // version numbers of concurrent TXs
-	history []CommittedTX // chanages keys; for detecting conflicts
-}
-
-type CommittedTX struct {
-	version uint64
-	writes  []KeyRange // sorted
-}
-
-// `BTree.get`, read a page.
-func (db *KV) pageRead(ptr uint64) []byte {
-	assert(ptr < db.page.flushed+db.page.nappend)
-	if node, ok := db.page.updates[ptr]; ok {
-		return node // pending update
-	}
-	return mmapRead(ptr, db.mmap.chunks)
-}
-
-func mmapRead(ptr uint64, chunks [][]byte) []byte {
-	start := uint64(0)
-	for _, chunk := range chunks {
-		end := start + uint64(len(chunk))/BTREE_PAGE_SIZE
-		if ptr < end {
-			offset := BTREE_PAGE_SIZE * (ptr - start)
-			return chunk[offset : offset+BTREE_PAGE_SIZE]
-		}
-		start = end
-	}
-	panic("bad ptr")
-}
-
-func assert(cond bool) {
-	if !cond {
-		panic("assertion failure")
-	}
-}
-
-// `BTree.new`, allocate a new page.
-func (db *KV) pageAlloc(node []byte) uint64 {
-	assert(len(node) == btree.BTREE_PAGE_SIZE)
-	if ptr := db.free.PopHead(); ptr != 0 { // try the free list
-		assert(db.page.updates[ptr] == nil)
-		db.page.updates[ptr] = node
-		return ptr
-	}
-	return db.pageAppend(node) // append
-}
-
-// `FreeList.new`, append a new page.
-func (db *KV) pageAppend(node []byte) uint64 {
-	assert(len(node) == btree.BTREE_PAGE_SIZE)
-	ptr := db.page.flushed + db.page.nappend
-	db.page.nappend++
-	assert(db.page.updates[ptr] == nil)
-	db.page.updates[ptr] = node
-	return ptr
-}
-
-// `FreeList.set`, update an existing page.
-func (db *KV) pageWrite(ptr uint64) []byte {
-	assert(ptr < db.page.flushed+db.page.nappend)
-	if node, ok := db.page.updates[ptr]; ok {
-		return node // pending update
-	}
-	// initialize from the file
-	node := make([]byte, btree.BTREE_PAGE_SIZE)
-	if !(ptr == 1 && db.page.flushed == 2) {
-		// special case: page 1 doesn't exist after creating an empty DB
-		copy(node, mmapRead(ptr, db.mmap.chunks))
-	}
-	db.page.updates[ptr] = node
-	return node
-}
-
-// open or create a file and fsync the directory
-func createFileSync(file string) (int, error) {
-	// obtain the directory fd
-	flags := os.O_RDONLY | syscall.O_DIRECTORY
-	dirfd, err := syscall.Open(path.Dir(file), flags, 0o644)
-	if err != nil {
-		return -1, fmt.Errorf("open directory: %w", err)
-	}
-	defer syscall.Close(dirfd)
-	// open or create the file
-	flags = os.O_RDWR | os.O_CREATE
-	fd, err := syscall.Openat(dirfd, path.Base(file), flags, 0o644)
-	if err != nil {
-		return -1, fmt.Errorf("open file: %w", err)
-	}
-	// fsync the directory
-	err = syscall.Fsync(dirfd)
-	if err != nil { // may leave an empty file
-		_ = syscall.Close(fd)
-		return -1, fmt.Errorf("fsync directory: %w", err)
-	}
-	// done
-	return fd, nil
-}
-
-// open or create a DB file
-func (db *KV) Open() error {
-	if db.Fsync == nil {
-		db.Fsync = syscall.Fsync
-	}
-	var err error
-	db.page.updates = map[uint64][]byte{}
-	// B+tree callbacks
-	db.tree.get = db.pageRead
-	db.tree.new = db.pageAlloc
-	db.tree.del = db.free.PushTail
-	// free list callbacks
-	db.free.get = db.pageRead
-	db.free.new = db.pageAppend
-	db.free.set = db.pageWrite
-	// open or create the DB file
-	if db.fd, err = createFileSync(db.Path); err != nil {
-		return err
-	}
-	// get the file size
-	finfo := syscall.Stat_t{}
-	if err = syscall.Fstat(db.fd, &finfo); err != nil {
-		goto fail
-	}
-	// create the initial mmap
-	if err = extendMmap(db, int(finfo.Size)); err != nil {
-		goto fail
-	}
-	// read the meta page
-	if err = readRoot(db, finfo.Size); err != nil {
-		goto fail
-	}
-	return nil
-	// error
-fail:
-	db.Close()
-	return fmt.Errorf("KV.Open: %w", err)
-}
-
-const DB_SIG = "BuildYourOwnDB12"
-
-/*
-the 1st page stores the root pointer and other auxiliary data.
-| sig | root | page_used | head_page | head_seq | tail_page | tail_seq | ver |
-| 16B |  8B  |     8B    |     8B    |    8B    |     8B    |    8B    |  8B |
-*/
-func loadMeta(db *KV, data []byte) {
-	db.tree.root = binary.LittleEndian.Uint64(data[16:24])
-	db.page.flushed = binary.LittleEndian.Uint64(data[24:32])
-	db.free.headPage = binary.LittleEndian.Uint64(data[32:40])
-	db.free.headSeq = binary.LittleEndian.Uint64(data[40:48])
-	db.free.tailPage = binary.LittleEndian.Uint64(data[48:56])
-	db.free.tailSeq = binary.LittleEndian.Uint64(data[56:64])
-	db.version = binary.LittleEndian.Uint64(data[64:72])
-}
-
-func saveMeta(db *KV) []byte {
-	var data [72]byte
-	copy(data[:16], []byte(DB_SIG))
-	binary.LittleEndian.PutUint64(data[16:24], db.tree.root)
-	binary.LittleEndian.PutUint64(data[24:32], db.page.flushed)
-	binary.LittleEndian.PutUint64(data[32:40], db.free.headPage)
-	binary.LittleEndian.PutUint64(data[40:48], db.free.headSeq)
-	binary.LittleEndian.PutUint64(data[48:56], db.free.tailPage)
-	binary.LittleEndian.PutUint64(data[56:64], db.free.tailSeq)
-	binary.LittleEndian.PutUint64(data[64:72], db.version)
-	return data[:]
-}
-
-func readRoot(db *KV, fileSize int64) error {
-	if fileSize%btree.BTREE_PAGE_SIZE != 0 {
-		return errors.New("file is not a multiple of pages")
-	}
-	if fileSize == 0 { // empty file
-		// reserve 2 pages: the meta page and a free list node
-		db.page.flushed = 2
-		// add an initial node to the free list so it's never empty
-		db.free.headPage = 1 // the 2nd page
-		db.free.tailPage = 1
-		return nil // the meta page will be written in the 1st update
-	}
-	// read the page
-	data := db.mmap.chunks[0]
-	loadMeta(db, data)
-	// initialize the free list
-	db.free.SetMaxVer(db.version)
-	// verify the page
-	bad := !bytes.Equal([]byte(DB_SIG), data[:16])
-	// pointers are within range?
-	maxpages := uint64(fileSize / btree.BTREE_PAGE_SIZE)
-	bad = bad || !(0 < db.page.flushed && db.page.flushed <= maxpages)
-	bad = bad || !(0 < db.tree.root && db.tree.root < db.page.flushed)
-	bad = bad || !(0 < db.free.headPage && db.free.headPage < db.page.flushed)
-	bad = bad || !(0 < db.free.tailPage && db.free.tailPage < db.page.flushed)
-	if bad {
-		return errors.New("bad meta page")
-	}
-	return nil
-}
-
-// update the meta page. it must be atomic.
-func updateRoot(db *KV) error {
-	// NOTE: atomic?
-	if _, err := syscall.Pwrite(db.fd, saveMeta(db), 0); err != nil {
-		return fmt.Errorf("write meta page: %w", err)
-	}
-	return nil
-}
-
-// extend the mmap by adding new mappings.
-func extendMmap(db *KV, size int) error {
-	if size <= db.mmap.total {
-		return nil // enough range
-	}
-	alloc := max(db.mmap.total, 64<<20) // double the current address space
-	for db.mmap.total+alloc < size {
-		alloc *= 2 // still not enough?
-	}
-	chunk, err := syscall.Mmap(
-		db.fd, int64(db.mmap.total), alloc,
-		syscall.PROT_READ, syscall.MAP_SHARED, // read-only
-	)
-	if err != nil {
-		return fmt.Errorf("mmap: %w", err)
-	}
-	db.mmap.total += alloc
-	db.mmap.chunks = append(db.mmap.chunks, chunk)
-	return nil
-}
-
-func updateFile(db *KV) error {
-	// 1. Write new nodes.
-	if err := writePages(db); err != nil {
-		return err
-	}
-	// 2. `fsync` to enforce the order between 1 and 3.
-	if err := db.Fsync(db.fd); err != nil {
-		return err
-	}
-	// 3. Update the root pointer atomically.
-	if err := updateRoot(db); err != nil {
-		return err
-	}
-	// 4. `fsync` to make everything persistent.
-	if err := db.Fsync(db.fd); err != nil {
-		return err
-	}
-	return nil
-}
-
-func updateOrRevert(db *KV, meta []byte) error {
-	// ensure the on-disk meta page matches the in-memory one after an error
-	if db.failed {
-		if _, err := syscall.Pwrite(db.fd, meta, 0); err != nil {
-			return fmt.Errorf("rewrite meta page: %w", err)
-		}
-		if err := db.Fsync(db.fd); err != nil {
-			return err
-		}
-		db.failed = false
-	}
-	// 2-phase update
-	err := updateFile(db)
-	// revert on error
-	if err != nil {
-		// the on-disk meta page is in an unknown state.
-		// mark it to be rewritten on later recovery.
-		db.failed = true
-		// in-memory states are reverted immediately to allow reads
-		loadMeta(db, meta)
-		// discard temporaries
-		db.page.nappend = 0
-		db.page.updates = map[uint64][]byte{}
-	}
-	return err
-}
-
-func writePages(db *KV) error {
-	// extend the mmap if needed
-	size := (db.page.flushed + db.page.nappend) * btree.BTREE_PAGE_SIZE
-	if err := extendMmap(db, int(size)); err != nil {
-		return err
-	}
-	// write data pages to the file
-	for ptr, node := range db.page.updates {
-		offset := int64(ptr * btree.BTREE_PAGE_SIZE)
-		if _, err := unix.Pwrite(db.fd, node, offset); err != nil {
-			return err
-		}
-	}
-	// discard in-memory data
-	db.page.flushed += db.page.nappend
-	db.page.nappend = 0
-	db.page.updates = map[uint64][]byte{}
-	return nil
-}
-
-// cleanups
-func (db *KV) Close() {
-	for _, chunk := range db.mmap.chunks {
-		err := syscall.Munmap(chunk)
-		assert(err == nil)
-	}
-	_ = syscall.Close(db.fd)
-}
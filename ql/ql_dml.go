@@ -0,0 +1,217 @@
+package ql
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+/*
+SQL writes, each statement in a transaction:
+	INSERT INTO table (cols) VALUES (vals), ...
+	REPLACE INTO ... and UPSERT INTO ..., with the same form
+	UPDATE table SET col = val, ... [WHERE pred AND ...] [LIMIT [offset,] count]
+	DELETE FROM table [WHERE pred AND ...] [LIMIT [offset,] count]
+the values are constants: integers, 'strings' or "strings" with the
+escapes \n, \t, \xHH, \\ and the quote, and NULL.
+
+INSERT fails on a duplicate key, and then nothing is written. REPLACE
+skips the rows that don't exist. UPDATE writes the SET columns only, and
+can't change the primary key. the rows of UPDATE and DELETE are found as
+in SELECT (see ql_query.go); a DELETE on a primary key range with no
+other predicate is a DBTX.DeleteRange.
+
+a WHERE that no index narrows is a full scan, which locks out the other
+writers for as long as it runs, so it's an error unless it's allowed by
+ExecOptions.
+*/
+
+type ExecOptions struct {
+	// run UPDATE and DELETE without a WHERE, or with a WHERE that scans
+	// the whole table
+	AllowFullScan bool
+}
+
+// run an INSERT, REPLACE, UPSERT, UPDATE or DELETE.
+// returns the number of rows added, updated or deleted.
+func (db *DB) Exec(sql string) (int64, error) {
+	return db.ExecWith(sql, ExecOptions{})
+}
+
+func (db *DB) ExecWith(sql string, opts ExecOptions) (int64, error) {
+	stmt, err := pParse(sql)
+	if err != nil {
+		return 0, err
+	}
+
+	affected := int64(0)
+	err = db.WriteBatch(func(b *Batch) error {
+		var err error
+		switch req := stmt.(type) {
+		case *QLInsert:
+			affected, err = qlExecInsert(&b.tx, req)
+		case *QLUPdate:
+			affected, err = qlExecUpdate(&b.tx, req, opts)
+		case *QLDelete:
+			affected, err = qlExecDelete(&b.tx, req, opts)
+		default:
+			err = errors.New("only INSERT, REPLACE, UPSERT, UPDATE and DELETE are supported by Exec")
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return affected, nil
+}
+
+func qlExecInsert(tx *DBTX, req *QLInsert) (int64, error) {
+	tdef, err := getTableDef(tx, req.Table)
+	if err != nil {
+		return 0, err
+	}
+	cols := make([]int, len(req.Names))
+	for i, name := range req.Names {
+		if cols[i] = slices.Index(tdef.Cols, name); cols[i] < 0 {
+			return 0, fmt.Errorf("unknown column: %s", name)
+		}
+	}
+
+	affected := int64(0)
+	for n, nodes := range req.Values {
+		vals, err := qlConsts(tdef, cols, nodes)
+		if err != nil {
+			return 0, fmt.Errorf("row %d: %w", n, err)
+		}
+		dbreq := DBUpdateReq{Record: Record{Cols: req.Names, Vals: vals}, Mode: req.Mode}
+		_, err = tx.Set(req.Table, &dbreq)
+		if req.Mode == MODE_UPDATE_ONLY && errors.Is(err, ErrRecordNotFound) {
+			continue // REPLACE skips it
+		}
+		if err != nil {
+			return 0, fmt.Errorf("row %d: %w", n, err)
+		}
+		if dbreq.Added || dbreq.Updated {
+			affected++
+		}
+	}
+	return affected, nil
+}
+
+// the constant values of the columns
+func qlConsts(tdef *TableDef, cols []int, nodes []QLNODE) ([]Value, error) {
+	vals, err := qlEvelMulti(Record{}, nodes)
+	if err != nil {
+		return nil, err
+	}
+	for i := range vals {
+		if vals[i], err = qlConst(tdef, cols[i], vals[i]); err != nil {
+			return nil, err
+		}
+	}
+	return vals, nil
+}
+
+func qlExecUpdate(tx *DBTX, req *QLUPdate, opts ExecOptions) (int64, error) {
+	tdef, err := getTableDef(tx, req.Table)
+	if err != nil {
+		return 0, err
+	}
+	cols := make([]int, len(req.Names))
+	for i, name := range req.Names {
+		if cols[i] = slices.Index(tdef.Cols, name); cols[i] < 0 {
+			return 0, fmt.Errorf("unknown column: %s", name)
+		}
+		if slices.Contains(tdef.Indexes[0], name) {
+			return 0, errors.New("cannot update the primary key")
+		}
+	}
+	vals, err := qlConsts(tdef, cols, req.Values)
+	if err != nil {
+		return 0, err
+	}
+
+	keys, _, err := qlExecKeys(tx, tdef, &req.QLScan, opts, false)
+	if err != nil {
+		return 0, err
+	}
+	affected := int64(0)
+	for _, key := range keys {
+		rec := Record{Cols: slices.Concat(key.Cols, req.Names), Vals: slices.Concat(key.Vals, vals)}
+		dbreq := DBUpdateReq{Record: rec, Partial: true}
+		if _, err := tx.Set(req.Table, &dbreq); err != nil {
+			return 0, err
+		}
+		if dbreq.Updated {
+			affected++
+		}
+	}
+	return affected, nil
+}
+
+func qlExecDelete(tx *DBTX, req *QLDelete, opts ExecOptions) (int64, error) {
+	tdef, err := getTableDef(tx, req.Table)
+	if err != nil {
+		return 0, err
+	}
+	keys, sc, err := qlExecKeys(tx, tdef, &req.QLScan, opts, true)
+	if err != nil {
+		return 0, err
+	}
+	if keys == nil {
+		return tx.DeleteRange(req.Table, sc.Key1, sc.Key2, sc.Cmp1, sc.Cmp2)
+	}
+	affected := int64(0)
+	for _, key := range keys {
+		deleted, err := dbDelete(tx, tdef, key)
+		if err != nil {
+			return 0, err
+		}
+		if deleted {
+			affected++
+		}
+	}
+	return affected, nil
+}
+
+// the primary keys of the rows of a WHERE, collected before the writes.
+// with `ranged`, nil keys for a primary key range with nothing else to
+// check, which is the range of the Scanner.
+func qlExecKeys(tx *DBTX, tdef *TableDef, req *QLScan, opts ExecOptions, ranged bool) ([]Record, *Scanner, error) {
+	if req.Key1.Type != 0 || req.Filter.Type != 0 {
+		return nil, nil, errors.New("INDEX BY and FILTER are not supported by Exec; use WHERE")
+	}
+	sc := &Scanner{}
+	r, err := qlWhereScan(tx, tdef, req, false, sc)
+	if err != nil {
+		return nil, nil, err
+	}
+	if r.fixed == 0 && !opts.AllowFullScan {
+		return nil, nil, errors.New("the WHERE scans the whole table; see ExecOptions.AllowFullScan")
+	}
+	if qlLimit(req, sc) {
+		return []Record{}, sc, nil
+	}
+	if ranged && r.index == 0 && r.all && sc.Offset == 0 && sc.Limit == 0 {
+		return nil, sc, nil
+	}
+
+	if err := dbScan(tx, tdef, sc); err != nil {
+		return nil, nil, err
+	}
+	defer sc.Close()
+	keys := []Record{}
+	for ; sc.Valid(); sc.Next() {
+		rec := Record{}
+		if err := sc.Deref(&rec); err != nil {
+			return nil, nil, err
+		}
+		key := Record{}
+		for _, col := range tdef.Indexes[0] {
+			key.Cols = append(key.Cols, col)
+			key.Vals = append(key.Vals, *rec.Get(col))
+		}
+		keys = append(keys, key)
+	}
+	return keys, sc, sc.Err()
+}
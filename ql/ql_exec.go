@@ -41,7 +41,7 @@ func qlEval(ctx *QLEvalContext, node QLNODE) {
 			qlErr(ctx, "unknown col.: %s", node.Str)
 		}
 	//literla value
-	case QL_I64, QL_STR:
+	case QL_I64, QL_STR, QL_NULL:
 		ctx.out = node.Value
 	case QL_TUP:
 		qlErr(ctx, "unexpected tuple")
@@ -108,6 +108,22 @@ func qlBinopI64(ctx *QLEvalContext, op uint32, a1 int64, a2 int64) int64 {
 	}
 }
 
+func qlBinopF64(ctx *QLEvalContext, op uint32, a1 float64, a2 float64) float64 {
+	switch op {
+	case QL_ADD:
+		return a1 + a2
+	case QL_SUB:
+		return a1 - a2
+	case QL_MUL:
+		return a1 * a2
+	case QL_DIV:
+		return a1 / a2
+	default:
+		qlErr(ctx, "bad f64 binop")
+		return 0
+	}
+}
+
 func qlBinopStr(ctx *QLEvalContext, op uint32, a1 []byte, a2 []byte) {
 	switch op {
 	case QL_ADD:
@@ -151,6 +167,8 @@ func qlBinop(ctx *QLEvalContext, node QLNODE) {
 	switch {
 	case ctx.err != nil:
 		return
+	case a1.Type == TYPE_NULL || a2.Type == TYPE_NULL:
+		qlErr(ctx, "null in expression")
 	case a1.Type == TYPE_INT64:
 		ctx.out.Type = QL_I64
 		ctx.out.I64 = qlBinopI64(ctx, node.Type, a1.I64, a2.I64)
@@ -162,6 +180,10 @@ func qlBinop(ctx *QLEvalContext, node QLNODE) {
 		ctx.out.Type = QL_STR
 		qlBinopStr(ctx, node.Type, a1.Str, a2.Str)
 
+	case a1.Type == TYPE_FLOAT64:
+		ctx.out.Type = TYPE_FLOAT64
+		ctx.out.F64 = qlBinopF64(ctx, node.Type, a1.F64, a2.F64)
+
 	default:
 		panic("unreachable")
 	}
@@ -193,6 +215,10 @@ func qlValueCmp(ctx *QLEvalContext, a1 Value, a2 Value) int {
 	case ctx.err != nil:
 		return 0
 
+	case a1.Type == TYPE_NULL || a2.Type == TYPE_NULL:
+		qlErr(ctx, "comparison with null")
+		return 0
+
 	case a1.Type != a2.Type:
 		qlErr(ctx, "comparison of different types")
 		return 0
@@ -203,6 +229,12 @@ func qlValueCmp(ctx *QLEvalContext, a1 Value, a2 Value) int {
 	case a1.Type == TYPE_BYTES:
 		return bytes.Compare(a1.Str, a2.Str)
 
+	case a1.Type == TYPE_FLOAT64:
+		return cmp.Compare(a1.F64, a2.F64)
+
+	case a1.Type == TYPE_BOOL, a1.Type == TYPE_TIMESTAMP:
+		return cmp.Compare(a1.I64, a2.I64)
+
 	default:
 		panic("unreachable")
 	}
@@ -370,7 +402,9 @@ func qlScanPull(iter *qlScanIter, rec *Record) (bool, error) {
 		return false, nil
 	}
 
-	iter.sc.Deref(rec)
+	if err := iter.sc.Deref(rec); err != nil {
+		return false, err
+	}
 	if iter.req.Filter.Type != 0 {
 		ctx := QLEvalContext{env: *rec}
 		qlEval(&ctx, iter.req.Filter)
@@ -439,7 +473,10 @@ func qlSelect(req *QLSelect, tx *DBTX) (RecordIter, error) {
 		return nil, err
 	}
 
-	tdef := getTableDef(tx, req.Table)
+	tdef, err := getTableDef(tx, req.Table)
+	if err != nil {
+		return nil, err
+	}
 	names, exprs := []string{}, []QLNODE{}
 	for i := range req.Names {
 		if req.Names[i] != "*" {
@@ -486,6 +523,9 @@ func qlInsert(req *QLInsert, tx *DBTX) (uint64, uint64, error) {
 
 		dbReq := DBUpdateReq{Record: Record{req.Names, vals}, Mode: req.Mode}
 		_, err = tx.Set(req.Table, &dbReq)
+		if errors.Is(err, ErrRecordExists) || errors.Is(err, ErrRecordNotFound) {
+			continue // refused by the mode
+		}
 		if err != nil {
 			return 0, 0, err
 		}
@@ -508,7 +548,10 @@ func qlDelete(req *QLDelete, tx *DBTX) (uint64, error) {
 		return 0, err
 	}
 
-	tdef := getTableDef(tx, req.Table)
+	tdef, err := getTableDef(tx, req.Table)
+	if err != nil {
+		return 0, err
+	}
 	deleted := uint64(0)
 
 	for ; records.Valid(); records.Next() {
@@ -520,8 +563,9 @@ func qlDelete(req *QLDelete, tx *DBTX) (uint64, error) {
 
 		vals, err := getValues(tdef, rec, tdef.Indexes[0])
 		assert(err == nil)
-		deleted, err := tx.Delete(req.Table, Record{tdef.Indexes[0], vals})
-		assert(err == nil && deleted)
+		if _, err := tx.Delete(req.Table, Record{tdef.Indexes[0], vals}); err != nil {
+			return 0, err
+		}
 	}
 
 	return deleted, nil
@@ -532,7 +576,10 @@ func qlUpdate(req *QLUPdate, tx *DBTX) (uint64, error) {
 	// no update to primary key
 	assert(len(req.Names) == len(req.Values))
 
-	tdef := getTableDef(tx, req.Table)
+	tdef, err := getTableDef(tx, req.Table)
+	if err != nil {
+		return 0, err
+	}
 	for _, col := range req.Names {
 		if slices.Index(tdef.Cols, col) < 0 {
 			return 0, fmt.Errorf("unknown col.: %s", col)
@@ -3,10 +3,11 @@ package ql
 import (
 	"fmt"
 	"math"
+	"strconv"
 	"strings"
 	"unicode"
 
-	"github.com/Adit0507/AdiDB/btree"
+	"github.com/Adit0507/AdiDB/internal/btree"
 	"github.com/Adit0507/AdiDB/table"
 )
 
@@ -15,6 +16,7 @@ const (
 	QL_UNINIT = 0
 	QL_STR   = table.TYPE_BYTES
 	QL_I64    = table.TYPE_INT64
+	QL_NULL   = table.TYPE_NULL
 	QL_CMP_GE = 10 // >=
 	QL_CMP_GT = 11 // >
 	QL_CMP_LT = 12 // <
@@ -50,6 +52,10 @@ type QLScan struct {
 	Filter QLNODE //filter expression
 	Offset int64
 	Limit  int64
+	Where  QLNODE // SQL; see ql_query.go
+	// the text of the WHERE and its offset in the statement
+	WhereSrc string
+	WherePos int
 }
 
 // statements: SELECT UPDATE DELETE
@@ -57,6 +63,9 @@ type QLSelect struct {
 	QLScan
 	Names  []string // expr. AS name
 	Output []QLNODE
+	// SQL ORDER BY
+	OrderBy []string
+	Desc    bool
 }
 
 type QLUPdate struct {
@@ -87,6 +96,16 @@ type Parser struct {
 	err   error
 }
 
+// a syntax error at a byte offset of the input
+type ParseError struct {
+	Pos int
+	Msg string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s at position %d", e.Msg, e.Pos)
+}
+
 func isSpace(ch byte) bool {
 	return unicode.IsSpace(rune(ch))
 }
@@ -163,11 +182,22 @@ var pKeywordSet = map[string]bool{
 	"index":  true,
 	"filter": true,
 	"limit":  true,
-}
-
+	"where":  true,
+	"order":  true,
+	"as":     true,
+	"and":    true,
+	"or":     true,
+	"not":    true,
+	"asc":    true,
+	"desc":   true,
+	"null":   true,
+}
+
+// the first error is kept, at the next token
 func pErr(p *Parser, format string, args ...interface{}) {
 	if p.err == nil {
-		p.err = fmt.Errorf(format, args...)
+		skipSpace(p)
+		p.err = &ParseError{Pos: p.idx, Msg: fmt.Sprintf(format, args...)}
 	}
 }
 
@@ -234,6 +264,15 @@ func pSelectExpr(p *Parser, node *QLSelect) {
 		node.Output = append(node.Output, QLNODE{Value: Value{Type: QL_STAR}})
 		return
 	}
+
+	// expr [AS name]
+	node.Output = append(node.Output, QLNODE{})
+	pExprOr(p, &node.Output[len(node.Output)-1])
+	name := ""
+	if pKeyword(p, "as") {
+		name = pMustSym(p)
+	}
+	node.Names = append(node.Names, name)
 }
 
 func pSelectExprList(p *Parser, node *QLSelect) {
@@ -261,7 +300,7 @@ func pScan(p *Parser, node *QLScan) {
 	}
 
 	node.Offset, node.Limit = 0, math.MaxInt64
-	if pKeyword(p, "index", "by") {
+	if pKeyword(p, "limit") {
 		pLimit(p, node)
 	}
 }
@@ -271,7 +310,7 @@ func pExprOr(p *Parser, node *QLNODE) {
 }
 
 func pExprAnd(p *Parser, node *QLNODE) {
-	pExprBinop(p, node, []string{"and"}, []uint32{QL_ADD}, pExprNot)
+	pExprBinop(p, node, []string{"and"}, []uint32{QL_AND}, pExprNot)
 }
 
 func pExprNot(p *Parser, node *QLNODE) {
@@ -280,6 +319,8 @@ func pExprNot(p *Parser, node *QLNODE) {
 		node.Type = QL_NOT
 		node.Kids = []QLNODE{{}}
 		pExprCmp(p, &node.Kids[0])
+	default:
+		pExprCmp(p, node)
 	}
 }
 
@@ -318,6 +359,8 @@ func pExprAtom(p *Parser, node *QLNODE) {
 	switch {
 	case pKeyword(p, "("):
 		pExprTuple(p, node)
+	case pKeyword(p, "null"):
+		node.Type = QL_NULL
 	case pSym(p, node):
 	case pNum(p, node):
 	case pStr(p, node):
@@ -335,7 +378,7 @@ func pStr(p *Parser, node *QLNODE) bool {
 		quote = p.input[cur]
 		cur++
 	}
-	if !(quote == '*' || quote == '\'') {
+	if !(quote == '"' || quote == '\'') {
 		return false
 	}
 
@@ -352,6 +395,24 @@ func pStr(p *Parser, node *QLNODE) bool {
 			case '"', '\'', '\\':
 				s = append(s, p.input[cur])
 				cur++
+			case 'n':
+				s = append(s, '\n')
+				cur++
+			case 't':
+				s = append(s, '\t')
+				cur++
+			case 'x': // a byte, \xHH
+				if cur+3 > len(p.input) {
+					pErr(p, "string not terminated")
+					return false
+				}
+				b, err := strconv.ParseUint(string(p.input[cur+1:cur+3]), 16, 8)
+				if err != nil {
+					pErr(p, "bad escape")
+					return false
+				}
+				s = append(s, byte(b))
+				cur += 3
 			default:
 				pErr(p, "unknown escape")
 				return false
@@ -389,7 +450,7 @@ func pExprTuple(p *Parser, node *QLNODE) {
 	}
 
 	if len(kids) == 1 && !comma {
-		node = &kids[0]
+		*node = kids[0]
 	} else {
 		node.Type = QL_TUP
 		node.Kids = kids
@@ -452,6 +513,14 @@ func pNum(p *Parser, node *QLNODE) bool {
 		return false
 	}
 
+	i64, err := strconv.ParseInt(string(p.input[p.idx:end]), 10, 64)
+	if err != nil {
+		pErr(p, "number out of range")
+		return false
+	}
+	node.Type = QL_I64
+	node.I64 = i64
+	p.idx = end
 	return true
 }
 
@@ -513,14 +582,35 @@ func pSelect(p *Parser) *QLSelect {
 	pExpect(p, "from", "expect `FROM` table")
 	stmt.Table = pMustSym(p)
 
+	// SQL: WHERE, ORDER BY, LIMIT
+	pWhere(p, &stmt.QLScan)
+	if pKeyword(p, "order", "by") {
+		stmt.OrderBy = append(stmt.OrderBy, pMustSym(p))
+		for pKeyword(p, ",") {
+			stmt.OrderBy = append(stmt.OrderBy, pMustSym(p))
+		}
+		if !pKeyword(p, "asc") {
+			stmt.Desc = pKeyword(p, "desc")
+		}
+	}
+
 	pScan(p, &stmt.QLScan)
 	return &stmt
 }
 
+func pWhere(p *Parser, node *QLScan) {
+	if pKeyword(p, "where") {
+		skipSpace(p)
+		node.WherePos = p.idx
+		pExprOr(p, &node.Where)
+		node.WhereSrc = string(p.input[node.WherePos:p.idx])
+	}
+}
+
 func pNameList(p *Parser) []string {
 	pExpect(p, "(", "expect parenthesis")
 	names := []string{pMustSym(p)}
-	comma := pKeyword(p, "expect comma")
+	comma := pKeyword(p, ",")
 
 	for p.err == nil && !pKeyword(p, ")") {
 		if !comma {
@@ -528,7 +618,7 @@ func pNameList(p *Parser) []string {
 		}
 
 		names = append(names, pMustSym(p))
-		comma = pKeyword(p, ")")
+		comma = pKeyword(p, ",")
 	}
 
 	return names
@@ -581,9 +671,24 @@ func pStmt(p *Parser) (r interface{}) {
 	return r
 }
 
+// a statement, optionally ending with a semicolon, and nothing after it
+func pParse(input string) (interface{}, error) {
+	p := Parser{input: []byte(input)}
+	stmt := pStmt(&p)
+	pKeyword(&p, ";")
+	if skipSpace(&p); p.err == nil && p.idx < len(p.input) {
+		pErr(&p, "unexpected input")
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	return stmt, nil
+}
+
 func pDelete(p *Parser) *QLDelete {
 	stmt := QLDelete{}
 	stmt.Table = pMustSym(p)
+	pWhere(p, &stmt.QLScan)
 	pScan(p, &stmt.QLScan)
 
 	return &stmt
@@ -599,6 +704,7 @@ func pUpdate(p *Parser) *QLUPdate {
 		pAssign(p, &stmt)
 	}
 
+	pWhere(p, &stmt.QLScan)
 	pScan(p, &stmt.QLScan)
 	return &stmt
 }
@@ -0,0 +1,316 @@
+package ql
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+)
+
+/*
+SQL SELECT on top of Scanner:
+	SELECT cols FROM table [WHERE pred AND ...] [ORDER BY pk [ASC|DESC]]
+		[LIMIT [offset,] count]
+a predicate compares a column with a constant: =, <, <=, > or >=.
+anything else, such as OR, != or NOT, makes the WHERE a filter expression
+of the Scanner (see table_expr.go), with the same evaluator as the scans
+of the network protocol; the predicates joined by AND at the top still
+give the range.
+
+the index is chosen by the planner of the table layer: the one with the
+most leading columns fixed by `=`, then with a range on the next column;
+a tie goes to the smaller estimate of DB.Analyze, or to the primary key.
+the predicates outside the range are checked by Scanner.Filter, and the
+plan is on the Scanner. ORDER BY takes the leading columns of the primary
+key, so it scans the primary key. without it, the rows are in the order
+of the index.
+
+what neither takes, such as arithmetic or comparing 2 columns, is an error
+rather than a scan that checks less than the query says.
+*/
+
+// the rows of a query; the read transaction is held until Close
+type Rows struct {
+	db     *DB
+	tx     *DBTX // allocated alone for the finalizer
+	sc     Scanner
+	names  []string // the output columns
+	cols   []string // the table columns of the output
+	rec    Record
+	start  bool
+	empty  bool // LIMIT 0
+	closed bool
+	err    error
+}
+
+// a column compared with a constant
+type qlPred struct {
+	col int
+	op  uint32
+	val Value
+}
+
+// run a SELECT in a snapshot
+func (db *DB) Query(sql string) (*Rows, error) {
+	stmt, err := pParse(sql)
+	if err != nil {
+		return nil, err
+	}
+	req, ok := stmt.(*QLSelect)
+	if !ok {
+		return nil, errors.New("only SELECT is supported by Query")
+	}
+
+	rows := &Rows{db: db, tx: &DBTX{}}
+	db.BeginRead(rows.tx)
+	tdef, err := getTableDef(rows.tx, req.Table)
+	if err == nil {
+		err = qlCompile(tdef, req, rows)
+	}
+	if err == nil && !rows.empty {
+		err = dbScan(rows.tx, tdef, &rows.sc)
+	}
+	if err != nil {
+		db.Abort(rows.tx)
+		return nil, err
+	}
+	return rows, nil
+}
+
+// the names of the output columns
+func (rows *Rows) Columns() []string {
+	return rows.names
+}
+
+// move to the next row; false at the end or on errors
+func (rows *Rows) Next() bool {
+	if rows.closed {
+		return false
+	}
+	if rows.start {
+		rows.sc.Next()
+	}
+	rows.start = true
+	if rows.empty || !rows.sc.Valid() {
+		rows.err = rows.sc.Err()
+		rows.Close()
+		return false
+	}
+	rec := Record{}
+	if err := rows.sc.Deref(&rec); err != nil {
+		rows.err = err
+		rows.Close()
+		return false
+	}
+	rows.rec = Record{Cols: rows.names, Vals: make([]Value, len(rows.cols))}
+	for i, col := range rows.cols {
+		rows.rec.Vals[i] = *rec.Get(col)
+	}
+	return true
+}
+
+// the current row, by the output names
+func (rows *Rows) Scan(rec *Record) error {
+	if !rows.start || rows.closed {
+		return errors.New("no row")
+	}
+	*rec = Record{Cols: slices.Clone(rows.rec.Cols), Vals: slices.Clone(rows.rec.Vals)}
+	return nil
+}
+
+func (rows *Rows) Err() error {
+	return rows.err
+}
+
+func (rows *Rows) Close() {
+	if !rows.closed {
+		rows.closed = true
+		rows.sc.Close()
+		rows.db.Abort(rows.tx)
+	}
+}
+
+// the Scanner of a SELECT
+func qlCompile(tdef *TableDef, req *QLSelect, rows *Rows) error {
+	if req.Key1.Type != 0 || req.Filter.Type != 0 {
+		return errors.New("INDEX BY and FILTER are not supported by Query; use WHERE")
+	}
+
+	// the output columns
+	for i, node := range req.Output {
+		switch {
+		case node.Type == QL_STAR:
+			rows.names = append(rows.names, tdef.Cols...)
+			rows.cols = append(rows.cols, tdef.Cols...)
+			continue
+		case node.Type != QL_SYM:
+			return errors.New("only columns can be selected")
+		case slices.Index(tdef.Cols, string(node.Str)) < 0:
+			return fmt.Errorf("unknown column: %s", node.Str)
+		}
+		name := req.Names[i]
+		if name == "" {
+			name = string(node.Str)
+		}
+		rows.names = append(rows.names, name)
+		rows.cols = append(rows.cols, string(node.Str))
+	}
+	sc := &rows.sc
+	for _, col := range rows.cols {
+		if !slices.Contains(sc.Cols, col) {
+			sc.Cols = append(sc.Cols, col)
+		}
+	}
+
+	// ORDER BY the primary key
+	if len(req.OrderBy) > len(tdef.Indexes[0]) ||
+		!slices.Equal(req.OrderBy, tdef.Indexes[0][:len(req.OrderBy)]) {
+		return errors.New("ORDER BY is only supported on the primary key")
+	}
+	sc.Desc = req.Desc
+
+	if _, err := qlWhereScan(rows.tx, tdef, &req.QLScan, len(req.OrderBy) > 0, sc); err != nil {
+		return err
+	}
+	rows.empty = qlLimit(&req.QLScan, sc)
+	return nil
+}
+
+// how a WHERE is run
+type qlRange struct {
+	index int // the index of the range
+	fixed int // the predicates in the range
+	all   bool
+}
+
+// the range and the filter of a WHERE
+func qlWhereScan(tx *DBTX, tdef *TableDef, req *QLScan, pkOnly bool, sc *Scanner) (qlRange, error) {
+	preds := []qlPred{}
+	rest := false
+	if req.Where.Type != 0 {
+		var err error
+		if rest, err = qlWhere(tdef, req.Where, &preds); err != nil {
+			return qlRange{}, err
+		}
+	}
+	conds := []Cond{}
+	for _, p := range preds {
+		conds = append(conds, Cond{Col: tdef.Cols[p.col], Op: qlCondOp(p.op), Val: p.val})
+	}
+	plan, err := planScan(tx, tdef, conds, pkOnly)
+	if err != nil {
+		return qlRange{}, err
+	}
+	planApply(plan, sc)
+	sc.SetFilterExpr("")
+	if rest {
+		if err := qlWhereExpr(tdef, req, sc); err != nil {
+			return qlRange{}, err
+		}
+	}
+	fixed := len(conds) - len(plan.Filter)
+	return qlRange{index: plan.Index, fixed: fixed, all: len(plan.Filter) == 0 && !rest}, nil
+}
+
+// the whole WHERE as the filter expression of the Scanner, checked here
+// so that its errors have the position in the statement
+func qlWhereExpr(tdef *TableDef, req *QLScan, sc *Scanner) error {
+	err := sc.SetFilterExpr(req.WhereSrc)
+	if err == nil {
+		_, err = exprBind(tdef, sc.expr)
+	}
+	if eerr := (*ExprError)(nil); errors.As(err, &eerr) {
+		return &ParseError{Pos: req.WherePos + eerr.Pos, Msg: eerr.Msg}
+	}
+	return err
+}
+
+// LIMIT; true for LIMIT 0, since 0 is unlimited for Scanner
+func qlLimit(req *QLScan, sc *Scanner) bool {
+	sc.Offset = int(req.Offset)
+	if req.Limit != math.MaxInt64 {
+		sc.Limit = int(req.Limit - req.Offset)
+		return sc.Limit == 0
+	}
+	return false
+}
+
+// the conjunctions of column comparisons; true if there are others
+func qlWhere(tdef *TableDef, node QLNODE, preds *[]qlPred) (bool, error) {
+	if node.Type == QL_AND {
+		rest, err := qlWhere(tdef, node.Kids[0], preds)
+		if err != nil {
+			return false, err
+		}
+		more, err := qlWhere(tdef, node.Kids[1], preds)
+		return rest || more, err
+	}
+
+	flip := map[uint32]uint32{
+		QL_CMP_EQ: QL_CMP_EQ, QL_CMP_LT: QL_CMP_GT, QL_CMP_LE: QL_CMP_GE,
+		QL_CMP_GT: QL_CMP_LT, QL_CMP_GE: QL_CMP_LE,
+	}
+	if _, ok := flip[node.Type]; !ok {
+		return true, nil // for the filter expression
+	}
+	sym, val, op := node.Kids[0], node.Kids[1], node.Type
+	if sym.Type != QL_SYM {
+		sym, val, op = val, sym, flip[op]
+	}
+	if sym.Type != QL_SYM {
+		return false, errors.New("WHERE compares a column with a constant")
+	}
+	col := slices.Index(tdef.Cols, string(sym.Str))
+	if col < 0 {
+		return false, fmt.Errorf("unknown column: %s", sym.Str)
+	}
+	if val.Type == QL_NEG && len(val.Kids) == 1 && val.Kids[0].Type == QL_I64 {
+		val = QLNODE{Value: Value{Type: QL_I64, I64: -val.Kids[0].I64}}
+	}
+
+	if val.Type != QL_I64 && val.Type != QL_STR {
+		return false, errors.New("WHERE compares a column with a constant")
+	}
+	v, err := qlConst(tdef, col, val.Value)
+	if err != nil {
+		return false, err
+	}
+	*preds = append(*preds, qlPred{col: col, op: op, val: v})
+	return false, nil
+}
+
+// a constant as a value of the column
+func qlConst(tdef *TableDef, col int, c Value) (Value, error) {
+	v := Value{Type: tdef.Types[col]}
+	switch {
+	case c.Type == QL_NULL:
+		v.Type = TYPE_NULL
+	case c.Type == QL_STR && (v.Type == TYPE_BYTES || v.Type == TYPE_JSON):
+		v.Str = c.Str
+	case c.Type == QL_I64 && (v.Type == TYPE_INT64 || v.Type == TYPE_TIMESTAMP):
+		v.I64 = c.I64
+	case c.Type == QL_I64 && v.Type == TYPE_BOOL && (c.I64 == 0 || c.I64 == 1):
+		v.I64 = c.I64
+	case c.Type == QL_I64 && v.Type == TYPE_FLOAT64:
+		v.F64 = float64(c.I64)
+	default:
+		return v, fmt.Errorf("bad value for column: %s", tdef.Cols[col])
+	}
+	return v, nil
+}
+
+// Cond.Op of a predicate
+func qlCondOp(op uint32) int {
+	switch op {
+	case QL_CMP_GT:
+		return CMP_GT
+	case QL_CMP_GE:
+		return CMP_GE
+	case QL_CMP_LT:
+		return CMP_LT
+	case QL_CMP_LE:
+		return CMP_LE
+	default:
+		return COND_EQ
+	}
+}
@@ -0,0 +1,338 @@
+package ql
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"slices"
+	"testing"
+
+	is "github.com/stretchr/testify/require"
+)
+
+func qlTestDB(t *testing.T) *DB {
+	os.Remove("q.db")
+	db := &DB{Path: "q.db"}
+	is.Nil(t, db.Open())
+	t.Cleanup(func() {
+		db.Close()
+		os.Remove("q.db")
+	})
+
+	tx := DBTX{}
+	db.Begin(&tx)
+	is.Nil(t, tx.TableNew(&TableDef{
+		Name:     "t",
+		Cols:     []string{"a", "b", "c", "d"},
+		Types:    []uint32{TYPE_INT64, TYPE_INT64, TYPE_BYTES, TYPE_INT64},
+		Indexes:  [][]string{{"a", "b"}, {"c"}},
+		Nullable: []bool{false, false, false, true},
+	}))
+	for a := int64(-2); a < 5; a++ {
+		for b := int64(0); b < 10; b++ {
+			rec := (&Record{}).AddInt64("a", a).AddInt64("b", b)
+			rec.AddStr("c", []byte(fmt.Sprint("c", (a+b+8)%4)))
+			if b%3 == 0 {
+				rec.AddNull("d")
+			} else {
+				rec.AddInt64("d", a*b)
+			}
+			_, err := tx.Insert("t", rec)
+			is.Nil(t, err)
+		}
+	}
+	is.Nil(t, db.Commit(&tx))
+	return db
+}
+
+func qlQueryAll(t *testing.T, db *DB, sql string) (cols []string, out []string) {
+	rows, err := db.Query(sql)
+	is.Nil(t, err, sql)
+	defer rows.Close()
+	for rows.Next() {
+		rec := Record{}
+		is.Nil(t, rows.Scan(&rec))
+		s := ""
+		for i := range rec.Cols {
+			if v := rec.Vals[i]; v.Type == TYPE_BYTES {
+				s += fmt.Sprintf("%s ", v.Str)
+			} else if v.Type == TYPE_NULL {
+				s += "null "
+			} else {
+				s += fmt.Sprintf("%d ", v.I64)
+			}
+		}
+		out = append(out, s[:len(s)-1])
+	}
+	is.Nil(t, rows.Err())
+	return rows.Columns(), out
+}
+
+func TestQLQuery(t *testing.T) {
+	db := qlTestDB(t)
+
+	cols, out := qlQueryAll(t, db, "SELECT * FROM t")
+	is.Equal(t, []string{"a", "b", "c", "d"}, cols)
+	is.Equal(t, 70, len(out))
+	is.Equal(t, "-2 0 c2 null", out[0])
+
+	cols, out = qlQueryAll(t, db, "select b, d as x, b from t where a = 3 and b > 4 and b <= 7;")
+	is.Equal(t, []string{"b", "x", "b"}, cols)
+	is.Equal(t, []string{"5 15 5", "6 null 6", "7 21 7"}, out)
+	_, out = qlQueryAll(t, db, "SELECT a, b FROM t WHERE 2 >= a AND a >= 2 AND -1 < b AND b < 2")
+	is.Equal(t, []string{"2 0", "2 1"}, out)
+	_, out = qlQueryAll(t, db, "SELECT a FROM t WHERE a = -2 AND d >= -4")
+	is.Equal(t, []string{"-2", "-2"}, out) // NULL matches nothing
+	_, out = qlQueryAll(t, db, "SELECT a, b FROM t ORDER BY a, b DESC LIMIT 3")
+	is.Equal(t, []string{"4 9", "4 8", "4 7"}, out)
+	_, out = qlQueryAll(t, db, "SELECT a, b FROM t WHERE a = 0 ORDER BY a ASC LIMIT 2, 3")
+	is.Equal(t, []string{"0 2", "0 3", "0 4"}, out)
+	_, out = qlQueryAll(t, db, "SELECT a FROM t LIMIT 0")
+	is.Empty(t, out)
+	_, out = qlQueryAll(t, db, "SELECT c FROM t WHERE c = 'c1' AND a = 0")
+	is.Equal(t, []string{"c1", "c1", "c1"}, out)
+
+	// the index
+	for sql, keys := range map[string][2][]string{
+		`SELECT * FROM t WHERE c = "c1" AND a >= 0`:          {{"c", "a"}, {"c"}},
+		`SELECT * FROM t WHERE c = "c1" AND a = 0 AND b < 5`: {{"c", "a"}, {"c", "a", "b"}},
+		`SELECT * FROM t WHERE a = 0 AND b < 5`:              {{"a"}, {"a", "b"}},
+		`SELECT * FROM t WHERE b = 0 AND c > "c1"`:           {{"c"}, nil},
+		`SELECT * FROM t WHERE c = "c1" ORDER BY a`:          {nil, nil},
+		`SELECT * FROM t WHERE d = 1`:                        {nil, nil},
+	} {
+		rows, err := db.Query(sql)
+		is.Nil(t, err)
+		is.Equal(t, keys[0], rows.sc.Key1.Cols, sql)
+		is.Equal(t, keys[1], rows.sc.Key2.Cols, sql)
+		is.NotNil(t, rows.sc.Plan(), sql)
+		rows.Close()
+	}
+
+	// against a full scan
+	_, all := qlQueryAll(t, db, "SELECT a, b, c FROM t")
+	ops := []string{"=", "<", "<=", ">", ">="}
+	for i := 0; i < 500; i++ {
+		where, match := []string{}, []func(a, b int64, c string) bool{}
+		for j := rand.Intn(4); j >= 0; j-- {
+			op, n := ops[rand.Intn(len(ops))], int64(rand.Intn(12)-3)
+			cmp := func(x int64) bool {
+				return map[string]bool{"=": x == n, "<": x < n, "<=": x <= n, ">": x > n, ">=": x >= n}[op]
+			}
+			switch rand.Intn(3) {
+			case 0:
+				where = append(where, fmt.Sprintf("a %s %d", op, n))
+				match = append(match, func(a, b int64, c string) bool { return cmp(a) })
+			case 1:
+				where = append(where, fmt.Sprintf("%d %s b", n, map[string]string{"=": "=", "<": ">", "<=": ">=", ">": "<", ">=": "<="}[op]))
+				match = append(match, func(a, b int64, c string) bool { return cmp(b) })
+			case 2:
+				s := fmt.Sprint("c", n)
+				where = append(where, fmt.Sprintf("c %s '%s'", op, s))
+				match = append(match, func(a, b int64, c string) bool {
+					return map[string]bool{"=": c == s, "<": c < s, "<=": c <= s, ">": c > s, ">=": c >= s}[op]
+				})
+			}
+		}
+		var expected []string
+		for _, row := range all {
+			a, b, c := int64(0), int64(0), ""
+			fmt.Sscan(row, &a, &b, &c)
+			ok := true
+			for _, f := range match {
+				ok = ok && f(a, b, c)
+			}
+			if ok {
+				expected = append(expected, row)
+			}
+		}
+		sql := "SELECT a, b, c FROM t WHERE " + where[0]
+		for _, w := range where[1:] {
+			sql += " AND " + w
+		}
+		_, out := qlQueryAll(t, db, sql)
+		slices.Sort(out)
+		slices.Sort(expected)
+		is.Equal(t, expected, out, sql)
+	}
+
+	// errors
+	for sql, pos := range map[string]int{
+		"SELECT * FROM t WHERE":                          21,
+		"SELECT * FROM t WHERE a = 'x":                   26,
+		"SELECT * FROM t xyz":                            16,
+		"SELECT * FROM t LIMIT":                          21,
+		"SELECT * FROM":                                  13,
+		"SELECT * FROM t; SELECT":                        17,
+		"SELEC * FROM t":                                 0,
+		"SELECT * FROM t WHERE a = 1 (":                  28,
+		"SELECT * FROM t WHERE a = 99999999999999999999": 26,
+	} {
+		_, err := db.Query(sql)
+		perr := (*ParseError)(nil)
+		is.True(t, errors.As(err, &perr), sql)
+		is.Equal(t, pos, perr.Pos, sql)
+	}
+	for _, sql := range []string{
+		"SELECT * FROM nope",
+		"SELECT e FROM t",
+		"SELECT a + 1 FROM t",
+		"SELECT * FROM t WHERE a + 1 = 2",
+		"SELECT * FROM t WHERE a = b",
+		"SELECT * FROM t WHERE a = 'x'",
+		"SELECT * FROM t WHERE e = 1",
+		"SELECT * FROM t WHERE a",
+		"SELECT * FROM t ORDER BY b",
+		"SELECT * FROM t ORDER BY c",
+		"SELECT * FROM t INDEX BY a > 1",
+		"DELETE FROM t",
+	} {
+		_, err := db.Query(sql)
+		is.Error(t, err, sql)
+	}
+}
+
+func TestQLWhereExpr(t *testing.T) {
+	db := qlTestDB(t)
+
+	// the conjuncts at the top still give the range
+	rows, err := db.Query("SELECT a, b FROM t WHERE a = 0 AND (b = 1 OR b = 8)")
+	is.Nil(t, err)
+	is.Equal(t, []string{"a"}, rows.sc.Key1.Cols)
+	is.Equal(t, "a = 0 AND (b = 1 OR b = 8)", rows.sc.FilterExpr())
+	rows.Close()
+	for sql, expected := range map[string][]string{
+		"SELECT a, b FROM t WHERE a = 0 AND (b = 1 OR b = 8)":       {"0 1", "0 8"},
+		"SELECT a, b FROM t WHERE a = 1 AND b != 0 AND NOT b < 8":   {"1 8", "1 9"},
+		"SELECT a, b FROM t WHERE a = 2 AND d != NULL AND b < 4":    {"2 1", "2 2"},
+		"SELECT a, b FROM t WHERE a = 2 AND NOT d > 6 AND b < 6":    {"2 1", "2 2"},
+		"SELECT a, b FROM t WHERE (a = -2 OR a = 4) AND b = 9":      {"-2 9", "4 9"},
+		"SELECT a, b FROM t WHERE b = 5 AND (c = 'c0' OR c = 'c1')": {"-1 5", "0 5", "3 5", "4 5"},
+	} {
+		_, out := qlQueryAll(t, db, sql)
+		is.Equal(t, expected, out, sql)
+	}
+
+	// DML checks the whole WHERE
+	affected, err := db.Exec("UPDATE t SET d = 0 WHERE a = 3 AND (b < 2 OR b > 8)")
+	is.Nil(t, err)
+	is.Equal(t, int64(3), affected)
+	_, err = db.Exec("DELETE FROM t WHERE a = 3 OR b = 3")
+	is.Error(t, err) // a full scan
+
+	// the errors are at their position in the statement
+	for sql, pos := range map[string]int{
+		"SELECT * FROM t WHERE a = 1 OR e = 2":   31,
+		"SELECT * FROM t WHERE a = 1 OR c != 2":  36,
+		"SELECT * FROM t WHERE NOT (a = 1 OR b)": 37,
+		"SELECT * FROM t WHERE a != 'x'":         27,
+	} {
+		_, err := db.Query(sql)
+		perr := (*ParseError)(nil)
+		is.True(t, errors.As(err, &perr), sql)
+		is.Equal(t, pos, perr.Pos, sql)
+	}
+}
+
+func TestQLExec(t *testing.T) {
+	db := qlTestDB(t)
+	exec := func(sql string, n int64) {
+		affected, err := db.Exec(sql)
+		is.Nil(t, err, sql)
+		is.Equal(t, n, affected, sql)
+	}
+	count := func(where string) int {
+		_, out := qlQueryAll(t, db, "SELECT a FROM t WHERE "+where)
+		return len(out)
+	}
+
+	// INSERT, with the escapes and NULL
+	exec(`INSERT INTO t (a, b, c, d) VALUES (10, 0, 'x\n\'', NULL), (10, 1, "y\x00\"\\", -5)`, 2)
+	_, out := qlQueryAll(t, db, "SELECT c, d FROM t WHERE a = 10")
+	is.Equal(t, []string{"x\n' null", "y\x00\"\\ -5"}, out)
+	// atomic
+	_, err := db.Exec("INSERT INTO t (a, b, c) VALUES (11, 0, 'z'), (10, 0, 'dup')")
+	is.Error(t, err)
+	is.Equal(t, 0, count("a = 11"))
+	exec("UPSERT INTO t (a, b, c) VALUES (10, 0, 'u'), (12, 0, 'v')", 2)
+	exec("REPLACE INTO t (a, b, c) VALUES (12, 0, 'w'), (13, 0, 'w')", 1)
+	_, out = qlQueryAll(t, db, "SELECT c FROM t WHERE a >= 10 AND b = 0")
+	is.Equal(t, []string{"u", "w"}, out)
+
+	// UPDATE writes the SET columns only
+	exec("UPDATE t SET d = 100 WHERE a = 0 AND b = 1", 1)
+	_, out = qlQueryAll(t, db, "SELECT a, b, c, d FROM t WHERE a = 0 AND b = 1")
+	is.Equal(t, []string{"0 1 c1 100"}, out)
+	exec("UPDATE t SET d = -7, c = 'c9' WHERE c = 'c1' AND a >= 0 AND a < 2", 6)
+	is.Equal(t, 6, count("c = 'c9' AND d = -7"))
+	is.Equal(t, 0, count("c = 'c1' AND a >= 0 AND a < 2"))
+	exec("UPDATE t SET d = 1 WHERE a = 99", 0)
+
+	// a full scan must be allowed
+	for _, sql := range []string{
+		"UPDATE t SET d = 1",
+		"UPDATE t SET d = 1 WHERE b = 1",
+		"DELETE FROM t WHERE d = 1",
+		"DELETE FROM t",
+	} {
+		_, err := db.Exec(sql)
+		is.Error(t, err, sql)
+	}
+	n := count("a >= -2 AND b = 1")
+	affected, err := db.ExecWith("UPDATE t SET d = 50 WHERE b = 1", ExecOptions{AllowFullScan: true})
+	is.Nil(t, err)
+	is.Equal(t, int64(n), affected)
+	is.Equal(t, n, count("a >= -2 AND d = 50"))
+
+	// DELETE by a primary key range, with a filter, and with a limit
+	exec("DELETE FROM t WHERE a = 3", 10)
+	exec("DELETE FROM t WHERE a = 3", 0)
+	exec("DELETE FROM t WHERE a = 4 AND d > 10", 5) // and d = 50
+	is.Equal(t, 5, count("a = 4"))
+	exec("DELETE FROM t WHERE a = 2 LIMIT 1, 2", 2)
+	_, out = qlQueryAll(t, db, "SELECT b FROM t WHERE a = 2")
+	is.Equal(t, []string{"0", "3", "4", "5", "6", "7", "8", "9"}, out)
+	exec("DELETE FROM t WHERE c = 'c9' AND a = 1", 3)
+	exec("DELETE FROM t WHERE a > 9 AND a <= 12 LIMIT 0", 0)
+
+	// errors, with nothing written
+	for _, sql := range []string{
+		"INSERT INTO t (a, b, e) VALUES (20, 0, 'x')",
+		"INSERT INTO t (a, b, c) VALUES ('x', 0, 'x')",
+		"INSERT INTO t (a, b, c) VALUES (20, 0, NULL)",
+		"INSERT INTO t (a, b, c) VALUES (20, 0, c)",
+		"INSERT INTO nope (a) VALUES (1)",
+		"UPDATE t SET a = 1 WHERE a = 0",
+		"UPDATE t SET e = 1 WHERE a = 0",
+		"UPDATE t SET d = 'x' WHERE a = 0",
+		"UPDATE t SET d = b WHERE a = 0",
+		"DELETE FROM t WHERE a = 1 OR a = 2",
+		"DELETE FROM t INDEX BY a = 1",
+		"SELECT * FROM t",
+		"CREATE TABLE u (a int64, PRIMARY KEY (a))",
+	} {
+		_, err := db.Exec(sql)
+		is.Error(t, err, sql)
+	}
+	is.Equal(t, 0, count("a = 20"))
+	for sql, pos := range map[string]int{
+		"INSERT INTO t (a) VALUES (1":         27,
+		"INSERT INTO t (a) VALUES (1), (2,":   33,
+		"UPDATE t SET d = 'a\\q' WHERE a = 0": 17,
+		"DELETE FROM t WHERE a = 1 AND":       29,
+	} {
+		_, err := db.Exec(sql)
+		perr := (*ParseError)(nil)
+		is.True(t, errors.As(err, &perr), sql)
+		is.Equal(t, pos, perr.Pos, sql)
+	}
+
+	// everything
+	_, out = qlQueryAll(t, db, "SELECT a FROM t")
+	affected, err = db.ExecWith("DELETE FROM t", ExecOptions{AllowFullScan: true})
+	is.Nil(t, err)
+	is.Equal(t, int64(len(out)), affected)
+	_, out = qlQueryAll(t, db, "SELECT a FROM t")
+	is.Empty(t, out)
+}
@@ -0,0 +1,431 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/Adit0507/AdiDB/table"
+)
+
+/*
+a standalone server. each call is a transaction of its own, so an embedded
+DB and a remote one are used the same way through Conn:
+- Embedded runs the calls on a DB in this process.
+- Client sends them to a Server; see server_client.go.
+
+the server runs the calls of each connection in a goroutine with Embedded.
+reads run in parallel on their own snapshots, and writes are serialized by
+the server so that they don't fail with conflicts against each other.
+*/
+
+// the calls of DBTX, each in a transaction
+type Conn interface {
+	Get(name string, rec *table.Record) (bool, error)
+	Set(name string, dbreq *table.DBUpdateReq) (bool, error)
+	Delete(name string, rec table.Record) (bool, error)
+	// the scan reads a snapshot until the rows are closed. Filter is not
+	// supported by Client; SetFilterExpr is.
+	Scan(name string, req *table.Scanner) (Rows, error)
+	TableNew(tdef *table.TableDef) error
+	ListTables() ([]string, error)
+	Close() error
+}
+
+// the rows of a scan, like Scanner
+type Rows interface {
+	Valid() bool
+	Next()
+	Deref(rec *table.Record) error
+	Err() error
+	Close()
+}
+
+// Conn of a DB in this process. Close doesn't close the DB.
+type Embedded struct {
+	DB *table.DB
+}
+
+func (e Embedded) Get(name string, rec *table.Record) (bool, error) {
+	tx := table.DBTX{}
+	e.DB.BeginRead(&tx)
+	defer e.DB.Abort(&tx)
+	return tx.Get(name, rec)
+}
+
+// run `fn` in a transaction and commit it
+func embeddedWrite(db *table.DB, fn func(tx *table.DBTX) error) error {
+	tx := table.DBTX{}
+	db.Begin(&tx)
+	if err := fn(&tx); err != nil {
+		db.Abort(&tx)
+		return err
+	}
+	return db.Commit(&tx)
+}
+
+func (e Embedded) Set(name string, dbreq *table.DBUpdateReq) (ok bool, err error) {
+	err = embeddedWrite(e.DB, func(tx *table.DBTX) error {
+		ok, err = tx.Set(name, dbreq)
+		return err
+	})
+	if err != nil {
+		dbreq.Added, dbreq.Updated = false, false
+		return false, err
+	}
+	return ok, nil
+}
+
+func (e Embedded) Delete(name string, rec table.Record) (ok bool, err error) {
+	err = embeddedWrite(e.DB, func(tx *table.DBTX) error {
+		ok, err = tx.Delete(name, rec)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return ok, nil
+}
+
+func (e Embedded) TableNew(tdef *table.TableDef) error {
+	// the prefixes are set on commit only
+	ndef := *tdef
+	err := embeddedWrite(e.DB, func(tx *table.DBTX) error {
+		return tx.TableNew(&ndef)
+	})
+	if err == nil {
+		*tdef = ndef
+	}
+	return err
+}
+
+func (e Embedded) ListTables() ([]string, error) {
+	tx := table.DBTX{}
+	e.DB.BeginRead(&tx)
+	defer e.DB.Abort(&tx)
+	return tx.ListTables()
+}
+
+func (e Embedded) Scan(name string, req *table.Scanner) (Rows, error) {
+	rows := &embeddedRows{db: e.DB, tx: &table.DBTX{}, sc: req}
+	e.DB.BeginRead(rows.tx)
+	if err := rows.tx.Scan(name, req); err != nil {
+		e.DB.Abort(rows.tx)
+		return nil, err
+	}
+	return rows, nil
+}
+
+func (e Embedded) Close() error {
+	return nil
+}
+
+type embeddedRows struct {
+	db     *table.DB
+	tx     *table.DBTX // allocated alone for the finalizer
+	sc     *table.Scanner
+	closed bool
+}
+
+func (rows *embeddedRows) Valid() bool {
+	return !rows.closed && rows.sc.Valid()
+}
+
+func (rows *embeddedRows) Next() {
+	rows.sc.Next()
+}
+
+func (rows *embeddedRows) Deref(rec *table.Record) error {
+	return rows.sc.Deref(rec)
+}
+
+func (rows *embeddedRows) Err() error {
+	return rows.sc.Err()
+}
+
+func (rows *embeddedRows) Close() {
+	if !rows.closed {
+		rows.closed = true
+		rows.sc.Close()
+		rows.db.Abort(rows.tx)
+	}
+}
+
+// serves a DB over TCP; see server_wire.go for the protocol
+type Server struct {
+	DB *table.DB
+	// rows per message of a scan; 0 for SERVER_SCAN_CHUNK
+	ScanChunk int
+	// internals
+	mu        sync.Mutex
+	listeners map[net.Listener]bool
+	conns     map[net.Conn]bool
+	closed    bool
+	wg        sync.WaitGroup
+	writes    sync.Mutex // serializes write transactions
+}
+
+const SERVER_SCAN_CHUNK = 256
+
+var ErrServerClosed = errors.New("server closed")
+
+func (s *Server) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// accept connections until Close; the listener is closed on return
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+	if s.listeners == nil {
+		s.listeners, s.conns = map[net.Listener]bool{}, map[net.Conn]bool{}
+	}
+	s.listeners[ln] = true
+	s.mu.Unlock()
+	defer ln.Close()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			delete(s.listeners, ln)
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return ErrServerClosed
+		}
+		s.conns[conn] = true
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+// stop accepting, close the connections and wait for the calls in
+// progress. open scans are ended.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for ln := range s.listeners {
+		ln.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+// the state of a connection
+type serverConn struct {
+	s    *Server
+	db   Embedded
+	scan Rows // the open scan
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.wg.Done()
+	sc := &serverConn{s: s, db: Embedded{DB: s.DB}}
+	defer func() {
+		if sc.scan != nil {
+			sc.scan.Close()
+		}
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+
+	br, bw := bufio.NewReader(conn), bufio.NewWriter(conn)
+	for {
+		op, body, err := wireRead(br)
+		if err != nil {
+			return
+		}
+		resp, err := sc.handle(op, body)
+		kind := byte(WIRE_OK)
+		if err != nil {
+			kind, resp = WIRE_ERR, wireError(err)
+		}
+		if wireWrite(bw, kind, resp) != nil || bw.Flush() != nil {
+			return
+		}
+	}
+}
+
+func (sc *serverConn) handle(op byte, body []byte) ([]byte, error) {
+	r := wireReader{buf: body}
+	w := wireWriter{}
+	switch op {
+	case OP_GET:
+		name, rec := r.str(), r.record()
+		if err := r.done(); err != nil {
+			return nil, err
+		}
+		ok, err := sc.db.Get(name, &rec)
+		if err != nil {
+			return nil, err
+		}
+		w.bool(ok)
+		w.record(&rec)
+
+	case OP_SET:
+		name := r.str()
+		dbreq := table.DBUpdateReq{Record: r.record(), Mode: int(r.varint())}
+		dbreq.Partial, dbreq.Expected = r.bool(), r.record()
+		if err := r.done(); err != nil {
+			return nil, err
+		}
+		sc.s.writes.Lock()
+		ok, err := sc.db.Set(name, &dbreq)
+		sc.s.writes.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		w.bool(ok)
+		w.bool(dbreq.Added)
+		w.bool(dbreq.Updated)
+		w.record(&dbreq.Record)
+
+	case OP_DELETE:
+		name, rec := r.str(), r.record()
+		if err := r.done(); err != nil {
+			return nil, err
+		}
+		sc.s.writes.Lock()
+		ok, err := sc.db.Delete(name, rec)
+		sc.s.writes.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		w.bool(ok)
+
+	case OP_SCAN:
+		name := r.str()
+		req := &table.Scanner{Cmp1: int(r.varint()), Cmp2: int(r.varint())}
+		req.Key1, req.Key2, req.Desc = r.record(), r.record(), r.bool()
+		for n := r.uvarint(); n > 0 && r.err == nil; n-- {
+			req.Cols = append(req.Cols, r.str())
+		}
+		req.Offset, req.Limit = int(r.varint()), int(r.varint())
+		expr := ""
+		if len(r.buf) > 0 {
+			expr = r.str()
+		}
+		if err := r.done(); err != nil {
+			return nil, err
+		}
+		if err := req.SetFilterExpr(expr); err != nil {
+			return nil, err
+		}
+		if sc.scan != nil {
+			sc.scan.Close()
+			sc.scan = nil
+		}
+		rows, err := sc.db.Scan(name, req)
+		if err != nil {
+			return nil, err
+		}
+		sc.scan = rows
+		return sc.chunk()
+
+	case OP_SCAN_NEXT:
+		if sc.scan == nil {
+			return nil, errors.New("no scan")
+		}
+		return sc.chunk()
+
+	case OP_SCAN_STOP:
+		if sc.scan != nil {
+			sc.scan.Close()
+			sc.scan = nil
+		}
+
+	case OP_TABLE_NEW:
+		tdef := &table.TableDef{}
+		if err := json.Unmarshal(body, tdef); err != nil {
+			return nil, errBadMessage
+		}
+		sc.s.writes.Lock()
+		err := sc.db.TableNew(tdef)
+		sc.s.writes.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		out, err := json.Marshal(tdef)
+		if err != nil {
+			return nil, err
+		}
+		return out, nil
+
+	case OP_LIST_TABLE:
+		names, err := sc.db.ListTables()
+		if err != nil {
+			return nil, err
+		}
+		w.uvarint(uint64(len(names)))
+		for _, name := range names {
+			w.str(name)
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown operation: %d", op)
+	}
+	return w.buf, nil
+}
+
+// the next rows of the scan and whether there are more:
+// | nrows | record | ... | more |
+func (sc *serverConn) chunk() ([]byte, error) {
+	limit := sc.s.ScanChunk
+	if limit <= 0 {
+		limit = SERVER_SCAN_CHUNK
+	}
+	w, recs := wireWriter{}, []table.Record{}
+	rows := sc.scan
+	for ; len(recs) < limit && rows.Valid(); rows.Next() {
+		rec := table.Record{}
+		if err := rows.Deref(&rec); err != nil {
+			return nil, sc.endScan(err)
+		}
+		recs = append(recs, rec)
+	}
+	more := rows.Valid()
+	if !more {
+		if err := sc.endScan(rows.Err()); err != nil {
+			return nil, err
+		}
+	}
+	w.uvarint(uint64(len(recs)))
+	for i := range recs {
+		w.record(&recs[i])
+	}
+	w.bool(more)
+	return w.buf, nil
+}
+
+func (sc *serverConn) endScan(err error) error {
+	sc.scan.Close()
+	sc.scan = nil
+	return err
+}
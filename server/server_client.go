@@ -0,0 +1,316 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/Adit0507/AdiDB/table"
+)
+
+// Conn of a Server. the calls are safe for concurrent use; each one takes
+// a connection from a pool, and a scan keeps its connection until Close.
+type Client struct {
+	addr   string
+	mu     sync.Mutex
+	idle   []*clientConn
+	closed bool
+}
+
+type clientConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+	bw   *bufio.Writer
+}
+
+var ErrClientClosed = errors.New("client closed")
+
+// connect to a Server. the connection is checked, then pooled.
+func Dial(addr string) (*Client, error) {
+	c := &Client{addr: addr}
+	cc, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+	c.put(cc)
+	return c, nil
+}
+
+func (c *Client) get() (*clientConn, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrClientClosed
+	}
+	if n := len(c.idle); n > 0 {
+		cc := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return cc, nil
+	}
+	c.mu.Unlock()
+
+	conn, err := net.Dial("tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	return &clientConn{conn: conn, br: bufio.NewReader(conn), bw: bufio.NewWriter(conn)}, nil
+}
+
+func (c *Client) put(cc *clientConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		cc.conn.Close()
+		return
+	}
+	c.idle = append(c.idle, cc)
+}
+
+// a request and its response. a connection with an I/O error is dropped.
+func (cc *clientConn) call(op byte, body []byte) ([]byte, error) {
+	err := wireWrite(cc.bw, op, body)
+	if err == nil {
+		err = cc.bw.Flush()
+	}
+	kind := byte(0)
+	if err == nil {
+		kind, body, err = wireRead(cc.br)
+	}
+	if err != nil {
+		cc.conn.Close()
+		return nil, err
+	}
+	switch kind {
+	case WIRE_OK:
+		return body, nil
+	case WIRE_ERR:
+		return nil, wireDecodeError(body)
+	default:
+		cc.conn.Close()
+		return nil, errBadMessage
+	}
+}
+
+// a call on a pooled connection
+func (c *Client) call(op byte, body []byte) ([]byte, error) {
+	cc, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := cc.call(op, body)
+	if err == nil || isRemote(err) {
+		c.put(cc)
+	}
+	return resp, err
+}
+
+// the connection is still usable after the error
+func isRemote(err error) bool {
+	rerr := (*RemoteError)(nil)
+	return errors.As(err, &rerr)
+}
+
+func (c *Client) Get(name string, rec *table.Record) (bool, error) {
+	w := wireWriter{}
+	w.str(name)
+	w.record(rec)
+	resp, err := c.call(OP_GET, w.buf)
+	if err != nil {
+		return false, err
+	}
+	r := wireReader{buf: resp}
+	ok, out := r.bool(), r.record()
+	if err := r.done(); err != nil {
+		return false, err
+	}
+	*rec = out
+	return ok, nil
+}
+
+func (c *Client) Set(name string, dbreq *table.DBUpdateReq) (bool, error) {
+	w := wireWriter{}
+	w.str(name)
+	w.record(&dbreq.Record)
+	w.varint(int64(dbreq.Mode))
+	w.bool(dbreq.Partial)
+	w.record(&dbreq.Expected)
+	dbreq.Added, dbreq.Updated = false, false
+	resp, err := c.call(OP_SET, w.buf)
+	if err != nil {
+		return false, err
+	}
+	r := wireReader{buf: resp}
+	ok, added, updated, rec := r.bool(), r.bool(), r.bool(), r.record()
+	if err := r.done(); err != nil {
+		return false, err
+	}
+	dbreq.Added, dbreq.Updated, dbreq.Record = added, updated, rec
+	return ok, nil
+}
+
+func (c *Client) Delete(name string, rec table.Record) (bool, error) {
+	w := wireWriter{}
+	w.str(name)
+	w.record(&rec)
+	resp, err := c.call(OP_DELETE, w.buf)
+	if err != nil {
+		return false, err
+	}
+	r := wireReader{buf: resp}
+	ok := r.bool()
+	return ok, r.done()
+}
+
+func (c *Client) TableNew(tdef *table.TableDef) error {
+	body, err := json.Marshal(tdef)
+	if err != nil {
+		return err
+	}
+	resp, err := c.call(OP_TABLE_NEW, body)
+	if err != nil {
+		return err
+	}
+	// the prefixes and the indexes from the server
+	ndef := table.TableDef{}
+	if err := json.Unmarshal(resp, &ndef); err != nil {
+		return errBadMessage
+	}
+	*tdef = ndef
+	return nil
+}
+
+func (c *Client) ListTables() ([]string, error) {
+	resp, err := c.call(OP_LIST_TABLE, nil)
+	if err != nil {
+		return nil, err
+	}
+	r := wireReader{buf: resp}
+	names := []string{}
+	for n := r.uvarint(); n > 0 && r.err == nil; n-- {
+		names = append(names, r.str())
+	}
+	return names, r.done()
+}
+
+func (c *Client) Scan(name string, req *table.Scanner) (Rows, error) {
+	if req.Filter != nil {
+		return nil, fmt.Errorf("remote scan: Filter is not supported")
+	}
+	w := wireWriter{}
+	w.str(name)
+	w.varint(int64(req.Cmp1))
+	w.varint(int64(req.Cmp2))
+	w.record(&req.Key1)
+	w.record(&req.Key2)
+	w.bool(req.Desc)
+	w.uvarint(uint64(len(req.Cols)))
+	for _, col := range req.Cols {
+		w.str(col)
+	}
+	w.varint(int64(req.Offset))
+	w.varint(int64(req.Limit))
+	w.str(req.FilterExpr())
+
+	cc, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+	rows := &clientRows{c: c, cc: cc}
+	if rows.err = rows.fetch(OP_SCAN, w.buf); rows.err != nil {
+		err := rows.err
+		rows.Close()
+		return nil, err
+	}
+	return rows, nil
+}
+
+// close the pooled connections; the open scans are closed on their Close
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for _, cc := range c.idle {
+		cc.conn.Close()
+	}
+	c.idle = nil
+	return nil
+}
+
+// the rows of a remote scan, a chunk at a time
+type clientRows struct {
+	c    *Client
+	cc   *clientConn // nil when the server has ended the scan
+	recs []table.Record
+	pos  int
+	more bool // the server has more rows
+	err  error
+}
+
+// a chunk of rows; the connection is returned once the scan is over
+func (rows *clientRows) fetch(op byte, body []byte) error {
+	resp, err := rows.cc.call(op, body)
+	if err != nil {
+		if isRemote(err) { // the server ended the scan
+			rows.c.put(rows.cc)
+		}
+		rows.cc = nil
+		return err
+	}
+	r := wireReader{buf: resp}
+	n := r.uvarint()
+	recs := []table.Record{}
+	for ; n > 0 && r.err == nil; n-- {
+		recs = append(recs, r.record())
+	}
+	more := r.bool()
+	if err := r.done(); err != nil {
+		rows.cc.conn.Close()
+		rows.cc = nil
+		return err
+	}
+	rows.recs, rows.pos, rows.more = recs, 0, more
+	if !more {
+		rows.c.put(rows.cc)
+		rows.cc = nil
+	}
+	return nil
+}
+
+func (rows *clientRows) Valid() bool {
+	return rows.err == nil && rows.pos < len(rows.recs)
+}
+
+func (rows *clientRows) Next() {
+	if rows.pos++; rows.pos < len(rows.recs) || !rows.more || rows.err != nil {
+		return
+	}
+	rows.recs = nil
+	rows.err = rows.fetch(OP_SCAN_NEXT, nil)
+}
+
+func (rows *clientRows) Deref(rec *table.Record) error {
+	if !rows.Valid() {
+		return fmt.Errorf("remote scan: no row")
+	}
+	*rec = rows.recs[rows.pos]
+	return nil
+}
+
+func (rows *clientRows) Err() error {
+	return rows.err
+}
+
+// end the scan on the server if it has more rows
+func (rows *clientRows) Close() {
+	if rows.cc != nil {
+		if _, err := rows.cc.call(OP_SCAN_STOP, nil); err == nil {
+			rows.c.put(rows.cc)
+		}
+		rows.cc = nil
+	}
+	rows.recs, rows.pos, rows.more = nil, 0, false
+}
@@ -0,0 +1,280 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/Adit0507/AdiDB/internal/btree"
+	"github.com/Adit0507/AdiDB/internal/btree_iter"
+	"github.com/Adit0507/AdiDB/table"
+	is "github.com/stretchr/testify/require"
+)
+
+// a server on a loopback listener
+type S struct {
+	db  table.DB
+	srv *Server
+	ln  net.Listener
+	err chan error
+}
+
+func newS(chunk int) *S {
+	os.Remove("s.db")
+	s := &S{db: table.DB{Path: "s.db"}, err: make(chan error, 1)}
+	if err := s.db.Open(); err != nil {
+		panic(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	s.ln = ln
+	s.srv = &Server{DB: &s.db, ScanChunk: chunk}
+	go func() { s.err <- s.srv.Serve(ln) }()
+	return s
+}
+
+func (s *S) dispose() {
+	s.srv.Close()
+	<-s.err
+	s.db.Close()
+	os.Remove("s.db")
+}
+
+func serverUser(id int64, email string) table.Record {
+	rec := table.Record{}
+	rec.AddInt64("id", id).AddStr("email", []byte(email))
+	return rec
+}
+
+// the same calls on an embedded DB and a remote one
+func testConn(t *testing.T, conn Conn) {
+	tdef := &table.TableDef{
+		Name:    "users",
+		Cols:    []string{"id", "email"},
+		Types:   []uint32{table.TYPE_INT64, table.TYPE_BYTES},
+		Indexes: [][]string{{"id"}, {"email"}},
+		Unique:  []bool{false, true},
+	}
+	is.Nil(t, conn.TableNew(tdef))
+	is.NotEmpty(t, tdef.Prefixes)
+	err := conn.TableNew(&table.TableDef{Name: "users", Cols: tdef.Cols, Types: tdef.Types, Indexes: [][]string{{"id"}}})
+	is.True(t, errors.Is(err, table.ErrTableExists))
+
+	names, err := conn.ListTables()
+	is.Nil(t, err)
+	is.Contains(t, names, "users")
+
+	// the 3 modes
+	dbreq := &table.DBUpdateReq{Record: serverUser(1, "a@x"), Mode: btree.MODE_UPDATE_ONLY}
+	ok, err := conn.Set("users", dbreq)
+	is.ErrorIs(t, err, table.ErrRecordNotFound)
+	is.False(t, ok)
+	dbreq = &table.DBUpdateReq{Record: serverUser(1, "a@x"), Mode: btree.MODE_INSERT_ONLY}
+	ok, err = conn.Set("users", dbreq)
+	is.Nil(t, err)
+	is.True(t, ok && dbreq.Added)
+	dbreq = &table.DBUpdateReq{Record: serverUser(1, "b@x"), Mode: btree.MODE_INSERT_ONLY}
+	ok, err = conn.Set("users", dbreq)
+	is.ErrorIs(t, err, table.ErrRecordExists)
+	is.False(t, ok)
+	dbreq = &table.DBUpdateReq{Record: serverUser(1, "b@x"), Mode: btree.MODE_UPDATE_ONLY}
+	ok, err = conn.Set("users", dbreq)
+	is.Nil(t, err)
+	is.True(t, ok && dbreq.Updated && !dbreq.Added)
+	for i := int64(2); i <= 20; i++ {
+		dbreq = &table.DBUpdateReq{Record: serverUser(i, fmt.Sprintf("u%02d@x", i))}
+		ok, err = conn.Set("users", dbreq)
+		is.Nil(t, err)
+		is.True(t, ok)
+	}
+
+	// errors keep their identity
+	dbreq = &table.DBUpdateReq{Record: serverUser(21, "b@x")}
+	_, err = conn.Set("users", dbreq)
+	is.True(t, errors.Is(err, table.ErrUniqueViolation))
+	_, err = conn.Set("nope", &table.DBUpdateReq{Record: serverUser(1, "")})
+	is.True(t, errors.Is(err, table.ErrTableNotFound))
+	bad := table.Record{}
+	bad.AddInt64("id", 21).AddInt64("email", 1)
+	_, err = conn.Set("users", &table.DBUpdateReq{Record: bad})
+	colErr := (*table.ErrBadColumnType)(nil)
+	is.True(t, errors.As(err, &colErr))
+	is.Equal(t, "email", colErr.Col)
+
+	rec := table.Record{}
+	rec.AddInt64("id", 1)
+	ok, err = conn.Get("users", &rec)
+	is.Nil(t, err)
+	is.True(t, ok)
+	is.Equal(t, "b@x", string(rec.Get("email").Str))
+	rec = table.Record{}
+	rec.AddInt64("id", 99)
+	ok, err = conn.Get("users", &rec)
+	is.Nil(t, err)
+	is.False(t, ok)
+
+	// scans in chunks, with a limit, and closed early
+	scan := func(req *table.Scanner, n int) []int64 {
+		rows, err := conn.Scan("users", req)
+		is.Nil(t, err)
+		defer rows.Close()
+		ids := []int64{}
+		for ; rows.Valid() && len(ids) != n; rows.Next() {
+			rec := table.Record{}
+			is.Nil(t, rows.Deref(&rec))
+			ids = append(ids, rec.Get("id").I64)
+		}
+		is.Nil(t, rows.Err())
+		return ids
+	}
+	all := func() *table.Scanner {
+		req := &table.Scanner{Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE}
+		req.Key1.AddInt64("id", 0)
+		req.Key2.AddInt64("id", 100)
+		return req
+	}
+	ids := scan(all(), -1)
+	is.Equal(t, 20, len(ids))
+	is.Equal(t, int64(1), ids[0])
+	is.Equal(t, int64(20), ids[19])
+	req := all()
+	req.Offset, req.Limit = 2, 7
+	is.Equal(t, []int64{3, 4, 5, 6, 7, 8, 9}, scan(req, -1))
+	req = all()
+	req.Desc = true
+	is.Equal(t, []int64{20, 19, 18, 17, 16}, scan(req, 5))
+	req = &table.Scanner{Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE, Cols: []string{"id"}}
+	req.Key1.AddStr("email", []byte("u10@x"))
+	req.Key2.AddStr("email", []byte("u12@x"))
+	is.Equal(t, []int64{10, 11, 12}, scan(req, -1))
+	req = all()
+	is.Nil(t, req.SetFilterExpr("id <= 3 OR email STARTS WITH 'u1'"))
+	is.Equal(t, []int64{1, 2, 3, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19}, scan(req, -1))
+	is.Nil(t, req.SetFilterExpr("id = 1 OR nope = 1"))
+	_, err = conn.Scan("users", req)
+	is.ErrorContains(t, err, "unknown column: nope at position 9")
+	_, err = conn.Scan("nope", all())
+	is.NotNil(t, err)
+
+	// a write between the chunks is not seen by the scan
+	rows, err := conn.Scan("users", all())
+	is.Nil(t, err)
+	key := table.Record{}
+	key.AddInt64("id", 20)
+	ok, err = conn.Delete("users", key)
+	is.Nil(t, err)
+	is.True(t, ok)
+	n := 0
+	for ; rows.Valid(); rows.Next() {
+		n++
+	}
+	is.Nil(t, rows.Err())
+	rows.Close()
+	is.Equal(t, 20, n)
+	is.Equal(t, 19, len(scan(all(), -1)))
+
+	ok, err = conn.Delete("users", key)
+	is.Nil(t, err)
+	is.False(t, ok)
+	key = table.Record{}
+	key.AddInt64("id", 19)
+	ok, err = conn.Delete("users", key)
+	is.Nil(t, err)
+	is.True(t, ok)
+}
+
+func TestServerEmbedded(t *testing.T) {
+	os.Remove("s.db")
+	db := table.DB{Path: "s.db"}
+	is.Nil(t, db.Open())
+	defer os.Remove("s.db")
+	defer db.Close()
+	testConn(t, Embedded{DB: &db})
+}
+
+func TestServerClient(t *testing.T) {
+	s := newS(3)
+	defer s.dispose()
+	c, err := Dial(s.ln.Addr().String())
+	is.Nil(t, err)
+	defer c.Close()
+	testConn(t, c)
+}
+
+func TestServerConcurrent(t *testing.T) {
+	s := newS(4)
+	defer s.dispose()
+	c, err := Dial(s.ln.Addr().String())
+	is.Nil(t, err)
+	defer c.Close()
+	tdef := &table.TableDef{
+		Name:    "kv",
+		Cols:    []string{"id", "email"},
+		Types:   []uint32{table.TYPE_INT64, table.TYPE_BYTES},
+		Indexes: [][]string{{"id"}},
+	}
+	is.Nil(t, c.TableNew(tdef))
+
+	// the writes don't conflict; the reads see whole commits
+	const N, M = 8, 25
+	wg := sync.WaitGroup{}
+	errs := make(chan error, 2*N)
+	for i := 0; i < N; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < M; j++ {
+				dbreq := &table.DBUpdateReq{Record: serverUser(int64(i*M+j), "x")}
+				if _, err := c.Set("kv", dbreq); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			req := &table.Scanner{Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE}
+			req.Key1.AddInt64("id", 0)
+			req.Key2.AddInt64("id", N*M)
+			rows, err := c.Scan("kv", req)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer rows.Close()
+			for ; rows.Valid(); rows.Next() {
+			}
+			if err := rows.Err(); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		is.Nil(t, err)
+	}
+
+	rows, err := Embedded{DB: &s.db}.Scan("kv", &table.Scanner{
+		Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE,
+		Key1: *(&table.Record{}).AddInt64("id", 0),
+		Key2: *(&table.Record{}).AddInt64("id", N*M),
+	})
+	is.Nil(t, err)
+	n := 0
+	for ; rows.Valid(); rows.Next() {
+		n++
+	}
+	rows.Close()
+	is.Equal(t, N*M, n)
+
+	// a closed server ends the connections
+	s.srv.Close()
+	_, err = c.ListTables()
+	is.NotNil(t, err)
+}
@@ -0,0 +1,322 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/Adit0507/AdiDB/internal/transactions"
+	"github.com/Adit0507/AdiDB/table"
+)
+
+/*
+the wire protocol. a connection carries one request at a time, and each
+request gets one response. a message is a frame:
+| len | kind | body |
+|  4B |  1B  | ...  |
+`len` counts the kind and the body. the kind of a request is an OP_*, the
+kind of a response is WIRE_OK or WIRE_ERR. an error body is a code for the
+known errors (see wireErrors), the message, and the column of the typed
+errors with one.
+
+numbers in a body are varints, strings and byte strings have a varint
+length. a value is its type and the payload:
+| type | I64 or F64 | or | type | len | Str |
+|  1B  |     8B     |    |  1B  | ... | ... |
+a record is the number of columns, then the name and the value of each.
+
+a scan request ends with the filter expression of the scan, "" for none;
+it may be left out by older clients. a scan replies with a chunk of rows and a flag for more rows; the client
+asks for the next chunk with OP_SCAN_NEXT, or ends the scan early with
+OP_SCAN_STOP. the server holds a snapshot for the scan in the meantime.
+*/
+
+const (
+	OP_GET        = 1
+	OP_SET        = 2
+	OP_DELETE     = 3
+	OP_SCAN       = 4
+	OP_SCAN_NEXT  = 5
+	OP_SCAN_STOP  = 6
+	OP_TABLE_NEW  = 7
+	OP_LIST_TABLE = 8
+)
+
+const (
+	WIRE_OK  = 0
+	WIRE_ERR = 1
+)
+
+// the largest frame accepted; the size is checked before it's allocated
+const WIRE_MAX_FRAME = 64 << 20
+
+// errors that keep their identity over the wire, by code. 0 is others.
+var wireErrors = []error{
+	nil,
+	table.ErrUniqueViolation,
+	table.ErrConflict,
+	table.ErrMemoryBudget,
+	transactions.ErrorConflict,
+	transactions.ErrReadOnly,
+	table.ErrTableNotFound,
+	table.ErrTableExists,
+	table.ErrRecordExists,
+	table.ErrRecordNotFound,
+	table.ErrBadRange,
+	&table.ErrBadColumnType{},
+	&table.ErrMissingColumn{},
+}
+
+// an error from the server. errors.Is works for the errors in wireErrors,
+// and errors.As for the typed ones.
+type RemoteError struct {
+	Msg string
+	err error
+}
+
+func (e *RemoteError) Error() string {
+	return e.Msg
+}
+
+func (e *RemoteError) Unwrap() error {
+	return e.err
+}
+
+var errBadMessage = errors.New("bad message")
+
+func wireWrite(w io.Writer, kind byte, body []byte) error {
+	if len(body)+1 > WIRE_MAX_FRAME {
+		return fmt.Errorf("message too large: %d bytes", len(body))
+	}
+	hdr := [5]byte{}
+	binary.LittleEndian.PutUint32(hdr[0:4], uint32(len(body)+1))
+	hdr[4] = kind
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(body)
+	return err
+}
+
+func wireRead(r io.Reader) (kind byte, body []byte, err error) {
+	hdr := [5]byte{}
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	size := binary.LittleEndian.Uint32(hdr[0:4])
+	if size < 1 || size > WIRE_MAX_FRAME {
+		return 0, nil, errBadMessage
+	}
+	body = make([]byte, size-1)
+	if _, err := io.ReadFull(r, body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	return hdr[4], body, nil
+}
+
+// the body of a WIRE_ERR response
+func wireError(err error) []byte {
+	code := 0
+	for i := 1; i < len(wireErrors); i++ {
+		if errors.Is(err, wireErrors[i]) {
+			code = i
+			break
+		}
+	}
+	col := ""
+	colType, colMissing := (*table.ErrBadColumnType)(nil), (*table.ErrMissingColumn)(nil)
+	if errors.As(err, &colType) {
+		col = colType.Col
+	} else if errors.As(err, &colMissing) {
+		col = colMissing.Col
+	}
+	w := wireWriter{}
+	w.uvarint(uint64(code))
+	w.str(err.Error())
+	w.str(col)
+	return w.buf
+}
+
+func wireDecodeError(body []byte) error {
+	r := wireReader{buf: body}
+	code := r.uvarint()
+	msg := r.str()
+	col := r.str()
+	if r.err != nil || code >= uint64(len(wireErrors)) {
+		return errBadMessage
+	}
+	err := wireErrors[code]
+	switch err.(type) {
+	case *table.ErrBadColumnType:
+		err = &table.ErrBadColumnType{Col: col}
+	case *table.ErrMissingColumn:
+		err = &table.ErrMissingColumn{Col: col}
+	}
+	return &RemoteError{Msg: msg, err: err}
+}
+
+type wireWriter struct {
+	buf []byte
+}
+
+func (w *wireWriter) uvarint(v uint64) {
+	w.buf = binary.AppendUvarint(w.buf, v)
+}
+
+func (w *wireWriter) varint(v int64) {
+	w.buf = binary.AppendVarint(w.buf, v)
+}
+
+func (w *wireWriter) bool(v bool) {
+	if v {
+		w.buf = append(w.buf, 1)
+	} else {
+		w.buf = append(w.buf, 0)
+	}
+}
+
+func (w *wireWriter) bytes(b []byte) {
+	w.uvarint(uint64(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+func (w *wireWriter) str(s string) {
+	w.uvarint(uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+func (w *wireWriter) value(v *table.Value) {
+	w.buf = append(w.buf, byte(v.Type))
+	switch v.Type {
+	case table.TYPE_BYTES, table.TYPE_JSON:
+		w.bytes(v.Str)
+	case table.TYPE_FLOAT64:
+		w.buf = binary.LittleEndian.AppendUint64(w.buf, math.Float64bits(v.F64))
+	case table.TYPE_NULL:
+	default:
+		w.buf = binary.LittleEndian.AppendUint64(w.buf, uint64(v.I64))
+	}
+}
+
+func (w *wireWriter) record(rec *table.Record) {
+	w.uvarint(uint64(len(rec.Cols)))
+	for i := range rec.Cols {
+		w.str(rec.Cols[i])
+		w.value(&rec.Vals[i])
+	}
+}
+
+// the first error is kept, and later reads return zero values
+type wireReader struct {
+	buf []byte
+	err error
+}
+
+func (r *wireReader) fail() {
+	if r.err == nil {
+		r.err = errBadMessage
+	}
+	r.buf = nil
+}
+
+func (r *wireReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *wireReader) varint() int64 {
+	v, n := binary.Varint(r.buf)
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *wireReader) bool() bool {
+	if len(r.buf) < 1 || r.buf[0] > 1 {
+		r.fail()
+		return false
+	}
+	v := r.buf[0] == 1
+	r.buf = r.buf[1:]
+	return v
+}
+
+func (r *wireReader) bytes() []byte {
+	n := r.uvarint()
+	if n > uint64(len(r.buf)) {
+		r.fail()
+		return nil
+	}
+	b := r.buf[:n:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *wireReader) str() string {
+	return string(r.bytes())
+}
+
+func (r *wireReader) u64() uint64 {
+	if len(r.buf) < 8 {
+		r.fail()
+		return 0
+	}
+	v := binary.LittleEndian.Uint64(r.buf)
+	r.buf = r.buf[8:]
+	return v
+}
+
+func (r *wireReader) value() (v table.Value) {
+	if len(r.buf) < 1 {
+		r.fail()
+		return v
+	}
+	v.Type = uint32(r.buf[0])
+	r.buf = r.buf[1:]
+	switch v.Type {
+	case table.TYPE_BYTES, table.TYPE_JSON:
+		v.Str = r.bytes()
+	case table.TYPE_FLOAT64:
+		v.F64 = math.Float64frombits(r.u64())
+	case table.TYPE_NULL:
+	case table.TYPE_INT64, table.TYPE_BOOL, table.TYPE_TIMESTAMP:
+		v.I64 = int64(r.u64())
+	default:
+		r.fail()
+	}
+	return v
+}
+
+func (r *wireReader) record() (rec table.Record) {
+	n := r.uvarint()
+	if n > uint64(len(r.buf)) { // at least a byte per column
+		r.fail()
+		return rec
+	}
+	for i := uint64(0); i < n && r.err == nil; i++ {
+		rec.Cols = append(rec.Cols, r.str())
+		rec.Vals = append(rec.Vals, r.value())
+	}
+	return rec
+}
+
+// the body is fully consumed
+func (r *wireReader) done() error {
+	if r.err == nil && len(r.buf) > 0 {
+		r.fail()
+	}
+	return r.err
+}
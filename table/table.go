@@ -2,35 +2,112 @@ package table
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"math"
 	"slices"
 	"sync"
+	"time"
 
-	"github.com/Adit0507/AdiDB/btree_iter"
-	"github.com/Adit0507/AdiDB/btree"
-	"github.com/Adit0507/AdiDB/kv"
-	"github.com/Adit0507/AdiDB/transactions"
+	"github.com/Adit0507/AdiDB/internal/btree"
+	"github.com/Adit0507/AdiDB/internal/btree_iter"
+	"github.com/Adit0507/AdiDB/internal/kv"
+	"github.com/Adit0507/AdiDB/internal/transactions"
 )
 
 const (
-	TYPE_ERROR = 0
-	TYPE_BYTES = 1
-	TYPE_INT64 = 2
-	TYPE_INF   = 0xff
+	TYPE_ERROR     = 0
+	TYPE_BYTES     = 1
+	TYPE_INT64     = 2
+	TYPE_NULL      = 3 // a value of a nullable column
+	TYPE_FLOAT64   = 4
+	TYPE_BOOL      = 5 // 0 or 1 in I64
+	TYPE_TIMESTAMP = 6 // UTC nanoseconds in I64
+	TYPE_JSON      = 7 // a JSON document in Str; see table_jsondoc.go
+	TYPE_INF       = 0xff
 )
 
 type DB struct {
-	Path   string
+	Path string
+	Options
+	// internals
 	kv     kv.KV
 	mu     sync.Mutex
 	tables map[string]*TableDef
+	// the schema generation of `tables`; see table_schema.go
+	tablesGen uint64
+	mem       memBudget
+	// one Migrate at a time in the process
+	migrating sync.Mutex
+	// by table and column; see AddValidator
+	validators map[string]map[string][]Validator
+	// by name; see RegisterIndexFunc
+	indexFns map[string]indexFn
+	// the tables with foreign keys to a table; see tableRefs
+	refs map[string][]*TableDef
+	// see table_watch.go
+	watch watchList
+}
+
+// the settings of a DB, read by DB.Open; the zero value is the default
+// for each
+type Options struct {
+	// see KV.NoSync and DB.Sync
+	NoSync bool
+	// see KV.Changes and DB.ChangesSince
+	Changes bool
+	// a 32-byte encryption key; see KV.Key
+	Key []byte
+	// page compression for a new file; see KV.Compression
+	Compression kv.Compressor
+	// writes fail with transactions.ErrReadOnly; see KV.ReadOnly
+	ReadOnly bool
+	// wait for another writer to close the file; see KV.LockTimeout
+	LockTimeout time.Duration
+	// the page size of a new file; see KV.PageSize
+	PageSize int
+	// bytes of the page cache; see KV.CacheSize
+	CacheSize int64
+	// catch a page freed twice, for debugging; see KV.GuardFree
+	GuardFree bool
+	// the growth of the file; see KV.InitialSize and kv_grow.go
+	InitialSize int64
+	GrowChunk   int64
+	GrowFactor  float64
+	Fallocate   bool
+	// instrumentation of the KV; see KV.Metrics
+	Metrics kv.Metrics
+	// notable events, and operations that take SlowOp or longer; see KV.Logger
+	Logger *slog.Logger
+	SlowOp time.Duration
+	// earlier versions kept for BeginReadAt; see KV.History
+	History int
+	// the time of the TTL deadlines; time.Now if nil
+	Clock func() time.Time
+	// memory budgets for open scanners in bytes; 0 for unlimited
+	MemLimit     int64 // all scanners
+	ScanMemLimit int64 // a single scanner
+	// the groups held by GroupBy when they don't follow the index; see
+	// GROUP_LIMIT
+	GroupLimit int
 }
 
 type DBTX struct {
 	kv transactions.KVTX
 	db *DB
+	// the schema is changed, or may differ in an earlier version (see
+	// BeginReadAt); the shared cache is neither read nor filled
+	schema bool
+	// outstanding savepoints, oldest first
+	saves    []savepoint
+	lastSave Savepoint
+	// rows added to @changes, to order them in the commit
+	nchanges int64
 }
 
 func (db *DB) Begin(tx *DBTX) {
@@ -38,11 +115,40 @@ func (db *DB) Begin(tx *DBTX) {
 	db.kv.Begin(&tx.kv)
 }
 
+// a read-only transaction pinned to the current version.
+// writes fail with transactions.ErrReadOnly. end it with Abort.
+func (db *DB) BeginRead(tx *DBTX) {
+	tx.db = db
+	db.kv.BeginRead(&tx.kv)
+}
+
+// BeginRead on an earlier version; see KV.BeginReadAt. the schemas are
+// read from that version too, not from the shared cache.
+func (db *DB) BeginReadAt(tx *DBTX, seq uint64) error {
+	tx.db = db
+	if err := db.kv.BeginReadAt(&tx.kv, seq); err != nil {
+		return err
+	}
+	tx.schema = true
+	return nil
+}
+
 func (db *DB) Commit(tx *DBTX) error {
-	return db.kv.Commit(&tx.kv)
+	db.mem.closeTX(tx)
+	watchCommit(db, tx)
+	if err := db.kv.Commit(&tx.kv); err != nil {
+		return err
+	}
+	if tx.schema {
+		db.mu.Lock()
+		schemaCacheDrop(db, 0)
+		db.mu.Unlock()
+	}
+	return nil
 }
 
 func (db *DB) Abort(tx *DBTX) {
+	db.mem.closeTX(tx)
 	db.kv.Abort(&tx.kv)
 }
 
@@ -54,12 +160,86 @@ func (tx*DBTX) Revert(save *transactions.TXSave) {
 	tx.kv.Revert(save)
 }
 
+// a marker to roll back to within a transaction
+type Savepoint uint64
+
+type savepoint struct {
+	id   Savepoint
+	save transactions.TXSave
+}
+
+// mark the current state of the transaction
+func (tx *DBTX) Savepoint() Savepoint {
+	tx.lastSave++
+	sp := savepoint{id: tx.lastSave}
+	tx.Save(&sp.save)
+	tx.saves = append(tx.saves, sp)
+	return sp.id
+}
+
+func findSavepoint(tx *DBTX, id Savepoint) (int, error) {
+	i := slices.IndexFunc(tx.saves, func(sp savepoint) bool { return sp.id == id })
+	if i < 0 {
+		return 0, fmt.Errorf("invalid savepoint: %d", id)
+	}
+	return i, nil
+}
+
+// discard the writes made after the savepoint. the savepoint stays valid,
+// the later ones are invalidated.
+func (tx *DBTX) RollbackTo(id Savepoint) error {
+	i, err := findSavepoint(tx, id)
+	if err != nil {
+		return err
+	}
+	tx.Revert(&tx.saves[i].save)
+	tx.saves = tx.saves[:i+1]
+	return nil
+}
+
+// forget the savepoint and the later ones, keeping the writes
+func (tx *DBTX) Release(id Savepoint) error {
+	i, err := findSavepoint(tx, id)
+	if err != nil {
+		return err
+	}
+	tx.saves = tx.saves[:i]
+	return nil
+}
+
 type TableDef struct {
 	Name     string
 	Types    []uint32 //col type
 	Cols     []string //col name
 	Prefixes []uint32
 	Indexes  [][]string
+	Unique   []bool `json:",omitempty"` // secondary indexes without duplicates
+	Building []bool `json:",omitempty"` // secondary indexes being filled; see table_index.go
+	Defaults []Value  `json:",omitempty"` // per column; for omitted columns and rows older than the column
+	AutoInc  bool     `json:",omitempty"` // generate the first primary key column
+	Nullable []bool   `json:",omitempty"` // per column; index columns can't be null
+	Checks   []Check  `json:",omitempty"` // see table_constraint.go
+	// see table_fkey.go
+	ForeignKeys []ForeignKey `json:",omitempty"`
+	// per index and column of the index; see table_collate.go
+	Collations [][]uint32 `json:",omitempty"`
+	// per index and column of the index; see table_desc.go
+	Descending [][]bool `json:",omitempty"`
+	// per index; see table_computed.go
+	Computed []IndexFunc `json:",omitempty"`
+	// the column of the row deadlines; see table_ttl.go
+	TTL string `json:",omitempty"`
+	// the columns of the write times; see table_times.go
+	CreatedAt string `json:",omitempty"`
+	UpdatedAt string `json:",omitempty"`
+	// the column of the row versions; see table_version.go
+	Version string `json:",omitempty"`
+	// log the writes in @changes; see table_changes.go
+	Changes      bool `json:",omitempty"`
+	ChangeValues bool `json:",omitempty"` // with the new rows
+	// per column; the bytes of a BYTES value, 0 for no limit. an index
+	// whose columns all have a limit must fit in a key; see indexKeyMax.
+	MaxLen []int `json:",omitempty"`
 }
 
 // table cell
@@ -67,6 +247,34 @@ type Value struct {
 	Type uint32
 	I64  int64
 	Str  []byte
+	F64  float64
+}
+
+func (v *Value) Bool() bool {
+	assert(v.Type == TYPE_BOOL)
+	return v.I64 != 0
+}
+
+func (v *Value) Time() time.Time {
+	assert(v.Type == TYPE_TIMESTAMP)
+	return time.Unix(0, v.I64).UTC()
+}
+
+// same type and value
+func (v *Value) Equal(other *Value) bool {
+	if v.Type != other.Type {
+		return false
+	}
+	switch v.Type {
+	case TYPE_BYTES, TYPE_JSON:
+		return bytes.Equal(v.Str, other.Str)
+	case TYPE_INT64, TYPE_BOOL, TYPE_TIMESTAMP:
+		return v.I64 == other.I64
+	case TYPE_FLOAT64:
+		return v.F64 == other.F64
+	default:
+		return true // no payload
+	}
 }
 
 // represents a list of col names and values
@@ -88,6 +296,48 @@ func (rec *Record) AddInt64(col string, val int64) *Record {
 
 	return rec
 }
+func (rec *Record) AddFloat64(col string, val float64) *Record {
+	rec.Cols = append(rec.Cols, col)
+	rec.Vals = append(rec.Vals, Value{Type: TYPE_FLOAT64, F64: val})
+
+	return rec
+}
+
+func (rec *Record) AddBool(col string, val bool) *Record {
+	v := Value{Type: TYPE_BOOL}
+	if val {
+		v.I64 = 1
+	}
+	rec.Cols = append(rec.Cols, col)
+	rec.Vals = append(rec.Vals, v)
+
+	return rec
+}
+
+// nanosecond precision; representable years are 1678 to 2262
+func (rec *Record) AddTime(col string, val time.Time) *Record {
+	rec.Cols = append(rec.Cols, col)
+	rec.Vals = append(rec.Vals, Value{Type: TYPE_TIMESTAMP, I64: val.UnixNano()})
+
+	return rec
+}
+
+// the text of a document; it's checked and compacted when it's written
+func (rec *Record) AddJSON(col string, doc []byte) *Record {
+	rec.Cols = append(rec.Cols, col)
+	rec.Vals = append(rec.Vals, Value{Type: TYPE_JSON, Str: doc})
+
+	return rec
+}
+
+func (rec *Record) AddNull(col string) *Record {
+	rec.Cols = append(rec.Cols, col)
+	rec.Vals = append(rec.Vals, Value{Type: TYPE_NULL})
+
+	return rec
+}
+
+// nil for a missing column, TYPE_NULL for a null value
 func (rec *Record) Get(key string) *Value {
 	for i, c := range rec.Cols {
 		if c == key {
@@ -117,9 +367,29 @@ var TDEF_TABLE = &TableDef{
 	Indexes:  [][]string{{"name"}},
 }
 
+// count the rows of each table; see table_stats.go
+var TDEF_STATS = &TableDef{
+	Name:     "@stats",
+	Types:    []uint32{TYPE_INT64, TYPE_INT64, TYPE_INT64},
+	Cols:     []string{"prefix", "rows", "bytes"},
+	Prefixes: []uint32{3},
+	Indexes:  [][]string{{"prefix"}},
+}
+
+// the writes of tables with TableDef.Changes; see table_changes.go
+var TDEF_CHANGES = &TableDef{
+	Name:     "@changes",
+	Types:    []uint32{TYPE_INT64, TYPE_INT64, TYPE_INT64, TYPE_INT64, TYPE_BYTES, TYPE_BYTES},
+	Cols:     []string{"seq", "prefix", "n", "op", "key", "val"},
+	Prefixes: []uint32{4},
+	Indexes:  [][]string{{"seq", "prefix", "n"}},
+}
+
 var INTERNAL_TABLES map[string]*TableDef = map[string]*TableDef{
-	"@meta":  TDEF_META,
-	"@table": TDEF_TABLE,
+	"@meta":    TDEF_META,
+	"@table":   TDEF_TABLE,
+	"@stats":   TDEF_STATS,
+	"@changes": TDEF_CHANGES,
 }
 
 func assert(cond bool ){
@@ -130,15 +400,20 @@ func assert(cond bool ){
 
 // reorder records to defined col. order
 func reorderRecord(tdef *TableDef, rec Record) ([]Value, error) {
-	assert(len(rec.Cols) == len(rec.Vals))
+	if len(rec.Cols) != len(rec.Vals) {
+		return nil, fmt.Errorf("bad record")
+	}
+	if err := checkDupCols(rec); err != nil {
+		return nil, err
+	}
 	out := make([]Value, len(tdef.Cols))
 	for i, c := range tdef.Cols {
 		v := rec.Get(c)
 		if v == nil {
 			continue
 		}
-		if v.Type != tdef.Types[i] {
-			return nil, fmt.Errorf("bad column type: %s", c)
+		if err := checkValue(tdef, i, *v); err != nil {
+			return nil, err
 		}
 		out[i] = *v
 	}
@@ -146,12 +421,74 @@ func reorderRecord(tdef *TableDef, rec Record) ([]Value, error) {
 	return out, nil
 }
 
+// a column twice is ambiguous
+func checkDupCols(rec Record) error {
+	for i, c := range rec.Cols {
+		if slices.Index(rec.Cols[:i], c) >= 0 {
+			return fmt.Errorf("duplicate column: %s", c)
+		}
+	}
+	return nil
+}
+
+// the value of an omitted column; nil if it has no default
+func colDefault(tdef *TableDef, col int) *Value {
+	if col < len(tdef.Defaults) && tdef.Defaults[col].Type != TYPE_ERROR {
+		return &tdef.Defaults[col]
+	}
+	return nil
+}
+
+func isNullable(tdef *TableDef, col int) bool {
+	return col < len(tdef.Nullable) && tdef.Nullable[col]
+}
+
+// check a value against the column type
+func checkValue(tdef *TableDef, col int, v Value) error {
+	switch name := tdef.Cols[col]; {
+	case v.Type == TYPE_NULL && !isNullable(tdef, col):
+		return errColumn(tdef, col, &v, fmt.Errorf("column is not nullable: %s", name))
+	case v.Type != TYPE_NULL && v.Type != tdef.Types[col]:
+		return errColumn(tdef, col, &v, &ErrBadColumnType{Col: name})
+	case v.Type == TYPE_FLOAT64 && math.IsNaN(v.F64):
+		return errColumn(tdef, col, &v, fmt.Errorf("NaN is not ordered: %s", name))
+	case v.Type == TYPE_BOOL && v.I64 != 0 && v.I64 != 1:
+		return errColumn(tdef, col, &v, fmt.Errorf("bad bool value: %s", name))
+	case v.Type == TYPE_JSON && !jsonValid(v.Str):
+		return errColumn(tdef, col, &v, fmt.Errorf("%w: %s", ErrInvalidJSON, name))
+	}
+	return nil
+}
+
+// 0 for no limit
+func colMaxLen(tdef *TableDef, col int) int {
+	if col < len(tdef.MaxLen) {
+		return tdef.MaxLen[col]
+	}
+	return 0
+}
+
+// the strings of a row to write fit in their columns. it's not checked by
+// checkValue, so that a longer value is still a bound of a range.
+func checkMaxLen(tdef *TableDef, cols []string, vals []Value) error {
+	if len(tdef.MaxLen) == 0 {
+		return nil
+	}
+	for i, c := range cols {
+		col := slices.Index(tdef.Cols, c)
+		if n := colMaxLen(tdef, col); n > 0 && vals[i].Type == TYPE_BYTES && len(vals[i].Str) > n {
+			return errColumn(tdef, col, &vals[i], &ErrValueTooLong{Col: c, Max: n})
+		}
+	}
+	return nil
+}
+
 func valuesComplete(tdef *TableDef, vals []Value, n int) error {
 	for i, v := range vals {
-		if i < n && v.Type == 0 {
-			return fmt.Errorf("missing column: %s", tdef.Cols[i])
+		if i < n && v.Type == 0 && !isNullable(tdef, i) && colDefault(tdef, i) == nil {
+			return errColumn(tdef, i, nil, &ErrMissingColumn{Col: tdef.Cols[i]})
 		} else if i >= n && v.Type != 0 {
-			return fmt.Errorf("extra column: %s", tdef.Cols[i])
+			return errColumn(tdef, i, &v, fmt.Errorf("extra column: %s", tdef.Cols[i]))
 		}
 	}
 
@@ -180,17 +517,15 @@ func escapeString(in []byte) []byte {
 	return out
 }
 
-func unescapeString(in []byte) []byte {
-	if bytes.Count(in, []byte{1}) == 0 {
-		return in
-	}
-
-	out := make([]byte, 0, len(in))
+// append the unescaped string to `out`
+func unescapeString(out []byte, in []byte) ([]byte, error) {
 	for i := 0; i < len(in); i++ {
 		if in[i] == 0x01 {
 			// 01 01 -> 00
 			i++
-			assert(in[i] == 1 || in[i] == 2)
+			if i == len(in) || (in[i] != 1 && in[i] != 2) {
+				return nil, errCorrupt("bad escape in a string")
+			}
 			out = append(out, in[i]-1)
 		} else {
 			out = append(out, in[i])
@@ -198,22 +533,77 @@ func unescapeString(in []byte) []byte {
 
 	}
 
-	return out
+	return out, nil
+}
+
+// a decoded string. it's appended to `*strs` if given; otherwise it points
+// into `in` unless it has escapes.
+func decodeString(in []byte, strs *[]byte) ([]byte, error) {
+	if strs == nil {
+		if bytes.IndexByte(in, 1) < 0 {
+			return in, nil
+		}
+		return unescapeString(make([]byte, 0, len(in)), in)
+	}
+	start := len(*strs)
+	out, err := unescapeString(*strs, in)
+	if err != nil {
+		return nil, err
+	}
+	*strs = out
+	return out[start:len(out):len(out)], nil
+}
+
+// IEEE 754 bits that compare as unsigned integers:
+// negatives have all bits flipped, positives only the sign bit.
+func encodeFloat64(f float64) uint64 {
+	u := math.Float64bits(f)
+	if u>>63 == 1 {
+		return ^u
+	}
+	return u | (1 << 63)
+}
+
+func decodeFloat64(u uint64) float64 {
+	if u>>63 == 1 {
+		return math.Float64frombits(u &^ (1 << 63))
+	}
+	return math.Float64frombits(^u)
 }
 
-// order preserving encoding
+// nulls sort before any other value
+const NULL_TAG = 0
+
+// order preserving encoding. a string ends with 0x00 and its 0x00 and
+// 0x01 bytes are escaped to 0x01 0x01 and 0x01 0x02, so a string sorts
+// before a longer one with it as a prefix, and the next column never
+// decides before the end of a string. see TestTableKeyOrder.
 func encodeValues(out []byte, vals []Value) []byte {
 	for _, v := range vals {
+		if v.Type == TYPE_NULL {
+			out = append(out, NULL_TAG)
+			continue
+		}
 		out = append(out, byte(v.Type))
 		switch v.Type {
-		case TYPE_INT64:
+		case TYPE_INT64, TYPE_TIMESTAMP:
 			var buf [8]byte
 			u := uint64(v.I64) + (1 << 63)        // flip the sign bit
 			binary.BigEndian.PutUint64(buf[:], u) // big endian
 			out = append(out, buf[:]...)
+		case TYPE_FLOAT64:
+			var buf [8]byte
+			binary.BigEndian.PutUint64(buf[:], encodeFloat64(v.F64))
+			out = append(out, buf[:]...)
+		case TYPE_BOOL:
+			assert(v.I64 == 0 || v.I64 == 1)
+			out = append(out, byte(v.I64))
 		case TYPE_BYTES:
 			out = append(out, escapeString(v.Str)...)
 			out = append(out, 0) // null-terminated
+		case TYPE_JSON:
+			out = append(out, escapeString(jsonCompact(v.Str))...)
+			out = append(out, 0)
 		default:
 			panic("what?")
 		}
@@ -240,28 +630,167 @@ func encodeKey(out []byte, prefix uint32, vals []Value) []byte {
 	return out
 }
 
-func decodeKey(in []byte, out []Value) {
-	decodeValues(in[4:], out)
+// the data read from the file doesn't decode
+func decodeKey(in []byte, out []Value) error {
+	return decodeKeyStrs(in, out, nil)
+}
+
+// decodeKey with the strings appended to `*strs`, see decodeString
+func decodeKeyStrs(in []byte, out []Value, strs *[]byte) error {
+	if len(in) < 4 {
+		return errCorrupt("no table prefix")
+	}
+	n, err := decodeValuesShort(in[4:], out, nil, strs)
+	if err == nil && n != len(out) {
+		err = errCorrupt("%d of %d values", n, len(out))
+	}
+	return err
+}
+
+func decodeValues(in []byte, out []Value) error {
+	n, err := decodeValuesShort(in, out, nil, nil)
+	if err == nil && n != len(out) {
+		err = errCorrupt("%d of %d values", n, len(out))
+	}
+	return err
+}
+
+// size of an encoded value without the type byte. -1 for an unknown
+// type or a value cut short.
+func encodedLen(tp uint32, in []byte) int {
+	n := -1
+	switch tp {
+	case TYPE_INT64, TYPE_TIMESTAMP, TYPE_FLOAT64:
+		n = 8
+	case TYPE_BOOL:
+		n = 1
+	case TYPE_BYTES, TYPE_JSON:
+		if idx := bytes.IndexByte(in, 0); idx >= 0 {
+			n = idx + 1 // null-terminated
+		}
+	}
+	if n > len(in) {
+		return -1
+	}
+	return n
 }
 
-func decodeValues(in []byte, out []Value) {
+// decode up to len(out) values, stopping early at the end of the input.
+// values flagged in `skip` are passed over and only keep their type.
+// returns the number of decoded values. the input is from the file, so
+// anything that doesn't fit the types is ErrCorrupt. strings go to
+// `strs` as in decodeString.
+func decodeValuesShort(in []byte, out []Value, skip []bool, strs *[]byte) (int, error) {
 	for i := range out {
+		if len(in) == 0 {
+			return i, nil
+		}
+		if in[0] == NULL_TAG {
+			out[i] = Value{Type: TYPE_NULL}
+			in = in[1:]
+			continue
+		}
+		if out[i].Type != uint32(in[0]) {
+			return i, errCorrupt("value %d: type %d, expected %d", i, in[0], out[i].Type)
+		}
+		n := encodedLen(out[i].Type, in[1:])
+		if n < 0 {
+			return i, errCorrupt("value %d: bad or truncated value of type %d", i, out[i].Type)
+		}
+		val := in[1 : 1+n]
+		in = in[1+n:]
+		if skip != nil && skip[i] {
+			continue
+		}
 		switch out[i].Type {
-		case TYPE_INT64:
-			u := binary.BigEndian.Uint64(in[:8])
+		case TYPE_INT64, TYPE_TIMESTAMP:
+			u := binary.BigEndian.Uint64(val)
 			out[i].I64 = int64(u - (1 << 63))
-			in = in[8:]
-		case TYPE_BYTES:
-			idx := bytes.IndexByte(in, 0)
-			assert(idx >= 0)
-			out[i].Str = unescapeString(in[:idx])
-			in = in[idx+1:]
-		default:
-			panic("what?")
+		case TYPE_FLOAT64:
+			out[i].F64 = decodeFloat64(binary.BigEndian.Uint64(val))
+		case TYPE_BOOL:
+			if val[0] > 1 {
+				return i, errCorrupt("value %d: bad bool %d", i, val[0])
+			}
+			out[i].I64 = int64(val[0])
+		case TYPE_BYTES, TYPE_JSON:
+			str, err := decodeString(val[:n-1], strs)
+			if err != nil {
+				return i, err
+			}
+			out[i].Str = str
 		}
 	}
 
-	assert(len(in) == 0)
+	if len(in) != 0 {
+		return len(out), errCorrupt("%d trailing bytes", len(in))
+	}
+	return len(out), nil
+}
+
+// the value of a row, the non primary key columns, starts with a header
+// since v1: the version byte and the number of columns as a uvarint. a v0
+// row is the bare values; its first byte is a type tag or NULL_TAG, which
+// are below the version bytes, or there is none. rows are written with
+// ROW_VERSION and any version is read.
+const (
+	ROW_V1      = 0x81
+	ROW_VERSION = ROW_V1
+)
+
+// the value of a row with the header of ROW_VERSION
+func encodeRow(out []byte, vals []Value) []byte {
+	out = append(out, ROW_VERSION)
+	out = binary.AppendUvarint(out, uint64(len(vals)))
+	return encodeValues(out, vals)
+}
+
+// the values of a row without the header, and their number; -1 for v0,
+// which doesn't have it
+func rowValues(in []byte) ([]byte, int, error) {
+	if len(in) == 0 || in[0] < ROW_V1 {
+		return in, -1, nil
+	}
+	if in[0] != ROW_V1 {
+		return nil, 0, errCorrupt("unknown row version %#x", in[0])
+	}
+	n, size := binary.Uvarint(in[1:])
+	if size <= 0 || n > math.MaxUint16 {
+		return nil, 0, errCorrupt("bad row header")
+	}
+	return in[1+size:], int(n), nil
+}
+
+// decode the non primary key columns of a row. rows written before a
+// column was added lack it, so it takes the default value, or null.
+func decodeRow(tdef *TableDef, in []byte, out []Value, skip []bool, strs *[]byte) error {
+	in, count, err := rowValues(in)
+	if err != nil {
+		return err
+	}
+	if count > len(out) {
+		return errCorrupt("%d values of %d columns", count, len(out))
+	}
+	n, err := decodeValuesShort(in, out, skip, strs)
+	if err == nil && count >= 0 && n != count {
+		err = errCorrupt("%d of %d values", n, count)
+	}
+	if err != nil || n == len(out) {
+		return err
+	}
+	cols := nonPrimaryKeyCols(tdef)
+	for i := n; i < len(out); i++ {
+		idx := slices.Index(tdef.Cols, cols[i])
+		switch {
+		case idx < len(tdef.Defaults) && tdef.Defaults[idx].Type == out[i].Type:
+			out[i] = tdef.Defaults[idx]
+		case isNullable(tdef, idx):
+			out[i] = Value{Type: TYPE_NULL}
+		default:
+			return errCorrupt("no value or default for column %s", cols[i])
+		}
+	}
+	return nil
 }
 
 // check for missing columns
@@ -275,6 +804,9 @@ func checkRecord(tdef *TableDef, rec Record, n int) ([]Value, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := checkMaxLen(tdef, tdef.Cols, vals); err != nil {
+		return nil, err
+	}
 	return vals, nil
 }
 
@@ -282,13 +814,24 @@ func checkRecord(tdef *TableDef, rec Record, n int) ([]Value, error) {
 func getValues(tdef *TableDef, rec Record, cols []string) ([]Value, error) {
 	vals := make([]Value, len(cols))
 	for i, c := range cols {
+		idx := slices.Index(tdef.Cols, c)
+		if idx < 0 {
+			return nil, fmt.Errorf("unknown column: %s", c)
+		}
 		v := rec.Get(c)
 		if v == nil {
-			return nil, fmt.Errorf("missing col.: %s", tdef.Cols[i])
+			v = colDefault(tdef, idx)
+		}
+		if v == nil && isNullable(tdef, idx) {
+			vals[i] = Value{Type: TYPE_NULL}
+			continue
+		}
+		if v == nil {
+			return nil, errColumn(tdef, idx, nil, &ErrMissingColumn{Col: c})
 		}
 
-		if v.Type != tdef.Types[slices.Index(tdef.Cols, c)] {
-			return nil, fmt.Errorf("bad column type: %s", c)
+		if err := checkValue(tdef, idx, *v); err != nil {
+			return nil, err
 		}
 		vals[i] = *v
 	}
@@ -297,6 +840,16 @@ func getValues(tdef *TableDef, rec Record, cols []string) ([]Value, error) {
 
 // get a single row by primary key
 func dbGet(tx *DBTX, tdef *TableDef, rec *Record) (bool, error) {
+	return dbGetCols(tx, tdef, rec, nil)
+}
+
+// get only some columns of a row; all columns if `cols` is empty
+func dbGetCols(tx *DBTX, tdef *TableDef, rec *Record, cols []string) (bool, error) {
+	return dbGetRow(tx, tdef, rec, cols, false)
+}
+
+// dbGetCols, and also a row past its TTL deadline with `expired`
+func dbGetRow(tx *DBTX, tdef *TableDef, rec *Record, cols []string, expired bool) (bool, error) {
 	vals, err := getValues(tdef, *rec, tdef.Indexes[0])
 	if err != nil {
 		return false, err
@@ -308,30 +861,100 @@ func dbGet(tx *DBTX, tdef *TableDef, rec *Record) (bool, error) {
 		Cmp2: btree_iter.CMP_LE,
 		Key1: Record{tdef.Indexes[0], vals},
 		Key2: Record{tdef.Indexes[0], vals},
+		Cols: cols,
+		expired: expired,
 	}
 
-	if err := dbScan(tx, tdef, &sc); err != nil || !sc.Valid() {
+	if err := dbScan(tx, tdef, &sc); err != nil {
+		return false, err
+	}
+	defer sc.Close()
+	if !sc.Valid() {
+		return false, sc.Err()
+	}
+	if err := sc.Deref(rec); err != nil {
 		return false, err
 	}
-	sc.Deref(rec)
 	return true, nil
 }
 
 func (tx *DBTX) Get(table string, rec *Record) (bool, error) {
-	tdef := getTableDef(tx, table)
-	if tdef == nil {
-		return false, fmt.Errorf("table not found: %s", table)
+	tdef, err := getTableDef(tx, table)
+	if err != nil {
+		return false, err
 	}
 
 	return dbGet(tx, tdef, rec)
 }
 
+// Get after a check of the context
+func (tx *DBTX) GetCtx(ctx context.Context, table string, rec *Record) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return tx.Get(table, rec)
+}
+
+// like Get, but the record only gets the listed columns in that order
+func (tx *DBTX) GetCols(table string, rec *Record, cols []string) (bool, error) {
+	tdef, err := getTableDef(tx, table)
+	if err != nil {
+		return false, err
+	}
+
+	return dbGetCols(tx, tdef, rec, cols)
+}
+
+// the row with the smallest primary key. `rec` can hold leading
+// primary key columns to only look at the rows with that prefix.
+func (tx *DBTX) First(table string, rec *Record) (bool, error) {
+	return dbFirstLast(tx, table, rec, false)
+}
+
+// the row with the largest primary key, see First.
+func (tx *DBTX) Last(table string, rec *Record) (bool, error) {
+	return dbFirstLast(tx, table, rec, true)
+}
+
+func dbFirstLast(tx *DBTX, table string, rec *Record, desc bool) (bool, error) {
+	tdef, err := getTableDef(tx, table)
+	if err != nil {
+		return false, err
+	}
+	pk := tdef.Indexes[0]
+	if len(rec.Cols) > len(pk) || !slices.Equal(pk[:len(rec.Cols)], rec.Cols) {
+		return false, fmt.Errorf("%w: not a primary key prefix: %v", ErrBadRange, rec.Cols)
+	}
+
+	sc := Scanner{
+		Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE,
+		Key1: *rec, Key2: *rec, Desc: desc, Limit: 1,
+	}
+	if err := dbScan(tx, tdef, &sc); err != nil {
+		return false, err
+	}
+	defer sc.Close()
+	if !sc.Valid() {
+		return false, sc.Err()
+	}
+	if err := sc.Deref(rec); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 const TABLE_PREFIX_MIN = 100
 
 func tableDefCheck(tdef *TableDef) error {
 	// very table schema
-	bad := tdef.Name == "" || len(tdef.Cols) == 0
+	bad := tdef.Name == "" || len(tdef.Cols) == 0 || len(tdef.Indexes) == 0
 	bad = bad || len(tdef.Cols) != len(tdef.Types)
+	bad = bad || len(tdef.Unique) > len(tdef.Indexes)
+	bad = bad || len(tdef.Building) > len(tdef.Indexes) || isBuilding(tdef, 0)
+	bad = bad || len(tdef.Defaults) > len(tdef.Cols)
+	bad = bad || len(tdef.Nullable) > len(tdef.Cols)
+	bad = bad || len(tdef.MaxLen) > len(tdef.Cols)
+	bad = bad || (tdef.ChangeValues && !tdef.Changes)
 	if bad {
 		return fmt.Errorf("bad table schema: %s", tdef.Name)
 	}
@@ -345,31 +968,132 @@ func tableDefCheck(tdef *TableDef) error {
 		tdef.Indexes[i] = index
 	}
 
-	return nil
-}
-
-func checkIndexCols(tdef *TableDef, index []string) ([]string, error) {
-	if len(index) == 0 {
-		return nil, fmt.Errorf("empty index")
+	for i, index := range tdef.Indexes {
+		for _, c := range index {
+			col := slices.Index(tdef.Cols, c)
+			if isNullable(tdef, col) {
+				return fmt.Errorf("index column cannot be nullable: %s", c)
+			}
+			// a computed index takes a path of it instead
+			if tdef.Types[col] == TYPE_JSON && !isComputed(tdef, i) {
+				return fmt.Errorf("JSON column cannot be indexed: %s", c)
+			}
+		}
+	}
+	if err := collateCheck(tdef); err != nil {
+		return err
+	}
+	if err := descCheck(tdef); err != nil {
+		return err
+	}
+	if err := computedCheck(tdef); err != nil {
+		return err
 	}
 
-	seen := map[string]bool{}
-	for _, c := range index {
-		// check index cols
-		if slices.Index(tdef.Cols, c) < 0 {
-			return nil, fmt.Errorf("unknown index column: %s", c)
+	// the limits are on byte strings, and the index keys can be stored
+	for i, n := range tdef.MaxLen {
+		if n < 0 || (n > 0 && tdef.Types[i] != TYPE_BYTES) {
+			return fmt.Errorf("bad max length: %s", tdef.Cols[i])
 		}
-		if seen[c] {
-			return nil, fmt.Errorf("duplicated column index: %s", c)
+	}
+	for i, index := range tdef.Indexes {
+		if size, ok := indexKeyMax(tdef, i); ok && size > btree.BTREE_MAX_KEY_SIZE {
+			return fmt.Errorf("index keys can be %d bytes, more than %d: %v",
+				size, btree.BTREE_MAX_KEY_SIZE, index)
 		}
-
-		seen[c] = true
 	}
 
-	// addin primary key to index
-	for _, c := range tdef.Indexes[0] {
-		if !seen[c] {
-			index = append(index, c)
+	if err := checksCheck(tdef); err != nil {
+		return err
+	}
+	if err := ttlCheck(tdef); err != nil {
+		return err
+	}
+	if err := timesCheck(tdef); err != nil {
+		return err
+	}
+	if err := versionCheck(tdef); err != nil {
+		return err
+	}
+
+	// a default has the type of the column, or is null for a nullable one
+	for i := range tdef.Defaults {
+		def := colDefault(tdef, i)
+		if def == nil {
+			continue
+		}
+		if slices.Contains(tdef.Indexes[0], tdef.Cols[i]) {
+			return fmt.Errorf("primary key column cannot have a default: %s", tdef.Cols[i])
+		}
+		if err := checkValue(tdef, i, *def); err != nil {
+			return fmt.Errorf("bad default: %w", err)
+		}
+		if err := checkMaxLen(tdef, tdef.Cols[i:i+1], []Value{*def}); err != nil {
+			return fmt.Errorf("bad default: %w", err)
+		}
+	}
+
+	if tdef.AutoInc {
+		idx := slices.Index(tdef.Cols, tdef.Indexes[0][0])
+		if tdef.Types[idx] != TYPE_INT64 {
+			return fmt.Errorf("auto-increment column is not INT64: %s", tdef.Cols[idx])
+		}
+	}
+
+	return nil
+}
+
+// the largest encoded key of an index, if every column has a limit: the
+// prefix, then a tag per value, with each byte of a string escaped and a
+// terminator. a custom collation can change the length of a string.
+func indexKeyMax(tdef *TableDef, index int) (int, bool) {
+	if isComputed(tdef, index) {
+		return 0, false // the size of the value is not known
+	}
+	size := 4
+	for i, c := range tdef.Indexes[index] {
+		col := slices.Index(tdef.Cols, c)
+		size++
+		switch tdef.Types[col] {
+		case TYPE_INT64, TYPE_TIMESTAMP, TYPE_FLOAT64:
+			size += 8
+		case TYPE_BOOL:
+			size += 1
+		case TYPE_BYTES:
+			n := colMaxLen(tdef, col)
+			if n == 0 || collation(tdef, index, i) >= COLLATE_CUSTOM {
+				return 0, false
+			}
+			size += 2*n + 1
+		default:
+			return 0, false
+		}
+	}
+	return size, true
+}
+
+func checkIndexCols(tdef *TableDef, index []string) ([]string, error) {
+	if len(index) == 0 {
+		return nil, fmt.Errorf("empty index")
+	}
+
+	seen := map[string]bool{}
+	for _, c := range index {
+		// check index cols
+		if slices.Index(tdef.Cols, c) < 0 {
+			return nil, fmt.Errorf("unknown index column: %s", c)
+		}
+		if seen[c] {
+			return nil, fmt.Errorf("duplicated column index: %s", c)
+		}
+
+		seen[c] = true
+	}
+
+	// addin primary key to index
+	for _, c := range tdef.Indexes[0] {
+		if !seen[c] {
+			index = append(index, c)
 		}
 	}
 	assert(len(index) <= len(tdef.Cols))
@@ -381,81 +1105,395 @@ func (tx *DBTX) TableNew(tdef *TableDef) error {
 		return err
 	}
 
-	// check existing table
+	if len(tdef.Prefixes) != 0 {
+		return fmt.Errorf("prefixes are allocated by TableNew: %s", tdef.Name)
+	}
+	if len(tdef.Building) != 0 {
+		return fmt.Errorf("indexes are built by CreateIndex: %s", tdef.Name)
+	}
+	if err := fkeyCheck(tx, tdef); err != nil {
+		return err
+	}
+
+	// check existing table. both writes below are in this transaction,
+	// so they are committed together, and the reads make a concurrent
+	// TableNew fail with a conflict instead of reusing the prefix.
 	table := (&Record{}).AddStr("name", []byte(tdef.Name))
 	ok, err := dbGet(tx, TDEF_TABLE, table)
-	assert(err == nil)
+	if err != nil {
+		return err
+	}
 	if ok {
-		return fmt.Errorf("table exists: %s", tdef.Name)
+		return fmt.Errorf("%w: %s", ErrTableExists, tdef.Name)
 	}
 
-	// alllocating new prefixes
-	prefix := uint32(TABLE_PREFIX_MIN)
-	meta := (&Record{}).AddStr("key", []byte("next_prefix"))
-	ok, err = dbGet(tx, TDEF_META, meta)
-	assert(err == nil)
-	if ok {
-		prefix = binary.LittleEndian.Uint32(meta.Get("val").Str)
-		assert(prefix > TABLE_PREFIX_MIN)
-	} else {
-		meta.AddStr("val", make([]byte, 4))
+	// alllocating new prefixes; see table_prefix.go
+	prefix, err := prefixAlloc(tx, uint32(len(tdef.Indexes)))
+	if err != nil {
+		return err
 	}
-	assert(len(tdef.Prefixes) == 0)
+	prefixes := []uint32{}
 	for i := range tdef.Indexes {
-		tdef.Prefixes = append(tdef.Prefixes, prefix+uint32(i))
+		prefixes = append(prefixes, prefix+uint32(i))
 	}
 
-	// updatin next prefix
-	next := prefix + uint32(len(tdef.Prefixes))
-	binary.LittleEndian.PutUint32(meta.Get("val").Str, next)
-	_, err = dbUpdate(tx, TDEF_META, &DBUpdateReq{Record: *meta})
+	// storin schema
+	if err := schemaChanged(tx); err != nil {
+		return err
+	}
+	ndef := *tdef
+	ndef.Prefixes = prefixes
+	val, err := json.Marshal(&ndef)
 	if err != nil {
 		return err
 	}
-
-	// storin schema
-	val, err := json.Marshal(tdef)
-	assert(err == nil)
 	table.AddStr("def", val)
 	_, err = dbUpdate(tx, TDEF_TABLE, &DBUpdateReq{Record: *table})
+	if err != nil {
+		return err
+	}
+	// the row counters start here
+	stats := (&Record{}).AddInt64("prefix", int64(prefixes[0])).
+		AddInt64("rows", 0).AddInt64("bytes", 0)
+	_, err = dbUpdate(tx, TDEF_STATS, &DBUpdateReq{Record: *stats})
+	if err != nil {
+		return err
+	}
 
-	return err
+	// the caller's definition gets the prefixes only on success
+	tdef.Prefixes = prefixes
+	return nil
+}
+
+// delete a table with all of its rows and indexes
+func (tx *DBTX) TableDrop(name string) (err error) {
+	if _, ok := INTERNAL_TABLES[name]; ok {
+		return fmt.Errorf("cannot drop internal table: %s", name)
+	}
+	tdef, err := getTableDef(tx, name)
+	if err != nil {
+		return err
+	}
+	if err := tableReferenced(tx, name); err != nil {
+		return err
+	}
+
+	// the prefixes are reused after the commit. the keys are deleted
+	// blindly; the scan makes a concurrent writer conflict.
+	defer checksumRecover(&err)
+	for _, prefix := range tdef.Prefixes {
+		start := encodeKey(nil, prefix, nil)
+		end := encodeKey(nil, prefix+1, nil)
+		keys := [][]byte(nil)
+		iter := tx.kv.Seek(start, btree_iter.CMP_GE, end, btree_iter.CMP_LT)
+		for ; iter.Valid(); iter.Next() {
+			key, _ := iter.Deref()
+			keys = append(keys, key)
+		}
+		for _, key := range keys {
+			if _, err := tx.kv.Del(&DeleteReq{Key: key}); err != nil {
+				return err
+			}
+		}
+	}
+
+	// remove the schema
+	table := (&Record{}).AddStr("name", []byte(name))
+	if _, err := dbDelete(tx, TDEF_TABLE, *table); err != nil {
+		return err
+	}
+	meta := (&Record{}).AddStr("key", autoIncKey(name))
+	if _, err := dbDelete(tx, TDEF_META, *meta); err != nil {
+		return err
+	}
+	for _, prefix := range tdef.Prefixes {
+		for _, key := range [][]byte{indexBuildKey(prefix), indexStatsKey(prefix)} {
+			meta := (&Record{}).AddStr("key", key)
+			if _, err := dbDelete(tx, TDEF_META, *meta); err != nil {
+				return err
+			}
+		}
+	}
+	stats := (&Record{}).AddInt64("prefix", int64(tdef.Prefixes[0]))
+	if _, err := dbDelete(tx, TDEF_STATS, *stats); err != nil {
+		return err
+	}
+	// the prefix is reused, so the changes must not outlive the table
+	if err := changesDrop(tx, tdef); err != nil {
+		return err
+	}
+	for _, prefix := range tdef.Prefixes {
+		if err := prefixFree(tx, prefix, 1); err != nil {
+			return err
+		}
+	}
+	return schemaChanged(tx)
+}
+
+// rename a table. rows are keyed by prefixes, so only the schema moves.
+func (tx *DBTX) TableRename(from string, to string) error {
+	for _, name := range []string{from, to} {
+		if _, ok := INTERNAL_TABLES[name]; ok {
+			return fmt.Errorf("cannot rename internal table: %s", name)
+		}
+	}
+	tdef, err := getTableDef(tx, from)
+	if err != nil {
+		return err
+	}
+	if to == "" {
+		return fmt.Errorf("bad table name: %s", to)
+	}
+	if err := tableReferenced(tx, from); err != nil {
+		return err
+	}
+	if _, err := getTableDef(tx, to); err == nil {
+		return fmt.Errorf("%w: %s", ErrTableExists, to)
+	} else if !errors.Is(err, ErrTableNotFound) {
+		return err
+	}
+
+	ndef := *tdef
+	ndef.Name = to
+	val, err := json.Marshal(&ndef)
+	if err != nil {
+		return err
+	}
+
+	// both changes are committed together by the transaction
+	table := (&Record{}).AddStr("name", []byte(from))
+	if _, err := dbDelete(tx, TDEF_TABLE, *table); err != nil {
+		return err
+	}
+	table = (&Record{}).AddStr("name", []byte(to)).AddStr("def", val)
+	req := DBUpdateReq{Record: *table, Mode: btree.MODE_INSERT_ONLY}
+	if _, err := dbUpdate(tx, TDEF_TABLE, &req); err != nil {
+		return err
+	}
+
+	// the auto-increment counter is keyed by name
+	meta := (&Record{}).AddStr("key", autoIncKey(from))
+	ok, err := dbGet(tx, TDEF_META, meta)
+	if err != nil {
+		return err
+	}
+	if ok {
+		if _, err := dbDelete(tx, TDEF_META, *meta); err != nil {
+			return err
+		}
+		meta.Get("key").Str = autoIncKey(to)
+		if _, err := dbUpdate(tx, TDEF_META, &DBUpdateReq{Record: *meta}); err != nil {
+			return err
+		}
+	}
+	return schemaChanged(tx)
+}
+
+// append a column to a table. existing rows are not rewritten;
+// they read the default value until they are updated. a null default
+// makes the column nullable.
+func (tx *DBTX) TableAddColumn(table string, col string, typ uint32, def Value) error {
+	if _, ok := INTERNAL_TABLES[table]; ok {
+		return fmt.Errorf("cannot alter internal table: %s", table)
+	}
+	tdef, err := getTableDef(tx, table)
+	if err != nil {
+		return err
+	}
+	if col == "" || slices.Index(tdef.Cols, col) >= 0 {
+		return fmt.Errorf("bad column: %s", col)
+	}
+	if _, ok := typeNames[typ]; !ok || typ == TYPE_NULL {
+		return &ErrBadColumnType{Col: col}
+	}
+	if def.Type != typ && def.Type != TYPE_NULL {
+		return &ErrBadColumnType{Col: col}
+	}
+
+	// the cached schema is shared, so modify a copy
+	ndef := *tdef
+	ndef.Cols = append(slices.Clone(tdef.Cols), col)
+	ndef.Types = append(slices.Clone(tdef.Types), typ)
+	ndef.Defaults = make([]Value, len(ndef.Cols))
+	copy(ndef.Defaults, tdef.Defaults)
+	ndef.Defaults[len(ndef.Cols)-1] = def
+	if def.Type == TYPE_NULL {
+		ndef.Nullable = make([]bool, len(ndef.Cols))
+		copy(ndef.Nullable, tdef.Nullable)
+		ndef.Nullable[len(ndef.Cols)-1] = true
+	}
+	// such as a NaN or a bad JSON document
+	if err := checkValue(&ndef, len(ndef.Cols)-1, def); err != nil {
+		return err
+	}
+
+	val, err := json.Marshal(&ndef)
+	if err != nil {
+		return err
+	}
+	rec := (&Record{}).AddStr("name", []byte(table)).AddStr("def", val)
+	req := DBUpdateReq{Record: *rec, Mode: btree.MODE_UPDATE_ONLY}
+	if _, err := dbUpdate(tx, TDEF_TABLE, &req); err != nil {
+		return err
+	}
+	return schemaChanged(tx)
 }
 
-// get table schema by naem
-func getTableDef(tx *DBTX, name string) *TableDef {
+// get table schema by naem; ErrTableNotFound if there is none
+func getTableDef(tx *DBTX, name string) (*TableDef, error) {
 	if tdef, ok := INTERNAL_TABLES[name]; ok {
-		return tdef // expose internal tables
+		return tdef, nil // expose internal tables
+	}
+	if tx.schema {
+		return getTableDefDB(tx, name) // uncommitted
+	}
+	// the cache is shared by concurrent transactions; see table_schema.go
+	gen, err := schemaGen(tx)
+	if err != nil {
+		return nil, err
 	}
-	tdef := tx.db.tables[name]
+	tx.db.mu.Lock()
+	tdef := (*TableDef)(nil)
+	if schemaCacheSync(tx.db, gen) {
+		tdef = tx.db.tables[name]
+	}
+	tx.db.mu.Unlock()
 	if tdef == nil {
-		if tdef = getTableDefDB(tx, name); tdef != nil {
+		tdef, err := getTableDefDB(tx, name)
+		if err != nil {
+			return nil, err
+		}
+		tx.db.mu.Lock()
+		if schemaCacheSync(tx.db, gen) {
 			tx.db.tables[name] = tdef
 		}
+		tx.db.mu.Unlock()
+		return tdef, nil
 	}
-	return tdef
+	// still read, so that a writer conflicts with a concurrent drop
+	// instead of writing to the prefixes after they are reused
+	tx.kv.Get(encodeKey(nil, TDEF_TABLE.Prefixes[0],
+		[]Value{{Type: TYPE_BYTES, Str: []byte(name)}}))
+	return tdef, nil
 }
 
-func getTableDefDB(tx *DBTX, name string) *TableDef {
+// a schema row that doesn't decode is ErrCorrupt, not a missing table
+func getTableDefDB(tx *DBTX, name string) (*TableDef, error) {
 	rec := (&Record{}).AddStr("name", []byte(name))
 	ok, err := dbGet(tx, TDEF_TABLE, rec)
-	assert(err == nil)
+	if err != nil {
+		return nil, err
+	}
 	if !ok {
-		return nil
+		return nil, errTableNotFound(name)
+	}
+
+	tdef, err := tableDefDecode(rec.Get("def").Str)
+	if err != nil {
+		return nil, errCorrupt("table %s: bad schema: %v", name, err)
+	}
+	if err := tableDefCheck(tdef); err != nil {
+		return nil, errCorrupt("table %s: bad schema: %v", name, err)
+	}
+	if len(tdef.Prefixes) != len(tdef.Indexes) {
+		return nil, errCorrupt("table %s: bad schema: prefixes", name)
 	}
+	return tdef, nil
+}
 
+// a schema row of @table. the first versions stored one prefix and the
+// primary key as the first `PKeys` columns, without secondary indexes;
+// they are read as Indexes[0] and Prefixes[0], and are written in the
+// current shape by the next schema change.
+func tableDefDecode(val []byte) (*TableDef, error) {
 	tdef := &TableDef{}
-	err = json.Unmarshal(rec.Get("def").Str, tdef)
-	assert(err == nil)
+	if err := json.Unmarshal(val, tdef); err != nil {
+		return nil, err
+	}
+	legacy := struct {
+		Prefix uint32
+		PKeys  int
+	}{}
+	if tdef.Indexes != nil || json.Unmarshal(val, &legacy) != nil || legacy.PKeys == 0 {
+		return tdef, nil
+	}
+	if legacy.PKeys < 0 || legacy.PKeys > len(tdef.Cols) {
+		return nil, fmt.Errorf("bad PKeys: %d", legacy.PKeys)
+	}
+	tdef.Indexes = [][]string{slices.Clone(tdef.Cols[:legacy.PKeys])}
+	tdef.Prefixes = []uint32{legacy.Prefix}
+	return tdef, nil
+}
+
+// names of the user tables in sorted order
+func (tx *DBTX) ListTables() ([]string, error) {
+	sc := Scanner{Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE}
+	if err := dbScan(tx, TDEF_TABLE, &sc); err != nil {
+		return nil, err
+	}
+	defer sc.Close()
+
+	names := []string{}
+	for ; sc.Valid(); sc.Next() {
+		rec := Record{}
+		if err := sc.Deref(&rec); err != nil {
+			return nil, err
+		}
+		names = append(names, string(rec.Get("name").Str))
+	}
+	return names, sc.Err()
+}
+
+// names of the internal tables, which are not stored in @table
+func (tx *DBTX) ListInternalTables() []string {
+	names := []string{}
+	for name := range INTERNAL_TABLES {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// a copy of the table schema that is safe to modify
+func (tx *DBTX) GetTableDef(name string) (*TableDef, error) {
+	tdef, err := getTableDef(tx, name)
+	if err != nil {
+		return nil, err
+	}
 
-	return tdef
+	// copy through JSON like the stored schema
+	val, err := json.Marshal(tdef)
+	assert(err == nil)
+	out := &TableDef{}
+	err = json.Unmarshal(val, out)
+	assert(err == nil)
+	return out, nil
 }
 
 type DBUpdateReq struct {
-	Record  Record
-	Mode    int
+	Record Record
+	Mode   int
+	// update only the supplied columns of an existing row,
+	// which is selected by the primary key
+	Partial bool
+	// write only if the current row holds these values
+	Expected Record
+	// take the columns of the write times from the record; see table_times.go
+	KeepTimes bool
+	// take the version column from the record, if it has it; see
+	// table_version.go
+	KeepVersion bool
+	// return the row before the write in Old. it's read by the write
+	// itself; Old is empty if there was no row.
+	WantOld bool
+	Old     Record
 	Updated bool
 	Added   bool
+	// the row as it's written, with the columns filled in by the engine,
+	// such as an auto-increment id, the defaults and the write times, and
+	// its encoded primary key. set also when the row doesn't change.
+	Row Record
+	Key []byte
 }
 
 func nonPrimaryKeyCols(tdef *TableDef) (out []string) {
@@ -472,136 +1510,912 @@ const (
 	INDEX_DEL = 2
 )
 
-// ADD OR REMOVE SECONDARY INDEX KEYS
-func indexOP(tx *DBTX, tdef *TableDef, op int, rec Record) error {
+// encoded secondary index keys of a row, indexed by the index number.
+func indexKeys(db *DB, tdef *TableDef, rec Record) ([][]byte, error) {
+	keys := make([][]byte, len(tdef.Indexes))
 	for i := 1; i < len(tdef.Indexes); i++ {
-		vals, err := getValues(tdef, rec, tdef.Indexes[i])
-		assert(err == nil)
-		key := encodeKey(nil, tdef.Prefixes[i], vals)
+		vals, err := indexValues(db, tdef, i, rec)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = indexKey(nil, tdef, i, vals)
+	}
+	return keys, nil
+}
+
+var ErrUniqueViolation = errors.New("unique constraint violation")
+
+func isUnique(tdef *TableDef, idx int) bool {
+	return idx < len(tdef.Unique) && tdef.Unique[idx]
+}
+
+// the columns of a unique index that must not repeat. these are the
+// index columns without the primary key columns appended to them, or the
+// arguments of a computed index.
+func uniqueCols(tdef *TableDef, idx int) []string {
+	index := tdef.Indexes[idx]
+	if isComputed(tdef, idx) {
+		return index[:tdef.Computed[idx].Args]
+	}
+	n := len(index)
+	for n > 0 && slices.Contains(tdef.Indexes[0], index[n-1]) {
+		n--
+	}
+	return index[:n]
+}
+
+// the leading values of the keys of a unique index for uniqueCols
+func uniqueLen(tdef *TableDef, idx int) int {
+	if isComputed(tdef, idx) {
+		return 1 // the value of the function
+	}
+	return len(uniqueCols(tdef, idx))
+}
+
+// the values of an index key that must be unique. a null of a computed
+// index collides with nothing, so it's the whole key.
+func uniqueVals(tdef *TableDef, idx int, vals []Value) []Value {
+	if isComputed(tdef, idx) && vals[0].Type == TYPE_NULL {
+		return vals
+	}
+	return vals[:uniqueLen(tdef, idx)]
+}
 
-		switch op {
-		case INDEX_ADD:
-			req := UpdateReq{Key: key, Val: nil}
-			if _, err := tx.kv.Update(&req); err != nil {
+// reject a row whose unique index columns collide with another row
+func checkUnique(tx *DBTX, tdef *TableDef, rec Record) (err error) {
+	defer checksumRecover(&err)
+	keys, err := indexKeys(tx.db, tdef, rec)
+	if err != nil {
+		return err
+	}
+	for i := 1; i < len(tdef.Indexes); i++ {
+		cols := uniqueCols(tdef, i)
+		if !isUnique(tdef, i) || len(cols) == 0 {
+			continue
+		}
+		vals, err := indexValues(tx.db, tdef, i, rec)
+		if err != nil {
+			return err
+		}
+		vals = uniqueVals(tdef, i, vals)
+		// any key with the same leading columns, except the row itself
+		start := indexKey(nil, tdef, i, vals)
+		end := indexKeyPartial(nil, tdef, i, vals, btree_iter.CMP_LE)
+		iter := tx.kv.Seek(start, btree_iter.CMP_GE, end, btree_iter.CMP_LE)
+		expired := []Record{}
+		for ; iter.Valid(); iter.Next() {
+			key, _ := iter.Deref()
+			if bytes.Equal(key, keys[i]) {
+				continue
+			}
+			// an expired row gives way
+			rec, err := ttlIndexKey(tx, tdef, i, key)
+			if err != nil {
+				return err
+			}
+			if rec == nil {
+				return fmt.Errorf("%w: table %s, index %v",
+					ErrUniqueViolation, tdef.Name, cols)
+			}
+			expired = append(expired, *rec)
+		}
+		for _, rec := range expired {
+			if _, err := dbDeleteRow(tx, tdef, rec, nil); err != nil {
 				return err
 			}
-			assert(req.Added) // internal consistency
-		case INDEX_DEL:
-			deleted, err := tx.kv.Del(&DeleteReq{Key: key})
-			assert(err == nil)
-			assert(deleted)
-		default:
-			panic("unreachable")
 		}
+	}
+	return nil
+}
+
+// ADD OR REMOVE A SECONDARY INDEX KEY
+func indexKeyOP(tx *DBTX, op int, key []byte) error {
+	switch op {
+	case INDEX_ADD:
+		req := UpdateReq{Key: key, Val: nil}
+		if _, err := tx.kv.Update(&req); err != nil {
+			return err
+		}
+		if !req.Added {
+			return errCorrupt("index key exists: %x", key)
+		}
+	case INDEX_DEL:
+		deleted, err := tx.kv.Del(&DeleteReq{Key: key})
 		if err != nil {
 			return err
 		}
+		if !deleted {
+			return errCorrupt("index key not found: %x", key)
+		}
+	default:
+		panic("unreachable")
 	}
-
 	return nil
 }
 
-// add row to table
-func dbUpdate(tx *DBTX, tdef *TableDef, dbreq *DBUpdateReq) (bool, error) {
-	cols := slices.Concat(tdef.Indexes[0], nonPrimaryKeyCols(tdef))
-	values, err := getValues(tdef, dbreq.Record, cols)
-	if err != nil {
-		return false, err
+// indexKeyOP on index `idx`. the key of an index being built may be
+// missing or present before the row is backfilled; see table_index.go
+func indexKeyOPAt(tx *DBTX, tdef *TableDef, idx int, op int, key []byte) (err error) {
+	if !isBuilding(tdef, idx) {
+		return indexKeyOP(tx, op, key)
 	}
-
+	if op == INDEX_ADD {
+		_, err = tx.kv.Update(&UpdateReq{Key: key, Val: nil})
+	} else {
+		_, err = tx.kv.Del(&DeleteReq{Key: key})
+	}
+	return err
+}
+
+// ADD OR REMOVE SECONDARY INDEX KEYS
+func indexOP(tx *DBTX, tdef *TableDef, op int, rec Record) error {
+	keys, err := indexKeys(tx.db, tdef, rec)
+	if err != nil {
+		return err
+	}
+	for i := 1; i < len(keys); i++ {
+		if err := indexKeyOPAt(tx, tdef, i, op, keys[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// move secondary index keys from the old row to the new row.
+// indexes whose keys didn't change are left alone.
+func indexUpdate(tx *DBTX, tdef *TableDef, oldRec Record, newRec Record) error {
+	oldKeys, err := indexKeys(tx.db, tdef, oldRec)
+	if err != nil {
+		return err
+	}
+	newKeys, err := indexKeys(tx.db, tdef, newRec)
+	if err != nil {
+		return err
+	}
+	for i := 1; i < len(tdef.Indexes); i++ {
+		if bytes.Equal(oldKeys[i], newKeys[i]) {
+			continue
+		}
+		if err := indexKeyOPAt(tx, tdef, i, INDEX_DEL, oldKeys[i]); err != nil {
+			return err
+		}
+		if err := indexKeyOPAt(tx, tdef, i, INDEX_ADD, newKeys[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add row to table
+func dbUpdate(tx *DBTX, tdef *TableDef, dbreq *DBUpdateReq) (bool, error) {
+	// a failed index update must not leave the row written
+	save := transactions.TXSave{}
+	tx.Save(&save)
+	updated, err := dbUpdateRow(tx, tdef, dbreq)
+	if err != nil {
+		tx.Revert(&save)
+		dbreq.Added, dbreq.Updated = false, false
+		// a write refused by its mode keeps the row and the old one
+		if !errors.Is(err, ErrRecordExists) && !errors.Is(err, ErrRecordNotFound) {
+			dbreq.Row, dbreq.Key = Record{}, nil
+		}
+	}
+	return updated, err
+}
+
+// the existing row with the supplied columns replaced
+func mergeRow(tx *DBTX, tdef *TableDef, rec Record) (Record, error) {
+	if len(rec.Cols) != len(rec.Vals) {
+		return Record{}, fmt.Errorf("bad record")
+	}
+	pk, err := getValues(tdef, rec, tdef.Indexes[0])
+	if err != nil {
+		return Record{}, err
+	}
+	row := Record{tdef.Indexes[0], pk}
+	ok, err := dbGet(tx, tdef, &row)
+	if err != nil {
+		return Record{}, err
+	}
+	if !ok {
+		return Record{}, fmt.Errorf("%w: %s", ErrRecordNotFound, tdef.Name)
+	}
+
+	for i, c := range rec.Cols {
+		if slices.Index(tdef.Indexes[0], c) >= 0 {
+			continue // the primary key selects the row
+		}
+		idx := slices.Index(tdef.Cols, c)
+		if idx < 0 {
+			return Record{}, fmt.Errorf("unknown column: %s", c)
+		}
+		if err := checkValue(tdef, idx, rec.Vals[i]); err != nil {
+			return Record{}, err
+		}
+		*row.Get(c) = rec.Vals[i]
+	}
+	return row, nil
+}
+
+var ErrConflict = errors.New("row doesn't hold the expected values")
+
+// returned by conditional updates; `Current` is empty if the row doesn't exist
+type ConflictError struct {
+	Current Record
+}
+
+func (e *ConflictError) Error() string {
+	return ErrConflict.Error()
+}
+
+func (e *ConflictError) Unwrap() error {
+	return ErrConflict
+}
+
+// compare the expected columns with the current row
+func checkExpected(tx *DBTX, tdef *TableDef, rec Record, expected Record) error {
+	if len(expected.Cols) != len(expected.Vals) {
+		return fmt.Errorf("bad record")
+	}
+	for _, c := range expected.Cols {
+		if slices.Index(tdef.Cols, c) < 0 {
+			return fmt.Errorf("unknown column: %s", c)
+		}
+	}
+
+	pk, err := getValues(tdef, rec, tdef.Indexes[0])
+	if err != nil {
+		return err
+	}
+	cur := Record{tdef.Indexes[0], pk}
+	ok, err := dbGet(tx, tdef, &cur)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return &ConflictError{}
+	}
+	for i, c := range expected.Cols {
+		if !cur.Get(c).Equal(&expected.Vals[i]) {
+			return &ConflictError{Current: cur}
+		}
+	}
+	return nil
+}
+
+func dbUpdateRow(tx *DBTX, tdef *TableDef, dbreq *DBUpdateReq) (bool, error) {
+	rec, mode := dbreq.Record, dbreq.Mode
+	if err := checkDupCols(rec); err != nil {
+		return false, err
+	}
+	if len(dbreq.Expected.Cols) > 0 {
+		if err := checkExpected(tx, tdef, rec, dbreq.Expected); err != nil {
+			return false, err
+		}
+	}
+	version, checkVersion := versionExpected(tdef, rec)
+	keepVersion := dbreq.KeepVersion && checkVersion
+	if dbreq.Partial {
+		var err error
+		if rec, err = mergeRow(tx, tdef, rec); err != nil {
+			return false, err
+		}
+		mode = btree.MODE_UPDATE_ONLY
+	}
+	if !dbreq.KeepTimes {
+		rec = timesFill(tx, tdef, rec)
+	}
+	if !keepVersion {
+		rec = versionFill(tdef, rec)
+	}
+
+	cols := slices.Concat(tdef.Indexes[0], nonPrimaryKeyCols(tdef))
+	values, err := getValues(tdef, rec, cols)
+	if err != nil {
+		return false, err
+	}
+	if err := checkMaxLen(tdef, cols, values); err != nil {
+		return false, err
+	}
+	// an expired row is replaced as if it was missing
+	if err := ttlPurge(tx, tdef, values[:len(tdef.Indexes[0])]); err != nil {
+		return false, err
+	}
+	if !dbreq.KeepTimes {
+		if err := timesKeep(tx, tdef, Record{cols, values}); err != nil {
+			return false, err
+		}
+	}
+	if !keepVersion {
+		err := versionNext(tx, tdef, Record{cols, values}, version, checkVersion)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	// the merged row, before anything is written
+	if err := checkConstraints(tx.db, tdef, Record{cols, values}); err != nil {
+		return false, err
+	}
+	if err := fkeyParents(tx, tdef, Record{cols, values}); err != nil {
+		return false, err
+	}
+	// unique indexes are checked before anything is written
+	if err := checkUnique(tx, tdef, Record{cols, values}); err != nil {
+		return false, err
+	}
+
 	// insert row
 	np := len(tdef.Indexes[0])
 	key := encodeKey(nil, tdef.Prefixes[0], values[:np])
-	val := encodeValues(nil, values[np:])
-	req := UpdateReq{Key: key, Val: val, Mode: dbreq.Mode}
+	val := encodeRow(nil, values[np:])
+	req := UpdateReq{Key: key, Val: val, Mode: mode}
 	if _, err := tx.kv.Update(&req); err != nil {
 		return false, err
 	}
 
-	dbreq.Added, dbreq.Updated = req.Added, req.Updated
-
-	// maintain secondary indexes
-	if req.Updated && !req.Added {
-		decodeValues(req.Old, values[np:])
-		oldRec := Record{cols, values}
-		// delete indexed keys
-		err := indexOP(tx, tdef, INDEX_DEL, oldRec)
-		assert(err == nil)
+	dbreq.Added, dbreq.Updated = req.Added, req.Updated
+	dbreq.Row, dbreq.Key = Record{cols, slices.Clone(values)}, key
+
+	// the old row, for the indexes and for WantOld
+	oldRec := Record{}
+	if req.Old != nil && (req.Updated || dbreq.WantOld) {
+		// decoded with the column types; a nullable value may be null in one of them
+		oldRec = Record{cols, slices.Clone(values)}
+		for i, c := range cols[np:] {
+			oldRec.Vals[np+i] = Value{Type: tdef.Types[slices.Index(tdef.Cols, c)]}
+		}
+		err := decodeRow(tdef, req.Old, oldRec.Vals[np:], nil, nil)
+		if err != nil {
+			return false, rowCorrupt(tdef, key, err)
+		}
+	}
+	if dbreq.WantOld {
+		dbreq.Old = oldRec
+	}
+	// refused by the mode; the old value is nil if there's no row
+	switch {
+	case mode == btree.MODE_INSERT_ONLY && req.Old != nil:
+		return false, fmt.Errorf("%w: %s", ErrRecordExists, tdef.Name)
+	case mode == btree.MODE_UPDATE_ONLY && req.Old == nil:
+		return false, fmt.Errorf("%w: %s", ErrRecordNotFound, tdef.Name)
+	}
+
+	// maintain secondary indexes, the counters and the change log
+	newRec := Record{cols, values}
+	switch {
+	case req.Added:
+		err = indexOP(tx, tdef, INDEX_ADD, newRec)
+		if err == nil {
+			err = statsAdd(tx, tdef, 1, int64(len(key)+len(val)))
+		}
+		if err == nil {
+			err = changeAdd(tx, tdef, CHANGE_ADD, key, val)
+		}
+	case req.Updated:
+		err = indexUpdate(tx, tdef, oldRec, newRec)
+		if err == nil {
+			err = statsAdd(tx, tdef, 0, int64(len(val)-len(req.Old)))
+		}
+		if err == nil {
+			err = changeAdd(tx, tdef, CHANGE_UPDATE, key, val)
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return req.Updated, nil
+}
+
+// addin a record
+func (tx *DBTX) Set(table string, dbreq *DBUpdateReq) (bool, error) {
+	tdef, err := getTableDef(tx, table)
+	if err != nil {
+		return false, err
+	}
+
+	if err := autoIncrement(tx, tdef, dbreq); err != nil {
+		return false, err
+	}
+	return dbUpdate(tx, tdef, dbreq)
+}
+
+// @meta key of the auto-increment counter
+func autoIncKey(table string) []byte {
+	return []byte("autoinc:" + table)
+}
+
+// the counter is a little-endian uint64
+func autoIncDecode(table string, val []byte) (int64, error) {
+	if len(val) != 8 {
+		return 0, errCorrupt("table %s: bad auto-increment counter", table)
+	}
+	return int64(binary.LittleEndian.Uint64(val)), nil
+}
+
+// fill in the missing first primary key column of an auto-increment table,
+// or move the counter past an explicit value. the counter is updated before
+// the row, gaps are left by failed inserts.
+func autoIncrement(tx *DBTX, tdef *TableDef, dbreq *DBUpdateReq) error {
+	if !tdef.AutoInc || dbreq.Partial || dbreq.Mode == btree.MODE_UPDATE_ONLY {
+		return nil
+	}
+
+	meta := (&Record{}).AddStr("key", autoIncKey(tdef.Name))
+	ok, err := dbGet(tx, TDEF_META, meta)
+	if err != nil {
+		return err
+	}
+	next := int64(1)
+	if ok {
+		if next, err = autoIncDecode(tdef.Name, meta.Get("val").Str); err != nil {
+			return err
+		}
+	}
+
+	col := tdef.Indexes[0][0]
+	rec := &dbreq.Record
+	switch v := rec.Get(col); {
+	case v == nil:
+		// don't append to the caller's slices
+		rec.Cols = append(slices.Clip(rec.Cols), col)
+		rec.Vals = append(slices.Clip(rec.Vals), Value{Type: TYPE_INT64, I64: next})
+		next++
+	case v.Type == TYPE_INT64 && v.I64 >= next:
+		next = v.I64 + 1
+	default:
+		return nil
+	}
+
+	val := make([]byte, 8) // the decoded value may point to the tree
+	binary.LittleEndian.PutUint64(val, uint64(next))
+	meta = (&Record{}).AddStr("key", autoIncKey(tdef.Name)).AddStr("val", val)
+	_, err = dbUpdate(tx, TDEF_META, &DBUpdateReq{Record: *meta})
+	return err
+}
+
+// the record gets the generated id of an auto-increment table
+func (tx *DBTX) Insert(table string, rec *Record) (bool, error) {
+	dbreq := DBUpdateReq{Record: *rec, Mode: btree.MODE_INSERT_ONLY}
+	updated, err := tx.Set(table, &dbreq)
+	*rec = dbreq.Record
+	return updated, err
+}
+func (tx *DBTX) Update(table string, rec Record) (bool, error) {
+	return tx.Set(table, &DBUpdateReq{Record: rec, Mode: btree.MODE_UPDATE_ONLY})
+}
+func (tx *DBTX) Upsert(table string, rec Record) (bool, error) {
+	return tx.Set(table, &DBUpdateReq{Record: rec, Mode: btree.MODE_UPSERT})
+}
+
+// Update, and the row before it; empty if there is none
+func (tx *DBTX) UpdateWithOld(table string, rec Record) (Record, bool, error) {
+	dbreq := DBUpdateReq{Record: rec, Mode: btree.MODE_UPDATE_ONLY, WantOld: true}
+	updated, err := tx.Set(table, &dbreq)
+	return dbreq.Old, updated, err
+}
+
+// Upsert, and the row before it; empty if it's added
+func (tx *DBTX) UpsertWithOld(table string, rec Record) (Record, bool, error) {
+	dbreq := DBUpdateReq{Record: rec, Mode: btree.MODE_UPSERT, WantOld: true}
+	updated, err := tx.Set(table, &dbreq)
+	return dbreq.Old, updated, err
+}
+
+// add `delta` to an INT64 column and return the new value.
+// it fails instead of wrapping around on overflow.
+func (tx *DBTX) Increment(table string, key Record, col string, delta int64) (int64, error) {
+	tdef, err := getTableDef(tx, table)
+	if err != nil {
+		return 0, err
+	}
+	idx := slices.Index(tdef.Cols, col)
+	if idx < 0 {
+		return 0, fmt.Errorf("unknown column: %s", col)
+	}
+	if slices.Index(tdef.Indexes[0], col) >= 0 {
+		return 0, fmt.Errorf("cannot increment a primary key column: %s", col)
+	}
+	if tdef.Types[idx] != TYPE_INT64 {
+		return 0, &ErrBadColumnType{Col: col}
+	}
+
+	pk, err := getValues(tdef, key, tdef.Indexes[0])
+	if err != nil {
+		return 0, err
+	}
+	rec := Record{tdef.Indexes[0], pk}
+	ok, err := dbGet(tx, tdef, &rec)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", ErrRecordNotFound, table)
+	}
+
+	v := rec.Get(col)
+	if v.Type == TYPE_NULL {
+		return 0, fmt.Errorf("cannot increment null: %s", col)
+	}
+	sum := v.I64 + delta
+	if (delta > 0 && sum < v.I64) || (delta < 0 && sum > v.I64) {
+		return 0, fmt.Errorf("integer overflow: %s", col)
+	}
+	v.I64 = sum
+
+	dbreq := DBUpdateReq{Record: rec, Mode: btree.MODE_UPDATE_ONLY}
+	if _, err := dbUpdate(tx, tdef, &dbreq); err != nil {
+		return 0, err
+	}
+	return sum, nil
+}
+
+// insert many rows in primary key order. duplicates are skipped and
+// the number of added rows is returned. nothing is written if any
+// record is invalid, and all the invalid records are reported.
+func (tx *DBTX) InsertBatch(table string, recs []Record) (int, error) {
+	tdef, err := getTableDef(tx, table)
+	if err != nil {
+		return 0, err
+	}
+
+	// validate everything first
+	type row struct {
+		key []byte
+		rec Record
+	}
+	rows := make([]row, len(recs))
+	errs := []error{}
+	for i, rec := range recs {
+		check := rec
+		if tdef.AutoInc && rec.Get(tdef.Indexes[0][0]) == nil {
+			check.Cols = append(slices.Clip(rec.Cols), tdef.Indexes[0][0])
+			check.Vals = append(slices.Clip(rec.Vals), Value{Type: TYPE_INT64})
+		}
+		check = versionFill(tdef, check)
+		if _, err := checkRecord(tdef, check, len(tdef.Cols)); err != nil {
+			errs = append(errs, errRecord(err, i))
+		} else if err := checkConstraints(tx.db, tdef, check); err != nil {
+			errs = append(errs, errRecord(err, i))
+		}
+		rows[i].rec = rec
+	}
+	if len(errs) > 0 {
+		return 0, errors.Join(errs...)
+	}
+
+	save := transactions.TXSave{}
+	tx.Save(&save)
+	for i := range rows {
+		dbreq := DBUpdateReq{Record: rows[i].rec, Mode: btree.MODE_INSERT_ONLY}
+		if err := autoIncrement(tx, tdef, &dbreq); err != nil {
+			tx.Revert(&save)
+			return 0, err
+		}
+		rows[i].rec = dbreq.Record
+		pk, err := getValues(tdef, dbreq.Record, tdef.Indexes[0])
+		assert(err == nil)
+		rows[i].key = encodeKey(nil, tdef.Prefixes[0], pk)
+	}
+
+	// sorted keys touch neighboring leaves
+	slices.SortStableFunc(rows, func(a, b row) int {
+		return bytes.Compare(a.key, b.key)
+	})
+	added := 0
+	for _, r := range rows {
+		dbreq := DBUpdateReq{Record: r.rec, Mode: btree.MODE_INSERT_ONLY}
+		_, err := dbUpdate(tx, tdef, &dbreq)
+		if errors.Is(err, ErrRecordExists) {
+			continue // a duplicate
+		}
+		if err != nil {
+			tx.Revert(&save)
+			return 0, err
+		}
+		if dbreq.Added {
+			added++
+		}
+	}
+	return added, nil
+}
+
+// delete a record by primary key
+func dbDelete(tx *DBTX, tdef *TableDef, rec Record) (bool, error) {
+	return dbDeleteOld(tx, tdef, rec, nil)
+}
+
+// dbDelete that also returns the deleted row in `old`
+func dbDeleteOld(tx *DBTX, tdef *TableDef, rec Record, old *Record) (bool, error) {
+	// a row that doesn't decode must not be left deleted
+	save := transactions.TXSave{}
+	tx.Save(&save)
+	deleted, err := dbDeleteRow(tx, tdef, rec, old)
+	if err != nil {
+		tx.Revert(&save)
+	}
+	return deleted, err
+}
+
+// `old` gets the row if it's deleted; it can be nil
+func dbDeleteRow(tx *DBTX, tdef *TableDef, rec Record, old *Record) (bool, error) {
+	vals, err := getValues(tdef, rec, tdef.Indexes[0])
+	if err != nil {
+		return false, err
+	}
+
+	// delete row
+	req := DeleteReq{Key: encodeKey(nil, tdef.Prefixes[0], vals)}
+	deleted, err := tx.kv.Del(&req)
+	if err != nil || !deleted {
+		return false, err
+	}
+
+	for _, c := range nonPrimaryKeyCols(tdef) {
+		tp := tdef.Types[slices.Index(tdef.Cols, c)]
+		vals = append(vals, Value{Type: tp})
+	}
+
+	if err := decodeRow(tdef, req.Old, vals[len(tdef.Indexes[0]):], nil, nil); err != nil {
+		return false, rowCorrupt(tdef, req.Key, err)
+	}
+	cols := slices.Concat(tdef.Indexes[0], nonPrimaryKeyCols(tdef))
+	// an expired row was already gone
+	expired := rowExpired(tdef, &Record{cols, vals}, ttlNow(tx, tdef))
+	if expect, ok := versionExpected(tdef, rec); ok && !expired {
+		cur := versionOf((&Record{cols, vals}).Get(tdef.Version))
+		if cur != expect {
+			return false, &VersionError{Table: tdef.Name, Expected: expect, Current: cur}
+		}
+	}
+	if err := fkeyChildren(tx, tdef, vals[:len(tdef.Indexes[0])]); err != nil {
+		return false, err
+	}
+	if err = indexOP(tx, tdef, INDEX_DEL, Record{cols, vals}); err != nil {
+		return false, err
+	}
+	if err = statsAdd(tx, tdef, -1, -int64(len(req.Key)+len(req.Old))); err != nil {
+		return false, err
+	}
+	if err = changeAdd(tx, tdef, CHANGE_DEL, req.Key, nil); err != nil {
+		return false, err
+	}
+
+	if old != nil && !expired {
+		*old = Record{cols, vals}
+	}
+	return !expired, nil
+}
+
+func (tx *DBTX) Delete(table string, rec Record) (bool, error) {
+	tdef, err := getTableDef(tx, table)
+	if err != nil {
+		return false, err
+	}
+
+	return dbDelete(tx, tdef, rec)
+}
+
+// Delete that fills `rec` with the deleted row; it's left alone if there
+// is no row. the read is part of the delete.
+func (tx *DBTX) DeleteReturning(table string, rec *Record) (bool, error) {
+	tdef, err := getTableDef(tx, table)
+	if err != nil {
+		return false, err
+	}
+
+	old := Record{}
+	deleted, err := dbDeleteOld(tx, tdef, *rec, &old)
+	if deleted {
+		*rec = old
+	}
+	return deleted, err
+}
+
+// delete the rows in a primary key range, returns the number of rows deleted
+func (tx *DBTX) DeleteRange(table string, key1 Record, key2 Record, cmp1 int, cmp2 int) (int64, error) {
+	return tx.DeleteRangeCtx(context.Background(), table, key1, key2, cmp1, cmp2)
+}
+
+// DeleteRange that stops with ctx.Err(). the rows deleted before are
+// whole and stay deleted in the transaction; their number is returned.
+func (tx *DBTX) DeleteRangeCtx(ctx context.Context, table string, key1 Record, key2 Record, cmp1 int, cmp2 int) (int64, error) {
+	tdef, err := getTableDef(tx, table)
+	if err != nil {
+		return 0, err
+	}
+
+	sc := Scanner{Cmp1: cmp1, Cmp2: cmp2, Key1: key1, Key2: key2, Ctx: ctx}
+	if err := dbScan(tx, tdef, &sc); err != nil {
+		return 0, err
+	}
+	defer sc.Close()
+	if sc.index != 0 {
+		return 0, fmt.Errorf("%w: not a primary key range: %s", ErrBadRange, table)
+	}
+
+	// collect the keys first; deleting invalidates the iterator
+	np := len(tdef.Indexes[0])
+	keys := []Record{}
+	for ; sc.Valid(); sc.Next() {
+		key, _ := sc.iter.Deref()
+		vals := make([]Value, np)
+		for i, c := range tdef.Indexes[0] {
+			vals[i].Type = tdef.Types[slices.Index(tdef.Cols, c)]
+		}
+		if err := decodeKey(key, vals); err != nil {
+			return 0, rowCorrupt(tdef, key, err)
+		}
+		keys = append(keys, Record{tdef.Indexes[0], vals})
+	}
+	if err := sc.Err(); err != nil {
+		return 0, err
+	}
+
+	count := int64(0)
+	for i, key := range keys {
+		if i%SCAN_CTX_ROWS == SCAN_CTX_ROWS-1 && ctx.Err() != nil {
+			return count, ctx.Err()
+		}
+		deleted, err := dbDelete(tx, tdef, key)
+		if err != nil {
+			return count, err
+		}
+		if deleted {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// get many rows by primary key with one forward pass over the sorted keys
+// (KVTX.GetSorted). the records are filled in place; missing rows are
+// reported as false.
+func (tx *DBTX) MultiGet(table string, recs []*Record) (found []bool, err error) {
+	tdef, err := getTableDef(tx, table)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([][]byte, len(recs))
+	errs := []error{}
+	for i, rec := range recs {
+		vals, err := getValues(tdef, *rec, tdef.Indexes[0])
+		if err != nil {
+			errs = append(errs, errRecord(err, i))
+			continue
+		}
+		keys[i] = encodeKey(nil, tdef.Prefixes[0], vals)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	found = make([]bool, len(recs))
+	if len(recs) == 0 {
+		return found, nil
+	}
+
+	order := make([]int, len(recs))
+	for i := range order {
+		order[i] = i
 	}
+	slices.SortFunc(order, func(a, b int) int {
+		return bytes.Compare(keys[a], keys[b])
+	})
 
-	if req.Updated {
-		if err = indexOP(tx, tdef, INDEX_ADD, dbreq.Record); err != nil {
-			return false, err
+	defer checksumRecover(&err)
+	sorted := make([][]byte, len(order))
+	for j, i := range order {
+		sorted[j] = keys[i]
+	}
+	now := ttlNow(tx, tdef)
+	err = tx.kv.GetSorted(sorted, func(j int, key []byte, val []byte) error {
+		i := order[j]
+		if err := rowDecode(tdef, key, val, recs[i], nil, nil); err != nil {
+			return err
 		}
+		found[i] = !rowExpired(tdef, recs[i], now) // see table_ttl.go
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-
-	return req.Updated, nil
+	return found, nil
 }
 
-// addin a record
-func (tx *DBTX) Set(table string, dbreq *DBUpdateReq) (bool, error) {
-	tdef := getTableDef(tx, table)
-	if tdef == nil {
-		return false, fmt.Errorf("table not found: %s", table)
-	}
+func (db *DB) Open() error {
+	db.kv.Path = db.Path
+	db.kv.NoSync = db.NoSync
+	db.kv.Changes = db.Changes
+	db.kv.Key = db.Key
+	db.kv.Compression = db.Compression
+	db.kv.ReadOnly = db.ReadOnly
+	db.kv.LockTimeout = db.LockTimeout
+	db.kv.PageSize = db.PageSize
+	db.kv.CacheSize = db.CacheSize
+	db.kv.GuardFree = db.GuardFree
+	db.kv.InitialSize = db.InitialSize
+	db.kv.GrowChunk = db.GrowChunk
+	db.kv.GrowFactor = db.GrowFactor
+	db.kv.Fallocate = db.Fallocate
+	db.kv.Metrics = db.Metrics
+	db.kv.Logger = db.Logger
+	db.kv.SlowOp = db.SlowOp
+	db.kv.History = db.History
+	db.kv.Merge = statsMerge
+	schemaCacheDrop(db, 0)
 
-	return dbUpdate(tx, tdef, dbreq)
+	// opening kv store
+	return db.kv.Open()
 }
 
-func (tx *DBTX) Insert(table string, rec Record) (bool, error) {
-	return tx.Set(table, &DBUpdateReq{Record: rec, Mode: btree.MODE_INSERT_ONLY})
+func (db *DB) Close() {
+	watchCloseAll(db)
+	db.kv.Close()
 }
-func (tx *DBTX) Update(table string, rec Record) (bool, error) {
-	return tx.Set(table, &DBUpdateReq{Record: rec, Mode: btree.MODE_UPDATE_ONLY})
+
+// hits and misses of the page cache; see KV.CacheStats
+func (db *DB) CacheStats() kv.CacheStats {
+	return db.kv.CacheStats()
 }
-func (tx *DBTX) Upsert(table string, rec Record) (bool, error) {
-	return tx.Set(table, &DBUpdateReq{Record: rec, Mode: btree.MODE_UPSERT})
+
+// shrink the file; see KV.Vacuum
+func (db *DB) Vacuum() (int64, error) {
+	return db.kv.Vacuum()
 }
 
-// delete a record by primary key
-func dbDelete(tx *DBTX, tdef *TableDef, rec Record) (bool, error) {
-	vals, err := getValues(tdef, rec, tdef.Indexes[0])
-	if err != nil {
-		return false, err
-	}
+func (db *DB) VacuumCtx(ctx context.Context) (int64, error) {
+	return db.kv.VacuumCtx(ctx)
+}
 
-	// delete row
-	req := DeleteReq{Key: encodeKey(nil, tdef.Prefixes[0], vals)}
-	if deleted, _ := tx.kv.Del(&req); !deleted {
-		return false, nil
-	}
+// copy the latest version to a new file; see KV.Backup
+func (db *DB) Backup(path string) error {
+	return db.kv.Backup(path)
+}
 
-	for _, c := range nonPrimaryKeyCols(tdef) {
-		tp := tdef.Types[slices.Index(tdef.Cols, c)]
-		vals = append(vals, Value{Type: tp})
-	}
+func (db *DB) BackupCtx(ctx context.Context, path string) error {
+	return db.kv.BackupCtx(ctx, path)
+}
 
-	decodeValues(req.Old, vals[len(tdef.Indexes[0]):])
-	err = indexOP(tx, tdef, INDEX_DEL, Record{tdef.Cols, vals})
-	assert(err == nil)
+// copy the latest version to `w`; see KV.BackupTo
+func (db *DB) BackupTo(w io.Writer) error {
+	return db.kv.BackupTo(w)
+}
 
-	return true, nil
+func (db *DB) BackupToCtx(ctx context.Context, w io.Writer) error {
+	return db.kv.BackupToCtx(ctx, w)
 }
 
-func (tx *DBTX) Delete(table string, rec Record) (bool, error) {
-	tdef := getTableDef(tx, table)
-	if tdef == nil {
-		return false, fmt.Errorf("table not found: %s", table)
-	}
+// the sequence number of the last commit; see KV.Seq
+func (db *DB) Seq() uint64 {
+	return db.kv.Seq()
+}
 
-	return dbDelete(tx, tdef, rec)
+// the sequence number for BeginReadAt; the same as Seq
+func (db *DB) CurrentSeq() uint64 {
+	return db.kv.CurrentSeq()
 }
 
-func (db *DB) Open() error {
-	db.kv.Path = db.Path
-	db.tables = map[string]*TableDef{}
+// write the updates after `seq`; see KV.ChangesSince
+func (db *DB) ChangesSince(seq uint64, w io.Writer) error {
+	return db.kv.ChangesSince(seq, w)
+}
 
-	// opening kv store
-	return db.kv.Open()
+// replay the output of ChangesSince; see KV.ApplyChanges
+func (db *DB) ApplyChanges(r io.Reader) error {
+	err := db.kv.ApplyChanges(r)
+	// the schema may be changed
+	db.mu.Lock()
+	schemaCacheDrop(db, 0)
+	db.mu.Unlock()
+	return err
 }
 
-func (db *DB) Close() {
-	db.kv.Close()
+// make all commits persistent in the NoSync mode
+func (db *DB) Sync() error {
+	return db.kv.Sync()
 }
 
 // scanner decodes KV's into rows
@@ -611,69 +2425,375 @@ type Scanner struct {
 	Cmp1 int
 	Cmp2 int
 
-	// range from Key 1 to key2
+	// range from Key 1 to key2, in the order of the index; see
+	// table_desc.go for descending columns
 	Key1 Record
 	Key2 Record
 
+	// iterate in descending order; the range can be given either way
+	Desc bool
+
+	// decode only these columns; all columns if empty
+	Cols []string
+
+	// skip the first `Offset` rows and stop after `Limit` rows.
+	// 0 for unlimited.
+	Offset int
+	Limit  int
+
+	// if set, only rows it accepts are visible. it sees the full row
+	// regardless of `Cols`. `Offset` and `Limit` count accepted rows.
+	// see also SetFilterExpr.
+	Filter func(*Record) bool
+
+	// if set, the scan stops with ctx.Err() once it's done. it's checked
+	// every SCAN_CTX_ROWS rows, including the rows rejected by `Filter`.
+	Ctx context.Context
+
+	// Deref reuses the slices of its record and the strings of the
+	// scanner, so a scan into the same record doesn't allocate. the values
+	// are only valid until the next Next(); keep them with Record.Clone.
+	Reuse bool
+
+	// the leaf pages read ahead of a scan of the file, as it moves to the
+	// next ones; see kv_prefetch.go. 0 for SCAN_PREFETCH once the scan
+	// has moved to SCAN_PREFETCH_AFTER leaves, so that a point query or a
+	// short range doesn't; negative for none.
+	Prefetch int
+
 	// internal
 	tx     *DBTX
 	index  int
 	tdef   *TableDef
 	iter   transactions.KVIter
 	keyEnd []byte
+	cmp1   int   // Cmp1 and Cmp2 in the iteration direction
+	cmp2   int
+	mem    int64 // bytes charged to the memory budget
+	rowMem int64 // part of `mem` for the current row
+	count  int   // rows passed by Next()
+	row    Record // current row decoded for Filter
+	err    error  // error from decoding for Filter
+	fail   error  // a corrupted page; the scan is stopped
+	steps  int    // of the iterator, for Ctx
+	// rows with a TTL deadline up to it are skipped; 0 for none
+	expiry  int64
+	expired bool // no expiry, for ExpireSweep
+	buf     rowBuf
+	ikey    Record // the index key of an index scan
+	plan    *Plan  // see Find; the index is the one of the plan
+	owned   bool   // the TX is ended by Close; see DB.Find
+	// see SetFilterExpr; `prog` is `expr` bound to the table by the scan
+	expr *filterExpr
+	prog *filterExpr
+	// the primary keys of an index scan are encoded in it. it's only
+	// appended to, since the reads of the KVTX keep them.
+	keys []byte
+}
+
+// the slices of the rows decoded with Scanner.Reuse
+type rowBuf struct {
+	cols []string // primary key columns, then the rest
+	full Record   // the row the columns are picked from
+	skip []bool
+	strs []byte
+}
+
+// the primary keys of an index scan are encoded in chunks of this size
+const SCAN_KEYS_CHUNK = 4096
+
+const SCAN_CTX_ROWS = 256
+
+// see Scanner.Prefetch
+const (
+	SCAN_PREFETCH       = 8
+	SCAN_PREFETCH_AFTER = 2
+)
+
+// count a step of the iterator; false if the context is done
+func scanStep(sc *Scanner) bool {
+	sc.steps++
+	if sc.Ctx != nil && sc.steps%SCAN_CTX_ROWS == 0 && sc.Ctx.Err() != nil {
+		sc.fail = sc.Ctx.Err()
+		return false
+	}
+	return true
 }
 
 // within range or not
 func (sc *Scanner) Valid() bool {
+	if sc.fail != nil {
+		return false
+	}
+	if sc.Limit > 0 && sc.count >= sc.Limit {
+		return false
+	}
 	return sc.iter.Valid()
 }
 
+// the error that stopped the scan early, if any
+func (sc *Scanner) Err() error {
+	return sc.fail
+}
+
 // movin underlying B+ tree iterator
 func (sc *Scanner) Next() {
+	if sc.fail != nil {
+		return
+	}
+	defer checksumRecover(&sc.fail)
 	sc.iter.Next()
+	sc.count++
+	if !scanStep(sc) {
+		return
+	}
+	if sc.Limit == 0 || sc.count < sc.Limit {
+		scanFilter(sc)
+	}
 }
 
-// return current row
-func (sc *Scanner) Deref(rec *Record) {
-	assert(sc.Valid())
-	tdef := sc.tdef
+// skip rows rejected by the filter, stops at the range end
+func scanFilter(sc *Scanner) {
+	for scanFiltered(sc) && sc.iter.Valid() {
+		sc.err = scanDecode(sc, &sc.row, nil)
+		if sc.err != nil || scanAccept(sc, &sc.row) {
+			return
+		}
+		sc.iter.Next()
+		if !scanStep(sc) {
+			return
+		}
+	}
+}
 
-	// fetch KV from iterator
-	key, val := sc.iter.Deref()
+// rows are decoded to be filtered
+func scanFiltered(sc *Scanner) bool {
+	return sc.Filter != nil || sc.prog != nil || sc.expiry != 0
+}
 
-	// prepare output record
-	rec.Cols = slices.Concat(tdef.Indexes[0], nonPrimaryKeyCols(tdef))
+func scanAccept(sc *Scanner, rec *Record) bool {
+	if sc.expiry != 0 && rowExpired(sc.tdef, rec, sc.expiry) {
+		return false
+	}
+	if sc.prog != nil && !exprMatch(sc.prog, rec) {
+		return false
+	}
+	return sc.Filter == nil || sc.Filter(rec)
+}
+
+// filter the rows by an expression; see table_expr.go. a syntax error is
+// returned here, and an unknown column or a wrong type by the scan. the
+// rows must pass both the expression and `Filter`. "" removes it.
+func (sc *Scanner) SetFilterExpr(expr string) error {
+	sc.expr = nil
+	if expr == "" {
+		return nil
+	}
+	e, err := exprParse(expr)
+	if err != nil {
+		return err
+	}
+	sc.expr = e
+	return nil
+}
+
+// the expression of SetFilterExpr; "" for none
+func (sc *Scanner) FilterExpr() string {
+	if sc.expr == nil {
+		return ""
+	}
+	return sc.expr.src
+}
+
+// the index chosen by dbScan; 0 is the primary key
+func (sc *Scanner) Index() int {
+	return sc.index
+}
+
+// columns of the chosen index
+func (sc *Scanner) IndexCols() []string {
+	return sc.tdef.Indexes[sc.index]
+}
+
+// prepare output record: primary key columns, then the rest. the columns
+// are the ones of `rb` if given.
+func rowInit(tdef *TableDef, rec *Record, rb *rowBuf) {
+	switch {
+	case rb == nil:
+		rec.Cols = slices.Concat(tdef.Indexes[0], nonPrimaryKeyCols(tdef))
+	case rb.cols == nil:
+		rb.cols = slices.Clip(slices.Concat(tdef.Indexes[0], nonPrimaryKeyCols(tdef)))
+		fallthrough
+	default:
+		rec.Cols = rb.cols
+	}
 	rec.Vals = rec.Vals[:0]
 	for _, c := range rec.Cols {
 		tp := tdef.Types[slices.Index(tdef.Cols, c)]
 		rec.Vals = append(rec.Vals, Value{Type: tp})
 	}
+}
+
+// decode a row of the primary index. if `cols` is given, only those
+// columns are decoded and the record holds them in that order.
+// with `rb` the record shares its slices, and the previous row of `rb`
+// is overwritten.
+func rowDecode(tdef *TableDef, key []byte, val []byte, rec *Record, cols []string, rb *rowBuf) error {
+	full := rec
+	var strs *[]byte
+	if rb != nil {
+		rb.strs = rb.strs[:0]
+		strs = &rb.strs
+		if len(cols) != 0 {
+			full = &rb.full
+		}
+	} else if len(cols) != 0 {
+		full = &Record{}
+	}
+	rowInit(tdef, full, rb)
+	np := len(tdef.Indexes[0])
+	if err := decodeKeyStrs(key, full.Vals[:np], strs); err != nil {
+		return rowCorrupt(tdef, key, err)
+	}
+	if len(cols) == 0 {
+		return rowCorrupt(tdef, key, decodeRow(tdef, val, full.Vals[np:], nil, strs))
+	}
+
+	var skip []bool
+	if rb != nil {
+		skip = rb.skip[:0]
+	}
+	for _, c := range full.Cols[np:] {
+		skip = append(skip, slices.Index(cols, c) < 0)
+	}
+	if rb != nil {
+		rb.skip = skip
+	}
+	if err := decodeRow(tdef, val, full.Vals[np:], skip, strs); err != nil {
+		return rowCorrupt(tdef, key, err)
+	}
+	rec.Vals = rec.Vals[:0]
+	for _, c := range cols {
+		rec.Vals = append(rec.Vals, *full.Get(c))
+	}
+	rec.Cols = slices.Clip(cols)
+	if rb == nil {
+		rec.Cols = slices.Clone(cols)
+	}
+	return nil
+}
+
+// the table and the key of a decoding error
+func rowCorrupt(tdef *TableDef, key []byte, err error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("table %s: bad row %x: %w", tdef.Name, key, err)
+}
+
+// return current row. see Scanner.Reuse for the lifetime of the values.
+func (sc *Scanner) Deref(rec *Record) error {
+	assert(sc.Valid())
+	if !scanFiltered(sc) {
+		return scanDecode(sc, rec, sc.Cols)
+	}
 
-	if sc.index == 0 {
-		// decode full row
-		np := len(tdef.Indexes[0])
-		decodeKey(key, rec.Vals[:np])
-		decodeValues(val, rec.Vals[np:])
+	// already decoded by the filter
+	if sc.err != nil {
+		return sc.err
+	}
+	cols := sc.Cols
+	if len(cols) == 0 {
+		cols = sc.row.Cols
+	}
+	if sc.Reuse {
+		rec.Cols, rec.Vals = slices.Clip(cols), rec.Vals[:0]
 	} else {
-		// decode index key
-		assert(len(val) == 0)
-		index := tdef.Indexes[sc.index]
-		irec := Record{index, make([]Value, len(index))}
+		rec.Cols, rec.Vals = slices.Clone(cols), make([]Value, 0, len(cols))
+	}
+	for _, c := range cols {
+		rec.Vals = append(rec.Vals, *sc.row.Get(c))
+	}
+	return nil
+}
+
+// the encoded key of the current row in the chosen index, without
+// decoding it. it's only valid until the next Next().
+func (sc *Scanner) Key() []byte {
+	if !sc.Valid() {
+		return nil
+	}
+	key, _ := sc.iter.Deref()
+	return key
+}
 
-		for i, c := range index {
-			irec.Vals[i].Type = tdef.Types[slices.Index(tdef.Cols, c)]
+func scanDecode(sc *Scanner, rec *Record, cols []string) (err error) {
+	tdef := sc.tdef
+
+	// fetch KV from iterator
+	key, val := sc.iter.Deref()
+	if sc.index != 0 {
+		if key, val, err = scanIndexRow(sc, key, val); err != nil {
+			return err
 		}
-		decodeKey(key, irec.Vals)
+	}
 
-		// extract primary key
-		for i, c := range tdef.Indexes[0] {
-			rec.Vals[i] = *irec.Get(c)
+	// the decoded row replaces the previous one
+	size := rowMemSize(tdef, key, val)
+	if err := scanCharge(sc, size-sc.rowMem); err != nil {
+		return err
+	}
+	sc.rowMem = size
+
+	var rb *rowBuf
+	if sc.Reuse {
+		rb = &sc.buf
+	}
+	return rowDecode(tdef, key, val, rec, cols, rb)
+}
+
+// the primary key and the row of an index key. the expired rows are
+// skipped by scanFilter.
+func scanIndexRow(sc *Scanner, key []byte, val []byte) (pkey []byte, row []byte, err error) {
+	defer checksumRecover(&err)
+	tdef := sc.tdef
+	if len(val) != 0 {
+		return nil, nil, rowCorrupt(tdef, key, errCorrupt("index value is not empty"))
+	}
+	// decode index key
+	cols, types := indexKeyCols(tdef, sc.index)
+	irec := &sc.ikey
+	irec.Cols, irec.Vals = cols, irec.Vals[:0]
+	for _, tp := range types {
+		irec.Vals = append(irec.Vals, Value{Type: tp})
+	}
+	ikey, err := indexKeyAsc(tdef, sc.index, key)
+	if err == nil {
+		err = decodeKey(ikey, irec.Vals)
+	}
+	if err != nil {
+		return nil, nil, rowCorrupt(tdef, key, err)
+	}
+
+	// encode the primary key
+	if cap(sc.keys)-len(sc.keys) < SCAN_KEYS_CHUNK/4 {
+		if err := scanCharge(sc, SCAN_KEYS_CHUNK); err != nil {
+			return nil, nil, err
 		}
+		sc.keys = make([]byte, 0, SCAN_KEYS_CHUNK)
+	}
+	start := len(sc.keys)
+	sc.keys = binary.BigEndian.AppendUint32(sc.keys, tdef.Prefixes[0])
+	for _, c := range tdef.Indexes[0] {
+		sc.keys = encodeValues(sc.keys, []Value{*irec.Get(c)})
+	}
+	pkey = sc.keys[start:len(sc.keys):len(sc.keys)]
 
-		// fetch row by primary key
-		ok, err := dbGet(sc.tx, tdef, rec)
-		assert(ok && err == nil)
+	row, ok := sc.tx.kv.Get(pkey)
+	if !ok {
+		return nil, nil, rowCorrupt(tdef, key, errCorrupt("index key without a row"))
 	}
+	return pkey, row, nil
 }
 
 // check col. types
@@ -684,58 +2804,229 @@ func checkTypes(tdef *TableDef, rec Record) error {
 
 	for i, c := range rec.Cols {
 		j := slices.Index(tdef.Cols, c)
-		if j < 0 || tdef.Types[j] != rec.Vals[i].Type {
+		if j < 0 {
 			return fmt.Errorf("bad column: %s", c)
 		}
+		if tdef.Types[j] != rec.Vals[i].Type {
+			return errColumn(tdef, j, &rec.Vals[i], &ErrBadColumnType{Col: c})
+		}
+		if err := checkValue(tdef, j, rec.Vals[i]); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
 func dbScan(tx *DBTX, tdef *TableDef, req *Scanner) error {
+	keyStart, keyEnd, err := scanRange(tdef, req)
+	if err != nil {
+		return err
+	}
+	req.tx = tx
+	req.tdef = tdef
+	return scanSeek(tx, req, keyStart, keyEnd)
+}
+
+// select the index and encode the range of the scan
+func scanRange(tdef *TableDef, req *Scanner) (keyStart []byte, keyEnd []byte, err error) {
 	switch {
 	case req.Cmp1 > 0 && req.Cmp2 < 0:
 	case req.Cmp1 < 0 && req.Cmp2 > 0:
 	default:
-		return fmt.Errorf("bad range")
+		return nil, nil, ErrBadRange
+	}
+	if err := scanCheck(tdef, req); err != nil {
+		return nil, nil, err
 	}
 
 	if err := checkTypes(tdef, req.Key1); err != nil {
-		return err
+		return nil, nil, err
 	}
 	if err := checkTypes(tdef, req.Key2); err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	req.tx = tx
-	req.tdef = tdef
-
 	// select index
 	isCovered := func(key []string,index []string) bool {
 		return len(index) >= len(key) && slices.Equal(index[:len(key)], key)
 	}
 
-	req.index = slices.IndexFunc(tdef.Indexes, func (index []string)bool  {
-		return isCovered(req.Key1.Cols, index) && isCovered(req.Key2.Cols, index)
-	})
+	// an index being built is incomplete
+	req.index = -1
+	for i, index := range tdef.Indexes {
+		if req.plan != nil && i != req.plan.Index {
+			continue
+		}
+		if isBuilding(tdef, i) || isComputed(tdef, i) {
+			continue
+		}
+		if isCovered(req.Key1.Cols, index) && isCovered(req.Key2.Cols, index) {
+			req.index = i
+			break
+		}
+	}
 	if req.index < 0 {
-		return fmt.Errorf("no index")
+		// a key must be a leading part of an index, in the same order
+		return nil, nil, fmt.Errorf("%w: no index for columns: %v, %v", ErrBadRange, req.Key1.Cols, req.Key2.Cols)
 	}
 
 	// encode start key
-	prefix := tdef.Prefixes[req.index]
-	keyStart := encodeKeyPartial(nil, prefix, req.Key1.Vals, req.Cmp1)
-	keyEnd := encodeKeyPartial(nil, prefix, req.Key2.Vals, req.Cmp2)
+	key1, key2 := req.Key1, req.Key2
+	req.cmp1, req.cmp2 = req.Cmp1, req.Cmp2
+	if req.Desc && req.Cmp1 > 0 {
+		key1, key2 = key2, key1
+		req.cmp1, req.cmp2 = req.Cmp2, req.Cmp1
+	}
+	keyStart = indexKeyPartial(nil, tdef, req.index, collateVals(tdef, req.index, key1.Vals), req.cmp1)
+	keyEnd = indexKeyPartial(nil, tdef, req.index, collateVals(tdef, req.index, key2.Vals), req.cmp2)
+	return keyStart, keyEnd, nil
+}
 
-	// seek to start key
-	req.iter = tx.kv.Seek(keyStart, req.Cmp1, keyEnd, req.Cmp2)
+// check the options other than the range
+func scanCheck(tdef *TableDef, req *Scanner) error {
+	if req.Offset < 0 || req.Limit < 0 {
+		return fmt.Errorf("bad offset or limit")
+	}
+	for i, c := range req.Cols {
+		if slices.Index(tdef.Cols, c) < 0 {
+			return fmt.Errorf("unknown column: %s", c)
+		}
+		if slices.Index(req.Cols[:i], c) >= 0 {
+			return fmt.Errorf("duplicated column: %s", c)
+		}
+	}
+	req.prog = nil
+	if req.expr != nil {
+		prog, err := exprBind(tdef, req.expr)
+		if err != nil {
+			return err
+		}
+		req.prog = prog
+	}
 	return nil
 }
 
+// position the scanner at the start of the encoded range
+func scanSeek(tx *DBTX, req *Scanner, keyStart []byte, keyEnd []byte) (err error) {
+	if req.Ctx != nil && req.Ctx.Err() != nil {
+		return req.Ctx.Err()
+	}
+	// the range keys are held until the scanner is closed
+	scanOpen(req)
+	if err := scanCharge(req, int64(len(keyStart)+len(keyEnd))); err != nil {
+		req.Close()
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			req.Close()
+		}
+	}()
+	defer checksumRecover(&err)
+
+	// seek to start key
+	req.fail = nil
+	req.iter = tx.kv.Seek(keyStart, req.cmp1, keyEnd, req.cmp2)
+	scanPrefetch(req)
+	req.keyEnd = keyEnd
+	req.err = nil
+	req.steps = 0
+	req.expiry = 0
+	req.buf, req.keys = rowBuf{}, nil
+	if !req.expired {
+		req.expiry = ttlNow(tx, req.tdef)
+	}
+	scanFilter(req)
+	for i := 0; i < req.Offset && req.iter.Valid() && req.fail == nil; i++ {
+		req.iter.Next()
+		if scanStep(req) {
+			scanFilter(req)
+		}
+	}
+	req.count = 0
+	return req.fail
+}
+
+// see Scanner.Prefetch
+func scanPrefetch(req *Scanner) {
+	iter := req.iter.(*transactions.CombinedIterator)
+	switch {
+	case req.Prefetch > 0:
+		iter.Prefetch(req.Prefetch, 0)
+	case req.Prefetch == 0:
+		iter.Prefetch(SCAN_PREFETCH, SCAN_PREFETCH_AFTER)
+	}
+}
+
 func (tx *DBTX) Scan(table string, req *Scanner) error {
-	tdef := getTableDef(tx, table)
-	if tdef == nil {
-		return fmt.Errorf("table not found: %s", table)
+	tdef, err := getTableDef(tx, table)
+	if err != nil {
+		return err
 	}
+	req.plan = nil
 
 	return dbScan(tx, tdef, req)
 }
+
+// the position of the scan for ScanResume, nil at the end of the range.
+// format: |dir 1B|cmp2 1B|len 4B|current key|end key|
+func (sc *Scanner) Token() []byte {
+	if !sc.iter.Valid() {
+		return nil
+	}
+	key, _ := sc.iter.Deref()
+	dir := int8(+1)
+	if sc.cmp1 < 0 {
+		dir = -1
+	}
+	out := []byte{byte(dir), byte(int8(sc.cmp2))}
+	out = binary.BigEndian.AppendUint32(out, uint32(len(key)))
+	out = append(out, key...)
+	return append(out, sc.keyEnd...)
+}
+
+// continue a scan from Scanner.Token(). the range and the index come
+// from the token, ignoring those of `req`; the other options (Cols,
+// Filter, Offset, Limit) come from `req`.
+// the scan starts at the next row if the token row is gone.
+func (tx *DBTX) ScanResume(table string, token []byte, req *Scanner) error {
+	tdef, err := getTableDef(tx, table)
+	if err != nil {
+		return err
+	}
+	if err := scanCheck(tdef, req); err != nil {
+		return err
+	}
+
+	if len(token) < 6 {
+		return fmt.Errorf("bad token")
+	}
+	dir, cmp2 := int8(token[0]), int(int8(token[1]))
+	n := uint64(binary.BigEndian.Uint32(token[2:6]))
+	if uint64(len(token)) < 6+n {
+		return fmt.Errorf("bad token")
+	}
+	keyStart, keyEnd := token[6:6+n], token[6+n:]
+	if len(keyStart) < 4 || len(keyEnd) < 4 || !bytes.Equal(keyStart[:4], keyEnd[:4]) {
+		return fmt.Errorf("bad token")
+	}
+	// the key prefix must belong to the table
+	req.index = slices.Index(tdef.Prefixes, binary.BigEndian.Uint32(keyStart))
+	if req.index < 0 {
+		return fmt.Errorf("bad token: not from table %s", table)
+	}
+
+	switch {
+	case dir > 0 && (cmp2 == btree_iter.CMP_LT || cmp2 == btree_iter.CMP_LE):
+		req.cmp1 = btree_iter.CMP_GE
+	case dir < 0 && (cmp2 == btree_iter.CMP_GT || cmp2 == btree_iter.CMP_GE):
+		req.cmp1 = btree_iter.CMP_LE
+	default:
+		return fmt.Errorf("bad token")
+	}
+	req.cmp2 = cmp2
+	req.tx = tx
+	req.tdef = tdef
+	return scanSeek(tx, req, slices.Clone(keyStart), slices.Clone(keyEnd))
+}
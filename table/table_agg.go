@@ -0,0 +1,156 @@
+package table
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+)
+
+// open a scan over the range of `sc` that decodes only `col`.
+// the column type is checked before iterating.
+func aggOpen(tx *DBTX, table string, sc *Scanner, col string, types ...uint32) (*Scanner, error) {
+	tdef, err := getTableDef(tx, table)
+	if err != nil {
+		return nil, err
+	}
+
+	scan := &Scanner{
+		Cmp1: sc.Cmp1, Cmp2: sc.Cmp2, Key1: sc.Key1, Key2: sc.Key2, Desc: sc.Desc,
+		Offset: sc.Offset, Limit: sc.Limit, Filter: sc.Filter, Ctx: sc.Ctx,
+		Prefetch: sc.Prefetch, expr: sc.expr,
+	}
+	if col != "" {
+		idx := slices.Index(tdef.Cols, col)
+		if idx < 0 {
+			return nil, fmt.Errorf("unknown column: %s", col)
+		}
+		if !slices.Contains(types, tdef.Types[idx]) {
+			return nil, &ErrBadColumnType{Col: col}
+		}
+		scan.Cols = []string{col}
+	}
+
+	if err := dbScan(tx, tdef, scan); err != nil {
+		return nil, err
+	}
+	return scan, nil
+}
+
+// number of rows in the scan range. rows are only decoded for `Filter`.
+func (tx *DBTX) Count(table string, sc *Scanner) (int64, error) {
+	scan, err := aggOpen(tx, table, sc, "")
+	if err != nil {
+		return 0, err
+	}
+	defer scan.Close()
+
+	n := int64(0)
+	for ; scan.Valid(); scan.Next() {
+		if scan.err != nil {
+			return 0, scan.err
+		}
+		n++
+	}
+	return n, scan.Err()
+}
+
+// sum of an INT64 or FLOAT64 column over the scan range, nulls are skipped.
+// INT64 sums fail instead of wrapping around on overflow.
+func (tx *DBTX) Sum(table string, col string, sc *Scanner) (Value, error) {
+	scan, err := aggOpen(tx, table, sc, col, TYPE_INT64, TYPE_FLOAT64)
+	if err != nil {
+		return Value{}, err
+	}
+	defer scan.Close()
+
+	sum := Value{Type: scan.tdef.Types[slices.Index(scan.tdef.Cols, col)]}
+	rec := Record{}
+	for ; scan.Valid(); scan.Next() {
+		if err := scan.Deref(&rec); err != nil {
+			return Value{}, err
+		}
+		v := rec.Vals[0]
+		switch v.Type {
+		case TYPE_INT64:
+			s := sum.I64 + v.I64
+			if (v.I64 > 0 && s < sum.I64) || (v.I64 < 0 && s > sum.I64) {
+				return Value{}, fmt.Errorf("integer overflow: %s", col)
+			}
+			sum.I64 = s
+		case TYPE_FLOAT64:
+			sum.F64 += v.F64
+		}
+	}
+	if err := scan.Err(); err != nil {
+		return Value{}, err
+	}
+	return sum, nil
+}
+
+// smallest value of a column over the scan range, nulls are skipped.
+// found is false if there is no value.
+func (tx *DBTX) Min(table string, col string, sc *Scanner) (Value, bool, error) {
+	return dbMinMax(tx, table, col, sc, -1)
+}
+
+// largest value of a column over the scan range, nulls are skipped.
+// found is false if there is no value.
+func (tx *DBTX) Max(table string, col string, sc *Scanner) (Value, bool, error) {
+	return dbMinMax(tx, table, col, sc, +1)
+}
+
+// `want` is -1 for the minimum and +1 for the maximum
+func dbMinMax(tx *DBTX, table string, col string, sc *Scanner, want int) (Value, bool, error) {
+	types := []uint32{TYPE_INT64, TYPE_FLOAT64, TYPE_TIMESTAMP, TYPE_BYTES}
+	scan, err := aggOpen(tx, table, sc, col, types...)
+	if err != nil {
+		return Value{}, false, err
+	}
+
+	// rows are ordered by the first index column, so the first row is
+	// the answer if the scan goes in the right direction. a descending
+	// column gives the largest value first.
+	leading := scan.IndexCols()[0] == col && collation(scan.tdef, scan.index, 0) == COLLATE_BINARY
+	ascending := (scan.cmp1 > 0) != isDesc(scan.tdef, scan.index, 0)
+	ordered := leading && ascending == (want < 0)
+	if leading && !ordered && sc.Offset == 0 && sc.Limit == 0 {
+		// otherwise it's the last row, the first one of the range
+		// scanned the other way
+		scan.Close()
+		rev := *sc
+		rev.Key1, rev.Key2, rev.Cmp1, rev.Cmp2 = sc.Key2, sc.Key1, sc.Cmp2, sc.Cmp1
+		if sc.Desc && sc.Cmp1 > 0 {
+			rev.Key1, rev.Key2, rev.Cmp1, rev.Cmp2 = sc.Key1, sc.Key2, sc.Cmp1, sc.Cmp2
+		}
+		rev.Desc = false
+		if scan, err = aggOpen(tx, table, &rev, col, types...); err != nil {
+			return Value{}, false, err
+		}
+		ordered = true
+	}
+	defer scan.Close()
+
+	best, found := Value{}, false
+	rec := Record{}
+	for ; scan.Valid(); scan.Next() {
+		if err := scan.Deref(&rec); err != nil {
+			return Value{}, false, err
+		}
+		v := rec.Vals[0]
+		if v.Type == TYPE_NULL {
+			continue
+		}
+		// the encoding preserves the order
+		if !found || bytes.Compare(encodeValues(nil, []Value{v}),
+			encodeValues(nil, []Value{best})) == want {
+			best, found = v, true
+		}
+		if ordered {
+			break
+		}
+	}
+	if err := scan.Err(); err != nil {
+		return Value{}, false, err
+	}
+	return best, found, nil
+}
@@ -0,0 +1,34 @@
+package table
+
+// writes to multiple tables that are committed together
+type Batch struct {
+	tx DBTX
+}
+
+// like DBTX.Set. the record is checked and applied immediately,
+// so later operations in the batch see it.
+func (b *Batch) Set(table string, dbreq *DBUpdateReq) (bool, error) {
+	return b.tx.Set(table, dbreq)
+}
+
+// like DBTX.Delete.
+func (b *Batch) Delete(table string, rec Record) (bool, error) {
+	return b.tx.Delete(table, rec)
+}
+
+// like DBTX.DeleteReturning.
+func (b *Batch) DeleteReturning(table string, rec *Record) (bool, error) {
+	return b.tx.DeleteReturning(table, rec)
+}
+
+// run `fn` and commit its writes as one transaction.
+// nothing is written if `fn` or the commit fails.
+func (db *DB) WriteBatch(fn func(b *Batch) error) error {
+	b := Batch{}
+	db.Begin(&b.tx)
+	if err := fn(&b); err != nil {
+		db.Abort(&b.tx)
+		return err
+	}
+	return db.Commit(&b.tx)
+}
@@ -0,0 +1,245 @@
+package table
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/Adit0507/AdiDB/internal/transactions"
+)
+
+/*
+buffered writes for many small upserts, such as telemetry. a BufferedWriter
+holds the writes given to Set and Delete in memory, encoded, by their
+encoded primary key, so a later write of the same row replaces an
+earlier one. Flush applies them in the order of the keys as one
+transaction, like DBTX.Set with MODE_UPSERT and DBTX.Delete, over the
+writes committed since they were buffered.
+
+Set and Delete check the columns, the types and the values, and the
+primary key. what depends on the stored data, such as missing columns,
+unique indexes and foreign keys, is checked by Flush; a write that fails
+it fails the whole Flush, which writes nothing and keeps the buffer. a
+conflict with a concurrent commit is retried.
+
+when a Set or a Delete reaches a limit of BufferOptions and its flush
+fails, the write stays in the buffer and the error is ErrNotFlushed,
+wrapping the error of the flush.
+
+the buffer is only seen by BufferedWriter.Get; the transactions of the
+DB see it once it's flushed. a crash before Flush loses the buffer and
+nothing else, since the writes are a single commit.
+*/
+
+type BufferOptions struct {
+	// Set and Delete flush once the buffer holds this many writes or
+	// bytes; 0 for no limit
+	MaxOps   int
+	MaxBytes int
+}
+
+type BufferedWriter struct {
+	db    *DB
+	opts  BufferOptions
+	mu    sync.Mutex
+	ops   map[string]bufOp // by the encoded primary key
+	bytes int
+}
+
+type bufOp struct {
+	table string
+	tdef  *TableDef // the schema it was encoded with
+	del   bool
+	cols  []string // the non primary key columns of the row
+	val   []byte   // their values, encoded; nil for a delete
+	size  int
+}
+
+func (db *DB) NewBufferedWriter(opts BufferOptions) *BufferedWriter {
+	return &BufferedWriter{db: db, opts: opts, ops: map[string]bufOp{}}
+}
+
+// buffer an upsert of the row; see the top
+func (w *BufferedWriter) Set(table string, rec Record) error {
+	return bufAdd(w, table, rec, false)
+}
+
+// buffer a delete of the row with the primary key of `rec`
+func (w *BufferedWriter) Delete(table string, rec Record) error {
+	return bufAdd(w, table, rec, true)
+}
+
+func bufAdd(w *BufferedWriter, table string, rec Record, del bool) error {
+	key, op, err := bufEncode(w.db, table, rec, del)
+	if err != nil {
+		return err
+	}
+	op.size = len(key) + len(op.val)
+	for _, col := range op.cols {
+		op.size += len(col)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.bytes += op.size - w.ops[string(key)].size
+	w.ops[string(key)] = op
+	if (w.opts.MaxOps > 0 && len(w.ops) >= w.opts.MaxOps) ||
+		(w.opts.MaxBytes > 0 && w.bytes >= w.opts.MaxBytes) {
+		if err := bufFlush(w); err != nil {
+			return fmt.Errorf("%w: %w", ErrNotFlushed, err)
+		}
+	}
+	return nil
+}
+
+// the encoded primary key and the encoded write, with the record checked
+func bufEncode(db *DB, table string, rec Record, del bool) ([]byte, bufOp, error) {
+	op := bufOp{table: table, del: del}
+	if _, ok := INTERNAL_TABLES[table]; ok {
+		return nil, op, fmt.Errorf("cannot write internal table: %s", table)
+	}
+	tx := DBTX{}
+	db.BeginRead(&tx)
+	defer db.Abort(&tx)
+	tdef, err := getTableDef(&tx, table)
+	if err != nil {
+		return nil, op, err
+	}
+	op.tdef = tdef
+	if err := checkDupCols(rec); err != nil {
+		return nil, op, err
+	}
+	if !del {
+		if err := checkTypes(tdef, rec); err != nil {
+			return nil, op, err
+		}
+	}
+	pk, err := getValues(tdef, rec, tdef.Indexes[0])
+	if err != nil {
+		return nil, op, err
+	}
+	if del {
+		if err := checkTypes(tdef, Record{tdef.Indexes[0], pk}); err != nil {
+			return nil, op, err
+		}
+		return encodeKey(nil, tdef.Prefixes[0], pk), op, nil
+	}
+	vals := []Value{}
+	for i, col := range rec.Cols {
+		if !slices.Contains(tdef.Indexes[0], col) {
+			op.cols = append(op.cols, col)
+			vals = append(vals, rec.Vals[i])
+		}
+	}
+	op.val = encodeValues([]byte{}, vals)
+	return encodeKey(nil, tdef.Prefixes[0], pk), op, nil
+}
+
+// the record of a buffered write: the row, or the primary key of a delete
+func bufDecode(key string, op bufOp) (Record, error) {
+	pk := op.tdef.Indexes[0]
+	rec := Record{Cols: slices.Concat(pk, op.cols)}
+	rec.Vals = make([]Value, len(rec.Cols))
+	for i, col := range rec.Cols {
+		rec.Vals[i].Type = op.tdef.Types[slices.Index(op.tdef.Cols, col)]
+	}
+	if err := decodeKey([]byte(key), rec.Vals[:len(pk)]); err != nil {
+		return Record{}, err
+	}
+	if err := decodeValues(op.val, rec.Vals[len(pk):]); err != nil {
+		return Record{}, err
+	}
+	return rec, nil
+}
+
+// the row in the buffer, or else in the DB. a buffered delete is a
+// missing row.
+func (w *BufferedWriter) Get(table string, rec *Record) (bool, error) {
+	key, _, err := bufEncode(w.db, table, *rec, true)
+	if err != nil {
+		return false, err
+	}
+	w.mu.Lock()
+	op, ok := w.ops[string(key)]
+	w.mu.Unlock()
+	if ok && op.table == table {
+		if op.del {
+			return false, nil
+		}
+		out, err := bufDecode(string(key), op)
+		if err != nil {
+			return false, err
+		}
+		*rec = out
+		return true, nil
+	}
+	tx := DBTX{}
+	w.db.BeginRead(&tx)
+	defer w.db.Abort(&tx)
+	return tx.Get(table, rec)
+}
+
+// the writes in the buffer
+func (w *BufferedWriter) Len() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.ops)
+}
+
+// drop the buffer without writing it
+func (w *BufferedWriter) Reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.ops, w.bytes = map[string]bufOp{}, 0
+}
+
+// write the buffer as one transaction; see the top
+func (w *BufferedWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return bufFlush(w)
+}
+
+// called with the lock held. a conflict is retried since the writes
+// don't depend on what they read.
+func bufFlush(w *BufferedWriter) error {
+	if len(w.ops) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(w.ops))
+	for k := range w.ops {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for {
+		err := bufApply(w, keys)
+		if !errors.Is(err, transactions.ErrorConflict) {
+			if err == nil {
+				w.ops, w.bytes = map[string]bufOp{}, 0
+			}
+			return err
+		}
+	}
+}
+
+func bufApply(w *BufferedWriter, keys []string) error {
+	tx := DBTX{}
+	w.db.Begin(&tx)
+	for _, k := range keys {
+		op := w.ops[k]
+		rec, err := bufDecode(k, op)
+		if err == nil && op.del {
+			_, err = tx.Delete(op.table, rec)
+		} else if err == nil {
+			_, err = tx.Set(op.table, &DBUpdateReq{Record: rec})
+		}
+		if err != nil {
+			w.db.Abort(&tx)
+			return fmt.Errorf("flush: %s: %w", op.table, err)
+		}
+	}
+	return w.db.Commit(&tx)
+}
@@ -0,0 +1,197 @@
+package table
+
+import (
+	"fmt"
+	"math"
+	"slices"
+
+	"github.com/Adit0507/AdiDB/internal/btree_iter"
+)
+
+/*
+change data capture. the writes of a table with TableDef.Changes are added
+to @changes in the same transaction, so a change is committed with its row
+or not at all. the key of a change is (seq, prefix, n):
+- seq: the sequence number of the commit; see DB.Seq.
+- prefix: the primary key prefix of the table.
+- n: the order of the write in the transaction.
+the sequence is only known on commit, so it's added by KVTX.SetStamped.
+commits are serialized, so a reader never sees a change appear before the
+ones it has read.
+
+the changes of all tables are in commit order; ReadChanges of a table skips
+the others. TrimChanges deletes the changes that are consumed.
+*/
+
+// the operations in @changes
+const (
+	CHANGE_ADD    = 1
+	CHANGE_UPDATE = 2
+	CHANGE_DEL    = 3
+)
+
+type ChangeEvent struct {
+	Seq uint64 // the commit
+	Op  int    // CHANGE_*
+	Key Record // the primary key
+	Row Record // the new row with TableDef.ChangeValues; empty for CHANGE_DEL
+}
+
+// log a write of a row
+func changeAdd(tx *DBTX, tdef *TableDef, op int, key []byte, val []byte) error {
+	if !tdef.Changes {
+		return nil
+	}
+	if !tdef.ChangeValues || op == CHANGE_DEL {
+		val = nil
+	}
+	tx.nchanges++
+	ckey := encodeKey(nil, TDEF_CHANGES.Prefixes[0], []Value{
+		{Type: TYPE_INT64, I64: 0}, // the commit sequence is added to it
+		{Type: TYPE_INT64, I64: int64(tdef.Prefixes[0])},
+		{Type: TYPE_INT64, I64: tx.nchanges},
+	})
+	cval := encodeValues(nil, []Value{
+		{Type: TYPE_INT64, I64: int64(op)},
+		{Type: TYPE_BYTES, Str: key},
+		{Type: TYPE_BYTES, Str: val},
+	})
+	// the sequence is after the prefix and the type byte
+	return tx.kv.SetStamped(ckey, 4+1, cval)
+}
+
+// scan the changes of a table
+func changesScan(tx *DBTX, tdef *TableDef, fromSeq uint64, sc *Scanner) error {
+	prefix := int64(tdef.Prefixes[0])
+	*sc = Scanner{
+		Cmp1: btree_iter.CMP_GE,
+		Cmp2: btree_iter.CMP_LE,
+		Key1: *(&Record{}).AddInt64("seq", int64(min(fromSeq, math.MaxInt64))),
+		Filter: func(rec *Record) bool {
+			return rec.Get("prefix").I64 == prefix
+		},
+	}
+	return dbScan(tx, TDEF_CHANGES, sc)
+}
+
+// delete the changes of a dropped table
+func changesDrop(tx *DBTX, tdef *TableDef) error {
+	if !tdef.Changes {
+		return nil
+	}
+	sc := Scanner{}
+	if err := changesScan(tx, tdef, 0, &sc); err != nil {
+		return err
+	}
+	defer sc.Close()
+	keys := []Record{}
+	for ; sc.Valid(); sc.Next() {
+		rec := Record{}
+		if err := sc.Deref(&rec); err != nil {
+			return err
+		}
+		keys = append(keys, Record{TDEF_CHANGES.Indexes[0], rec.Vals[:3]})
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if _, err := dbDelete(tx, TDEF_CHANGES, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// iterates the changes of a table from a snapshot
+type ChangeIter struct {
+	tx     DBTX
+	tdef   *TableDef
+	sc     Scanner
+	closed bool
+}
+
+func (iter *ChangeIter) Valid() bool {
+	return iter.sc.Valid()
+}
+
+func (iter *ChangeIter) Next() {
+	iter.sc.Next()
+}
+
+// the error that stopped the iteration early, if any
+func (iter *ChangeIter) Err() error {
+	return iter.sc.Err()
+}
+
+// the current change
+func (iter *ChangeIter) Deref(ev *ChangeEvent) error {
+	rec := Record{}
+	if err := iter.sc.Deref(&rec); err != nil {
+		return err
+	}
+	tdef := iter.tdef
+	ev.Seq = uint64(rec.Get("seq").I64)
+	ev.Op = int(rec.Get("op").I64)
+	key, val := rec.Get("key").Str, rec.Get("val").Str
+
+	ev.Row = Record{}
+	if ev.Op != CHANGE_DEL && tdef.ChangeValues {
+		if err := rowDecode(tdef, key, val, &ev.Row, nil, nil); err != nil {
+			return err
+		}
+	}
+	ev.Key = Record{Cols: tdef.Indexes[0], Vals: make([]Value, len(tdef.Indexes[0]))}
+	for i, c := range tdef.Indexes[0] {
+		ev.Key.Vals[i].Type = tdef.Types[slices.Index(tdef.Cols, c)]
+	}
+	return rowCorrupt(tdef, key, decodeKey(key, ev.Key.Vals))
+}
+
+// end the snapshot
+func (iter *ChangeIter) Close() {
+	if !iter.closed {
+		iter.closed = true
+		iter.sc.Close()
+		iter.tx.db.Abort(&iter.tx)
+	}
+}
+
+// the changes of a table from the commit `fromSeq` on, in commit order.
+// the iterator reads a snapshot and must be closed.
+func (db *DB) ReadChanges(table string, fromSeq uint64) (*ChangeIter, error) {
+	iter := &ChangeIter{}
+	db.BeginRead(&iter.tx)
+	tdef, err := getTableDef(&iter.tx, table)
+	iter.tdef = tdef
+	switch {
+	case err != nil:
+	case !tdef.Changes:
+		err = fmt.Errorf("table has no change log: %s", table)
+	default:
+		err = changesScan(&iter.tx, iter.tdef, fromSeq, &iter.sc)
+	}
+	if err != nil {
+		db.Abort(&iter.tx)
+		return nil, err
+	}
+	return iter, nil
+}
+
+// delete the changes of all tables up to the commit `upToSeq`, which
+// should be consumed already. returns the number of changes deleted.
+func (db *DB) TrimChanges(upToSeq uint64) (int64, error) {
+	tx := DBTX{}
+	db.Begin(&tx)
+	key2 := (&Record{}).AddInt64("seq", int64(min(upToSeq, math.MaxInt64)))
+	count, err := tx.DeleteRange(TDEF_CHANGES.Name, Record{}, *key2,
+		btree_iter.CMP_GE, btree_iter.CMP_LE)
+	if err != nil {
+		db.Abort(&tx)
+		return 0, err
+	}
+	if err := db.Commit(&tx); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
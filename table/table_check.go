@@ -0,0 +1,177 @@
+package table
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/Adit0507/AdiDB/internal/btree_iter"
+	"github.com/Adit0507/AdiDB/internal/kv"
+)
+
+// a table or an index of it, by key prefix
+type checkDef struct {
+	tdef  *TableDef
+	index int
+}
+
+// verify the whole file: the B+tree, the free list, and that every key
+// decodes with its table schema. all problems found are returned.
+// meant to be run without concurrent writers.
+func (db *DB) Check() error {
+	tx := DBTX{}
+	db.BeginRead(&tx)
+	defs, errs := checkTableDefs(&tx)
+	db.Abort(&tx)
+
+	err := db.kv.Check(func(key []byte, val []byte) error {
+		return checkRow(defs, key, val)
+	})
+	return errors.Join(append(errs, err)...)
+}
+
+// the schemas by prefix
+func checkTableDefs(tx *DBTX) (map[uint32]checkDef, []error) {
+	defs := map[uint32]checkDef{}
+	errs := []error(nil)
+	add := func(tdef *TableDef) {
+		for i, prefix := range tdef.Prefixes {
+			if other, ok := defs[prefix]; ok {
+				errs = append(errs, fmt.Errorf("table %s: prefix %d is used by %s",
+					tdef.Name, prefix, other.tdef.Name))
+				continue
+			}
+			defs[prefix] = checkDef{tdef, i}
+		}
+	}
+	for _, tdef := range INTERNAL_TABLES {
+		add(tdef)
+	}
+
+	sc := Scanner{Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE}
+	if err := dbScan(tx, TDEF_TABLE, &sc); err != nil {
+		return defs, append(errs, err)
+	}
+	defer sc.Close()
+	for ; sc.Valid(); sc.Next() {
+		rec := Record{}
+		if err := sc.Deref(&rec); err != nil {
+			return defs, append(errs, err)
+		}
+		name := string(rec.Get("name").Str)
+		tdef, err := tableDefDecode(rec.Get("def").Str)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("table %s: bad schema: %w", name, err))
+			continue
+		}
+		if err := tableDefCheck(tdef); err != nil {
+			errs = append(errs, fmt.Errorf("table %s: bad schema: %w", name, err))
+			continue
+		}
+		if len(tdef.Prefixes) != len(tdef.Indexes) {
+			errs = append(errs, fmt.Errorf("table %s: bad schema: prefixes", name))
+			continue
+		}
+		add(tdef)
+	}
+	if err := sc.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	return defs, errs
+}
+
+// decode a KV with the schema of its prefix
+func checkRow(defs map[uint32]checkDef, key []byte, val []byte) error {
+	if len(key) < 4 {
+		return errors.New("no table prefix")
+	}
+	def, ok := defs[binary.BigEndian.Uint32(key)]
+	if !ok {
+		return fmt.Errorf("unknown table prefix: %d", binary.BigEndian.Uint32(key))
+	}
+	tdef := def.tdef
+
+	if def.index == 0 {
+		return rowDecode(tdef, key, val, &Record{}, nil, nil)
+	}
+	if len(val) != 0 {
+		return fmt.Errorf("table %s: index value is not empty", tdef.Name)
+	}
+	_, types := indexKeyCols(tdef, def.index)
+	vals := make([]Value, len(types))
+	for i, tp := range types {
+		vals[i].Type = tp
+	}
+	ikey, err := indexKeyAsc(tdef, def.index, key)
+	if err == nil {
+		err = decodeKey(ikey, vals)
+	}
+	return rowCorrupt(tdef, key, err)
+}
+
+type DumpOptions struct {
+	Prefix uint32 // only the keys of a table or index prefix; 0 for all
+}
+
+// write the pages of the file to `w`, with the keys decoded by the schema
+// of their prefix; see KV.DebugDump. safe beside concurrent writers, and
+// a bad schema or key is printed instead of failing the dump.
+func (db *DB) DebugDump(w io.Writer, opts DumpOptions) error {
+	tx := DBTX{}
+	db.BeginRead(&tx)
+	defs, errs := checkTableDefs(&tx)
+	db.Abort(&tx)
+	for _, err := range errs {
+		if _, err := fmt.Fprintf(w, "BAD: %v\n", err); err != nil {
+			return err
+		}
+	}
+
+	kvOpts := kv.KVDumpOptions{Key: func(key []byte) string {
+		return dumpKey(defs, key)
+	}}
+	if opts.Prefix != 0 {
+		kvOpts.Prefix = binary.BigEndian.AppendUint32(nil, opts.Prefix)
+	}
+	return db.kv.DebugDump(w, kvOpts)
+}
+
+// a key decoded with the schema of its prefix, as in checkRow
+func dumpKey(defs map[uint32]checkDef, key []byte) string {
+	if len(key) < 4 {
+		return "(no table prefix)"
+	}
+	def, ok := defs[binary.BigEndian.Uint32(key)]
+	if !ok {
+		return fmt.Sprintf("(unknown table prefix %d)", binary.BigEndian.Uint32(key))
+	}
+	tdef := def.tdef
+	index, types := indexKeyCols(tdef, def.index)
+	vals := make([]Value, len(types))
+	for i, tp := range types {
+		vals[i].Type = tp
+	}
+	ikey, err := indexKeyAsc(tdef, def.index, key)
+	if err == nil {
+		err = decodeKey(ikey, vals)
+	}
+	name := tdef.Name
+	if def.index > 0 {
+		name = fmt.Sprintf("%s index %d", tdef.Name, def.index)
+	}
+	if isComputed(tdef, def.index) {
+		index = slices.Clone(index)
+		index[0] = tdef.Computed[def.index].Func + "(...)"
+	}
+	if err != nil {
+		return fmt.Sprintf("%s (BAD: %v)", name, err)
+	}
+	cols := []string{}
+	for i, c := range index {
+		cols = append(cols, c+"="+valString(vals[i]))
+	}
+	return name + " (" + strings.Join(cols, ", ") + ")"
+}
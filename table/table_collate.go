@@ -0,0 +1,155 @@
+package table
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+)
+
+/*
+collations of the byte-string columns of secondary indexes, such as an
+index on emails that ignores the case. TableDef.Collations has an id per
+column of each index, COLLATE_BINARY when missing. the collation maps the
+value to the bytes stored in the index key, both when the keys of a row
+are written and when the range of a scan is encoded, so the index is
+ordered and compared by the mapped bytes while the row keeps the original
+ones. a unique index is unique under its collation.
+
+the primary key is not collated: it's the identity of a row, and a
+secondary index key ends with it to find the row.
+
+an index keeps the collation it was created with; CreateIndexCollate
+rejects an index on the same columns with another one. a custom collation
+is registered under an id from COLLATE_CUSTOM before a schema that uses
+it is read. it's stored by its id only, so its mapping must not change
+while an index uses it.
+*/
+
+const (
+	COLLATE_BINARY = 0 // the bytes as they are
+	COLLATE_NOCASE = 1 // ASCII letters in lower case
+	// the first id of RegisterCollation
+	COLLATE_CUSTOM = 1 << 16
+)
+
+var collations = struct {
+	sync.RWMutex
+	fns map[uint32]func([]byte) []byte
+}{fns: map[uint32]func([]byte) []byte{COLLATE_NOCASE: foldASCII}}
+
+func foldASCII(in []byte) []byte {
+	out := make([]byte, len(in))
+	for i, c := range in {
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		out[i] = c
+	}
+	return out
+}
+
+// add a collation for TableDef.Collations. `fn` returns new bytes and
+// must always map a value to the same bytes; see the top.
+func RegisterCollation(id uint32, fn func(in []byte) []byte) error {
+	if id < COLLATE_CUSTOM {
+		return fmt.Errorf("collation id is reserved: %d", id)
+	}
+	collations.Lock()
+	defer collations.Unlock()
+	if _, ok := collations.fns[id]; ok {
+		return fmt.Errorf("collation exists: %d", id)
+	}
+	collations.fns[id] = fn
+	return nil
+}
+
+func collationFn(id uint32) func([]byte) []byte {
+	collations.RLock()
+	defer collations.RUnlock()
+	return collations.fns[id]
+}
+
+// the collation of the column `i` of the index `idx`
+func collation(tdef *TableDef, idx int, i int) uint32 {
+	if idx < len(tdef.Collations) && i < len(tdef.Collations[idx]) {
+		return tdef.Collations[idx][i]
+	}
+	return COLLATE_BINARY
+}
+
+// the collations are known and on byte-string columns of secondary indexes
+func collateCheck(tdef *TableDef) error {
+	if len(tdef.Collations) > len(tdef.Indexes) {
+		return fmt.Errorf("bad table schema: %s: collations", tdef.Name)
+	}
+	for idx, ids := range tdef.Collations {
+		if len(ids) > len(tdef.Indexes[idx]) {
+			return fmt.Errorf("bad table schema: %s: collations", tdef.Name)
+		}
+		for i, id := range ids {
+			if id == COLLATE_BINARY {
+				continue
+			}
+			col := tdef.Indexes[idx][i]
+			if collationFn(id) == nil {
+				return fmt.Errorf("unknown collation: %d", id)
+			}
+			if slices.Contains(tdef.Indexes[0], col) {
+				return fmt.Errorf("primary key column cannot have a collation: %s", col)
+			}
+			if tdef.Types[slices.Index(tdef.Cols, col)] != TYPE_BYTES {
+				return fmt.Errorf("collation of a column that is not BYTES: %s", col)
+			}
+		}
+	}
+	return nil
+}
+
+// the index `idx` has the collations of `ids`, as in TableDef.Collations
+func collateEqual(tdef *TableDef, idx int, ids []uint32) bool {
+	for i := range tdef.Indexes[idx] {
+		id := uint32(COLLATE_BINARY)
+		if i < len(ids) {
+			id = ids[i]
+		}
+		if collation(tdef, idx, i) != id {
+			return false
+		}
+	}
+	return len(ids) <= len(tdef.Indexes[idx])
+}
+
+// the values of the leading columns of the index `idx` as they are in its
+// keys. `vals` is not modified.
+func collateVals(tdef *TableDef, idx int, vals []Value) []Value {
+	if idx >= len(tdef.Collations) {
+		return vals
+	}
+	out := []Value(nil)
+	for i := range vals {
+		id := collation(tdef, idx, i)
+		if id == COLLATE_BINARY || vals[i].Type != TYPE_BYTES {
+			continue
+		}
+		if out == nil {
+			out = slices.Clone(vals)
+		}
+		out[i].Str = collationFn(id)(vals[i].Str)
+	}
+	if out == nil {
+		return vals
+	}
+	return out
+}
+
+// the values of the index key of a row
+func indexValues(db *DB, tdef *TableDef, idx int, rec Record) ([]Value, error) {
+	if isComputed(tdef, idx) {
+		return computedValues(db, tdef, idx, rec)
+	}
+	vals, err := getValues(tdef, rec, tdef.Indexes[idx])
+	if err != nil {
+		return nil, err
+	}
+	return collateVals(tdef, idx, vals), nil
+}
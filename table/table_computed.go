@@ -0,0 +1,256 @@
+package table
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/Adit0507/AdiDB/internal/btree_iter"
+)
+
+/*
+computed indexes: a secondary index on a function of columns, such as
+the lower case of an email or the first bytes of a long URL, without a
+column that holds it. TableDef.Computed has, per index, the name of the
+function and the number of leading columns of the index that are its
+arguments. the keys of such an index are the value of the function
+followed by the primary key; the rows are unchanged.
+
+the functions are registered on the DB handle by name, with the type of
+their values, and the schema only refers to them by name. a schema is
+read without them, so a DB with a computed index opens before they are
+registered; the writes to the table and the scans of the index fail
+until the function is registered. a function must always map the same
+arguments to the same value, or the index will miss rows. it may give a
+null for no value, such as a missing field of a JSON document; the nulls
+sort first.
+
+the planner and the scans by columns never use a computed index, since
+its keys are not the columns. DBTX.ScanComputed and DBTX.GetByComputed
+take values of the argument columns and apply the function to them, as
+it's applied to the rows. CreateIndexFunc adds and backfills an index
+like CreateIndex; a computed index has no collations and no descending
+columns.
+*/
+
+// see TableDef.Computed
+type IndexFunc struct {
+	Func string // registered with DB.RegisterIndexFunc; "" for an index on the columns
+	Args int    // the leading columns of the index passed to it
+	Type uint32 // of its values
+}
+
+type indexFn struct {
+	tp uint32
+	fn func(args []Value) Value
+}
+
+// add a function for computed indexes; see the top
+func (db *DB) RegisterIndexFunc(name string, tp uint32, fn func(args []Value) Value) error {
+	if name == "" {
+		return fmt.Errorf("empty index function name")
+	}
+	if _, ok := typeNames[tp]; !ok || tp == TYPE_NULL {
+		return fmt.Errorf("bad index function type: %d", tp)
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.indexFns[name]; ok {
+		return fmt.Errorf("index function exists: %s", name)
+	}
+	if db.indexFns == nil {
+		db.indexFns = map[string]indexFn{}
+	}
+	db.indexFns[name] = indexFn{tp: tp, fn: fn}
+	return nil
+}
+
+func indexFnGet(db *DB, name string) (indexFn, error) {
+	if db != nil {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		if f, ok := db.indexFns[name]; ok {
+			return f, nil
+		}
+	}
+	return indexFn{}, fmt.Errorf("unknown index function: %s", name)
+}
+
+func isComputed(tdef *TableDef, idx int) bool {
+	return idx < len(tdef.Computed) && tdef.Computed[idx].Func != ""
+}
+
+// the functions fit the indexes; they are not looked up, see the top
+func computedCheck(tdef *TableDef) error {
+	if len(tdef.Computed) > len(tdef.Indexes) {
+		return fmt.Errorf("bad table schema: %s: computed", tdef.Name)
+	}
+	for idx, c := range tdef.Computed {
+		if c.Func == "" {
+			continue
+		}
+		bad := idx == 0 || c.Args < 1 || c.Args > len(tdef.Indexes[idx])
+		bad = bad || c.Type == TYPE_NULL || typeNames[c.Type] == ""
+		if bad {
+			return fmt.Errorf("bad computed index: %s: %s", tdef.Name, c.Func)
+		}
+		for i := range tdef.Indexes[idx] {
+			if collation(tdef, idx, i) != COLLATE_BINARY || isDesc(tdef, idx, i) {
+				return fmt.Errorf("computed index with a collation or an order: %s", c.Func)
+			}
+		}
+	}
+	return nil
+}
+
+// the index `idx` is computed by `fn` of its leading `args` columns; ""
+// for an index on the columns
+func computedEqual(tdef *TableDef, idx int, fn string, args int) bool {
+	if !isComputed(tdef, idx) {
+		return fn == ""
+	}
+	return tdef.Computed[idx].Func == fn && tdef.Computed[idx].Args == args
+}
+
+// the names and the types of the values of the keys of the index `idx`.
+// the value of a computed index is named "".
+func indexKeyCols(tdef *TableDef, idx int) ([]string, []uint32) {
+	cols := tdef.Indexes[idx]
+	types := []uint32(nil)
+	if isComputed(tdef, idx) {
+		cols = append([]string{""}, tdef.Indexes[0]...)
+		types = append(types, tdef.Computed[idx].Type)
+	}
+	for _, c := range cols[len(types):] {
+		types = append(types, tdef.Types[slices.Index(tdef.Cols, c)])
+	}
+	return cols, types
+}
+
+// the value of the function of a computed index for the values of its
+// argument columns
+func computedValue(db *DB, tdef *TableDef, idx int, args []Value) (Value, error) {
+	c := tdef.Computed[idx]
+	f, err := indexFnGet(db, c.Func)
+	if err != nil {
+		return Value{}, err
+	}
+	v := f.fn(args)
+	if v.Type != c.Type && v.Type != TYPE_NULL {
+		return Value{}, fmt.Errorf("index function %s: %s, not %s",
+			c.Func, typeName(v.Type), typeName(c.Type))
+	}
+	return v, nil
+}
+
+// the values of the key of a row in a computed index
+func computedValues(db *DB, tdef *TableDef, idx int, rec Record) ([]Value, error) {
+	args, err := getValues(tdef, rec, tdef.Indexes[idx][:tdef.Computed[idx].Args])
+	if err != nil {
+		return nil, err
+	}
+	v, err := computedValue(db, tdef, idx, args)
+	if err != nil {
+		return nil, err
+	}
+	pk, err := getValues(tdef, rec, tdef.Indexes[0])
+	if err != nil {
+		return nil, err
+	}
+	return append([]Value{v}, pk...), nil
+}
+
+// add a computed index on `fn` of `cols` and fill it with the existing
+// rows, like CreateIndexCtx. `fn` must be registered.
+func (db *DB) CreateIndexFunc(ctx context.Context, table string, fn string, cols []string, unique bool) error {
+	if _, err := indexFnGet(db, fn); err != nil {
+		return err
+	}
+	return indexCreate(ctx, db, table, cols, nil, nil, fn, unique)
+}
+
+// the computed index of `fn` whose arguments are the columns of `args`,
+// in any order, and the arguments in the order of the index
+func computedFind(tdef *TableDef, fn string, args Record) (int, []Value, error) {
+	for i := range tdef.Indexes {
+		if !isComputed(tdef, i) || isBuilding(tdef, i) || tdef.Computed[i].Func != fn {
+			continue
+		}
+		cols := tdef.Indexes[i][:tdef.Computed[i].Args]
+		missing := slices.ContainsFunc(cols, func(c string) bool { return args.Get(c) == nil })
+		if len(cols) == len(args.Cols) && !missing {
+			vals, err := getValues(tdef, args, cols)
+			return i, vals, err
+		}
+	}
+	return 0, nil, fmt.Errorf("%w: no computed index of %s on %v", ErrBadRange, fn, args.Cols)
+}
+
+// scan the rows by the computed index of `fn`: Key1 and Key2 of `sc` are
+// values of its argument columns, the function is applied to them, and
+// the range is of its values, compared by Cmp1 and Cmp2. the other
+// options are as in Scan.
+func (tx *DBTX) ScanComputed(table string, fn string, sc *Scanner) error {
+	tdef, err := getTableDef(tx, table)
+	if err != nil {
+		return err
+	}
+	sc.plan = nil
+	switch {
+	case sc.Cmp1 > 0 && sc.Cmp2 < 0:
+	case sc.Cmp1 < 0 && sc.Cmp2 > 0:
+	default:
+		return ErrBadRange
+	}
+	if err := scanCheck(tdef, sc); err != nil {
+		return err
+	}
+
+	idx, args1, err := computedFind(tdef, fn, sc.Key1)
+	if err != nil {
+		return err
+	}
+	idx2, args2, err := computedFind(tdef, fn, sc.Key2)
+	if err != nil {
+		return err
+	}
+	if idx2 != idx {
+		return fmt.Errorf("%w: the bounds are of 2 indexes", ErrBadRange)
+	}
+	v1, err := computedValue(tx.db, tdef, idx, args1)
+	if err != nil {
+		return err
+	}
+	v2, err := computedValue(tx.db, tdef, idx, args2)
+	if err != nil {
+		return err
+	}
+
+	sc.index = idx
+	sc.cmp1, sc.cmp2 = sc.Cmp1, sc.Cmp2
+	if sc.Desc && sc.Cmp1 > 0 {
+		v1, v2 = v2, v1
+		sc.cmp1, sc.cmp2 = sc.Cmp2, sc.Cmp1
+	}
+	keyStart := indexKeyPartial(nil, tdef, idx, []Value{v1}, sc.cmp1)
+	keyEnd := indexKeyPartial(nil, tdef, idx, []Value{v2}, sc.cmp2)
+	sc.tx, sc.tdef = tx, tdef
+	return scanSeek(tx, sc, keyStart, keyEnd)
+}
+
+// the first row, in the order of the index, whose value of the computed
+// index of `fn` is the one of `args`, values of its argument columns
+func (tx *DBTX) GetByComputed(table string, fn string, args Record, rec *Record) (bool, error) {
+	sc := Scanner{
+		Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE,
+		Key1: args, Key2: args, Limit: 1,
+	}
+	if err := tx.ScanComputed(table, fn, &sc); err != nil {
+		return false, err
+	}
+	defer sc.Close()
+	if !sc.Valid() {
+		return false, sc.Err()
+	}
+	return true, sc.Deref(rec)
+}
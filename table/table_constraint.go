@@ -0,0 +1,119 @@
+package table
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+/*
+column constraints, checked on every write before anything is stored.
+the declarative ones are in the schema (TableDef.Checks); the others are Go
+functions registered on the DB handle with AddValidator, which are not
+stored and must be registered again after Open. both see the row as it is
+written, so a partial update is checked with the columns it keeps and an
+omitted column with its default. a NULL is not checked.
+
+a violation is a *ValidationError naming the column that wraps
+ErrConstraint.
+*/
+
+var ErrConstraint = errors.New("constraint violation")
+
+// declarative checks of a column
+type Check struct {
+	Col      string
+	NonEmpty bool   `json:",omitempty"` // TYPE_BYTES
+	Min      *int64 `json:",omitempty"` // TYPE_INT64, inclusive
+	Max      *int64 `json:",omitempty"` // TYPE_INT64, inclusive
+}
+
+// a validator of the values of a column
+type Validator func(v Value) error
+
+// add a validator of a column, run after the checks of the schema.
+// the validators of a column run in the order they are added.
+func (db *DB) AddValidator(table string, col string, fn Validator) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.validators == nil {
+		db.validators = map[string]map[string][]Validator{}
+	}
+	// a copy, the old one may be in use by a write
+	cols := maps.Clone(db.validators[table])
+	if cols == nil {
+		cols = map[string][]Validator{}
+	}
+	cols[col] = append(slices.Clip(cols[col]), fn)
+	db.validators[table] = cols
+}
+
+// the validators of a table, by column
+func tableValidators(db *DB, table string) map[string][]Validator {
+	if db == nil {
+		return nil
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.validators[table]
+}
+
+// the checks fit the column types
+func checksCheck(tdef *TableDef) error {
+	for _, c := range tdef.Checks {
+		idx := slices.Index(tdef.Cols, c.Col)
+		if idx < 0 {
+			return fmt.Errorf("unknown check column: %s", c.Col)
+		}
+		tp := tdef.Types[idx]
+		bad := c.NonEmpty && tp != TYPE_BYTES
+		bad = bad || (c.Min != nil || c.Max != nil) && tp != TYPE_INT64
+		bad = bad || c.Min != nil && c.Max != nil && *c.Min > *c.Max
+		if bad {
+			return fmt.Errorf("bad check: %s", c.Col)
+		}
+	}
+	return nil
+}
+
+func checkOne(c *Check, v Value) error {
+	switch {
+	case c.NonEmpty && len(v.Str) == 0:
+		return fmt.Errorf("%w: %s is empty", ErrConstraint, c.Col)
+	case c.Min != nil && v.I64 < *c.Min:
+		return fmt.Errorf("%w: %s is less than %d", ErrConstraint, c.Col, *c.Min)
+	case c.Max != nil && v.I64 > *c.Max:
+		return fmt.Errorf("%w: %s is more than %d", ErrConstraint, c.Col, *c.Max)
+	}
+	return nil
+}
+
+// run the checks and the validators on the columns of the record
+func checkConstraints(db *DB, tdef *TableDef, rec Record) error {
+	validators := tableValidators(db, tdef.Name)
+	if len(tdef.Checks) == 0 && len(validators) == 0 {
+		return nil
+	}
+	for i, col := range rec.Cols {
+		v := rec.Vals[i]
+		if v.Type == TYPE_NULL {
+			continue
+		}
+		idx := slices.Index(tdef.Cols, col)
+		for j := range tdef.Checks {
+			if tdef.Checks[j].Col != col {
+				continue
+			}
+			if err := checkOne(&tdef.Checks[j], v); err != nil {
+				return errColumn(tdef, idx, &v, err)
+			}
+		}
+		for _, fn := range validators[col] {
+			if err := fn(v); err != nil {
+				return errColumn(tdef, idx, &v, fmt.Errorf("%w: %s: %w", ErrConstraint, col, err))
+			}
+		}
+	}
+	return nil
+}
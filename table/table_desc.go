@@ -0,0 +1,132 @@
+package table
+
+import (
+	"encoding/binary"
+	"fmt"
+	"slices"
+
+	"github.com/Adit0507/AdiDB/internal/btree_iter"
+)
+
+/*
+descending columns of secondary indexes, such as an index on (device,
+time DESC) whose forward scan gives the latest rows of a device first.
+TableDef.Descending has a flag per column of each index, ascending when
+missing.
+
+a descending value is stored with the bytes after its type tag inverted,
+so the keys, compared as bytes, are in the declared order. the inverted
+string of a BYTES value ends with 0xff instead of 0, and its escaped bytes
+are below 0xff, so a string still sorts after its extensions, which is
+the reverse of their order. the tag is kept, and the values of an index
+column all have the same type, so the tags don't change the order. an
+index key is restored before it's decoded.
+
+the range of a scan is in the order of its index: on a descending column,
+Key1 of a forward scan is the largest value, as in (device = 1, time <=
+t1) .. (device = 1, time >= t0) for the rows of [t0, t1] newest first.
+the planner turns the conditions on the columns into such ranges.
+
+the primary key is not descending: it's the identity of a row, and a
+secondary index key ends with it to find the row.
+*/
+
+// the column `i` of the index `idx` is descending
+func isDesc(tdef *TableDef, idx int, i int) bool {
+	return idx < len(tdef.Descending) && i < len(tdef.Descending[idx]) && tdef.Descending[idx][i]
+}
+
+func hasDesc(tdef *TableDef, idx int) bool {
+	return idx < len(tdef.Descending) && slices.Contains(tdef.Descending[idx], true)
+}
+
+// the flags fit the indexes, and the primary key is ascending
+func descCheck(tdef *TableDef) error {
+	if len(tdef.Descending) > len(tdef.Indexes) {
+		return fmt.Errorf("bad table schema: %s: descending", tdef.Name)
+	}
+	for idx, flags := range tdef.Descending {
+		if len(flags) > len(tdef.Indexes[idx]) {
+			return fmt.Errorf("bad table schema: %s: descending", tdef.Name)
+		}
+		if idx == 0 && slices.Contains(flags, true) {
+			return fmt.Errorf("primary key column cannot be descending: %s", tdef.Name)
+		}
+	}
+	return nil
+}
+
+// the index `idx` has the directions of `flags`, as in TableDef.Descending
+func descEqual(tdef *TableDef, idx int, flags []bool) bool {
+	for i := range tdef.Indexes[idx] {
+		if isDesc(tdef, idx, i) != (i < len(flags) && flags[i]) {
+			return false
+		}
+	}
+	return len(flags) <= len(tdef.Indexes[idx])
+}
+
+// encodeKey for the leading columns of the index `idx`
+func indexKey(out []byte, tdef *TableDef, idx int, vals []Value) []byte {
+	if !hasDesc(tdef, idx) {
+		return encodeKey(out, tdef.Prefixes[idx], vals)
+	}
+	out = binary.BigEndian.AppendUint32(out, tdef.Prefixes[idx])
+	for i := range vals {
+		start := len(out)
+		out = encodeValues(out, vals[i:i+1])
+		if isDesc(tdef, idx, i) {
+			descInvert(out[start+1:])
+		}
+	}
+	return out
+}
+
+// encodeKeyPartial for the leading columns of the index `idx`
+func indexKeyPartial(out []byte, tdef *TableDef, idx int, vals []Value, cmp int) []byte {
+	out = indexKey(out, tdef, idx, vals)
+	if cmp == btree_iter.CMP_GT || cmp == btree_iter.CMP_LE {
+		out = append(out, 0xff)
+	}
+	return out
+}
+
+// a key of the index `idx` with the descending values restored, for
+// decodeKey. it's a copy if it has any.
+func indexKeyAsc(tdef *TableDef, idx int, key []byte) ([]byte, error) {
+	if !hasDesc(tdef, idx) {
+		return key, nil
+	}
+	if len(key) < 4 {
+		return nil, errCorrupt("no table prefix")
+	}
+	out := slices.Clone(key)
+	in := out[4:]
+	for i, c := range tdef.Indexes[idx] {
+		tp := tdef.Types[slices.Index(tdef.Cols, c)]
+		if len(in) == 0 || uint32(in[0]) != tp {
+			return nil, errCorrupt("value %d: bad type", i)
+		}
+		n := encodedLen(tp, in[1:])
+		if isDesc(tdef, idx, i) && tp == TYPE_BYTES {
+			n = -1
+			if end := slices.Index(in[1:], 0xff); end >= 0 {
+				n = end + 1 // the inverted terminator
+			}
+		}
+		if n < 0 {
+			return nil, errCorrupt("value %d: bad or truncated value of type %d", i, tp)
+		}
+		if isDesc(tdef, idx, i) {
+			descInvert(in[1 : 1+n])
+		}
+		in = in[1+n:]
+	}
+	return out, nil
+}
+
+func descInvert(b []byte) {
+	for i := range b {
+		b[i] = ^b[i]
+	}
+}
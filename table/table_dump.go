@@ -0,0 +1,404 @@
+package table
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+
+	"github.com/Adit0507/AdiDB/internal/btree_iter"
+)
+
+/*
+a logical dump: the user tables as JSON lines, for moving the data
+between format versions and for reading a DB in a diff. the output is
+the same for the same rows:
+- the 1st line is the header, {"dump":"AdiDB","version":1}.
+- a table is a line with the schema, without the prefixes, and the
+  auto-increment counter if there's one, then a line per row, in primary
+  key order.
+- the tables are in name order.
+a row is an array of the values in the order of the columns:
+- NULL is null, BOOL is a JSON bool.
+- INT64 and TIMESTAMP are JSON numbers.
+- BYTES is a base64 string, so the dump is valid UTF-8.
+- JSON is a string of the document.
+- FLOAT64 is a JSON number, or "+Inf" or "-Inf".
+
+the internal tables are not dumped. the row counters are rebuilt by the
+restore, and the change logs start over.
+*/
+
+const DUMP_VERSION = 1
+
+// the rows written per transaction by a restore that doesn't bulk load
+const RESTORE_BATCH = 1000
+
+type dumpHeader struct {
+	Dump    string `json:"dump"`
+	Version int    `json:"version"`
+}
+
+type dumpTable struct {
+	Table   *TableDef `json:"table"`
+	AutoInc int64     `json:"autoinc,omitempty"` // the next generated key
+}
+
+type RestoreOptions struct {
+	// add the rows to the tables that exist, replacing the rows with the
+	// same primary keys. without it, the DB must have no tables.
+	Merge bool
+}
+
+// write the user tables in a snapshot; see the format above
+func (db *DB) Dump(w io.Writer) error {
+	tx := DBTX{}
+	db.BeginRead(&tx)
+	defer db.Abort(&tx)
+
+	bw := bufio.NewWriter(w)
+	if err := dumpLine(bw, dumpHeader{Dump: "AdiDB", Version: DUMP_VERSION}); err != nil {
+		return err
+	}
+	names, err := tx.ListTables()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := dumpRows(&tx, bw, name); err != nil {
+			return fmt.Errorf("dump %s: %w", name, err)
+		}
+	}
+	return bw.Flush()
+}
+
+func dumpLine(bw *bufio.Writer, v any) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	bw.Write(line)
+	return bw.WriteByte('\n')
+}
+
+func dumpRows(tx *DBTX, bw *bufio.Writer, name string) error {
+	tdef, err := tx.GetTableDef(name)
+	if err != nil {
+		return err
+	}
+	counter, err := autoIncCounter(tx, tdef)
+	if err != nil {
+		return err
+	}
+	sc := Scanner{Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE}
+	if err := dbScan(tx, tdef, &sc); err != nil {
+		return err
+	}
+	defer sc.Close()
+
+	ndef := *tdef
+	ndef.Prefixes = nil
+	ndef.Building = nil // the restore writes all index keys
+	if err := dumpLine(bw, dumpTable{Table: &ndef, AutoInc: counter}); err != nil {
+		return err
+	}
+	for ; sc.Valid(); sc.Next() {
+		rec := Record{}
+		if err := sc.Deref(&rec); err != nil {
+			return err
+		}
+		row := make([]any, len(tdef.Cols))
+		for i, col := range tdef.Cols {
+			if row[i], err = dumpValue(rec.Get(col)); err != nil {
+				return err
+			}
+		}
+		if err := dumpLine(bw, row); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+// the value for encoding/json
+func dumpValue(v *Value) (any, error) {
+	switch v.Type {
+	case TYPE_NULL:
+		return nil, nil
+	case TYPE_BYTES:
+		return v.Str, nil // base64
+	case TYPE_JSON:
+		return string(v.Str), nil
+	case TYPE_INT64, TYPE_TIMESTAMP:
+		return v.I64, nil
+	case TYPE_BOOL:
+		return v.I64 == 1, nil
+	case TYPE_FLOAT64:
+		if math.IsInf(v.F64, 0) {
+			return strconv.FormatFloat(v.F64, 'g', -1, 64), nil
+		}
+		return v.F64, nil
+	default:
+		return nil, fmt.Errorf("bad value type: %d", v.Type)
+	}
+}
+
+// the counter of an auto-increment table, 0 if none
+func autoIncCounter(tx *DBTX, tdef *TableDef) (int64, error) {
+	if !tdef.AutoInc {
+		return 0, nil
+	}
+	meta := (&Record{}).AddStr("key", autoIncKey(tdef.Name))
+	ok, err := dbGet(tx, TDEF_META, meta)
+	if err != nil || !ok {
+		return 0, err
+	}
+	return autoIncDecode(tdef.Name, meta.Get("val").Str)
+}
+
+// the lines of a dump, with a line of lookahead
+type dumpReader struct {
+	br   *bufio.Reader
+	line []byte // the next line; nil at the end
+	n    int    // of the next line
+	err  error
+}
+
+func (r *dumpReader) next() {
+	line, err := r.br.ReadBytes('\n')
+	r.n++
+	switch {
+	case err == io.EOF && len(line) == 0:
+		r.line = nil
+	case err != nil && err != io.EOF:
+		r.line, r.err = nil, err
+	default:
+		r.line = bytes.TrimSuffix(line, []byte("\n"))
+	}
+}
+
+func (r *dumpReader) fail(err error) {
+	if r.err == nil {
+		r.err = fmt.Errorf("line %d: %w", r.n, err)
+	}
+	r.line = nil
+}
+
+func (r *dumpReader) isRow() bool {
+	return len(r.line) > 0 && r.line[0] == '['
+}
+
+// the next row of the table, false at the next table or the end
+func (r *dumpReader) row(tdef *TableDef) (*Record, bool) {
+	if !r.isRow() {
+		return nil, false
+	}
+	vals, err := restoreRow(tdef, r.line)
+	if err != nil {
+		r.fail(err)
+		return nil, false
+	}
+	r.next()
+	return &Record{Cols: tdef.Cols, Vals: vals}, true
+}
+
+func restoreRow(tdef *TableDef, line []byte) ([]Value, error) {
+	dec := json.NewDecoder(bytes.NewReader(line))
+	dec.UseNumber()
+	row := []any{}
+	if err := dec.Decode(&row); err != nil {
+		return nil, err
+	}
+	if len(row) != len(tdef.Cols) {
+		return nil, errors.New("wrong number of values")
+	}
+	vals := make([]Value, len(row))
+	for i := range row {
+		if err := restoreValue(tdef.Types[i], row[i], &vals[i]); err != nil {
+			return nil, fmt.Errorf("column %s: %w", tdef.Cols[i], err)
+		}
+	}
+	return vals, nil
+}
+
+func restoreValue(tp uint32, in any, v *Value) (err error) {
+	*v = Value{Type: tp}
+	switch x := in.(type) {
+	case nil:
+		v.Type = TYPE_NULL
+	case bool:
+		if tp != TYPE_BOOL {
+			return errors.New("bad value")
+		}
+		if x {
+			v.I64 = 1
+		}
+	case json.Number:
+		switch tp {
+		case TYPE_INT64, TYPE_TIMESTAMP:
+			v.I64, err = strconv.ParseInt(string(x), 10, 64)
+		case TYPE_FLOAT64:
+			v.F64, err = strconv.ParseFloat(string(x), 64)
+		default:
+			err = errors.New("bad value")
+		}
+	case string:
+		switch tp {
+		case TYPE_BYTES:
+			v.Str, err = base64.StdEncoding.DecodeString(x)
+		case TYPE_JSON:
+			v.Str = []byte(x)
+		case TYPE_FLOAT64:
+			if x != "+Inf" && x != "-Inf" {
+				return errors.New("bad value")
+			}
+			v.F64, err = strconv.ParseFloat(x, 64)
+		default:
+			err = errors.New("bad value")
+		}
+	default:
+		err = errors.New("bad value")
+	}
+	return err
+}
+
+// add the output of Dump. new tables are bulk loaded unless they have a
+// change log. it's not atomic: a failed restore leaves the tables before
+// the error, and the rows already written to the current one.
+func (db *DB) Restore(r io.Reader, opts RestoreOptions) error {
+	dr := &dumpReader{br: bufio.NewReader(r)}
+	dr.next()
+	hdr := dumpHeader{}
+	if dr.line == nil || json.Unmarshal(dr.line, &hdr) != nil || hdr.Dump != "AdiDB" {
+		if dr.err != nil {
+			return dr.err
+		}
+		return errors.New("restore: not a dump")
+	}
+	if hdr.Version != DUMP_VERSION {
+		return fmt.Errorf("restore: unknown dump version %d", hdr.Version)
+	}
+
+	if !opts.Merge {
+		tx := DBTX{}
+		db.BeginRead(&tx)
+		names, err := tx.ListTables()
+		db.Abort(&tx)
+		if err != nil {
+			return err
+		}
+		if len(names) > 0 {
+			return errors.New("restore: the DB has tables; see RestoreOptions.Merge")
+		}
+	}
+
+	for dr.next(); dr.line != nil; {
+		line := dumpTable{}
+		if err := json.Unmarshal(dr.line, &line); err != nil || line.Table == nil {
+			dr.fail(errors.New("bad table"))
+			break
+		}
+		dr.next()
+		if err := restoreTable(db, dr, line, opts); err != nil {
+			return fmt.Errorf("restore %s: %w", line.Table.Name, err)
+		}
+	}
+	if dr.err != nil {
+		return fmt.Errorf("restore: %w", dr.err)
+	}
+	return nil
+}
+
+// create or check the table, then add its rows
+func restoreTable(db *DB, dr *dumpReader, line dumpTable, opts RestoreOptions) error {
+	tdef := line.Table
+	tdef.Prefixes = nil
+	tx := DBTX{}
+	db.Begin(&tx)
+	created := false
+	cur, err := getTableDef(&tx, tdef.Name)
+	if err != nil && !errors.Is(err, ErrTableNotFound) {
+		db.Abort(&tx)
+		return err
+	}
+	if cur == nil {
+		created = true
+		if err := tx.TableNew(tdef); err != nil {
+			db.Abort(&tx)
+			return err
+		}
+	} else {
+		cur, _ = tx.GetTableDef(tdef.Name)
+		tdef.Prefixes = cur.Prefixes
+		if err := tableDefCheck(tdef); err != nil || !tableDefSame(cur, tdef) {
+			db.Abort(&tx)
+			return errors.New("the schema differs from the dump")
+		}
+	}
+	if err := db.Commit(&tx); err != nil {
+		return err
+	}
+
+	if created && !tdef.Changes {
+		_, err := db.Load(tdef.Name, func() (*Record, bool) { return dr.row(tdef) })
+		if err == nil {
+			err = dr.err
+		}
+		if err != nil {
+			return err
+		}
+	} else {
+		for dr.isRow() {
+			err := db.WriteBatch(func(b *Batch) error {
+				for i := 0; i < RESTORE_BATCH; i++ {
+					rec, ok := dr.row(tdef)
+					if !ok {
+						return dr.err
+					}
+					dbreq := DBUpdateReq{Record: *rec, KeepTimes: true, KeepVersion: true}
+					if _, err := b.Set(tdef.Name, &dbreq); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if line.AutoInc > 0 {
+		return restoreAutoInc(db, tdef, line.AutoInc, created)
+	}
+	return nil
+}
+
+// same schema, with the stored form of the indexes
+func tableDefSame(a *TableDef, b *TableDef) bool {
+	val1, err1 := json.Marshal(a)
+	val2, err2 := json.Marshal(b)
+	return err1 == nil && err2 == nil && bytes.Equal(val1, val2)
+}
+
+// the counter from the dump; a merge only moves it forward
+func restoreAutoInc(db *DB, tdef *TableDef, counter int64, created bool) error {
+	tx := DBTX{}
+	db.Begin(&tx)
+	cur, err := autoIncCounter(&tx, tdef)
+	if err == nil && (created || counter > cur) {
+		val := binary.LittleEndian.AppendUint64(nil, uint64(counter))
+		meta := (&Record{}).AddStr("key", autoIncKey(tdef.Name)).AddStr("val", val)
+		_, err = dbUpdate(&tx, TDEF_META, &DBUpdateReq{Record: *meta})
+	}
+	if err != nil {
+		db.Abort(&tx)
+		return err
+	}
+	return db.Commit(&tx)
+}
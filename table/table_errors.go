@@ -0,0 +1,184 @@
+package table
+
+import (
+	"errors"
+	"fmt"
+)
+
+/*
+errors to branch on with errors.Is and errors.As; the messages are for
+humans and may change. they are wrapped with the names of the tables and
+the columns, like "table not found: users".
+
+a write refused by its mode fails with ErrRecordExists for
+MODE_INSERT_ONLY and ErrRecordNotFound for MODE_UPDATE_ONLY, as do the
+calls that need the row, such as partial updates and Increment. Delete
+still reports a missing row with `false`.
+*/
+
+var (
+	ErrTableNotFound  = errors.New("table not found")
+	ErrTableExists    = errors.New("table exists")
+	ErrRecordExists   = errors.New("row exists")
+	ErrRecordNotFound = errors.New("row not found")
+	// the range of a scan can't be used: bad comparisons, or keys that
+	// are not a prefix of an index
+	ErrBadRange = errors.New("bad range")
+	// a row, an index key or a schema in the file doesn't decode. it's
+	// wrapped with what was read, such as the key.
+	ErrCorrupt = errors.New("corrupt data")
+)
+
+// a value, or a new column, that is not of the column type
+type ErrBadColumnType struct {
+	Col string
+}
+
+func (e *ErrBadColumnType) Error() string {
+	return "bad column type: " + e.Col
+}
+
+// errors.Is matches any column with an empty Col
+func (e *ErrBadColumnType) Is(target error) bool {
+	t, ok := target.(*ErrBadColumnType)
+	return ok && (t.Col == "" || t.Col == e.Col)
+}
+
+// a byte string longer than the limit of its column; see TableDef.MaxLen
+type ErrValueTooLong struct {
+	Col string
+	Max int
+}
+
+func (e *ErrValueTooLong) Error() string {
+	return fmt.Sprintf("value too long: %s (max %d bytes)", e.Col, e.Max)
+}
+
+func (e *ErrValueTooLong) Is(target error) bool {
+	t, ok := target.(*ErrValueTooLong)
+	return ok && (t.Col == "" || t.Col == e.Col)
+}
+
+// the record of a write or a delete has another version than the row;
+// see table_version.go
+var ErrVersionMismatch = errors.New("row version mismatch")
+
+type VersionError struct {
+	Table    string
+	Expected int64 // of the record
+	Current  int64 // of the row; 0 if it doesn't exist
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("table %s: %v: expected %d, current %d",
+		e.Table, ErrVersionMismatch, e.Expected, e.Current)
+}
+
+func (e *VersionError) Unwrap() error {
+	return ErrVersionMismatch
+}
+
+// a record without a column that it needs
+type ErrMissingColumn struct {
+	Col string
+}
+
+func (e *ErrMissingColumn) Error() string {
+	return "missing column: " + e.Col
+}
+
+func (e *ErrMissingColumn) Is(target error) bool {
+	t, ok := target.(*ErrMissingColumn)
+	return ok && (t.Col == "" || t.Col == e.Col)
+}
+
+// a field that is not a column of the table, such as a key of RecordFromMap
+type ErrUnknownColumn struct {
+	Col string
+}
+
+func (e *ErrUnknownColumn) Error() string {
+	return "unknown column: " + e.Col
+}
+
+func (e *ErrUnknownColumn) Is(target error) bool {
+	t, ok := target.(*ErrUnknownColumn)
+	return ok && (t.Col == "" || t.Col == e.Col)
+}
+
+// a record that doesn't fit the schema. Err is the reason, such as
+// *ErrBadColumnType or *ErrMissingColumn, and is matched by errors.Is
+// and errors.As. the batch calls check every record first and return the
+// failures together with errors.Join.
+type ValidationError struct {
+	Table  string
+	Col    string
+	Want   uint32 // the column type
+	Got    uint32 // the value type; 0 for a missing value
+	Record int    // the index in a batch, or -1
+	Err    error
+}
+
+func (e *ValidationError) Error() string {
+	msg := "table " + e.Table + ": "
+	if e.Record >= 0 {
+		msg += fmt.Sprintf("record %d: ", e.Record)
+	}
+	msg += e.Err.Error()
+	if e.Got != 0 && e.Got != TYPE_NULL && e.Got != e.Want {
+		msg += fmt.Sprintf(" (%s, not %s)", typeName(e.Want), typeName(e.Got))
+	}
+	return msg
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+var typeNames = map[uint32]string{
+	TYPE_BYTES:     "BYTES",
+	TYPE_INT64:     "INT64",
+	TYPE_NULL:      "NULL",
+	TYPE_FLOAT64:   "FLOAT64",
+	TYPE_BOOL:      "BOOL",
+	TYPE_TIMESTAMP: "TIMESTAMP",
+	TYPE_JSON:      "JSON",
+}
+
+func typeName(tp uint32) string {
+	if name, ok := typeNames[tp]; ok {
+		return name
+	}
+	return fmt.Sprintf("type %d", tp)
+}
+
+// the column `col` of the schema, with the value `v` if there is one
+func errColumn(tdef *TableDef, col int, v *Value, err error) *ValidationError {
+	e := &ValidationError{Table: tdef.Name, Col: tdef.Cols[col], Want: tdef.Types[col], Record: -1, Err: err}
+	if v != nil {
+		e.Got = v.Type
+	}
+	return e
+}
+
+// the record index of the validation errors in `err`, for the batches
+func errRecord(err error, i int) error {
+	verr := (*ValidationError)(nil)
+	if errors.As(err, &verr) {
+		verr.Record = i
+		return err
+	}
+	return fmt.Errorf("record %d: %w", i, err)
+}
+
+func errTableNotFound(name string) error {
+	return fmt.Errorf("%w: %s", ErrTableNotFound, name)
+}
+
+func errCorrupt(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrCorrupt, fmt.Sprintf(format, args...))
+}
+
+// a write of a BufferedWriter was buffered, but the flush it started
+// failed; it's wrapped with the error of the flush. see table_buffer.go
+var ErrNotFlushed = errors.New("buffered but not flushed")
@@ -0,0 +1,21 @@
+package table
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// drop the pages of a closed file from the page cache, so the next reads
+// are from the disk
+func evictFile(path string) (bool, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer fp.Close()
+	if err := fp.Sync(); err != nil {
+		return false, err
+	}
+	return true, unix.Fadvise(int(fp.Fd()), 0, 0, unix.FADV_DONTNEED)
+}
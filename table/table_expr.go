@@ -0,0 +1,486 @@
+package table
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/Adit0507/AdiDB/internal/btree_iter"
+)
+
+/*
+filter expressions, a text form of Scanner.Filter that can be sent over
+the network or written in a WHERE. the grammar:
+
+	expr   := and { OR and }
+	and    := not { AND not }
+	not    := NOT not | ( expr ) | column op literal | column STARTS WITH string
+	column := name { . key }
+	op     := = | != | < | <= | > | >=
+
+a literal is an integer, a decimal, a string in '' or "" with the escapes
+of the SQL layer (\' \" \\ \n \t \xHH), TRUE, FALSE or NULL. the keywords
+are in any case. a malformed expression is an *ExprError with the byte
+offset of the problem.
+
+the columns and the literals are checked against the schema when the scan
+starts: an integer is taken by INT64, TIMESTAMP and FLOAT64 columns, a
+decimal by FLOAT64, a string by BYTES, TRUE and FALSE, or 1 and 0, by BOOL. STARTS WITH
+is for BYTES. `= NULL` and `!= NULL` test for null; otherwise a
+comparison with a null is unknown, as in SQL: NOT of it is unknown too,
+AND and OR are unknown unless the other side decides, and a row whose
+expression is unknown doesn't match. so a null matches no comparison,
+even under NOT, as with the conditions of Find.
+
+a column with keys after dots, like payload.user.id, is a field of a JSON
+column, as in Value.JSONGet. the keys are names or array positions. the
+literal is not converted, and is compared with the field as described in
+table_jsondoc.go; a missing field is null.
+
+an expression is parsed into a slice of nodes, and bound to a table into
+a copy with the column positions and the converted literals, so a row is
+checked in place without allocating, except for the fields of documents.
+*/
+
+type ExprError struct {
+	Pos int // byte offset in the expression
+	Msg string
+}
+
+func (e *ExprError) Error() string {
+	return fmt.Sprintf("%s at position %d", e.Msg, e.Pos)
+}
+
+const (
+	EXPR_OR     = 1
+	EXPR_AND    = 2
+	EXPR_NOT    = 3
+	EXPR_CMP    = 4 // column op literal
+	EXPR_PREFIX = 5 // column STARTS WITH string
+)
+
+// a comparison op besides COND_EQ and btree_iter.CMP_*
+const exprNE = 1
+
+// the kinds of literals
+const (
+	litInt = iota + 1
+	litFloat
+	litStr
+	litBool
+	litNull
+)
+
+type exprNode struct {
+	op   int    // EXPR_*
+	kids [2]int // operands of OR, AND and NOT
+	// a comparison
+	col    string
+	path   string // of a JSON field; "" for the column
+	colPos int
+	cmp    int // COND_EQ, btree_iter.CMP_* or exprNE
+	lit    int // lit*
+	litPos int
+	val    Value // as parsed, then as the column type
+	idx    int   // the column in a row of the table
+}
+
+type filterExpr struct {
+	src   string
+	nodes []exprNode
+	root  int
+}
+
+// parse an expression; see the top
+func exprParse(src string) (*filterExpr, error) {
+	p := exprParser{src: src, e: &filterExpr{src: src}}
+	root, err := exprOr(&p)
+	if err == nil && p.skipSpace() < len(src) {
+		err = p.fail("unexpected input")
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.e.root = root
+	return p.e, nil
+}
+
+type exprParser struct {
+	src string
+	pos int
+	e   *filterExpr
+}
+
+func (p *exprParser) fail(msg string) error {
+	return &ExprError{Pos: p.pos, Msg: msg}
+}
+
+func (p *exprParser) skipSpace() int {
+	for p.pos < len(p.src) && strings.IndexByte(" \t\r\n", p.src[p.pos]) >= 0 {
+		p.pos++
+	}
+	return p.pos
+}
+
+func exprIsIdent(ch byte, first bool) bool {
+	return ch == '_' || ('a' <= ch && ch <= 'z') || ('A' <= ch && ch <= 'Z') ||
+		(!first && '0' <= ch && ch <= '9')
+}
+
+// the identifier at the position, without consuming it
+func (p *exprParser) peekIdent() string {
+	p.skipSpace()
+	end := p.pos
+	for end < len(p.src) && exprIsIdent(p.src[end], end == p.pos) {
+		end++
+	}
+	return p.src[p.pos:end]
+}
+
+// consume a keyword in any case
+func (p *exprParser) keyword(kw string) bool {
+	if word := p.peekIdent(); strings.EqualFold(word, kw) {
+		p.pos += len(word)
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) add(n exprNode) int {
+	p.e.nodes = append(p.e.nodes, n)
+	return len(p.e.nodes) - 1
+}
+
+func exprOr(p *exprParser) (int, error) {
+	left, err := exprAnd(p)
+	for err == nil && p.keyword("OR") {
+		right := 0
+		if right, err = exprAnd(p); err == nil {
+			left = p.add(exprNode{op: EXPR_OR, kids: [2]int{left, right}})
+		}
+	}
+	return left, err
+}
+
+func exprAnd(p *exprParser) (int, error) {
+	left, err := exprNot(p)
+	for err == nil && p.keyword("AND") {
+		right := 0
+		if right, err = exprNot(p); err == nil {
+			left = p.add(exprNode{op: EXPR_AND, kids: [2]int{left, right}})
+		}
+	}
+	return left, err
+}
+
+func exprNot(p *exprParser) (int, error) {
+	if p.keyword("NOT") {
+		kid, err := exprNot(p)
+		if err != nil {
+			return 0, err
+		}
+		return p.add(exprNode{op: EXPR_NOT, kids: [2]int{kid}}), nil
+	}
+	if p.skipSpace() < len(p.src) && p.src[p.pos] == '(' {
+		p.pos++
+		kid, err := exprOr(p)
+		if err != nil {
+			return 0, err
+		}
+		if p.skipSpace() >= len(p.src) || p.src[p.pos] != ')' {
+			return 0, p.fail("expect )")
+		}
+		p.pos++
+		return kid, nil
+	}
+	return exprCmp(p)
+}
+
+func exprCmp(p *exprParser) (int, error) {
+	n := exprNode{op: EXPR_CMP, colPos: p.skipSpace()}
+	n.col = p.peekIdent()
+	if n.col == "" {
+		return 0, p.fail("expect column")
+	}
+	p.pos += len(n.col)
+	for p.pos < len(p.src) && p.src[p.pos] == '.' {
+		end := p.pos + 1
+		for end < len(p.src) && exprIsIdent(p.src[end], false) {
+			end++
+		}
+		if end == p.pos+1 {
+			return 0, p.fail("expect JSON key")
+		}
+		n.path = p.src[len(n.col)+n.colPos+1 : end]
+		p.pos = end
+	}
+
+	if p.keyword("STARTS") {
+		if !p.keyword("WITH") {
+			return 0, p.fail("expect WITH")
+		}
+		n.op = EXPR_PREFIX
+	} else {
+		type opSym struct {
+			sym string
+			cmp int
+		}
+		ops := []opSym{
+			{"!=", exprNE}, {"<=", btree_iter.CMP_LE}, {">=", btree_iter.CMP_GE},
+			{"=", COND_EQ}, {"<", btree_iter.CMP_LT}, {">", btree_iter.CMP_GT},
+		}
+		p.skipSpace()
+		i := slices.IndexFunc(ops, func(o opSym) bool { return strings.HasPrefix(p.src[p.pos:], o.sym) })
+		if i < 0 {
+			return 0, p.fail("expect comparison")
+		}
+		n.cmp = ops[i].cmp
+		p.pos += len(ops[i].sym)
+	}
+
+	if err := exprLiteral(p, &n); err != nil {
+		return 0, err
+	}
+	switch {
+	case n.op == EXPR_PREFIX && n.lit != litStr:
+		return 0, &ExprError{Pos: n.litPos, Msg: "STARTS WITH takes a string"}
+	case n.lit == litNull && n.cmp != COND_EQ && n.cmp != exprNE:
+		return 0, &ExprError{Pos: n.litPos, Msg: "NULL only compares with = or !="}
+	}
+	return p.add(n), nil
+}
+
+func exprLiteral(p *exprParser, n *exprNode) error {
+	n.litPos = p.skipSpace()
+	if p.pos >= len(p.src) {
+		return p.fail("expect literal")
+	}
+	switch ch := p.src[p.pos]; {
+	case ch == '\'' || ch == '"':
+		str, err := exprString(p)
+		n.lit, n.val = litStr, Value{Type: TYPE_BYTES, Str: str}
+		return err
+	case ch == '-' || ('0' <= ch && ch <= '9'):
+		return exprNumber(p, n)
+	}
+	switch word := strings.ToUpper(p.peekIdent()); word {
+	case "TRUE", "FALSE":
+		n.lit, n.val = litBool, Value{Type: TYPE_BOOL}
+		if word == "TRUE" {
+			n.val.I64 = 1
+		}
+	case "NULL":
+		n.lit, n.val = litNull, Value{Type: TYPE_NULL}
+	default:
+		return p.fail("expect literal")
+	}
+	p.pos += len(p.peekIdent())
+	return nil
+}
+
+func exprNumber(p *exprParser, n *exprNode) error {
+	end := p.pos
+	if p.src[end] == '-' {
+		end++
+	}
+	float := false
+	for ; end < len(p.src); end++ {
+		ch := p.src[end]
+		if ch == '.' && !float {
+			float = true
+		} else if ch < '0' || ch > '9' {
+			break
+		}
+	}
+	text := p.src[p.pos:end]
+	if float {
+		f, err := strconv.ParseFloat(text, 64)
+		if err != nil || math.IsInf(f, 0) {
+			return p.fail("bad number")
+		}
+		n.lit, n.val = litFloat, Value{Type: TYPE_FLOAT64, F64: f}
+	} else {
+		i, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			return p.fail("bad number")
+		}
+		n.lit, n.val = litInt, Value{Type: TYPE_INT64, I64: i}
+	}
+	p.pos = end
+	return nil
+}
+
+// a quoted string, with the escapes of the SQL layer
+func exprString(p *exprParser) ([]byte, error) {
+	quote := p.src[p.pos]
+	out := []byte{}
+	for i := p.pos + 1; i < len(p.src); i++ {
+		ch := p.src[i]
+		switch {
+		case ch == quote:
+			p.pos = i + 1
+			return out, nil
+		case ch != '\\':
+			out = append(out, ch)
+			continue
+		case i+1 >= len(p.src):
+			continue // unterminated
+		}
+		i++
+		switch p.src[i] {
+		case '\'', '"', '\\':
+			out = append(out, p.src[i])
+		case 'n':
+			out = append(out, '\n')
+		case 't':
+			out = append(out, '\t')
+		case 'x':
+			b, err := strconv.ParseUint(p.src[i+1:min(i+3, len(p.src))], 16, 8)
+			if err != nil || i+3 > len(p.src) {
+				p.pos = i - 1
+				return nil, p.fail("bad escape")
+			}
+			out = append(out, byte(b))
+			i += 2
+		default:
+			p.pos = i - 1
+			return nil, p.fail("bad escape")
+		}
+	}
+	return nil, p.fail("unterminated string")
+}
+
+// a copy of the expression for the table, with the columns and the
+// literals checked; see the top
+func exprBind(tdef *TableDef, expr *filterExpr) (*filterExpr, error) {
+	out := &filterExpr{src: expr.src, nodes: slices.Clone(expr.nodes), root: expr.root}
+	row := slices.Concat(tdef.Indexes[0], nonPrimaryKeyCols(tdef)) // see rowInit
+	for i := range out.nodes {
+		n := &out.nodes[i]
+		if n.op != EXPR_CMP && n.op != EXPR_PREFIX {
+			continue
+		}
+		col := slices.Index(tdef.Cols, n.col)
+		if col < 0 {
+			return nil, &ExprError{Pos: n.colPos, Msg: "unknown column: " + n.col}
+		}
+		n.idx = slices.Index(row, n.col)
+		tp := tdef.Types[col]
+		if n.path != "" {
+			if tp != TYPE_JSON {
+				return nil, &ExprError{Pos: n.colPos, Msg: "not a JSON column: " + n.col}
+			}
+			if n.lit == litInt {
+				n.val.F64 = float64(n.val.I64) // for a FLOAT64 field; see jsonCoerce
+			}
+			continue
+		}
+		ok := false
+		switch n.lit {
+		case litNull:
+			ok = true
+		case litInt:
+			ok = tp == TYPE_INT64 || tp == TYPE_TIMESTAMP || tp == TYPE_FLOAT64
+			if tp == TYPE_FLOAT64 {
+				n.val.F64 = float64(n.val.I64)
+			}
+		case litFloat:
+			ok = tp == TYPE_FLOAT64
+		case litStr:
+			ok = tp == TYPE_BYTES
+		case litBool:
+			ok = tp == TYPE_BOOL
+		}
+		if n.lit == litInt && tp == TYPE_BOOL {
+			ok = n.val.I64 == 0 || n.val.I64 == 1
+		}
+		if !ok {
+			return nil, &ExprError{Pos: n.litPos, Msg: "wrong type for column: " + n.col}
+		}
+		if n.lit != litNull {
+			n.val.Type = tp
+		}
+	}
+	return out, nil
+}
+
+// the values of an expression; see the top
+const (
+	exprFalse = iota
+	exprTrue
+	exprUnknown
+)
+
+// the row is accepted by a bound expression
+func exprMatch(e *filterExpr, rec *Record) bool {
+	return exprEval(e.nodes, e.root, rec) == exprTrue
+}
+
+func exprEval(nodes []exprNode, i int, rec *Record) int {
+	n := &nodes[i]
+	switch n.op {
+	case EXPR_OR:
+		a := exprEval(nodes, n.kids[0], rec)
+		if a == exprTrue {
+			return a
+		}
+		b := exprEval(nodes, n.kids[1], rec)
+		if b == exprTrue {
+			return b
+		}
+		return max(a, b)
+	case EXPR_AND:
+		a := exprEval(nodes, n.kids[0], rec)
+		if a == exprFalse {
+			return a
+		}
+		b := exprEval(nodes, n.kids[1], rec)
+		if b == exprFalse {
+			return b
+		}
+		return max(a, b)
+	case EXPR_NOT:
+		switch exprEval(nodes, n.kids[0], rec) {
+		case exprTrue:
+			return exprFalse
+		case exprFalse:
+			return exprTrue
+		}
+		return exprUnknown
+	}
+
+	var v *Value
+	if n.idx < len(rec.Cols) && rec.Cols[n.idx] == n.col {
+		v = &rec.Vals[n.idx]
+	} else {
+		v = rec.Get(n.col)
+	}
+	field := Value{}
+	if n.path != "" && v != nil {
+		field, _ = v.JSONGet(n.path)
+		v = &field
+	}
+	null := v == nil || v.Type == TYPE_NULL || v.Type == TYPE_ERROR
+	ok := false
+	switch {
+	case n.lit == litNull:
+		ok = null == (n.cmp == COND_EQ)
+	case null:
+		return exprUnknown
+	case n.path != "" && !jsonCoerce(v, &n.val):
+		ok = n.cmp == exprNE
+	case n.op == EXPR_PREFIX:
+		ok = bytes.HasPrefix(v.Str, n.val.Str)
+	case n.cmp == exprNE:
+		ok = !condHolds(COND_EQ, v, &n.val)
+	default:
+		ok = condHolds(n.cmp, v, &n.val)
+	}
+	if ok {
+		return exprTrue
+	}
+	return exprFalse
+}
@@ -0,0 +1,205 @@
+package table
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/Adit0507/AdiDB/internal/btree_iter"
+)
+
+/*
+foreign keys. the columns of a child row refer to the primary key of a row
+in the parent table. a write of a child row fails if the parent row is
+missing, unless one of the columns is NULL. a delete of a parent row fails
+while it has children, or deletes them too with Cascade, which goes on to
+their own children. all of it is in the transaction of the write, and a
+delete that fails leaves nothing deleted.
+
+the columns must be a leading part of an index of the child table, in
+order, so that the children of a row are a range of that index.
+a referenced table can't be dropped or renamed.
+*/
+
+var ErrForeignKey = errors.New("foreign key violation")
+
+type ForeignKey struct {
+	Cols    []string // of the child table
+	Table   string   // the parent table; its primary key in order
+	Cascade bool     `json:",omitempty"` // delete the children with the parent
+}
+
+// the foreign keys of a new table refer to an existing table
+func fkeyCheck(tx *DBTX, tdef *TableDef) error {
+	for _, fk := range tdef.ForeignKeys {
+		parent := tdef
+		if fk.Table != tdef.Name {
+			if _, ok := INTERNAL_TABLES[fk.Table]; ok {
+				return fmt.Errorf("foreign key to internal table: %s", fk.Table)
+			}
+			var err error
+			if parent, err = getTableDef(tx, fk.Table); err != nil {
+				return fmt.Errorf("foreign key: %w", err)
+			}
+		}
+		pk := parent.Indexes[0]
+		if len(fk.Cols) != len(pk) {
+			return fmt.Errorf("foreign key %v: not the primary key of %s", fk.Cols, fk.Table)
+		}
+		for i, c := range fk.Cols {
+			idx := slices.Index(tdef.Cols, c)
+			if idx < 0 {
+				return fmt.Errorf("foreign key: unknown column: %s", c)
+			}
+			if tdef.Types[idx] != parent.Types[slices.Index(parent.Cols, pk[i])] {
+				return fmt.Errorf("foreign key: %w", &ErrBadColumnType{Col: c})
+			}
+		}
+		if !slices.ContainsFunc(tdef.Indexes, func(index []string) bool {
+			return len(index) >= len(fk.Cols) && slices.Equal(index[:len(fk.Cols)], fk.Cols)
+		}) {
+			return fmt.Errorf("foreign key %v: no index starts with the columns", fk.Cols)
+		}
+	}
+	return nil
+}
+
+// the parent rows of a row that is written exist
+func fkeyParents(tx *DBTX, tdef *TableDef, rec Record) error {
+	for _, fk := range tdef.ForeignKeys {
+		vals, err := getValues(tdef, rec, fk.Cols)
+		if err != nil {
+			return err
+		}
+		if slices.ContainsFunc(vals, func(v Value) bool { return v.Type == TYPE_NULL }) {
+			continue
+		}
+		parent, err := getTableDef(tx, fk.Table)
+		if err != nil {
+			return err
+		}
+		ok, err := dbGetCols(tx, parent, &Record{parent.Indexes[0], vals}, parent.Indexes[0])
+		if err != nil {
+			return err
+		}
+		if !ok {
+			idx := slices.Index(tdef.Cols, fk.Cols[0])
+			return errColumn(tdef, idx, &vals[0],
+				fmt.Errorf("%w: %v: no row in %s", ErrForeignKey, fk.Cols, fk.Table))
+		}
+	}
+	return nil
+}
+
+// the children of a deleted row; `pk` is its primary key
+func fkeyChildren(tx *DBTX, tdef *TableDef, pk []Value) error {
+	refs, err := tableRefs(tx, tdef.Name)
+	if err != nil {
+		return err
+	}
+	for _, child := range refs {
+		for _, fk := range child.ForeignKeys {
+			if fk.Table != tdef.Name {
+				continue
+			}
+			rows, err := fkeyRows(tx, child, fk, pk)
+			if err != nil {
+				return err
+			}
+			if len(rows) > 0 && !fk.Cascade {
+				return fmt.Errorf("%w: a row of %s is referenced by %s",
+					ErrForeignKey, tdef.Name, child.Name)
+			}
+			for _, row := range rows {
+				if _, err := dbDeleteRow(tx, child, row, nil); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// the rows of the child table that refer to the primary key
+func fkeyRows(tx *DBTX, child *TableDef, fk ForeignKey, pk []Value) ([]Record, error) {
+	key := Record{fk.Cols, pk}
+	sc := Scanner{
+		Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE,
+		Key1: key, Key2: key, Cols: child.Indexes[0],
+	}
+	if err := dbScan(tx, child, &sc); err != nil {
+		return nil, err
+	}
+	defer sc.Close()
+	rows := []Record{}
+	for ; sc.Valid(); sc.Next() {
+		rec := Record{}
+		if err := sc.Deref(&rec); err != nil {
+			return nil, err
+		}
+		rows = append(rows, rec)
+	}
+	return rows, sc.Err()
+}
+
+// the tables with foreign keys to a table. it's cached like the schemas.
+func tableRefs(tx *DBTX, parent string) ([]*TableDef, error) {
+	if _, ok := INTERNAL_TABLES[parent]; ok {
+		return nil, nil
+	}
+	gen := uint64(0)
+	if !tx.schema {
+		var err error
+		if gen, err = schemaGen(tx); err != nil {
+			return nil, err
+		}
+		tx.db.mu.Lock()
+		refs := map[string][]*TableDef(nil)
+		if schemaCacheSync(tx.db, gen) {
+			refs = tx.db.refs
+		}
+		tx.db.mu.Unlock()
+		if refs != nil {
+			return refs[parent], nil
+		}
+	}
+
+	names, err := tx.ListTables()
+	if err != nil {
+		return nil, err
+	}
+	refs := map[string][]*TableDef{}
+	for _, name := range names {
+		tdef, err := getTableDef(tx, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, fk := range tdef.ForeignKeys {
+			if !slices.Contains(refs[fk.Table], tdef) {
+				refs[fk.Table] = append(refs[fk.Table], tdef)
+			}
+		}
+	}
+	if !tx.schema {
+		tx.db.mu.Lock()
+		if schemaCacheSync(tx.db, gen) {
+			tx.db.refs = refs
+		}
+		tx.db.mu.Unlock()
+	}
+	return refs[parent], nil
+}
+
+// a table can't be dropped or renamed while another one refers to it
+func tableReferenced(tx *DBTX, name string) error {
+	refs, err := tableRefs(tx, name)
+	if err != nil {
+		return err
+	}
+	for _, child := range refs {
+		if child.Name != name {
+			return fmt.Errorf("%w: table %s is referenced by %s", ErrForeignKey, name, child.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,308 @@
+package table
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"sort"
+	"unsafe"
+)
+
+/*
+aggregates by group over a scan, as in GROUP BY. each result is a Record of
+the group columns and then one column per AggSpec.
+
+when the group columns are the leading columns of the index of the scan,
+in any order, the rows of a group are next to each other, so the groups
+are computed as the rows go by and only the current one is held. the
+results are then in the order of the scan. otherwise the groups are held
+in a map, up to DB.GroupLimit of them, and returned in the order of their
+values. a collated column doesn't follow the index, since rows with
+different values can be equal in its order.
+
+the groups, and the results of the streamed ones, are charged to the scan
+against DB.ScanMemLimit and DB.MemLimit (see table_mem.go), so a budget
+fails a GroupBy with ErrMemoryBudget before it holds too many of them.
+
+nulls are skipped by the aggregates of a column, as in SQL; a group of
+nulls is a group. with no group columns there's one result, also for no
+rows.
+*/
+
+const (
+	AGG_COUNT = 1 // rows with a non-null value, or all rows without Col
+	AGG_SUM   = 2 // INT64 or FLOAT64
+	AGG_MIN   = 3
+	AGG_MAX   = 4
+)
+
+// the groups held by GroupBy in a map if DB.GroupLimit is 0
+const GROUP_LIMIT = 100000
+
+type AggSpec struct {
+	Func int    // AGG_*
+	Col  string // "" for AGG_COUNT of the rows
+	Name string // of the result column; such as "sum(col)" if empty
+}
+
+// the aggregates of a group
+type aggGroup struct {
+	key   []Value
+	vals  []Value
+	found []bool // the min or max has a value
+}
+
+// approximate memory of a group: its key, twice for the map or the
+// result, and its aggregates
+func groupMemSize(g *aggGroup) int64 {
+	return int64(unsafe.Sizeof(*g)) + 2*valuesMemSize(g.key) + valuesMemSize(g.vals) + int64(len(g.found))
+}
+
+// aggregate the rows of `sc` by the values of `groupCols`; see the top
+func (tx *DBTX) GroupBy(table string, sc *Scanner, groupCols []string, aggs []AggSpec) ([]Record, error) {
+	tdef, err := getTableDef(tx, table)
+	if err != nil {
+		return nil, err
+	}
+	names, types, err := aggCheck(tdef, groupCols, aggs)
+	if err != nil {
+		return nil, err
+	}
+
+	// the columns read, with their position in the decoded rows
+	cols := slices.Clone(groupCols)
+	for _, a := range aggs {
+		if a.Col != "" && !slices.Contains(cols, a.Col) {
+			cols = append(cols, a.Col)
+		}
+	}
+	scan := &Scanner{
+		Cmp1: sc.Cmp1, Cmp2: sc.Cmp2, Key1: sc.Key1, Key2: sc.Key2, Desc: sc.Desc,
+		Offset: sc.Offset, Limit: sc.Limit, Filter: sc.Filter, Ctx: sc.Ctx,
+		Cols: cols, Prefetch: sc.Prefetch, expr: sc.expr,
+	}
+	if len(cols) == 0 {
+		scan.Cols = tdef.Indexes[0][:1] // any column
+	}
+	if err := dbScan(tx, tdef, scan); err != nil {
+		return nil, err
+	}
+	defer scan.Close()
+	pos := make([]int, len(aggs))
+	for i, a := range aggs {
+		pos[i] = slices.Index(cols, a.Col)
+	}
+
+	newGroup := func(key []Value) *aggGroup {
+		g := &aggGroup{key: key, vals: make([]Value, len(aggs)), found: make([]bool, len(aggs))}
+		for i := range aggs {
+			g.vals[i] = Value{Type: types[i]}
+		}
+		return g
+	}
+	result := func(g *aggGroup) Record {
+		rec := Record{Cols: names, Vals: slices.Concat(g.key, g.vals)}
+		for i, a := range aggs {
+			if (a.Func == AGG_MIN || a.Func == AGG_MAX) && !g.found[i] {
+				rec.Vals[len(g.key)+i] = Value{Type: TYPE_NULL}
+			}
+		}
+		return rec
+	}
+
+	out := []Record{}
+	limit := tx.db.GroupLimit
+	if limit <= 0 {
+		limit = GROUP_LIMIT
+	}
+	streamed := groupStreamed(tdef, scan, groupCols)
+	groups := map[string]*aggGroup{}
+	var cur *aggGroup
+	rec := Record{}
+	for ; scan.Valid(); scan.Next() {
+		if err := scan.Deref(&rec); err != nil {
+			return nil, err
+		}
+		key := rec.Vals[:len(groupCols)]
+		switch {
+		case streamed:
+			if cur == nil || !valuesEqual(cur.key, key) {
+				if cur != nil {
+					out = append(out, result(cur))
+				}
+				cur = newGroup(slices.Clone(key))
+				if err := scanCharge(scan, groupMemSize(cur)); err != nil {
+					return nil, err
+				}
+			}
+		default:
+			hkey := string(encodeValues(nil, key))
+			if cur = groups[hkey]; cur == nil {
+				if len(groups) >= limit {
+					return nil, fmt.Errorf("%w: more than %d groups", ErrMemoryBudget, limit)
+				}
+				cur = newGroup(slices.Clone(key))
+				if err := scanCharge(scan, groupMemSize(cur)); err != nil {
+					return nil, err
+				}
+				groups[hkey] = cur
+			}
+		}
+		// a min or a max may hold a longer string
+		before := groupMemSize(cur)
+		if err := aggAdd(cur, aggs, pos, rec.Vals); err != nil {
+			return nil, err
+		}
+		if err := scanCharge(scan, groupMemSize(cur)-before); err != nil {
+			return nil, err
+		}
+	}
+	if err := scan.Err(); err != nil {
+		return nil, err
+	}
+
+	if !streamed {
+		keys := make([]string, 0, len(groups))
+		for k := range groups {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys) // the encoding preserves the order
+		for _, k := range keys {
+			out = append(out, result(groups[k]))
+		}
+	} else if cur != nil {
+		out = append(out, result(cur))
+	}
+	if len(groupCols) == 0 && len(out) == 0 {
+		out = append(out, result(newGroup(nil)))
+	}
+	return out, nil
+}
+
+// the columns of the results and the types of the aggregates
+func aggCheck(tdef *TableDef, groupCols []string, aggs []AggSpec) ([]string, []uint32, error) {
+	names := []string{}
+	for _, c := range groupCols {
+		if slices.Index(tdef.Cols, c) < 0 {
+			return nil, nil, fmt.Errorf("unknown column: %s", c)
+		}
+		if slices.Contains(names, c) {
+			return nil, nil, fmt.Errorf("duplicated column: %s", c)
+		}
+		names = append(names, c)
+	}
+	types := []uint32{}
+	for _, a := range aggs {
+		tp := uint32(TYPE_INT64)
+		if a.Col != "" {
+			idx := slices.Index(tdef.Cols, a.Col)
+			if idx < 0 {
+				return nil, nil, fmt.Errorf("unknown column: %s", a.Col)
+			}
+			tp = tdef.Types[idx]
+		}
+		allowed := []uint32{}
+		switch a.Func {
+		case AGG_COUNT:
+			allowed = []uint32{tp}
+			tp = TYPE_INT64
+		case AGG_SUM:
+			allowed = []uint32{TYPE_INT64, TYPE_FLOAT64}
+		case AGG_MIN, AGG_MAX:
+			allowed = []uint32{TYPE_INT64, TYPE_FLOAT64, TYPE_TIMESTAMP, TYPE_BYTES}
+		default:
+			return nil, nil, fmt.Errorf("unknown aggregate: %d", a.Func)
+		}
+		if a.Func != AGG_COUNT && a.Col == "" {
+			return nil, nil, fmt.Errorf("aggregate without a column: %d", a.Func)
+		}
+		if !slices.Contains(allowed, tp) {
+			return nil, nil, &ErrBadColumnType{Col: a.Col}
+		}
+		name := aggName(a)
+		if slices.Contains(names, name) {
+			return nil, nil, fmt.Errorf("duplicated column: %s", name)
+		}
+		names = append(names, name)
+		types = append(types, tp)
+	}
+	return names, types, nil
+}
+
+func aggName(a AggSpec) string {
+	if a.Name != "" {
+		return a.Name
+	}
+	col := a.Col
+	if col == "" {
+		col = "*"
+	}
+	fn := map[int]string{AGG_COUNT: "count", AGG_SUM: "sum", AGG_MIN: "min", AGG_MAX: "max"}[a.Func]
+	return fn + "(" + col + ")"
+}
+
+// the group columns lead the index of the scan, without collations
+func groupStreamed(tdef *TableDef, sc *Scanner, groupCols []string) bool {
+	index := sc.IndexCols()
+	if len(groupCols) > len(index) {
+		return false
+	}
+	for i, c := range index[:len(groupCols)] {
+		if !slices.Contains(groupCols, c) || collation(tdef, sc.index, i) != COLLATE_BINARY {
+			return false
+		}
+	}
+	return true
+}
+
+func valuesEqual(a []Value, b []Value) bool {
+	for i := range a {
+		if !a[i].Equal(&b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// add a row to the aggregates of its group. `pos` is the column of each
+// aggregate in `row`, -1 for none.
+func aggAdd(g *aggGroup, aggs []AggSpec, pos []int, row []Value) error {
+	for i, a := range aggs {
+		if pos[i] < 0 {
+			g.vals[i].I64++ // the rows
+			continue
+		}
+		v := &row[pos[i]]
+		if v.Type == TYPE_NULL {
+			continue
+		}
+		acc := &g.vals[i]
+		switch a.Func {
+		case AGG_COUNT:
+			acc.I64++
+		case AGG_SUM:
+			if v.Type == TYPE_FLOAT64 {
+				acc.F64 += v.F64
+				break
+			}
+			s := acc.I64 + v.I64
+			if (v.I64 > 0 && s < acc.I64) || (v.I64 < 0 && s > acc.I64) {
+				return fmt.Errorf("integer overflow: %s", a.Col)
+			}
+			acc.I64 = s
+		case AGG_MIN, AGG_MAX:
+			want := -1
+			if a.Func == AGG_MAX {
+				want = +1
+			}
+			// the encoding preserves the order
+			if !g.found[i] || bytes.Compare(encodeValues(nil, []Value{*v}),
+				encodeValues(nil, []Value{*acc})) == want {
+				*acc = *v
+				acc.Str = slices.Clone(v.Str)
+				g.found[i] = true
+			}
+		}
+	}
+	return nil
+}
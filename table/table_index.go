@@ -0,0 +1,371 @@
+package table
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/Adit0507/AdiDB/internal/btree"
+	"github.com/Adit0507/AdiDB/internal/btree_iter"
+	"github.com/Adit0507/AdiDB/internal/transactions"
+)
+
+/*
+adding a secondary index to a table with rows. the index gets a new prefix
+and is appended to the schema as TableDef.Building: writes maintain it like
+the other indexes, but scans don't use it until it's complete. the existing
+rows are then backfilled in primary key order, `indexBatch` rows per
+transaction, and the last primary key done is kept in @meta, so an
+interrupted build resumes from there with the same CreateIndex call.
+
+concurrent writes are not blocked. a writer that started before the schema
+change conflicts with it, since it read the schema. a later one adds and
+removes the keys of the index itself; a key may be missing or present when
+the row isn't backfilled yet, so these updates are not checked. a batch
+and a writer that touch the same row conflict with each other, since both
+read its index key, and the loser is retried.
+
+a unique index is checked as it's backfilled. a duplicate aborts the build:
+the keys are deleted, the index is removed from the schema, and the prefix
+is freed.
+*/
+
+// rows per transaction of an index build; a var for the tests
+var indexBatch = 1000
+
+// a secondary index whose keys are not all written yet
+func isBuilding(tdef *TableDef, idx int) bool {
+	return idx < len(tdef.Building) && tdef.Building[idx]
+}
+
+// @meta key of the last primary key backfilled into the index
+func indexBuildKey(prefix uint32) []byte {
+	return binary.BigEndian.AppendUint32([]byte("index_build:"), prefix)
+}
+
+// add a secondary index on `cols` and fill it with the existing rows. see
+// the top for concurrent writes; a call after an interrupted one resumes it.
+func (db *DB) CreateIndex(table string, cols []string, unique bool) error {
+	return db.CreateIndexCtx(context.Background(), table, cols, unique)
+}
+
+// CreateIndex that stops between batches with ctx.Err(); the build resumes
+// with the next call
+func (db *DB) CreateIndexCtx(ctx context.Context, table string, cols []string, unique bool) error {
+	return db.CreateIndexCollate(ctx, table, cols, nil, unique)
+}
+
+// CreateIndexCtx with a collation per column, as in TableDef.Collations
+func (db *DB) CreateIndexCollate(ctx context.Context, table string, cols []string, collate []uint32, unique bool) error {
+	return indexCreate(ctx, db, table, cols, collate, nil, "", unique)
+}
+
+// CreateIndexCtx with descending columns, as in TableDef.Descending
+func (db *DB) CreateIndexDesc(ctx context.Context, table string, cols []string, desc []bool, unique bool) error {
+	return indexCreate(ctx, db, table, cols, nil, desc, "", unique)
+}
+
+func indexCreate(ctx context.Context, db *DB, table string, cols []string,
+	collate []uint32, desc []bool, fn string, unique bool) error {
+	prefix, err := indexAdd(db, table, cols, collate, desc, fn, unique)
+	if err != nil {
+		return err
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		done, err := indexBackfill(db, table, prefix)
+		if errors.Is(err, ErrUniqueViolation) {
+			if aerr := indexAbort(db, table, prefix); aerr != nil {
+				return aerr
+			}
+			return err
+		}
+		if errors.Is(err, transactions.ErrorConflict) {
+			continue // with the rows of the batch read again
+		}
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// the prefix of the index, which is added to the schema if it's not there
+func indexAdd(db *DB, table string, cols []string, collate []uint32, desc []bool,
+	fn string, unique bool) (prefix uint32, err error) {
+	if _, ok := INTERNAL_TABLES[table]; ok {
+		return 0, fmt.Errorf("cannot alter internal table: %s", table)
+	}
+	err = indexTX(db, func(tx *DBTX) error {
+		tdef, err := getTableDef(tx, table)
+		if err != nil {
+			return err
+		}
+		index, err := checkIndexCols(tdef, slices.Clone(cols))
+		if err != nil {
+			return err
+		}
+		for i, other := range tdef.Indexes {
+			if !slices.Equal(other, index) || !computedEqual(tdef, i, fn, len(cols)) {
+				continue
+			}
+			same := collateEqual(tdef, i, collate) && descEqual(tdef, i, desc)
+			if isBuilding(tdef, i) && isUnique(tdef, i) == unique && same {
+				prefix = tdef.Prefixes[i]
+				return nil
+			}
+			if !collateEqual(tdef, i, collate) {
+				return fmt.Errorf("index exists with another collation: %v", cols)
+			}
+			if !same {
+				return fmt.Errorf("index exists with another order: %v", cols)
+			}
+			return fmt.Errorf("index exists: %v", cols)
+		}
+
+		if prefix, err = prefixAlloc(tx, 1); err != nil {
+			return err
+		}
+		// the cached schema is shared, so modify a copy
+		n := len(tdef.Indexes) + 1
+		ndef := *tdef
+		ndef.Indexes = append(slices.Clone(tdef.Indexes), index)
+		ndef.Prefixes = append(slices.Clone(tdef.Prefixes), prefix)
+		if unique || len(tdef.Unique) != 0 {
+			ndef.Unique = make([]bool, n)
+			copy(ndef.Unique, tdef.Unique)
+			ndef.Unique[n-1] = unique
+		}
+		ndef.Building = make([]bool, n)
+		copy(ndef.Building, tdef.Building)
+		ndef.Building[n-1] = true
+		if len(collate) != 0 || len(tdef.Collations) != 0 {
+			ndef.Collations = make([][]uint32, n)
+			copy(ndef.Collations, tdef.Collations)
+			ndef.Collations[n-1] = slices.Clone(collate)
+		}
+		if len(desc) != 0 || len(tdef.Descending) != 0 {
+			ndef.Descending = make([][]bool, n)
+			copy(ndef.Descending, tdef.Descending)
+			ndef.Descending[n-1] = slices.Clone(desc)
+		}
+		if fn != "" || len(tdef.Computed) != 0 {
+			ndef.Computed = make([]IndexFunc, n)
+			copy(ndef.Computed, tdef.Computed)
+		}
+		if fn != "" {
+			f, err := indexFnGet(db, fn)
+			if err != nil {
+				return err
+			}
+			ndef.Computed[n-1] = IndexFunc{Func: fn, Args: len(cols), Type: f.tp}
+		}
+		if err := tableDefCheck(&ndef); err != nil {
+			return err
+		}
+		return indexSchema(tx, &ndef)
+	})
+	return prefix, err
+}
+
+// run `fn` in a transaction that is committed if it succeeds
+func indexTX(db *DB, fn func(tx *DBTX) error) error {
+	tx := DBTX{}
+	db.Begin(&tx)
+	if err := fn(&tx); err != nil {
+		db.Abort(&tx)
+		return err
+	}
+	return db.Commit(&tx)
+}
+
+// replace the stored schema of the table
+func indexSchema(tx *DBTX, tdef *TableDef) error {
+	val, err := json.Marshal(tdef)
+	if err != nil {
+		return err
+	}
+	rec := (&Record{}).AddStr("name", []byte(tdef.Name)).AddStr("def", val)
+	req := DBUpdateReq{Record: *rec, Mode: btree.MODE_UPDATE_ONLY}
+	if _, err := dbUpdate(tx, TDEF_TABLE, &req); err != nil {
+		return err
+	}
+	return schemaChanged(tx)
+}
+
+// the number of the index being built, from the schema of the TX
+func indexFind(tx *DBTX, table string, prefix uint32) (*TableDef, int, error) {
+	tdef, err := getTableDef(tx, table)
+	if err != nil {
+		return nil, 0, err
+	}
+	idx := slices.Index(tdef.Prefixes, prefix)
+	if idx <= 0 || !isBuilding(tdef, idx) {
+		return nil, 0, fmt.Errorf("index build of %s: the index was removed", table)
+	}
+	return tdef, idx, nil
+}
+
+// backfill the next batch of rows in a transaction
+func indexBackfill(db *DB, table string, prefix uint32) (done bool, err error) {
+	err = indexTX(db, func(tx *DBTX) error {
+		tdef, idx, err := indexFind(tx, table, prefix)
+		if err != nil {
+			return err
+		}
+		meta := (&Record{}).AddStr("key", indexBuildKey(prefix))
+		ok, err := dbGet(tx, TDEF_META, meta)
+		if err != nil {
+			return err
+		}
+
+		// the rows after the last one done
+		start, cmp := encodeKey(nil, tdef.Prefixes[0], nil), btree_iter.CMP_GE
+		if ok {
+			start, cmp = meta.Get("val").Str, btree_iter.CMP_GT
+		}
+		end := encodeKey(nil, tdef.Prefixes[0]+1, nil)
+		rows, last, err := indexRows(tx, tdef, start, cmp, end)
+		if err != nil {
+			return err
+		}
+		for _, rec := range rows {
+			if err := indexBackfillRow(tx, tdef, idx, rec); err != nil {
+				return err
+			}
+		}
+
+		if done = len(rows) < indexBatch; !done {
+			meta = (&Record{}).AddStr("key", indexBuildKey(prefix)).AddStr("val", last)
+			_, err = dbUpdate(tx, TDEF_META, &DBUpdateReq{Record: *meta})
+			return err
+		}
+		// the index is complete
+		ndef := *tdef
+		ndef.Building = slices.Clone(tdef.Building)
+		ndef.Building[idx] = false
+		if !slices.Contains(ndef.Building, true) {
+			ndef.Building = nil
+		}
+		if err := indexSchema(tx, &ndef); err != nil {
+			return err
+		}
+		_, err = dbDelete(tx, TDEF_META, *meta)
+		return err
+	})
+	return done && err == nil, err
+}
+
+// up to `indexBatch` rows from `start`, and the primary key of the last one
+func indexRows(tx *DBTX, tdef *TableDef, start []byte, cmp int, end []byte) (rows []Record, last []byte, err error) {
+	defer checksumRecover(&err)
+	iter := tx.kv.Seek(start, cmp, end, btree_iter.CMP_LT)
+	for ; iter.Valid() && len(rows) < indexBatch; iter.Next() {
+		key, val := iter.Deref()
+		rec := Record{}
+		if err := rowDecode(tdef, key, val, &rec, nil, nil); err != nil {
+			return nil, nil, err
+		}
+		rows = append(rows, rec)
+		last = key
+	}
+	return rows, slices.Clone(last), nil
+}
+
+// add the index key of a row, unless a writer did
+func indexBackfillRow(tx *DBTX, tdef *TableDef, idx int, rec Record) (err error) {
+	defer checksumRecover(&err)
+	vals, err := indexValues(tx.db, tdef, idx, rec)
+	if err != nil {
+		return err
+	}
+	key := indexKey(nil, tdef, idx, vals)
+	if cols := uniqueCols(tdef, idx); isUnique(tdef, idx) && len(cols) != 0 {
+		// any other key with the same leading columns
+		uvals := uniqueVals(tdef, idx, vals)
+		start := indexKey(nil, tdef, idx, uvals)
+		end := indexKeyPartial(nil, tdef, idx, uvals, btree_iter.CMP_LE)
+		iter := tx.kv.Seek(start, btree_iter.CMP_GE, end, btree_iter.CMP_LE)
+		for ; iter.Valid(); iter.Next() {
+			if other, _ := iter.Deref(); !bytes.Equal(other, key) {
+				return fmt.Errorf("%w: table %s, index %v", ErrUniqueViolation, tdef.Name, cols)
+			}
+		}
+	}
+	_, err = tx.kv.Update(&UpdateReq{Key: key, Val: nil})
+	return err
+}
+
+// remove an index that failed to build, with its keys and progress
+func indexAbort(db *DB, table string, prefix uint32) error {
+	for {
+		err := indexRemove(db, table, prefix)
+		if !errors.Is(err, transactions.ErrorConflict) {
+			return err
+		}
+	}
+}
+
+func indexRemove(db *DB, table string, prefix uint32) error {
+	return indexTX(db, func(tx *DBTX) error {
+		tdef, idx, err := indexFind(tx, table, prefix)
+		if err != nil {
+			return err
+		}
+		if err := indexDeleteKeys(tx, prefix); err != nil {
+			return err
+		}
+
+		ndef := *tdef
+		ndef.Indexes = slices.Delete(slices.Clone(tdef.Indexes), idx, idx+1)
+		ndef.Prefixes = slices.Delete(slices.Clone(tdef.Prefixes), idx, idx+1)
+		if idx < len(tdef.Unique) {
+			ndef.Unique = slices.Delete(slices.Clone(tdef.Unique), idx, idx+1)
+		}
+		if idx < len(tdef.Collations) {
+			ndef.Collations = slices.Delete(slices.Clone(tdef.Collations), idx, idx+1)
+		}
+		if idx < len(tdef.Descending) {
+			ndef.Descending = slices.Delete(slices.Clone(tdef.Descending), idx, idx+1)
+		}
+		if idx < len(tdef.Computed) {
+			ndef.Computed = slices.Delete(slices.Clone(tdef.Computed), idx, idx+1)
+		}
+		ndef.Building = slices.Delete(slices.Clone(tdef.Building), idx, idx+1)
+		if !slices.Contains(ndef.Building, true) {
+			ndef.Building = nil
+		}
+		if err := indexSchema(tx, &ndef); err != nil {
+			return err
+		}
+		meta := (&Record{}).AddStr("key", indexBuildKey(prefix))
+		if _, err := dbDelete(tx, TDEF_META, *meta); err != nil {
+			return err
+		}
+		return prefixFree(tx, prefix, 1)
+	})
+}
+
+// delete the keys under a prefix; see TableDrop
+func indexDeleteKeys(tx *DBTX, prefix uint32) (err error) {
+	defer checksumRecover(&err)
+	start := encodeKey(nil, prefix, nil)
+	end := encodeKey(nil, prefix+1, nil)
+	keys := [][]byte(nil)
+	iter := tx.kv.Seek(start, btree_iter.CMP_GE, end, btree_iter.CMP_LT)
+	for ; iter.Valid(); iter.Next() {
+		key, _ := iter.Deref()
+		keys = append(keys, key)
+	}
+	for _, key := range keys {
+		if _, err := tx.kv.Del(&DeleteReq{Key: key}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package table
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/Adit0507/AdiDB/internal/btree_iter"
+)
+
+/*
+an index nested-loop join. each row of a scan of the left table is looked
+up in the right table by the columns of `on`, a left column to a right
+one. the right columns must be the leading columns of an index of the
+right table, in any order, so a lookup is a point query on the primary key
+or a range of a secondary index, never a scan of the whole table. the
+columns are checked before the scan: they exist, and the 2 sides have the
+same type.
+
+the join is inner: a left row without a match is skipped, or given to
+emit with a nil right row by LeftJoin. a null matches nothing, as in SQL.
+the right rows are read by a single Scanner with Reuse into a single
+Record, so the lookups don't allocate per row; the records given to emit
+are only valid until it returns. the lookup key and the right row are
+charged to the left scan along with its own row, so DB.ScanMemLimit bounds
+the buffers of the whole join, and DB.MemLimit counts them with the other
+scanners (see table_mem.go).
+*/
+
+// the rows of the scan `sc` of the `left` table with their rows in the
+// `right` table; see the top. an error from emit stops the join.
+func (tx *DBTX) Join(left string, sc *Scanner, right string, on map[string]string,
+	emit func(l *Record, r *Record) error) error {
+	return dbJoin(tx, left, sc, right, on, false, emit)
+}
+
+// Join, and the left rows without a match with a nil right row
+func (tx *DBTX) LeftJoin(left string, sc *Scanner, right string, on map[string]string,
+	emit func(l *Record, r *Record) error) error {
+	return dbJoin(tx, left, sc, right, on, true, emit)
+}
+
+// the right index of a join, and the left columns of its leading columns
+func joinIndex(ltdef *TableDef, rtdef *TableDef, sc *Scanner, on map[string]string) (int, []string, error) {
+	if len(on) == 0 {
+		return 0, nil, fmt.Errorf("no join columns")
+	}
+	rcols := []string{}
+	for lc, rc := range on {
+		li, ri := slices.Index(ltdef.Cols, lc), slices.Index(rtdef.Cols, rc)
+		if li < 0 {
+			return 0, nil, fmt.Errorf("unknown column: %s.%s", ltdef.Name, lc)
+		}
+		if ri < 0 {
+			return 0, nil, fmt.Errorf("unknown column: %s.%s", rtdef.Name, rc)
+		}
+		if ltdef.Types[li] != rtdef.Types[ri] {
+			return 0, nil, fmt.Errorf("%w: %s.%s and %s.%s differ",
+				&ErrBadColumnType{Col: lc}, ltdef.Name, lc, rtdef.Name, rc)
+		}
+		if slices.Contains(rcols, rc) {
+			return 0, nil, fmt.Errorf("duplicated column: %s.%s", rtdef.Name, rc)
+		}
+		if len(sc.Cols) > 0 && !slices.Contains(sc.Cols, lc) {
+			return 0, nil, fmt.Errorf("join column not in the scan: %s", lc)
+		}
+		rcols = append(rcols, rc)
+	}
+
+	for i, index := range rtdef.Indexes {
+		n := len(rcols)
+		if isBuilding(rtdef, i) || isComputed(rtdef, i) || len(index) < n {
+			continue
+		}
+		lead := index[:n]
+		match := true
+		for j, c := range lead {
+			// a collated index doesn't compare the values as they are
+			match = match && slices.Contains(rcols, c) && collation(rtdef, i, j) == COLLATE_BINARY
+		}
+		if !match {
+			continue
+		}
+		lcols := make([]string, n)
+		for lc, rc := range on {
+			lcols[slices.Index(lead, rc)] = lc
+		}
+		return i, lcols, nil
+	}
+	return 0, nil, fmt.Errorf("%w: no index for columns: %s %v", ErrBadRange, rtdef.Name, rcols)
+}
+
+func dbJoin(tx *DBTX, left string, sc *Scanner, right string, on map[string]string,
+	outer bool, emit func(l *Record, r *Record) error) error {
+	ltdef, err := getTableDef(tx, left)
+	if err != nil {
+		return err
+	}
+	rtdef, err := getTableDef(tx, right)
+	if err != nil {
+		return err
+	}
+	index, lcols, err := joinIndex(ltdef, rtdef, sc, on)
+	if err != nil {
+		return err
+	}
+
+	if err := dbScan(tx, ltdef, sc); err != nil {
+		return err
+	}
+	defer sc.Close()
+	key := Record{rtdef.Indexes[index][:len(lcols)], make([]Value, len(lcols))}
+	rsc := Scanner{Reuse: true}
+	defer rsc.Close()
+	lrec, rrec := Record{}, Record{}
+	held := int64(0) // charged to `sc` for the key and the right row
+	hold := func(size int64) error {
+		if err := scanCharge(sc, size-held); err != nil {
+			return err
+		}
+		held = size
+		return nil
+	}
+	for ; sc.Valid(); sc.Next() {
+		if err := sc.Deref(&lrec); err != nil {
+			return err
+		}
+		found := false
+		null := false
+		for i, c := range lcols {
+			key.Vals[i] = *lrec.Get(c)
+			null = null || key.Vals[i].Type == TYPE_NULL
+		}
+		if err := hold(valuesMemSize(key.Vals)); err != nil {
+			return err
+		}
+		if !null {
+			rsc.Cmp1, rsc.Cmp2 = btree_iter.CMP_GE, btree_iter.CMP_LE
+			rsc.Key1, rsc.Key2 = key, key
+			if err := dbScan(tx, rtdef, &rsc); err != nil {
+				return err
+			}
+			for ; rsc.Valid(); rsc.Next() {
+				if err := rsc.Deref(&rrec); err != nil {
+					return err
+				}
+				if err := hold(valuesMemSize(key.Vals) + rsc.rowMem); err != nil {
+					return err
+				}
+				found = true
+				if err := emit(&lrec, &rrec); err != nil {
+					return err
+				}
+			}
+			if err := rsc.Err(); err != nil {
+				return err
+			}
+		}
+		if !found && outer {
+			if err := emit(&lrec, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return sc.Err()
+}
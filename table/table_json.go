@@ -0,0 +1,271 @@
+package table
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Adit0507/AdiDB/internal/btree"
+	"github.com/Adit0507/AdiDB/internal/btree_iter"
+)
+
+/*
+rows as JSON objects keyed by the column names, for HTTP handlers and
+other tools. ExportJSON writes an object per line (NDJSON), in primary
+key order, with the columns in the order of the schema. the values:
+- NULL is null, BOOL is a JSON bool, INT64 is a JSON number.
+- FLOAT64 is a JSON number, or "+Inf" or "-Inf".
+- TIMESTAMP is an RFC 3339 string in UTC, with nanoseconds.
+- BYTES is a string if it's valid UTF-8, or {"base64": "..."} otherwise.
+- JSON is the document itself.
+ImportJSON takes the same values, as NDJSON or as a JSON array. numbers
+are not converted through float64, so an INT64 keeps its precision, and
+a TIMESTAMP can also be a number of nanoseconds.
+*/
+
+type ImportOptions struct {
+	// skip the fields that are not columns; they fail the import otherwise
+	IgnoreUnknown bool
+}
+
+// the marker of a BYTES value that is not UTF-8
+const JSON_BASE64 = "base64"
+
+// write the rows of a table in a snapshot, an object per line
+func (db *DB) ExportJSON(table string, w io.Writer) error {
+	tx := DBTX{}
+	db.BeginRead(&tx)
+	defer db.Abort(&tx)
+	tdef, err := getTableDef(&tx, table)
+	if err != nil {
+		return err
+	}
+	sc := Scanner{Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE}
+	if err := dbScan(&tx, tdef, &sc); err != nil {
+		return err
+	}
+	defer sc.Close()
+
+	bw := bufio.NewWriter(w)
+	line := []byte{}
+	for ; sc.Valid(); sc.Next() {
+		rec := Record{}
+		if err := sc.Deref(&rec); err != nil {
+			return err
+		}
+		line = append(line[:0], '{')
+		for i, col := range tdef.Cols {
+			if i > 0 {
+				line = append(line, ',')
+			}
+			line = jsonAppendString(line, col)
+			line = append(line, ':')
+			line = jsonAppendValue(line, rec.Get(col))
+		}
+		line = append(line, '}', '\n')
+		if _, err := bw.Write(line); err != nil {
+			return err
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func jsonAppendString(out []byte, s string) []byte {
+	val, err := json.Marshal(s)
+	assert(err == nil)
+	return append(out, val...)
+}
+
+func jsonAppendValue(out []byte, v *Value) []byte {
+	switch v.Type {
+	case TYPE_BYTES:
+		if utf8.Valid(v.Str) {
+			return jsonAppendString(out, string(v.Str))
+		}
+		out = append(out, `{"`+JSON_BASE64+`":"`...)
+		out = base64.StdEncoding.AppendEncode(out, v.Str)
+		return append(out, `"}`...)
+	case TYPE_JSON:
+		return append(out, v.Str...)
+	case TYPE_INT64:
+		return strconv.AppendInt(out, v.I64, 10)
+	case TYPE_BOOL:
+		return strconv.AppendBool(out, v.I64 == 1)
+	case TYPE_TIMESTAMP:
+		return jsonAppendString(out, v.Time().Format(time.RFC3339Nano))
+	case TYPE_FLOAT64:
+		if math.IsInf(v.F64, 0) || math.IsNaN(v.F64) { // from a damaged file
+			return jsonAppendString(out, strconv.FormatFloat(v.F64, 'g', -1, 64))
+		}
+		val, err := json.Marshal(v.F64)
+		assert(err == nil)
+		return append(out, val...)
+	default:
+		return append(out, "null"...)
+	}
+}
+
+// upsert the rows of a JSON array or of NDJSON in a transaction. nothing
+// is written if a row is bad; the error has the index of the row.
+// returns the number of rows.
+func (db *DB) ImportJSON(table string, r io.Reader, opts ImportOptions) (int, error) {
+	br := bufio.NewReader(r)
+	dec := json.NewDecoder(br)
+	dec.UseNumber()
+	array := false
+	for {
+		c, err := br.ReadByte()
+		if err == io.EOF {
+			return 0, nil
+		} else if err != nil {
+			return 0, err
+		}
+		if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+			br.UnreadByte()
+			array = c == '['
+			break
+		}
+	}
+	if array {
+		if _, err := dec.Token(); err != nil {
+			return 0, err
+		}
+	}
+
+	tx := DBTX{}
+	db.Begin(&tx)
+	n, err := importRows(&tx, table, dec, array, opts)
+	if err != nil {
+		db.Abort(&tx)
+		return 0, err
+	}
+	if err := db.Commit(&tx); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func importRows(tx *DBTX, table string, dec *json.Decoder, array bool, opts ImportOptions) (int, error) {
+	tdef, err := getTableDef(tx, table)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for ; !array || dec.More(); n++ {
+		obj := map[string]json.RawMessage{}
+		err := dec.Decode(&obj)
+		if err == io.EOF && !array {
+			return n, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("record %d: %w", n, err)
+		}
+		rec, err := importRecord(tdef, obj, opts)
+		if err == nil {
+			dbreq := DBUpdateReq{Record: rec, Mode: btree.MODE_UPSERT, KeepTimes: true, KeepVersion: true}
+			_, err = tx.Set(table, &dbreq)
+		}
+		if err != nil {
+			return 0, errRecord(err, n)
+		}
+	}
+	if _, err := dec.Token(); err != nil { // the closing bracket
+		return 0, err
+	}
+	return n, nil
+}
+
+// a record in the order of the schema
+func importRecord(tdef *TableDef, obj map[string]json.RawMessage, opts ImportOptions) (Record, error) {
+	rec := Record{}
+	for key := range obj {
+		if !slices.Contains(tdef.Cols, key) && !opts.IgnoreUnknown {
+			return rec, fmt.Errorf("unknown column: %s", key)
+		}
+	}
+	for i, col := range tdef.Cols {
+		raw, ok := obj[col]
+		if !ok {
+			continue
+		}
+		v, err := importValue(tdef.Types[i], raw)
+		if err != nil {
+			return rec, fmt.Errorf("column %s: %w", col, err)
+		}
+		rec.Cols = append(rec.Cols, col)
+		rec.Vals = append(rec.Vals, v)
+	}
+	return rec, nil
+}
+
+var errJSONValue = errors.New("bad value for the column type")
+
+func importValue(tp uint32, raw json.RawMessage) (v Value, err error) {
+	if tp == TYPE_JSON && string(raw) != "null" {
+		return Value{Type: TYPE_JSON, Str: raw}, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var in any
+	if err := dec.Decode(&in); err != nil {
+		return v, err
+	}
+	v.Type = tp
+	switch x := in.(type) {
+	case nil:
+		v.Type = TYPE_NULL
+	case bool:
+		if tp != TYPE_BOOL {
+			return v, errJSONValue
+		}
+		if x {
+			v.I64 = 1
+		}
+	case json.Number:
+		switch tp {
+		case TYPE_INT64, TYPE_TIMESTAMP:
+			v.I64, err = strconv.ParseInt(string(x), 10, 64)
+		case TYPE_FLOAT64:
+			v.F64, err = strconv.ParseFloat(string(x), 64)
+		default:
+			err = errJSONValue
+		}
+	case string:
+		switch tp {
+		case TYPE_BYTES:
+			v.Str = []byte(x)
+		case TYPE_TIMESTAMP:
+			t, perr := time.Parse(time.RFC3339Nano, x)
+			v.I64, err = t.UnixNano(), perr
+		case TYPE_FLOAT64:
+			if x != "+Inf" && x != "-Inf" {
+				return v, errJSONValue
+			}
+			v.F64, err = strconv.ParseFloat(x, 64)
+		default:
+			err = errJSONValue
+		}
+	case map[string]any:
+		// the only nested value
+		s, ok := x[JSON_BASE64].(string)
+		if tp != TYPE_BYTES || !ok || len(x) != 1 {
+			return v, errors.New("nested value")
+		}
+		v.Str, err = base64.StdEncoding.DecodeString(s)
+	default:
+		err = errors.New("nested value")
+	}
+	return v, err
+}
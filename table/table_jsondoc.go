@@ -0,0 +1,161 @@
+package table
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+/*
+JSON document columns. a TYPE_JSON value is the text of a document in
+Str, of any JSON type. it's checked when it's written, and a document
+that is not valid UTF-8 JSON fails the write with a *ValidationError
+wrapping ErrInvalidJSON. it's stored compacted, so a read gives the text
+without the whitespace. a large document is a large row, and goes to the
+overflow pages like one.
+
+the fields are read with Value.JSONGet and a path of object keys and
+array positions separated by dots, like "user.tags.0". a key with a dot
+can't be reached. the numbers keep their text until they are read: a
+number without a fraction or an exponent that fits is an INT64, so the
+large ids are exact, and the others are FLOAT64. a string is BYTES, an
+object or an array is a JSON value of its text.
+
+a filter expression compares a field with `payload.user.id = 42`. a
+missing field and a JSON null are null. an INT64 and a FLOAT64 compare
+as numbers; a field of another type than the literal matches no
+comparison, except !=. a JSON column is not indexed; a path of it is, by
+a computed index of JSONIndexFunc.
+*/
+
+// a TYPE_JSON value that doesn't parse
+var ErrInvalidJSON = errors.New("invalid JSON")
+
+func jsonValid(doc []byte) bool {
+	return utf8.Valid(doc) && json.Valid(doc)
+}
+
+// the document without the whitespace. it's checked by checkValue before
+// it's written.
+func jsonCompact(doc []byte) []byte {
+	buf := bytes.Buffer{}
+	if json.Compact(&buf, doc) != nil {
+		return doc
+	}
+	return buf.Bytes()
+}
+
+// the field at `path` of a document, "" for the whole document; see the
+// top. false for a missing field or a value that is not a document.
+func (v *Value) JSONGet(path string) (Value, bool) {
+	if v.Type != TYPE_JSON {
+		return Value{}, false
+	}
+	raw := json.RawMessage(bytes.TrimSpace(v.Str))
+	if path != "" {
+		for _, key := range strings.Split(path, ".") {
+			var ok bool
+			if raw, ok = jsonField(raw, key); !ok {
+				return Value{}, false
+			}
+		}
+	}
+	return jsonValue(raw)
+}
+
+// a field of an object, or an element of an array by its position
+func jsonField(raw json.RawMessage, key string) (json.RawMessage, bool) {
+	switch {
+	case len(raw) > 0 && raw[0] == '{':
+		obj := map[string]json.RawMessage{}
+		if json.Unmarshal(raw, &obj) != nil {
+			return nil, false
+		}
+		field, ok := obj[key]
+		return field, ok
+	case len(raw) > 0 && raw[0] == '[':
+		arr := []json.RawMessage{}
+		if json.Unmarshal(raw, &arr) != nil {
+			return nil, false
+		}
+		i, err := strconv.Atoi(key)
+		if err != nil || i < 0 || i >= len(arr) {
+			return nil, false
+		}
+		return arr[i], true
+	}
+	return nil, false
+}
+
+// a JSON value as a Value; see the top
+func jsonValue(raw json.RawMessage) (Value, bool) {
+	if len(raw) == 0 {
+		return Value{}, false
+	}
+	switch raw[0] {
+	case 'n':
+		return Value{Type: TYPE_NULL}, true
+	case 't', 'f':
+		v := Value{Type: TYPE_BOOL}
+		if raw[0] == 't' {
+			v.I64 = 1
+		}
+		return v, true
+	case '"':
+		s := ""
+		if json.Unmarshal(raw, &s) != nil {
+			return Value{}, false
+		}
+		return Value{Type: TYPE_BYTES, Str: []byte(s)}, true
+	case '{', '[':
+		return Value{Type: TYPE_JSON, Str: jsonCompact(raw)}, true
+	}
+	text := string(raw)
+	if !strings.ContainsAny(text, ".eE") {
+		if i, err := strconv.ParseInt(text, 10, 64); err == nil {
+			return Value{Type: TYPE_INT64, I64: i}, true
+		}
+	}
+	// out of range is an infinity
+	f, err := strconv.ParseFloat(text, 64)
+	if err != nil && !errors.Is(err, strconv.ErrRange) {
+		return Value{}, false
+	}
+	return Value{Type: TYPE_FLOAT64, F64: f}, true
+}
+
+// a field compared with a literal of a filter: true if they are of the
+// same type, after an INT64 field is taken as a FLOAT64. an INT64 literal
+// has its F64 for a FLOAT64 field.
+func jsonCoerce(field *Value, lit *Value) bool {
+	switch {
+	case field.Type == lit.Type:
+		return true
+	case field.Type == TYPE_INT64 && lit.Type == TYPE_FLOAT64:
+		*field = Value{Type: TYPE_FLOAT64, F64: float64(field.I64)}
+		return true
+	case field.Type == TYPE_FLOAT64 && lit.Type == TYPE_INT64:
+		return true
+	}
+	return false
+}
+
+// a function of a computed index on the field at `path` of its argument,
+// a JSON column, for DB.RegisterIndexFunc with the same type. a missing
+// field, or one of another type, is a null; an INT64 field is converted
+// for a FLOAT64 index.
+func JSONIndexFunc(path string, tp uint32) func(args []Value) Value {
+	return func(args []Value) Value {
+		v, ok := args[0].JSONGet(path)
+		if ok && v.Type == TYPE_INT64 && tp == TYPE_FLOAT64 {
+			v = Value{Type: TYPE_FLOAT64, F64: float64(v.I64)}
+		}
+		if !ok || v.Type != tp {
+			return Value{Type: TYPE_NULL}
+		}
+		return v
+	}
+}
@@ -0,0 +1,210 @@
+package table
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/Adit0507/AdiDB/internal/btree_iter"
+)
+
+/*
+a bulk load writes the rows of an empty table with KV.BulkLoad, which
+takes the KVs in key order. the rows come in primary key order and are
+passed through, while the secondary index keys are collected and sorted
+in memory. the KVs of each index go in the order of the key prefixes; if
+an index prefix is before the primary key prefix, the rows are collected
+first.
+*/
+
+// an index key; the first `n` bytes must not repeat in a unique index
+type loadKey struct {
+	key []byte
+	n   int
+}
+
+// add rows to an empty table, in strictly ascending primary key order.
+// it's much faster than inserts for a large input; see KV.BulkLoad.
+// a missing auto-increment key is generated. nothing is written if any
+// record is invalid. the table must not be written concurrently, and it
+// can't have a change log. the auto-increment counter and the row counters
+// are updated after the rows. returns the number of rows.
+func (db *DB) Load(table string, next func() (*Record, bool)) (int, error) {
+	tx := DBTX{}
+	db.BeginRead(&tx)
+	tdef, err := getTableDef(&tx, table)
+	counter := int64(1)
+	if err == nil && tdef.Changes {
+		err = fmt.Errorf("a bulk load is not in the change log: %s", table)
+	} else if err == nil {
+		counter, err = loadCheck(&tx, tdef)
+	}
+	if err != nil {
+		db.Abort(&tx)
+		return 0, err
+	}
+	defer db.Abort(&tx) // for the parents of foreign keys
+
+	cols := slices.Concat(tdef.Indexes[0], nonPrimaryKeyCols(tdef))
+	np := len(tdef.Indexes[0])
+	keys := make([][]loadKey, len(tdef.Indexes))
+
+	// a row as a KV; the index keys are collected
+	nrows, last, nbytes := 0, int64(0), int64(0)
+	var prev []byte
+	row := func() ([]byte, []byte, error) {
+		rec, ok := next()
+		if !ok {
+			return nil, nil, io.EOF
+		}
+		nrows++
+		check := *rec
+		if tdef.AutoInc {
+			if v := rec.Get(tdef.Indexes[0][0]); v == nil {
+				check.Cols = append(slices.Clip(rec.Cols), tdef.Indexes[0][0])
+				check.Vals = append(slices.Clip(rec.Vals), Value{Type: TYPE_INT64, I64: counter})
+			}
+		}
+		if _, err := checkRecord(tdef, check, len(tdef.Cols)); err != nil {
+			return nil, nil, errRecord(err, nrows-1)
+		}
+		values, err := getValues(tdef, check, cols)
+		assert(err == nil)
+		if err := checkConstraints(db, tdef, Record{cols, values}); err != nil {
+			return nil, nil, errRecord(err, nrows-1)
+		}
+		if err := fkeyParents(&tx, tdef, Record{cols, values}); err != nil {
+			return nil, nil, errRecord(err, nrows-1)
+		}
+		key := encodeKey(nil, tdef.Prefixes[0], values[:np])
+		if prev != nil && bytes.Compare(prev, key) >= 0 {
+			return nil, nil, fmt.Errorf("record %d: not in primary key order", nrows-1)
+		}
+		prev = key
+		if tdef.AutoInc && values[0].I64 >= counter {
+			counter, last = values[0].I64+1, values[0].I64
+		}
+
+		newRec := Record{cols, values}
+		for i := 1; i < len(tdef.Indexes); i++ {
+			vals, err := indexValues(db, tdef, i, newRec)
+			if err != nil {
+				return nil, nil, errRecord(err, nrows-1)
+			}
+			k := loadKey{key: indexKey(nil, tdef, i, vals)}
+			if isUnique(tdef, i) {
+				k.n = len(indexKey(nil, tdef, i, uniqueVals(tdef, i, vals)))
+			}
+			keys[i] = append(keys[i], k)
+		}
+		val := encodeRow(nil, values[np:])
+		nbytes += int64(len(key) + len(val))
+		return key, val, nil
+	}
+
+	// the indexes in the order of the prefixes
+	order := make([]int, len(tdef.Indexes))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortFunc(order, func(a, b int) int {
+		return cmp.Compare(tdef.Prefixes[a], tdef.Prefixes[b])
+	})
+	var rows [][2][]byte
+	if order[0] != 0 {
+		for {
+			key, val, err := row()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return 0, err
+			}
+			rows = append(rows, [2][]byte{key, val})
+		}
+	}
+
+	pos, idx := 0, 0 // in `order` and in the current index
+	input := func() ([]byte, []byte, error) {
+		for ; pos < len(order); pos, idx = pos+1, 0 {
+			i := order[pos]
+			switch {
+			case i == 0 && order[0] == 0:
+				key, val, err := row()
+				if err != io.EOF {
+					return key, val, err
+				}
+			case i == 0 && idx < len(rows):
+				idx++
+				return rows[idx-1][0], rows[idx-1][1], nil
+			case i > 0 && idx < len(keys[i]):
+				if idx == 0 {
+					if err := loadSort(tdef, i, keys[i]); err != nil {
+						return nil, nil, err
+					}
+				}
+				idx++
+				return keys[i][idx-1].key, nil, nil
+			}
+		}
+		return nil, nil, io.EOF
+	}
+	if _, err := db.kv.BulkLoad(input); err != nil {
+		return 0, err
+	}
+
+	if nrows == 0 {
+		return 0, nil
+	}
+	// count the rows and move the auto-increment counter past the keys
+	wtx := DBTX{}
+	db.Begin(&wtx)
+	err = statsAdd(&wtx, tdef, int64(nrows), nbytes)
+	if err == nil && tdef.AutoInc && last > 0 {
+		dbreq := DBUpdateReq{Record: *(&Record{}).AddInt64(tdef.Indexes[0][0], last)}
+		err = autoIncrement(&wtx, tdef, &dbreq)
+	}
+	if err != nil {
+		db.Abort(&wtx)
+		return nrows, err
+	}
+	if err := db.Commit(&wtx); err != nil {
+		return nrows, err
+	}
+	return nrows, nil
+}
+
+// the table is empty; returns the auto-increment counter
+func loadCheck(tx *DBTX, tdef *TableDef) (counter int64, err error) {
+	defer checksumRecover(&err)
+	start := encodeKey(nil, tdef.Prefixes[0], nil)
+	end := encodeKey(nil, tdef.Prefixes[0]+1, nil)
+	if tx.kv.Seek(start, btree_iter.CMP_GE, end, btree_iter.CMP_LT).Valid() {
+		return 0, fmt.Errorf("table is not empty: %s", tdef.Name)
+	}
+
+	meta := (&Record{}).AddStr("key", autoIncKey(tdef.Name))
+	ok, err := dbGet(tx, TDEF_META, meta)
+	if err != nil || !ok {
+		return 1, err
+	}
+	return autoIncDecode(tdef.Name, meta.Get("val").Str)
+}
+
+// sort the keys of a secondary index and check the unique columns
+func loadSort(tdef *TableDef, idx int, keys []loadKey) error {
+	slices.SortFunc(keys, func(a, b loadKey) int {
+		return bytes.Compare(a.key, b.key)
+	})
+	if !isUnique(tdef, idx) || len(uniqueCols(tdef, idx)) == 0 {
+		return nil
+	}
+	for i := 1; i < len(keys); i++ {
+		if bytes.Equal(keys[i-1].key[:keys[i-1].n], keys[i].key[:keys[i].n]) {
+			return fmt.Errorf("%w: table %s, index %v",
+				ErrUniqueViolation, tdef.Name, uniqueCols(tdef, idx))
+		}
+	}
+	return nil
+}
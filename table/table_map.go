@@ -0,0 +1,227 @@
+package table
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"time"
+)
+
+/*
+records as map[string]any, for handlers that decode JSON into maps. ToMap
+gives each value as its Go type: nil for NULL, int64, float64, bool,
+time.Time, and []byte for BYTES, or a string with MapOptions.Strings,
+and json.RawMessage for JSON.
+
+RecordFromMap goes the other way with the schema, since a decoded number
+doesn't say which column type it's for. it takes:
+- nil for NULL.
+- INT64: any Go integer, a json.Number, or a float that is a whole number,
+  as encoding/json decodes numbers; a value out of range is an error.
+- FLOAT64: any Go number or a json.Number.
+- BOOL: a bool.
+- TIMESTAMP: a time.Time, an RFC 3339 string, or an INT64 of nanoseconds.
+- BYTES: a string or a []byte.
+- JSON: a json.RawMessage or a []byte of the document text, or any other
+  value, which is marshaled, so a string is a JSON string.
+the errors are *ValidationError: *ErrUnknownColumn for a key that is not a
+column, and *ErrBadColumnType for a value that doesn't convert.
+*/
+
+type MapOptions struct {
+	Strings bool // BYTES as string instead of []byte
+}
+
+// the columns of the record by name; see the top
+func (rec *Record) ToMap() map[string]any {
+	return rec.ToMapOpts(MapOptions{})
+}
+
+func (rec *Record) ToMapOpts(opts MapOptions) map[string]any {
+	out := make(map[string]any, len(rec.Cols))
+	for i, col := range rec.Cols {
+		v := &rec.Vals[i]
+		switch v.Type {
+		case TYPE_NULL:
+			out[col] = nil
+		case TYPE_BYTES:
+			if opts.Strings {
+				out[col] = string(v.Str)
+			} else {
+				out[col] = v.Str
+			}
+		case TYPE_FLOAT64:
+			out[col] = v.F64
+		case TYPE_BOOL:
+			out[col] = v.Bool()
+		case TYPE_TIMESTAMP:
+			out[col] = v.Time()
+		case TYPE_JSON:
+			out[col] = json.RawMessage(v.Str)
+		default:
+			out[col] = v.I64
+		}
+	}
+	return out
+}
+
+// a record of the keys of `m` in the order of the schema; see the top.
+// the columns that are not in `m` are not in the record.
+func RecordFromMap(tdef *TableDef, m map[string]any) (Record, error) {
+	rec := Record{}
+	for key := range m {
+		if !slices.Contains(tdef.Cols, key) {
+			return Record{}, &ValidationError{Table: tdef.Name, Col: key, Record: -1,
+				Err: &ErrUnknownColumn{Col: key}}
+		}
+	}
+	for i, col := range tdef.Cols {
+		x, ok := m[col]
+		if !ok {
+			continue
+		}
+		v, err := mapValue(tdef.Types[i], x)
+		if err != nil {
+			e := errColumn(tdef, i, nil, fmt.Errorf("%w: %v", &ErrBadColumnType{Col: col}, err))
+			return Record{}, e
+		}
+		rec.Cols = append(rec.Cols, col)
+		rec.Vals = append(rec.Vals, v)
+	}
+	return rec, nil
+}
+
+// a Go value as a value of the column type
+func mapValue(tp uint32, x any) (Value, error) {
+	v := Value{Type: tp}
+	if x == nil {
+		return Value{Type: TYPE_NULL}, nil
+	}
+	var err error
+	switch tp {
+	case TYPE_INT64:
+		v.I64, err = mapInt64(x)
+	case TYPE_FLOAT64:
+		v.F64, err = mapFloat64(x)
+	case TYPE_BOOL:
+		b, ok := x.(bool)
+		if !ok {
+			return v, mapTypeErr(x)
+		}
+		if b {
+			v.I64 = 1
+		}
+	case TYPE_TIMESTAMP:
+		switch t := x.(type) {
+		case time.Time:
+			v.I64 = t.UnixNano()
+		case string:
+			parsed, perr := time.Parse(time.RFC3339Nano, t)
+			v.I64, err = parsed.UnixNano(), perr
+		default:
+			v.I64, err = mapInt64(x)
+		}
+	case TYPE_BYTES:
+		switch s := x.(type) {
+		case string:
+			v.Str = []byte(s)
+		case []byte:
+			v.Str = s
+		default:
+			return v, mapTypeErr(x)
+		}
+	case TYPE_JSON:
+		switch doc := x.(type) {
+		case json.RawMessage:
+			v.Str = doc
+		case []byte:
+			v.Str = doc
+		default:
+			v.Str, err = json.Marshal(x)
+		}
+	default:
+		return v, fmt.Errorf("unknown column type: %d", tp)
+	}
+	return v, err
+}
+
+func mapTypeErr(x any) error {
+	return fmt.Errorf("a value of %T", x)
+}
+
+func mapInt64(x any) (int64, error) {
+	switch n := x.(type) {
+	case int:
+		return int64(n), nil
+	case int8:
+		return int64(n), nil
+	case int16:
+		return int64(n), nil
+	case int32:
+		return int64(n), nil
+	case int64:
+		return n, nil
+	case uint:
+		return mapUint64(uint64(n))
+	case uint8:
+		return int64(n), nil
+	case uint16:
+		return int64(n), nil
+	case uint32:
+		return int64(n), nil
+	case uint64:
+		return mapUint64(n)
+	case float32:
+		return mapFloatInt(float64(n))
+	case float64:
+		return mapFloatInt(n)
+	case json.Number:
+		i, err := strconv.ParseInt(string(n), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("not an INT64: %s", n)
+		}
+		return i, nil
+	default:
+		return 0, mapTypeErr(x)
+	}
+}
+
+func mapUint64(n uint64) (int64, error) {
+	if n > math.MaxInt64 {
+		return 0, fmt.Errorf("out of range: %d", n)
+	}
+	return int64(n), nil
+}
+
+// a whole number in the range of INT64. 2^63 is the first float past it.
+func mapFloatInt(f float64) (int64, error) {
+	if f != math.Trunc(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("not a whole number: %v", f)
+	}
+	if f < math.MinInt64 || f >= 1<<63 {
+		return 0, fmt.Errorf("out of range: %v", f)
+	}
+	return int64(f), nil
+}
+
+func mapFloat64(x any) (float64, error) {
+	switch n := x.(type) {
+	case float32:
+		return float64(n), nil
+	case float64:
+		return n, nil
+	case json.Number:
+		f, err := strconv.ParseFloat(string(n), 64)
+		if err != nil {
+			return 0, fmt.Errorf("not a FLOAT64: %s", n)
+		}
+		return f, nil
+	}
+	i, err := mapInt64(x)
+	if err != nil {
+		return 0, mapTypeErr(x)
+	}
+	return float64(i), nil
+}
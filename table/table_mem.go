@@ -0,0 +1,138 @@
+package table
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"unsafe"
+)
+
+var ErrMemoryBudget = errors.New("memory budget exceeded")
+
+// memory held by the open scanners of a DB
+type memBudget struct {
+	mu       sync.Mutex
+	used     int64
+	scanners map[*Scanner]bool
+}
+
+// approximate memory of a decoded row. it's conservative because
+// decoded strings are never longer than their encoded form.
+func rowMemSize(tdef *TableDef, key []byte, val []byte) int64 {
+	size := int64(len(key) + len(val))
+	for _, c := range tdef.Cols {
+		size += int64(unsafe.Sizeof(Value{})) + int64(unsafe.Sizeof(c)) + int64(len(c))
+	}
+	return size
+}
+
+// approximate memory of values held apart from a row, such as the keys
+// of GroupBy
+func valuesMemSize(vals []Value) int64 {
+	size := int64(len(vals)) * int64(unsafe.Sizeof(Value{}))
+	for i := range vals {
+		size += int64(len(vals[i].Str))
+	}
+	return size
+}
+
+// register a scanner so that its memory can be tracked and released
+func scanOpen(sc *Scanner) {
+	mem := &sc.tx.db.mem
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	if mem.scanners == nil {
+		mem.scanners = map[*Scanner]bool{}
+	}
+	mem.release(sc) // reused scanner
+	sc.mem, sc.rowMem = 0, 0
+	mem.scanners[sc] = true
+}
+
+// charge `n` bytes to the scanner and the DB, negative to release.
+func scanCharge(sc *Scanner, n int64) error {
+	db := sc.tx.db
+	mem := &db.mem
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	if !mem.scanners[sc] {
+		return nil // closed; nothing is tracked
+	}
+
+	if n > 0 && db.ScanMemLimit > 0 && sc.mem+n > db.ScanMemLimit {
+		return fmt.Errorf("%w: scanner needs %d bytes, limit %d",
+			ErrMemoryBudget, sc.mem+n, db.ScanMemLimit)
+	}
+	if n > 0 && db.MemLimit > 0 && mem.used+n > db.MemLimit {
+		return fmt.Errorf("%w: scanners need %d bytes, limit %d",
+			ErrMemoryBudget, mem.used+n, db.MemLimit)
+	}
+	sc.mem += n
+	mem.used += n
+	return nil
+}
+
+func (mem *memBudget) release(sc *Scanner) {
+	if mem.scanners[sc] {
+		delete(mem.scanners, sc)
+		mem.used -= sc.mem
+		sc.mem, sc.rowMem = 0, 0
+	}
+}
+
+// release scanners left open by a finished transaction
+func (mem *memBudget) closeTX(tx *DBTX) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	for sc := range mem.scanners {
+		if sc.tx == tx {
+			mem.release(sc)
+		}
+	}
+}
+
+// release the memory held by the scanner, and end the transaction of
+// DB.Find. scanners are also closed when the transaction ends.
+func (sc *Scanner) Close() {
+	if sc.tx == nil {
+		return
+	}
+	mem := &sc.tx.db.mem
+	mem.mu.Lock()
+	mem.release(sc)
+	mem.mu.Unlock()
+	if sc.owned {
+		sc.owned = false
+		sc.tx.db.Abort(sc.tx)
+	}
+}
+
+// bytes currently charged to the scanner
+func (sc *Scanner) MemUsed() int64 {
+	return sc.mem
+}
+
+// for debugging: an open scanner and its memory usage
+type ScanStat struct {
+	Table string
+	Index int
+	Mem   int64
+}
+
+// list open scanners
+func (db *DB) ScanStats() []ScanStat {
+	db.mem.mu.Lock()
+	defer db.mem.mu.Unlock()
+	out := []ScanStat{}
+	for sc := range db.mem.scanners {
+		out = append(out, ScanStat{Table: sc.tdef.Name, Index: sc.index, Mem: sc.mem})
+	}
+	return out
+}
+
+// bytes held by all open scanners
+func (db *DB) MemUsed() int64 {
+	db.mem.mu.Lock()
+	defer db.mem.mu.Unlock()
+	return db.mem.used
+}
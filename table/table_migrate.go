@@ -0,0 +1,119 @@
+package table
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+/*
+schema migrations. an application registers its migrations in a Migrator,
+in the order of their ids, and calls DB.Migrate on open. the id of the last
+migration applied is the schema version, kept in @meta. each pending
+migration runs in its own transaction, which also moves the version to its
+id, so a failed migration leaves the version at the one before it and
+nothing of its own updates; the next Migrate starts again from it.
+
+Migrate calls are serialized in the process by a mutex and between
+processes by KV.LockFile, and the version is read after both are taken.
+a process only sees the commits of another one after it reopens the file,
+so a file written by several processes must be migrated before the others
+open it.
+*/
+
+// @meta key of the id of the last migration applied
+const SCHEMA_VERSION_KEY = "schema_version"
+
+type Migration struct {
+	ID uint64 // > 0, increasing in the Migrator
+	Fn func(tx *DBTX) error
+}
+
+type Migrator struct {
+	Migrations []Migration
+}
+
+// add a migration after the others
+func (m *Migrator) Add(id uint64, fn func(tx *DBTX) error) *Migrator {
+	m.Migrations = append(m.Migrations, Migration{ID: id, Fn: fn})
+	return m
+}
+
+// the id of the last migration applied; 0 if none
+func (db *DB) SchemaVersion() (uint64, error) {
+	tx := DBTX{}
+	db.BeginRead(&tx)
+	defer db.Abort(&tx)
+	return schemaVersion(&tx)
+}
+
+func schemaVersion(tx *DBTX) (uint64, error) {
+	meta := (&Record{}).AddStr("key", []byte(SCHEMA_VERSION_KEY))
+	ok, err := dbGet(tx, TDEF_META, meta)
+	if err != nil || !ok {
+		return 0, err
+	}
+	val := meta.Get("val").Str
+	if len(val) != 8 {
+		return 0, errCorrupt("bad %s", SCHEMA_VERSION_KEY)
+	}
+	return binary.LittleEndian.Uint64(val), nil
+}
+
+// apply the migrations after the schema version, in order. returns the
+// number applied; on an error the ones before it stay applied.
+func (db *DB) Migrate(m *Migrator) (int, error) {
+	for i, mig := range m.Migrations {
+		if mig.ID == 0 || (i > 0 && mig.ID <= m.Migrations[i-1].ID) {
+			return 0, fmt.Errorf("migration %d: ids must increase from 1", mig.ID)
+		}
+	}
+
+	db.migrating.Lock()
+	defer db.migrating.Unlock()
+	unlock, err := db.kv.LockFile()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	version, err := db.SchemaVersion()
+	if err != nil {
+		return 0, err
+	}
+	applied := 0
+	for _, mig := range m.Migrations {
+		if mig.ID <= version {
+			continue
+		}
+		if err := migrateOne(db, mig); err != nil {
+			return applied, fmt.Errorf("migration %d: %w", mig.ID, err)
+		}
+		applied++
+	}
+	return applied, nil
+}
+
+// the migration and the version in a transaction
+func migrateOne(db *DB, mig Migration) error {
+	tx := DBTX{}
+	db.Begin(&tx)
+	err := mig.Fn(&tx)
+	if err == nil {
+		// reading it again makes a concurrent Migrate a conflict
+		var version uint64
+		version, err = schemaVersion(&tx)
+		if err == nil && version >= mig.ID {
+			err = fmt.Errorf("already applied, the version is %d", version)
+		}
+	}
+	if err == nil {
+		val := binary.LittleEndian.AppendUint64(nil, mig.ID)
+		meta := (&Record{}).AddStr("key", []byte(SCHEMA_VERSION_KEY)).AddStr("val", val)
+		_, err = dbUpdate(&tx, TDEF_META, &DBUpdateReq{Record: *meta})
+	}
+	if err != nil {
+		db.Abort(&tx)
+		return err
+	}
+	return db.Commit(&tx)
+}
@@ -0,0 +1,181 @@
+package table
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+
+	"github.com/Adit0507/AdiDB/internal/btree_iter"
+)
+
+/*
+a scan of several ranges of the same index as one stream, such as the rows
+of `user_id IN (a, b, c)`. the ranges are sorted by their start in the
+direction of the scan and scanned one after another with a single Scanner.
+a range that starts at or before the last key returned starts after it
+instead, so overlapping ranges don't return a row twice and the keys stay
+in order.
+*/
+
+// a range of MultiScanner, as in Scanner
+type ScanRange struct {
+	Cmp1 int
+	Cmp2 int
+	Key1 Record
+	Key2 Record
+}
+
+type MultiScanner struct {
+	Ranges []ScanRange
+	// Desc, Cols, Filter, Ctx and Reuse as in Scanner; its range is not
+	// used. Offset and Limit count the rows of all ranges.
+	Opts Scanner
+
+	// internal
+	sc     Scanner // of the current range
+	ranges []multiRange
+	next   int    // in `ranges`
+	open   bool   // `sc` is positioned
+	last   []byte // the key of the last row passed
+	count  int    // rows passed by Next()
+	fail   error
+}
+
+// an encoded range
+type multiRange struct {
+	start []byte
+	end   []byte
+	cmp1  int
+	cmp2  int
+}
+
+// scan the ranges of `req` in a transaction
+func (tx *DBTX) MultiScan(table string, req *MultiScanner) error {
+	tdef, err := getTableDef(tx, table)
+	if err != nil {
+		return err
+	}
+	if err := scanCheck(tdef, &req.Opts); err != nil {
+		return err
+	}
+
+	// the ranges must agree on the index and the direction
+	req.ranges = req.ranges[:0]
+	index := -1
+	for _, r := range req.Ranges {
+		sc := Scanner{Cmp1: r.Cmp1, Cmp2: r.Cmp2, Key1: r.Key1, Key2: r.Key2, Desc: req.Opts.Desc}
+		start, end, err := scanRange(tdef, &sc)
+		if err != nil {
+			return err
+		}
+		if index >= 0 && sc.index != index {
+			return fmt.Errorf("%w: the ranges are on different indexes", ErrBadRange)
+		}
+		if len(req.ranges) > 0 && (sc.cmp1 > 0) != (req.ranges[0].cmp1 > 0) {
+			return fmt.Errorf("%w: the ranges go in different directions", ErrBadRange)
+		}
+		index = sc.index
+		req.ranges = append(req.ranges, multiRange{start, end, sc.cmp1, sc.cmp2})
+	}
+	slices.SortStableFunc(req.ranges, func(a, b multiRange) int {
+		if a.cmp1 < 0 {
+			return bytes.Compare(b.start, a.start)
+		}
+		return bytes.Compare(a.start, b.start)
+	})
+	req.ranges = slices.CompactFunc(req.ranges, func(a, b multiRange) bool {
+		return bytes.Equal(a.start, b.start) && bytes.Equal(a.end, b.end) &&
+			a.cmp1 == b.cmp1 && a.cmp2 == b.cmp2
+	})
+
+	// the scanner of the ranges
+	req.sc.Close()
+	opts := &req.Opts
+	req.sc = Scanner{Cols: opts.Cols, Filter: opts.Filter, Ctx: opts.Ctx, Reuse: opts.Reuse}
+	req.sc.prog = opts.prog
+	req.sc.tx, req.sc.tdef, req.sc.index = tx, tdef, max(index, 0)
+	req.next, req.open, req.last, req.count, req.fail = 0, false, nil, 0, nil
+	if req.fail = multiFill(req); req.fail != nil {
+		return req.fail
+	}
+	for i := 0; i < opts.Offset && multiValid(req); i++ {
+		multiStep(req)
+	}
+	req.count = 0
+	return req.fail
+}
+
+// move to the next range with a row, if the current one is done
+func multiFill(req *MultiScanner) error {
+	for req.next < len(req.ranges) {
+		if req.open && (req.sc.Valid() || req.sc.Err() != nil) {
+			return req.sc.Err()
+		}
+		r := req.ranges[req.next]
+		req.next++
+		// not before the rows already passed
+		start, cmp1 := r.start, r.cmp1
+		if req.last != nil {
+			c := bytes.Compare(start, req.last)
+			if cmp1 > 0 && c <= 0 {
+				start, cmp1 = req.last, btree_iter.CMP_GT
+			} else if cmp1 < 0 && c >= 0 {
+				start, cmp1 = req.last, btree_iter.CMP_LT
+			}
+		}
+		req.sc.cmp1, req.sc.cmp2 = cmp1, r.cmp2
+		if err := scanSeek(req.sc.tx, &req.sc, slices.Clone(start), r.end); err != nil {
+			return err
+		}
+		req.open = true
+	}
+	return nil
+}
+
+func multiValid(req *MultiScanner) bool {
+	return req.fail == nil && req.open && req.sc.Valid()
+}
+
+// pass the current row
+func multiStep(req *MultiScanner) {
+	req.last = append(req.last[:0], req.sc.Key()...)
+	req.sc.Next()
+	req.fail = multiFill(req)
+}
+
+func (req *MultiScanner) Valid() bool {
+	if req.Opts.Limit > 0 && req.count >= req.Opts.Limit {
+		return false
+	}
+	return multiValid(req)
+}
+
+func (req *MultiScanner) Next() {
+	if !req.Valid() {
+		return
+	}
+	req.count++
+	multiStep(req)
+}
+
+// the current row; see Scanner.Deref
+func (req *MultiScanner) Deref(rec *Record) error {
+	return req.sc.Deref(rec)
+}
+
+// the error that stopped the scan early, if any
+func (req *MultiScanner) Err() error {
+	if req.fail != nil {
+		return req.fail
+	}
+	return req.sc.Err()
+}
+
+// the index of the ranges; 0 is the primary key
+func (req *MultiScanner) Index() int {
+	return req.sc.index
+}
+
+func (req *MultiScanner) Close() {
+	req.sc.Close()
+}
@@ -0,0 +1,395 @@
+package table
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/Adit0507/AdiDB/internal/btree_iter"
+)
+
+/*
+choosing the index of a scan from conditions on columns, for DB.Find and
+the SQL layer. an index is scored by its leading columns fixed by `=`, two
+each, then one for each bound on the next column; the highest score wins.
+a tie is decided by the estimated rows of the ranges, and without
+statistics by the order of the indexes, so the primary key wins. the
+conditions that the range doesn't cover are checked by Scanner.Filter.
+
+the estimates come from DB.Analyze, which counts the keys of each index and
+the distinct values of its leading column, and keeps them in @meta. they
+are not updated by writes, so they are as old as the last Analyze. a range
+that fixes the leading column is estimated at rows/distinct, a range on
+it at a third of the rows, and no range at all of them.
+*/
+
+// Cond.Op of an equality; the other ops are the CMP_* of Scanner.Cmp1
+const COND_EQ = 0
+
+// a column compared with a value
+type Cond struct {
+	Col string
+	Op  int
+	Val Value
+}
+
+// how a scan is run; see Scanner.Plan
+type Plan struct {
+	Index int      // of TableDef.Indexes
+	Cols  []string // of the index
+	// the range of the index, as in Scanner
+	Key1 Record
+	Key2 Record
+	Cmp1 int
+	Cmp2 int
+	// the conditions checked on each row of the range
+	Filter []Cond
+	// the estimated rows of the range; -1 without statistics
+	Rows int64
+}
+
+// the statistics of an index, as of the last DB.Analyze
+type IndexStats struct {
+	Rows     int64
+	Distinct int64 // values of the leading column
+}
+
+// @meta key of the statistics of the index with the prefix
+func indexStatsKey(prefix uint32) []byte {
+	return binary.BigEndian.AppendUint32([]byte("index_stats:"), prefix)
+}
+
+// the statistics of an index; false if it has none
+func indexStats(tx *DBTX, prefix uint32) (IndexStats, bool, error) {
+	meta := (&Record{}).AddStr("key", indexStatsKey(prefix))
+	ok, err := dbGet(tx, TDEF_META, meta)
+	if err != nil || !ok {
+		return IndexStats{}, false, err
+	}
+	val := meta.Get("val").Str
+	if len(val) != 16 {
+		return IndexStats{}, false, errCorrupt("bad %s", indexStatsKey(prefix))
+	}
+	return IndexStats{
+		Rows:     int64(binary.LittleEndian.Uint64(val[0:8])),
+		Distinct: int64(binary.LittleEndian.Uint64(val[8:16])),
+	}, true, nil
+}
+
+// count the keys of the indexes of a table and the distinct values of
+// their leading columns for the planner. it reads the whole table.
+func (db *DB) Analyze(table string) error {
+	return indexTX(db, func(tx *DBTX) error {
+		tdef, err := getTableDef(tx, table)
+		if err != nil {
+			return err
+		}
+		for i, prefix := range tdef.Prefixes {
+			if isBuilding(tdef, i) {
+				continue
+			}
+			stats, err := analyzeIndex(tx, tdef, i)
+			if err != nil {
+				return err
+			}
+			val := binary.LittleEndian.AppendUint64(nil, uint64(stats.Rows))
+			val = binary.LittleEndian.AppendUint64(val, uint64(stats.Distinct))
+			meta := (&Record{}).AddStr("key", indexStatsKey(prefix)).AddStr("val", val)
+			if _, err := dbUpdate(tx, TDEF_META, &DBUpdateReq{Record: *meta}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// the keys are in order, so a new leading value differs from the last one
+func analyzeIndex(tx *DBTX, tdef *TableDef, idx int) (stats IndexStats, err error) {
+	defer checksumRecover(&err)
+	_, types := indexKeyCols(tdef, idx)
+	tp := types[0]
+	start := encodeKey(nil, tdef.Prefixes[idx], nil)
+	end := encodeKey(nil, tdef.Prefixes[idx]+1, nil)
+	iter := tx.kv.Seek(start, btree_iter.CMP_GE, end, btree_iter.CMP_LT)
+	var last []byte
+	for ; iter.Valid(); iter.Next() {
+		raw, _ := iter.Deref()
+		key, err := indexKeyAsc(tdef, idx, raw)
+		if err != nil {
+			return IndexStats{}, rowCorrupt(tdef, raw, err)
+		}
+		// the type tag and the value
+		n := -1
+		if len(key) > 4 && uint32(key[4]) == tp {
+			n = encodedLen(tp, key[5:])
+		}
+		if n < 0 {
+			return IndexStats{}, rowCorrupt(tdef, key, errCorrupt("bad leading column"))
+		}
+		lead := key[4 : 5+n]
+		if stats.Rows == 0 || !bytes.Equal(lead, last) {
+			stats.Distinct++
+			last = slices.Clone(lead)
+		}
+		stats.Rows++
+	}
+	return stats, nil
+}
+
+// check the conditions against the schema
+func condCheck(tdef *TableDef, conds []Cond) error {
+	for _, c := range conds {
+		col := slices.Index(tdef.Cols, c.Col)
+		if col < 0 {
+			return fmt.Errorf("unknown column: %s", c.Col)
+		}
+		switch c.Op {
+		case COND_EQ, btree_iter.CMP_GT, btree_iter.CMP_GE, btree_iter.CMP_LT, btree_iter.CMP_LE:
+		default:
+			return fmt.Errorf("bad condition op: %d", c.Op)
+		}
+		if c.Val.Type == TYPE_NULL {
+			return fmt.Errorf("a condition can't compare with NULL: %s", c.Col)
+		}
+		if err := checkValue(tdef, col, c.Val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the best index for the conditions; see the top. with `pkOnly`, the
+// primary key is used.
+func planScan(tx *DBTX, tdef *TableDef, conds []Cond, pkOnly bool) (*Plan, error) {
+	if err := condCheck(tdef, conds); err != nil {
+		return nil, err
+	}
+	find := func(col string, ops ...int) int {
+		return slices.IndexFunc(conds, func(c Cond) bool {
+			return c.Col == col && slices.Contains(ops, c.Op)
+		})
+	}
+
+	var best *Plan
+	bestScore := -1
+	for i, index := range tdef.Indexes {
+		if pkOnly && i > 0 {
+			break
+		}
+		if isBuilding(tdef, i) || isComputed(tdef, i) {
+			continue // incomplete, or not on the columns
+		}
+		used := []int{}
+		key := Record{}
+		for _, col := range index {
+			j := find(col, COND_EQ)
+			if j < 0 {
+				break
+			}
+			used = append(used, j)
+			key.Cols = append(key.Cols, col)
+			key.Vals = append(key.Vals, conds[j].Val)
+		}
+		plan := &Plan{Index: i, Cols: index, Key1: key, Key2: key,
+			Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE}
+		score := 2 * len(key.Cols)
+		if n := len(key.Cols); n < len(index) {
+			bound := func(ops ...int) (Record, int, bool) {
+				j := find(index[n], ops...)
+				if j < 0 {
+					return key, 0, false
+				}
+				used = append(used, j)
+				return Record{
+					Cols: append(slices.Clone(key.Cols), index[n]),
+					Vals: append(slices.Clone(key.Vals), conds[j].Val),
+				}, conds[j].Op, true
+			}
+			k1, op1, ok1 := bound(btree_iter.CMP_GT, btree_iter.CMP_GE)
+			k2, op2, ok2 := bound(btree_iter.CMP_LT, btree_iter.CMP_LE)
+			if isDesc(tdef, i, n) {
+				// the range starts from the upper bound; see table_desc.go
+				k1, op1, ok1, k2, op2, ok2 = k2, -op2, ok2, k1, -op1, ok1
+			}
+			if ok1 {
+				plan.Key1, plan.Cmp1, score = k1, op1, score+1
+			}
+			if ok2 {
+				plan.Key2, plan.Cmp2, score = k2, op2, score+1
+			}
+		}
+		for j, c := range conds {
+			if !slices.Contains(used, j) {
+				plan.Filter = append(plan.Filter, c)
+			}
+		}
+		var err error
+		if plan.Rows, err = planRows(tx, tdef, plan, score); err != nil {
+			return nil, err
+		}
+
+		better := score > bestScore
+		if score == bestScore && plan.Rows >= 0 && best.Rows >= 0 {
+			better = plan.Rows < best.Rows
+		}
+		if better {
+			best, bestScore = plan, score
+		}
+	}
+	return best, nil
+}
+
+// the estimated rows of the range of a plan; see the top
+func planRows(tx *DBTX, tdef *TableDef, plan *Plan, score int) (int64, error) {
+	stats, ok, err := indexStats(tx, tdef.Prefixes[plan.Index])
+	if err != nil || !ok {
+		return -1, err
+	}
+	switch {
+	case score >= 2:
+		return stats.Rows / max(stats.Distinct, 1), nil
+	case score == 1:
+		return stats.Rows / 3, nil
+	default:
+		return stats.Rows, nil
+	}
+}
+
+// set up the scanner with the range and the filter of the plan
+func planApply(plan *Plan, sc *Scanner) {
+	sc.Key1, sc.Key2 = plan.Key1, plan.Key2
+	sc.Cmp1, sc.Cmp2 = plan.Cmp1, plan.Cmp2
+	sc.Filter = nil
+	if conds := plan.Filter; len(conds) > 0 {
+		sc.Filter = func(rec *Record) bool {
+			return condMatch(conds, rec)
+		}
+	}
+	sc.plan = plan
+}
+
+// every condition holds; NULL matches nothing
+func condMatch(conds []Cond, rec *Record) bool {
+	for i := range conds {
+		v := rec.Get(conds[i].Col)
+		if v == nil || v.Type == TYPE_NULL || !condHolds(conds[i].Op, v, &conds[i].Val) {
+			return false
+		}
+	}
+	return true
+}
+
+// a non-null value compared with `val` of its type; also used by the
+// filter expressions
+func condHolds(op int, v *Value, val *Value) bool {
+	r := 0
+	switch v.Type {
+	case TYPE_BYTES, TYPE_JSON:
+		r = bytes.Compare(v.Str, val.Str)
+	case TYPE_FLOAT64:
+		r = cmp.Compare(v.F64, val.F64)
+	default:
+		r = cmp.Compare(v.I64, val.I64)
+	}
+	switch op {
+	case COND_EQ:
+		return r == 0
+	case btree_iter.CMP_GT:
+		return r > 0
+	case btree_iter.CMP_GE:
+		return r >= 0
+	case btree_iter.CMP_LT:
+		return r < 0
+	case btree_iter.CMP_LE:
+		return r <= 0
+	}
+	return false
+}
+
+// the plan of a scan set up by Find or by the SQL layer; nil otherwise
+func (sc *Scanner) Plan() *Plan {
+	return sc.plan
+}
+
+// for debugging, such as:
+// index [age id] >= (3) .. <= (3), filter [name = "x"], ~12 rows
+func (p *Plan) String() string {
+	out := fmt.Sprintf("index %v", p.Cols)
+	if len(p.Key1.Cols) > 0 || len(p.Key2.Cols) > 0 {
+		out += fmt.Sprintf(" %s %s .. %s %s", cmpString(p.Cmp1), keyString(p.Key1),
+			cmpString(p.Cmp2), keyString(p.Key2))
+	}
+	if len(p.Filter) > 0 {
+		filter := []string{}
+		for _, c := range p.Filter {
+			filter = append(filter, fmt.Sprintf("%s %s %s", c.Col, cmpString(c.Op), valString(c.Val)))
+		}
+		out += ", filter [" + strings.Join(filter, " AND ") + "]"
+	}
+	if p.Rows >= 0 {
+		out += fmt.Sprintf(", ~%d rows", p.Rows)
+	}
+	return out
+}
+
+func cmpString(op int) string {
+	return map[int]string{
+		COND_EQ: "=", btree_iter.CMP_GT: ">", btree_iter.CMP_GE: ">=",
+		btree_iter.CMP_LT: "<", btree_iter.CMP_LE: "<=",
+	}[op]
+}
+
+func keyString(key Record) string {
+	vals := []string{}
+	for _, v := range key.Vals {
+		vals = append(vals, valString(v))
+	}
+	return "(" + strings.Join(vals, ", ") + ")"
+}
+
+func valString(v Value) string {
+	switch v.Type {
+	case TYPE_BYTES:
+		return fmt.Sprintf("%q", v.Str)
+	case TYPE_JSON:
+		return string(v.Str)
+	case TYPE_FLOAT64:
+		return fmt.Sprint(v.F64)
+	case TYPE_NULL:
+		return "NULL"
+	default:
+		return fmt.Sprint(v.I64)
+	}
+}
+
+// scan the rows that match all conditions, with the index chosen by the
+// planner. the range fields of `sc` and its Filter are replaced; the other
+// options are kept.
+func (tx *DBTX) Find(table string, conds []Cond, sc *Scanner) error {
+	tdef, err := getTableDef(tx, table)
+	if err != nil {
+		return err
+	}
+	plan, err := planScan(tx, tdef, conds, false)
+	if err != nil {
+		return err
+	}
+	planApply(plan, sc)
+	return dbScan(tx, tdef, sc)
+}
+
+// tx.Find in a read transaction of its own, which is ended by Close
+func (db *DB) Find(table string, conds []Cond) (*Scanner, error) {
+	tx := &DBTX{}
+	db.BeginRead(tx)
+	sc := &Scanner{}
+	if err := tx.Find(table, conds, sc); err != nil {
+		db.Abort(tx)
+		return nil, err
+	}
+	sc.owned = true
+	return sc, nil
+}
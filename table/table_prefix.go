@@ -0,0 +1,156 @@
+package table
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/Adit0507/AdiDB/internal/btree_iter"
+)
+
+/*
+key prefixes of tables. new prefixes come from the "next_prefix" counter in
+@meta. the prefixes of a dropped table are added to "free_prefixes", a list
+of ranges of 8 bytes each:
+| start | count |
+|  4B   |  4B   |
+TableNew takes the first run of prefixes in a range that is large enough
+and has no key left under it.
+
+a writer reads the schema of its table (see getTableDef), so a writer that
+is concurrent with the drop fails with a conflict instead of adding rows
+under the prefixes.
+*/
+
+type prefixRange struct {
+	start uint32
+	count uint32
+}
+
+func getFreePrefixes(tx *DBTX) ([]prefixRange, error) {
+	meta := (&Record{}).AddStr("key", []byte("free_prefixes"))
+	ok, err := dbGet(tx, TDEF_META, meta)
+	if err != nil || !ok {
+		return nil, err
+	}
+	val := meta.Get("val").Str
+	if len(val)%8 != 0 {
+		return nil, fmt.Errorf("bad free_prefixes")
+	}
+	out := []prefixRange{}
+	for ; len(val) > 0; val = val[8:] {
+		out = append(out, prefixRange{
+			start: binary.LittleEndian.Uint32(val[0:4]),
+			count: binary.LittleEndian.Uint32(val[4:8]),
+		})
+	}
+	return out, nil
+}
+
+func setFreePrefixes(tx *DBTX, free []prefixRange) error {
+	meta := (&Record{}).AddStr("key", []byte("free_prefixes"))
+	if len(free) == 0 {
+		_, err := dbDelete(tx, TDEF_META, *meta)
+		return err
+	}
+	val := []byte{}
+	for _, r := range free {
+		val = binary.LittleEndian.AppendUint32(val, r.start)
+		val = binary.LittleEndian.AppendUint32(val, r.count)
+	}
+	meta.AddStr("val", val)
+	_, err := dbUpdate(tx, TDEF_META, &DBUpdateReq{Record: *meta})
+	return err
+}
+
+// the prefix of the first key in [start, end), if any
+func prefixFirstKey(tx *DBTX, start uint32, end uint32) (prefix uint32, ok bool, err error) {
+	defer checksumRecover(&err)
+	key1 := encodeKey(nil, start, nil)
+	key2 := encodeKey(nil, end, nil)
+	iter := tx.kv.Seek(key1, btree_iter.CMP_GE, key2, btree_iter.CMP_LT)
+	if !iter.Valid() {
+		return 0, false, nil
+	}
+	key, _ := iter.Deref()
+	return binary.BigEndian.Uint32(key), true, nil
+}
+
+// `count` consecutive prefixes for a new table
+func prefixAlloc(tx *DBTX, count uint32) (uint32, error) {
+	free, err := getFreePrefixes(tx)
+	if err != nil {
+		return 0, err
+	}
+	for i, r := range free {
+		end := r.start + r.count
+		for start := r.start; start+count <= end; {
+			// rows left by a bug or a bad replay must not show up in the table
+			used, ok, err := prefixFirstKey(tx, start, start+count)
+			if err != nil {
+				return 0, err
+			}
+			if ok {
+				start = used + 1
+				continue
+			}
+			// what's left of the range on both sides
+			rest := []prefixRange{}
+			if start > r.start {
+				rest = append(rest, prefixRange{r.start, start - r.start})
+			}
+			if start+count < end {
+				rest = append(rest, prefixRange{start + count, end - start - count})
+			}
+			free = append(free[:i], append(rest, free[i+1:]...)...)
+			return start, setFreePrefixes(tx, free)
+		}
+	}
+
+	prefix := uint32(TABLE_PREFIX_MIN)
+	meta := (&Record{}).AddStr("key", []byte("next_prefix"))
+	ok, err := dbGet(tx, TDEF_META, meta)
+	if err != nil {
+		return 0, err
+	}
+	if ok {
+		val := meta.Get("val").Str
+		if len(val) != 4 {
+			return 0, fmt.Errorf("bad next_prefix")
+		}
+		prefix = binary.LittleEndian.Uint32(val)
+		if prefix <= TABLE_PREFIX_MIN {
+			return 0, fmt.Errorf("bad next_prefix: %d", prefix)
+		}
+	}
+
+	// updatin next prefix. the decoded value may point to the tree, so
+	// it's not modified in place.
+	next := make([]byte, 4)
+	binary.LittleEndian.PutUint32(next, prefix+count)
+	meta = (&Record{}).AddStr("key", []byte("next_prefix")).AddStr("val", next)
+	_, err = dbUpdate(tx, TDEF_META, &DBUpdateReq{Record: *meta})
+	return prefix, err
+}
+
+// add the prefixes of a dropped table to the free ranges, which are kept
+// sorted and merged with their neighbors
+func prefixFree(tx *DBTX, start uint32, count uint32) error {
+	free, err := getFreePrefixes(tx)
+	if err != nil {
+		return err
+	}
+	i := 0
+	for i < len(free) && free[i].start < start {
+		i++
+	}
+	free = append(free[:i], append([]prefixRange{{start, count}}, free[i:]...)...)
+	if i+1 < len(free) && start+count == free[i+1].start {
+		free[i].count += free[i+1].count
+		free = append(free[:i+1], free[i+2:]...)
+	}
+	if i > 0 && free[i-1].start+free[i-1].count == start {
+		free[i-1].count += free[i].count
+		free = append(free[:i], free[i+1:]...)
+	}
+	return setFreePrefixes(tx, free)
+}
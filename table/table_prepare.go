@@ -0,0 +1,241 @@
+package table
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+prepared statements for hot queries. DB.PrepareGet resolves the schema of
+the table and checks the primary key columns once; GetStmt.Get then only
+checks the types of the values, encodes the key into a pooled buffer and
+decodes the row, without the reordering of a Record and the Scanner of
+DBTX.Get. DB.PrepareScan does the same for the ranges of an index whose
+bounds always have the same columns and comparisons.
+
+a statement keeps the schema generation row of @meta it was checked at
+(see table_schema.go). each call compares it with the snapshot of its
+transaction, and checks the statement again if it differs, so the
+statement follows the schema changes and fails once its table is gone or
+its columns no longer fit. a transaction that changes a schema checks it
+on every call, since its changes aren't in a generation yet.
+
+a statement is safe for concurrent use; the checked state is replaced as
+a whole.
+*/
+
+type GetStmt struct {
+	db    *DB
+	table string
+	cols  []string // the order of the values of Get
+	plan  atomic.Pointer[stmtPlan]
+}
+
+type ScanStmt struct {
+	db    *DB
+	table string
+	cols  []string // leading columns of an index
+	cmp1  int
+	cmp2  int
+	plan  atomic.Pointer[stmtPlan]
+}
+
+// a statement checked against a schema generation
+type stmtPlan struct {
+	gen    []byte // the @meta row
+	hasGen bool
+	tdef   *TableDef
+	types  []uint32 // of the values
+	order  []int    // the value of each primary key column; GetStmt only
+	strKey bool     // a BYTES column in the primary key
+}
+
+// the buffers of a call
+type stmtBuf struct {
+	key  []byte
+	vals []Value
+}
+
+var stmtBufs = sync.Pool{New: func() any { return &stmtBuf{} }}
+
+// a point query on the primary key, given as its columns in the order of
+// the values of GetStmt.Get
+func (db *DB) PrepareGet(table string, pkCols ...string) (*GetStmt, error) {
+	st := &GetStmt{db: db, table: table, cols: slices.Clone(pkCols)}
+	tx := DBTX{}
+	db.BeginRead(&tx)
+	defer db.Abort(&tx)
+	if _, err := st.check(&tx); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func (st *GetStmt) check(tx *DBTX) (*stmtPlan, error) {
+	return stmtCheck(tx, st.table, &st.plan, func(tdef *TableDef) (*stmtPlan, error) {
+		pk := tdef.Indexes[0]
+		if len(st.cols) != len(pk) {
+			return nil, fmt.Errorf("not the primary key: %v", st.cols)
+		}
+		plan := &stmtPlan{tdef: tdef}
+		for _, c := range pk {
+			i := slices.Index(st.cols, c)
+			if i < 0 {
+				return nil, fmt.Errorf("not the primary key: %v", st.cols)
+			}
+			plan.order = append(plan.order, i)
+		}
+		for _, c := range st.cols {
+			plan.types = append(plan.types, tdef.Types[slices.Index(tdef.Cols, c)])
+			plan.strKey = plan.strKey || plan.types[len(plan.types)-1] == TYPE_BYTES
+		}
+		return plan, nil
+	})
+}
+
+// the row of the primary key `vals`, in the order of PrepareGet, in its
+// own read transaction
+func (st *GetStmt) Get(rec *Record, vals ...Value) (bool, error) {
+	tx := DBTX{}
+	st.db.BeginRead(&tx)
+	defer st.db.Abort(&tx)
+	return st.GetTX(&tx, rec, vals...)
+}
+
+// Get in a transaction
+func (st *GetStmt) GetTX(tx *DBTX, rec *Record, vals ...Value) (ok bool, err error) {
+	plan, err := st.check(tx)
+	if err != nil {
+		return false, err
+	}
+	if err := stmtVals(plan, st.cols, vals); err != nil {
+		return false, err
+	}
+	buf := stmtBufs.Get().(*stmtBuf)
+	defer stmtBufs.Put(buf)
+	buf.vals = buf.vals[:0]
+	for _, i := range plan.order {
+		buf.vals = append(buf.vals, vals[i])
+	}
+	tdef := plan.tdef
+	buf.key = encodeKey(buf.key[:0], tdef.Prefixes[0], buf.vals)
+
+	// a read-write transaction keeps the key of a read for its conflicts,
+	// and the decoded strings can point into it, while the buffer is reused
+	key := buf.key
+	if !tx.kv.readOnly || plan.strKey {
+		key = slices.Clone(key)
+	}
+	defer checksumRecover(&err)
+	val, ok := tx.kv.Get(key)
+	if !ok {
+		return false, nil
+	}
+	if err := rowDecode(tdef, key, val, rec, nil, nil); err != nil {
+		return false, err
+	}
+	if now := ttlNow(tx, tdef); now != 0 && rowExpired(tdef, rec, now) {
+		return false, nil
+	}
+	return true, nil
+}
+
+// a scan of the ranges of an index whose bounds are values of its leading
+// columns `cols`, compared by cmp1 and cmp2 as in Scanner
+func (db *DB) PrepareScan(table string, cols []string, cmp1 int, cmp2 int) (*ScanStmt, error) {
+	st := &ScanStmt{db: db, table: table, cols: slices.Clone(cols), cmp1: cmp1, cmp2: cmp2}
+	tx := DBTX{}
+	db.BeginRead(&tx)
+	defer db.Abort(&tx)
+	if _, err := st.check(&tx); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func (st *ScanStmt) check(tx *DBTX) (*stmtPlan, error) {
+	return stmtCheck(tx, st.table, &st.plan, func(tdef *TableDef) (*stmtPlan, error) {
+		switch {
+		case st.cmp1 > 0 && st.cmp2 < 0:
+		case st.cmp1 < 0 && st.cmp2 > 0:
+		default:
+			return nil, ErrBadRange
+		}
+		plan := &stmtPlan{tdef: tdef}
+		for i, c := range st.cols {
+			j := slices.Index(tdef.Cols, c)
+			if j < 0 {
+				return nil, fmt.Errorf("unknown column: %s", c)
+			}
+			if slices.Contains(st.cols[:i], c) {
+				return nil, fmt.Errorf("duplicated column: %s", c)
+			}
+			plan.types = append(plan.types, tdef.Types[j])
+		}
+		// the index of scanRange
+		for i, index := range tdef.Indexes {
+			if !isBuilding(tdef, i) && !isComputed(tdef, i) && len(index) >= len(st.cols) &&
+				slices.Equal(index[:len(st.cols)], st.cols) {
+				return plan, nil
+			}
+		}
+		return nil, fmt.Errorf("%w: no index for columns: %v", ErrBadRange, st.cols)
+	})
+}
+
+// start the scan `sc` in the transaction, from `key1` to `key2`, values of
+// the columns of PrepareScan. the other options of `sc` are kept.
+func (st *ScanStmt) Scan(tx *DBTX, sc *Scanner, key1 []Value, key2 []Value) error {
+	plan, err := st.check(tx)
+	if err != nil {
+		return err
+	}
+	if err := stmtVals(plan, st.cols, key1); err != nil {
+		return err
+	}
+	if err := stmtVals(plan, st.cols, key2); err != nil {
+		return err
+	}
+	sc.Cmp1, sc.Cmp2 = st.cmp1, st.cmp2
+	sc.Key1, sc.Key2 = Record{st.cols, key1}, Record{st.cols, key2}
+	return dbScan(tx, plan.tdef, sc)
+}
+
+// the statement checked for the snapshot of the transaction; see the top
+func stmtCheck(tx *DBTX, table string, cur *atomic.Pointer[stmtPlan],
+	check func(*TableDef) (*stmtPlan, error)) (plan *stmtPlan, err error) {
+	defer checksumRecover(&err)
+	gen, hasGen := tx.kv.snapshot.Get(schemaGenRowKey)
+	plan = cur.Load()
+	if plan != nil && !tx.schema && plan.hasGen == hasGen && bytes.Equal(plan.gen, gen) {
+		return plan, nil
+	}
+	tdef, err := getTableDef(tx, table)
+	if err != nil {
+		return nil, err
+	}
+	if plan, err = check(tdef); err != nil {
+		return nil, err
+	}
+	if !tx.schema {
+		plan.gen, plan.hasGen = slices.Clone(gen), hasGen
+		cur.Store(plan)
+	}
+	return plan, nil
+}
+
+// the values of a call have the types of the columns
+func stmtVals(plan *stmtPlan, cols []string, vals []Value) error {
+	if len(vals) != len(cols) {
+		return fmt.Errorf("expect %d values, got %d", len(cols), len(vals))
+	}
+	for i := range vals {
+		if vals[i].Type != plan.types[i] {
+			return &ErrBadColumnType{Col: cols[i]}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package table
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+/*
+typed access to the columns of a record. the getters return
+*ErrMissingColumn for a column that is not in the record, so a typo is an
+error instead of a nil *Value, *ErrBadColumnType for a value of another
+type, and ErrNullValue for a NULL. the Must variants panic instead; they
+are for tests and for records that come from the schema.
+*/
+
+var ErrNullValue = errors.New("null value")
+
+// the value as INT64
+func (v *Value) Int64() (int64, error) {
+	if err := v.check(TYPE_INT64, ""); err != nil {
+		return 0, err
+	}
+	return v.I64, nil
+}
+
+// the value as BYTES
+func (v *Value) Bytes() ([]byte, error) {
+	if err := v.check(TYPE_BYTES, ""); err != nil {
+		return nil, err
+	}
+	return v.Str, nil
+}
+
+func (v *Value) check(tp uint32, col string) error {
+	switch v.Type {
+	case tp:
+		return nil
+	case TYPE_NULL:
+		return fmt.Errorf("%w: %s", ErrNullValue, col)
+	default:
+		return &ErrBadColumnType{Col: col}
+	}
+}
+
+// the column is in the record
+func (rec *Record) Has(col string) bool {
+	return rec.Get(col) != nil
+}
+
+// the value of a column of the type
+func (rec *Record) typed(col string, tp uint32) (*Value, error) {
+	v := rec.Get(col)
+	if v == nil {
+		return nil, &ErrMissingColumn{Col: col}
+	}
+	return v, v.check(tp, col)
+}
+
+func (rec *Record) GetInt64(col string) (int64, error) {
+	v, err := rec.typed(col, TYPE_INT64)
+	if err != nil {
+		return 0, err
+	}
+	return v.I64, nil
+}
+
+func (rec *Record) GetStr(col string) ([]byte, error) {
+	v, err := rec.typed(col, TYPE_BYTES)
+	if err != nil {
+		return nil, err
+	}
+	return v.Str, nil
+}
+
+func (rec *Record) GetFloat64(col string) (float64, error) {
+	v, err := rec.typed(col, TYPE_FLOAT64)
+	if err != nil {
+		return 0, err
+	}
+	return v.F64, nil
+}
+
+func (rec *Record) GetBool(col string) (bool, error) {
+	v, err := rec.typed(col, TYPE_BOOL)
+	if err != nil {
+		return false, err
+	}
+	return v.I64 != 0, nil
+}
+
+func (rec *Record) GetTime(col string) (time.Time, error) {
+	v, err := rec.typed(col, TYPE_TIMESTAMP)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return v.Time(), nil
+}
+
+func (rec *Record) MustGetInt64(col string) int64 {
+	return must(rec.GetInt64(col))
+}
+
+func (rec *Record) MustGetStr(col string) []byte {
+	return must(rec.GetStr(col))
+}
+
+func (rec *Record) MustGetFloat64(col string) float64 {
+	return must(rec.GetFloat64(col))
+}
+
+func (rec *Record) MustGetBool(col string) bool {
+	return must(rec.GetBool(col))
+}
+
+func (rec *Record) MustGetTime(col string) time.Time {
+	return must(rec.GetTime(col))
+}
+
+func must[T any](v T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// replace the value of a column, or add the column. unlike the Add
+// methods, it never makes a record with a column twice.
+func (rec *Record) Set(col string, v Value) *Record {
+	if old := rec.Get(col); old != nil {
+		*old = v
+		return rec
+	}
+	rec.Cols = append(rec.Cols, col)
+	rec.Vals = append(rec.Vals, v)
+	return rec
+}
+
+// a copy that shares nothing with the record, such as a row of a scan
+// with Scanner.Reuse that is kept after Next()
+func (rec *Record) Clone() Record {
+	out := Record{slices.Clone(rec.Cols), slices.Clone(rec.Vals)}
+	for i := range out.Vals {
+		if out.Vals[i].Str != nil {
+			out.Vals[i].Str = slices.Clone(out.Vals[i].Str)
+		}
+	}
+	return out
+}
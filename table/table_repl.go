@@ -0,0 +1,125 @@
+package table
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+/*
+replication. the primary keeps the change log (DB.Changes) and a replica
+applies it, a transaction per commit of the primary. the last commit
+applied is saved in the @meta of the replica with its updates, so a stream
+that is cut off can be applied again from its start, and the commits
+already applied are skipped.
+
+a replica starts from an empty file, if the primary kept the change log
+from the start, or from a Backup of the primary. it must not be written
+otherwise, since the primary's updates would replace the local ones.
+*/
+
+var ErrReplicaGap = errors.New("the stream doesn't continue the replica")
+
+// @meta key of the last commit of the primary applied by ApplyStream
+const REPL_SEQ_KEY = "repl_seq"
+
+// the last commit of the primary in this replica. it's the Seq of a
+// Backup of the primary before anything is applied.
+func (db *DB) AppliedSeq() (uint64, error) {
+	tx := DBTX{}
+	db.BeginRead(&tx)
+	defer db.Abort(&tx)
+	return appliedSeq(&tx)
+}
+
+func appliedSeq(tx *DBTX) (uint64, error) {
+	meta := (&Record{}).AddStr("key", []byte(REPL_SEQ_KEY))
+	ok, err := dbGet(tx, TDEF_META, meta)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return tx.kv.version, nil
+	}
+	val := meta.Get("val").Str
+	if len(val) != 8 {
+		return 0, fmt.Errorf("bad %s", REPL_SEQ_KEY)
+	}
+	return binary.LittleEndian.Uint64(val), nil
+}
+
+// write the commits from `fromSeq` on, for ApplyStream on a replica
+// at `fromSeq-1`. the format is the one of KV.ChangesSince.
+func (db *DB) StreamChanges(fromSeq uint64, w io.Writer) error {
+	return db.kv.ChangesSince(max(fromSeq, 1)-1, w)
+}
+
+// apply the output of StreamChanges to a replica, in order. the commits
+// up to AppliedSeq are skipped; a missing commit fails with ErrReplicaGap
+// and nothing after it is applied.
+func (db *DB) ApplyStream(r io.Reader) error {
+	br := bufio.NewReader(r)
+	prev, err := changesStart(br)
+	if err != nil {
+		return err
+	}
+	applied, err := db.AppliedSeq()
+	if err != nil {
+		return err
+	}
+	if prev > applied {
+		return fmt.Errorf("%w: the stream starts after %d, the replica is at %d",
+			ErrReplicaGap, prev, applied)
+	}
+	for {
+		seq, rec, err := changesNext(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read changes: %w", err)
+		}
+		if seq <= prev {
+			return fmt.Errorf("bad change stream: commit %d after %d", seq, prev)
+		}
+		prev = seq
+		if seq <= applied {
+			continue
+		}
+		if seq != applied+1 {
+			return fmt.Errorf("%w: commit %d after %d", ErrReplicaGap, seq, applied)
+		}
+		if err := applyCommit(db, seq, rec[16:]); err != nil {
+			return fmt.Errorf("apply commit %d: %w", seq, err)
+		}
+		applied = seq
+	}
+}
+
+// the updates of a commit of the primary and its sequence
+func applyCommit(db *DB, seq uint64, ops []byte) error {
+	tx := DBTX{}
+	db.Begin(&tx)
+	err := walScan(ops, func(_ byte, key []byte, _ []byte) error {
+		if len(key) >= 4 && binary.BigEndian.Uint32(key) == TDEF_TABLE.Prefixes[0] {
+			tx.schema = true // the schema cache is dropped on commit
+		}
+		return nil
+	})
+	if err == nil {
+		err = changesApplyTX(&tx.kv, ops)
+	}
+	if err == nil {
+		// after the updates, which may have the sequence of a chained primary
+		val := binary.LittleEndian.AppendUint64(nil, seq)
+		meta := (&Record{}).AddStr("key", []byte(REPL_SEQ_KEY)).AddStr("val", val)
+		_, err = dbUpdate(&tx, TDEF_META, &DBUpdateReq{Record: *meta})
+	}
+	if err != nil {
+		db.Abort(&tx)
+		return err
+	}
+	return db.Commit(&tx)
+}
@@ -0,0 +1,85 @@
+package table
+
+import (
+	"encoding/binary"
+)
+
+/*
+the schemas of the user tables are cached in DB.tables and DB.refs, shared
+by the transactions of the DB. a transaction that changes a schema adds 1
+to the "schema_gen" counter in @meta, and the cache holds the schemas of
+one generation. getTableDef reads the counter from the snapshot of the
+transaction, without adding it to the reads for conflicts:
+- the same generation uses the cache.
+- a later one drops the cache, which then holds that generation.
+- an earlier one, a transaction that began before the change, reads the
+  schema without the cache, so it doesn't put a dropped table back.
+the commit of a change also drops the cache, which covers the files
+written before the counter, where it's 0.
+
+this also catches the changes by another DB on the same file, once this
+DB reads a version with them.
+*/
+
+// @meta key of the schema generation, a little-endian uint64
+var schemaGenKey = []byte("schema_gen")
+
+// the encoded key of its row
+var schemaGenRowKey = encodeKey(nil, TDEF_META.Prefixes[0], []Value{{Type: TYPE_BYTES, Str: schemaGenKey}})
+
+// the generation in the snapshot of the transaction
+func schemaGen(tx *DBTX) (gen uint64, err error) {
+	defer checksumRecover(&err)
+	val, ok := tx.kv.snapshot.Get(schemaGenRowKey)
+	if !ok {
+		return 0, nil
+	}
+	out := []Value{{Type: TYPE_BYTES}}
+	if err := decodeRow(TDEF_META, val, out, nil, nil); err != nil || len(out[0].Str) != 8 {
+		return 0, errCorrupt("bad schema generation")
+	}
+	return binary.LittleEndian.Uint64(out[0].Str), nil
+}
+
+// the transaction changes a schema. the counter is read like any row, so
+// concurrent changes conflict instead of taking the same generation.
+func schemaChanged(tx *DBTX) error {
+	tx.schema = true
+	meta := (&Record{}).AddStr("key", schemaGenKey)
+	ok, err := dbGet(tx, TDEF_META, meta)
+	if err != nil {
+		return err
+	}
+	gen := uint64(0)
+	if ok {
+		val := meta.Get("val").Str
+		if len(val) != 8 {
+			return errCorrupt("bad schema generation")
+		}
+		gen = binary.LittleEndian.Uint64(val)
+	}
+	val := binary.LittleEndian.AppendUint64(nil, gen+1)
+	meta = (&Record{}).AddStr("key", schemaGenKey).AddStr("val", val)
+	_, err = dbUpdate(tx, TDEF_META, &DBUpdateReq{Record: *meta})
+	return err
+}
+
+// whether a transaction of the generation `gen` can use the cache; see the
+// top. called with DB.mu held.
+func schemaCacheSync(db *DB, gen uint64) bool {
+	if gen == db.tablesGen {
+		return true
+	}
+	if gen < db.tablesGen && (len(db.tables) > 0 || db.refs != nil) {
+		return false
+	}
+	schemaCacheDrop(db, gen)
+	return true
+}
+
+// called with DB.mu held
+func schemaCacheDrop(db *DB, gen uint64) {
+	db.tables = map[string]*TableDef{}
+	db.refs = nil
+	db.tablesGen = gen
+}
@@ -0,0 +1,108 @@
+package table
+
+import (
+	"encoding/binary"
+
+	"github.com/Adit0507/AdiDB/internal/btree_iter"
+	"github.com/Adit0507/AdiDB/internal/kv"
+)
+
+/*
+the rows and bytes of each table are counted in the @stats table, keyed by
+the primary key prefix. row writes change the counters with KVTX.Merge in
+the same transaction, so they are committed with the rows, and concurrent
+writers don't conflict on them.
+
+tables created before @stats have no counters; DB.Stats scans them instead.
+*/
+
+type TableStats struct {
+	Rows  int64
+	Bytes int64 // keys and values of the rows, without indexes
+}
+
+type DBStats struct {
+	KV     kv.KVStats
+	Tables map[string]TableStats // user tables
+}
+
+// `KV.Merge` of the @stats rows: the counters are added up.
+// a table without counters, or with damaged ones, is left alone.
+func statsMerge(key []byte, old []byte, delta []byte) []byte {
+	assert(binary.BigEndian.Uint32(key) == TDEF_STATS.Prefixes[0])
+	if old == nil {
+		return nil
+	}
+	a := []Value{{Type: TYPE_INT64}, {Type: TYPE_INT64}}
+	b := []Value{{Type: TYPE_INT64}, {Type: TYPE_INT64}}
+	if decodeRow(TDEF_STATS, old, a, nil, nil) != nil || decodeValues(delta, b) != nil {
+		return nil
+	}
+	for i := range a {
+		a[i].I64 += b[i].I64
+	}
+	return encodeRow(nil, a)
+}
+
+// change the counters of a table
+func statsAdd(tx *DBTX, tdef *TableDef, rows int64, bytes int64) error {
+	if tdef.Prefixes[0] < TABLE_PREFIX_MIN || (rows == 0 && bytes == 0) {
+		return nil // internal tables
+	}
+	key := encodeKey(nil, TDEF_STATS.Prefixes[0],
+		[]Value{{Type: TYPE_INT64, I64: int64(tdef.Prefixes[0])}})
+	delta := encodeValues(nil,
+		[]Value{{Type: TYPE_INT64, I64: rows}, {Type: TYPE_INT64, I64: bytes}})
+	return tx.kv.Merge(key, delta)
+}
+
+// the counters of a table, or a scan of its rows without them
+func tableStats(tx *DBTX, tdef *TableDef) (stats TableStats, err error) {
+	rec := (&Record{}).AddInt64("prefix", int64(tdef.Prefixes[0]))
+	ok, err := dbGet(tx, TDEF_STATS, rec)
+	if err != nil {
+		return TableStats{}, err
+	}
+	if ok {
+		return TableStats{Rows: rec.Get("rows").I64, Bytes: rec.Get("bytes").I64}, nil
+	}
+
+	defer checksumRecover(&err)
+	start := encodeKey(nil, tdef.Prefixes[0], nil)
+	end := encodeKey(nil, tdef.Prefixes[0]+1, nil)
+	iter := tx.kv.Seek(start, btree_iter.CMP_GE, end, btree_iter.CMP_LT)
+	for ; iter.Valid(); iter.Next() {
+		key, val := iter.Deref()
+		stats.Rows++
+		stats.Bytes += int64(len(key) + len(val))
+	}
+	return stats, nil
+}
+
+// file, tree and per-table statistics. the tables are read from a snapshot
+// with a point query each, so it's cheap enough to be polled.
+func (db *DB) Stats() (DBStats, error) {
+	kvStats, err := db.kv.Stats()
+	if err != nil {
+		return DBStats{}, err
+	}
+	stats := DBStats{KV: kvStats, Tables: map[string]TableStats{}}
+
+	tx := DBTX{}
+	db.BeginRead(&tx)
+	defer db.Abort(&tx)
+	names, err := tx.ListTables()
+	if err != nil {
+		return DBStats{}, err
+	}
+	for _, name := range names {
+		tdef, err := getTableDef(&tx, name)
+		if err != nil {
+			return DBStats{}, err
+		}
+		if stats.Tables[name], err = tableStats(&tx, tdef); err != nil {
+			return DBStats{}, err
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,308 @@
+package table
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Go structs as rows. the fields tagged with `db:"col"` are the columns;
+the other fields are ignored. the field types:
+- string and []byte for BYTES.
+- int64 and int for INT64, float64 for FLOAT64, bool for BOOL.
+- time.Time for TIMESTAMP; as for AddTime, the years 1678 to 2262.
+- json.RawMessage for JSON.
+- a pointer to one of those for a nullable column; nil is NULL.
+a field of another type is an error the first time the struct type is
+used. `db:"col,pk"` marks the primary key for StructTableDef.
+
+the fields of a struct type are looked up once and cached.
+*/
+
+type structField struct {
+	col   string
+	index int
+	ptr   bool // nil is NULL
+	typ   uint32
+	pk    bool
+}
+
+type structInfo struct {
+	fields []structField
+	err    error
+}
+
+var structCache sync.Map // reflect.Type -> *structInfo
+
+var timeType = reflect.TypeOf(time.Time{})
+var rawJSONType = reflect.TypeOf(json.RawMessage{})
+
+// the fields of a struct type, cached
+func structFields(t reflect.Type) ([]structField, error) {
+	if info, ok := structCache.Load(t); ok {
+		return info.(*structInfo).fields, info.(*structInfo).err
+	}
+	info := &structInfo{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag, ok := f.Tag.Lookup("db")
+		if !ok || tag == "-" {
+			continue
+		}
+		col, opt, _ := strings.Cut(tag, ",")
+		if col == "" {
+			col = f.Name
+		}
+		sf := structField{col: col, index: i, pk: opt == "pk"}
+		ft := f.Type
+		if ft.Kind() == reflect.Pointer {
+			sf.ptr, ft = true, ft.Elem()
+		}
+		switch {
+		case ft == timeType:
+			sf.typ = TYPE_TIMESTAMP
+		case ft == rawJSONType:
+			sf.typ = TYPE_JSON
+		case ft.Kind() == reflect.String:
+			sf.typ = TYPE_BYTES
+		case ft.Kind() == reflect.Slice && ft.Elem().Kind() == reflect.Uint8:
+			sf.typ = TYPE_BYTES
+		case ft.Kind() == reflect.Int64 || ft.Kind() == reflect.Int:
+			sf.typ = TYPE_INT64
+		case ft.Kind() == reflect.Float64:
+			sf.typ = TYPE_FLOAT64
+		case ft.Kind() == reflect.Bool:
+			sf.typ = TYPE_BOOL
+		}
+		if sf.typ == 0 || !f.IsExported() {
+			info.err = fmt.Errorf("field %s: unsupported type %s", f.Name, f.Type)
+			break
+		}
+		info.fields = append(info.fields, sf)
+	}
+	actual, _ := structCache.LoadOrStore(t, info)
+	return actual.(*structInfo).fields, actual.(*structInfo).err
+}
+
+// the struct behind a pointer
+func structElem(v any) (reflect.Value, []structField, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return reflect.Value{}, nil, errors.New("not a pointer to a struct")
+	}
+	rv = rv.Elem()
+	fields, err := structFields(rv.Type())
+	return rv, fields, err
+}
+
+// the columns of a struct; `v` is a struct or a pointer to one
+func structRecord(v any) (Record, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Pointer && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return Record{}, errors.New("not a struct")
+	}
+	fields, err := structFields(rv.Type())
+	if err != nil {
+		return Record{}, err
+	}
+	rec := Record{}
+	for _, f := range fields {
+		rec.Cols = append(rec.Cols, f.col)
+		rec.Vals = append(rec.Vals, structValue(f, rv.Field(f.index)))
+	}
+	return rec, nil
+}
+
+func structValue(f structField, fv reflect.Value) Value {
+	if f.ptr {
+		if fv.IsNil() {
+			return Value{Type: TYPE_NULL}
+		}
+		fv = fv.Elem()
+	}
+	v := Value{Type: f.typ}
+	switch f.typ {
+	case TYPE_TIMESTAMP:
+		v.I64 = fv.Interface().(time.Time).UnixNano()
+	case TYPE_BYTES, TYPE_JSON:
+		if fv.Kind() == reflect.String {
+			v.Str = []byte(fv.String())
+		} else {
+			v.Str = fv.Bytes()
+		}
+	case TYPE_INT64:
+		v.I64 = fv.Int()
+	case TYPE_FLOAT64:
+		v.F64 = fv.Float()
+	case TYPE_BOOL:
+		if fv.Bool() {
+			v.I64 = 1
+		}
+	}
+	return v
+}
+
+// fill the fields of the columns in the record; the others are left alone
+func structFill(rv reflect.Value, fields []structField, rec *Record) error {
+	for _, f := range fields {
+		v := rec.Get(f.col)
+		if v == nil {
+			continue
+		}
+		fv := rv.Field(f.index)
+		if v.Type == TYPE_NULL {
+			if !f.ptr {
+				return fmt.Errorf("field %s: NULL needs a pointer", rv.Type().Field(f.index).Name)
+			}
+			fv.SetZero()
+			continue
+		}
+		if v.Type != f.typ {
+			return fmt.Errorf("field %s: column %s has another type", rv.Type().Field(f.index).Name, f.col)
+		}
+		if f.ptr {
+			fv.Set(reflect.New(fv.Type().Elem()))
+			fv = fv.Elem()
+		}
+		switch f.typ {
+		case TYPE_TIMESTAMP:
+			fv.Set(reflect.ValueOf(v.Time()))
+		case TYPE_BYTES, TYPE_JSON:
+			if fv.Kind() == reflect.String {
+				fv.SetString(string(v.Str))
+			} else {
+				fv.SetBytes(append([]byte{}, v.Str...))
+			}
+		case TYPE_INT64:
+			fv.SetInt(v.I64)
+		case TYPE_FLOAT64:
+			fv.SetFloat(v.F64)
+		case TYPE_BOOL:
+			fv.SetBool(v.I64 != 0)
+		}
+	}
+	return nil
+}
+
+// like Insert, with the columns from the tagged fields of `v`
+func (tx *DBTX) InsertStruct(table string, v any) (bool, error) {
+	rec, err := structRecord(v)
+	if err != nil {
+		return false, err
+	}
+	return tx.Insert(table, &rec)
+}
+
+// like Get; the primary key is read from the fields of `v`, which must be
+// a pointer to a struct, and the other fields are filled.
+func (tx *DBTX) GetStruct(table string, v any) (bool, error) {
+	tdef, err := getTableDef(tx, table)
+	if err != nil {
+		return false, err
+	}
+	rv, fields, err := structElem(v)
+	if err != nil {
+		return false, err
+	}
+	rec := Record{}
+	for _, col := range tdef.Indexes[0] {
+		i := structFieldIndex(fields, col)
+		if i < 0 {
+			return false, fmt.Errorf("no field for the primary key column: %s", col)
+		}
+		rec.Cols = append(rec.Cols, col)
+		rec.Vals = append(rec.Vals, structValue(fields[i], rv.Field(fields[i].index)))
+	}
+	ok, err := dbGet(tx, tdef, &rec)
+	if err != nil || !ok {
+		return false, err
+	}
+	return true, structFill(rv, fields, &rec)
+}
+
+func structFieldIndex(fields []structField, col string) int {
+	for i := range fields {
+		if fields[i].col == col {
+			return i
+		}
+	}
+	return -1
+}
+
+// like Deref, into the tagged fields of a pointer to a struct
+func (sc *Scanner) DerefStruct(v any) error {
+	rv, fields, err := structElem(v)
+	if err != nil {
+		return err
+	}
+	rec := Record{}
+	if err := sc.Deref(&rec); err != nil {
+		return err
+	}
+	return structFill(rv, fields, &rec)
+}
+
+// DBTX.InsertStruct in a transaction
+func (db *DB) InsertStruct(table string, v any) (bool, error) {
+	tx := DBTX{}
+	db.Begin(&tx)
+	ok, err := tx.InsertStruct(table, v)
+	if err != nil {
+		db.Abort(&tx)
+		return false, err
+	}
+	return ok, db.Commit(&tx)
+}
+
+// DBTX.GetStruct in a snapshot
+func (db *DB) GetStruct(table string, v any) (bool, error) {
+	tx := DBTX{}
+	db.BeginRead(&tx)
+	defer db.Abort(&tx)
+	return tx.GetStruct(table, v)
+}
+
+// a schema from the tagged fields, in their order. the primary key is the
+// fields marked `pk`, or the first field; the pointers are nullable.
+func StructTableDef(name string, v any) (*TableDef, error) {
+	t := reflect.TypeOf(v)
+	if t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil, errors.New("not a struct")
+	}
+	fields, err := structFields(t)
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, errors.New("no tagged fields")
+	}
+	tdef := &TableDef{Name: name, Indexes: [][]string{nil}}
+	nullable := false
+	for _, f := range fields {
+		tdef.Cols = append(tdef.Cols, f.col)
+		tdef.Types = append(tdef.Types, f.typ)
+		tdef.Nullable = append(tdef.Nullable, f.ptr)
+		nullable = nullable || f.ptr
+		if f.pk {
+			tdef.Indexes[0] = append(tdef.Indexes[0], f.col)
+		}
+	}
+	if tdef.Indexes[0] == nil {
+		tdef.Indexes[0] = []string{fields[0].col}
+	}
+	if !nullable {
+		tdef.Nullable = nil
+	}
+	return tdef, nil
+}
@@ -0,0 +1,242 @@
+package table
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+
+	"github.com/Adit0507/AdiDB/internal/btree_iter"
+)
+
+/*
+merge of 2 copies of a DB that were written separately. the rows of each
+table are compared by primary key with an ordered merge of a scan on each
+side, and the differences are written in a transaction per DB:
+- a row on one side is copied to the other.
+- a row on both sides with different values is a conflict. the row from
+  SyncOptions.Resolve is written to both.
+
+deletes are not tracked, so a row deleted on one side is copied back from
+the other. to delete a row, mark it with a column and let the resolver keep
+the mark, or delete it on both sides. auto-increment keys generated on
+both sides collide and are resolved like other conflicts.
+*/
+
+// the column of the built-in resolver, INT64 or TIMESTAMP
+const SYNC_UPDATED_AT = "updated_at"
+
+type SyncOptions struct {
+	// the tables to merge; every table in both DBs if empty
+	Tables []string
+	// the row for both sides when they differ; `local` is from the DB of
+	// SyncWith. nil leaves both rows as they are. without it, the row with
+	// the later SYNC_UPDATED_AT wins if the table has the column; the
+	// local row wins a tie.
+	Resolve func(local *Record, remote *Record) *Record
+}
+
+type SyncResult struct {
+	Pushed     int // rows written to the other DB
+	Pulled     int // rows written to this DB
+	Conflicted int // rows that differ on both sides
+}
+
+// merge the rows of the tables in both DBs. the 2 DBs are committed one
+// after the other; if the other one fails, this one is already committed,
+// and running it again completes the merge.
+func (db *DB) SyncWith(other *DB, opts SyncOptions) (SyncResult, error) {
+	local, remote := DBTX{}, DBTX{}
+	db.Begin(&local)
+	other.Begin(&remote)
+	res := SyncResult{}
+	if err := syncTables(&local, &remote, opts, &res); err != nil {
+		db.Abort(&local)
+		other.Abort(&remote)
+		return SyncResult{}, err
+	}
+	if err := db.Commit(&local); err != nil {
+		other.Abort(&remote)
+		return SyncResult{}, err
+	}
+	if err := other.Commit(&remote); err != nil {
+		return res, fmt.Errorf("sync: only the local DB is committed: %w", err)
+	}
+	return res, nil
+}
+
+func syncTables(local *DBTX, remote *DBTX, opts SyncOptions, res *SyncResult) error {
+	names := opts.Tables
+	if len(names) == 0 {
+		names1, err := local.ListTables()
+		if err != nil {
+			return err
+		}
+		names2, err := remote.ListTables()
+		if err != nil {
+			return err
+		}
+		for _, name := range names1 {
+			if _, ok := slices.BinarySearch(names2, name); ok {
+				names = append(names, name)
+			}
+		}
+	}
+
+	for _, name := range names {
+		if _, ok := INTERNAL_TABLES[name]; ok {
+			return fmt.Errorf("cannot sync internal table: %s", name)
+		}
+		tdef1, err := getTableDef(local, name)
+		if err != nil {
+			return err
+		}
+		tdef2, err := getTableDef(remote, name)
+		if err != nil {
+			return err
+		}
+		same := slices.Equal(tdef1.Cols, tdef2.Cols) && slices.Equal(tdef1.Types, tdef2.Types)
+		if !same || !slices.Equal(tdef1.Indexes[0], tdef2.Indexes[0]) {
+			return fmt.Errorf("table %s: the schemas differ", name)
+		}
+		if err := syncTable(local, remote, [2]*TableDef{tdef1, tdef2}, opts, res); err != nil {
+			return fmt.Errorf("table %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// the built-in resolver; nil without the column
+func lastWriterWins(tdef *TableDef, local *Record, remote *Record) *Record {
+	idx := slices.Index(tdef.Cols, SYNC_UPDATED_AT)
+	if idx < 0 || (tdef.Types[idx] != TYPE_INT64 && tdef.Types[idx] != TYPE_TIMESTAMP) {
+		return nil
+	}
+	// null is older than any time
+	v1, v2 := local.Get(SYNC_UPDATED_AT), remote.Get(SYNC_UPDATED_AT)
+	if v2.Type != TYPE_NULL && (v1.Type == TYPE_NULL || v2.I64 > v1.I64) {
+		return remote
+	}
+	return local
+}
+
+// same values in every column
+func rowEqual(tdef *TableDef, rec1 *Record, rec2 *Record) bool {
+	for _, c := range tdef.Cols {
+		v1, v2 := rec1.Get(c), rec2.Get(c)
+		if v1 == nil || v2 == nil || !v1.Equal(v2) {
+			return false
+		}
+	}
+	return true
+}
+
+// the schemas are the same except for the prefixes
+func syncTable(local *DBTX, remote *DBTX, tdefs [2]*TableDef, opts SyncOptions, res *SyncResult) error {
+	tdef := tdefs[0]
+	scans := [2]Scanner{}
+	for i, tx := range []*DBTX{local, remote} {
+		scans[i] = Scanner{Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE}
+		if err := dbScan(tx, tdefs[i], &scans[i]); err != nil {
+			return err
+		}
+		defer scans[i].Close()
+	}
+
+	// the rows to write are collected; the scans are in the same TXs
+	push, pull := []Record{}, []Record{}
+	sc1, sc2 := &scans[0], &scans[1]
+	for sc1.Valid() || sc2.Valid() {
+		rec1, rec2 := Record{}, Record{} // kept by `push` and `pull`
+		cmp := 0
+		switch {
+		case !sc2.Valid():
+			cmp = -1
+		case !sc1.Valid():
+			cmp = +1
+		default:
+			key1, _ := sc1.iter.Deref()
+			key2, _ := sc2.iter.Deref()
+			cmp = bytes.Compare(key1[4:], key2[4:]) // without the prefixes
+		}
+		if cmp <= 0 {
+			if err := sc1.Deref(&rec1); err != nil {
+				return err
+			}
+		}
+		if cmp >= 0 {
+			if err := sc2.Deref(&rec2); err != nil {
+				return err
+			}
+		}
+
+		switch {
+		case cmp < 0:
+			push = append(push, rec1)
+			sc1.Next()
+		case cmp > 0:
+			pull = append(pull, rec2)
+			sc2.Next()
+		default:
+			if !rowEqual(tdef, &rec1, &rec2) {
+				res.Conflicted++
+				row, err := syncResolve(tdef, opts, &rec1, &rec2)
+				if err != nil {
+					return err
+				}
+				if row != nil && !rowEqual(tdef, row, &rec1) {
+					pull = append(pull, *row)
+				}
+				if row != nil && !rowEqual(tdef, row, &rec2) {
+					push = append(push, *row)
+				}
+			}
+			sc1.Next()
+			sc2.Next()
+		}
+	}
+	if err := sc1.Err(); err != nil {
+		return err
+	}
+	if err := sc2.Err(); err != nil {
+		return err
+	}
+
+	for _, rec := range push {
+		dbreq := DBUpdateReq{Record: rec, KeepTimes: true, KeepVersion: true}
+		if _, err := remote.Set(tdef.Name, &dbreq); err != nil {
+			return err
+		}
+	}
+	for _, rec := range pull {
+		dbreq := DBUpdateReq{Record: rec, KeepTimes: true, KeepVersion: true}
+		if _, err := local.Set(tdef.Name, &dbreq); err != nil {
+			return err
+		}
+	}
+	res.Pushed += len(push)
+	res.Pulled += len(pull)
+	return nil
+}
+
+// the row for both sides of a conflict; nil to leave them
+func syncResolve(tdef *TableDef, opts SyncOptions, local *Record, remote *Record) (*Record, error) {
+	var row *Record
+	if opts.Resolve != nil {
+		row = opts.Resolve(local, remote)
+	} else {
+		row = lastWriterWins(tdef, local, remote)
+	}
+	if row == nil {
+		return nil, nil
+	}
+	// the resolver must not move the row
+	pk1, err := getValues(tdef, *row, tdef.Indexes[0])
+	if err != nil {
+		return nil, err
+	}
+	pk2, _ := getValues(tdef, *local, tdef.Indexes[0])
+	if !bytes.Equal(encodeValues(nil, pk1), encodeValues(nil, pk2)) {
+		return nil, fmt.Errorf("the resolver changed the primary key")
+	}
+	return row, nil
+}
@@ -1,13 +1,29 @@
 package table
 
 import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"math"
+	"math/rand"
 	"os"
 	"reflect"
+	"slices"
 	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+	"unicode/utf8"
 
-	"github.com/Adit0507/AdiDB/btree_iter"
+	"github.com/Adit0507/AdiDB/internal/btree"
+	"github.com/Adit0507/AdiDB/internal/btree_iter"
+	"github.com/Adit0507/AdiDB/internal/kv"
+	"github.com/Adit0507/AdiDB/internal/transactions"
 	is "github.com/stretchr/testify/require"
 )
 
@@ -16,10 +32,16 @@ type R struct {
 	ref map[string][]Record
 }
 
+// options of the DBs created by newR; see TestTablePageSize
+var (
+	testPageSize  = 0
+	testCacheSize = int64(0)
+)
+
 func newR() *R {
 	os.Remove("r.db")
 	r := &R{
-		db:  DB{Path: "r.db"},
+		db:  DB{Path: "r.db", Options: Options{PageSize: testPageSize, CacheSize: testCacheSize}},
 		ref: map[string][]Record{},
 	}
 	err := r.db.Open()
@@ -27,6 +49,16 @@ func newR() *R {
 	return r
 }
 
+// the schema, or nil for a missing table
+func testTableDef(tx *DBTX, name string) *TableDef {
+	tdef, err := getTableDef(tx, name)
+	if errors.Is(err, ErrTableNotFound) {
+		return nil
+	}
+	assert(err == nil)
+	return tdef
+}
+
 func (r *R) dispose() {
 	r.db.Close()
 	os.Remove("r.db")
@@ -221,8 +253,9 @@ func TestStringEscape(t *testing.T) {
 	for i, s := range in {
 		b := escapeString(s)
 		is.Equal(t, out[i], b)
-		s2 := unescapeString(b)
-		is.Equal(t, s, s2)
+		s2, err := unescapeString([]byte("x"), b)
+		is.Nil(t, err)
+		is.Equal(t, append([]byte("x"), s...), s2)
 	}
 }
 
@@ -235,7 +268,7 @@ func TestTableEncoding(t *testing.T) {
 		v := Value{Type: TYPE_INT64, I64: int64(i)}
 		b := encodeValues(nil, []Value{v})
 		out := []Value{v}
-		decodeValues(b, out)
+		is.Nil(t, decodeValues(b, out))
 		assert(out[0].I64 == int64(i))
 		encoded = append(encoded, string(b))
 	}
@@ -243,6 +276,128 @@ func TestTableEncoding(t *testing.T) {
 	is.True(t, sort.StringsAreSorted(encoded))
 }
 
+// the logical order of the values of a column, NULL first. -0 is before
+// 0, as they are different keys.
+func testCompareValue(a, b *Value) int {
+	if a.Type == TYPE_NULL || b.Type == TYPE_NULL {
+		return cmp.Compare(btoi(a.Type != TYPE_NULL), btoi(b.Type != TYPE_NULL))
+	}
+	switch a.Type {
+	case TYPE_BYTES:
+		return bytes.Compare(a.Str, b.Str)
+	case TYPE_FLOAT64:
+		if a.F64 == 0 && b.F64 == 0 {
+			return -cmp.Compare(btoi(math.Signbit(a.F64)), btoi(math.Signbit(b.F64)))
+		}
+		return cmp.Compare(a.F64, b.F64)
+	default:
+		return cmp.Compare(a.I64, b.I64)
+	}
+}
+
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func testCompareTuple(a, b []Value) int {
+	for i := range a {
+		if c := testCompareValue(&a[i], &b[i]); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// random values that favor the edge cases of the encoding
+func testRandValue(rng *rand.Rand, tp uint32) Value {
+	if rng.Intn(8) == 0 {
+		return Value{Type: TYPE_NULL}
+	}
+	v := Value{Type: tp}
+	switch tp {
+	case TYPE_BYTES:
+		v.Str = []byte{}
+		for n := rng.Intn(5); n > 0; n-- {
+			v.Str = append(v.Str, []byte{0, 1, 2, 'a', 0xfe, 0xff}[rng.Intn(6)])
+		}
+	case TYPE_INT64, TYPE_TIMESTAMP:
+		ints := []int64{math.MinInt64, -1 << 32, -1, 0, 1, 255, 256, 1 << 32, math.MaxInt64}
+		v.I64 = ints[rng.Intn(len(ints))]
+		if rng.Intn(3) == 0 {
+			v.I64 = rng.Int63() - rng.Int63()
+		}
+	case TYPE_FLOAT64:
+		floats := []float64{
+			math.Inf(-1), -math.MaxFloat64, -1.5, -math.SmallestNonzeroFloat64,
+			math.Copysign(0, -1), 0, math.SmallestNonzeroFloat64, 1.5,
+			math.MaxFloat64, math.Inf(1),
+		}
+		v.F64 = floats[rng.Intn(len(floats))]
+		if rng.Intn(3) == 0 {
+			v.F64 = rng.NormFloat64() * 1e6
+		}
+	case TYPE_BOOL:
+		v.I64 = int64(rng.Intn(2))
+	}
+	return v
+}
+
+// the order of the encoded keys is the order of the values, column by
+// column, and the keys decode to the values
+func TestTableKeyOrder(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	schemas := [][]uint32{
+		{TYPE_BYTES},
+		{TYPE_BYTES, TYPE_BYTES},
+		{TYPE_BYTES, TYPE_INT64},
+		{TYPE_INT64, TYPE_BYTES},
+		{TYPE_FLOAT64, TYPE_BOOL, TYPE_BYTES},
+		{TYPE_TIMESTAMP, TYPE_BYTES, TYPE_INT64},
+	}
+	const prefix = 100
+	for _, schema := range schemas {
+		tuples := make([][]Value, 300)
+		keys := make([][]byte, len(tuples))
+		for i := range tuples {
+			for _, tp := range schema {
+				tuples[i] = append(tuples[i], testRandValue(rng, tp))
+			}
+			keys[i] = encodeKey(nil, prefix, tuples[i])
+
+			out := make([]Value, len(schema))
+			for j, tp := range schema {
+				out[j].Type = tp
+			}
+			is.Nil(t, decodeKey(keys[i], out))
+			is.Equal(t, 0, testCompareTuple(tuples[i], out), "%v %v", tuples[i], out)
+		}
+
+		for i := range tuples {
+			for j := range tuples {
+				want := testCompareTuple(tuples[i], tuples[j])
+				got := bytes.Compare(keys[i], keys[j])
+				is.Equal(t, want, got, "%v %v", tuples[i], tuples[j])
+			}
+		}
+
+		// the range of a prefix of the columns holds the keys with it
+		for i := range tuples {
+			for n := 1; n < len(schema); n++ {
+				lo := encodeKeyPartial(nil, prefix, tuples[i][:n], btree_iter.CMP_GE)
+				hi := encodeKeyPartial(nil, prefix, tuples[i][:n], btree_iter.CMP_LE)
+				for j := range tuples {
+					in := bytes.Compare(lo, keys[j]) <= 0 && bytes.Compare(keys[j], hi) <= 0
+					same := testCompareTuple(tuples[i][:n], tuples[j][:n]) == 0
+					is.Equal(t, same, in, "%v %v", tuples[i][:n], tuples[j])
+				}
+			}
+		}
+	}
+}
+
 func TestTableScan(t *testing.T) {
 	r := newR()
 	tdef := &TableDef{
@@ -492,3 +647,7910 @@ func TestTableIndex(t *testing.T) {
 
 	r.dispose()
 }
+
+func TestScanMemBudget(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	tdef := &TableDef{
+		Name:    "tbl_test",
+		Cols:    []string{"k", "v"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"k"}},
+	}
+	r.create(tdef)
+	for i := 0; i < 1000; i++ {
+		rec := Record{}
+		rec.AddInt64("k", int64(i)).AddStr("v", []byte(strings.Repeat("x", 100)))
+		r.add("tbl_test", rec)
+	}
+
+	all := func(sc *Scanner) error {
+		for ; sc.Valid(); sc.Next() {
+			rec := Record{}
+			if err := sc.Deref(&rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// a single row exceeds the per-scanner budget
+	r.db.ScanMemLimit = 64
+	tx := r.begin()
+	sc := Scanner{Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE}
+	is.Nil(t, tx.Scan("tbl_test", &sc))
+	is.ErrorIs(t, all(&sc), ErrMemoryBudget)
+	is.Equal(t, 1, len(r.db.ScanStats()))
+	r.commit(tx)
+	is.Equal(t, 0, len(r.db.ScanStats()))
+	is.Equal(t, int64(0), r.db.MemUsed())
+
+	// rows are released as the scanner moves
+	r.db.ScanMemLimit = 1024
+	tx = r.begin()
+	sc = Scanner{Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE}
+	is.Nil(t, tx.Scan("tbl_test", &sc))
+	is.Nil(t, all(&sc))
+	is.True(t, sc.MemUsed() > 0)
+	sc.Close()
+	is.Equal(t, int64(0), r.db.MemUsed())
+
+	// the global budget is shared by open scanners
+	r.db.ScanMemLimit = 0
+	r.db.MemLimit = 300
+	sc1 := Scanner{Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE}
+	sc2 := Scanner{Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE}
+	is.Nil(t, tx.Scan("tbl_test", &sc1))
+	is.Nil(t, tx.Scan("tbl_test", &sc2))
+	rec := Record{}
+	is.Nil(t, sc1.Deref(&rec))
+	is.ErrorIs(t, sc2.Deref(&rec), ErrMemoryBudget)
+	is.True(t, r.db.MemUsed() <= 300)
+	sc1.Close()
+	is.Nil(t, sc2.Deref(&rec))
+	r.db.Abort(tx)
+	is.Equal(t, int64(0), r.db.MemUsed())
+}
+
+// raw KV keys under a prefix
+func rawKeys(tx *DBTX, prefix uint32) (keys []string) {
+	start := encodeKey(nil, prefix, nil)
+	end := encodeKey(nil, prefix+1, nil)
+	iter := tx.kv.Seek(start, btree_iter.CMP_GE, end, btree_iter.CMP_LT)
+	for ; iter.Valid(); iter.Next() {
+		key, _ := iter.Deref()
+		keys = append(keys, string(key))
+	}
+	return keys
+}
+
+func TestTableIndexKeys(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	tdef := &TableDef{
+		Name:    "tbl_test",
+		Cols:    []string{"k", "a", "b", "c"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES, TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"k"}, {"a"}, {"b"}},
+	}
+	r.create(tdef)
+
+	record := func(k int64, a string, b int64, c string) Record {
+		rec := Record{}
+		rec.AddInt64("k", k).AddStr("a", []byte(a))
+		rec.AddInt64("b", b).AddStr("c", []byte(c))
+		return rec
+	}
+	counts := func() []int {
+		tx := r.begin()
+		defer r.commit(tx)
+		out := []int{}
+		for _, prefix := range tdef.Prefixes {
+			out = append(out, len(rawKeys(tx, prefix)))
+		}
+		return out
+	}
+
+	r.add("tbl_test", record(1, "x", 10, "c1"))
+	r.add("tbl_test", record(2, "y", 20, "c2"))
+	is.Equal(t, []int{2, 2, 2}, counts())
+
+	// the index keys follow the updated values
+	tx := r.begin()
+	before := rawKeys(tx, tdef.Prefixes[2])
+	r.commit(tx)
+	r.add("tbl_test", record(1, "z", 10, "c3"))
+	is.Equal(t, []int{2, 2, 2}, counts())
+	tx = r.begin()
+	is.Equal(t, before, rawKeys(tx, tdef.Prefixes[2]))
+	key := encodeKey(nil, tdef.Prefixes[1], []Value{
+		{Type: TYPE_BYTES, Str: []byte("z")}, {Type: TYPE_INT64, I64: 1},
+	})
+	is.Contains(t, rawKeys(tx, tdef.Prefixes[1]), string(key))
+	r.commit(tx)
+
+	// a failed index write leaves nothing behind
+	tx = r.begin()
+	long := strings.Repeat("a", 995)
+	bad := record(3, long, 30, "c")
+	_, err := tx.Insert("tbl_test", &bad)
+	is.NotNil(t, err)
+	got := Record{}
+	got.AddInt64("k", 3)
+	ok, err := tx.Get("tbl_test", &got)
+	is.Nil(t, err)
+	is.False(t, ok)
+	r.commit(tx)
+	is.Equal(t, []int{2, 2, 2}, counts())
+
+	// deleting removes every index key
+	rec := Record{}
+	r.del("tbl_test", *rec.AddInt64("k", 1))
+	is.Equal(t, []int{1, 1, 1}, counts())
+	rec = Record{}
+	r.del("tbl_test", *rec.AddInt64("k", 2))
+	is.Equal(t, []int{0, 0, 0}, counts())
+}
+
+func TestTableScanSecondaryIndex(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	tdef := &TableDef{
+		Name:    "tbl_test",
+		Cols:    []string{"id", "name", "score"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES, TYPE_INT64},
+		Indexes: [][]string{{"id"}, {"score"}},
+	}
+	r.create(tdef)
+
+	type pair struct{ score, id int64 }
+	ref := []pair{}
+	for i := int64(0); i < 50; i++ {
+		score := int64(fmix32(uint32(i))%20) - 10
+		rec := Record{}
+		rec.AddInt64("id", i).AddStr("name", []byte("n")).AddInt64("score", score)
+		r.add("tbl_test", rec)
+		if -5 <= score && score < 5 {
+			ref = append(ref, pair{score, i})
+		}
+	}
+	sort.Slice(ref, func(i, j int) bool {
+		return ref[i].score < ref[j].score ||
+			(ref[i].score == ref[j].score && ref[i].id < ref[j].id)
+	})
+
+	key := func(score int64) Record {
+		rec := Record{}
+		rec.AddInt64("score", score)
+		return rec
+	}
+	scan := func(sc Scanner) []pair {
+		tx := r.begin()
+		defer r.commit(tx)
+		is.Nil(t, tx.Scan("tbl_test", &sc))
+		is.Equal(t, 1, sc.Index())
+		is.Equal(t, []string{"score", "id"}, sc.IndexCols())
+		out := []pair{}
+		for ; sc.Valid(); sc.Next() {
+			rec := Record{}
+			is.Nil(t, sc.Deref(&rec))
+			is.Equal(t, 3, len(rec.Cols)) // the full row
+			out = append(out, pair{rec.Get("score").I64, rec.Get("id").I64})
+		}
+		return out
+	}
+
+	asc := scan(Scanner{
+		Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LT,
+		Key1: key(-5), Key2: key(5),
+	})
+	is.Equal(t, ref, asc)
+
+	desc := scan(Scanner{
+		Cmp1: btree_iter.CMP_LT, Cmp2: btree_iter.CMP_GE,
+		Key1: key(5), Key2: key(-5),
+	})
+	slices.Reverse(desc)
+	is.Equal(t, ref, desc)
+}
+
+func TestTableUniqueIndex(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	tdef := &TableDef{
+		Name:    "users",
+		Cols:    []string{"id", "email", "name"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES, TYPE_BYTES},
+		Indexes: [][]string{{"id"}, {"email"}, {"name"}},
+		Unique:  []bool{false, true, false},
+	}
+	r.create(tdef)
+
+	user := func(id int64, email string, name string) Record {
+		rec := Record{}
+		rec.AddInt64("id", id).AddStr("email", []byte(email))
+		rec.AddStr("name", []byte(name))
+		return rec
+	}
+	set := func(rec Record) error {
+		tx := r.begin()
+		_, err := tx.Upsert("users", rec)
+		r.commit(tx)
+		return err
+	}
+
+	is.Nil(t, set(user(1, "a@x", "alice")))
+	is.Nil(t, set(user(2, "b@x", "alice"))) // not unique
+	err := set(user(3, "a@x", "carol"))
+	is.ErrorIs(t, err, ErrUniqueViolation)
+	err = set(user(2, "a@x", "bob"))
+	is.ErrorIs(t, err, ErrUniqueViolation)
+
+	// the rejected writes left nothing behind
+	tx := r.begin()
+	is.Equal(t, 2, len(rawKeys(tx, tdef.Prefixes[1])))
+	got := Record{}
+	got.AddInt64("id", 3)
+	ok, err := tx.Get("users", &got)
+	is.Nil(t, err)
+	is.False(t, ok)
+	got = Record{}
+	got.AddInt64("id", 2)
+	_, err = tx.Get("users", &got)
+	is.Nil(t, err)
+	is.Equal(t, "b@x", string(got.Get("email").Str))
+	r.commit(tx)
+
+	// the same row may keep its value
+	is.Nil(t, set(user(1, "a@x", "alice2")))
+	// the value is free after it moves
+	is.Nil(t, set(user(1, "c@x", "alice2")))
+	is.Nil(t, set(user(3, "a@x", "carol")))
+}
+
+func TestTableDrop(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	tdef := &TableDef{
+		Name:    "tbl_test",
+		Cols:    []string{"ki1", "ks2", "s1", "i2"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES, TYPE_BYTES, TYPE_INT64},
+		Indexes: [][]string{{"ki1", "ks2"}, {"i2"}},
+	}
+	r.create(tdef)
+	for i := int64(0); i < 10; i++ {
+		rec := Record{}
+		rec.AddInt64("ki1", i).AddStr("ks2", []byte("hello"))
+		rec.AddStr("s1", []byte("world")).AddInt64("i2", i*i)
+		r.add("tbl_test", rec)
+	}
+
+	tx := r.begin()
+	is.NotNil(t, tx.TableDrop("@meta"))
+	is.NotNil(t, tx.TableDrop("@table"))
+	is.NotNil(t, tx.TableDrop("nope"))
+	is.Nil(t, tx.TableDrop("tbl_test"))
+	// the drop is visible inside the transaction
+	for _, prefix := range tdef.Prefixes {
+		is.Empty(t, rawKeys(tx, prefix))
+	}
+	is.NotNil(t, tx.TableDrop("tbl_test"))
+	r.commit(tx)
+
+	tx = r.begin()
+	for _, prefix := range tdef.Prefixes {
+		is.Empty(t, rawKeys(tx, prefix))
+	}
+	rec := Record{}
+	rec.AddInt64("ki1", 1).AddStr("ks2", []byte("hello"))
+	_, err := tx.Get("tbl_test", &rec)
+	is.ErrorContains(t, err, "table not found")
+	_, err = tx.Insert("tbl_test", &rec)
+	is.ErrorContains(t, err, "table not found")
+	r.commit(tx)
+
+	// the name and the prefixes are reused
+	tdef2 := &TableDef{
+		Name:    "tbl_test",
+		Cols:    []string{"k", "v"},
+		Types:   []uint32{TYPE_BYTES, TYPE_BYTES},
+		Indexes: [][]string{{"k"}},
+	}
+	r.create(tdef2)
+	is.Equal(t, tdef.Prefixes[0], tdef2.Prefixes[0])
+	tx = r.begin()
+	rec = Record{}
+	rec.AddStr("k", []byte("a")).AddStr("v", []byte("b"))
+	_, err = tx.Insert("tbl_test", &rec)
+	is.Nil(t, err)
+	r.commit(tx)
+}
+
+func TestTableAddColumn(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	tdef := &TableDef{
+		Name:    "tbl_test",
+		Cols:    []string{"k", "v"},
+		Types:   []uint32{TYPE_BYTES, TYPE_BYTES},
+		Indexes: [][]string{{"k"}},
+	}
+	r.create(tdef)
+	for _, k := range []string{"a", "b"} {
+		rec := Record{}
+		rec.AddStr("k", []byte(k)).AddStr("v", []byte("old"))
+		r.add("tbl_test", rec)
+	}
+
+	tx := r.begin()
+	zero := Value{Type: TYPE_INT64}
+	is.NotNil(t, tx.TableAddColumn("tbl_test", "v", TYPE_INT64, zero))
+	is.NotNil(t, tx.TableAddColumn("tbl_test", "score", TYPE_BYTES, zero))
+	is.NotNil(t, tx.TableAddColumn("nope", "score", TYPE_INT64, zero))
+	is.NotNil(t, tx.TableAddColumn("@meta", "score", TYPE_INT64, zero))
+	is.Nil(t, tx.TableAddColumn("tbl_test", "score", TYPE_INT64, zero))
+	r.commit(tx)
+
+	// old rows read the default
+	tx = r.begin()
+	rec := Record{}
+	rec.AddStr("k", []byte("a"))
+	ok, err := tx.Get("tbl_test", &rec)
+	is.Nil(t, err)
+	is.True(t, ok)
+	is.Equal(t, int64(0), rec.Get("score").I64)
+	is.Equal(t, "old", string(rec.Get("v").Str))
+
+	// new writes use the wider encoding
+	rec = Record{}
+	rec.AddStr("k", []byte("b")).AddStr("v", []byte("new"))
+	rec.AddInt64("score", 7)
+	_, err = tx.Update("tbl_test", rec)
+	is.Nil(t, err)
+	rec = Record{}
+	rec.AddStr("k", []byte("c")).AddStr("v", []byte("new"))
+	_, err = tx.Insert("tbl_test", &rec)
+	is.Nil(t, err) // takes the default
+	r.commit(tx)
+
+	// reopen to check the stored schema
+	r.db.Close()
+	r.db = DB{Path: r.db.Path}
+	is.Nil(t, r.db.Open())
+	tx = r.begin()
+	sc := Scanner{
+		Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE,
+		Key1: *(&Record{}).AddStr("k", []byte("")),
+		Key2: *(&Record{}).AddStr("k", []byte("z")),
+	}
+	is.Nil(t, tx.Scan("tbl_test", &sc))
+	scores := []int64{}
+	for ; sc.Valid(); sc.Next() {
+		got := Record{}
+		is.Nil(t, sc.Deref(&got))
+		scores = append(scores, got.Get("score").I64)
+	}
+	is.Equal(t, []int64{0, 7, 0}, scores)
+
+	// deletes see the default too
+	rec = Record{}
+	rec.AddStr("k", []byte("a"))
+	ok, err = tx.Delete("tbl_test", rec)
+	is.Nil(t, err)
+	is.True(t, ok)
+	r.commit(tx)
+
+	// the other types, and a nullable column with a null default
+	tx = r.begin()
+	nan := Value{Type: TYPE_FLOAT64, F64: math.NaN()}
+	is.NotNil(t, tx.TableAddColumn("tbl_test", "f", TYPE_FLOAT64, nan))
+	is.ErrorIs(t, tx.TableAddColumn("tbl_test", "doc", TYPE_JSON, Value{Type: TYPE_JSON, Str: []byte("{")}), ErrInvalidJSON)
+	is.NotNil(t, tx.TableAddColumn("tbl_test", "x", 99, Value{Type: 99}))
+	is.NotNil(t, tx.TableAddColumn("tbl_test", "x", TYPE_NULL, Value{Type: TYPE_NULL}))
+	adds := []struct {
+		col string
+		tp  uint32
+		def Value
+	}{
+		{"f", TYPE_FLOAT64, Value{Type: TYPE_FLOAT64, F64: 1.5}},
+		{"flag", TYPE_BOOL, Value{Type: TYPE_BOOL, I64: 1}},
+		{"at", TYPE_TIMESTAMP, Value{Type: TYPE_TIMESTAMP, I64: time.Unix(100, 0).UnixNano()}},
+		{"doc", TYPE_JSON, Value{Type: TYPE_JSON, Str: []byte(`{"a":1}`)}},
+		{"note", TYPE_BYTES, Value{Type: TYPE_NULL}},
+	}
+	for _, a := range adds {
+		is.Nil(t, tx.TableAddColumn("tbl_test", a.col, a.tp, a.def), a.col)
+	}
+	r.commit(tx)
+	tx = r.begin()
+	rec = *(&Record{}).AddStr("k", []byte("b"))
+	ok, err = tx.Get("tbl_test", &rec)
+	is.Nil(t, err)
+	is.True(t, ok)
+	for _, a := range adds {
+		is.Equal(t, a.def, *rec.Get(a.col), a.col)
+	}
+	// the nullable column takes a value
+	rec = *(&Record{}).AddStr("k", []byte("b")).AddStr("v", []byte("x")).AddStr("note", []byte("hi"))
+	_, err = tx.Update("tbl_test", rec)
+	is.Nil(t, err)
+	rec = *(&Record{}).AddStr("k", []byte("b"))
+	ok, err = tx.Get("tbl_test", &rec)
+	is.Nil(t, err)
+	is.True(t, ok)
+	is.Equal(t, "hi", string(rec.Get("note").Str))
+	r.commit(tx)
+}
+
+func TestTableRename(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	for _, name := range []string{"t1", "t2"} {
+		r.create(&TableDef{
+			Name:    name,
+			Cols:    []string{"k", "v"},
+			Types:   []uint32{TYPE_BYTES, TYPE_BYTES},
+			Indexes: [][]string{{"k"}, {"v"}},
+		})
+	}
+	rec := Record{}
+	rec.AddStr("k", []byte("a")).AddStr("v", []byte("b"))
+	r.add("t1", rec)
+
+	tx := r.begin()
+	is.NotNil(t, tx.TableRename("t1", "t2"))
+	is.NotNil(t, tx.TableRename("t1", "@meta"))
+	is.NotNil(t, tx.TableRename("@table", "t3"))
+	is.NotNil(t, tx.TableRename("nope", "t3"))
+	is.Nil(t, tx.TableRename("t1", "t3"))
+	r.commit(tx)
+
+	tx = r.begin()
+	got := Record{}
+	got.AddStr("k", []byte("a"))
+	_, err := tx.Get("t1", &got)
+	is.ErrorContains(t, err, "table not found")
+	ok, err := tx.Get("t3", &got)
+	is.Nil(t, err)
+	is.True(t, ok)
+	is.Equal(t, "b", string(got.Get("v").Str))
+	is.Equal(t, "t3", testTableDef(tx, "t3").Name)
+
+	// secondary indexes still work
+	sc := Scanner{
+		Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE,
+		Key1: *(&Record{}).AddStr("v", []byte("b")),
+		Key2: *(&Record{}).AddStr("v", []byte("b")),
+	}
+	is.Nil(t, tx.Scan("t3", &sc))
+	is.True(t, sc.Valid())
+	r.commit(tx)
+
+	// the old name is free
+	r.create(&TableDef{
+		Name:    "t1",
+		Cols:    []string{"k"},
+		Types:   []uint32{TYPE_INT64},
+		Indexes: [][]string{{"k"}},
+	})
+}
+
+func TestTableList(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	tx := r.begin()
+	names, err := tx.ListTables()
+	is.Nil(t, err)
+	is.Empty(t, names)
+	is.Equal(t, []string{"@changes", "@meta", "@stats", "@table"}, tx.ListInternalTables())
+	r.commit(tx)
+
+	for _, name := range []string{"t2", "t1", "t3"} {
+		r.create(&TableDef{
+			Name:    name,
+			Cols:    []string{"k", "v"},
+			Types:   []uint32{TYPE_BYTES, TYPE_INT64},
+			Indexes: [][]string{{"k"}, {"v"}},
+		})
+	}
+
+	tx = r.begin()
+	names, err = tx.ListTables()
+	is.Nil(t, err)
+	is.Equal(t, []string{"t1", "t2", "t3"}, names)
+
+	// the schema is a copy that serializes like the stored one
+	tdef, err := tx.GetTableDef("t1")
+	is.Nil(t, err)
+	is.Equal(t, []string{"v", "k"}, tdef.Indexes[1])
+	stored := (&Record{}).AddStr("name", []byte("t1"))
+	ok, err := tx.Get("@table", stored)
+	is.Nil(t, err)
+	is.True(t, ok)
+	val, err := json.Marshal(tdef)
+	is.Nil(t, err)
+	is.Equal(t, string(stored.Get("def").Str), string(val))
+
+	tdef.Cols[0] = "oops"
+	tdef, err = tx.GetTableDef("t1")
+	is.Nil(t, err)
+	is.Equal(t, "k", tdef.Cols[0])
+
+	_, err = tx.GetTableDef("nope")
+	is.NotNil(t, err)
+	tdef, err = tx.GetTableDef("@meta")
+	is.Nil(t, err)
+	is.Equal(t, "@meta", tdef.Name)
+	r.commit(tx)
+}
+
+func TestTableAutoIncrement(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	tx := r.begin()
+	is.NotNil(t, tx.TableNew(&TableDef{
+		Name:    "bad",
+		Cols:    []string{"k", "v"},
+		Types:   []uint32{TYPE_BYTES, TYPE_BYTES},
+		Indexes: [][]string{{"k"}},
+		AutoInc: true,
+	}))
+	r.db.Abort(tx)
+	r.create(&TableDef{
+		Name:    "tbl_test",
+		Cols:    []string{"id", "v"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"id"}, {"v"}},
+		AutoInc: true,
+	})
+
+	insert := func(rec Record) int64 {
+		tx := r.begin()
+		_, err := tx.Insert("tbl_test", &rec)
+		is.Nil(t, err)
+		r.commit(tx)
+		return rec.Get("id").I64
+	}
+	row := func(v string) Record {
+		rec := Record{}
+		rec.AddStr("v", []byte(v))
+		return rec
+	}
+
+	is.Equal(t, int64(1), insert(row("a")))
+	is.Equal(t, int64(2), insert(row("b")))
+	// explicit ids advance the counter
+	is.Equal(t, int64(10), insert(*(&Record{}).AddInt64("id", 10).AddStr("v", []byte("c"))))
+	is.Equal(t, int64(11), insert(row("d")))
+	is.Equal(t, int64(5), insert(*(&Record{}).AddInt64("id", 5).AddStr("v", []byte("e"))))
+	is.Equal(t, int64(12), insert(row("f")))
+
+	// several inserts in one transaction
+	tx = r.begin()
+	for i := int64(13); i < 16; i++ {
+		rec := row("g")
+		_, err := tx.Insert("tbl_test", &rec)
+		is.Nil(t, err)
+		is.Equal(t, i, rec.Get("id").I64)
+	}
+	r.commit(tx)
+
+	// the counter survives a restart
+	r.db.Close()
+	r.db = DB{Path: r.db.Path}
+	is.Nil(t, r.db.Open())
+	is.Equal(t, int64(16), insert(row("h")))
+
+	tx = r.begin()
+	got := (&Record{}).AddInt64("id", 16)
+	ok, err := tx.Get("tbl_test", got)
+	is.Nil(t, err)
+	is.True(t, ok)
+	is.Equal(t, "h", string(got.Get("v").Str))
+
+	// the counter follows renames and goes away with the table
+	is.Nil(t, tx.TableRename("tbl_test", "tbl_new"))
+	rec := row("i")
+	_, err = tx.Insert("tbl_new", &rec)
+	is.Nil(t, err)
+	is.Equal(t, int64(17), rec.Get("id").I64)
+	is.Nil(t, tx.TableDrop("tbl_new"))
+	r.commit(tx)
+
+	r.create(&TableDef{
+		Name:    "tbl_new",
+		Cols:    []string{"id", "v"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"id"}},
+		AutoInc: true,
+	})
+	tx = r.begin()
+	rec = row("j")
+	_, err = tx.Insert("tbl_new", &rec)
+	is.Nil(t, err)
+	is.Equal(t, int64(1), rec.Get("id").I64)
+	r.commit(tx)
+}
+
+func TestTableWrittenRow(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	r.create(&TableDef{
+		Name:     "tbl_test",
+		Cols:     []string{"id", "v", "n"},
+		Types:    []uint32{TYPE_INT64, TYPE_BYTES, TYPE_INT64},
+		Indexes:  [][]string{{"id"}, {"v"}},
+		Defaults: []Value{{}, {}, {Type: TYPE_INT64, I64: 7}},
+		AutoInc:  true,
+	})
+
+	tx := r.begin()
+	defer r.db.Abort(tx)
+	tdef := testTableDef(tx, "tbl_test")
+	dbreq := DBUpdateReq{Record: *(&Record{}).AddStr("v", []byte("a")), Mode: btree.MODE_INSERT_ONLY}
+	_, err := tx.Set("tbl_test", &dbreq)
+	is.Nil(t, err)
+	is.True(t, dbreq.Added)
+	is.Equal(t, int64(1), dbreq.Record.Get("id").I64)
+	is.Equal(t, int64(1), dbreq.Row.Get("id").I64)
+	is.Equal(t, "a", string(dbreq.Row.Get("v").Str))
+	is.Equal(t, int64(7), dbreq.Row.Get("n").I64)
+	pk, err := getValues(tdef, dbreq.Row, tdef.Indexes[0])
+	is.Nil(t, err)
+	is.Equal(t, encodeKey(nil, tdef.Prefixes[0], pk), dbreq.Key)
+
+	// the row as read back
+	got := (&Record{}).AddInt64("id", 1)
+	ok, err := tx.Get("tbl_test", got)
+	is.Nil(t, err)
+	is.True(t, ok)
+	for _, c := range tdef.Cols {
+		is.Equal(t, *got.Get(c), *dbreq.Row.Get(c), c)
+	}
+
+	// an existing key is reported by an insert that doesn't add it
+	dbreq = DBUpdateReq{Record: *(&Record{}).AddInt64("id", 1).AddStr("v", []byte("b")), Mode: btree.MODE_INSERT_ONLY}
+	_, err = tx.Set("tbl_test", &dbreq)
+	is.ErrorIs(t, err, ErrRecordExists)
+	is.False(t, dbreq.Added)
+	is.NotNil(t, dbreq.Key)
+	// nothing on an error
+	dbreq = DBUpdateReq{Record: *(&Record{}).AddInt64("id", 2).AddInt64("v", 3)}
+	_, err = tx.Set("tbl_test", &dbreq)
+	is.NotNil(t, err)
+	is.Nil(t, dbreq.Key)
+	is.Empty(t, dbreq.Row.Cols)
+}
+
+func TestTableNull(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	tx := r.begin()
+	is.NotNil(t, tx.TableNew(&TableDef{
+		Name:     "bad",
+		Cols:     []string{"k", "v"},
+		Types:    []uint32{TYPE_BYTES, TYPE_BYTES},
+		Indexes:  [][]string{{"k"}, {"v"}},
+		Nullable: []bool{false, true},
+	}))
+	r.db.Abort(tx)
+	r.create(&TableDef{
+		Name:     "tbl_test",
+		Cols:     []string{"k", "a", "b"},
+		Types:    []uint32{TYPE_BYTES, TYPE_INT64, TYPE_BYTES},
+		Indexes:  [][]string{{"k"}},
+		Nullable: []bool{false, true, true},
+	})
+
+	tx = r.begin()
+	// omitted and explicit nulls
+	rec := (&Record{}).AddStr("k", []byte("x")).AddStr("b", []byte("y"))
+	_, err := tx.Insert("tbl_test", rec)
+	is.Nil(t, err)
+	rec = (&Record{}).AddStr("k", []byte("z")).AddNull("a").AddNull("b")
+	_, err = tx.Insert("tbl_test", rec)
+	is.Nil(t, err)
+	// keys can't be null
+	rec = (&Record{}).AddNull("k").AddInt64("a", 1).AddStr("b", nil)
+	_, err = tx.Insert("tbl_test", rec)
+	is.ErrorContains(t, err, "not nullable")
+	r.commit(tx)
+
+	tx = r.begin()
+	got := (&Record{}).AddStr("k", []byte("x"))
+	ok, err := tx.Get("tbl_test", got)
+	is.Nil(t, err)
+	is.True(t, ok)
+	is.Equal(t, Value{Type: TYPE_NULL}, *got.Get("a"))
+	is.Equal(t, "y", string(got.Get("b").Str))
+	is.Nil(t, got.Get("c"))
+
+	got = (&Record{}).AddStr("k", []byte("z"))
+	ok, err = tx.Get("tbl_test", got)
+	is.Nil(t, err)
+	is.True(t, ok)
+	is.Equal(t, uint32(TYPE_NULL), got.Get("a").Type)
+	is.Equal(t, uint32(TYPE_NULL), got.Get("b").Type)
+
+	// null can be replaced by a value
+	rec = (&Record{}).AddStr("k", []byte("z")).AddInt64("a", 5).AddNull("b")
+	_, err = tx.Update("tbl_test", *rec)
+	is.Nil(t, err)
+	ok, err = tx.Get("tbl_test", got)
+	is.Nil(t, err)
+	is.True(t, ok)
+	is.Equal(t, int64(5), got.Get("a").I64)
+	r.commit(tx)
+
+	// nulls sort first
+	vals := []Value{{Type: TYPE_NULL}, {Type: TYPE_INT64, I64: math.MinInt64}}
+	is.Less(t, string(encodeValues(nil, vals[:1])), string(encodeValues(nil, vals[1:])))
+	out := []Value{{Type: TYPE_INT64}, {Type: TYPE_INT64}}
+	is.Nil(t, decodeValues(encodeValues(nil, vals), out))
+	is.Equal(t, vals, out)
+}
+
+func TestTableFloat64(t *testing.T) {
+	input := []float64{
+		math.Inf(-1), -math.MaxFloat64, -1.5, -math.SmallestNonzeroFloat64,
+		math.Copysign(0, -1), 0, math.SmallestNonzeroFloat64, 1, 1.5,
+		math.MaxFloat64, math.Inf(1),
+	}
+	encoded := []string{}
+	for _, f := range input {
+		b := encodeValues(nil, []Value{{Type: TYPE_FLOAT64, F64: f}})
+		out := []Value{{Type: TYPE_FLOAT64}}
+		is.Nil(t, decodeValues(b, out))
+		is.Equal(t, math.Float64bits(f), math.Float64bits(out[0].F64))
+		encoded = append(encoded, string(b))
+	}
+	is.True(t, sort.StringsAreSorted(encoded))
+
+	r := newR()
+	defer r.dispose()
+	r.create(&TableDef{
+		Name:    "tbl_test",
+		Cols:    []string{"k", "v"},
+		Types:   []uint32{TYPE_FLOAT64, TYPE_INT64},
+		Indexes: [][]string{{"k"}},
+	})
+	ref := []float64{}
+	for i := int64(0); i < 100; i++ {
+		k := float64(int32(fmix32(uint32(i)))) / 1000
+		rec := Record{}
+		rec.AddFloat64("k", k).AddInt64("v", i)
+		r.add("tbl_test", rec)
+		ref = append(ref, k)
+	}
+	slices.Sort(ref)
+
+	tx := r.begin()
+	nan := Record{}
+	nan.AddFloat64("k", math.NaN()).AddInt64("v", 0)
+	_, err := tx.Insert("tbl_test", &nan)
+	is.ErrorContains(t, err, "NaN")
+
+	scan := func(lo float64, hi float64) (got []float64) {
+		sc := Scanner{
+			Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE,
+			Key1: *(&Record{}).AddFloat64("k", lo),
+			Key2: *(&Record{}).AddFloat64("k", hi),
+		}
+		is.Nil(t, tx.Scan("tbl_test", &sc))
+		for ; sc.Valid(); sc.Next() {
+			rec := Record{}
+			is.Nil(t, sc.Deref(&rec))
+			got = append(got, rec.Get("k").F64)
+		}
+		return got
+	}
+	is.Equal(t, ref, scan(math.Inf(-1), math.Inf(1)))
+	want := []float64{}
+	for _, f := range ref {
+		if -1e6 <= f && f <= 1e6 {
+			want = append(want, f)
+		}
+	}
+	is.NotEmpty(t, want)
+	is.Equal(t, want, scan(-1e6, 1e6))
+
+	sc := Scanner{
+		Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE,
+		Key1: *(&Record{}).AddFloat64("k", math.NaN()),
+		Key2: *(&Record{}).AddFloat64("k", 0),
+	}
+	is.NotNil(t, tx.Scan("tbl_test", &sc))
+	r.commit(tx)
+}
+
+func TestTableBool(t *testing.T) {
+	f := encodeValues(nil, []Value{{Type: TYPE_BOOL, I64: 0}})
+	tr := encodeValues(nil, []Value{{Type: TYPE_BOOL, I64: 1}})
+	is.Equal(t, 2, len(f))
+	is.Less(t, string(f), string(tr))
+	err := decodeValues([]byte{TYPE_BOOL, 2}, []Value{{Type: TYPE_BOOL}})
+	is.ErrorIs(t, err, ErrCorrupt)
+
+	r := newR()
+	defer r.dispose()
+	tdef := &TableDef{
+		Name:    "tbl_test",
+		Cols:    []string{"flag", "id", "done"},
+		Types:   []uint32{TYPE_BOOL, TYPE_INT64, TYPE_BOOL},
+		Indexes: [][]string{{"flag", "id"}, {"done"}},
+	}
+	r.create(tdef)
+
+	// the schema round-trips through @table
+	tx := r.begin()
+	stored, err := getTableDefDB(tx, "tbl_test")
+	is.Nil(t, err)
+	is.Equal(t, tdef.Types, stored.Types)
+	r.commit(tx)
+
+	for i := int64(0); i < 10; i++ {
+		rec := Record{}
+		rec.AddBool("flag", i%2 == 0).AddInt64("id", i).AddBool("done", i%3 == 0)
+		r.add("tbl_test", rec)
+	}
+
+	tx = r.begin()
+	bad := Record{}
+	bad.AddBool("flag", true).AddInt64("id", 100)
+	bad.Vals = append(bad.Vals, Value{Type: TYPE_BOOL, I64: 2})
+	bad.Cols = append(bad.Cols, "done")
+	_, err = tx.Insert("tbl_test", &bad)
+	is.ErrorContains(t, err, "bad bool")
+
+	scan := func(col string, val bool) (ids []int64) {
+		key := *(&Record{}).AddBool(col, val)
+		sc := Scanner{
+			Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE,
+			Key1: key, Key2: key,
+		}
+		is.Nil(t, tx.Scan("tbl_test", &sc))
+		for ; sc.Valid(); sc.Next() {
+			rec := Record{}
+			is.Nil(t, sc.Deref(&rec))
+			is.Equal(t, val, rec.Get(col).Bool())
+			ids = append(ids, rec.Get("id").I64)
+		}
+		return ids
+	}
+	is.Equal(t, []int64{1, 3, 5, 7, 9}, scan("flag", false))
+	is.Equal(t, []int64{0, 2, 4, 6, 8}, scan("flag", true))
+	is.Equal(t, []int64{3, 9, 0, 6}, scan("done", true)) // sorted by the PK
+	r.commit(tx)
+}
+
+func TestTableTimestamp(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	r.create(&TableDef{
+		Name:    "tbl_test",
+		Cols:    []string{"ts", "v"},
+		Types:   []uint32{TYPE_TIMESTAMP, TYPE_INT64},
+		Indexes: [][]string{{"ts"}},
+	})
+
+	base := time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)
+	ref := []time.Time{}
+	for i := int64(-50); i < 50; i++ {
+		ts := base.Add(time.Duration(i) * 1000 * time.Hour)
+		rec := Record{}
+		rec.AddTime("ts", ts).AddInt64("v", i)
+		r.add("tbl_test", rec)
+		ref = append(ref, ts)
+	}
+
+	tx := r.begin()
+	// INT64 is a different type
+	bad := Record{}
+	bad.AddInt64("ts", 1).AddInt64("v", 1)
+	_, err := tx.Insert("tbl_test", &bad)
+	is.ErrorContains(t, err, "bad column type")
+
+	lo, hi := ref[10], ref[60]
+	sc := Scanner{
+		Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LT,
+		Key1: *(&Record{}).AddTime("ts", lo),
+		Key2: *(&Record{}).AddTime("ts", hi),
+	}
+	is.Nil(t, tx.Scan("tbl_test", &sc))
+	got := []time.Time{}
+	for ; sc.Valid(); sc.Next() {
+		rec := Record{}
+		is.Nil(t, sc.Deref(&rec))
+		got = append(got, rec.Get("ts").Time())
+	}
+	is.Equal(t, ref[10:60], got)
+	is.True(t, got[0].Before(base))
+	r.commit(tx)
+}
+
+func TestTableLargeValue(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	r.create(&TableDef{
+		Name:    "tbl_test",
+		Cols:    []string{"k", "v"},
+		Types:   []uint32{TYPE_BYTES, TYPE_BYTES},
+		Indexes: [][]string{{"k"}},
+	})
+
+	big := func(seed int) []byte {
+		b := make([]byte, 1<<20)
+		for i := range b {
+			b[i] = byte(fmix32(uint32(seed + i)))
+		}
+		return b
+	}
+	upsert := func(v []byte) {
+		tx := r.begin()
+		rec := Record{}
+		rec.AddStr("k", []byte("blob")).AddStr("v", v)
+		_, err := tx.Upsert("tbl_test", rec)
+		is.Nil(t, err)
+		r.commit(tx)
+	}
+	get := func() []byte {
+		tx := r.begin()
+		defer r.commit(tx)
+		rec := (&Record{}).AddStr("k", []byte("blob"))
+		ok, err := tx.Get("tbl_test", rec)
+		is.Nil(t, err)
+		if !ok {
+			return nil
+		}
+		return rec.Get("v").Str
+	}
+	del := func() {
+		tx := r.begin()
+		rec := Record{}
+		rec.AddStr("k", []byte("blob"))
+		ok, err := tx.Delete("tbl_test", rec)
+		is.Nil(t, err)
+		is.True(t, ok)
+		r.commit(tx)
+	}
+
+	v1, v2 := big(1), big(2)
+	upsert(v1)
+	is.Equal(t, v1, get())
+	upsert(v2)
+	is.Equal(t, v2, get())
+	del()
+	is.Nil(t, get())
+
+	// the overflow pages are reused instead of growing the file
+	upsert(v1)
+	pages := r.db.kv.page.flushed
+	for i := 0; i < 4; i++ {
+		upsert(big(i + 3))
+		del()
+		upsert(v1)
+	}
+	is.Equal(t, v1, get())
+	is.Less(t, r.db.kv.page.flushed, pages+pages/2)
+
+	// also readable after reopening
+	r.db.Close()
+	r.db = DB{Path: r.db.Path}
+	is.Nil(t, r.db.Open())
+	is.Equal(t, v1, get())
+}
+
+func TestTablePartialUpdate(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	r.create(&TableDef{
+		Name:    "tbl_test",
+		Cols:    []string{"k", "a", "b", "c"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES, TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"k"}, {"b"}},
+	})
+	rec := Record{}
+	rec.AddInt64("k", 1).AddStr("a", []byte("x"))
+	rec.AddInt64("b", 2).AddStr("c", []byte("z"))
+	r.add("tbl_test", rec)
+
+	set := func(rec Record) (*DBUpdateReq, error) {
+		tx := r.begin()
+		defer r.commit(tx)
+		dbreq := &DBUpdateReq{Record: rec, Partial: true}
+		_, err := tx.Set("tbl_test", dbreq)
+		return dbreq, err
+	}
+
+	// the middle column changes, the others survive
+	dbreq, err := set(*(&Record{}).AddInt64("k", 1).AddInt64("b", 5))
+	is.Nil(t, err)
+	is.True(t, dbreq.Updated)
+	is.False(t, dbreq.Added)
+	dbreq, err = set(*(&Record{}).AddInt64("k", 1).AddInt64("b", 5))
+	is.Nil(t, err)
+	is.False(t, dbreq.Updated)
+
+	tx := r.begin()
+	got := (&Record{}).AddInt64("k", 1)
+	ok, err := tx.Get("tbl_test", got)
+	is.Nil(t, err)
+	is.True(t, ok)
+	is.Equal(t, "x", string(got.Get("a").Str))
+	is.Equal(t, int64(5), got.Get("b").I64)
+	is.Equal(t, "z", string(got.Get("c").Str))
+	// the index follows
+	sc := Scanner{
+		Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE,
+		Key1: *(&Record{}).AddInt64("b", 5),
+		Key2: *(&Record{}).AddInt64("b", 5),
+	}
+	is.Nil(t, tx.Scan("tbl_test", &sc))
+	is.True(t, sc.Valid())
+	r.commit(tx)
+
+	// the row must exist; the primary key can't move it
+	_, err = set(*(&Record{}).AddInt64("k", 2).AddInt64("b", 5))
+	is.ErrorContains(t, err, "row not found")
+	_, err = set(*(&Record{}).AddInt64("k", 1).AddStr("b", nil))
+	is.ErrorContains(t, err, "bad column type")
+	_, err = set(*(&Record{}).AddInt64("k", 1).AddStr("d", nil))
+	is.ErrorContains(t, err, "unknown column")
+	_, err = set(*(&Record{}).AddStr("a", nil))
+	is.NotNil(t, err)
+}
+
+func TestTableIncrement(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	r.create(&TableDef{
+		Name:    "tbl_test",
+		Cols:    []string{"k", "n", "s"},
+		Types:   []uint32{TYPE_BYTES, TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"k"}, {"n"}},
+	})
+	rec := Record{}
+	rec.AddStr("k", []byte("a")).AddInt64("n", 1).AddStr("s", []byte("x"))
+	r.add("tbl_test", rec)
+
+	key := *(&Record{}).AddStr("k", []byte("a"))
+	tx := r.begin()
+	n, err := tx.Increment("tbl_test", key, "n", 10)
+	is.Nil(t, err)
+	is.Equal(t, int64(11), n)
+	n, err = tx.Increment("tbl_test", key, "n", -20)
+	is.Nil(t, err)
+	is.Equal(t, int64(-9), n)
+	r.commit(tx)
+
+	tx = r.begin()
+	got := (&Record{}).AddStr("k", []byte("a"))
+	_, err = tx.Get("tbl_test", got)
+	is.Nil(t, err)
+	is.Equal(t, int64(-9), got.Get("n").I64)
+	is.Equal(t, "x", string(got.Get("s").Str))
+	// the secondary index is updated
+	sc := Scanner{
+		Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE,
+		Key1: *(&Record{}).AddInt64("n", -9),
+		Key2: *(&Record{}).AddInt64("n", -9),
+	}
+	is.Nil(t, tx.Scan("tbl_test", &sc))
+	is.True(t, sc.Valid())
+
+	_, err = tx.Increment("tbl_test", *(&Record{}).AddStr("k", []byte("b")), "n", 1)
+	is.ErrorContains(t, err, "row not found")
+	_, err = tx.Increment("tbl_test", key, "k", 1)
+	is.ErrorContains(t, err, "primary key")
+	_, err = tx.Increment("tbl_test", key, "s", 1)
+	is.ErrorContains(t, err, "bad column type")
+
+	// overflow is an error and changes nothing
+	_, err = tx.Increment("tbl_test", key, "n", math.MinInt64)
+	is.ErrorContains(t, err, "overflow")
+	n, err = tx.Increment("tbl_test", key, "n", math.MaxInt64)
+	is.Nil(t, err)
+	is.Equal(t, int64(math.MaxInt64-9), n)
+	_, err = tx.Increment("tbl_test", key, "n", 10)
+	is.ErrorContains(t, err, "overflow")
+	n, err = tx.Increment("tbl_test", key, "n", 0)
+	is.Nil(t, err)
+	is.Equal(t, int64(math.MaxInt64-9), n)
+	r.commit(tx)
+}
+
+func TestTableConditionalUpdate(t *testing.T) {
+	is.True(t, (&Value{Type: TYPE_BYTES, Str: []byte("a")}).Equal(&Value{Type: TYPE_BYTES, Str: []byte("a")}))
+	is.False(t, (&Value{Type: TYPE_BYTES, Str: []byte("a")}).Equal(&Value{Type: TYPE_BYTES, Str: []byte("b")}))
+	is.True(t, (&Value{Type: TYPE_INT64, I64: 1}).Equal(&Value{Type: TYPE_INT64, I64: 1}))
+	is.False(t, (&Value{Type: TYPE_INT64, I64: 1}).Equal(&Value{Type: TYPE_INT64, I64: 2}))
+	is.False(t, (&Value{Type: TYPE_INT64, I64: 1}).Equal(&Value{Type: TYPE_TIMESTAMP, I64: 1}))
+
+	r := newR()
+	defer r.dispose()
+	r.create(&TableDef{
+		Name:    "tbl_test",
+		Cols:    []string{"k", "ver", "v"},
+		Types:   []uint32{TYPE_BYTES, TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"k"}},
+	})
+	rec := Record{}
+	rec.AddStr("k", []byte("a")).AddInt64("ver", 1).AddStr("v", []byte("x"))
+	r.add("tbl_test", rec)
+
+	cas := func(ver int64, next int64) (*DBUpdateReq, error) {
+		tx := r.begin()
+		defer r.commit(tx)
+		rec := Record{}
+		rec.AddStr("k", []byte("a")).AddInt64("ver", next).AddStr("v", []byte("y"))
+		dbreq := &DBUpdateReq{Record: rec}
+		dbreq.Expected.AddInt64("ver", ver)
+		_, err := tx.Set("tbl_test", dbreq)
+		return dbreq, err
+	}
+
+	// a stale expectation fails with the current row
+	dbreq, err := cas(0, 1)
+	is.ErrorIs(t, err, ErrConflict)
+	cerr := &ConflictError{}
+	is.ErrorAs(t, err, &cerr)
+	is.Equal(t, int64(1), cerr.Current.Get("ver").I64)
+	is.Equal(t, "x", string(cerr.Current.Get("v").Str))
+	is.False(t, dbreq.Updated)
+
+	dbreq, err = cas(1, 2)
+	is.Nil(t, err)
+	is.True(t, dbreq.Updated)
+	_, err = cas(1, 2)
+	is.ErrorIs(t, err, ErrConflict)
+
+	// a missing row is a conflict too
+	tx := r.begin()
+	rec = Record{}
+	rec.AddStr("k", []byte("b")).AddInt64("ver", 1).AddStr("v", []byte("y"))
+	dbreq = &DBUpdateReq{Record: rec}
+	dbreq.Expected.AddStr("v", []byte("y"))
+	_, err = tx.Set("tbl_test", dbreq)
+	is.ErrorAs(t, err, &cerr)
+	is.Empty(t, cerr.Current.Cols)
+	r.commit(tx)
+}
+
+func TestTableDeleteRange(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	tdef := &TableDef{
+		Name:    "tbl_test",
+		Cols:    []string{"k", "v"},
+		Types:   []uint32{TYPE_INT64, TYPE_INT64},
+		Indexes: [][]string{{"k"}, {"v"}},
+	}
+	r.create(tdef)
+	for i := int64(0); i < 20; i++ {
+		rec := Record{}
+		rec.AddInt64("k", i).AddInt64("v", -i)
+		r.add("tbl_test", rec)
+	}
+	key := func(k int64) Record {
+		return *(&Record{}).AddInt64("k", k)
+	}
+
+	tx := r.begin()
+	n, err := tx.DeleteRange("tbl_test", key(5), key(10), btree_iter.CMP_GE, btree_iter.CMP_LT)
+	is.Nil(t, err)
+	is.Equal(t, int64(5), n)
+	n, err = tx.DeleteRange("tbl_test", key(15), key(12), btree_iter.CMP_LE, btree_iter.CMP_GT)
+	is.Nil(t, err)
+	is.Equal(t, int64(3), n)
+	n, err = tx.DeleteRange("tbl_test", key(5), key(10), btree_iter.CMP_GE, btree_iter.CMP_LE)
+	is.Nil(t, err)
+	is.Equal(t, int64(1), n) // only 10 is left
+	n, err = tx.DeleteRange("tbl_test", key(100), key(200), btree_iter.CMP_GE, btree_iter.CMP_LE)
+	is.Nil(t, err)
+	is.Equal(t, int64(0), n)
+	v := *(&Record{}).AddInt64("v", 0)
+	_, err = tx.DeleteRange("tbl_test", v, v, btree_iter.CMP_GE, btree_iter.CMP_LE)
+	is.NotNil(t, err)
+	r.commit(tx)
+
+	tx = r.begin()
+	left := []int64{}
+	sc := Scanner{Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE}
+	is.Nil(t, tx.Scan("tbl_test", &sc))
+	for ; sc.Valid(); sc.Next() {
+		rec := Record{}
+		is.Nil(t, sc.Deref(&rec))
+		left = append(left, rec.Get("k").I64)
+	}
+	is.Equal(t, []int64{0, 1, 2, 3, 4, 11, 12, 16, 17, 18, 19}, left)
+	// the index entries are gone too
+	is.Equal(t, len(left), len(rawKeys(tx, tdef.Prefixes[1])))
+	r.commit(tx)
+}
+
+func TestTableInsertBatch(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	tdef := &TableDef{
+		Name:    "tbl_test",
+		Cols:    []string{"k", "v"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"k"}, {"v"}},
+	}
+	r.create(tdef)
+	row := func(k int64, v string) Record {
+		return *(&Record{}).AddInt64("k", k).AddStr("v", []byte(v))
+	}
+
+	tx := r.begin()
+	old := row(5, "old")
+	_, err := tx.Insert("tbl_test", &old)
+	is.Nil(t, err)
+	recs := []Record{}
+	for i := int64(9); i >= 0; i-- {
+		recs = append(recs, row(i, "new"))
+	}
+	recs = append(recs, row(3, "dup"))
+	n, err := tx.InsertBatch("tbl_test", recs)
+	is.Nil(t, err)
+	is.Equal(t, 9, n) // 5 exists, 3 is repeated
+
+	// an invalid record fails the whole batch
+	bad := []Record{row(20, "a"), *(&Record{}).AddInt64("k", 21)}
+	_, err = tx.InsertBatch("tbl_test", bad)
+	is.ErrorContains(t, err, "record 1")
+	r.commit(tx)
+
+	tx = r.begin()
+	got := []string{}
+	sc := Scanner{Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE}
+	is.Nil(t, tx.Scan("tbl_test", &sc))
+	for ; sc.Valid(); sc.Next() {
+		rec := Record{}
+		is.Nil(t, sc.Deref(&rec))
+		got = append(got, fmt.Sprintf("%d:%s", rec.Get("k").I64, rec.Get("v").Str))
+	}
+	is.Equal(t, []string{
+		"0:new", "1:new", "2:new", "3:new", "4:new",
+		"5:old", "6:new", "7:new", "8:new", "9:new",
+	}, got)
+	is.Equal(t, 10, len(rawKeys(tx, tdef.Prefixes[1])))
+	r.commit(tx)
+}
+
+func benchmarkInsert(b *testing.B, batch bool) {
+	r := newR()
+	defer r.dispose()
+	r.create(&TableDef{
+		Name:    "tbl_test",
+		Cols:    []string{"k", "v"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"k"}},
+	})
+	const size = 1000
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		recs := []Record{}
+		for j := 0; j < size; j++ {
+			k := int64(fmix32(uint32(i*size + j)))
+			recs = append(recs, *(&Record{}).AddInt64("k", k).AddStr("v", []byte("v")))
+		}
+		if batch {
+			tx := r.begin()
+			_, err := tx.InsertBatch("tbl_test", recs)
+			assert(err == nil)
+			r.commit(tx)
+		} else {
+			for j := range recs {
+				tx := r.begin()
+				_, err := tx.Insert("tbl_test", &recs[j])
+				assert(err == nil)
+				r.commit(tx)
+			}
+		}
+	}
+}
+
+func BenchmarkInsertBatch(b *testing.B) { benchmarkInsert(b, true) }
+func BenchmarkInsertLoop(b *testing.B)  { benchmarkInsert(b, false) }
+
+func TestTableMultiGet(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	r.create(&TableDef{
+		Name:    "tbl_test",
+		Cols:    []string{"k", "v"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"k"}},
+	})
+	for i := int64(0); i < 100; i += 2 {
+		rec := Record{}
+		rec.AddInt64("k", i).AddStr("v", []byte(fmt.Sprint(i*i)))
+		r.add("tbl_test", rec)
+	}
+
+	tx := r.begin()
+	// the pending writes are visible
+	_, err := tx.Insert("tbl_test", (&Record{}).AddInt64("k", 51).AddStr("v", []byte("new")))
+	is.Nil(t, err)
+	_, err = tx.Delete("tbl_test", *(&Record{}).AddInt64("k", 40))
+	is.Nil(t, err)
+
+	ks := []int64{98, 3, 0, 51, 40, 10, 10, 200, -1}
+	recs := []*Record{}
+	for _, k := range ks {
+		recs = append(recs, (&Record{}).AddInt64("k", k))
+	}
+	found, err := tx.MultiGet("tbl_test", recs)
+	is.Nil(t, err)
+	is.Equal(t, []bool{true, false, true, true, false, true, true, false, false}, found)
+	is.Equal(t, "9604", string(recs[0].Get("v").Str))
+	is.Equal(t, "0", string(recs[2].Get("v").Str))
+	is.Equal(t, "new", string(recs[3].Get("v").Str))
+	is.Equal(t, "100", string(recs[6].Get("v").Str))
+	is.Nil(t, recs[1].Get("v"))
+
+	recs = []*Record{(&Record{}).AddInt64("k", 1), (&Record{}).AddStr("k", nil)}
+	_, err = tx.MultiGet("tbl_test", recs)
+	is.ErrorContains(t, err, "record 1")
+	found, err = tx.MultiGet("tbl_test", nil)
+	is.Nil(t, err)
+	is.Empty(t, found)
+	r.commit(tx)
+
+	// only the keys are read, not the rows between them
+	tx = r.begin()
+	found, err = tx.MultiGet("tbl_test", []*Record{(&Record{}).AddInt64("k", 0), (&Record{}).AddInt64("k", 98)})
+	is.Nil(t, err)
+	is.Equal(t, []bool{true, true}, found)
+	other := r.begin()
+	_, err = other.Insert("tbl_test", (&Record{}).AddInt64("k", 53).AddStr("v", []byte("x")))
+	is.Nil(t, err)
+	r.commit(other)
+	_, err = tx.Insert("tbl_test", (&Record{}).AddInt64("k", 55).AddStr("v", []byte("y")))
+	is.Nil(t, err)
+	is.Nil(t, r.db.Commit(tx))
+}
+
+// a few keys far apart in a large table
+func BenchmarkMultiGetSparse(b *testing.B) {
+	r := newR()
+	defer r.dispose()
+	r.create(&TableDef{
+		Name:    "tbl_test",
+		Cols:    []string{"k", "v"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"k"}},
+	})
+	const size = 100000
+	tx := r.begin()
+	for i := int64(0); i < size; i++ {
+		_, err := tx.Insert("tbl_test", (&Record{}).AddInt64("k", i).AddStr("v", []byte("v")))
+		assert(err == nil)
+	}
+	r.commit(tx)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		recs := []*Record{}
+		for _, k := range []int64{size - 1, 0, size / 2, size - 2} {
+			recs = append(recs, (&Record{}).AddInt64("k", k))
+		}
+		tx := r.begin()
+		found, err := tx.MultiGet("tbl_test", recs)
+		assert(err == nil && !slices.Contains(found, false))
+		r.db.Abort(tx)
+	}
+}
+
+func TestTableScanLimitOffset(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	r.create(&TableDef{
+		Name:    "tbl_test",
+		Cols:    []string{"k", "v"},
+		Types:   []uint32{TYPE_INT64, TYPE_INT64},
+		Indexes: [][]string{{"k"}, {"v"}},
+	})
+	for i := int64(0); i < 10; i++ {
+		rec := Record{}
+		rec.AddInt64("k", i).AddInt64("v", -i)
+		r.add("tbl_test", rec)
+	}
+
+	tx := r.begin()
+	defer r.commit(tx)
+	scan := func(sc Scanner) (got []int64) {
+		is.Nil(t, tx.Scan("tbl_test", &sc))
+		for ; sc.Valid(); sc.Next() {
+			rec := Record{}
+			is.Nil(t, sc.Deref(&rec))
+			got = append(got, rec.Get("k").I64)
+		}
+		return got
+	}
+	fwd := Scanner{
+		Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LT,
+		Key1: *(&Record{}).AddInt64("k", 2), Key2: *(&Record{}).AddInt64("k", 8),
+	}
+	rev := Scanner{
+		Cmp1: btree_iter.CMP_LE, Cmp2: btree_iter.CMP_GT,
+		Key1: *(&Record{}).AddInt64("k", 8), Key2: *(&Record{}).AddInt64("k", 2),
+	}
+	with := func(sc Scanner, offset int, limit int) Scanner {
+		sc.Offset, sc.Limit = offset, limit
+		return sc
+	}
+
+	is.Equal(t, []int64{2, 3, 4, 5, 6, 7}, scan(fwd))
+	is.Equal(t, []int64{4, 5, 6}, scan(with(fwd, 2, 3)))
+	is.Equal(t, []int64{6, 5, 4}, scan(with(rev, 2, 3)))
+	is.Equal(t, []int64{8, 7}, scan(with(rev, 0, 2)))
+	is.Equal(t, []int64{6, 7}, scan(with(fwd, 4, 100))) // limit past the end
+	is.Empty(t, scan(with(fwd, 6, 1)))                  // offset past the end
+	is.Empty(t, scan(with(rev, 100, 0)))
+
+	// secondary indexes too
+	idx := Scanner{
+		Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE,
+		Key1: *(&Record{}).AddInt64("v", -100), Key2: *(&Record{}).AddInt64("v", 100),
+		Offset: 1, Limit: 2,
+	}
+	is.Equal(t, []int64{8, 7}, scan(idx))
+
+	bad := with(fwd, -1, 0)
+	is.NotNil(t, tx.Scan("tbl_test", &bad))
+}
+
+func TestTableProjection(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	r.create(&TableDef{
+		Name:    "tbl_test",
+		Cols:    []string{"k", "a", "b", "c", "d"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES, TYPE_INT64, TYPE_BYTES, TYPE_FLOAT64},
+		Indexes: [][]string{{"k"}, {"b"}},
+	})
+	for i := int64(0); i < 5; i++ {
+		rec := Record{}
+		rec.AddInt64("k", i).AddStr("a", []byte("a\x00\x01")).AddInt64("b", -i)
+		rec.AddStr("c", []byte(fmt.Sprint("c", i))).AddFloat64("d", 0.5)
+		r.add("tbl_test", rec)
+	}
+
+	tx := r.begin()
+	defer r.commit(tx)
+	scan := func(sc Scanner) (got []Record) {
+		is.Nil(t, tx.Scan("tbl_test", &sc))
+		for ; sc.Valid(); sc.Next() {
+			rec := Record{}
+			is.Nil(t, sc.Deref(&rec))
+			got = append(got, rec)
+		}
+		return got
+	}
+	want := func(k int64) Record {
+		rec := Record{}
+		rec.AddStr("c", []byte(fmt.Sprint("c", k))).AddInt64("k", k)
+		return rec
+	}
+
+	cols := []string{"c", "k"}
+	pk := Scanner{
+		Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE,
+		Key1: *(&Record{}).AddInt64("k", 1), Key2: *(&Record{}).AddInt64("k", 2),
+		Cols: cols,
+	}
+	is.Equal(t, []Record{want(1), want(2)}, scan(pk))
+	idx := Scanner{
+		Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE,
+		Key1: *(&Record{}).AddInt64("b", -4), Key2: *(&Record{}).AddInt64("b", -3),
+		Cols: cols,
+	}
+	is.Equal(t, []Record{want(4), want(3)}, scan(idx))
+
+	got := (&Record{}).AddInt64("k", 3)
+	ok, err := tx.GetCols("tbl_test", got, []string{"d", "a"})
+	is.Nil(t, err)
+	is.True(t, ok)
+	is.Equal(t, []string{"d", "a"}, got.Cols)
+	is.Equal(t, 0.5, got.Vals[0].F64)
+	is.Equal(t, "a\x00\x01", string(got.Vals[1].Str))
+
+	bad := pk
+	bad.Cols = []string{"k", "nope"}
+	is.ErrorContains(t, tx.Scan("tbl_test", &bad), "unknown column")
+	bad.Cols = []string{"k", "k"}
+	is.NotNil(t, tx.Scan("tbl_test", &bad))
+}
+
+func TestTablePrefixScan(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	r.create(&TableDef{
+		Name:    "tbl_test",
+		Cols:    []string{"user", "ts", "v"},
+		Types:   []uint32{TYPE_BYTES, TYPE_INT64, TYPE_INT64},
+		Indexes: [][]string{{"user", "ts"}},
+	})
+	for _, user := range []string{"a", "b", "bb", "c"} {
+		for ts := int64(-2); ts <= 2; ts++ {
+			rec := Record{}
+			rec.AddStr("user", []byte(user)).AddInt64("ts", ts).AddInt64("v", 0)
+			r.add("tbl_test", rec)
+		}
+	}
+
+	tx := r.begin()
+	defer r.commit(tx)
+	scan := func(cmp1 int, cmp2 int, key1 Record, key2 Record) (got []string) {
+		sc := Scanner{Cmp1: cmp1, Cmp2: cmp2, Key1: key1, Key2: key2}
+		is.Nil(t, tx.Scan("tbl_test", &sc))
+		for ; sc.Valid(); sc.Next() {
+			rec := Record{}
+			is.Nil(t, sc.Deref(&rec))
+			got = append(got, fmt.Sprintf("%s%d", rec.Get("user").Str, rec.Get("ts").I64))
+		}
+		return got
+	}
+	user := func(u string) Record {
+		return *(&Record{}).AddStr("user", []byte(u))
+	}
+
+	// every row of one user, in both directions
+	b := []string{"b-2", "b-1", "b0", "b1", "b2"}
+	is.Equal(t, b, scan(btree_iter.CMP_GE, btree_iter.CMP_LE, user("b"), user("b")))
+	rb := slices.Clone(b)
+	slices.Reverse(rb)
+	is.Equal(t, rb, scan(btree_iter.CMP_LE, btree_iter.CMP_GE, user("b"), user("b")))
+
+	// exclusive bounds skip the whole prefix
+	got := scan(btree_iter.CMP_GT, btree_iter.CMP_LT, user("a"), user("c"))
+	is.Equal(t, 10, len(got))
+	is.Equal(t, "b-2", got[0])
+	is.Equal(t, "bb2", got[9])
+
+	// a prefix and a full key
+	full := *(&Record{}).AddStr("user", []byte("bb")).AddInt64("ts", 0)
+	is.Equal(t, []string{"bb0", "bb-1", "bb-2"},
+		scan(btree_iter.CMP_LE, btree_iter.CMP_GE, full, user("bb")))
+
+	// only leading columns make a prefix
+	ts := *(&Record{}).AddInt64("ts", 0)
+	sc := Scanner{Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE, Key1: ts, Key2: ts}
+	is.ErrorContains(t, tx.Scan("tbl_test", &sc), "no index for columns")
+}
+
+func TestTableScanFilter(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	r.create(&TableDef{
+		Name:    "tbl_test",
+		Cols:    []string{"k", "v", "s"},
+		Types:   []uint32{TYPE_INT64, TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"k"}, {"v"}},
+	})
+	for i := int64(0); i < 20; i++ {
+		rec := Record{}
+		rec.AddInt64("k", i).AddInt64("v", -i).AddStr("s", []byte(fmt.Sprint(i%3)))
+		r.add("tbl_test", rec)
+	}
+
+	tx := r.begin()
+	defer r.commit(tx)
+	scan := func(sc Scanner) (got []int64) {
+		is.Nil(t, tx.Scan("tbl_test", &sc))
+		for ; sc.Valid(); sc.Next() {
+			rec := Record{}
+			is.Nil(t, sc.Deref(&rec))
+			got = append(got, rec.Get("k").I64)
+		}
+		return got
+	}
+	zero := func(rec *Record) bool { return string(rec.Get("s").Str) == "0" }
+	all := Scanner{
+		Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE,
+		Key1: *(&Record{}).AddInt64("k", 0), Key2: *(&Record{}).AddInt64("k", 100),
+		Filter: zero,
+	}
+	is.Equal(t, []int64{0, 3, 6, 9, 12, 15, 18}, scan(all))
+
+	// limit and offset count the accepted rows
+	sc := all
+	sc.Offset, sc.Limit = 2, 3
+	is.Equal(t, []int64{6, 9, 12}, scan(sc))
+
+	// reverse, through a secondary index
+	rev := Scanner{
+		Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE,
+		Key1: *(&Record{}).AddInt64("v", -10), Key2: *(&Record{}).AddInt64("v", 0),
+		Filter: zero, Limit: 2,
+	}
+	is.Equal(t, []int64{9, 6}, scan(rev))
+
+	// the filter sees columns that are not projected
+	sc = all
+	sc.Cols = []string{"k"}
+	is.Nil(t, tx.Scan("tbl_test", &sc))
+	rec := Record{}
+	is.Nil(t, sc.Deref(&rec))
+	is.Equal(t, []string{"k"}, rec.Cols)
+
+	// rejecting everything ends the scan
+	sc = all
+	sc.Filter = func(*Record) bool { return false }
+	is.Empty(t, scan(sc))
+}
+
+func TestTableFilterExpr(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	r.create(&TableDef{
+		Name:     "tbl_test",
+		Cols:     []string{"k", "v", "s", "f", "b"},
+		Types:    []uint32{TYPE_INT64, TYPE_INT64, TYPE_BYTES, TYPE_FLOAT64, TYPE_BOOL},
+		Indexes:  [][]string{{"k"}},
+		Nullable: []bool{false, true, false, false, false},
+	})
+	for i := int64(0); i < 20; i++ {
+		rec := Record{}
+		rec.AddInt64("k", i)
+		if i%5 == 0 {
+			rec.AddNull("v")
+		} else {
+			rec.AddInt64("v", i*10)
+		}
+		rec.AddStr("s", []byte([]string{"apple", "apricot", "banana"}[i%3]))
+		rec.AddFloat64("f", float64(i)/2).AddBool("b", i%2 == 0)
+		r.add("tbl_test", rec)
+	}
+
+	tx := r.begin()
+	defer r.commit(tx)
+	scan := func(sc Scanner) (got []int64) {
+		is.Nil(t, tx.Scan("tbl_test", &sc))
+		for ; sc.Valid(); sc.Next() {
+			rec := Record{}
+			is.Nil(t, sc.Deref(&rec))
+			got = append(got, rec.Get("k").I64)
+		}
+		return got
+	}
+	all := Scanner{
+		Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE,
+		Key1: *(&Record{}).AddInt64("k", 0), Key2: *(&Record{}).AddInt64("k", 100),
+	}
+	for expr, expected := range map[string][]int64{
+		"k < 3 OR k >= 18":                         {0, 1, 2, 18, 19},
+		"v = NULL":                                 {0, 5, 10, 15},
+		"v != null and k < 4":                      {1, 2, 3},
+		"NOT v > 50 AND k < 8":                     {1, 2, 3, 4}, // a null is unknown, even under NOT
+		"NOT (v > 50 OR k > 7)":                    {1, 2, 3, 4},
+		"(NOT v > 50 OR v = NULL) AND k < 8":       {0, 1, 2, 3, 4, 5},
+		"NOT v = NULL AND k < 3":                   {1, 2},
+		"(v > 50 OR k = 0) AND k < 12":             {0, 6, 7, 8, 9, 11},
+		"s STARTS WITH 'ap' AND k >= 15":           {15, 16, 18, 19},
+		"f >= 9 AND b = TRUE":                      {18},
+		"f = 1":                                    {2},
+		`(k = 1 OR k = 2) AND NOT (s = "apricot")`: {2},
+		"b = 0 AND k < 4":                          {1, 3},
+		"k = -1":                                   nil,
+	} {
+		sc := all
+		is.Nil(t, sc.SetFilterExpr(expr))
+		is.Equal(t, expr, sc.FilterExpr())
+		is.Equal(t, expected, scan(sc), expr)
+	}
+
+	// with Filter, Offset and Limit
+	sc := all
+	is.Nil(t, sc.SetFilterExpr("v != NULL"))
+	sc.Filter = func(rec *Record) bool { return rec.Get("k").I64%2 == 0 }
+	sc.Offset, sc.Limit = 1, 3
+	is.Equal(t, []int64{4, 6, 8}, scan(sc))
+	sc.Filter, sc.Offset, sc.Limit = nil, 0, 0
+	n, err := tx.Count("tbl_test", &sc)
+	is.Nil(t, err)
+	is.Equal(t, int64(16), n)
+	is.Nil(t, sc.SetFilterExpr(""))
+	is.Equal(t, 20, len(scan(sc)))
+
+	// syntax errors, by SetFilterExpr
+	for expr, pos := range map[string]int{
+		"":                         -1,
+		"k <":                      3,
+		"k = 1 AND":                9,
+		"(k = 1":                   6,
+		"k == 1":                   3,
+		"k = 1 k":                  6,
+		"s = 'abc":                 4,
+		`s = 'a\q'`:                6,
+		"s STARTS 'a'":             9,
+		"s STARTS WITH 1":          14,
+		"v < NULL":                 4,
+		"k = 99999999999999999999": 4,
+		"= 1":                      0,
+	} {
+		err := sc.SetFilterExpr(expr)
+		if pos < 0 {
+			is.Nil(t, err)
+			continue
+		}
+		eerr := (*ExprError)(nil)
+		is.True(t, errors.As(err, &eerr), expr)
+		is.Equal(t, pos, eerr.Pos, expr)
+		is.Contains(t, err.Error(), fmt.Sprint("at position ", pos))
+	}
+	// columns and types, by the scan
+	for expr, pos := range map[string]int{
+		"nope = 1":                   0,
+		"k = 'x'":                    4,
+		"k = 1.5":                    4,
+		"b = 2":                      4,
+		"k = 1 OR f STARTS WITH 'x'": 23,
+	} {
+		sc := all
+		is.Nil(t, sc.SetFilterExpr(expr))
+		eerr := (*ExprError)(nil)
+		is.True(t, errors.As(tx.Scan("tbl_test", &sc), &eerr), expr)
+		is.Equal(t, pos, eerr.Pos, expr)
+	}
+
+	// checking a row doesn't allocate
+	sc = all
+	is.Nil(t, sc.SetFilterExpr(`(v > 10 OR v = NULL) AND s STARTS WITH "ap" AND NOT f < 1.5`))
+	is.Nil(t, tx.Scan("tbl_test", &sc))
+	rec := Record{}
+	is.Nil(t, sc.Deref(&rec))
+	is.Equal(t, []string{"k", "v", "s", "f", "b"}, rec.Cols)
+	is.Zero(t, testing.AllocsPerRun(100, func() { exprMatch(sc.prog, &rec) }))
+	sc.Close()
+}
+
+func TestTableAggregate(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	r.create(&TableDef{
+		Name:     "tbl_test",
+		Cols:     []string{"k", "v", "f", "s"},
+		Types:    []uint32{TYPE_INT64, TYPE_INT64, TYPE_FLOAT64, TYPE_BYTES},
+		Indexes:  [][]string{{"k"}, {"v"}},
+		Nullable: []bool{false, false, true, false},
+	})
+	for i := int64(0); i < 10; i++ {
+		rec := Record{}
+		rec.AddInt64("k", i).AddInt64("v", 5-i).AddStr("s", []byte(fmt.Sprint(i%4)))
+		if i%2 == 0 {
+			rec.AddFloat64("f", float64(i)/2)
+		} else {
+			rec.AddNull("f")
+		}
+		r.add("tbl_test", rec)
+	}
+
+	tx := r.begin()
+	defer r.commit(tx)
+	rng := func(cmp1 int, cmp2 int, k1 int64, k2 int64) *Scanner {
+		return &Scanner{
+			Cmp1: cmp1, Cmp2: cmp2,
+			Key1: *(&Record{}).AddInt64("k", k1), Key2: *(&Record{}).AddInt64("k", k2),
+		}
+	}
+	all := rng(btree_iter.CMP_GE, btree_iter.CMP_LE, 0, 100)
+
+	n, err := tx.Count("tbl_test", all)
+	is.Nil(t, err)
+	is.Equal(t, int64(10), n)
+	n, err = tx.Count("tbl_test", rng(btree_iter.CMP_LT, btree_iter.CMP_GE, 7, 2))
+	is.Nil(t, err)
+	is.Equal(t, int64(5), n)
+	sc := *all
+	sc.Filter = func(rec *Record) bool { return rec.Get("v").I64 > 0 }
+	n, err = tx.Count("tbl_test", &sc)
+	is.Nil(t, err)
+	is.Equal(t, int64(5), n)
+
+	sum, err := tx.Sum("tbl_test", "v", all)
+	is.Nil(t, err)
+	is.Equal(t, Value{Type: TYPE_INT64, I64: 5}, sum)
+	sum, err = tx.Sum("tbl_test", "f", all) // nulls are skipped
+	is.Nil(t, err)
+	is.Equal(t, Value{Type: TYPE_FLOAT64, F64: 10}, sum)
+
+	for _, sc := range []*Scanner{all, rng(btree_iter.CMP_LE, btree_iter.CMP_GE, 100, 0)} {
+		v, ok, err := tx.Min("tbl_test", "k", sc)
+		is.Nil(t, err)
+		is.True(t, ok)
+		is.Equal(t, int64(0), v.I64)
+		v, ok, err = tx.Max("tbl_test", "k", sc)
+		is.Nil(t, err)
+		is.True(t, ok)
+		is.Equal(t, int64(9), v.I64)
+		v, ok, err = tx.Min("tbl_test", "v", sc)
+		is.Nil(t, err)
+		is.True(t, ok)
+		is.Equal(t, int64(-4), v.I64)
+		v, ok, err = tx.Max("tbl_test", "s", sc)
+		is.Nil(t, err)
+		is.True(t, ok)
+		is.Equal(t, "3", string(v.Str))
+	}
+	// the leading column reads only one row, in either direction
+	for _, sc := range []*Scanner{all, rng(btree_iter.CMP_LE, btree_iter.CMP_GE, 100, 0)} {
+		read := 0
+		counted := *sc
+		counted.Filter = func(*Record) bool { read++; return true }
+		v, ok, err := tx.Max("tbl_test", "k", &counted)
+		is.True(t, ok && err == nil)
+		is.Equal(t, int64(9), v.I64)
+		is.Equal(t, 1, read)
+		read = 0
+		v, ok, err = tx.Min("tbl_test", "k", &counted)
+		is.True(t, ok && err == nil)
+		is.Equal(t, int64(0), v.I64)
+		is.Equal(t, 1, read)
+	}
+	v, ok, err := tx.Max("tbl_test", "f", rng(btree_iter.CMP_GE, btree_iter.CMP_LE, 0, 7))
+	is.Nil(t, err)
+	is.True(t, ok)
+	is.Equal(t, 3.0, v.F64)
+	_, ok, err = tx.Min("tbl_test", "f", rng(btree_iter.CMP_GE, btree_iter.CMP_LE, 3, 3))
+	is.Nil(t, err)
+	is.False(t, ok) // only null
+
+	_, err = tx.Sum("tbl_test", "s", all)
+	is.ErrorContains(t, err, "bad column type")
+	_, err = tx.Sum("tbl_test", "x", all)
+	is.ErrorContains(t, err, "unknown column")
+
+	big := Record{}
+	big.AddInt64("k", 100).AddInt64("v", math.MaxInt64).AddStr("s", nil).AddNull("f")
+	_, err = tx.Insert("tbl_test", &big)
+	is.Nil(t, err)
+	_, err = tx.Sum("tbl_test", "v", all)
+	is.ErrorContains(t, err, "integer overflow")
+}
+
+func TestTableScanToken(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	r.create(&TableDef{
+		Name:    "tbl_test",
+		Cols:    []string{"k", "v"},
+		Types:   []uint32{TYPE_INT64, TYPE_INT64},
+		Indexes: [][]string{{"k"}, {"v"}},
+	})
+	r.create(&TableDef{
+		Name:    "tbl_other",
+		Cols:    []string{"k"},
+		Types:   []uint32{TYPE_INT64},
+		Indexes: [][]string{{"k"}},
+	})
+	for i := int64(0); i < 10; i++ {
+		rec := Record{}
+		rec.AddInt64("k", i).AddInt64("v", -i)
+		r.add("tbl_test", rec)
+	}
+
+	// read a page and return the token for the next one
+	page := func(sc *Scanner) (got []int64, token []byte) {
+		for ; sc.Valid(); sc.Next() {
+			rec := Record{}
+			is.Nil(t, sc.Deref(&rec))
+			got = append(got, rec.Get("k").I64)
+		}
+		return got, sc.Token()
+	}
+	reopen := func() {
+		r.db.Close()
+		r.db = DB{Path: r.db.Path}
+		is.Nil(t, r.db.Open())
+	}
+
+	tx := r.begin()
+	sc := Scanner{
+		Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LT,
+		Key1: *(&Record{}).AddInt64("k", 1), Key2: *(&Record{}).AddInt64("k", 9),
+		Limit: 3,
+	}
+	is.Nil(t, tx.Scan("tbl_test", &sc))
+	got, token := page(&sc)
+	r.commit(tx)
+	is.Equal(t, []int64{1, 2, 3}, got)
+
+	reopen()
+	tx = r.begin()
+	sc = Scanner{Limit: 3}
+	is.Nil(t, tx.ScanResume("tbl_test", token, &sc))
+	got, token = page(&sc)
+	is.Equal(t, []int64{4, 5, 6}, got)
+	r.commit(tx)
+
+	// the token row is deleted
+	r.del("tbl_test", *(&Record{}).AddInt64("k", 7))
+	reopen()
+	tx = r.begin()
+	sc = Scanner{}
+	is.Nil(t, tx.ScanResume("tbl_test", token, &sc))
+	got, token = page(&sc)
+	is.Equal(t, []int64{8}, got)
+	is.Nil(t, token)
+
+	// reverse through a secondary index
+	sc = Scanner{
+		Cmp1: btree_iter.CMP_LE, Cmp2: btree_iter.CMP_GE,
+		Key1: *(&Record{}).AddInt64("v", 0), Key2: *(&Record{}).AddInt64("v", -100),
+		Limit: 4,
+	}
+	is.Nil(t, tx.Scan("tbl_test", &sc))
+	got, token = page(&sc)
+	is.Equal(t, []int64{0, 1, 2, 3}, got)
+	sc = Scanner{Limit: 4}
+	is.Nil(t, tx.ScanResume("tbl_test", token, &sc))
+	got, _ = page(&sc)
+	is.Equal(t, []int64{4, 5, 6, 8}, got)
+
+	// tokens are bound to the table
+	sc = Scanner{}
+	is.ErrorContains(t, tx.ScanResume("tbl_other", token, &sc), "not from table")
+	is.NotNil(t, tx.ScanResume("tbl_test", token[:5], &sc))
+	r.commit(tx)
+}
+
+func TestTableFirstLast(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	r.create(&TableDef{
+		Name:    "tbl_test",
+		Cols:    []string{"user", "ts", "v"},
+		Types:   []uint32{TYPE_BYTES, TYPE_TIMESTAMP, TYPE_INT64},
+		Indexes: [][]string{{"user", "ts"}, {"v"}},
+	})
+
+	tx := r.begin()
+	rec := Record{}
+	ok, err := tx.First("tbl_test", &rec)
+	is.Nil(t, err)
+	is.False(t, ok) // empty table
+	ok, err = tx.Last("tbl_test", &rec)
+	is.Nil(t, err)
+	is.False(t, ok)
+	r.commit(tx)
+
+	base := time.Unix(1700000000, 0).UTC()
+	for i, user := range []string{"a", "b", "c"} {
+		for j := 0; j < 3; j++ {
+			rec := Record{}
+			rec.AddStr("user", []byte(user)).AddTime("ts", base.Add(time.Duration(j)*time.Hour))
+			rec.AddInt64("v", int64(i*3+j))
+			r.add("tbl_test", rec)
+		}
+	}
+
+	tx = r.begin()
+	defer r.commit(tx)
+	v := func(first bool, rec Record) int64 {
+		var ok bool
+		var err error
+		if first {
+			ok, err = tx.First("tbl_test", &rec)
+		} else {
+			ok, err = tx.Last("tbl_test", &rec)
+		}
+		is.Nil(t, err)
+		is.True(t, ok)
+		return rec.Get("v").I64
+	}
+	user := func(u string) Record {
+		return *(&Record{}).AddStr("user", []byte(u))
+	}
+	is.Equal(t, int64(0), v(true, Record{}))
+	is.Equal(t, int64(8), v(false, Record{}))
+	is.Equal(t, int64(3), v(true, user("b")))
+	is.Equal(t, int64(5), v(false, user("b")))
+
+	rec = user("bb")
+	ok, err = tx.Last("tbl_test", &rec)
+	is.Nil(t, err)
+	is.False(t, ok)
+	rec = *(&Record{}).AddInt64("v", 1)
+	_, err = tx.First("tbl_test", &rec)
+	is.ErrorContains(t, err, "not a primary key prefix")
+
+	// Desc flips the direction of a range given in ascending order
+	scan := func(sc Scanner) (got []int64) {
+		is.Nil(t, tx.Scan("tbl_test", &sc))
+		for ; sc.Valid(); sc.Next() {
+			rec := Record{}
+			is.Nil(t, sc.Deref(&rec))
+			got = append(got, rec.Get("v").I64)
+		}
+		return got
+	}
+	sc := Scanner{
+		Cmp1: btree_iter.CMP_GT, Cmp2: btree_iter.CMP_LE,
+		Key1: *(&Record{}).AddInt64("v", 2), Key2: *(&Record{}).AddInt64("v", 6),
+	}
+	is.Equal(t, []int64{3, 4, 5, 6}, scan(sc))
+	sc.Desc = true
+	is.Equal(t, []int64{6, 5, 4, 3}, scan(sc))
+	sc.Limit = 2
+	is.Equal(t, []int64{6, 5}, scan(sc))
+
+	// already descending
+	sc = Scanner{
+		Cmp1: btree_iter.CMP_LE, Cmp2: btree_iter.CMP_GE,
+		Key1: user("c"), Key2: user("c"), Desc: true,
+	}
+	is.Equal(t, []int64{8, 7, 6}, scan(sc))
+}
+
+func TestTableAbort(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	r.create(&TableDef{
+		Name:    "tbl_test",
+		Cols:    []string{"k", "v"},
+		Types:   []uint32{TYPE_INT64, TYPE_INT64},
+		Indexes: [][]string{{"k"}, {"v"}},
+	})
+	for i := int64(0); i < 5; i++ {
+		r.add("tbl_test", *(&Record{}).AddInt64("k", i).AddInt64("v", i))
+	}
+	r.db.Close()
+	before, err := os.ReadFile(r.db.Path)
+	is.Nil(t, err)
+	r.db = DB{Path: r.db.Path}
+	is.Nil(t, r.db.Open())
+
+	// schema and data in one transaction
+	tx := r.begin()
+	is.Nil(t, tx.TableNew(&TableDef{
+		Name:    "tbl_new",
+		Cols:    []string{"k"},
+		Types:   []uint32{TYPE_INT64},
+		Indexes: [][]string{{"k"}},
+	}))
+	_, err = tx.Insert("tbl_new", (&Record{}).AddInt64("k", 1))
+	is.Nil(t, err)
+	_, err = tx.Upsert("tbl_test", *(&Record{}).AddInt64("k", 1).AddInt64("v", 10))
+	is.Nil(t, err)
+	_, err = tx.Delete("tbl_test", *(&Record{}).AddInt64("k", 2))
+	is.Nil(t, err)
+
+	// its own writes are visible
+	rec := *(&Record{}).AddInt64("k", 1)
+	ok, err := tx.Get("tbl_new", &rec)
+	is.Nil(t, err)
+	is.True(t, ok)
+	rec = *(&Record{}).AddInt64("k", 1)
+	ok, err = tx.Get("tbl_test", &rec)
+	is.Nil(t, err)
+	is.True(t, ok)
+	is.Equal(t, int64(10), rec.Get("v").I64)
+	n, err := tx.Count("tbl_test", &Scanner{
+		Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE,
+		Key1: *(&Record{}).AddInt64("v", 0), Key2: *(&Record{}).AddInt64("v", 100),
+	})
+	is.Nil(t, err)
+	is.Equal(t, int64(4), n)
+	r.db.Abort(tx)
+
+	// the uncommitted schema is not cached
+	tx = r.begin()
+	is.Nil(t, testTableDef(tx, "tbl_new"))
+	r.db.Abort(tx)
+
+	r.db.Close()
+	after, err := os.ReadFile(r.db.Path)
+	is.Nil(t, err)
+	is.True(t, slices.Equal(before, after))
+
+	r.db = DB{Path: r.db.Path}
+	is.Nil(t, r.db.Open())
+	tx = r.begin()
+	defer r.commit(tx)
+	is.Nil(t, testTableDef(tx, "tbl_new"))
+	for i := int64(0); i < 5; i++ {
+		rec := *(&Record{}).AddInt64("k", i)
+		ok, err := tx.Get("tbl_test", &rec)
+		is.Nil(t, err)
+		is.True(t, ok)
+		is.Equal(t, i, rec.Get("v").I64)
+	}
+}
+
+func TestTableReadSnapshot(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	r.create(&TableDef{
+		Name:    "tbl_test",
+		Cols:    []string{"k", "v"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"k"}},
+	})
+	val := []byte(strings.Repeat("x", 1000))
+	for i := int64(0); i < 50; i++ {
+		r.add("tbl_test", *(&Record{}).AddInt64("k", i).AddStr("v", val))
+	}
+
+	snap := DBTX{}
+	r.db.BeginRead(&snap)
+	all := Scanner{
+		Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE,
+		Key1: *(&Record{}).AddInt64("k", math.MinInt64),
+		Key2: *(&Record{}).AddInt64("k", math.MaxInt64),
+	}
+	count := func(tx *DBTX) int64 {
+		n, err := tx.Count("tbl_test", &all)
+		is.Nil(t, err)
+		return n
+	}
+	is.Equal(t, int64(50), count(&snap))
+
+	// rewrite every page while the snapshot is open
+	for i := int64(0); i < 100; i++ {
+		r.add("tbl_test", *(&Record{}).AddInt64("k", i).AddStr("v", []byte(fmt.Sprint(i))))
+	}
+	tx := r.begin()
+	is.Equal(t, int64(100), count(tx))
+	r.commit(tx)
+
+	is.Equal(t, int64(50), count(&snap))
+	sc := all
+	is.Nil(t, snap.Scan("tbl_test", &sc))
+	for ; sc.Valid(); sc.Next() {
+		rec := Record{}
+		is.Nil(t, sc.Deref(&rec))
+		is.Equal(t, val, rec.Get("v").Str)
+	}
+
+	_, err := snap.Upsert("tbl_test", *(&Record{}).AddInt64("k", 0).AddStr("v", nil))
+	is.ErrorIs(t, err, transactions.ErrReadOnly)
+	_, err = snap.Delete("tbl_test", *(&Record{}).AddInt64("k", 0))
+	is.ErrorIs(t, err, transactions.ErrReadOnly)
+	r.db.Abort(&snap)
+}
+
+func TestTableSavepoint(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	r.create(&TableDef{
+		Name:    "tbl_test",
+		Cols:    []string{"k", "v"},
+		Types:   []uint32{TYPE_INT64, TYPE_INT64},
+		Indexes: [][]string{{"k"}, {"v"}},
+	})
+	r.add("tbl_test", *(&Record{}).AddInt64("k", 0).AddInt64("v", 0))
+
+	tx := r.begin()
+	keys := func() (got []int64) {
+		sc := Scanner{
+			Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE,
+			Key1: *(&Record{}).AddInt64("v", 0), Key2: *(&Record{}).AddInt64("v", 100),
+		}
+		is.Nil(t, tx.Scan("tbl_test", &sc))
+		for ; sc.Valid(); sc.Next() {
+			rec := Record{}
+			is.Nil(t, sc.Deref(&rec))
+			got = append(got, rec.Get("k").I64)
+		}
+		return got
+	}
+	add := func(k int64) {
+		_, err := tx.Insert("tbl_test", (&Record{}).AddInt64("k", k).AddInt64("v", k))
+		is.Nil(t, err)
+	}
+
+	add(1)
+	sp1 := tx.Savepoint()
+	add(2)
+	_, err := tx.Delete("tbl_test", *(&Record{}).AddInt64("k", 0))
+	is.Nil(t, err)
+	sp2 := tx.Savepoint()
+	add(3)
+	is.Equal(t, []int64{1, 2, 3}, keys())
+
+	is.Nil(t, tx.RollbackTo(sp2))
+	is.Equal(t, []int64{1, 2}, keys())
+	add(4)
+	is.Nil(t, tx.RollbackTo(sp2)) // still valid
+	is.Equal(t, []int64{1, 2}, keys())
+
+	is.Nil(t, tx.RollbackTo(sp1))
+	is.Equal(t, []int64{0, 1}, keys())
+	is.NotNil(t, tx.RollbackTo(sp2)) // invalidated by the earlier one
+
+	sp3 := tx.Savepoint()
+	add(5)
+	is.Nil(t, tx.Release(sp3))
+	is.NotNil(t, tx.RollbackTo(sp3))
+	is.Equal(t, []int64{0, 1, 5}, keys())
+	r.commit(tx)
+
+	tx = r.begin()
+	defer r.commit(tx)
+	is.Equal(t, []int64{0, 1, 5}, keys())
+}
+
+func TestTableConcurrentReaders(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	r.create(&TableDef{
+		Name:    "tbl_test",
+		Cols:    []string{"k", "v"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"k"}, {"v"}},
+	})
+	all := Scanner{
+		Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE,
+		Key1: *(&Record{}).AddInt64("k", math.MinInt64),
+		Key2: *(&Record{}).AddInt64("k", math.MaxInt64),
+	}
+
+	const nrows = 400
+	done := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			last := 0
+			for stop := false; !stop; {
+				select {
+				case <-done:
+					stop = true // one more pass after the last write
+				default:
+				}
+
+				tx := DBTX{}
+				r.db.BeginRead(&tx)
+				sc := all
+				n := 0
+				err := tx.Scan("tbl_test", &sc)
+				for ; err == nil && sc.Valid(); sc.Next() {
+					rec := Record{}
+					if err = sc.Deref(&rec); err == nil {
+						k, v := rec.Get("k").I64, string(rec.Get("v").Str)
+						if v != fmt.Sprint(k) {
+							err = fmt.Errorf("bad row: %d %s", k, v)
+						}
+					}
+					n++
+				}
+				r.db.Abort(&tx)
+				if err != nil || n < last {
+					t.Errorf("reader: %v, %d rows after %d", err, n, last)
+					return
+				}
+				last = n
+			}
+			if last != nrows {
+				t.Errorf("reader: %d rows at the end", last)
+			}
+		}()
+	}
+
+	for i := 0; i < nrows; i += 5 {
+		tx := r.begin()
+		for j := i; j < i+5; j++ {
+			rec := Record{}
+			rec.AddInt64("k", int64(j)).AddStr("v", []byte(fmt.Sprint(j)))
+			_, err := tx.Insert("tbl_test", &rec)
+			is.Nil(t, err)
+		}
+		r.commit(tx)
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestTableWriteBatch(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	r.create(&TableDef{
+		Name:    "tbl_test",
+		Cols:    []string{"k", "v"},
+		Types:   []uint32{TYPE_INT64, TYPE_INT64},
+		Indexes: [][]string{{"k"}},
+	})
+	r.create(&TableDef{
+		Name:    "tbl_audit",
+		Cols:    []string{"id", "msg"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"id"}},
+		AutoInc: true,
+	})
+	r.add("tbl_test", *(&Record{}).AddInt64("k", 1).AddInt64("v", 1))
+
+	update := func(v int64) func(b *Batch) error {
+		return func(b *Batch) error {
+			rec := (&Record{}).AddInt64("k", 1).AddInt64("v", v)
+			if _, err := b.Set("tbl_test", &DBUpdateReq{Record: *rec}); err != nil {
+				return err
+			}
+			audit := (&Record{}).AddStr("msg", []byte(fmt.Sprint("set ", v)))
+			_, err := b.Set("tbl_audit", &DBUpdateReq{Record: *audit})
+			return err
+		}
+	}
+	check := func(v int64, audits int64) {
+		tx := r.begin()
+		defer r.commit(tx)
+		rec := *(&Record{}).AddInt64("k", 1)
+		ok, err := tx.Get("tbl_test", &rec)
+		is.Nil(t, err)
+		is.True(t, ok)
+		is.Equal(t, v, rec.Get("v").I64)
+		n, err := tx.Count("tbl_audit", &Scanner{
+			Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE,
+			Key1: *(&Record{}).AddInt64("id", math.MinInt64),
+			Key2: *(&Record{}).AddInt64("id", math.MaxInt64),
+		})
+		is.Nil(t, err)
+		is.Equal(t, audits, n)
+	}
+	reopen := func() {
+		r.db.Close()
+		r.db = DB{Path: r.db.Path}
+		is.Nil(t, r.db.Open())
+	}
+
+	is.Nil(t, r.db.WriteBatch(update(2)))
+	check(2, 1)
+
+	// the callback fails
+	err := r.db.WriteBatch(func(b *Batch) error {
+		if err := update(3)(b); err != nil {
+			return err
+		}
+		bad := (&Record{}).AddInt64("k", 2)
+		_, err := b.Set("tbl_test", &DBUpdateReq{Record: *bad})
+		return err // missing column
+	})
+	is.NotNil(t, err)
+	check(2, 1)
+
+	// crash before the meta page is written
+	r.db.kv.Fsync = func(int) error { return fmt.Errorf("fsync error!") }
+	is.NotNil(t, r.db.WriteBatch(update(4)))
+	reopen()
+	check(2, 1)
+
+	// in order: a set then a delete of the same key
+	is.Nil(t, r.db.WriteBatch(func(b *Batch) error {
+		rec := (&Record{}).AddInt64("k", 5).AddInt64("v", 5)
+		if _, err := b.Set("tbl_test", &DBUpdateReq{Record: *rec}); err != nil {
+			return err
+		}
+		_, err := b.Delete("tbl_test", *(&Record{}).AddInt64("k", 5))
+		return err
+	}))
+	reopen()
+	check(2, 1)
+	rec := *(&Record{}).AddInt64("k", 5)
+	is.False(t, r.get("tbl_test", &rec))
+}
+
+func TestTableNewAtomic(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	newDef := func(name string) *TableDef {
+		return &TableDef{
+			Name:    name,
+			Cols:    []string{"k", "v"},
+			Types:   []uint32{TYPE_INT64, TYPE_INT64},
+			Indexes: [][]string{{"k"}, {"v"}},
+		}
+	}
+	t1 := newDef("t1")
+	r.create(t1)
+	is.Equal(t, []uint32{100, 101}, t1.Prefixes)
+
+	// crash before the meta page is written
+	r.db.kv.Fsync = func(int) error { return fmt.Errorf("fsync error!") }
+	tx := r.begin()
+	is.Nil(t, tx.TableNew(newDef("t2")))
+	is.NotNil(t, r.db.Commit(tx))
+	r.db.Close()
+	r.db = DB{Path: r.db.Path}
+	is.Nil(t, r.db.Open())
+	is.Nil(t, r.db.Check())
+
+	tx = r.begin()
+	is.Nil(t, testTableDef(tx, "t2"))
+	r.db.Abort(tx)
+
+	// a failed TableNew leaves the definition untouched
+	t3 := newDef("t3")
+	tx = &DBTX{}
+	r.db.BeginRead(tx)
+	is.ErrorIs(t, tx.TableNew(t3), transactions.ErrReadOnly)
+	r.db.Abort(tx)
+	is.Empty(t, t3.Prefixes)
+
+	// no prefix is leaked
+	r.create(t3)
+	is.Equal(t, []uint32{102, 103}, t3.Prefixes)
+	tx = r.begin()
+	is.NotNil(t, tx.TableNew(t3)) // already has prefixes
+	r.db.Abort(tx)
+
+	// concurrent creations cannot share a prefix
+	tx1, tx2 := r.begin(), r.begin()
+	is.Nil(t, tx1.TableNew(newDef("t4")))
+	is.Nil(t, tx2.TableNew(newDef("t5")))
+	r.commit(tx1)
+	is.ErrorIs(t, r.db.Commit(tx2), transactions.ErrorConflict)
+	tx = r.begin()
+	defer r.commit(tx)
+	is.Equal(t, []uint32{104, 105}, testTableDef(tx, "t4").Prefixes)
+	is.Nil(t, testTableDef(tx, "t5"))
+}
+
+func TestTableChecksum(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	tdef := &TableDef{
+		Name:    "tbl",
+		Cols:    []string{"k", "v"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"k"}},
+	}
+	r.create(tdef)
+	tx := r.begin()
+	for i := 0; i < 500; i++ {
+		rec := (&Record{}).AddInt64("k", int64(i)).AddStr("v", make([]byte, 100))
+		_, err := tx.Insert("tbl", rec)
+		is.Nil(t, err)
+	}
+	r.commit(tx)
+
+	// the rightmost leaf holds the last rows
+	leaf := r.db.kv.tree.root
+	for {
+		node := btree.BNode(r.db.kv.pageRead(leaf))
+		if node.btype() == btree.BNODE_LEAF {
+			break
+		}
+		leaf = node.getPtr(node.nkeys() - 1)
+	}
+	r.db.Close()
+	flip := func() {
+		fp, err := os.OpenFile(r.db.Path, os.O_RDWR, 0)
+		is.Nil(t, err)
+		defer fp.Close()
+		b := []byte{0}
+		pos := int64(leaf)*btree.BTREE_PAGE_SIZE + 100
+		_, err = fp.ReadAt(b, pos)
+		is.Nil(t, err)
+		b[0] ^= 0xff
+		_, err = fp.WriteAt(b, pos)
+		is.Nil(t, err)
+	}
+	flip()
+	r.db = DB{Path: r.db.Path}
+	is.Nil(t, r.db.Open())
+
+	ce := &kv.ChecksumError{}
+	tx = r.begin()
+	rec := (&Record{}).AddInt64("k", 0)
+	ok, err := tx.Get("tbl", rec)
+	is.True(t, ok)
+	is.Nil(t, err)
+	rec = (&Record{}).AddInt64("k", 499)
+	_, err = tx.Get("tbl", rec)
+	is.ErrorAs(t, err, &ce)
+	is.Equal(t, leaf, ce.Page)
+	_, err = tx.Delete("tbl", *rec)
+	is.ErrorIs(t, err, kv.ErrChecksum)
+
+	// a scan stops at the bad page
+	sc := Scanner{Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE}
+	is.Nil(t, tx.Scan("tbl", &sc))
+	n := 0
+	for ; sc.Valid(); sc.Next() {
+		n++
+	}
+	is.Less(t, n, 500)
+	is.ErrorIs(t, sc.Err(), kv.ErrChecksum)
+	sc.Close()
+	_, err = tx.Count("tbl", &Scanner{Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE})
+	is.ErrorIs(t, err, kv.ErrChecksum)
+	r.db.Abort(tx)
+
+	flip()
+	r.db.Close()
+	r.db = DB{Path: r.db.Path}
+	is.Nil(t, r.db.Open())
+	tx = r.begin()
+	n64, err := tx.Count("tbl", &Scanner{Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE})
+	is.Nil(t, err)
+	is.Equal(t, int64(500), n64)
+	r.db.Abort(tx)
+}
+
+func TestTableCheck(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	tdef := &TableDef{
+		Name:    "tbl",
+		Cols:    []string{"k", "v", "blob"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES, TYPE_BYTES},
+		Indexes: [][]string{{"k"}, {"v"}},
+	}
+	r.create(tdef)
+	tx := r.begin()
+	for i := 0; i < 300; i++ {
+		rec := (&Record{}).AddInt64("k", int64(i)).AddStr("v", []byte(fmt.Sprintf("v%d", i))).
+			AddStr("blob", nil)
+		_, err := tx.Insert("tbl", rec)
+		is.Nil(t, err)
+	}
+	big := (&Record{}).AddInt64("k", 1000).AddStr("v", nil).AddStr("blob", make([]byte, 5000))
+	_, err := tx.Insert("tbl", big)
+	is.Nil(t, err)
+	r.commit(tx)
+	tx = r.begin()
+	for i := 0; i < 300; i += 2 {
+		_, err := tx.Delete("tbl", *(&Record{}).AddInt64("k", int64(i)))
+		is.Nil(t, err)
+	}
+	r.commit(tx)
+	is.Nil(t, r.db.Check())
+
+	// keys that don't match the schema
+	tx = r.begin()
+	key := encodeKey(nil, tdef.Prefixes[0], []Value{{Type: TYPE_BYTES, Str: []byte("x")}})
+	_, err = tx.kv.Set(key, nil)
+	is.Nil(t, err)
+	_, err = tx.kv.Set(encodeKey(nil, 999, nil), nil)
+	is.Nil(t, err)
+	r.commit(tx)
+	err = r.db.Check()
+	is.ErrorContains(t, err, "table tbl: bad row")
+	is.ErrorContains(t, err, "unknown table prefix: 999")
+}
+
+func TestTableVacuum(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	tdef := &TableDef{
+		Name:    "tbl",
+		Cols:    []string{"k", "v"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"k"}, {"v"}},
+	}
+	r.create(tdef)
+	const N = 100000
+	const batch = 1000 // rows per transaction
+	for i := 0; i < N; i += batch {
+		tx := r.begin()
+		for j := i; j < i+batch; j++ {
+			rec := (&Record{}).AddInt64("k", int64(j)).AddStr("v", []byte(fmt.Sprintf("value%08d", j)))
+			_, err := tx.Insert("tbl", rec)
+			is.Nil(t, err)
+		}
+		r.commit(tx)
+	}
+	for i := 0; i < N; i += batch {
+		tx := r.begin()
+		for j := i; j < i+batch; j++ {
+			if j%10 != 0 {
+				_, err := tx.Delete("tbl", *(&Record{}).AddInt64("k", int64(j)))
+				is.Nil(t, err)
+			}
+		}
+		r.commit(tx)
+	}
+
+	stat := func() int64 {
+		finfo, err := os.Stat(r.db.Path)
+		is.Nil(t, err)
+		return finfo.Size()
+	}
+	size := stat()
+	reclaimed, err := r.db.Vacuum()
+	is.Nil(t, err)
+	is.Equal(t, size-stat(), reclaimed)
+	// 10% of the rows are left
+	is.Less(t, stat(), size/5)
+	is.Nil(t, r.db.Check())
+
+	r.db.Close()
+	r.db = DB{Path: r.db.Path}
+	is.Nil(t, r.db.Open())
+	tx := r.begin()
+	n, err := tx.Count("tbl", &Scanner{Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE})
+	is.Nil(t, err)
+	is.Equal(t, int64(N/10), n)
+	for i := 0; i < N; i += 10 {
+		rec := (&Record{}).AddInt64("k", int64(i))
+		ok, err := tx.Get("tbl", rec)
+		is.True(t, ok)
+		is.Nil(t, err)
+		is.Equal(t, fmt.Sprintf("value%08d", i), string(rec.Get("v").Str))
+	}
+	sc := Scanner{
+		Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE,
+		Key1: *(&Record{}).AddStr("v", nil), Key2: *(&Record{}).AddStr("v", []byte("z")),
+	}
+	n, err = tx.Count("tbl", &sc)
+	is.Nil(t, err)
+	is.Equal(t, int64(N/10), n)
+	r.db.Abort(tx)
+}
+
+func TestTableBackup(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	defer os.Remove("r_backup.db")
+	tdef := &TableDef{
+		Name:    "tbl",
+		Cols:    []string{"k", "v"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"k"}, {"v"}},
+	}
+	r.create(tdef)
+	const N = 20000
+	for i := 0; i < N; i += 1000 {
+		tx := r.begin()
+		for j := i; j < i+1000; j++ {
+			rec := (&Record{}).AddInt64("k", int64(j)).AddStr("v", []byte(fmt.Sprintf("value%08d", j)))
+			_, err := tx.Insert("tbl", rec)
+			is.Nil(t, err)
+		}
+		r.commit(tx)
+	}
+
+	// writes during the backup
+	stop := make(chan struct{})
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			tx := r.begin()
+			rec := (&Record{}).AddInt64("k", int64(i%N)).AddStr("v", []byte(fmt.Sprintf("new%08d", i)))
+			_, err := tx.Update("tbl", *rec)
+			assert(err == nil)
+			_, err = tx.Delete("tbl", *(&Record{}).AddInt64("k", int64((i*7)%N)))
+			assert(err == nil)
+			r.commit(tx)
+		}
+	}()
+	err := r.db.Backup("r_backup.db")
+	close(stop)
+	wg.Wait()
+	is.Nil(t, err)
+	is.Nil(t, r.db.Check())
+
+	copied := DB{Path: "r_backup.db"}
+	is.Nil(t, copied.Open())
+	defer copied.Close()
+	is.Nil(t, copied.Check())
+	tx := DBTX{}
+	copied.Begin(&tx)
+	n, err := tx.Count("tbl", &Scanner{Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE})
+	is.Nil(t, err)
+	is.True(t, 0 < n && n <= N)
+	copied.Abort(&tx)
+}
+
+func TestTableChanges(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	defer os.Remove("r_backup.db")
+	defer os.Remove("r.db-changes")
+	r.db.Close()
+	r.db = DB{Path: r.db.Path, Options: Options{Changes: true}}
+	is.Nil(t, r.db.Open())
+	tdef := &TableDef{
+		Name:    "tbl",
+		Cols:    []string{"k", "v"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"k"}, {"v"}},
+	}
+	r.create(tdef)
+	tx := r.begin()
+	for i := 0; i < 1000; i++ {
+		rec := (&Record{}).AddInt64("k", int64(i)).AddStr("v", []byte(fmt.Sprintf("value%d", i)))
+		_, err := tx.Insert("tbl", rec)
+		is.Nil(t, err)
+	}
+	r.commit(tx)
+
+	// a copy at `seq`
+	is.Nil(t, r.db.Backup("r_backup.db"))
+	seq := r.db.Seq()
+
+	tx = r.begin()
+	for i := 0; i < 1000; i += 3 {
+		_, err := tx.Update("tbl", *(&Record{}).AddInt64("k", int64(i)).AddStr("v", []byte("new")))
+		is.Nil(t, err)
+		_, err = tx.Delete("tbl", *(&Record{}).AddInt64("k", int64(i+1)))
+		is.Nil(t, err)
+	}
+	r.commit(tx)
+	r.create(&TableDef{
+		Name:    "tbl2",
+		Cols:    []string{"k", "v"},
+		Types:   []uint32{TYPE_BYTES, TYPE_INT64},
+		Indexes: [][]string{{"k"}},
+	})
+	r.add("tbl2", *(&Record{}).AddStr("k", []byte("a")).AddInt64("v", 1))
+
+	buf := bytes.Buffer{}
+	is.Nil(t, r.db.ChangesSince(seq, &buf))
+	copied := DB{Path: "r_backup.db"}
+	is.Nil(t, copied.Open())
+	defer copied.Close()
+	is.Nil(t, copied.ApplyChanges(&buf))
+	is.Nil(t, copied.Check())
+
+	// the same KVs
+	dump := func(db *DB) (kvs []string) {
+		tx := DBTX{}
+		db.BeginRead(&tx)
+		defer db.Abort(&tx)
+		end := []byte{0xff, 0xff, 0xff, 0xff, 0xff}
+		for iter := tx.kv.Seek(nil, btree_iter.CMP_GT, end, btree_iter.CMP_LE); iter.Valid(); iter.Next() {
+			key, val := iter.Deref()
+			kvs = append(kvs, string(key), string(val))
+		}
+		return kvs
+	}
+	is.Equal(t, dump(&r.db), dump(&copied))
+	// the new table is seen
+	tx = &DBTX{}
+	copied.Begin(tx)
+	rec := (&Record{}).AddStr("k", []byte("a"))
+	ok, err := tx.Get("tbl2", rec)
+	is.True(t, ok)
+	is.Nil(t, err)
+	is.Equal(t, int64(1), rec.Get("v").I64)
+	copied.Abort(tx)
+}
+
+func TestTableEncrypt(t *testing.T) {
+	os.Remove("r.db")
+	defer os.Remove("r.db")
+	key := []byte("0123456789abcdef0123456789abcdef")
+	r := &R{db: DB{Path: "r.db", Options: Options{Key: key}}, ref: map[string][]Record{}}
+	is.Nil(t, r.db.Open())
+	tdef := &TableDef{
+		Name:    "tbl",
+		Cols:    []string{"k", "v"},
+		Types:   []uint32{TYPE_BYTES, TYPE_BYTES},
+		Indexes: [][]string{{"k"}, {"v"}},
+	}
+	r.create(tdef)
+	for i := 0; i < 1000; i++ {
+		r.add("tbl", *(&Record{}).AddStr("k", []byte(fmt.Sprintf("user%d@example.com", i))).
+			AddStr("v", []byte(fmt.Sprintf("confidential %d", i))))
+	}
+	r.db.Close()
+
+	data, err := os.ReadFile("r.db")
+	is.Nil(t, err)
+	for _, plain := range []string{"example.com", "confidential", "tbl"} {
+		is.False(t, bytes.Contains(data, []byte(plain)))
+	}
+
+	// a wrong key fails cleanly
+	wrong := DB{Path: "r.db", Options: Options{Key: []byte("0123456789abcdef0123456789abcdeX")}}
+	is.ErrorIs(t, wrong.Open(), kv.ErrBadKey)
+	wrong = DB{Path: "r.db"}
+	is.ErrorIs(t, wrong.Open(), kv.ErrBadKey)
+
+	r.db = DB{Path: "r.db", Options: Options{Key: key}}
+	is.Nil(t, r.db.Open())
+	defer r.db.Close()
+	is.Nil(t, r.db.Check())
+	rec := (&Record{}).AddStr("k", []byte("user7@example.com"))
+	is.True(t, r.get("tbl", rec))
+	is.Equal(t, "confidential 7", string(rec.Get("v").Str))
+}
+
+func TestTableCompress(t *testing.T) {
+	os.Remove("r.db")
+	defer os.Remove("r.db")
+	r := &R{db: DB{Path: "r.db", Options: Options{Compression: &kv.FlateCompressor{}}}, ref: map[string][]Record{}}
+	is.Nil(t, r.db.Open())
+	tdef := &TableDef{
+		Name:    "tbl",
+		Cols:    []string{"k", "v"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"k"}, {"v"}},
+	}
+	r.create(tdef)
+	for i := 0; i < 1000; i++ {
+		r.add("tbl", *(&Record{}).AddInt64("k", int64(i)).
+			AddStr("v", []byte(fmt.Sprintf("a compressible value %d", i%10))))
+	}
+	r.db.Close()
+
+	// the method is in the file
+	r.db = DB{Path: "r.db"}
+	is.Nil(t, r.db.Open())
+	defer r.db.Close()
+	is.Nil(t, r.db.Check())
+	rec := (&Record{}).AddInt64("k", 7)
+	is.True(t, r.get("tbl", rec))
+	is.Equal(t, "a compressible value 7", string(rec.Get("v").Str))
+}
+
+func TestTableReadOnly(t *testing.T) {
+	r := newR()
+	defer os.Remove("r.db")
+	tdef := &TableDef{
+		Name:    "tbl",
+		Cols:    []string{"k", "v"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"k"}, {"v"}},
+	}
+	r.create(tdef)
+	for i := 0; i < 100; i++ {
+		r.add("tbl", *(&Record{}).AddInt64("k", int64(i)).AddStr("v", []byte(fmt.Sprint(i))))
+	}
+	r.db.Close()
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	is.Nil(t, os.Chtimes("r.db", past, past))
+	data, err := os.ReadFile("r.db")
+	is.Nil(t, err)
+
+	r.db = DB{Path: "r.db", Options: Options{ReadOnly: true}}
+	is.Nil(t, r.db.Open())
+	is.Nil(t, r.db.Check())
+	tx := r.begin()
+	req := Scanner{Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE, Key1: Record{}, Key2: Record{}}
+	is.Nil(t, tx.Scan("tbl", &req))
+	got := []Record{}
+	for ; req.Valid(); req.Next() {
+		rec := Record{}
+		req.Deref(&rec)
+		got = append(got, rec)
+	}
+	is.Equal(t, r.ref["tbl"], got)
+
+	rec := *(&Record{}).AddInt64("k", 1000).AddStr("v", []byte("new"))
+	_, err = tx.Insert("tbl", &rec)
+	is.ErrorIs(t, err, transactions.ErrReadOnly)
+	_, err = tx.Upsert("tbl", rec)
+	is.ErrorIs(t, err, transactions.ErrReadOnly)
+	_, err = tx.Update("tbl", *(&Record{}).AddInt64("k", 1).AddStr("v", []byte("new")))
+	is.ErrorIs(t, err, transactions.ErrReadOnly)
+	_, err = tx.Delete("tbl", *(&Record{}).AddInt64("k", 1))
+	is.ErrorIs(t, err, transactions.ErrReadOnly)
+	other := *tdef
+	other.Name, other.Prefixes = "other", nil
+	is.ErrorIs(t, tx.TableNew(&other), transactions.ErrReadOnly)
+	r.db.Abort(tx)
+	r.db.Close()
+
+	finfo, err := os.Stat("r.db")
+	is.Nil(t, err)
+	is.True(t, past.Equal(finfo.ModTime()))
+	after, err := os.ReadFile("r.db")
+	is.Nil(t, err)
+	is.True(t, bytes.Equal(data, after))
+}
+
+// tests that use newR, to be run with other options
+var tableSuite = []func(*testing.T){
+	TestTableCreate, TestTableBasic, TestTableScan, TestTableIndex,
+	TestTableIndexKeys, TestTableScanSecondaryIndex, TestTableUniqueIndex,
+	TestTableDrop, TestTableAddColumn, TestTableLargeValue,
+	TestTableDeleteRange, TestTableInsertBatch, TestTableMultiGet,
+	TestTableScanLimitOffset, TestTableProjection, TestTablePrefixScan,
+	TestTableScanFilter, TestTableAggregate, TestTableScanToken,
+	TestTableFirstLast, TestTableAbort, TestTableReadSnapshot, TestTableCheck,
+	TestTableLoad,
+}
+
+func TestTablePageSize(t *testing.T) {
+	defer func() { testPageSize = 0 }()
+	for _, size := range []int{4096, 8192, 16384} {
+		testPageSize = size
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			for _, test := range tableSuite {
+				test(t)
+			}
+		})
+	}
+
+	// the size is in the file
+	testPageSize = 16384
+	r := newR()
+	r.create(&TableDef{
+		Name:    "tbl",
+		Cols:    []string{"k", "v"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"k"}},
+	})
+	r.add("tbl", *(&Record{}).AddInt64("k", 1).AddStr("v", []byte("v")))
+	r.db.Close()
+	finfo, err := os.Stat("r.db")
+	is.Nil(t, err)
+	is.Zero(t, finfo.Size()%16384)
+	wrong := DB{Path: "r.db", Options: Options{PageSize: 4096}}
+	is.NotNil(t, wrong.Open())
+	r.db = DB{Path: "r.db"}
+	is.Nil(t, r.db.Open())
+	rec := (&Record{}).AddInt64("k", 1)
+	is.True(t, r.get("tbl", rec))
+	r.dispose()
+}
+
+// a small cache is churned by the table suite
+func TestTableCache(t *testing.T) {
+	testCacheSize = 8 * btree.BTREE_PAGE_SIZE
+	defer func() { testCacheSize = 0 }()
+	for _, test := range tableSuite {
+		test(t)
+	}
+
+	r := newR()
+	defer r.dispose()
+	r.create(&TableDef{
+		Name:    "tbl",
+		Cols:    []string{"k", "v"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"k"}},
+	})
+	for i := 0; i < 500; i++ {
+		r.add("tbl", *(&Record{}).AddInt64("k", int64(i)).AddStr("v", []byte(fmt.Sprint(i))))
+	}
+	for i := 0; i < 500; i += 7 {
+		rec := (&Record{}).AddInt64("k", int64(i))
+		is.True(t, r.get("tbl", rec))
+	}
+	stats := r.db.CacheStats()
+	is.Greater(t, stats.Hits, uint64(0))
+	is.LessOrEqual(t, stats.Pages, 8)
+}
+
+func TestTableLoad(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	tdef := func(name string) *TableDef {
+		return &TableDef{
+			Name:    name,
+			Cols:    []string{"id", "email", "name", "blob"},
+			Types:   []uint32{TYPE_INT64, TYPE_BYTES, TYPE_BYTES, TYPE_BYTES},
+			Indexes: [][]string{{"id"}, {"email"}, {"name"}},
+			Unique:  []bool{false, true, false},
+			AutoInc: true,
+		}
+	}
+	loaded, inserted := tdef("loaded"), tdef("inserted")
+	r.create(loaded)
+	r.create(inserted)
+	row := func(i int) *Record {
+		rec := (&Record{}).AddInt64("id", int64(i*3+1))
+		rec.AddStr("email", []byte(fmt.Sprintf("u%d@x", fmix32(uint32(i)))))
+		rec.AddStr("name", []byte(fmt.Sprint(i%10)))
+		if i%100 == 0 {
+			rec.AddStr("blob", make([]byte, 5000)) // overflow pages
+		} else {
+			rec.AddStr("blob", nil)
+		}
+		return rec
+	}
+	const N = 3000
+	for i := 0; i < N; i += 500 {
+		tx := r.begin()
+		for j := i; j < i+500; j++ {
+			_, err := tx.Insert("inserted", row(j))
+			is.Nil(t, err)
+		}
+		r.commit(tx)
+	}
+	i := 0
+	n, err := r.db.Load("loaded", func() (*Record, bool) {
+		if i++; i > N {
+			return nil, false
+		}
+		return row(i - 1), true
+	})
+	is.Nil(t, err)
+	is.Equal(t, N, n)
+	is.Nil(t, r.db.Check())
+
+	// the same rows and index keys as inserts
+	tx := r.begin()
+	for idx := range loaded.Indexes {
+		strip := func(keys []string) (out []string) {
+			for _, key := range keys {
+				out = append(out, key[4:])
+			}
+			return out
+		}
+		is.Equal(t, strip(rawKeys(tx, inserted.Prefixes[idx])), strip(rawKeys(tx, loaded.Prefixes[idx])))
+	}
+	scans := []Scanner{
+		{Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE},
+		{
+			Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE,
+			Key1: *(&Record{}).AddStr("email", nil), Key2: *(&Record{}).AddStr("email", []byte("~")),
+		},
+	}
+	for _, sc := range scans {
+		got := [2][]string{}
+		for k, table := range []string{"inserted", "loaded"} {
+			sc := sc
+			is.Nil(t, tx.Scan(table, &sc))
+			for ; sc.Valid(); sc.Next() {
+				rec := Record{}
+				is.Nil(t, sc.Deref(&rec))
+				got[k] = append(got[k], fmt.Sprint(rec.Vals))
+			}
+		}
+		is.Equal(t, N, len(got[1]))
+		is.Equal(t, got[0], got[1])
+	}
+	rec := (&Record{}).AddInt64("id", 301)
+	ok, err := tx.Get("loaded", rec)
+	is.Nil(t, err)
+	is.True(t, ok)
+	is.Equal(t, 5000, len(rec.Get("blob").Str))
+	// the auto-increment counter is moved
+	rec = (&Record{}).AddStr("email", []byte("new")).AddStr("name", nil).AddStr("blob", nil)
+	_, err = tx.Insert("loaded", rec)
+	is.Nil(t, err)
+	is.Equal(t, int64((N-1)*3+2), rec.Get("id").I64)
+	r.commit(tx)
+
+	// errors; nothing is written
+	bad := tdef("bad")
+	r.create(bad)
+	load := func(table string, recs ...*Record) error {
+		i := 0
+		_, err := r.db.Load(table, func() (*Record, bool) {
+			if i++; i > len(recs) {
+				return nil, false
+			}
+			return recs[i-1], true
+		})
+		return err
+	}
+	is.ErrorContains(t, load("loaded", row(N)), "not empty")
+	is.ErrorContains(t, load("bad", row(2), row(1)), "record 1: not in primary key order")
+	is.ErrorContains(t, load("bad", row(1), row(1)), "record 1: not in primary key order")
+	dup := row(2)
+	dup.Vals[1] = row(1).Vals[1]
+	is.ErrorIs(t, load("bad", row(1), dup), ErrUniqueViolation)
+	is.ErrorContains(t, load("bad", row(1), (&Record{}).AddInt64("id", 100)), "record 1")
+	is.ErrorContains(t, load("nope"), "table not found")
+	tx = r.begin()
+	for idx := range bad.Indexes {
+		is.Empty(t, rawKeys(tx, bad.Prefixes[idx]))
+	}
+	r.commit(tx)
+
+	// generated keys
+	recs := []*Record{}
+	for i := 0; i < 10; i++ {
+		rec := row(i)
+		rec.Cols, rec.Vals = rec.Cols[1:], rec.Vals[1:]
+		recs = append(recs, rec)
+	}
+	is.Nil(t, load("bad", recs...))
+	rec = (&Record{}).AddInt64("id", 10)
+	tx = r.begin()
+	ok, err = tx.Get("bad", rec)
+	is.Nil(t, err)
+	is.True(t, ok)
+	is.Equal(t, row(9).Vals[1], rec.Vals[1])
+	r.commit(tx)
+	is.Nil(t, r.db.Check())
+}
+
+func benchmarkLoad(b *testing.B, bulk bool) {
+	const size = 100000
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		r := newR()
+		r.create(&TableDef{
+			Name:    "tbl_test",
+			Cols:    []string{"k", "v"},
+			Types:   []uint32{TYPE_INT64, TYPE_BYTES},
+			Indexes: [][]string{{"k"}, {"v"}},
+		})
+		row := func(j int) *Record {
+			return (&Record{}).AddInt64("k", int64(j)).AddStr("v", []byte(fmt.Sprint(fmix32(uint32(j)))))
+		}
+		b.StartTimer()
+		if bulk {
+			j := 0
+			_, err := r.db.Load("tbl_test", func() (*Record, bool) {
+				j++
+				return row(j), j <= size
+			})
+			assert(err == nil)
+		} else {
+			for j := 0; j < size; j += 1000 {
+				recs := []Record{}
+				for k := j; k < j+1000; k++ {
+					recs = append(recs, *row(k))
+				}
+				tx := r.begin()
+				_, err := tx.InsertBatch("tbl_test", recs)
+				assert(err == nil)
+				r.commit(tx)
+			}
+		}
+		b.StopTimer()
+		r.dispose()
+	}
+}
+
+// 100k rows with a secondary index into an empty table
+func BenchmarkLoadBulk(b *testing.B)   { benchmarkLoad(b, true) }
+func BenchmarkLoadInsert(b *testing.B) { benchmarkLoad(b, false) }
+
+// the row counters by a scan
+func scanStats(tx *DBTX, prefix uint32) (stats TableStats) {
+	start := encodeKey(nil, prefix, nil)
+	end := encodeKey(nil, prefix+1, nil)
+	iter := tx.kv.Seek(start, btree_iter.CMP_GE, end, btree_iter.CMP_LT)
+	for ; iter.Valid(); iter.Next() {
+		key, val := iter.Deref()
+		stats.Rows++
+		stats.Bytes += int64(len(key) + len(val))
+	}
+	return stats
+}
+
+func TestTableStats(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	for _, name := range []string{"t1", "t2"} {
+		r.create(&TableDef{
+			Name:    name,
+			Cols:    []string{"id", "name", "n"},
+			Types:   []uint32{TYPE_INT64, TYPE_BYTES, TYPE_INT64},
+			Indexes: [][]string{{"id"}, {"name"}},
+			AutoInc: true,
+		})
+	}
+	check := func() {
+		stats, err := r.db.Stats()
+		is.Nil(t, err)
+		tx := DBTX{}
+		r.db.BeginRead(&tx)
+		defer r.db.Abort(&tx)
+		names, err := tx.ListTables()
+		is.Nil(t, err)
+		is.Len(t, stats.Tables, len(names))
+		for _, name := range names {
+			tdef := testTableDef(&tx, name)
+			is.Equal(t, scanStats(&tx, tdef.Prefixes[0]), stats.Tables[name], name)
+		}
+		is.Equal(t, stats.KV.Pages, stats.KV.FreePages+stats.KV.ListPages+
+			stats.KV.NodePages+stats.KV.LeafPages+stats.KV.OverflowPages+1)
+	}
+	check()
+
+	row := func(i int, name string) Record {
+		return *(&Record{}).AddInt64("id", int64(i)).AddStr("name", []byte(name)).AddInt64("n", 0)
+	}
+	for i := 1; i <= 100; i++ {
+		r.add("t1", row(i, strings.Repeat("x", i)))
+	}
+	check()
+
+	// every kind of write
+	tx := r.begin()
+	for i := 1; i <= 100; i += 3 {
+		_, err := tx.Update("t1", row(i, "y"))
+		is.Nil(t, err)
+	}
+	_, err := tx.Set("t1", &DBUpdateReq{
+		Record: *(&Record{}).AddInt64("id", 2).AddStr("name", []byte("partial")), Partial: true,
+	})
+	is.Nil(t, err)
+	_, err = tx.Increment("t1", *(&Record{}).AddInt64("id", 5), "n", 1<<40)
+	is.Nil(t, err)
+	_, err = tx.Delete("t1", *(&Record{}).AddInt64("id", 7))
+	is.Nil(t, err)
+	_, err = tx.DeleteRange("t1", *(&Record{}).AddInt64("id", 50), *(&Record{}).AddInt64("id", 60),
+		btree_iter.CMP_GE, btree_iter.CMP_LT)
+	is.Nil(t, err)
+	_, err = tx.InsertBatch("t1", []Record{row(200, "a"), row(201, "b"), row(1, "dup")})
+	is.Nil(t, err)
+	// reverted with the row
+	_, err = tx.Set("t1", &DBUpdateReq{Record: row(8, "y"), Expected: row(8, "z")})
+	is.ErrorIs(t, err, ErrConflict)
+	r.commit(tx)
+	check()
+
+	// concurrent writers of different rows don't conflict
+	tx1, tx2 := r.begin(), r.begin()
+	rec := row(300, "c")
+	_, err = tx1.Insert("t1", &rec)
+	is.Nil(t, err)
+	_, err = tx2.Delete("t1", row(9, ""))
+	is.Nil(t, err)
+	r.commit(tx1)
+	r.commit(tx2)
+	check()
+
+	// bulk load
+	i := 0
+	n, err := r.db.Load("t2", func() (*Record, bool) {
+		i++
+		rec := row(i, fmt.Sprint(i))
+		return &rec, i <= 500
+	})
+	is.Nil(t, err)
+	is.Equal(t, 500, n)
+	check()
+
+	// a table without counters is scanned
+	tx = r.begin()
+	tdef := testTableDef(tx, "t2")
+	_, err = tx.Delete("@stats", *(&Record{}).AddInt64("prefix", int64(tdef.Prefixes[0])))
+	is.Nil(t, err)
+	r.commit(tx)
+	r.add("t2", row(1000, "d")) // not counted
+	check()
+
+	// dropped with the table
+	tx = r.begin()
+	is.Nil(t, tx.TableDrop("t1"))
+	r.commit(tx)
+	check()
+	tx = r.begin()
+	rows, err := tx.Count("@stats", &Scanner{Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE})
+	is.Nil(t, err)
+	is.Zero(t, rows)
+	r.commit(tx)
+	is.Nil(t, r.db.Check())
+}
+
+func TestTablePrefixReuse(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	tdef := func(name string, nindex int) *TableDef {
+		tdef := &TableDef{
+			Name:    name,
+			Cols:    []string{"a", "b", "c"},
+			Types:   []uint32{TYPE_INT64, TYPE_INT64, TYPE_INT64},
+			Indexes: [][]string{{"a"}, {"b"}, {"c"}}[:nindex],
+		}
+		return tdef
+	}
+	drop := func(name string) {
+		tx := r.begin()
+		is.Nil(t, tx.TableDrop(name))
+		r.commit(tx)
+	}
+	insert := func(name string, a int64) {
+		tx := r.begin()
+		_, err := tx.Insert(name, (&Record{}).AddInt64("a", a).AddInt64("b", 2).AddInt64("c", 3))
+		is.Nil(t, err)
+		r.commit(tx)
+	}
+	nextPrefix := func() uint32 {
+		tx := r.begin()
+		defer r.commit(tx)
+		rec := (&Record{}).AddStr("key", []byte("next_prefix"))
+		ok, err := tx.Get("@meta", rec)
+		is.True(t, ok)
+		is.Nil(t, err)
+		return binary.LittleEndian.Uint32(rec.Get("val").Str)
+	}
+	r.create(tdef("keep", 1))
+
+	// create and drop tables of different sizes in a loop
+	for i := 0; i < 200; i++ {
+		for j := 1; j <= 3; j++ {
+			name := fmt.Sprintf("tmp%d", j)
+			r.create(tdef(name, 1+(i+j)%3))
+			insert(name, 1)
+		}
+		for j := 1; j <= 3; j++ {
+			drop(fmt.Sprintf("tmp%d", j))
+		}
+	}
+	is.LessOrEqual(t, nextPrefix(), uint32(TABLE_PREFIX_MIN+1+9))
+
+	// dropped ranges are merged
+	a, b := tdef("a", 2), tdef("b", 2)
+	r.create(a)
+	r.create(b)
+	is.Equal(t, a.Prefixes[1]+1, b.Prefixes[0])
+	drop("a")
+	drop("b")
+	c := tdef("c", 3)
+	r.create(c)
+	is.Equal(t, a.Prefixes[0], c.Prefixes[0])
+	drop("c")
+
+	// prefixes with keys left are skipped
+	tx := r.begin()
+	free, err := getFreePrefixes(tx)
+	is.Nil(t, err)
+	is.NotEmpty(t, free)
+	stray := free[0].start
+	_, err = tx.kv.Set(encodeKey(nil, stray, []Value{{Type: TYPE_INT64, I64: 1}}), nil)
+	is.Nil(t, err)
+	r.commit(tx)
+	d := tdef("d", 1)
+	r.create(d)
+	is.NotEqual(t, stray, d.Prefixes[0])
+	tx = r.begin()
+	is.Len(t, rawKeys(tx, stray), 1)
+	r.commit(tx)
+
+	// a writer conflicts with a concurrent drop
+	insert("d", 1)
+	writer := r.begin()
+	_, err = writer.Insert("d", (&Record{}).AddInt64("a", 2).AddInt64("b", 2).AddInt64("c", 3))
+	is.Nil(t, err)
+	drop("d")
+	is.ErrorIs(t, r.db.Commit(writer), transactions.ErrorConflict)
+	e := tdef("e", 1)
+	r.create(e)
+	is.Equal(t, d.Prefixes[0], e.Prefixes[0])
+	tx = r.begin()
+	is.Empty(t, rawKeys(tx, e.Prefixes[0]))
+	r.commit(tx)
+	// only the stray key is reported
+	err = r.db.Check()
+	is.ErrorContains(t, err, fmt.Sprintf("unknown table prefix: %d", stray))
+	is.Len(t, strings.Split(err.Error(), "\n"), 1)
+}
+
+// the changes of a table after `seq`, as "op key [row]"
+func readChangeLog(t *testing.T, db *DB, table string, seq uint64) (out []string) {
+	iter, err := db.ReadChanges(table, seq+1)
+	is.Nil(t, err)
+	defer iter.Close()
+	for ; iter.Valid(); iter.Next() {
+		ev := ChangeEvent{}
+		is.Nil(t, iter.Deref(&ev))
+		is.Greater(t, ev.Seq, seq)
+		s := fmt.Sprintf("%d %d", ev.Op, ev.Key.Get("k").I64)
+		if len(ev.Row.Cols) > 0 {
+			s += fmt.Sprintf(" %s", ev.Row.Get("v").Str)
+		}
+		out = append(out, s)
+	}
+	is.Nil(t, iter.Err())
+	return out
+}
+
+func TestTableChangeLog(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	tdef := func(name string) *TableDef {
+		return &TableDef{
+			Name:    name,
+			Cols:    []string{"k", "v"},
+			Types:   []uint32{TYPE_INT64, TYPE_BYTES},
+			Indexes: [][]string{{"k"}, {"v"}},
+		}
+	}
+	full, keys, plain := tdef("full"), tdef("keys"), tdef("plain")
+	full.Changes, full.ChangeValues = true, true
+	keys.Changes = true
+	r.create(full)
+	r.create(keys)
+	r.create(plain)
+	row := func(k int64, v string) *Record {
+		return (&Record{}).AddInt64("k", k).AddStr("v", []byte(v))
+	}
+	seq0 := r.db.Seq()
+
+	// every write path is logged
+	tx := r.begin()
+	for _, name := range []string{"full", "keys", "plain"} {
+		_, err := tx.Insert(name, row(1, "a"))
+		is.Nil(t, err)
+		_, err = tx.InsertBatch(name, []Record{*row(3, "c"), *row(2, "b")})
+		is.Nil(t, err)
+		_, err = tx.Update(name, *row(1, "A"))
+		is.Nil(t, err)
+		_, err = tx.Update(name, *row(1, "A")) // not changed
+		is.Nil(t, err)
+		_, err = tx.Delete(name, *(&Record{}).AddInt64("k", 2))
+		is.Nil(t, err)
+	}
+	r.commit(tx)
+	seq1 := r.db.Seq()
+	is.Equal(t, []string{"1 1 a", "1 2 b", "1 3 c", "2 1 A", "3 2"}, readChangeLog(t, &r.db, "full", seq0))
+	is.Equal(t, []string{"1 1", "1 2", "1 3", "2 1", "3 2"}, readChangeLog(t, &r.db, "keys", seq0))
+	_, err := r.db.ReadChanges("plain", 0)
+	is.Error(t, err)
+	_, err = r.db.ReadChanges("nope", 0)
+	is.Error(t, err)
+
+	// rolled back and aborted writes are not logged
+	tx = r.begin()
+	sp := tx.Savepoint()
+	_, err = tx.Insert("full", row(4, "d"))
+	is.Nil(t, err)
+	is.Nil(t, tx.RollbackTo(sp))
+	_, err = tx.DeleteRange("full", *(&Record{}).AddInt64("k", 3), *(&Record{}).AddInt64("k", 3),
+		btree_iter.CMP_GE, btree_iter.CMP_LE)
+	is.Nil(t, err)
+	r.commit(tx)
+	tx = r.begin()
+	_, err = tx.Insert("full", row(5, "e"))
+	is.Nil(t, err)
+	r.db.Abort(tx)
+	is.Equal(t, []string{"3 3"}, readChangeLog(t, &r.db, "full", seq1))
+
+	// concurrent writers don't conflict on the log
+	tx1, tx2 := r.begin(), r.begin()
+	_, err = tx1.Insert("full", row(6, "f"))
+	is.Nil(t, err)
+	_, err = tx2.Insert("full", row(7, "g"))
+	is.Nil(t, err)
+	is.Nil(t, r.db.Commit(tx2))
+	is.Nil(t, r.db.Commit(tx1))
+	seq2 := r.db.Seq()
+	is.Equal(t, []string{"1 7 g", "1 6 f"}, readChangeLog(t, &r.db, "full", seq2-2))
+
+	// trimmed up to a commit
+	n, err := r.db.TrimChanges(seq1)
+	is.Nil(t, err)
+	is.Equal(t, int64(10), n)
+	is.Equal(t, []string{"3 3", "1 7 g", "1 6 f"}, readChangeLog(t, &r.db, "full", 0))
+	is.Empty(t, readChangeLog(t, &r.db, "keys", 0))
+
+	// an iterator reads a snapshot
+	iter, err := r.db.ReadChanges("full", 0)
+	is.Nil(t, err)
+	r.add("full", *row(8, "h"))
+	count := 0
+	for ; iter.Valid(); iter.Next() {
+		count++
+	}
+	iter.Close()
+	iter.Close()
+	is.Equal(t, 3, count)
+
+	// not with a bulk load
+	_, err = r.db.Load("keys", func() (*Record, bool) { return nil, false })
+	is.Error(t, err)
+
+	// dropped with the table, since the prefix is reused
+	tx = r.begin()
+	_, err = tx.Insert("keys", row(9, "i"))
+	is.Nil(t, err)
+	r.commit(tx)
+	tx = r.begin()
+	is.Nil(t, tx.TableDrop("full"))
+	r.commit(tx)
+	is.Equal(t, []string{"1 9"}, readChangeLog(t, &r.db, "keys", 0))
+	tx = r.begin()
+	is.Len(t, rawKeys(tx, TDEF_CHANGES.Prefixes[0]), 1)
+	r.commit(tx)
+	is.Nil(t, r.db.Check())
+
+	// the log survives a reopen
+	r.db.Close()
+	r.db = DB{Path: r.db.Path}
+	is.Nil(t, r.db.Open())
+	is.Equal(t, []string{"1 9"}, readChangeLog(t, &r.db, "keys", 0))
+
+	bad := tdef("bad")
+	bad.ChangeValues = true
+	tx = r.begin()
+	is.Error(t, tx.TableNew(bad))
+	r.db.Abort(tx)
+}
+
+// the rows of every user table
+func scanAll(t *testing.T, db *DB) map[string][]string {
+	tx := DBTX{}
+	db.BeginRead(&tx)
+	defer db.Abort(&tx)
+	names, err := tx.ListTables()
+	is.Nil(t, err)
+	out := map[string][]string{}
+	for _, name := range names {
+		sc := Scanner{Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE}
+		is.Nil(t, tx.Scan(name, &sc))
+		rows := []string{}
+		for ; sc.Valid(); sc.Next() {
+			rec := Record{}
+			is.Nil(t, sc.Deref(&rec))
+			rows = append(rows, fmt.Sprint(rec))
+		}
+		is.Nil(t, sc.Err())
+		sc.Close()
+		out[name] = rows
+	}
+	return out
+}
+
+func TestTableReplication(t *testing.T) {
+	defer os.Remove("r_replica.db")
+	defer os.Remove("r.db-changes")
+	os.Remove("r.db-changes")
+	os.Remove("r_replica.db")
+	r := newR()
+	defer r.dispose()
+	r.db.Close()
+	r.db = DB{Path: r.db.Path, Options: Options{Changes: true}}
+	is.Nil(t, r.db.Open())
+	replica := DB{Path: "r_replica.db"}
+	is.Nil(t, replica.Open())
+	defer replica.Close()
+
+	sync := func() {
+		applied, err := replica.AppliedSeq()
+		is.Nil(t, err)
+		buf := bytes.Buffer{}
+		is.Nil(t, r.db.StreamChanges(applied+1, &buf))
+		is.Nil(t, replica.ApplyStream(&buf))
+		applied, err = replica.AppliedSeq()
+		is.Nil(t, err)
+		is.Equal(t, r.db.Seq(), applied)
+		is.Equal(t, scanAll(t, &r.db), scanAll(t, &replica))
+	}
+	tdef := func(name string) *TableDef {
+		return &TableDef{
+			Name:    name,
+			Cols:    []string{"k", "v", "n"},
+			Types:   []uint32{TYPE_INT64, TYPE_BYTES, TYPE_INT64},
+			Indexes: [][]string{{"k"}, {"v"}},
+			AutoInc: true,
+		}
+	}
+	workload := func(table string, seed int) {
+		for i := 0; i < 20; i++ {
+			tx := r.begin()
+			for j := 0; j < 10; j++ {
+				k := int64(fmix32(uint32(seed*1000+i*10+j)) % 100)
+				rec := (&Record{}).AddInt64("k", k).AddStr("v", []byte(fmt.Sprint(seed, i, j))).AddInt64("n", int64(j))
+				var err error
+				switch j % 3 {
+				case 0, 1:
+					_, err = tx.Upsert(table, *rec)
+				case 2:
+					_, err = tx.Delete(table, *(&Record{}).AddInt64("k", k))
+				}
+				is.Nil(t, err)
+			}
+			_, err := tx.Insert(table, (&Record{}).AddStr("v", []byte("auto")).AddInt64("n", 0))
+			is.Nil(t, err)
+			r.commit(tx)
+		}
+	}
+
+	r.create(tdef("t1"))
+	workload("t1", 1)
+	sync()
+
+	// a new table and more writes
+	r.create(tdef("t2"))
+	workload("t1", 2)
+	workload("t2", 3)
+	sync()
+	tx := DBTX{}
+	replica.BeginRead(&tx)
+	is.NotNil(t, testTableDef(&tx, "t2"))
+	replica.Abort(&tx)
+	is.Nil(t, replica.Check())
+
+	// applied commits are skipped
+	workload("t2", 4)
+	full := bytes.Buffer{}
+	is.Nil(t, r.db.StreamChanges(1, &full))
+	is.Nil(t, replica.ApplyStream(bytes.NewReader(full.Bytes())))
+	is.Equal(t, scanAll(t, &r.db), scanAll(t, &replica))
+	is.Nil(t, replica.ApplyStream(bytes.NewReader(full.Bytes())))
+
+	// a gap fails before anything is applied
+	workload("t1", 5)
+	workload("t1", 6)
+	applied := r.db.Seq()
+	workload("t2", 7)
+	gapped := bytes.Buffer{}
+	is.Nil(t, r.db.StreamChanges(applied+1, &gapped))
+	is.ErrorIs(t, replica.ApplyStream(&gapped), ErrReplicaGap)
+	seq, err := replica.AppliedSeq()
+	is.Nil(t, err)
+	is.Less(t, seq, applied)
+
+	// a stream cut off in a record applies the commits before it
+	cut := bytes.Buffer{}
+	is.Nil(t, r.db.StreamChanges(seq+1, &cut))
+	is.Error(t, replica.ApplyStream(bytes.NewReader(cut.Bytes()[:cut.Len()-1])))
+	seq2, err := replica.AppliedSeq()
+	is.Nil(t, err)
+	is.Equal(t, r.db.Seq()-1, seq2)
+	sync()
+
+	// out of order
+	stream := bytes.Buffer{}
+	is.Nil(t, r.db.StreamChanges(1, &stream))
+	data := stream.Bytes()
+	first := 24 + int(binary.LittleEndian.Uint32(data[28:32])) + 8
+	second := first + int(binary.LittleEndian.Uint32(data[first+4:first+8])) + 8
+	swapped := slices.Concat(data[:24], data[first:second], data[24:first], data[second:])
+	is.ErrorContains(t, replica.ApplyStream(bytes.NewReader(swapped)), "bad change stream")
+	is.Equal(t, scanAll(t, &r.db), scanAll(t, &replica))
+}
+
+func TestTableSync(t *testing.T) {
+	defer os.Remove("r_sync.db")
+	os.Remove("r_sync.db")
+	r := newR()
+	defer r.dispose()
+	other := DB{Path: "r_sync.db"}
+	is.Nil(t, other.Open())
+	defer other.Close()
+
+	items := func() *TableDef {
+		return &TableDef{
+			Name:    "items",
+			Cols:    []string{"k", "v", SYNC_UPDATED_AT},
+			Types:   []uint32{TYPE_INT64, TYPE_BYTES, TYPE_TIMESTAMP},
+			Indexes: [][]string{{"k"}, {"v"}},
+		}
+	}
+	notes := func() *TableDef {
+		return &TableDef{
+			Name:    "notes",
+			Cols:    []string{"k", "v"},
+			Types:   []uint32{TYPE_BYTES, TYPE_BYTES},
+			Indexes: [][]string{{"k"}},
+		}
+	}
+	write := func(db *DB, table string, recs ...*Record) {
+		tx := DBTX{}
+		db.Begin(&tx)
+		for _, rec := range recs {
+			_, err := tx.Upsert(table, *rec)
+			is.Nil(t, err)
+		}
+		is.Nil(t, db.Commit(&tx))
+	}
+	item := func(k int64, v string, at int64) *Record {
+		return (&Record{}).AddInt64("k", k).AddStr("v", []byte(v)).AddTime(SYNC_UPDATED_AT, time.Unix(at, 0))
+	}
+	note := func(k string, v string) *Record {
+		return (&Record{}).AddStr("k", []byte(k)).AddStr("v", []byte(v))
+	}
+
+	// the prefixes differ on both sides
+	r.create(&TableDef{Name: "local", Cols: []string{"k"}, Types: []uint32{TYPE_INT64}, Indexes: [][]string{{"k"}}})
+	r.create(items())
+	r.create(notes())
+	tx := DBTX{}
+	other.Begin(&tx)
+	is.Nil(t, tx.TableNew(notes()))
+	is.Nil(t, tx.TableNew(items()))
+	is.Nil(t, other.Commit(&tx))
+
+	write(&r.db, "items", item(1, "a", 10), item(2, "b", 10), item(3, "c", 20), item(5, "e", 10))
+	write(&other, "items", item(2, "b", 10), item(3, "C", 10), item(4, "d", 10), item(5, "E", 30), item(6, "f", 10))
+	write(&r.db, "notes", note("x", "1"), note("y", "2"))
+	write(&other, "notes", note("y", "3"), note("z", "4"))
+	write(&r.db, "local", (&Record{}).AddInt64("k", 1))
+
+	// the later row wins; notes have no time, so the conflict is left
+	res, err := r.db.SyncWith(&other, SyncOptions{})
+	is.Nil(t, err)
+	is.Equal(t, SyncResult{Pushed: 1 + 1 + 1, Pulled: 2 + 1 + 1, Conflicted: 2 + 1}, res)
+	rows1, rows2 := scanAll(t, &r.db), scanAll(t, &other)
+	is.Equal(t, rows1["items"], rows2["items"])
+	is.Equal(t, []string{
+		fmt.Sprint(*item(1, "a", 10)), fmt.Sprint(*item(2, "b", 10)), fmt.Sprint(*item(3, "c", 20)),
+		fmt.Sprint(*item(4, "d", 10)), fmt.Sprint(*item(5, "E", 30)), fmt.Sprint(*item(6, "f", 10)),
+	}, rows1["items"])
+	is.NotEqual(t, rows1["notes"], rows2["notes"])
+	is.Len(t, rows1["notes"], 3)
+	is.Len(t, rows2["notes"], 3)
+	is.NotContains(t, rows2, "local")
+
+	// a resolver
+	concat := func(local, remote *Record) *Record {
+		v := slices.Concat(local.Get("v").Str, remote.Get("v").Str)
+		return note(string(local.Get("k").Str), string(v))
+	}
+	res, err = r.db.SyncWith(&other, SyncOptions{Tables: []string{"notes"}, Resolve: concat})
+	is.Nil(t, err)
+	is.Equal(t, SyncResult{Pushed: 1, Pulled: 1, Conflicted: 1}, res)
+	rows1, rows2 = scanAll(t, &r.db), scanAll(t, &other)
+	is.Equal(t, rows1["notes"], rows2["notes"])
+	is.Contains(t, rows1["notes"], fmt.Sprint(*note("y", "23")))
+
+	// nothing left to do
+	res, err = r.db.SyncWith(&other, SyncOptions{})
+	is.Nil(t, err)
+	is.Equal(t, SyncResult{}, res)
+
+	// the primary key can't be changed, and nothing is written on errors
+	write(&other, "notes", note("y", "5"))
+	_, err = r.db.SyncWith(&other, SyncOptions{Resolve: func(local, remote *Record) *Record {
+		return note("w", "")
+	}})
+	is.Error(t, err)
+	is.Equal(t, rows1, scanAll(t, &r.db))
+	_, err = r.db.SyncWith(&other, SyncOptions{Tables: []string{"local"}})
+	is.Error(t, err)
+
+	// the same schema is required
+	tx2 := DBTX{}
+	other.Begin(&tx2)
+	is.Nil(t, tx2.TableNew(&TableDef{Name: "local", Cols: []string{"k"}, Types: []uint32{TYPE_BYTES}, Indexes: [][]string{{"k"}}}))
+	is.Nil(t, other.Commit(&tx2))
+	_, err = r.db.SyncWith(&other, SyncOptions{})
+	is.ErrorContains(t, err, "schemas differ")
+
+	is.Nil(t, r.db.Check())
+	is.Nil(t, other.Check())
+}
+
+func TestTableDumpRestore(t *testing.T) {
+	defer os.Remove("r_dump.db")
+	os.Remove("r_dump.db")
+	r := newR()
+	defer r.dispose()
+
+	tx := r.begin()
+	is.Nil(t, tx.TableNew(&TableDef{
+		Name:     "all",
+		Cols:     []string{"k", "s", "f", "b", "ts", "n"},
+		Types:    []uint32{TYPE_INT64, TYPE_BYTES, TYPE_FLOAT64, TYPE_BOOL, TYPE_TIMESTAMP, TYPE_BYTES},
+		Indexes:  [][]string{{"k"}, {"s"}},
+		Unique:   []bool{false, true},
+		Nullable: []bool{false, false, false, false, false, true},
+	}))
+	is.Nil(t, tx.TableNew(&TableDef{
+		Name: "auto", Cols: []string{"id", "v"}, Types: []uint32{TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"id"}}, AutoInc: true,
+	}))
+	is.Nil(t, tx.TableNew(&TableDef{
+		Name: "logged", Cols: []string{"k", "v"}, Types: []uint32{TYPE_BYTES, TYPE_INT64},
+		Indexes: [][]string{{"k"}}, Changes: true,
+	}))
+	is.Nil(t, tx.TableNew(&TableDef{
+		Name: "empty", Cols: []string{"k"}, Types: []uint32{TYPE_INT64}, Indexes: [][]string{{"k"}},
+	}))
+	for i := int64(-50); i < 50; i++ {
+		rec := (&Record{}).AddInt64("k", i).AddStr("s", []byte{0xff, byte(i), '\n', '"'})
+		rec.AddFloat64("f", float64(i)/3).AddBool("b", i%2 == 0)
+		rec.AddTime("ts", time.Unix(0, i*1e9).UTC())
+		if i%3 == 0 {
+			rec.AddNull("n")
+		} else {
+			rec.AddStr("n", []byte(fmt.Sprint(i)))
+		}
+		_, err := tx.Insert("all", rec)
+		is.Nil(t, err)
+	}
+	for i, f := range []float64{math.Inf(1), math.Inf(-1), 0, 1e300} {
+		rec := (&Record{}).AddInt64("k", int64(1000+i)).AddStr("s", []byte(fmt.Sprint(f)))
+		rec.AddFloat64("f", f).AddBool("b", true).AddTime("ts", time.Unix(0, 0)).AddNull("n")
+		_, err := tx.Upsert("all", *rec)
+		is.Nil(t, err)
+	}
+	for i := 0; i < 10; i++ {
+		_, err := tx.Insert("auto", (&Record{}).AddStr("v", []byte("x")))
+		is.Nil(t, err)
+		_, err = tx.Insert("logged", (&Record{}).AddStr("k", []byte(fmt.Sprint(i))).AddInt64("v", int64(i)))
+		is.Nil(t, err)
+	}
+	_, err := tx.Delete("auto", *(&Record{}).AddInt64("id", 10)) // the counter stays at 11
+	is.Nil(t, err)
+	r.commit(tx)
+
+	dump1 := bytes.Buffer{}
+	is.Nil(t, r.db.Dump(&dump1))
+	is.True(t, utf8.Valid(dump1.Bytes()))
+	lines := strings.Split(dump1.String(), "\n")
+	is.Equal(t, `{"dump":"AdiDB","version":1}`, lines[0])
+	is.Contains(t, dump1.String(), `"autoinc":11}`)
+	is.Contains(t, dump1.String(), `,"+Inf",`)
+	is.Equal(t, 1+4+104+9+10+1, len(lines))
+
+	// dump, restore, dump
+	other := DB{Path: "r_dump.db"}
+	is.Nil(t, other.Open())
+	defer other.Close()
+	is.Nil(t, other.Restore(bytes.NewReader(dump1.Bytes()), RestoreOptions{}))
+	dump2 := bytes.Buffer{}
+	is.Nil(t, other.Dump(&dump2))
+	is.Equal(t, dump1.String(), dump2.String())
+	is.Equal(t, scanAll(t, &r.db), scanAll(t, &other))
+	is.Nil(t, other.Check())
+
+	tx2 := DBTX{}
+	other.Begin(&tx2)
+	rec := (&Record{}).AddStr("v", []byte("y"))
+	_, err = tx2.Insert("auto", rec)
+	is.Nil(t, err)
+	is.Equal(t, int64(11), rec.Get("id").I64)
+	other.Abort(&tx2)
+
+	// a non-empty DB needs Merge, which replaces the rows by primary key
+	err = other.Restore(bytes.NewReader(dump1.Bytes()), RestoreOptions{})
+	is.ErrorContains(t, err, "RestoreOptions.Merge")
+	tx3 := DBTX{}
+	other.Begin(&tx3)
+	_, err = tx3.Upsert("logged", *(&Record{}).AddStr("k", []byte("1")).AddInt64("v", -1))
+	is.Nil(t, err)
+	_, err = tx3.Insert("empty", (&Record{}).AddInt64("k", 7))
+	is.Nil(t, err)
+	is.Nil(t, other.Commit(&tx3))
+	is.Nil(t, other.Restore(bytes.NewReader(dump1.Bytes()), RestoreOptions{Merge: true}))
+	dump3 := bytes.Buffer{}
+	is.Nil(t, other.Dump(&dump3))
+	is.NotEqual(t, dump1.String(), dump3.String())
+	is.Equal(t, strings.Replace(dump1.String(), "\n{\"table\":{\"Name\":\"logged\"", "\n[7]\n{\"table\":{\"Name\":\"logged\"", 1), dump3.String())
+
+	// the schema must be the same for a merge
+	bad := strings.Replace(dump1.String(), `"Name":"empty","Types":[2]`, `"Name":"empty","Types":[1]`, 1)
+	is.NotEqual(t, bad, dump1.String())
+	err = other.Restore(strings.NewReader(bad), RestoreOptions{Merge: true})
+	is.ErrorContains(t, err, "schema differs")
+
+	// bad input
+	for _, in := range []string{
+		"",
+		"{}\n",
+		`{"dump":"AdiDB","version":2}`,
+		"{\"dump\":\"AdiDB\",\"version\":1}\n[1]\n",
+		"{\"dump\":\"AdiDB\",\"version\":1}\n{\"table\":{\"Name\":\"t\",\"Types\":[2],\"Cols\":[\"k\"],\"Indexes\":[[\"k\"]]}}\n[\"x\"]\n",
+		"{\"dump\":\"AdiDB\",\"version\":1}\n{\"table\":{\"Name\":\"u\",\"Types\":[2],\"Cols\":[\"k\"],\"Indexes\":[[\"k\"]]}}\n[1,2]\n",
+	} {
+		os.Remove("r_dump2.db")
+		db := DB{Path: "r_dump2.db"}
+		is.Nil(t, db.Open())
+		is.Error(t, db.Restore(strings.NewReader(in), RestoreOptions{}), in)
+		db.Close()
+	}
+	os.Remove("r_dump2.db")
+}
+
+func TestTableJSON(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	tx := r.begin()
+	is.Nil(t, tx.TableNew(&TableDef{
+		Name:     "docs",
+		Cols:     []string{"id", "s", "f", "b", "ts", "n"},
+		Types:    []uint32{TYPE_INT64, TYPE_BYTES, TYPE_FLOAT64, TYPE_BOOL, TYPE_TIMESTAMP, TYPE_INT64},
+		Indexes:  [][]string{{"id"}, {"s"}},
+		Unique:   []bool{false, true},
+		Nullable: []bool{false, false, false, false, false, true},
+		AutoInc:  true,
+	}))
+	r.commit(tx)
+
+	in := `[
+		{"id": 9007199254740993, "s": "héllo", "f": 0.1, "b": true, "ts": "2024-01-02T03:04:05.123456789Z", "n": null},
+		{"id": -1, "s": {"base64": "/wA="}, "f": "-Inf", "b": false, "ts": 5, "n": -9223372036854775808},
+		{"s": "auto", "f": 1e300, "b": false, "ts": "2024-01-02T04:04:05+01:00"}
+	]`
+	n, err := r.db.ImportJSON("docs", strings.NewReader(in), ImportOptions{})
+	is.Nil(t, err)
+	is.Equal(t, 3, n)
+
+	out := bytes.Buffer{}
+	is.Nil(t, r.db.ExportJSON("docs", &out))
+	expected := `{"id":-1,"s":{"base64":"/wA="},"f":"-Inf","b":false,"ts":"1970-01-01T00:00:00.000000005Z","n":-9223372036854775808}
+{"id":9007199254740993,"s":"héllo","f":0.1,"b":true,"ts":"2024-01-02T03:04:05.123456789Z","n":null}
+{"id":9007199254740994,"s":"auto","f":1e+300,"b":false,"ts":"2024-01-02T03:04:05Z","n":null}
+`
+	is.Equal(t, expected, out.String())
+
+	// NDJSON round trip, with upserts
+	n, err = r.db.ImportJSON("docs", strings.NewReader(strings.Replace(expected, `"héllo"`, `"bye"`, 1)), ImportOptions{})
+	is.Nil(t, err)
+	is.Equal(t, 3, n)
+	out2 := bytes.Buffer{}
+	is.Nil(t, r.db.ExportJSON("docs", &out2))
+	is.Equal(t, strings.Replace(expected, `"héllo"`, `"bye"`, 1), out2.String())
+	n, err = r.db.ImportJSON("docs", strings.NewReader(" \n"), ImportOptions{})
+	is.Nil(t, err)
+	is.Equal(t, 0, n)
+
+	// unknown fields
+	unknown := `{"id": 1, "s": "x", "f": 0, "b": true, "ts": 0, "extra": [1]}`
+	_, err = r.db.ImportJSON("docs", strings.NewReader(unknown), ImportOptions{})
+	is.ErrorContains(t, err, "record 0: unknown column: extra")
+	n, err = r.db.ImportJSON("docs", strings.NewReader(unknown), ImportOptions{IgnoreUnknown: true})
+	is.Nil(t, err)
+	is.Equal(t, 1, n)
+
+	// a bad row fails the whole import, with its index
+	for _, bad := range []string{
+		`{"id": 2, "s": "a", "f": 0, "b": true, "ts": 0}` + "\n" + `{"id": 1.5, "s": "b", "f": 0, "b": true, "ts": 0}`,
+		`[{"id": 2, "s": "a", "f": 0, "b": true, "ts": 0}, {"id": 3, "s": {"x": 1}, "f": 0, "b": true, "ts": 0}]`,
+		`[{"id": 2, "s": "a", "f": 0, "b": true, "ts": 0}, {"id": 3, "s": "b", "f": 0, "b": 1, "ts": 0}]`,
+		`[{"id": 2, "s": "a", "f": 0, "b": true, "ts": 0}, {"id": 3, "s": "bye", "f": 0, "b": true, "ts": 0}]`,
+		`[{"id": 2, "s": "a", "f": 0, "b": true, "ts": 0}, {"id": 3, "f": 0, "b": true, "ts": 0}]`,
+		`[{"id": 2, "s": "a", "f": 0, "b": true, "ts": 0}, {"id": 99999999999999999999, "s": "b", "f": 0, "b": true, "ts": 0}]`,
+		`[{"id": 2, "s": "a", "f": 0, "b": true, "ts": 0}, [3]]`,
+	} {
+		_, err = r.db.ImportJSON("docs", strings.NewReader(bad), ImportOptions{})
+		is.ErrorContains(t, err, "record 1:", bad)
+	}
+	_, err = r.db.ImportJSON("nope", strings.NewReader("[]"), ImportOptions{})
+	is.Error(t, err)
+	is.Error(t, r.db.ExportJSON("nope", &out))
+
+	out3 := bytes.Buffer{}
+	is.Nil(t, r.db.ExportJSON("docs", &out3))
+	is.Equal(t, 4, strings.Count(out3.String(), "\n"))
+	is.NotContains(t, out3.String(), `"id":2,`)
+	is.Nil(t, r.db.Check())
+}
+
+type testUser struct {
+	ID      int64     `db:"id,pk"`
+	Name    string    `db:"name"`
+	Avatar  []byte    `db:"avatar"`
+	Score   *float64  `db:"score"`
+	Admin   bool      `db:"admin"`
+	Created time.Time `db:"created"`
+	Visits  int       `db:"visits"`
+	cache   string
+}
+
+func TestTableStruct(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+
+	tdef, err := StructTableDef("users", &testUser{})
+	is.Nil(t, err)
+	is.Equal(t, []string{"id", "name", "avatar", "score", "admin", "created", "visits"}, tdef.Cols)
+	is.Equal(t, []uint32{TYPE_INT64, TYPE_BYTES, TYPE_BYTES, TYPE_FLOAT64, TYPE_BOOL, TYPE_TIMESTAMP, TYPE_INT64}, tdef.Types)
+	is.Equal(t, [][]string{{"id"}}, tdef.Indexes)
+	is.Equal(t, []bool{false, false, false, true, false, false, false}, tdef.Nullable)
+	tdef.Indexes = append(tdef.Indexes, []string{"name"})
+	r.create(tdef)
+
+	score := 2.5
+	now := time.Unix(1700000000, 123).UTC()
+	users := []testUser{
+		{ID: 1, Name: "ann", Avatar: []byte{0, 1}, Score: &score, Admin: true, Created: now, Visits: 3},
+		{ID: 2, Name: "bob", Created: now.Add(time.Hour)},
+		{ID: 3, Name: "cy", Avatar: []byte{}, Created: now.Add(-time.Hour), Visits: -1},
+	}
+	for i := range users {
+		ok, err := r.db.InsertStruct("users", users[i])
+		is.Nil(t, err)
+		is.True(t, ok)
+	}
+	ok, err := r.db.InsertStruct("users", &users[0])
+	is.Nil(t, err)
+	is.False(t, ok)
+
+	// by the primary key
+	for _, u := range users {
+		got := testUser{ID: u.ID, cache: "x"}
+		ok, err := r.db.GetStruct("users", &got)
+		is.Nil(t, err)
+		is.True(t, ok)
+		is.Equal(t, "x", got.cache)
+		got.cache = ""
+		if u.Avatar == nil {
+			u.Avatar = []byte{}
+		}
+		is.True(t, u.Created.Equal(got.Created))
+		u.Created, got.Created = time.Time{}, time.Time{}
+		is.Equal(t, u, got)
+	}
+	got := testUser{ID: 9}
+	ok, err = r.db.GetStruct("users", &got)
+	is.Nil(t, err)
+	is.False(t, ok)
+
+	// a scan, with a subset of the columns
+	tx := DBTX{}
+	r.db.BeginRead(&tx)
+	sc := Scanner{Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE, Cols: []string{"id", "name"}}
+	sc.Key1.AddStr("name", []byte("b"))
+	sc.Key2.AddStr("name", []byte("z"))
+	is.Nil(t, tx.Scan("users", &sc))
+	names := []string{}
+	for ; sc.Valid(); sc.Next() {
+		u := testUser{Visits: 7}
+		is.Nil(t, sc.DerefStruct(&u))
+		is.Equal(t, 7, u.Visits)
+		names = append(names, fmt.Sprint(u.ID, u.Name))
+	}
+	is.Equal(t, []string{"2bob", "3cy"}, names)
+	is.Error(t, sc.DerefStruct(testUser{}))
+	sc.Close()
+	r.db.Abort(&tx)
+
+	// the errors
+	type badKind struct {
+		ID  int64   `db:"id"`
+		Map []int32 `db:"m"`
+	}
+	_, err = r.db.InsertStruct("users", badKind{})
+	is.ErrorContains(t, err, "field Map")
+	_, err = StructTableDef("x", badKind{})
+	is.ErrorContains(t, err, "field Map")
+	type noKey struct {
+		Name string `db:"name"`
+	}
+	_, err = r.db.GetStruct("users", &noKey{})
+	is.ErrorContains(t, err, "primary key column: id")
+	type wrongType struct {
+		ID   int64 `db:"id"`
+		Name int64 `db:"name"`
+	}
+	_, err = r.db.GetStruct("users", &wrongType{ID: 1})
+	is.ErrorContains(t, err, "field Name")
+	type notNull struct {
+		ID    int64   `db:"id"`
+		Score float64 `db:"score"`
+	}
+	_, err = r.db.GetStruct("users", &notNull{ID: 2})
+	is.ErrorContains(t, err, "field Score")
+	_, err = r.db.GetStruct("users", got)
+	is.Error(t, err)
+	_, err = r.db.GetStruct("nope", &got)
+	is.Error(t, err)
+}
+
+// a context that is cancelled after `n` calls of Err
+type cancelAfter struct {
+	context.Context
+	n int
+}
+
+func (ctx *cancelAfter) Err() error {
+	if ctx.n--; ctx.n < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestTableContext(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	r.create(&TableDef{
+		Name:    "tbl_test",
+		Cols:    []string{"k", "v"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"k"}},
+	})
+	const N = 2000
+	tx := r.begin()
+	for i := int64(0); i < N; i++ {
+		_, err := tx.Insert("tbl_test", (&Record{}).AddInt64("k", i).AddStr("v", []byte("x")))
+		is.Nil(t, err)
+	}
+	r.commit(tx)
+	all := func(ctx context.Context) *Scanner {
+		sc := &Scanner{Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE, Ctx: ctx}
+		sc.Key1.AddInt64("k", 0)
+		sc.Key2.AddInt64("k", N)
+		return sc
+	}
+
+	// cancelled in the middle of a scan
+	tx = &DBTX{}
+	r.db.BeginRead(tx)
+	ctx, cancel := context.WithCancel(context.Background())
+	sc := all(ctx)
+	is.Nil(t, tx.Scan("tbl_test", sc))
+	n := 0
+	for ; sc.Valid(); sc.Next() {
+		if n++; n == 100 {
+			cancel()
+		}
+	}
+	is.ErrorIs(t, sc.Err(), context.Canceled)
+	is.True(t, n < 100+SCAN_CTX_ROWS, n)
+	sc.Close()
+
+	// while the filter rejects the rows, and in the offset
+	ctx, cancel = context.WithCancel(context.Background())
+	sc = all(ctx)
+	seen := 0
+	sc.Filter = func(rec *Record) bool {
+		if seen++; seen == 10 {
+			cancel()
+		}
+		return seen < 5
+	}
+	is.Nil(t, tx.Scan("tbl_test", sc))
+	for ; sc.Valid(); sc.Next() {
+	}
+	is.ErrorIs(t, sc.Err(), context.Canceled)
+	is.True(t, seen < 10+SCAN_CTX_ROWS, seen)
+	sc.Close()
+	sc = all(ctx)
+	sc.Filter = func(rec *Record) bool { return false }
+	is.ErrorIs(t, tx.Scan("tbl_test", sc), context.Canceled)
+	sc = all(&cancelAfter{Context: context.Background(), n: 2})
+	sc.Offset = N - 1
+	is.ErrorIs(t, tx.Scan("tbl_test", sc), context.Canceled)
+
+	// not started
+	_, err := tx.Count("tbl_test", all(ctx))
+	is.ErrorIs(t, err, context.Canceled)
+	_, err = tx.GetCtx(ctx, "tbl_test", (&Record{}).AddInt64("k", 1))
+	is.ErrorIs(t, err, context.Canceled)
+	ok, err := tx.GetCtx(context.Background(), "tbl_test", (&Record{}).AddInt64("k", 1))
+	is.True(t, ok && err == nil)
+	count, err := tx.Count("tbl_test", all(context.Background()))
+	is.Nil(t, err)
+	is.Equal(t, int64(N), count)
+	r.db.Abort(tx)
+
+	// a DeleteRange stops between the rows: 1 check to seek and 1 per
+	// SCAN_CTX_ROWS rows while the keys are collected, then the deletes
+	key1, key2 := *(&Record{}).AddInt64("k", 0), *(&Record{}).AddInt64("k", N)
+	tx = r.begin()
+	ctx2 := &cancelAfter{Context: context.Background(), n: 1 + N/SCAN_CTX_ROWS}
+	deleted, err := tx.DeleteRangeCtx(ctx2, "tbl_test", key1, key2, btree_iter.CMP_GE, btree_iter.CMP_LT)
+	is.ErrorIs(t, err, context.Canceled)
+	is.Equal(t, int64(SCAN_CTX_ROWS-1), deleted)
+	count, err = tx.Count("tbl_test", all(context.Background()))
+	is.Nil(t, err)
+	is.Equal(t, int64(N-SCAN_CTX_ROWS+1), count)
+	deleted, err = tx.DeleteRangeCtx(ctx, "tbl_test", key1, key2, btree_iter.CMP_GE, btree_iter.CMP_LT)
+	is.ErrorIs(t, err, context.Canceled)
+	is.Zero(t, deleted)
+	r.commit(tx)
+	is.Nil(t, r.db.Check())
+
+	_, err = r.db.VacuumCtx(ctx)
+	is.ErrorIs(t, err, context.Canceled)
+	is.ErrorIs(t, r.db.BackupToCtx(ctx, &bytes.Buffer{}), context.Canceled)
+}
+
+func TestTableErrors(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	tdef := &TableDef{
+		Name:    "tbl_test",
+		Cols:    []string{"k", "v"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"k"}, {"v"}},
+	}
+	r.create(tdef)
+	r.add("tbl_test", *(&Record{}).AddInt64("k", 1).AddStr("v", []byte("a")))
+
+	tx := r.begin()
+	defer r.db.Abort(tx)
+	err := tx.TableNew(&TableDef{Name: "tbl_test", Cols: tdef.Cols, Types: tdef.Types, Indexes: tdef.Indexes})
+	is.ErrorIs(t, err, ErrTableExists)
+	_, err = tx.Get("nope", (&Record{}).AddInt64("k", 1))
+	is.ErrorIs(t, err, ErrTableNotFound)
+	is.ErrorContains(t, err, "nope")
+	is.ErrorIs(t, tx.Scan("nope", &Scanner{}), ErrTableNotFound)
+
+	// the typed errors carry the column
+	_, err = tx.Insert("tbl_test", (&Record{}).AddInt64("k", 2).AddInt64("v", 3))
+	colType := (*ErrBadColumnType)(nil)
+	is.True(t, errors.As(err, &colType))
+	is.Equal(t, "v", colType.Col)
+	is.ErrorIs(t, err, &ErrBadColumnType{})
+	is.ErrorIs(t, err, &ErrBadColumnType{Col: "v"})
+	is.False(t, errors.Is(err, &ErrBadColumnType{Col: "k"}))
+	_, err = tx.Insert("tbl_test", (&Record{}).AddInt64("k", 2))
+	colMissing := (*ErrMissingColumn)(nil)
+	is.True(t, errors.As(err, &colMissing))
+	is.Equal(t, "v", colMissing.Col)
+
+	// not an index, and not a range
+	sc := Scanner{Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE}
+	sc.Key1.AddInt64("k", 1).AddStr("v", []byte("a"))
+	sc.Key2.AddInt64("k", 1).AddStr("v", []byte("a"))
+	is.ErrorIs(t, tx.Scan("tbl_test", &sc), ErrBadRange)
+	sc = Scanner{Cmp1: btree_iter.CMP_LE, Cmp2: btree_iter.CMP_LE}
+	sc.Key1.AddInt64("k", 1)
+	sc.Key2.AddInt64("k", 2)
+	is.ErrorIs(t, tx.Scan("tbl_test", &sc), ErrBadRange)
+
+	// so do the writes refused by their mode, with the table name
+	dbreq := DBUpdateReq{Record: *(&Record{}).AddInt64("k", 9).AddStr("v", nil), Partial: true}
+	_, err = tx.Set("tbl_test", &dbreq)
+	is.ErrorIs(t, err, ErrRecordNotFound)
+	ok, err := tx.Update("tbl_test", *(&Record{}).AddInt64("k", 9).AddStr("v", nil))
+	is.ErrorIs(t, err, ErrRecordNotFound)
+	is.EqualError(t, err, "row not found: tbl_test")
+	is.False(t, ok)
+	_, err = tx.Insert("tbl_test", (&Record{}).AddInt64("k", 1).AddStr("v", nil))
+	is.ErrorIs(t, err, ErrRecordExists)
+	// duplicates are still skipped by a batch
+	n, err := tx.InsertBatch("tbl_test", []Record{
+		*(&Record{}).AddInt64("k", 1).AddStr("v", nil),
+		*(&Record{}).AddInt64("k", 8).AddStr("v", nil),
+	})
+	is.Nil(t, err)
+	is.Equal(t, 1, n)
+}
+
+func TestTableCorrupt(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	tdef := &TableDef{
+		Name:    "tbl_test",
+		Cols:    []string{"k", "v", "n"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES, TYPE_INT64},
+		Indexes: [][]string{{"k"}, {"v"}},
+	}
+	r.create(tdef)
+	r.add("tbl_test", *(&Record{}).AddInt64("k", 0).AddStr("v", []byte("a")).AddInt64("n", 1))
+
+	// rows that don't decode with the schema
+	n8 := encodeValues(nil, []Value{{Type: TYPE_INT64, I64: 1}})
+	bad := [][]byte{
+		slices.Concat(n8, n8),                                    // not BYTES
+		{TYPE_BYTES, 'a'},                                        // unterminated
+		slices.Concat([]byte{TYPE_BYTES, 1, 5, 0}, n8),           // bad escape
+		slices.Concat([]byte{TYPE_BYTES, 'a', 0}, n8, []byte{0}), // trailing
+		slices.Concat([]byte{TYPE_BYTES, 'a', 0}, n8[:5]),        // short
+	}
+	tx := r.begin()
+	for i, val := range bad {
+		key := encodeKey(nil, tdef.Prefixes[0], []Value{{Type: TYPE_INT64, I64: int64(i + 1)}})
+		_, err := tx.kv.Set(key, val)
+		is.Nil(t, err)
+	}
+	r.commit(tx)
+
+	tx = r.begin()
+	defer r.db.Abort(tx)
+	for i := range bad {
+		k := int64(i + 1)
+		_, err := tx.Get("tbl_test", (&Record{}).AddInt64("k", k))
+		is.ErrorIs(t, err, ErrCorrupt, i)
+		is.ErrorContains(t, err, "table tbl_test: bad row")
+		_, err = tx.Delete("tbl_test", *(&Record{}).AddInt64("k", k))
+		is.ErrorIs(t, err, ErrCorrupt, i)
+		_, err = tx.Update("tbl_test", *(&Record{}).AddInt64("k", k).AddStr("v", []byte("b")).AddInt64("n", 2))
+		is.ErrorIs(t, err, ErrCorrupt, i)
+	}
+	sc := Scanner{Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE}
+	sc.Key1.AddInt64("k", 0)
+	sc.Key2.AddInt64("k", 10)
+	is.Nil(t, tx.Scan("tbl_test", &sc))
+	is.Nil(t, sc.Deref(&Record{}))
+	sc.Next()
+	is.ErrorIs(t, sc.Deref(&Record{}), ErrCorrupt)
+
+	// an index key without a row
+	ikey := encodeKey(nil, tdef.Prefixes[1], []Value{{Type: TYPE_BYTES, Str: []byte("z")}, {Type: TYPE_INT64, I64: 99}})
+	_, err := tx.kv.Set(ikey, nil)
+	is.Nil(t, err)
+	sc = Scanner{Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE}
+	sc.Key1.AddStr("v", []byte("z"))
+	sc.Key2.AddStr("v", []byte("z"))
+	is.Nil(t, tx.Scan("tbl_test", &sc))
+	is.True(t, sc.Valid())
+	is.ErrorIs(t, sc.Deref(&Record{}), ErrCorrupt)
+
+	// schemas that don't decode are not missing tables
+	for name, def := range map[string]string{
+		"bad_json":   `{"Name":`,
+		"bad_schema": `{"Name":"bad_schema","Cols":["a"],"Types":[2]}`,
+	} {
+		rec := (&Record{}).AddStr("name", []byte(name)).AddStr("def", []byte(def))
+		_, err := dbUpdate(tx, TDEF_TABLE, &DBUpdateReq{Record: *rec})
+		is.Nil(t, err)
+		_, err = tx.Get(name, (&Record{}).AddInt64("a", 1))
+		is.ErrorIs(t, err, ErrCorrupt, name)
+		is.False(t, errors.Is(err, ErrTableNotFound))
+		_, err = tx.GetTableDef(name)
+		is.ErrorIs(t, err, ErrCorrupt, name)
+	}
+}
+
+// the decoders never panic on the data read from a file, and what they
+// accept is what the encoder writes
+func FuzzTableDecode(f *testing.F) {
+	types := []uint32{TYPE_BYTES, TYPE_INT64, TYPE_BOOL, TYPE_FLOAT64, TYPE_TIMESTAMP}
+	shapes := [][]uint32{{TYPE_BYTES, TYPE_INT64, TYPE_BYTES}}
+	for _, a := range types {
+		shapes = append(shapes, []uint32{a})
+		for _, b := range types {
+			shapes = append(shapes, []uint32{a, b})
+		}
+	}
+	sample := map[uint32]Value{
+		TYPE_BYTES:     {Type: TYPE_BYTES, Str: []byte{'a', 0, 1, 'b'}},
+		TYPE_INT64:     {Type: TYPE_INT64, I64: -3},
+		TYPE_BOOL:      {Type: TYPE_BOOL, I64: 1},
+		TYPE_FLOAT64:   {Type: TYPE_FLOAT64, F64: 1.5},
+		TYPE_TIMESTAMP: {Type: TYPE_TIMESTAMP, I64: 1e18},
+	}
+	for _, shape := range shapes {
+		vals := []Value{}
+		for _, tp := range shape {
+			vals = append(vals, sample[tp])
+		}
+		b := encodeValues(nil, vals)
+		f.Add(b)
+		f.Add(b[:len(b)-1])
+		f.Add(encodeValues(nil, []Value{{Type: TYPE_NULL}, vals[0]}))
+	}
+	f.Add([]byte{TYPE_BYTES, 1, 3, 0})
+	f.Add([]byte{99, 0})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, shape := range shapes {
+			out := make([]Value, len(shape))
+			reset := func() {
+				for i, tp := range shape {
+					out[i] = Value{Type: tp}
+				}
+			}
+			reset()
+			if err := decodeValues(data, out); err == nil {
+				is.Equal(t, data, encodeValues(nil, out))
+			} else {
+				is.ErrorIs(t, err, ErrCorrupt)
+			}
+
+			reset()
+			skip := make([]bool, len(shape))
+			skip[0] = true
+			n, err := decodeValuesShort(data, out, skip, nil)
+			is.True(t, n <= len(out))
+			if err != nil {
+				is.ErrorIs(t, err, ErrCorrupt)
+			}
+
+			reset()
+			if err := decodeKey(data, out); err != nil {
+				is.ErrorIs(t, err, ErrCorrupt)
+			}
+		}
+		if _, err := unescapeString(nil, data); err != nil {
+			is.ErrorIs(t, err, ErrCorrupt)
+		}
+	})
+}
+
+func TestTableLegacySchema(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+
+	// a schema row of the first versions, with a row
+	tx := r.begin()
+	prefix, err := prefixAlloc(tx, 1)
+	is.Nil(t, err)
+	def := fmt.Sprintf(`{"Name":"old","Types":[2,1],"Cols":["k","v"],"Prefix":%d,"PKeys":1}`, prefix)
+	rec := (&Record{}).AddStr("name", []byte("old")).AddStr("def", []byte(def))
+	_, err = dbUpdate(tx, TDEF_TABLE, &DBUpdateReq{Record: *rec})
+	is.Nil(t, err)
+	key := encodeKey(nil, prefix, []Value{{Type: TYPE_INT64, I64: 1}})
+	_, err = tx.kv.Set(key, encodeValues(nil, []Value{{Type: TYPE_BYTES, Str: []byte("a")}}))
+	is.Nil(t, err)
+	r.commit(tx)
+
+	tx = r.begin()
+	tdef, err := tx.GetTableDef("old")
+	is.Nil(t, err)
+	is.Equal(t, [][]string{{"k"}}, tdef.Indexes)
+	is.Equal(t, []uint32{prefix}, tdef.Prefixes)
+	got := (&Record{}).AddInt64("k", 1)
+	ok, err := tx.Get("old", got)
+	is.Nil(t, err)
+	is.True(t, ok)
+	is.Equal(t, "a", string(got.Get("v").Str))
+	ok, err = tx.Insert("old", (&Record{}).AddInt64("k", 2).AddStr("v", []byte("b")))
+	is.Nil(t, err)
+	is.True(t, ok)
+
+	// the next schema change writes the current shape
+	is.Nil(t, tx.TableAddColumn("old", "n", TYPE_INT64, Value{Type: TYPE_INT64}))
+	r.commit(tx)
+	tx = r.begin()
+	rec = (&Record{}).AddStr("name", []byte("old"))
+	ok, err = dbGet(tx, TDEF_TABLE, rec)
+	is.Nil(t, err)
+	is.True(t, ok)
+	is.Contains(t, string(rec.Get("def").Str), `"Indexes":[["k"]]`)
+	r.db.Abort(tx)
+	is.Nil(t, r.db.Check())
+
+	_, err = tableDefDecode([]byte(`{"Name":"x","Types":[2],"Cols":["k"],"PKeys":2}`))
+	is.NotNil(t, err)
+}
+
+func TestTableRowVersion(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	tdef := &TableDef{
+		Name:     "tbl_test",
+		Cols:     []string{"k", "v", "n", "note"},
+		Types:    []uint32{TYPE_INT64, TYPE_BYTES, TYPE_INT64, TYPE_BYTES},
+		Indexes:  [][]string{{"k"}, {"n"}},
+		Nullable: []bool{false, false, false, true},
+		Defaults: []Value{{}, {}, {Type: TYPE_INT64, I64: 7}, {}},
+	}
+	r.create(tdef)
+	vals := func(v string, n ...int64) []Value {
+		out := []Value{{Type: TYPE_BYTES, Str: []byte(v)}}
+		for _, i := range n {
+			out = append(out, Value{Type: TYPE_INT64, I64: i})
+		}
+		return out
+	}
+	key := func(k int64) []byte {
+		return encodeKey(nil, tdef.Prefixes[0], []Value{{Type: TYPE_INT64, I64: k}})
+	}
+	v1 := func(count byte, vals []Value) []byte {
+		return encodeValues([]byte{ROW_V1, count}, vals)
+	}
+
+	// rows as the old code wrote them, and v1 rows with fewer columns
+	rows := map[int64][]byte{
+		1: encodeValues(nil, append(vals("a", 1), Value{Type: TYPE_BYTES, Str: []byte("x")})),
+		2: encodeValues(nil, vals("b")),
+		3: v1(1, vals("c")),
+		4: v1(2, vals("d", 4)),
+	}
+	tx := r.begin()
+	for k, val := range rows {
+		_, err := tx.kv.Set(key(k), val)
+		is.Nil(t, err)
+		// the index key and the counters too, as a row written by the DB
+		n := int64(7)
+		if k == 1 || k == 4 {
+			n = k
+		}
+		ikey := encodeKey(nil, tdef.Prefixes[1], []Value{{Type: TYPE_INT64, I64: n}, {Type: TYPE_INT64, I64: k}})
+		_, err = tx.kv.Set(ikey, nil)
+		is.Nil(t, err)
+		is.Nil(t, statsAdd(tx, tdef, 1, int64(len(key(k))+len(val))))
+	}
+	r.commit(tx)
+	is.Nil(t, r.db.Check())
+
+	want := map[int64][2]Value{
+		1: {{Type: TYPE_INT64, I64: 1}, {Type: TYPE_BYTES, Str: []byte("x")}},
+		2: {{Type: TYPE_INT64, I64: 7}, {Type: TYPE_NULL}},
+		3: {{Type: TYPE_INT64, I64: 7}, {Type: TYPE_NULL}},
+		4: {{Type: TYPE_INT64, I64: 4}, {Type: TYPE_NULL}},
+	}
+	tx = r.begin()
+	for k, w := range want {
+		got := (&Record{}).AddInt64("k", k)
+		ok, err := tx.Get("tbl_test", got)
+		is.Nil(t, err)
+		is.True(t, ok)
+		is.Equal(t, w[0], *got.Get("n"), k)
+		is.Equal(t, w[1], *got.Get("note"), k)
+	}
+	// an update writes the current version
+	_, err := tx.Update("tbl_test", *(&Record{}).AddInt64("k", 2).AddStr("v", []byte("bb")).
+		AddInt64("n", 7).AddNull("note"))
+	is.Nil(t, err)
+	val, ok := tx.kv.Get(key(2))
+	is.True(t, ok)
+	is.Equal(t, v1(3, []Value{vals("bb", 7)[0], vals("bb", 7)[1], {Type: TYPE_NULL}}), val)
+	r.commit(tx)
+	is.Nil(t, r.db.Check())
+
+	// headers that don't fit the schema
+	bad := [][]byte{
+		{ROW_V1 + 1},        // unknown version
+		{ROW_V1},            // no count
+		v1(4, vals("e", 1)), // more columns than the schema
+		v1(2, vals("e")),    // fewer values than the count
+		v1(1, vals("e", 1)), // more values than the count
+	}
+	tx = r.begin()
+	for i, val := range bad {
+		_, err := tx.kv.Set(key(int64(10+i)), val)
+		is.Nil(t, err)
+	}
+	for i := range bad {
+		_, err := tx.Get("tbl_test", (&Record{}).AddInt64("k", int64(10+i)))
+		is.ErrorIs(t, err, ErrCorrupt, i)
+	}
+	r.db.Abort(tx)
+}
+
+func TestTableValidation(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	r.create(&TableDef{
+		Name:     "tbl_test",
+		Cols:     []string{"k", "v", "f", "b", "n"},
+		Types:    []uint32{TYPE_INT64, TYPE_BYTES, TYPE_FLOAT64, TYPE_BOOL, TYPE_INT64},
+		Indexes:  [][]string{{"k"}},
+		Nullable: []bool{false, false, false, false, true},
+	})
+	row := func(k int64) *Record {
+		return (&Record{}).AddInt64("k", k).AddStr("v", []byte("x")).
+			AddFloat64("f", 1).AddBool("b", true).AddInt64("n", 1)
+	}
+	with := func(k int64, col string, v Value) *Record {
+		rec := row(k)
+		*rec.Get(col) = v
+		return rec
+	}
+	without := func(k int64, col string) *Record {
+		rec := row(k)
+		i := slices.Index(rec.Cols, col)
+		rec.Cols = slices.Delete(rec.Cols, i, i+1)
+		rec.Vals = slices.Delete(rec.Vals, i, i+1)
+		return rec
+	}
+	check := func(err error, col string, want uint32, got uint32, record int) {
+		verr := (*ValidationError)(nil)
+		is.True(t, errors.As(err, &verr), "%v", err)
+		is.Equal(t, "tbl_test", verr.Table)
+		is.Equal(t, col, verr.Col)
+		is.Equal(t, want, verr.Want)
+		is.Equal(t, got, verr.Got)
+		is.Equal(t, record, verr.Record)
+	}
+
+	tx := r.begin()
+	defer r.db.Abort(tx)
+	_, err := tx.Insert("tbl_test", with(1, "v", Value{Type: TYPE_INT64, I64: 2}))
+	check(err, "v", TYPE_BYTES, TYPE_INT64, -1)
+	is.ErrorIs(t, err, &ErrBadColumnType{Col: "v"})
+	is.EqualError(t, err, "table tbl_test: bad column type: v (BYTES, not INT64)")
+	_, err = tx.Insert("tbl_test", without(1, "f"))
+	check(err, "f", TYPE_FLOAT64, 0, -1)
+	is.ErrorIs(t, err, &ErrMissingColumn{Col: "f"})
+	_, err = tx.Insert("tbl_test", with(1, "b", Value{Type: TYPE_NULL}))
+	check(err, "b", TYPE_BOOL, TYPE_NULL, -1)
+	_, err = tx.Insert("tbl_test", with(1, "f", Value{Type: TYPE_FLOAT64, F64: math.NaN()}))
+	check(err, "f", TYPE_FLOAT64, TYPE_FLOAT64, -1)
+	_, err = tx.Insert("tbl_test", with(1, "b", Value{Type: TYPE_BOOL, I64: 2}))
+	check(err, "b", TYPE_BOOL, TYPE_BOOL, -1)
+	_, err = tx.Insert("tbl_test", without(1, "n"))
+	is.Nil(t, err)
+	// a partial update checks the supplied columns
+	dbreq := DBUpdateReq{Record: *(&Record{}).AddInt64("k", 1).AddInt64("b", 1), Partial: true}
+	_, err = tx.Set("tbl_test", &dbreq)
+	check(err, "b", TYPE_BOOL, TYPE_INT64, -1)
+
+	// a batch reports every bad record
+	_, err = tx.InsertBatch("tbl_test", []Record{
+		*row(10), *without(11, "v"), *row(12),
+		*with(13, "k", Value{Type: TYPE_BYTES}), *with(14, "n", Value{Type: TYPE_BOOL}),
+	})
+	errs := err.(interface{ Unwrap() []error }).Unwrap()
+	is.Len(t, errs, 3)
+	check(errs[0], "v", TYPE_BYTES, 0, 1)
+	check(errs[1], "k", TYPE_INT64, TYPE_BYTES, 3)
+	check(errs[2], "n", TYPE_INT64, TYPE_BOOL, 4)
+	is.ErrorContains(t, err, "table tbl_test: record 3: bad column type: k (INT64, not BYTES)")
+	ok, err := tx.Get("tbl_test", (&Record{}).AddInt64("k", 10))
+	is.Nil(t, err)
+	is.False(t, ok)
+
+	_, err = tx.MultiGet("tbl_test", []*Record{row(1), (&Record{}).AddStr("k", nil)})
+	check(err, "k", TYPE_INT64, TYPE_BYTES, 1)
+}
+
+func TestTableRecordAccessors(t *testing.T) {
+	now := time.Date(2024, 5, 6, 7, 8, 9, 10, time.UTC)
+	rec := Record{}
+	rec.AddInt64("i", 3).AddStr("s", []byte("x")).AddFloat64("f", 1.5).
+		AddBool("b", true).AddTime("t", now).AddNull("z")
+
+	is.True(t, rec.Has("i"))
+	is.False(t, rec.Has("nope"))
+	i, err := rec.GetInt64("i")
+	is.Nil(t, err)
+	is.Equal(t, int64(3), i)
+	s, err := rec.GetStr("s")
+	is.Nil(t, err)
+	is.Equal(t, "x", string(s))
+	is.Equal(t, 1.5, rec.MustGetFloat64("f"))
+	is.True(t, rec.MustGetBool("b"))
+	is.Equal(t, now, rec.MustGetTime("t"))
+
+	_, err = rec.GetInt64("nope")
+	is.ErrorIs(t, err, &ErrMissingColumn{Col: "nope"})
+	_, err = rec.GetStr("i")
+	is.ErrorIs(t, err, &ErrBadColumnType{Col: "i"})
+	_, err = rec.GetInt64("z")
+	is.ErrorIs(t, err, ErrNullValue)
+	is.Panics(t, func() { rec.MustGetStr("i") })
+	_, err = rec.Get("s").Int64()
+	is.ErrorIs(t, err, &ErrBadColumnType{})
+	b, err := rec.Get("s").Bytes()
+	is.Nil(t, err)
+	is.Equal(t, "x", string(b))
+
+	// Set replaces; the Add methods make a column twice
+	rec.Set("i", Value{Type: TYPE_INT64, I64: 4}).Set("new", Value{Type: TYPE_INT64, I64: 5})
+	is.Equal(t, int64(4), rec.MustGetInt64("i"))
+	is.Equal(t, int64(5), rec.MustGetInt64("new"))
+	is.Len(t, rec.Cols, 7)
+
+	r := newR()
+	defer r.dispose()
+	r.create(&TableDef{
+		Name:    "tbl_test",
+		Cols:    []string{"k", "v"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"k"}},
+	})
+	tx := r.begin()
+	defer r.db.Abort(tx)
+	_, err = tx.Insert("tbl_test", (&Record{}).AddInt64("k", 1).AddStr("v", nil).AddStr("v", []byte("a")))
+	is.ErrorContains(t, err, "duplicate column: v")
+}
+
+func TestTableMigrate(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+
+	version := func() uint64 {
+		v, err := r.db.SchemaVersion()
+		is.Nil(t, err)
+		return v
+	}
+	is.Equal(t, uint64(0), version())
+
+	runs := map[uint64]int{}
+	fail := true
+	m := (&Migrator{}).Add(1, func(tx *DBTX) error {
+		runs[1]++
+		return tx.TableNew(&TableDef{
+			Name:    "users",
+			Cols:    []string{"id", "name"},
+			Types:   []uint32{TYPE_INT64, TYPE_BYTES},
+			Indexes: [][]string{{"id"}},
+		})
+	}).Add(2, func(tx *DBTX) error {
+		runs[2]++
+		return tx.TableAddColumn("users", "email", TYPE_BYTES, Value{Type: TYPE_BYTES})
+	}).Add(3, func(tx *DBTX) error {
+		runs[3]++
+		// the updates of a failed migration are not kept
+		err := tx.TableAddColumn("users", "age", TYPE_INT64, Value{Type: TYPE_INT64})
+		if err == nil && fail {
+			err = errors.New("boom")
+		}
+		return err
+	})
+
+	// fails at 3: the version is at 2 and 3 left nothing
+	n, err := r.db.Migrate(m)
+	is.ErrorContains(t, err, "migration 3: boom")
+	is.Equal(t, 2, n)
+	is.Equal(t, uint64(2), version())
+	tx := r.begin()
+	tdef := testTableDef(tx, "users")
+	r.db.Abort(tx)
+	is.Equal(t, []string{"id", "name", "email"}, tdef.Cols)
+
+	// the next run starts from 3
+	fail = false
+	n, err = r.db.Migrate(m)
+	is.Nil(t, err)
+	is.Equal(t, 1, n)
+	is.Equal(t, uint64(3), version())
+	is.Equal(t, map[uint64]int{1: 1, 2: 1, 3: 2}, runs)
+
+	// concurrent calls apply each migration once
+	runs = map[uint64]int{}
+	m.Add(4, func(tx *DBTX) error {
+		runs[4]++
+		rec := (&Record{}).AddInt64("id", 1).AddStr("name", []byte("a")).
+			AddStr("email", nil).AddInt64("age", 30)
+		_, err := tx.Insert("users", rec)
+		return err
+	})
+	wg := sync.WaitGroup{}
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := r.db.Migrate(m)
+			is.Nil(t, err)
+		}()
+	}
+	wg.Wait()
+	is.Equal(t, map[uint64]int{4: 1}, runs)
+	is.Equal(t, uint64(4), version())
+
+	// survives a reopen
+	r.db.Close()
+	r.db = DB{Path: r.db.Path}
+	is.Nil(t, r.db.Open())
+	is.Equal(t, uint64(4), version())
+	n, err = r.db.Migrate(m)
+	is.Nil(t, err)
+	is.Equal(t, 0, n)
+
+	// the ids must increase
+	_, err = r.db.Migrate((&Migrator{}).Add(2, nil).Add(2, nil))
+	is.ErrorContains(t, err, "ids must increase")
+}
+
+func TestTableDefaults(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+
+	tdef := func() *TableDef {
+		return &TableDef{
+			Name:     "tbl",
+			Cols:     []string{"k", "s", "n", "f", "note"},
+			Types:    []uint32{TYPE_INT64, TYPE_BYTES, TYPE_INT64, TYPE_FLOAT64, TYPE_BYTES},
+			Indexes:  [][]string{{"k"}, {"n"}},
+			Nullable: []bool{false, false, false, true, true},
+			Defaults: []Value{
+				{}, {Type: TYPE_BYTES, Str: []byte("new")}, {Type: TYPE_INT64, I64: 7},
+				{Type: TYPE_FLOAT64, F64: 1.5}, {Type: TYPE_NULL},
+			},
+		}
+	}
+	// type checked at TableNew
+	for _, bad := range []func(*TableDef){
+		func(d *TableDef) { d.Defaults[2] = Value{Type: TYPE_BYTES} },
+		func(d *TableDef) { d.Defaults[1] = Value{Type: TYPE_NULL} },
+		func(d *TableDef) { d.Defaults[0] = Value{Type: TYPE_INT64} },
+	} {
+		d := tdef()
+		bad(d)
+		tx := r.begin()
+		is.NotNil(t, tx.TableNew(d))
+		r.db.Abort(tx)
+	}
+	r.create(tdef())
+
+	get := func(table string, k int64) Record {
+		tx := r.begin()
+		defer r.db.Abort(tx)
+		rec := (&Record{}).AddInt64("k", k)
+		ok, err := tx.Get(table, rec)
+		is.Nil(t, err)
+		is.True(t, ok)
+		return *rec
+	}
+	want := func(k int64, s string, n int64, f Value, note Value) Record {
+		rec := (&Record{}).AddInt64("k", k).AddStr("s", []byte(s)).AddInt64("n", n)
+		rec.Cols = append(rec.Cols, "f", "note")
+		rec.Vals = append(rec.Vals, f, note)
+		return *rec
+	}
+	null := Value{Type: TYPE_NULL}
+
+	// the omitted columns are written with their defaults
+	tx := r.begin()
+	_, err := tx.Insert("tbl", (&Record{}).AddInt64("k", 1))
+	is.Nil(t, err)
+	// an explicit value wins, null included
+	_, err = tx.Insert("tbl", (&Record{}).AddInt64("k", 2).AddStr("s", []byte("x")).
+		AddNull("f").AddStr("note", []byte("y")))
+	is.Nil(t, err)
+	r.commit(tx)
+	is.Equal(t, want(1, "new", 7, Value{Type: TYPE_FLOAT64, F64: 1.5}, null), get("tbl", 1))
+	is.Equal(t, want(2, "x", 7, null, Value{Type: TYPE_BYTES, Str: []byte("y")}), get("tbl", 2))
+
+	// the secondary index has the default
+	tx = r.begin()
+	sc := Scanner{
+		Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE,
+		Key1: *(&Record{}).AddInt64("n", 7), Key2: *(&Record{}).AddInt64("n", 7),
+	}
+	is.Nil(t, tx.Scan("tbl", &sc))
+	count := 0
+	for ; sc.Valid(); sc.Next() {
+		count++
+	}
+	is.Nil(t, sc.Err())
+	sc.Close()
+	r.db.Abort(tx)
+	is.Equal(t, 2, count)
+
+	// an upsert replaces the row, a partial update keeps the old values
+	tx = r.begin()
+	_, err = tx.Upsert("tbl", *(&Record{}).AddInt64("k", 2))
+	is.Nil(t, err)
+	_, err = tx.Update("tbl", *(&Record{}).AddInt64("k", 1).AddInt64("n", 8))
+	is.Nil(t, err)
+	_, err = tx.Set("tbl", &DBUpdateReq{Record: *(&Record{}).AddInt64("k", 1).AddStr("s", []byte("z")), Partial: true})
+	is.Nil(t, err)
+	r.commit(tx)
+	is.Equal(t, want(2, "new", 7, Value{Type: TYPE_FLOAT64, F64: 1.5}, null), get("tbl", 2))
+	is.Equal(t, want(1, "z", 8, Value{Type: TYPE_FLOAT64, F64: 1.5}, null), get("tbl", 1))
+
+	// bulk loads too
+	d := tdef()
+	d.Name = "tbl2"
+	r.create(d)
+	recs := []Record{*(&Record{}).AddInt64("k", 3)}
+	n, err := r.db.Load("tbl2", func() (*Record, bool) {
+		if len(recs) == 0 {
+			return nil, false
+		}
+		rec := &recs[0]
+		recs = recs[1:]
+		return rec, true
+	})
+	is.Nil(t, err)
+	is.Equal(t, 1, n)
+	is.Equal(t, want(3, "new", 7, Value{Type: TYPE_FLOAT64, F64: 1.5}, null), get("tbl2", 3))
+}
+
+func TestTableConstraints(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+
+	ptr := func(v int64) *int64 { return &v }
+	tdef := func() *TableDef {
+		return &TableDef{
+			Name:     "tbl",
+			Cols:     []string{"k", "name", "age", "note"},
+			Types:    []uint32{TYPE_INT64, TYPE_BYTES, TYPE_INT64, TYPE_BYTES},
+			Indexes:  [][]string{{"k"}},
+			Nullable: []bool{false, false, false, true},
+			Checks: []Check{
+				{Col: "name", NonEmpty: true},
+				{Col: "age", Min: ptr(0), Max: ptr(150)},
+				{Col: "note", NonEmpty: true},
+			},
+		}
+	}
+	// checked against the types at TableNew
+	for _, bad := range []Check{
+		{Col: "age", NonEmpty: true},
+		{Col: "name", Min: ptr(1)},
+		{Col: "age", Min: ptr(2), Max: ptr(1)},
+		{Col: "nope", NonEmpty: true},
+	} {
+		d := tdef()
+		d.Checks = append(d.Checks, bad)
+		tx := r.begin()
+		is.NotNil(t, tx.TableNew(d))
+		r.db.Abort(tx)
+	}
+	r.create(tdef())
+	r.db.AddValidator("tbl", "name", func(v Value) error {
+		if v.Str[0] == '_' {
+			return errors.New("reserved name")
+		}
+		return nil
+	})
+
+	row := func(k int64, name string, age int64) Record {
+		return *(&Record{}).AddInt64("k", k).AddStr("name", []byte(name)).AddInt64("age", age)
+	}
+	write := func(req *DBUpdateReq) error {
+		tx := r.begin()
+		_, err := tx.Set("tbl", req)
+		if err != nil {
+			r.db.Abort(tx)
+			return err
+		}
+		r.commit(tx)
+		return nil
+	}
+	violation := func(err error, col string, msg string) {
+		verr := (*ValidationError)(nil)
+		is.ErrorAs(t, err, &verr)
+		is.Equal(t, col, verr.Col)
+		is.ErrorIs(t, err, ErrConstraint)
+		is.ErrorContains(t, err, msg)
+	}
+
+	is.Nil(t, write(&DBUpdateReq{Record: row(1, "a", 30)}))
+	violation(write(&DBUpdateReq{Record: row(2, "", 30)}), "name", "name is empty")
+	violation(write(&DBUpdateReq{Record: row(2, "b", -1)}), "age", "age is less than 0")
+	violation(write(&DBUpdateReq{Record: row(2, "b", 151)}), "age", "age is more than 150")
+	violation(write(&DBUpdateReq{Record: row(2, "_b", 1)}), "name", "name: reserved name")
+	// a NULL is not checked, an empty value is
+	rec := row(2, "b", 1)
+	is.Nil(t, write(&DBUpdateReq{Record: *rec.AddNull("note")}))
+	rec = row(3, "b", 1)
+	violation(write(&DBUpdateReq{Record: *rec.AddStr("note", nil)}), "note", "note is empty")
+
+	// upserts and partial updates check the merged row
+	violation(write(&DBUpdateReq{Record: row(1, "a", 200), Mode: btree.MODE_UPSERT}), "age", "more than")
+	partial := *(&Record{}).AddInt64("k", 1).AddInt64("age", 200)
+	violation(write(&DBUpdateReq{Record: partial, Partial: true}), "age", "more than")
+	partial = *(&Record{}).AddInt64("k", 1).AddInt64("age", 31)
+	is.Nil(t, write(&DBUpdateReq{Record: partial, Partial: true}))
+	tx := r.begin()
+	got := *(&Record{}).AddInt64("k", 1)
+	ok, err := tx.Get("tbl", &got)
+	r.db.Abort(tx)
+	is.Nil(t, err)
+	is.True(t, ok)
+	is.Equal(t, []byte("a"), got.Get("name").Str)
+	is.Equal(t, int64(31), got.Get("age").I64)
+
+	// batches report every failing record
+	tx = r.begin()
+	_, err = tx.InsertBatch("tbl", []Record{row(10, "x", 1), row(11, "", 1), row(12, "y", 999)})
+	r.db.Abort(tx)
+	verrs := []*ValidationError{}
+	for _, e := range err.(interface{ Unwrap() []error }).Unwrap() {
+		verr := (*ValidationError)(nil)
+		is.ErrorAs(t, e, &verr)
+		verrs = append(verrs, verr)
+	}
+	is.Len(t, verrs, 2)
+	is.Equal(t, []int{1, 2}, []int{verrs[0].Record, verrs[1].Record})
+
+	// the checks are stored with the schema, the validators are not
+	r.db.Close()
+	r.db = DB{Path: r.db.Path}
+	is.Nil(t, r.db.Open())
+	violation(write(&DBUpdateReq{Record: row(4, "", 1)}), "name", "empty")
+	is.Nil(t, write(&DBUpdateReq{Record: row(4, "_b", 1)}))
+}
+
+func TestTableForeignKeys(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+
+	r.create(&TableDef{
+		Name:    "users",
+		Cols:    []string{"id", "name"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"id"}},
+	})
+	posts := func() *TableDef {
+		return &TableDef{
+			Name:        "posts",
+			Cols:        []string{"id", "user", "title"},
+			Types:       []uint32{TYPE_INT64, TYPE_INT64, TYPE_BYTES},
+			Indexes:     [][]string{{"id"}, {"user"}},
+			ForeignKeys: []ForeignKey{{Cols: []string{"user"}, Table: "users", Cascade: true}},
+		}
+	}
+	// checked at TableNew
+	for _, bad := range []func(*TableDef){
+		func(d *TableDef) { d.ForeignKeys[0].Table = "nope" },
+		func(d *TableDef) { d.ForeignKeys[0].Table = "@meta" },
+		func(d *TableDef) { d.ForeignKeys[0].Cols = []string{"title"} }, // type
+		func(d *TableDef) { d.ForeignKeys[0].Cols = []string{"user", "id"} },
+		func(d *TableDef) { d.Indexes = d.Indexes[:1] }, // no index
+	} {
+		d := posts()
+		bad(d)
+		tx := r.begin()
+		is.NotNil(t, tx.TableNew(d))
+		r.db.Abort(tx)
+	}
+	r.create(posts())
+	r.create(&TableDef{
+		Name:     "comments",
+		Cols:     []string{"post", "id", "text"},
+		Types:    []uint32{TYPE_INT64, TYPE_INT64, TYPE_BYTES},
+		Indexes:  [][]string{{"post", "id"}},
+		Nullable: []bool{false, false, true},
+		ForeignKeys: []ForeignKey{
+			{Cols: []string{"post"}, Table: "posts", Cascade: true},
+		},
+	})
+	r.create(&TableDef{
+		Name:        "votes",
+		Cols:        []string{"user", "post"},
+		Types:       []uint32{TYPE_INT64, TYPE_INT64},
+		Indexes:     [][]string{{"user", "post"}},
+		ForeignKeys: []ForeignKey{{Cols: []string{"user"}, Table: "users"}},
+	})
+
+	insert := func(table string, rec *Record) error {
+		tx := r.begin()
+		_, err := tx.Insert(table, rec)
+		if err != nil {
+			r.db.Abort(tx)
+			return err
+		}
+		r.commit(tx)
+		return nil
+	}
+	user := func(id int64) *Record { return (&Record{}).AddInt64("id", id).AddStr("name", nil) }
+	post := func(id, user int64) *Record {
+		return (&Record{}).AddInt64("id", id).AddInt64("user", user).AddStr("title", nil)
+	}
+	comment := func(post, id int64) *Record {
+		return (&Record{}).AddInt64("post", post).AddInt64("id", id).AddNull("text")
+	}
+	count := func(table string) int {
+		tx := r.begin()
+		defer r.db.Abort(tx)
+		n := 0
+		sc := Scanner{Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE}
+		is.Nil(t, tx.Scan(table, &sc))
+		defer sc.Close()
+		for ; sc.Valid(); sc.Next() {
+			n++
+		}
+		return n
+	}
+
+	// orphans are rejected
+	err := insert("posts", post(1, 1))
+	is.ErrorIs(t, err, ErrForeignKey)
+	verr := (*ValidationError)(nil)
+	is.ErrorAs(t, err, &verr)
+	is.Equal(t, "user", verr.Col)
+	is.Nil(t, insert("users", user(1)))
+	is.Nil(t, insert("users", user(2)))
+	is.Nil(t, insert("posts", post(1, 1)))
+	is.Nil(t, insert("posts", post(2, 1)))
+	is.Nil(t, insert("posts", post(3, 2)))
+	is.ErrorIs(t, insert("comments", comment(4, 1)), ErrForeignKey)
+	for _, p := range []int64{1, 1, 2, 3} {
+		is.Nil(t, insert("comments", comment(p, int64(count("comments")))))
+	}
+	// so is an update to a missing parent
+	tx := r.begin()
+	_, err = tx.Update("posts", *post(3, 9))
+	is.ErrorIs(t, err, ErrForeignKey)
+	r.db.Abort(tx)
+
+	// a referenced table can't go away
+	tx = r.begin()
+	is.ErrorIs(t, tx.TableDrop("users"), ErrForeignKey)
+	is.ErrorIs(t, tx.TableRename("posts", "posts2"), ErrForeignKey)
+	r.db.Abort(tx)
+
+	// without cascade, the children keep the parent. the posts come first,
+	// so their cascade is undone.
+	is.Nil(t, insert("votes", (&Record{}).AddInt64("user", 2).AddInt64("post", 3)))
+	tx = r.begin()
+	_, err = tx.Delete("users", *(&Record{}).AddInt64("id", 2))
+	is.ErrorIs(t, err, ErrForeignKey)
+	r.commit(tx)
+	is.Equal(t, []int{2, 3, 4}, []int{count("users"), count("posts"), count("comments")})
+
+	// the cascade goes through two levels
+	tx = r.begin()
+	deleted, err := tx.Delete("users", *(&Record{}).AddInt64("id", 1))
+	is.Nil(t, err)
+	is.True(t, deleted)
+	r.commit(tx)
+	is.Equal(t, []int{1, 1, 1}, []int{count("users"), count("posts"), count("comments")})
+
+	tx = r.begin()
+	_, err = tx.Delete("votes", *(&Record{}).AddInt64("user", 2).AddInt64("post", 3))
+	is.Nil(t, err)
+	_, err = tx.Delete("users", *(&Record{}).AddInt64("id", 2))
+	is.Nil(t, err)
+	r.commit(tx)
+	is.Equal(t, []int{0, 0, 0}, []int{count("users"), count("posts"), count("comments")})
+}
+
+func TestTableTTL(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	now := time.Unix(1000, 0)
+	r.db.Clock = func() time.Time { return now }
+	at := func(sec int64) int64 { return sec * int64(time.Second) }
+
+	tx := r.begin()
+	is.NotNil(t, tx.TableNew(&TableDef{
+		Name: "bad", Cols: []string{"k", "v"}, Types: []uint32{TYPE_BYTES, TYPE_BYTES},
+		Indexes: [][]string{{"k"}}, TTL: "v",
+	}))
+	r.db.Abort(tx)
+	// the sweep scans the index on the deadlines of "sessions", and all
+	// the rows of "tokens"
+	for _, name := range []string{"sessions", "tokens"} {
+		tdef := &TableDef{
+			Name:    name,
+			Cols:    []string{"id", "user", "expires_at"},
+			Types:   []uint32{TYPE_BYTES, TYPE_BYTES, TYPE_INT64},
+			Indexes: [][]string{{"id"}, {"user"}},
+			Unique:  []bool{false, true},
+			TTL:     "expires_at",
+		}
+		if name == "sessions" {
+			tdef.Indexes = append(tdef.Indexes, []string{"expires_at"})
+		}
+		r.create(tdef)
+	}
+
+	row := func(id string, user string, expires int64) *Record {
+		return (&Record{}).AddStr("id", []byte(id)).AddStr("user", []byte(user)).
+			AddInt64("expires_at", expires)
+	}
+	ids := func(table string, sc Scanner) []string {
+		tx := r.begin()
+		defer r.db.Abort(tx)
+		is.Nil(t, tx.Scan(table, &sc))
+		defer sc.Close()
+		out := []string{}
+		for ; sc.Valid(); sc.Next() {
+			rec := Record{}
+			is.Nil(t, sc.Deref(&rec))
+			out = append(out, string(rec.Get("id").Str))
+		}
+		is.Nil(t, sc.Err())
+		return out
+	}
+	all := Scanner{Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE}
+	byUser := Scanner{
+		Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE,
+		Key1: *(&Record{}).AddStr("user", nil), Key2: *(&Record{}).AddStr("user", []byte("z")),
+	}
+
+	for _, table := range []string{"sessions", "tokens"} {
+		tx := r.begin()
+		for _, rec := range []*Record{row("a", "u1", at(1500)), row("b", "u2", at(2000)), row("c", "u3", 0)} {
+			_, err := tx.Insert(table, rec)
+			is.Nil(t, err)
+		}
+		r.commit(tx)
+		is.Equal(t, []string{"a", "b", "c"}, ids(table, all))
+	}
+
+	// lazy expiry
+	now = time.Unix(1600, 0)
+	for _, table := range []string{"sessions", "tokens"} {
+		is.Equal(t, []string{"b", "c"}, ids(table, all))
+		is.Equal(t, []string{"b", "c"}, ids(table, byUser))
+		tx := r.begin()
+		ok, err := tx.Get(table, (&Record{}).AddStr("id", []byte("a")))
+		is.Nil(t, err)
+		is.False(t, ok)
+		n, err := tx.Count(table, &Scanner{Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE})
+		is.Nil(t, err)
+		is.Equal(t, int64(2), n)
+		found, err := tx.MultiGet(table, []*Record{
+			(&Record{}).AddStr("id", []byte("b")), (&Record{}).AddStr("id", []byte("a")),
+		})
+		is.Nil(t, err)
+		is.Equal(t, []bool{true, false}, found)
+		r.db.Abort(tx)
+	}
+	// an expired row gives way to an insert, by key or by unique value
+	tx = r.begin()
+	_, err := tx.Insert("sessions", row("a", "u9", at(3000)))
+	is.Nil(t, err)
+	_, err = tx.Insert("tokens", row("d", "u1", at(3000)))
+	is.Nil(t, err)
+	// and a delete of it is a miss
+	deleted, err := tx.Delete("tokens", *(&Record{}).AddStr("id", []byte("a")))
+	is.Nil(t, err)
+	is.False(t, deleted)
+	r.commit(tx)
+	is.Equal(t, []string{"a", "b", "c"}, ids("sessions", all))
+	is.Equal(t, []string{"b", "c", "d"}, ids("tokens", all))
+
+	// the sweep deletes the rows
+	now = time.Unix(2500, 0)
+	for _, table := range []string{"sessions", "tokens"} {
+		n, err := r.db.ExpireSweep(table, 0)
+		is.Nil(t, err)
+		is.Equal(t, 1, n) // "b"
+		n, err = r.db.ExpireSweep(table, 0)
+		is.Nil(t, err)
+		is.Equal(t, 0, n)
+	}
+	stats, err := r.db.Stats()
+	is.Nil(t, err)
+	is.Equal(t, int64(2), stats.Tables["tokens"].Rows)
+
+	// in the background
+	now = time.Unix(5000, 0)
+	stop := r.db.StartSweeper(time.Millisecond)
+	for start := time.Now(); time.Since(start) < 5*time.Second; {
+		tx := r.begin()
+		n, err := tx.Count("sessions", &Scanner{Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE})
+		is.Nil(t, err)
+		r.db.Abort(tx)
+		is.Equal(t, int64(1), n)
+		stats, err := r.db.Stats()
+		is.Nil(t, err)
+		if stats.Tables["sessions"].Rows == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	is.Nil(t, stop())
+	is.Equal(t, []string{"c"}, ids("sessions", all))
+	_, err = r.db.ExpireSweep("sessions", 0)
+	is.Nil(t, err)
+}
+
+func TestTableWriteTimes(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	now := time.Unix(100, 0)
+	r.db.Clock = func() time.Time { return now }
+
+	tx := r.begin()
+	is.NotNil(t, tx.TableNew(&TableDef{
+		Name: "bad", Cols: []string{"k", "v"}, Types: []uint32{TYPE_BYTES, TYPE_BYTES},
+		Indexes: [][]string{{"k"}}, UpdatedAt: "v",
+	}))
+	r.db.Abort(tx)
+	r.create(&TableDef{
+		Name:      "tbl",
+		Cols:      []string{"k", "v", "created_at", "updated_at"},
+		Types:     []uint32{TYPE_BYTES, TYPE_INT64, TYPE_TIMESTAMP, TYPE_INT64},
+		Indexes:   [][]string{{"k"}},
+		CreatedAt: "created_at",
+		UpdatedAt: "updated_at",
+	})
+
+	write := func(req DBUpdateReq) (bool, bool) {
+		tx := r.begin()
+		updated, err := tx.Set("tbl", &req)
+		is.Nil(t, err)
+		r.commit(tx)
+		return req.Added, updated
+	}
+	times := func() (int64, int64) {
+		tx := r.begin()
+		defer r.db.Abort(tx)
+		rec := (&Record{}).AddStr("k", []byte("a"))
+		ok, err := tx.Get("tbl", rec)
+		is.Nil(t, err)
+		is.True(t, ok)
+		return rec.Get("created_at").Time().Unix(), rec.Get("updated_at").I64 / int64(time.Second)
+	}
+	row := func(v int64) Record {
+		return *(&Record{}).AddStr("k", []byte("a")).AddInt64("v", v)
+	}
+	check := func(created, updated int64) {
+		c, u := times()
+		is.Equal(t, [2]int64{created, updated}, [2]int64{c, u})
+	}
+
+	// an insert sets both
+	added, _ := write(DBUpdateReq{Record: row(1), Mode: btree.MODE_INSERT_ONLY})
+	is.True(t, added)
+	check(100, 100)
+
+	// an update only the second, and the values of the caller are replaced
+	now = time.Unix(200, 0)
+	rec := row(2)
+	rec.AddTime("created_at", time.Unix(1, 0)).AddInt64("updated_at", 1)
+	_, updated := write(DBUpdateReq{Record: rec, Mode: btree.MODE_UPDATE_ONLY})
+	is.True(t, updated)
+	check(100, 200)
+
+	// an upsert of the same values changes nothing
+	now = time.Unix(300, 0)
+	added, updated = write(DBUpdateReq{Record: row(2), Mode: btree.MODE_UPSERT})
+	is.False(t, added)
+	is.False(t, updated)
+	check(100, 200)
+
+	// partial updates too
+	partial := *(&Record{}).AddStr("k", []byte("a")).AddInt64("v", 3)
+	_, updated = write(DBUpdateReq{Record: partial, Partial: true})
+	is.True(t, updated)
+	check(100, 300)
+	now = time.Unix(400, 0)
+	_, updated = write(DBUpdateReq{Record: partial, Partial: true})
+	is.False(t, updated)
+	check(100, 300)
+
+	// unless the times are kept, for imports
+	rec = row(3)
+	rec.AddTime("created_at", time.Unix(1, 0)).AddInt64("updated_at", 2*int64(time.Second))
+	_, updated = write(DBUpdateReq{Record: rec, KeepTimes: true})
+	is.True(t, updated)
+	check(1, 2)
+}
+
+func TestTableUpdateOld(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	r.create(&TableDef{
+		Name:     "tbl",
+		Cols:     []string{"k", "v", "n"},
+		Types:    []uint32{TYPE_BYTES, TYPE_INT64, TYPE_BYTES},
+		Indexes:  [][]string{{"k"}, {"v"}},
+		Nullable: []bool{false, false, true},
+	})
+	row := func(k string, v int64) Record {
+		return *(&Record{}).AddStr("k", []byte(k)).AddInt64("v", v).AddNull("n")
+	}
+
+	tx := r.begin()
+	defer r.db.Abort(tx)
+	// an insert has no old row
+	old, updated, err := tx.UpsertWithOld("tbl", row("a", 1))
+	is.Nil(t, err)
+	is.True(t, updated)
+	is.Equal(t, Record{}, old)
+
+	// an update has
+	old, updated, err = tx.UpsertWithOld("tbl", row("a", 2))
+	is.Nil(t, err)
+	is.True(t, updated)
+	is.Equal(t, row("a", 1), old)
+	rec := row("a", 3)
+	rec.Vals[2] = Value{Type: TYPE_BYTES, Str: []byte("x")}
+	old, updated, err = tx.UpdateWithOld("tbl", rec)
+	is.Nil(t, err)
+	is.True(t, updated)
+	is.Equal(t, row("a", 2), old)
+
+	// so does a write that changes nothing or is refused by the mode
+	old, updated, err = tx.UpsertWithOld("tbl", rec)
+	is.Nil(t, err)
+	is.False(t, updated)
+	is.Equal(t, rec, old)
+	dbreq := DBUpdateReq{Record: row("a", 4), Mode: btree.MODE_INSERT_ONLY, WantOld: true}
+	_, err = tx.Set("tbl", &dbreq)
+	is.ErrorIs(t, err, ErrRecordExists)
+	is.False(t, dbreq.Added)
+	is.Equal(t, rec, dbreq.Old)
+
+	// an update of a missing row has none
+	old, updated, err = tx.UpdateWithOld("tbl", row("b", 1))
+	is.ErrorIs(t, err, ErrRecordNotFound)
+	is.False(t, updated)
+	is.Equal(t, Record{}, old)
+
+	// partial updates too
+	partial := *(&Record{}).AddStr("k", []byte("a")).AddInt64("v", 5)
+	dbreq = DBUpdateReq{Record: partial, Partial: true, WantOld: true}
+	_, err = tx.Set("tbl", &dbreq)
+	is.Nil(t, err)
+	is.Equal(t, rec, dbreq.Old)
+	// the index was updated from it
+	sc := Scanner{
+		Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE,
+		Key1: *(&Record{}).AddInt64("v", 0), Key2: *(&Record{}).AddInt64("v", 9),
+	}
+	is.Nil(t, tx.Scan("tbl", &sc))
+	defer sc.Close()
+	is.True(t, sc.Valid())
+	got := Record{}
+	is.Nil(t, sc.Deref(&got))
+	is.Equal(t, int64(5), got.Get("v").I64)
+	sc.Next()
+	is.False(t, sc.Valid())
+}
+
+func TestTableDeleteReturning(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	r.create(&TableDef{
+		Name:    "tbl",
+		Cols:    []string{"k", "v", "s"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES, TYPE_INT64},
+		Indexes: [][]string{{"k"}, {"s"}},
+	})
+	row := *(&Record{}).AddInt64("k", 1).AddStr("v", []byte("one")).AddInt64("s", 10)
+	r.add("tbl", row)
+
+	tx := r.begin()
+	defer r.db.Abort(tx)
+	// a missing row leaves the record alone
+	rec := (&Record{}).AddInt64("k", 2)
+	deleted, err := tx.DeleteReturning("tbl", rec)
+	is.Nil(t, err)
+	is.False(t, deleted)
+	is.Equal(t, *(&Record{}).AddInt64("k", 2), *rec)
+
+	rec = (&Record{}).AddInt64("k", 1)
+	deleted, err = tx.DeleteReturning("tbl", rec)
+	is.Nil(t, err)
+	is.True(t, deleted)
+	is.Equal(t, row, *rec)
+	// the row and its index keys are gone
+	ok, err := tx.Get("tbl", (&Record{}).AddInt64("k", 1))
+	is.Nil(t, err)
+	is.False(t, ok)
+	n, err := tx.Count("tbl", &Scanner{
+		Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE,
+		Key1: *(&Record{}).AddInt64("s", 0), Key2: *(&Record{}).AddInt64("s", 99),
+	})
+	is.Nil(t, err)
+	is.Equal(t, int64(0), n)
+}
+
+func TestTableScanReuse(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	r.create(&TableDef{
+		Name:    "tbl",
+		Cols:    []string{"k", "v", "s"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES, TYPE_INT64},
+		Indexes: [][]string{{"k"}, {"s"}},
+	})
+	const size = 100
+	for i := int64(0); i < size; i++ {
+		// with escapes
+		v := []byte{'v', byte(i), 0, 1}
+		r.add("tbl", *(&Record{}).AddInt64("k", i).AddStr("v", v).AddInt64("s", -i))
+	}
+
+	tx := r.begin()
+	defer r.db.Abort(tx)
+	scan := func(sc Scanner, keep func(rec *Record) Record) (out []Record) {
+		is.Nil(t, tx.Scan("tbl", &sc))
+		defer sc.Close()
+		rec := Record{}
+		for ; sc.Valid(); sc.Next() {
+			is.Nil(t, sc.Deref(&rec))
+			out = append(out, keep(&rec))
+		}
+		is.Nil(t, sc.Err())
+		return out
+	}
+	scans := []Scanner{
+		{Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE},
+		{Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE, Cols: []string{"v", "k"}},
+		{
+			Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE,
+			Key1: *(&Record{}).AddInt64("s", -50), Key2: *(&Record{}).AddInt64("s", 0),
+		},
+		{
+			Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE,
+			Filter: func(rec *Record) bool { return rec.Get("k").I64%3 == 0 },
+			Cols:   []string{"v"},
+		},
+	}
+	for _, sc := range scans {
+		want := scan(sc, func(rec *Record) Record {
+			out := *rec
+			*rec = Record{}
+			return out
+		})
+		sc.Reuse = true
+		is.Equal(t, want, scan(sc, (*Record).Clone))
+		// without Clone the rows share the buffers
+		got := scan(sc, func(rec *Record) Record { return *rec })
+		is.NotEqual(t, want, got)
+	}
+
+	// positions without decoding
+	tdef, err := getTableDef(tx, "tbl")
+	is.Nil(t, err)
+	sc := Scanner{Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE}
+	is.Nil(t, tx.Scan("tbl", &sc))
+	for i := int64(0); sc.Valid(); sc.Next() {
+		is.Equal(t, encodeKey(nil, tdef.Prefixes[0], []Value{{Type: TYPE_INT64, I64: i}}), sc.Key())
+		i++
+	}
+	is.Nil(t, sc.Key())
+	sc.Close()
+
+	// the allocations of a scan don't grow with the rows
+	allocs := func(sc Scanner) float64 {
+		rec := Record{}
+		return testing.AllocsPerRun(5, func() {
+			assert(tx.Scan("tbl", &sc) == nil)
+			for ; sc.Valid(); sc.Next() {
+				assert(sc.Deref(&rec) == nil)
+			}
+			sc.Close()
+		})
+	}
+	for _, sc := range scans[:3] {
+		is.Greater(t, allocs(sc), float64(size))
+		sc.Reuse = true
+		is.Less(t, allocs(sc), float64(size/4))
+	}
+}
+
+// a scan of 1000 rows per op, decoded into the same record
+func benchmarkScan(b *testing.B, reuse bool, index bool) {
+	r := newR()
+	defer r.dispose()
+	r.create(&TableDef{
+		Name:    "tbl_test",
+		Cols:    []string{"k", "v", "s"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES, TYPE_INT64},
+		Indexes: [][]string{{"k"}, {"s"}},
+	})
+	const size = 1000
+	recs := []Record{}
+	for j := 0; j < size; j++ {
+		v := []byte(fmt.Sprint("v\x00", j))
+		recs = append(recs, *(&Record{}).AddInt64("k", int64(j)).AddStr("v", v).AddInt64("s", int64(-j)))
+	}
+	tx := r.begin()
+	_, err := tx.InsertBatch("tbl_test", recs)
+	assert(err == nil)
+	r.commit(tx)
+
+	tx = r.begin()
+	defer r.db.Abort(tx)
+	rec := Record{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sc := Scanner{Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE, Reuse: reuse}
+		if index {
+			sc.Key1 = *(&Record{}).AddInt64("s", -size)
+			sc.Key2 = *(&Record{}).AddInt64("s", 0)
+		}
+		assert(tx.Scan("tbl_test", &sc) == nil)
+		for ; sc.Valid(); sc.Next() {
+			assert(sc.Deref(&rec) == nil)
+		}
+		sc.Close()
+	}
+}
+
+func BenchmarkScan(b *testing.B)           { benchmarkScan(b, false, false) }
+func BenchmarkScanReuse(b *testing.B)      { benchmarkScan(b, true, false) }
+func BenchmarkScanIndex(b *testing.B)      { benchmarkScan(b, false, true) }
+func BenchmarkScanIndexReuse(b *testing.B) { benchmarkScan(b, true, true) }
+
+// an Err that fails after `n` calls, to stop an index build between batches
+type countCtx struct {
+	context.Context
+	n int
+}
+
+func (c *countCtx) Err() error {
+	if c.n--; c.n < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestTableCreateIndex(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	defer func(n int) { indexBatch = n }(indexBatch)
+	indexBatch = 10
+
+	tdef := &TableDef{
+		Name:    "users",
+		Cols:    []string{"id", "email", "age"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES, TYPE_INT64},
+		Indexes: [][]string{{"id"}},
+	}
+	r.create(tdef)
+	for i := int64(0); i < 100; i++ {
+		rec := Record{}
+		rec.AddInt64("id", i).AddStr("email", []byte(fmt.Sprintf("u%d@x", i)))
+		rec.AddInt64("age", i%7)
+		r.add("users", rec)
+	}
+
+	// the keys of the index on `age` match the rows
+	check := func() {
+		tx := r.begin()
+		defer r.db.Abort(tx)
+		tdef := testTableDef(tx, "users")
+		expect := []string{}
+		for _, rec := range r.ref["users"] {
+			vals, err := getValues(tdef, rec, []string{"age", "id"})
+			is.Nil(t, err)
+			expect = append(expect, string(encodeKey(nil, tdef.Prefixes[1], vals)))
+		}
+		slices.Sort(expect)
+		is.Equal(t, expect, rawKeys(tx, tdef.Prefixes[1]))
+	}
+	scanAge := func(age int64) (n int, err error) {
+		tx := r.begin()
+		defer r.db.Abort(tx)
+		sc := Scanner{
+			Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE,
+			Key1: *(&Record{}).AddInt64("age", age),
+			Key2: *(&Record{}).AddInt64("age", age),
+		}
+		if err := tx.Scan("users", &sc); err != nil {
+			return 0, err
+		}
+		defer sc.Close()
+		for ; sc.Valid(); sc.Next() {
+			n++
+		}
+		return n, sc.Err()
+	}
+
+	// stopped after 3 batches
+	ctx := &countCtx{Context: context.Background(), n: 3}
+	err := r.db.CreateIndexCtx(ctx, "users", []string{"age"}, false)
+	is.ErrorIs(t, err, context.Canceled)
+	tx := r.begin()
+	tdef = testTableDef(tx, "users")
+	is.Equal(t, []bool{false, true}, tdef.Building)
+	is.Equal(t, 30, len(rawKeys(tx, tdef.Prefixes[1])))
+	r.db.Abort(tx)
+	// not used by scans yet
+	_, err = scanAge(1)
+	is.ErrorIs(t, err, ErrBadRange)
+
+	// writes before and after the position of the build
+	r.del("users", *(&Record{}).AddInt64("id", 5))
+	r.del("users", *(&Record{}).AddInt64("id", 50))
+	for _, id := range []int64{3, 60, 200} {
+		rec := Record{}
+		rec.AddInt64("id", id).AddStr("email", []byte(fmt.Sprintf("v%d@x", id)))
+		rec.AddInt64("age", 1)
+		r.add("users", rec)
+	}
+
+	// resumed after a restart
+	r.db.Close()
+	r.db = DB{Path: "r.db"}
+	is.Nil(t, r.db.Open())
+	is.Nil(t, r.db.CreateIndex("users", []string{"age"}, false))
+	check()
+	n, err := scanAge(1)
+	is.Nil(t, err)
+	is.Equal(t, 17, n)
+	tx = r.begin()
+	tdef = testTableDef(tx, "users")
+	is.Nil(t, tdef.Building)
+	meta := (&Record{}).AddStr("key", indexBuildKey(tdef.Prefixes[1]))
+	ok, err := dbGet(tx, TDEF_META, meta)
+	is.Nil(t, err)
+	is.False(t, ok)
+	r.db.Abort(tx)
+	is.ErrorContains(t, r.db.CreateIndex("users", []string{"age"}, false), "index exists")
+	is.NotNil(t, r.db.CreateIndex("@meta", []string{"val"}, false))
+	is.NotNil(t, r.db.CreateIndex("users", []string{"nope"}, false))
+
+	// a unique index with a duplicate leaves nothing
+	rec := Record{}
+	rec.AddInt64("id", 300).AddStr("email", []byte("u90@x")).AddInt64("age", 0)
+	r.add("users", rec)
+	err = r.db.CreateIndex("users", []string{"email"}, true)
+	is.ErrorIs(t, err, ErrUniqueViolation)
+	tx = r.begin()
+	tdef = testTableDef(tx, "users")
+	is.Equal(t, 2, len(tdef.Indexes))
+	is.Nil(t, tdef.Building)
+	is.Empty(t, rawKeys(tx, tdef.Prefixes[1]+1))
+	r.db.Abort(tx)
+
+	// and its prefix is reused
+	r.del("users", rec)
+	is.Nil(t, r.db.CreateIndex("users", []string{"email"}, true))
+	tx = r.begin()
+	tdef = testTableDef(tx, "users")
+	is.Equal(t, []bool{false, false, true}, tdef.Unique)
+	is.Equal(t, tdef.Prefixes[1]+1, tdef.Prefixes[2])
+	is.Equal(t, len(r.ref["users"]), len(rawKeys(tx, tdef.Prefixes[2])))
+	r.db.Abort(tx)
+}
+
+func TestTablePlan(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	tdef := &TableDef{
+		Name:    "events",
+		Cols:    []string{"id", "status", "user", "note"},
+		Types:   []uint32{TYPE_INT64, TYPE_INT64, TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"id"}, {"status"}, {"user"}},
+	}
+	r.create(tdef)
+	// few statuses, most of them 0, and many users
+	tx := r.begin()
+	for i := int64(0); i < 1000; i++ {
+		rec := (&Record{}).AddInt64("id", i).AddInt64("status", btoi64(i < 10))
+		rec.AddInt64("user", i%200).AddStr("note", []byte(fmt.Sprint("n", i)))
+		_, err := tx.Insert("events", rec)
+		is.Nil(t, err)
+	}
+	r.commit(tx)
+
+	eq := func(col string, v int64) Cond {
+		return Cond{Col: col, Op: COND_EQ, Val: Value{Type: TYPE_INT64, I64: v}}
+	}
+	find := func(conds ...Cond) (*Plan, []int64) {
+		sc, err := r.db.Find("events", conds)
+		is.Nil(t, err)
+		defer sc.Close()
+		ids := []int64{}
+		for ; sc.Valid(); sc.Next() {
+			rec := Record{}
+			is.Nil(t, sc.Deref(&rec))
+			ids = append(ids, rec.Get("id").I64)
+		}
+		is.Nil(t, sc.Err())
+		return sc.Plan(), ids
+	}
+
+	// a tie without statistics goes to the first index
+	plan, ids := find(eq("status", 1), eq("user", 7))
+	is.Equal(t, 1, plan.Index)
+	is.Equal(t, int64(-1), plan.Rows)
+	is.Equal(t, []int64{7}, ids)
+
+	// the statistics make `user` the selective one
+	is.Nil(t, r.db.Analyze("events"))
+	tx = r.begin()
+	stats, ok, err := indexStats(tx, tdef.Prefixes[1])
+	is.Nil(t, err)
+	is.True(t, ok)
+	is.Equal(t, IndexStats{Rows: 1000, Distinct: 2}, stats)
+	stats, _, _ = indexStats(tx, tdef.Prefixes[2])
+	is.Equal(t, IndexStats{Rows: 1000, Distinct: 200}, stats)
+	r.db.Abort(tx)
+
+	plan, ids = find(eq("status", 1), eq("user", 7))
+	is.Equal(t, 2, plan.Index)
+	is.Equal(t, int64(5), plan.Rows)
+	is.Equal(t, []Cond{eq("status", 1)}, plan.Filter)
+	is.Equal(t, []int64{7}, ids)
+	is.Equal(t, `index [user id] >= (7) .. <= (7), filter [status = 1], ~5 rows`, plan.String())
+	_, ids = find(eq("status", 0), eq("user", 7))
+	is.Equal(t, []int64{207, 407, 607, 807}, ids)
+
+	// more columns in the range win over the statistics
+	plan, ids = find(eq("status", 1), eq("id", 3))
+	is.Equal(t, 1, plan.Index)
+	is.Equal(t, int64(500), plan.Rows)
+	is.Equal(t, []int64{3}, ids)
+	// a range on a selective column against an equality on the other
+	plan, ids = find(eq("status", 1),
+		Cond{Col: "user", Op: btree_iter.CMP_GE, Val: Value{Type: TYPE_INT64, I64: 5}},
+		Cond{Col: "user", Op: btree_iter.CMP_LT, Val: Value{Type: TYPE_INT64, I64: 8}})
+	is.Equal(t, 2, plan.Index)
+	is.Equal(t, int64(333), plan.Rows)
+	is.Equal(t, []int64{5, 6, 7}, ids)
+	// a filtered primary key scan
+	plan, ids = find(Cond{Col: "note", Op: COND_EQ, Val: Value{Type: TYPE_BYTES, Str: []byte("n42")}})
+	is.Equal(t, 0, plan.Index)
+	is.Equal(t, int64(1000), plan.Rows)
+	is.Equal(t, []int64{42}, ids)
+
+	_, err = r.db.Find("events", []Cond{eq("nope", 1)})
+	is.NotNil(t, err)
+	_, err = r.db.Find("events", []Cond{{Col: "user", Op: COND_EQ, Val: Value{Type: TYPE_BYTES}}})
+	is.NotNil(t, err)
+	_, err = r.db.Find("events", []Cond{{Col: "user", Op: 7, Val: Value{Type: TYPE_INT64}}})
+	is.NotNil(t, err)
+
+	// a plain scan has no plan
+	tx = r.begin()
+	sc := Scanner{Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE}
+	is.Nil(t, tx.Scan("events", &sc))
+	is.Nil(t, sc.Plan())
+	sc.Close()
+	// the statistics go with the table
+	is.Nil(t, tx.TableDrop("events"))
+	_, ok, err = indexStats(tx, tdef.Prefixes[2])
+	is.Nil(t, err)
+	is.False(t, ok)
+	r.commit(tx)
+}
+
+func btoi64(b bool) int64 {
+	return int64(btoi(b))
+}
+
+func TestTableMultiScan(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	r.create(&TableDef{
+		Name:    "orders",
+		Cols:    []string{"id", "user", "amount"},
+		Types:   []uint32{TYPE_INT64, TYPE_INT64, TYPE_INT64},
+		Indexes: [][]string{{"id"}, {"user"}},
+	})
+	tx := r.begin()
+	for i := int64(0); i < 100; i++ {
+		rec := (&Record{}).AddInt64("id", i).AddInt64("user", i%10).AddInt64("amount", i*10)
+		_, err := tx.Insert("orders", rec)
+		is.Nil(t, err)
+	}
+	r.commit(tx)
+
+	user := func(v int64) Record { return *(&Record{}).AddInt64("user", v) }
+	in := func(users ...int64) (out []ScanRange) {
+		for _, u := range users {
+			out = append(out, ScanRange{
+				Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE, Key1: user(u), Key2: user(u),
+			})
+		}
+		return out
+	}
+	scan := func(req *MultiScanner) (ids []int64) {
+		tx := r.begin()
+		defer r.db.Abort(tx)
+		is.Nil(t, tx.MultiScan("orders", req))
+		defer req.Close()
+		for ; req.Valid(); req.Next() {
+			rec := Record{}
+			is.Nil(t, req.Deref(&rec))
+			ids = append(ids, rec.Get("id").I64)
+		}
+		is.Nil(t, req.Err())
+		return ids
+	}
+
+	// in the order of the index, once each
+	req := &MultiScanner{Ranges: in(7, 1, 7)}
+	ids := scan(req)
+	is.Equal(t, 1, req.Index())
+	is.Equal(t, []int64{1, 11, 21, 31, 41, 51, 61, 71, 81, 91, 7, 17, 27, 37, 47, 57, 67, 77, 87, 97}, ids)
+	// overlapping ranges
+	ranges := append(in(3), ScanRange{
+		Cmp1: btree_iter.CMP_GT, Cmp2: btree_iter.CMP_LT, Key1: user(2), Key2: user(5),
+	})
+	ids = scan(&MultiScanner{Ranges: ranges, Opts: Scanner{Limit: 12}})
+	is.Equal(t, []int64{3, 13, 23, 33, 43, 53, 63, 73, 83, 93, 4, 14}, ids)
+	// descending, with the options of a Scanner
+	req = &MultiScanner{Ranges: in(1, 7, 2), Opts: Scanner{
+		Desc:   true,
+		Cols:   []string{"id"},
+		Filter: func(rec *Record) bool { return rec.Get("id").I64 < 30 },
+		Offset: 1,
+		Limit:  4,
+	}}
+	is.Equal(t, []int64{17, 7, 22, 12}, scan(req))
+	// none
+	is.Empty(t, scan(&MultiScanner{}))
+	is.Empty(t, scan(&MultiScanner{Ranges: in(42)}))
+
+	tx = r.begin()
+	defer r.db.Abort(tx)
+	ranges = append(in(1), ScanRange{
+		Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE,
+		Key1: *(&Record{}).AddInt64("id", 1), Key2: *(&Record{}).AddInt64("id", 2),
+	})
+	is.ErrorIs(t, tx.MultiScan("orders", &MultiScanner{Ranges: ranges}), ErrBadRange)
+	ranges = append(in(1), ScanRange{
+		Cmp1: btree_iter.CMP_LE, Cmp2: btree_iter.CMP_GE, Key1: user(5), Key2: user(4),
+	})
+	is.ErrorIs(t, tx.MultiScan("orders", &MultiScanner{Ranges: ranges}), ErrBadRange)
+}
+
+func TestTableHistory(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	r.db.Close()
+	r.db = DB{Path: r.db.Path, Options: Options{History: 4}}
+	is.Nil(t, r.db.Open())
+	r.create(&TableDef{
+		Name:    "tbl",
+		Cols:    []string{"k", "v"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"k"}, {"v"}},
+	})
+	row := func(k int, v string) *Record {
+		return (&Record{}).AddInt64("k", int64(k)).AddStr("v", []byte(v))
+	}
+	tx := r.begin()
+	for i := 0; i < 1000; i++ {
+		_, err := tx.Insert("tbl", row(i, fmt.Sprintf("value%d", i)))
+		is.Nil(t, err)
+	}
+	r.commit(tx)
+
+	// the rows of a TX
+	rows := func(tx *DBTX) (out []Record) {
+		sc := Scanner{Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE}
+		is.Nil(t, tx.Scan("tbl", &sc))
+		defer sc.Close()
+		for ; sc.Valid(); sc.Next() {
+			rec := Record{}
+			is.Nil(t, sc.Deref(&rec))
+			out = append(out, rec)
+		}
+		is.Nil(t, sc.Err())
+		return out
+	}
+	// the rows at `seq`
+	at := func(seq uint64) ([]Record, error) {
+		tx := DBTX{}
+		if err := r.db.BeginReadAt(&tx, seq); err != nil {
+			return nil, err
+		}
+		defer r.db.Abort(&tx)
+		if _, err := tx.Get("tbl", (&Record{}).AddInt64("k", 5)); err != nil {
+			return nil, err
+		}
+		return rows(&tx), nil
+	}
+
+	seq := r.db.CurrentSeq()
+	tx = r.begin()
+	want := rows(tx)
+	r.db.Abort(tx)
+	is.Equal(t, 1000, len(want))
+
+	// the freed pages are not reused for the kept version
+	for round := 0; round < 3; round++ {
+		tx = r.begin()
+		for i := round; i < 1000; i += 3 {
+			_, err := tx.Update("tbl", *row(i, fmt.Sprintf("round%d-%d", round, i)))
+			is.Nil(t, err)
+			_, err = tx.Delete("tbl", *(&Record{}).AddInt64("k", int64(i+1)))
+			is.Nil(t, err)
+			_, err = tx.Insert("tbl", row(1000+1000*round+i, "new"))
+			is.Nil(t, err)
+		}
+		r.commit(tx)
+	}
+	got, err := at(seq)
+	is.Nil(t, err)
+	is.Equal(t, want, got)
+	tx = r.begin()
+	cur := rows(tx)
+	r.db.Abort(tx)
+	is.NotEqual(t, want, cur)
+	got, err = at(r.db.CurrentSeq())
+	is.Nil(t, err)
+	is.Equal(t, cur, got)
+
+	// the history is in the meta page
+	r.db.Close()
+	r.db = DB{Path: r.db.Path, Options: Options{History: 4}}
+	is.Nil(t, r.db.Open())
+	got, err = at(seq)
+	is.Nil(t, err)
+	is.Equal(t, want, got)
+	// the schema of the version
+	tx = r.begin()
+	is.Nil(t, tx.TableDrop("tbl"))
+	r.commit(tx)
+	got, err = at(seq)
+	is.Nil(t, err)
+	is.Equal(t, want, got)
+
+	// an open view keeps its version
+	view := DBTX{}
+	is.Nil(t, r.db.BeginReadAt(&view, seq))
+	for i := 0; i < 5; i++ {
+		r.create(&TableDef{
+			Name:    fmt.Sprintf("tbl%d", i),
+			Cols:    []string{"k"},
+			Types:   []uint32{TYPE_INT64},
+			Indexes: [][]string{{"k"}},
+		})
+	}
+	_, err = at(seq)
+	is.ErrorIs(t, err, kv.ErrHistoryGone)
+	is.Equal(t, want, rows(&view))
+	r.db.Abort(&view)
+	_, err = at(seq + 100)
+	is.ErrorIs(t, err, kv.ErrHistoryGone)
+
+	// without History
+	r.db.Close()
+	r.db = DB{Path: r.db.Path}
+	is.Nil(t, r.db.Open())
+	_, err = at(r.db.CurrentSeq() - 1)
+	is.ErrorIs(t, err, kv.ErrHistoryGone)
+	_, err = at(r.db.CurrentSeq())
+	is.ErrorIs(t, err, ErrTableNotFound)
+}
+
+func TestTableCollation(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	r.create(&TableDef{
+		Name:       "users",
+		Cols:       []string{"id", "email", "name"},
+		Types:      []uint32{TYPE_INT64, TYPE_BYTES, TYPE_BYTES},
+		Indexes:    [][]string{{"id"}, {"email"}, {"name"}},
+		Unique:     []bool{false, true},
+		Collations: [][]uint32{nil, {COLLATE_NOCASE}},
+	})
+	user := func(id int64, email string, name string) Record {
+		return *(&Record{}).AddInt64("id", id).AddStr("email", []byte(email)).AddStr("name", []byte(name))
+	}
+	r.add("users", user(1, "Alice@x.com", "Alice"))
+	r.add("users", user(2, "bob@Y.com", "Bob"))
+	r.add("users", user(3, "BOB2@y.com", "bob"))
+
+	// the ids of the rows in a range of an index
+	scan := func(col string, cmp1 int, v1 string, cmp2 int, v2 string) (ids []int64) {
+		tx := r.begin()
+		defer r.db.Abort(tx)
+		sc := Scanner{
+			Cmp1: cmp1, Cmp2: cmp2,
+			Key1: *(&Record{}).AddStr(col, []byte(v1)),
+			Key2: *(&Record{}).AddStr(col, []byte(v2)),
+		}
+		is.Nil(t, tx.Scan("users", &sc))
+		defer sc.Close()
+		for ; sc.Valid(); sc.Next() {
+			rec := Record{}
+			is.Nil(t, sc.Deref(&rec))
+			ids = append(ids, rec.Get("id").I64)
+			// the row keeps the original bytes
+			is.Equal(t, rec.Vals, r.ref["users"][rec.Get("id").I64-1].Vals)
+		}
+		is.Nil(t, sc.Err())
+		return ids
+	}
+	is.Equal(t, []int64{1}, scan("email", btree_iter.CMP_GE, "ALICE@X.COM", btree_iter.CMP_LE, "alice@x.com"))
+	is.Equal(t, []int64{3, 2}, scan("email", btree_iter.CMP_GE, "B", btree_iter.CMP_LT, "C"))
+	// not collated
+	is.Equal(t, []int64{3}, scan("name", btree_iter.CMP_GE, "bob", btree_iter.CMP_LE, "bob"))
+	is.Equal(t, []int64{2}, scan("name", btree_iter.CMP_GE, "B", btree_iter.CMP_LT, "C"))
+
+	// unique under the collation
+	tx := r.begin()
+	_, err := tx.Insert("users", (&Record{}).AddInt64("id", 4).
+		AddStr("email", []byte("alice@X.com")).AddStr("name", nil))
+	is.ErrorIs(t, err, ErrUniqueViolation)
+	_, err = tx.Update("users", user(2, "BOB@y.COM", "Bob"))
+	is.Nil(t, err)
+	r.commit(tx)
+	r.ref["users"][1] = user(2, "BOB@y.COM", "Bob")
+
+	// the collations are in the schema
+	r.db.Close()
+	r.db = DB{Path: r.db.Path}
+	is.Nil(t, r.db.Open())
+	is.Equal(t, []int64{2}, scan("email", btree_iter.CMP_GE, "bob@y.com", btree_iter.CMP_LE, "bob@y.com"))
+	is.Nil(t, r.db.Check())
+
+	// a custom collation on a new index
+	trim := uint32(COLLATE_CUSTOM + 1)
+	is.Nil(t, RegisterCollation(trim, func(in []byte) []byte {
+		return bytes.Clone(bytes.TrimSpace(in))
+	}))
+	is.NotNil(t, RegisterCollation(trim, bytes.Clone))
+	is.NotNil(t, RegisterCollation(COLLATE_NOCASE, bytes.Clone))
+	r.create(&TableDef{
+		Name:    "tags",
+		Cols:    []string{"id", "tag"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"id"}},
+	})
+	r.add("tags", *(&Record{}).AddInt64("id", 1).AddStr("tag", []byte(" go ")))
+	ctx := context.Background()
+	is.Nil(t, r.db.CreateIndexCollate(ctx, "tags", []string{"tag"}, []uint32{trim}, false))
+	tx = r.begin()
+	sc := Scanner{
+		Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE,
+		Key1: *(&Record{}).AddStr("tag", []byte("go")),
+		Key2: *(&Record{}).AddStr("tag", []byte("go")),
+	}
+	is.Nil(t, tx.Scan("tags", &sc))
+	is.True(t, sc.Valid())
+	rec := Record{}
+	is.Nil(t, sc.Deref(&rec))
+	is.Equal(t, " go ", string(rec.Get("tag").Str))
+	sc.Close()
+	r.db.Abort(tx)
+	// the collation of an index can't change
+	err = r.db.CreateIndexCollate(ctx, "tags", []string{"tag"}, []uint32{COLLATE_NOCASE}, false)
+	is.ErrorContains(t, err, "collation")
+	is.ErrorContains(t, r.db.CreateIndex("tags", []string{"tag"}, false), "collation")
+
+	// bad collations
+	for _, bad := range [][][]uint32{
+		{{COLLATE_NOCASE}},                 // the primary key
+		{nil, {0, COLLATE_NOCASE}},         // appended primary key column
+		{nil, {42}},                        // unknown
+		{nil, nil, {COLLATE_NOCASE, 0, 0}}, // too many
+	} {
+		tx := r.begin()
+		err := tx.TableNew(&TableDef{
+			Name:       "bad",
+			Cols:       []string{"k", "v", "n"},
+			Types:      []uint32{TYPE_BYTES, TYPE_BYTES, TYPE_INT64},
+			Indexes:    [][]string{{"k"}, {"v"}, {"n"}},
+			Collations: bad,
+		})
+		is.NotNil(t, err)
+		r.db.Abort(tx)
+	}
+	tx = r.begin()
+	err = tx.TableNew(&TableDef{
+		Name:       "bad",
+		Cols:       []string{"k", "n"},
+		Types:      []uint32{TYPE_BYTES, TYPE_INT64},
+		Indexes:    [][]string{{"k"}, {"n"}},
+		Collations: [][]uint32{nil, {COLLATE_NOCASE}},
+	})
+	is.ErrorContains(t, err, "not BYTES")
+	r.db.Abort(tx)
+}
+
+func TestTableRecordMap(t *testing.T) {
+	tdef := &TableDef{
+		Name:     "tbl",
+		Cols:     []string{"i", "s", "f", "b", "ts", "n"},
+		Types:    []uint32{TYPE_INT64, TYPE_BYTES, TYPE_FLOAT64, TYPE_BOOL, TYPE_TIMESTAMP, TYPE_INT64},
+		Indexes:  [][]string{{"i"}},
+		Nullable: []bool{false, false, false, false, false, true},
+	}
+	ts := time.Date(2024, 2, 29, 12, 30, 0, 123456789, time.UTC)
+	for _, i := range []int64{0, 1, -1, math.MaxInt64, math.MinInt64} {
+		rec := (&Record{}).AddInt64("i", i).AddStr("s", []byte("héllo\x00")).
+			AddFloat64("f", -1.5).AddBool("b", true).AddTime("ts", ts).AddNull("n")
+
+		m := rec.ToMap()
+		is.Equal(t, map[string]any{
+			"i": i, "s": []byte("héllo\x00"), "f": -1.5, "b": true, "ts": ts, "n": nil,
+		}, m)
+		back, err := RecordFromMap(tdef, m)
+		is.Nil(t, err)
+		is.Equal(t, *rec, back)
+		is.Equal(t, "héllo\x00", rec.ToMapOpts(MapOptions{Strings: true})["s"])
+
+		// through JSON, with exact numbers
+		data, err := json.Marshal(rec.ToMapOpts(MapOptions{Strings: true}))
+		is.Nil(t, err)
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		m = map[string]any{}
+		is.Nil(t, dec.Decode(&m))
+		back, err = RecordFromMap(tdef, m)
+		is.Nil(t, err)
+		is.Equal(t, *rec, back)
+	}
+
+	// numbers decoded as float64
+	m := map[string]any{}
+	is.Nil(t, json.Unmarshal([]byte(`{"i": 9007199254740992, "f": 3, "ts": 1e9}`), &m))
+	rec, err := RecordFromMap(tdef, m)
+	is.Nil(t, err)
+	is.Equal(t, int64(1<<53), rec.MustGetInt64("i"))
+	is.Equal(t, 3.0, rec.MustGetFloat64("f"))
+	is.Equal(t, time.Unix(1, 0).UTC(), rec.MustGetTime("ts"))
+	is.Equal(t, []string{"i", "f", "ts"}, rec.Cols)
+	// other Go types
+	rec, err = RecordFromMap(tdef, map[string]any{"i": uint32(7), "f": int8(-2), "ts": ts.Format(time.RFC3339Nano)})
+	is.Nil(t, err)
+	is.Equal(t, int64(7), rec.MustGetInt64("i"))
+	is.Equal(t, -2.0, rec.MustGetFloat64("f"))
+	is.Equal(t, ts, rec.MustGetTime("ts"))
+
+	// errors
+	_, err = RecordFromMap(tdef, map[string]any{"i": 1, "x": 2})
+	ve := &ValidationError{}
+	is.ErrorAs(t, err, &ve)
+	is.Equal(t, "x", ve.Col)
+	is.ErrorIs(t, err, &ErrUnknownColumn{Col: "x"})
+	for col, bad := range map[string]any{
+		"i":  uint64(math.MaxInt64) + 1,
+		"n":  json.Number("9223372036854775808"),
+		"ts": math.Pow(2, 63),
+		"s":  42,
+		"b":  "true",
+		"f":  "1.5",
+	} {
+		_, err := RecordFromMap(tdef, map[string]any{col: bad})
+		is.ErrorIs(t, err, &ErrBadColumnType{Col: col}, col)
+		is.ErrorAs(t, err, &ve)
+		is.Equal(t, col, ve.Col)
+	}
+	_, err = RecordFromMap(tdef, map[string]any{"i": 1.5})
+	is.ErrorIs(t, err, &ErrBadColumnType{})
+	_, err = RecordFromMap(tdef, map[string]any{"i": math.Inf(1)})
+	is.ErrorIs(t, err, &ErrBadColumnType{})
+}
+
+func TestTableSchemaCache(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	tdef := &TableDef{
+		Name:    "tbl",
+		Cols:    []string{"k", "v"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"k"}},
+	}
+	r.create(tdef)
+	row := func(k int) *Record {
+		return (&Record{}).AddInt64("k", int64(k)).AddStr("v", []byte("v"))
+	}
+	tx := r.begin()
+	_, err := tx.Insert("tbl", row(1))
+	is.Nil(t, err)
+	r.commit(tx)
+
+	// a TX that began before the drop reads the schema after it
+	old := r.begin()
+	tx = r.begin()
+	is.Nil(t, tx.TableDrop("tbl"))
+	r.commit(tx)
+	ok, err := old.Get("tbl", row(1))
+	is.Nil(t, err)
+	is.True(t, ok)
+	r.db.Abort(old)
+
+	// and doesn't leave it in the cache
+	tx = r.begin()
+	_, err = tx.Insert("tbl", row(2))
+	is.ErrorIs(t, err, ErrTableNotFound)
+	r.db.Abort(tx)
+	tx = r.begin()
+	_, found, err := prefixFirstKey(tx, tdef.Prefixes[0], tdef.Prefixes[0]+1)
+	is.Nil(t, err)
+	is.False(t, found)
+	r.db.Abort(tx)
+
+	// the generation isn't a read for conflicts
+	r.create(&TableDef{
+		Name:    "a",
+		Cols:    []string{"k", "v"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"k"}},
+	})
+	tx = r.begin()
+	_, err = tx.Insert("a", row(1))
+	is.Nil(t, err)
+	r.create(&TableDef{
+		Name:    "b",
+		Cols:    []string{"k", "v"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"k"}},
+	})
+	is.Nil(t, r.db.Commit(tx))
+
+	// another DB on the file sees the changes after opening it
+	tx = r.begin()
+	is.NotNil(t, testTableDef(tx, "b"))
+	r.db.Abort(tx)
+	gen := r.db.tablesGen
+	is.True(t, gen > 0)
+	other := DB{Path: r.db.Path, Options: Options{ReadOnly: true}}
+	is.Nil(t, other.Open())
+	defer other.Close()
+	tx = &DBTX{}
+	other.Begin(tx)
+	_, err = tx.Get("tbl", row(1))
+	is.ErrorIs(t, err, ErrTableNotFound)
+	_, err = tx.Get("b", row(1))
+	is.Nil(t, err)
+	other.Abort(tx)
+	is.Equal(t, gen, other.tablesGen)
+}
+
+func TestTableTruncate(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	r.create(&TableDef{
+		Name:    "tbl_test",
+		Cols:    []string{"id", "v"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"id"}, {"v"}},
+		AutoInc: true,
+	})
+	r.create(&TableDef{
+		Name:    "keep",
+		Cols:    []string{"id", "v"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"id"}},
+	})
+	row := func(i int) Record {
+		return *(&Record{}).AddInt64("id", int64(i)).AddStr("v", []byte(fmt.Sprint(fmix32(uint32(i)))))
+	}
+	const size = 50000
+	for i := 1; i <= size; i += 5000 {
+		recs := []Record{}
+		for j := i; j < i+5000; j++ {
+			recs = append(recs, row(j))
+		}
+		tx := r.begin()
+		_, err := tx.InsertBatch("tbl_test", recs)
+		is.Nil(t, err)
+		r.commit(tx)
+	}
+	for i := 1; i <= 10; i++ {
+		r.add("keep", row(i))
+	}
+
+	before, err := r.db.Stats()
+	is.Nil(t, err)
+	count, err := r.db.Truncate("tbl_test")
+	is.Nil(t, err)
+	is.Equal(t, int64(size), count)
+	after, err := r.db.Stats()
+	is.Nil(t, err)
+
+	// the pages of the table are freed
+	pages := func(s DBStats) uint64 { return s.KV.NodePages + s.KV.LeafPages + s.KV.OverflowPages }
+	is.Greater(t, pages(before), pages(after)+100)
+	is.GreaterOrEqual(t, after.KV.FreePages-before.KV.FreePages, (pages(before)-pages(after))*3/4)
+	is.Equal(t, TableStats{}, after.Tables["tbl_test"])
+	is.Equal(t, int64(10), after.Tables["keep"].Rows)
+
+	// no keys under any prefix
+	tx := r.begin()
+	sc := Scanner{Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE}
+	is.Nil(t, tx.Scan("tbl_test", &sc))
+	is.False(t, sc.Valid())
+	for _, prefix := range testTableDef(tx, "tbl_test").Prefixes {
+		_, found, err := prefixFirstKey(tx, prefix, prefix+1)
+		is.Nil(t, err)
+		is.False(t, found)
+	}
+	r.db.Abort(tx)
+	kept := row(10)
+	is.True(t, r.get("keep", &kept))
+	is.Nil(t, r.db.Check())
+
+	// the schema stays, with the counter starting over
+	tx = r.begin()
+	rec := *(&Record{}).AddStr("v", []byte("a"))
+	_, err = tx.Insert("tbl_test", &rec)
+	is.Nil(t, err)
+	is.Equal(t, int64(1), rec.Get("id").I64)
+	r.commit(tx)
+	count, err = r.db.Truncate("tbl_test")
+	is.Nil(t, err)
+	is.Equal(t, int64(1), count)
+
+	// row by row for the change feed
+	r.create(&TableDef{
+		Name:    "feed",
+		Cols:    []string{"id", "v"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"id"}},
+		Changes: true,
+	})
+	for i := 1; i <= 5; i++ {
+		r.add("feed", row(i))
+	}
+	count, err = r.db.Truncate("feed")
+	is.Nil(t, err)
+	is.Equal(t, int64(5), count)
+	gone := row(1)
+	is.False(t, r.get("feed", &gone))
+
+	// refused
+	_, err = r.db.Truncate("@meta")
+	is.NotNil(t, err)
+	_, err = r.db.Truncate("nope")
+	is.ErrorIs(t, err, ErrTableNotFound)
+	r.create(&TableDef{
+		Name:        "child",
+		Cols:        []string{"id", "parent"},
+		Types:       []uint32{TYPE_INT64, TYPE_INT64},
+		Indexes:     [][]string{{"id"}, {"parent"}},
+		ForeignKeys: []ForeignKey{{Cols: []string{"parent"}, Table: "keep"}},
+	})
+	_, err = r.db.Truncate("keep")
+	is.ErrorIs(t, err, ErrForeignKey)
+	kept = row(1)
+	is.True(t, r.get("keep", &kept))
+}
+
+func benchmarkTruncate(b *testing.B, fast bool) {
+	const size = 50000
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		r := newR()
+		r.create(&TableDef{
+			Name:    "tbl_test",
+			Cols:    []string{"k", "v"},
+			Types:   []uint32{TYPE_INT64, TYPE_BYTES},
+			Indexes: [][]string{{"k"}, {"v"}},
+		})
+		j := 0
+		_, err := r.db.Load("tbl_test", func() (*Record, bool) {
+			j++
+			rec := (&Record{}).AddInt64("k", int64(j)).AddStr("v", []byte(fmt.Sprint(fmix32(uint32(j)))))
+			return rec, j <= size
+		})
+		assert(err == nil)
+		b.StartTimer()
+		if fast {
+			_, err := r.db.Truncate("tbl_test")
+			assert(err == nil)
+		} else {
+			tx := r.begin()
+			_, err := tx.DeleteRange("tbl_test", Record{}, Record{}, btree_iter.CMP_GE, btree_iter.CMP_LE)
+			assert(err == nil)
+			r.commit(tx)
+		}
+		b.StopTimer()
+		r.dispose()
+	}
+}
+
+// 50k rows with a secondary index
+func BenchmarkTruncate(b *testing.B)     { benchmarkTruncate(b, true) }
+func BenchmarkTruncateLoop(b *testing.B) { benchmarkTruncate(b, false) }
+
+func TestTableWatch(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	r.create(&TableDef{
+		Name:    "tbl_test",
+		Cols:    []string{"k", "v"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"k"}},
+	})
+	key := func(k int) Record { return *(&Record{}).AddInt64("k", int64(k)) }
+	row := func(k int, v string) Record { return *(&Record{}).AddInt64("k", int64(k)).AddStr("v", []byte(v)) }
+	drain := func(w *Watcher) (out []ChangeEvent) {
+		for {
+			select {
+			case ev, ok := <-w.C:
+				if !ok {
+					return out
+				}
+				out = append(out, ev)
+			default:
+				return out
+			}
+		}
+	}
+
+	_, err := r.db.Watch("tbl_test", Record{}, *(&Record{}).AddStr("v", nil), WatchOptions{})
+	is.NotNil(t, err)
+	_, err = r.db.Watch("@meta", Record{}, Record{}, WatchOptions{})
+	is.NotNil(t, err)
+	all, err := r.db.Watch("tbl_test", Record{}, Record{}, WatchOptions{Buffer: 10000})
+	is.Nil(t, err)
+	low, err := r.db.Watch("tbl_test", Record{}, key(49), WatchOptions{Buffer: 10000})
+	is.Nil(t, err)
+	high, err := r.db.Watch("tbl_test", key(25), key(99), WatchOptions{Buffer: 10000})
+	is.Nil(t, err)
+
+	// concurrent writers
+	wg := sync.WaitGroup{}
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := g; k < 100; k += 4 {
+				for {
+					tx := r.begin()
+					rec := row(k, "a")
+					_, err := tx.Insert("tbl_test", &rec)
+					assert(err == nil)
+					if k%3 == 0 {
+						_, err = tx.Update("tbl_test", row(k, "b"))
+						assert(err == nil)
+					}
+					if r.db.Commit(tx) == nil {
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	tx := r.begin()
+	_, err = tx.Update("tbl_test", row(1, "c"))
+	is.Nil(t, err)
+	_, err = tx.Update("tbl_test", row(2, "a")) // unchanged
+	is.Nil(t, err)
+	_, err = tx.Delete("tbl_test", key(30))
+	is.Nil(t, err)
+	r.commit(tx)
+	// nothing from a rollback or an abort
+	tx = r.begin()
+	sp := tx.Savepoint()
+	_, err = tx.Delete("tbl_test", key(31))
+	is.Nil(t, err)
+	is.Nil(t, tx.RollbackTo(sp))
+	r.commit(tx)
+	tx = r.begin()
+	_, err = tx.Delete("tbl_test", key(32))
+	is.Nil(t, err)
+	r.db.Abort(tx)
+
+	events := drain(all)
+	is.Len(t, events, 102)
+	for i, ev := range events {
+		is.Equal(t, 1, len(ev.Key.Cols))
+		is.Empty(t, ev.Row.Cols)
+		if i > 0 {
+			is.LessOrEqual(t, events[i-1].Seq, ev.Seq)
+		}
+	}
+	is.Equal(t, CHANGE_UPDATE, events[100].Op)
+	is.Equal(t, key(1), events[100].Key)
+	is.Equal(t, CHANGE_DEL, events[101].Op)
+	is.Equal(t, key(30), events[101].Key)
+	// the events in range, in the same order
+	for _, w := range []struct {
+		w      *Watcher
+		lo, hi int64
+	}{{low, 0, 49}, {high, 25, 99}} {
+		want := []ChangeEvent{}
+		for _, ev := range events {
+			if k := ev.Key.Get("k").I64; w.lo <= k && k <= w.hi {
+				want = append(want, ev)
+			}
+		}
+		is.Equal(t, want, drain(w.w))
+	}
+
+	// several rows in one commit
+	tx = r.begin()
+	_, err = tx.DeleteRange("tbl_test", key(40), key(59), btree_iter.CMP_GE, btree_iter.CMP_LE)
+	is.Nil(t, err)
+	r.commit(tx)
+	events = drain(high)
+	is.Len(t, events, 20)
+	for i, ev := range events {
+		is.Equal(t, CHANGE_DEL, ev.Op)
+		is.Equal(t, events[0].Seq, ev.Seq)
+		is.Equal(t, key(40+i), ev.Key)
+	}
+	count, err := r.db.Truncate("tbl_test")
+	is.Nil(t, err)
+	is.Equal(t, int64(79), count)
+	events = drain(all)
+	is.Len(t, events, 20+79)
+	is.Len(t, drain(low), 10+39)
+	for _, ev := range events[20:] {
+		is.Equal(t, CHANGE_DEL, ev.Op)
+	}
+
+	// an overflow doesn't block the writer
+	small, err := r.db.Watch("tbl_test", Record{}, Record{}, WatchOptions{Buffer: 2})
+	is.Nil(t, err)
+	for k := 0; k < 3; k++ {
+		r.add("tbl_test", row(k, "a"))
+	}
+	is.Len(t, drain(small), 2)
+	_, ok := <-small.C
+	is.False(t, ok)
+	is.ErrorIs(t, small.Err(), ErrWatchOverflow)
+	small.Close()
+
+	// Close while writing
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for k := 100; k < 300; k++ {
+			r.add("tbl_test", row(k, "a"))
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		w, err := r.db.Watch("tbl_test", key(100), Record{}, WatchOptions{Buffer: 1000})
+		is.Nil(t, err)
+		time.Sleep(time.Millisecond)
+		w.Close()
+		w.Close()
+		for ev := range w.C {
+			is.GreaterOrEqual(t, ev.Key.Get("k").I64, int64(100))
+		}
+		is.Nil(t, w.Err())
+	}
+	<-done
+
+	// closed with the DB
+	r.db.Close()
+	_, ok = <-all.C
+	is.False(t, ok)
+	is.Nil(t, all.Err())
+	r.db = DB{Path: r.db.Path}
+	is.Nil(t, r.db.Open())
+}
+
+func TestTableJoin(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	r.create(&TableDef{
+		Name:    "users",
+		Cols:    []string{"id", "name"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"id"}},
+	})
+	r.create(&TableDef{
+		Name:    "orders",
+		Cols:    []string{"id", "user", "note"},
+		Types:   []uint32{TYPE_INT64, TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"id"}, {"user"}},
+	})
+	for i := 1; i <= 3; i++ {
+		r.add("users", *(&Record{}).AddInt64("id", int64(i)).AddStr("name", []byte(fmt.Sprint("u", i))))
+	}
+	// user 1 has 3 orders, user 2 none; user 9 doesn't exist
+	for i, u := range []int64{1, 1, 3, 1, 9} {
+		r.add("orders", *(&Record{}).AddInt64("id", int64(10+i)).AddInt64("user", u).AddStr("note", nil))
+	}
+
+	tx := r.begin()
+	defer r.db.Abort(tx)
+	all := func() *Scanner { return &Scanner{Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE} }
+	pairs := func(join func(string, *Scanner, string, map[string]string, func(l *Record, r *Record) error) error,
+		left string, right string, on map[string]string, lcol string, rcol string) (out [][2]int64) {
+		err := join(left, all(), right, on, func(l *Record, r *Record) error {
+			p := [2]int64{l.Get(lcol).I64, -1}
+			if r != nil {
+				p[1] = r.Get(rcol).I64
+			}
+			out = append(out, p)
+			return nil
+		})
+		is.Nil(t, err)
+		return out
+	}
+
+	// a point lookup on the primary key
+	want := [][2]int64{{10, 1}, {11, 1}, {12, 3}, {13, 1}}
+	is.Equal(t, want, pairs(tx.Join, "orders", "users", map[string]string{"user": "id"}, "id", "id"))
+	want = [][2]int64{{10, 1}, {11, 1}, {12, 3}, {13, 1}, {14, -1}}
+	is.Equal(t, want, pairs(tx.LeftJoin, "orders", "users", map[string]string{"user": "id"}, "id", "id"))
+	// one to many by a secondary index
+	want = [][2]int64{{1, 10}, {1, 11}, {1, 13}, {3, 12}}
+	is.Equal(t, want, pairs(tx.Join, "users", "orders", map[string]string{"id": "user"}, "id", "id"))
+	want = [][2]int64{{1, 10}, {1, 11}, {1, 13}, {2, -1}, {3, 12}}
+	is.Equal(t, want, pairs(tx.LeftJoin, "users", "orders", map[string]string{"id": "user"}, "id", "id"))
+
+	// the right rows are read into the same record
+	rows := map[*Record]bool{}
+	err := tx.Join("users", all(), "orders", map[string]string{"id": "user"}, func(l *Record, r *Record) error {
+		rows[r] = true
+		return nil
+	})
+	is.Nil(t, err)
+	is.Len(t, rows, 1)
+	// an error from emit
+	stop := errors.New("stop")
+	err = tx.Join("users", all(), "orders", map[string]string{"id": "user"}, func(l *Record, r *Record) error {
+		return stop
+	})
+	is.ErrorIs(t, err, stop)
+
+	// checked before the scan
+	emit := func(l *Record, r *Record) error { panic("unreachable") }
+	for _, on := range []map[string]string{
+		{},
+		{"nope": "id"},
+		{"id": "nope"},
+		{"note": "id"},             // BYTES and INT64
+		{"id": "id", "user": "id"}, // a column twice
+	} {
+		is.NotNil(t, tx.Join("orders", all(), "users", on, emit), on)
+	}
+	is.ErrorIs(t, tx.Join("users", all(), "orders", map[string]string{"name": "note"}, emit), ErrBadRange)
+	is.ErrorIs(t, tx.Join("users", all(), "orders", map[string]string{"name": "user"}, emit), &ErrBadColumnType{})
+	sc := all()
+	sc.Cols = []string{"name"}
+	is.NotNil(t, tx.Join("users", sc, "orders", map[string]string{"id": "user"}, emit))
+
+	// the right row counts with the left one against the budget: the
+	// rows of order 10 and of its user are about 3200 bytes each
+	big := bytes.Repeat([]byte("x"), 3000)
+	tx2 := r.begin()
+	defer r.db.Abort(tx2)
+	_, err = tx2.Update("users", *(&Record{}).AddInt64("id", 1).AddStr("name", big))
+	is.Nil(t, err)
+	_, err = tx2.Update("orders", *(&Record{}).AddInt64("id", 10).AddInt64("user", 1).AddStr("note", big))
+	is.Nil(t, err)
+	r.db.ScanMemLimit = 5000
+	defer func() { r.db.ScanMemLimit = 0 }()
+	for _, table := range []string{"users", "orders"} {
+		sc := all()
+		is.Nil(t, tx2.Scan(table, sc))
+		for ; sc.Valid(); sc.Next() {
+			is.Nil(t, sc.Deref(&Record{}))
+		}
+		sc.Close()
+	}
+	err = tx2.Join("orders", all(), "users", map[string]string{"user": "id"}, func(l *Record, r *Record) error {
+		return nil
+	})
+	is.ErrorIs(t, err, ErrMemoryBudget)
+}
+
+func TestTableGroupBy(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	r.create(&TableDef{
+		Name:     "sales",
+		Cols:     []string{"k", "region", "day", "amount", "price"},
+		Types:    []uint32{TYPE_INT64, TYPE_BYTES, TYPE_INT64, TYPE_INT64, TYPE_FLOAT64},
+		Indexes:  [][]string{{"k"}, {"region", "day"}},
+		Nullable: []bool{false, false, false, true, false},
+	})
+	rows := []struct {
+		region string
+		day    int64
+		amount int64 // 0 for null
+		price  float64
+	}{{"a", 1, 10, 1.5}, {"a", 2, 0, 2.5}, {"b", 1, 5, 0.5}, {"c", 2, 7, 3}, {"b", 2, 1, 1}, {"a", 1, 3, 4}}
+	for i, row := range rows {
+		rec := (&Record{}).AddInt64("k", int64(i+1)).AddStr("region", []byte(row.region)).
+			AddInt64("day", row.day).AddFloat64("price", row.price)
+		if row.amount == 0 {
+			rec.AddNull("amount")
+		} else {
+			rec.AddInt64("amount", row.amount)
+		}
+		r.add("sales", *rec)
+	}
+
+	aggs := []AggSpec{
+		{Func: AGG_COUNT}, {Func: AGG_COUNT, Col: "amount"}, {Func: AGG_SUM, Col: "amount"},
+		{Func: AGG_MIN, Col: "price"}, {Func: AGG_MAX, Col: "price", Name: "top"},
+	}
+	result := func(key *Record, n int64, na int64, sum int64, lo float64, hi float64) Record {
+		return *key.AddInt64("count(*)", n).AddInt64("count(amount)", na).AddInt64("sum(amount)", sum).
+			AddFloat64("min(price)", lo).AddFloat64("top", hi)
+	}
+	byRegion := func() *Scanner {
+		return &Scanner{
+			Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE,
+			Key1: *(&Record{}).AddStr("region", []byte("a")),
+			Key2: *(&Record{}).AddStr("region", []byte("z")),
+		}
+	}
+	all := func() *Scanner { return &Scanner{Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE} }
+	region := func(s string) *Record { return (&Record{}).AddStr("region", []byte(s)) }
+	day := func(d int64) *Record { return (&Record{}).AddInt64("day", d) }
+
+	tx := r.begin()
+	defer r.db.Abort(tx)
+	// the groups follow the index, so they are not held
+	r.db.GroupLimit = 1
+	got, err := tx.GroupBy("sales", byRegion(), []string{"region"}, aggs)
+	is.Nil(t, err)
+	is.Equal(t, []Record{
+		result(region("a"), 3, 2, 13, 1.5, 4),
+		result(region("b"), 2, 2, 6, 0.5, 1),
+		result(region("c"), 1, 1, 7, 3, 3),
+	}, got)
+	got, err = tx.GroupBy("sales", byRegion(), []string{"day", "region"}, aggs[:1])
+	is.Nil(t, err)
+	is.Len(t, got, 5)
+	is.Equal(t, *day(1).AddStr("region", []byte("a")).AddInt64("count(*)", 2), got[0])
+
+	// in a map up to the limit
+	_, err = tx.GroupBy("sales", all(), []string{"day"}, aggs)
+	is.ErrorIs(t, err, ErrMemoryBudget)
+	r.db.GroupLimit = 0
+	got, err = tx.GroupBy("sales", all(), []string{"day"}, aggs)
+	is.Nil(t, err)
+	is.Equal(t, []Record{result(day(1), 3, 3, 18, 0.5, 4), result(day(2), 3, 2, 8, 1, 3)}, got)
+	sc := all()
+	sc.Desc = true
+	got, err = tx.GroupBy("sales", sc, []string{"day"}, aggs)
+	is.Nil(t, err)
+	is.Equal(t, []Record{result(day(1), 3, 3, 18, 0.5, 4), result(day(2), 3, 2, 8, 1, 3)}, got)
+
+	// no groups
+	got, err = tx.GroupBy("sales", all(), nil, aggs)
+	is.Nil(t, err)
+	is.Equal(t, []Record{result(&Record{}, 6, 5, 26, 0.5, 4)}, got)
+
+	// the groups are charged to the scan; a row is about 400 bytes, a
+	// group of all the aggregates about 400 more
+	r.db.ScanMemLimit = 1000
+	_, err = tx.GroupBy("sales", all(), []string{"day"}, aggs)
+	is.ErrorIs(t, err, ErrMemoryBudget)
+	got, err = tx.GroupBy("sales", all(), nil, aggs)
+	is.Nil(t, err)
+	is.Len(t, got, 1)
+	r.db.ScanMemLimit = SCAN_KEYS_CHUNK + 600 // and the keys of the index
+	_, err = tx.GroupBy("sales", byRegion(), []string{"region"}, aggs)
+	is.ErrorIs(t, err, ErrMemoryBudget)
+	r.db.ScanMemLimit = 0
+
+	// an empty scan
+	empty := func() *Scanner {
+		sc := all()
+		sc.Filter = func(*Record) bool { return false }
+		return sc
+	}
+	got, err = tx.GroupBy("sales", empty(), []string{"region"}, aggs)
+	is.Nil(t, err)
+	is.Empty(t, got)
+	got, err = tx.GroupBy("sales", empty(), nil, aggs)
+	is.Nil(t, err)
+	want := *(&Record{}).AddInt64("count(*)", 0).AddInt64("count(amount)", 0).AddInt64("sum(amount)", 0).
+		AddNull("min(price)").AddNull("top")
+	is.Equal(t, []Record{want}, got)
+
+	for _, bad := range [][]AggSpec{
+		{{Func: AGG_SUM, Col: "region"}},
+		{{Func: AGG_SUM}},
+		{{Func: 99, Col: "day"}},
+		{{Func: AGG_MIN, Col: "nope"}},
+		{{Func: AGG_COUNT}, {Func: AGG_COUNT}},
+	} {
+		_, err = tx.GroupBy("sales", all(), []string{"day"}, bad)
+		is.NotNil(t, err, bad)
+	}
+	_, err = tx.GroupBy("sales", all(), []string{"nope"}, aggs)
+	is.NotNil(t, err)
+	_, err = tx.GroupBy("sales", all(), []string{"day", "day"}, aggs)
+	is.NotNil(t, err)
+}
+
+func TestTablePrepare(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	r.create(&TableDef{
+		Name:    "tbl_test",
+		Cols:    []string{"a", "b", "v"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES, TYPE_INT64},
+		Indexes: [][]string{{"a", "b"}, {"v"}},
+	})
+	for a := int64(0); a < 10; a++ {
+		for i, b := range []string{"x", "y"} {
+			rec := Record{}
+			rec.AddInt64("a", a).AddStr("b", []byte(b)).AddInt64("v", a*2+int64(i))
+			r.add("tbl_test", rec)
+		}
+	}
+	str := func(s string) Value { return Value{Type: TYPE_BYTES, Str: []byte(s)} }
+	i64 := func(i int64) Value { return Value{Type: TYPE_INT64, I64: i} }
+
+	_, err := r.db.PrepareGet("nope", "a")
+	is.ErrorIs(t, err, ErrTableNotFound)
+	for _, cols := range [][]string{{"a"}, {"a", "v"}, {"a", "b", "v"}} {
+		_, err := r.db.PrepareGet("tbl_test", cols...)
+		is.Error(t, err, cols)
+	}
+
+	// the values in the order of the statement
+	st, err := r.db.PrepareGet("tbl_test", "b", "a")
+	is.Nil(t, err)
+	rec := Record{}
+	ok, err := st.Get(&rec, str("y"), i64(3))
+	is.Nil(t, err)
+	is.True(t, ok)
+	is.Equal(t, []string{"a", "b", "v"}, rec.Cols)
+	is.Equal(t, int64(7), rec.Get("v").I64)
+	ok, err = st.Get(&rec, str("z"), i64(3))
+	is.Nil(t, err)
+	is.False(t, ok)
+	_, err = st.Get(&rec, i64(3), str("y"))
+	is.ErrorAs(t, err, new(*ErrBadColumnType))
+	_, err = st.Get(&rec, str("y"))
+	is.Error(t, err)
+
+	// the key buffer is reused, but not by the strings of a row
+	ok, err = st.Get(&rec, str("x"), i64(1))
+	is.True(t, ok && err == nil)
+	b := rec.Get("b").Str
+	ok, err = st.Get(&Record{}, str("y"), i64(9))
+	is.True(t, ok && err == nil)
+	is.Equal(t, "x", string(b))
+
+	// less work than DBTX.Get
+	tx := r.begin()
+	key := []Value{str("z"), i64(3)}
+	prepared := testing.AllocsPerRun(100, func() { st.GetTX(tx, &rec, key...) })
+	plain := testing.AllocsPerRun(100, func() {
+		tx.Get("tbl_test", (&Record{}).AddInt64("a", 3).AddStr("b", []byte("z")))
+	})
+	is.Less(t, prepared, plain)
+	r.db.Abort(tx)
+
+	// the reads of a write TX keep their own keys, not the reused buffer
+	tx = r.begin()
+	ok, err = st.GetTX(tx, &rec, str("x"), i64(1))
+	is.True(t, ok && err == nil)
+	ok, err = st.GetTX(tx, &rec, str("x"), i64(2))
+	is.True(t, ok && err == nil)
+	tx2 := r.begin()
+	_, err = tx2.Update("tbl_test", *(&Record{}).AddInt64("a", 1).AddStr("b", []byte("x")).AddInt64("v", 100))
+	is.Nil(t, err)
+	r.commit(tx2)
+	_, err = tx.Update("tbl_test", *(&Record{}).AddInt64("a", 5).AddStr("b", []byte("x")).AddInt64("v", 101))
+	is.Nil(t, err)
+	is.ErrorIs(t, r.db.Commit(tx), transactions.ErrorConflict)
+
+	// a range of an index
+	sst, err := r.db.PrepareScan("tbl_test", []string{"v"}, btree_iter.CMP_GE, btree_iter.CMP_LT)
+	is.Nil(t, err)
+	scan := func(lo int64, hi int64) (got []int64) {
+		tx := r.begin()
+		defer r.db.Abort(tx)
+		sc := Scanner{Cols: []string{"v"}}
+		is.Nil(t, sst.Scan(tx, &sc, []Value{i64(lo)}, []Value{i64(hi)}))
+		defer sc.Close()
+		for ; sc.Valid(); sc.Next() {
+			rec := Record{}
+			is.Nil(t, sc.Deref(&rec))
+			got = append(got, rec.Get("v").I64)
+		}
+		return got
+	}
+	is.Equal(t, []int64{3, 4, 5}, scan(3, 6))
+	is.Equal(t, []int64{18, 19}, scan(18, 100))
+	_, err = r.db.PrepareScan("tbl_test", []string{"b"}, btree_iter.CMP_GE, btree_iter.CMP_LE)
+	is.ErrorIs(t, err, ErrBadRange)
+	_, err = r.db.PrepareScan("tbl_test", []string{"v"}, btree_iter.CMP_GE, btree_iter.CMP_GT)
+	is.ErrorIs(t, err, ErrBadRange)
+
+	// the schema changes are followed, also in the transaction of one
+	tx = r.begin()
+	is.Nil(t, tx.TableAddColumn("tbl_test", "w", TYPE_INT64, i64(5)))
+	ok, err = st.GetTX(tx, &rec, str("x"), i64(2))
+	is.True(t, ok && err == nil)
+	is.Equal(t, int64(5), rec.Get("w").I64)
+	r.commit(tx)
+	ok, err = st.Get(&rec, str("x"), i64(2))
+	is.True(t, ok && err == nil)
+	is.Equal(t, []string{"a", "b", "v", "w"}, rec.Cols)
+
+	tx = r.begin()
+	is.Nil(t, tx.TableDrop("tbl_test"))
+	r.commit(tx)
+	_, err = st.Get(&rec, str("x"), i64(2))
+	is.ErrorIs(t, err, ErrTableNotFound)
+	r.create(&TableDef{
+		Name:    "tbl_test",
+		Cols:    []string{"a", "b"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"a"}},
+	})
+	_, err = st.Get(&rec, str("x"), i64(2))
+	is.ErrorContains(t, err, "not the primary key")
+	tx = r.begin()
+	is.ErrorContains(t, sst.Scan(tx, &Scanner{}, []Value{i64(0)}, []Value{i64(1)}), "unknown column: v")
+	r.db.Abort(tx)
+}
+
+func benchmarkGet(b *testing.B, prepared bool) {
+	r := newR()
+	defer r.dispose()
+	r.create(&TableDef{
+		Name:    "tbl_test",
+		Cols:    []string{"k", "v"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"k"}},
+	})
+	const size = 1000
+	recs := []Record{}
+	for j := 0; j < size; j++ {
+		recs = append(recs, *(&Record{}).AddInt64("k", int64(j)).AddStr("v", []byte(fmt.Sprint(j))))
+	}
+	tx := r.begin()
+	_, err := tx.InsertBatch("tbl_test", recs)
+	assert(err == nil)
+	r.commit(tx)
+	st, err := r.db.PrepareGet("tbl_test", "k")
+	assert(err == nil)
+
+	tx = r.begin()
+	defer r.db.Abort(tx)
+	rec := Record{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		k := int64(i % size)
+		ok := false
+		if prepared {
+			ok, err = st.GetTX(tx, &rec, Value{Type: TYPE_INT64, I64: k})
+		} else {
+			rec = Record{}
+			ok, err = tx.Get("tbl_test", rec.AddInt64("k", k))
+		}
+		assert(ok && err == nil)
+	}
+}
+
+// point queries on 1000 rows
+func BenchmarkGet(b *testing.B)         { benchmarkGet(b, false) }
+func BenchmarkGetPrepared(b *testing.B) { benchmarkGet(b, true) }
+
+func TestTableBufferedWriter(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	r.create(&TableDef{
+		Name:    "tbl_test",
+		Cols:    []string{"k", "v"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"k"}, {"v"}},
+	})
+	row := func(k int64, v string) Record {
+		return *(&Record{}).AddInt64("k", k).AddStr("v", []byte(v))
+	}
+	key := func(k int64) Record { return *(&Record{}).AddInt64("k", k) }
+	stored := func() map[int64]string {
+		tx := r.begin()
+		defer r.db.Abort(tx)
+		sc := Scanner{Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE}
+		is.Nil(t, tx.Scan("tbl_test", &sc))
+		defer sc.Close()
+		out := map[int64]string{}
+		for ; sc.Valid(); sc.Next() {
+			rec := Record{}
+			is.Nil(t, sc.Deref(&rec))
+			out[rec.Get("k").I64] = string(rec.Get("v").Str)
+		}
+		return out
+	}
+
+	// checked when buffered
+	w := r.db.NewBufferedWriter(BufferOptions{})
+	is.ErrorIs(t, w.Set("nope", row(1, "a")), ErrTableNotFound)
+	is.Error(t, w.Set("@meta", row(1, "a")))
+	is.ErrorAs(t, w.Set("tbl_test", *(&Record{}).AddStr("k", []byte("a"))), new(*ErrBadColumnType))
+	is.ErrorAs(t, w.Set("tbl_test", *(&Record{}).AddStr("v", []byte("a"))), new(*ErrMissingColumn))
+	extra := row(1, "a")
+	is.Error(t, w.Set("tbl_test", *extra.AddInt64("nope", 1)))
+	is.Equal(t, 0, w.Len())
+
+	// the last write of a row wins
+	for i := int64(0); i < 100; i++ {
+		is.Nil(t, w.Set("tbl_test", row(i%10, fmt.Sprint("v", i))))
+	}
+	is.Nil(t, w.Delete("tbl_test", key(3)))
+	is.Equal(t, 10, w.Len())
+
+	// seen by the writer only
+	rec := key(5)
+	ok, err := w.Get("tbl_test", &rec)
+	is.True(t, ok && err == nil)
+	is.Equal(t, "v95", string(rec.Get("v").Str))
+	rec = key(3)
+	ok, err = w.Get("tbl_test", &rec)
+	is.False(t, ok || err != nil)
+	is.Empty(t, stored())
+
+	// interleaved with direct writes: the buffer is applied over them
+	tx := r.begin()
+	for _, k := range []int64{3, 5, 20} {
+		_, err := tx.Set("tbl_test", &DBUpdateReq{Record: row(k, "direct")})
+		is.Nil(t, err)
+	}
+	r.commit(tx)
+	rec = key(20)
+	ok, err = w.Get("tbl_test", &rec)
+	is.True(t, ok && err == nil)
+	is.Equal(t, "direct", string(rec.Get("v").Str))
+	is.Nil(t, w.Flush())
+	is.Equal(t, 0, w.Len())
+	expected := map[int64]string{20: "direct"}
+	for k := int64(0); k < 10; k++ {
+		if k != 3 {
+			expected[k] = fmt.Sprint("v", 90+k)
+		}
+	}
+	is.Equal(t, expected, stored())
+	tx = r.begin()
+	n, err := tx.Count("tbl_test", &Scanner{
+		Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE,
+		Key1: *(&Record{}).AddStr("v", []byte("v")), Key2: *(&Record{}).AddStr("v", []byte("w")),
+	})
+	r.db.Abort(tx)
+	is.Nil(t, err)
+	is.Equal(t, int64(9), n) // the index follows
+
+	// a failed flush writes nothing and keeps the buffer
+	is.Nil(t, w.Set("tbl_test", row(31, "a")))
+	is.Nil(t, w.Set("tbl_test", key(30)))
+	is.ErrorAs(t, w.Flush(), new(*ErrMissingColumn))
+	is.Equal(t, 2, w.Len())
+	is.Equal(t, expected, stored())
+	is.Nil(t, w.Set("tbl_test", row(30, "b")))
+	is.Nil(t, w.Flush())
+	expected[30], expected[31] = "b", "a"
+	is.Equal(t, expected, stored())
+	is.Nil(t, w.Set("tbl_test", key(40)))
+	w.Reset()
+	is.Nil(t, w.Flush())
+
+	// the limits
+	w = r.db.NewBufferedWriter(BufferOptions{MaxOps: 5})
+	for k := int64(100); k < 112; k++ {
+		is.Nil(t, w.Set("tbl_test", row(k, "x")))
+	}
+	is.Equal(t, 2, w.Len())
+	is.Equal(t, len(expected)+10, len(stored()))
+	w = r.db.NewBufferedWriter(BufferOptions{MaxBytes: 1000})
+	is.Nil(t, w.Set("tbl_test", row(200, "x")))
+	is.Equal(t, 1, w.Len())
+	is.Nil(t, w.Set("tbl_test", row(200, strings.Repeat("x", 1000))))
+	is.Equal(t, 0, w.Len())
+
+	// a failed flush on a limit keeps the write that started it
+	w = r.db.NewBufferedWriter(BufferOptions{MaxOps: 2})
+	is.Nil(t, w.Set("tbl_test", key(300)))
+	err = w.Set("tbl_test", row(301, "a"))
+	is.ErrorIs(t, err, ErrNotFlushed)
+	is.ErrorAs(t, err, new(*ErrMissingColumn))
+	is.Equal(t, 2, w.Len())
+	rec = key(301)
+	ok, err = w.Get("tbl_test", &rec)
+	is.True(t, ok && err == nil)
+	is.Equal(t, "a", string(rec.Get("v").Str))
+	is.Nil(t, w.Set("tbl_test", row(300, "c")))
+	is.Equal(t, 0, w.Len())
+	is.Equal(t, "c", stored()[300])
+	is.Equal(t, "a", stored()[301])
+}
+
+func TestTableScanPrefetch(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	r.db.Close()
+	m := &kv.Counters{}
+	r.db = DB{Path: r.db.Path, Options: Options{Metrics: m}}
+	is.Nil(t, r.db.Open())
+	r.create(&TableDef{
+		Name:    "tbl_test",
+		Cols:    []string{"k", "v"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"k"}},
+	})
+	recs := []Record{}
+	for k := 0; k < 2000; k++ {
+		recs = append(recs, *(&Record{}).AddInt64("k", int64(k)).AddStr("v", []byte(strings.Repeat("v", 100))))
+	}
+	tx := r.begin()
+	_, err := tx.InsertBatch("tbl_test", recs)
+	is.Nil(t, err)
+	r.commit(tx)
+
+	count := func(sc Scanner) int {
+		tx := r.begin()
+		defer r.db.Abort(tx)
+		sc.Cmp1, sc.Cmp2 = btree_iter.CMP_GE, btree_iter.CMP_LE
+		sc.Key1 = *(&Record{}).AddInt64("k", 0)
+		sc.Key2 = *(&Record{}).AddInt64("k", math.MaxInt64)
+		is.Nil(t, tx.Scan("tbl_test", &sc))
+		defer sc.Close()
+		n := 0
+		for ; sc.Valid(); sc.Next() {
+			n++
+		}
+		is.Nil(t, sc.Err())
+		return n
+	}
+	prefetched := func() uint64 { return m.Snapshot().Counts[kv.METRIC_PREFETCH] }
+
+	// not for a point query, or when turned off
+	base := prefetched()
+	tx = r.begin()
+	ok, err := tx.Get("tbl_test", (&Record{}).AddInt64("k", 1000))
+	is.Nil(t, err)
+	is.True(t, ok)
+	r.db.Abort(tx)
+	is.Equal(t, 1, count(Scanner{Limit: 1}))
+	is.Equal(t, 2000, count(Scanner{Prefetch: -1}))
+	is.Equal(t, base, prefetched())
+
+	// automatic for a long range, in either direction
+	is.Equal(t, 2000, count(Scanner{}))
+	forward := prefetched()
+	is.Greater(t, forward, base)
+	is.Equal(t, 2000, count(Scanner{Desc: true}))
+	is.Greater(t, prefetched(), forward)
+	is.Equal(t, 2000, count(Scanner{Prefetch: 1}))
+}
+
+func benchmarkScanFile(b *testing.B, prefetch int) {
+	r := newR()
+	defer r.dispose()
+	r.db.Close()
+	opts := Options{CacheSize: 16 * btree.BTREE_PAGE_SIZE}
+	r.db = DB{Path: r.db.Path, Options: opts}
+	assert(r.db.Open() == nil)
+	r.create(&TableDef{
+		Name:    "tbl_test",
+		Cols:    []string{"k", "v"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"k"}},
+	})
+	const size = 20000
+	recs := []Record{}
+	for j := 0; j < size; j++ {
+		recs = append(recs, *(&Record{}).AddInt64("k", int64(j)).AddStr("v", []byte(strings.Repeat("v", 100))))
+	}
+	tx := r.begin()
+	_, err := tx.InsertBatch("tbl_test", recs)
+	assert(err == nil)
+	r.commit(tx)
+
+	rec := Record{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// cold: the file is reopened with its pages out of the page cache
+		b.StopTimer()
+		r.db.Close()
+		ok, err := evictFile(r.db.Path)
+		assert(err == nil)
+		if !ok {
+			b.Skip("the page cache can't be dropped")
+		}
+		r.db = DB{Path: r.db.Path, Options: opts}
+		assert(r.db.Open() == nil)
+		b.StartTimer()
+
+		tx := r.begin()
+		sc := Scanner{
+			Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE,
+			Key1:     *(&Record{}).AddInt64("k", 0),
+			Key2:     *(&Record{}).AddInt64("k", size),
+			Prefetch: prefetch, Reuse: true,
+		}
+		assert(tx.Scan("tbl_test", &sc) == nil)
+		n := 0
+		for ; sc.Valid(); sc.Next() {
+			assert(sc.Deref(&rec) == nil)
+			n++
+		}
+		assert(n == size)
+		sc.Close()
+		r.db.Abort(tx)
+	}
+	b.ReportMetric(float64(size*b.N)/b.Elapsed().Seconds(), "rows/s")
+}
+
+// full scans of 20000 rows read from the disk, with a small page cache
+func BenchmarkScanFile(b *testing.B)         { benchmarkScanFile(b, -1) }
+func BenchmarkScanFilePrefetch(b *testing.B) { benchmarkScanFile(b, 0) }
+
+func TestTableMaxLen(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	tdef := func(maxLen ...int) *TableDef {
+		return &TableDef{
+			Name:    "tbl_test",
+			Cols:    []string{"k", "n", "v"},
+			Types:   []uint32{TYPE_BYTES, TYPE_INT64, TYPE_BYTES},
+			Indexes: [][]string{{"k", "n"}},
+			MaxLen:  maxLen,
+		}
+	}
+
+	// the primary key can't fit: 4 + (1 + 2*495 + 1) + (1 + 8) bytes
+	tx := r.begin()
+	is.ErrorContains(t, tx.TableNew(tdef(495)), "index keys can be 1005 bytes, more than 1000")
+	is.ErrorContains(t, tx.TableNew(tdef(10, 10)), "bad max length: n")
+	is.ErrorContains(t, tx.TableNew(tdef(10, 0, -1)), "bad max length: v")
+	is.ErrorContains(t, tx.TableNew(tdef(10, 0, 0, 0)), "bad table schema")
+	r.db.Abort(tx)
+	r.create(tdef(490, 0, 8))
+
+	row := func(k string, v string) *Record {
+		return (&Record{}).AddStr("k", []byte(k)).AddInt64("n", 1).AddStr("v", []byte(v))
+	}
+	tx = r.begin()
+	_, err := tx.Insert("tbl_test", row(strings.Repeat("\x00", 490), "12345678"))
+	is.Nil(t, err)
+	_, err = tx.Insert("tbl_test", row(strings.Repeat("k", 491), "x"))
+	verr := (*ValidationError)(nil)
+	is.ErrorAs(t, err, &verr)
+	is.Equal(t, "k", verr.Col)
+	is.ErrorIs(t, err, &ErrValueTooLong{Col: "k"})
+	_, err = tx.Insert("tbl_test", row("a", "123456789"))
+	is.ErrorIs(t, err, &ErrValueTooLong{Col: "v"})
+	is.ErrorContains(t, err, "value too long: v (max 8 bytes)")
+	_, err = tx.InsertBatch("tbl_test", []Record{*row("b", "x"), *row("c", "123456789")})
+	is.ErrorIs(t, err, &ErrValueTooLong{Col: "v"})
+	// partial updates and secondary indexes
+	_, err = tx.Insert("tbl_test", row("b", "x"))
+	is.Nil(t, err)
+	_, err = tx.Set("tbl_test", &DBUpdateReq{Record: *row("b", "123456789"), Partial: true})
+	is.ErrorIs(t, err, &ErrValueTooLong{Col: "v"})
+	r.commit(tx)
+	// the keys of the index end with the primary key
+	err = r.db.CreateIndex("tbl_test", []string{"v"}, false)
+	is.ErrorContains(t, err, "index keys can be 1013 bytes")
+
+	// a longer value is still a bound of a range
+	tx = r.begin()
+	defer r.db.Abort(tx)
+	sc := Scanner{
+		Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE,
+		Key1: *(&Record{}).AddStr("k", nil),
+		Key2: *(&Record{}).AddStr("k", []byte(strings.Repeat("\xff", 1000))),
+	}
+	is.Nil(t, tx.Scan("tbl_test", &sc))
+	defer sc.Close()
+	is.True(t, sc.Valid())
+}
+
+// the keys of an index with descending columns are in the declared order,
+// column by column, and decode to the values
+func TestTableDescKeyOrder(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	schemas := []struct {
+		types []uint32
+		desc  []bool
+	}{
+		{[]uint32{TYPE_BYTES}, []bool{true}},
+		{[]uint32{TYPE_BYTES, TYPE_BYTES}, []bool{false, true}},
+		{[]uint32{TYPE_BYTES, TYPE_BYTES}, []bool{true, false}},
+		{[]uint32{TYPE_INT64, TYPE_BYTES}, []bool{true, true}},
+		{[]uint32{TYPE_FLOAT64, TYPE_BOOL, TYPE_BYTES}, []bool{true, false, true}},
+		{[]uint32{TYPE_TIMESTAMP, TYPE_BYTES, TYPE_INT64}, []bool{false, true, false}},
+	}
+	for _, schema := range schemas {
+		tdef := &TableDef{Name: "tbl_test", Prefixes: []uint32{100, 101}}
+		for i, tp := range schema.types {
+			tdef.Cols = append(tdef.Cols, fmt.Sprint("c", i))
+			tdef.Types = append(tdef.Types, tp)
+		}
+		tdef.Indexes = [][]string{tdef.Cols[len(tdef.Cols)-1:], tdef.Cols}
+		tdef.Descending = [][]bool{nil, schema.desc}
+		compare := func(a, b []Value) int {
+			for i := range a {
+				c := testCompareValue(&a[i], &b[i])
+				if schema.desc[i] {
+					c = -c
+				}
+				if c != 0 {
+					return c
+				}
+			}
+			return 0
+		}
+
+		tuples := make([][]Value, 300)
+		keys := make([][]byte, len(tuples))
+		for i := range tuples {
+			for _, tp := range schema.types {
+				v := testRandValue(rng, tp)
+				for v.Type == TYPE_NULL {
+					v = testRandValue(rng, tp) // index columns are not null
+				}
+				tuples[i] = append(tuples[i], v)
+			}
+			keys[i] = indexKey(nil, tdef, 1, tuples[i])
+
+			out := make([]Value, len(schema.types))
+			for j, tp := range schema.types {
+				out[j].Type = tp
+			}
+			asc, err := indexKeyAsc(tdef, 1, keys[i])
+			is.Nil(t, err)
+			is.Nil(t, decodeKey(asc, out))
+			is.Equal(t, 0, testCompareTuple(tuples[i], out), "%v %v", tuples[i], out)
+		}
+
+		for i := range tuples {
+			for j := range tuples {
+				want := compare(tuples[i], tuples[j])
+				got := bytes.Compare(keys[i], keys[j])
+				is.Equal(t, want, got, "%v %v %v", schema.desc, tuples[i], tuples[j])
+			}
+		}
+
+		// the range of a prefix of the columns holds the keys with it
+		for i := range tuples {
+			for n := 1; n < len(schema.types); n++ {
+				lo := indexKeyPartial(nil, tdef, 1, tuples[i][:n], btree_iter.CMP_GE)
+				hi := indexKeyPartial(nil, tdef, 1, tuples[i][:n], btree_iter.CMP_LE)
+				for j := range tuples {
+					in := bytes.Compare(lo, keys[j]) <= 0 && bytes.Compare(keys[j], hi) <= 0
+					same := testCompareTuple(tuples[i][:n], tuples[j][:n]) == 0
+					is.Equal(t, same, in, "%v %v", tuples[i][:n], tuples[j])
+				}
+			}
+		}
+	}
+}
+
+func TestTableDescIndex(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	tdef := &TableDef{
+		Name:    "events",
+		Cols:    []string{"id", "device", "time", "name"},
+		Types:   []uint32{TYPE_INT64, TYPE_INT64, TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"id"}, {"device", "time"}},
+		// the time of a device newest first
+		Descending: [][]bool{nil, {false, true}},
+	}
+	bad := *tdef
+	bad.Descending = [][]bool{{true}}
+	tx := r.begin()
+	is.ErrorContains(t, tx.TableNew(&bad), "primary key column cannot be descending")
+	bad.Descending = [][]bool{nil, {false, true, false, true}}
+	is.ErrorContains(t, tx.TableNew(&bad), "bad table schema")
+	r.db.Abort(tx)
+	r.create(tdef)
+
+	tx = r.begin()
+	for i := int64(0); i < 300; i++ {
+		rec := (&Record{}).AddInt64("id", i).AddInt64("device", i%3).AddInt64("time", (i*7)%100)
+		rec.AddStr("name", []byte(fmt.Sprint("n", i%10)))
+		_, err := tx.Insert("events", rec)
+		is.Nil(t, err)
+	}
+	r.commit(tx)
+	is.Nil(t, r.db.Check())
+	is.Nil(t, r.db.Analyze("events"))
+
+	times := func(sc *Scanner) []int64 {
+		defer sc.Close()
+		out := []int64{}
+		for ; sc.Valid(); sc.Next() {
+			rec := Record{}
+			is.Nil(t, sc.Deref(&rec))
+			out = append(out, rec.Get("time").I64)
+		}
+		is.Nil(t, sc.Err())
+		return out
+	}
+	// the rows of a device in the order of the index, and backward
+	dev := *(&Record{}).AddInt64("device", 1)
+	for _, desc := range []bool{false, true} {
+		tx = r.begin()
+		sc := Scanner{Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE, Key1: dev, Key2: dev, Desc: desc}
+		is.Nil(t, tx.Scan("events", &sc))
+		got := times(&sc)
+		is.Equal(t, 100, len(got))
+		want := slices.Clone(got)
+		slices.Sort(want)
+		if !desc {
+			slices.Reverse(want)
+		}
+		is.Equal(t, want, got)
+		r.db.Abort(tx)
+	}
+
+	// a range is in the order of the index, from the larger time
+	tx = r.begin()
+	sc := Scanner{
+		Cmp1: btree_iter.CMP_GT, Cmp2: btree_iter.CMP_LE,
+		Key1: *(&Record{}).AddInt64("device", 1).AddInt64("time", 50),
+		Key2: *(&Record{}).AddInt64("device", 1).AddInt64("time", 40),
+	}
+	is.Nil(t, tx.Scan("events", &sc))
+	got := times(&sc)
+	is.Equal(t, int64(49), got[0])
+	is.Equal(t, int64(40), got[len(got)-1])
+	r.db.Abort(tx)
+
+	// the planner turns the conditions into the range
+	for _, ops := range [][2]int{
+		{btree_iter.CMP_GE, btree_iter.CMP_LE}, {btree_iter.CMP_GT, btree_iter.CMP_LT},
+	} {
+		conds := []Cond{
+			{Col: "device", Op: COND_EQ, Val: Value{Type: TYPE_INT64, I64: 2}},
+			{Col: "time", Op: ops[0], Val: Value{Type: TYPE_INT64, I64: 40}},
+			{Col: "time", Op: ops[1], Val: Value{Type: TYPE_INT64, I64: 50}},
+		}
+		sc, err := r.db.Find("events", conds)
+		is.Nil(t, err)
+		is.Equal(t, 1, sc.Plan().Index)
+		is.Empty(t, sc.Plan().Filter)
+		got := times(sc)
+		is.NotEmpty(t, got)
+		for i, tm := range got {
+			is.True(t, condHolds(ops[0], &Value{Type: TYPE_INT64, I64: tm}, &conds[1].Val))
+			is.True(t, condHolds(ops[1], &Value{Type: TYPE_INT64, I64: tm}, &conds[2].Val))
+			is.True(t, i == 0 || got[i-1] > tm)
+		}
+	}
+
+	// a descending string column, added to the table
+	ctx := context.Background()
+	is.Nil(t, r.db.CreateIndexDesc(ctx, "events", []string{"name"}, []bool{true}, false))
+	is.ErrorContains(t, r.db.CreateIndex("events", []string{"name"}, false), "another order")
+	tx = r.begin()
+	sc = Scanner{
+		Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE,
+		Key1: *(&Record{}).AddStr("name", []byte("n7")),
+		Key2: *(&Record{}).AddStr("name", []byte("n2")),
+	}
+	is.Nil(t, tx.Scan("events", &sc))
+	names := []string{}
+	for ; sc.Valid(); sc.Next() {
+		rec := Record{}
+		is.Nil(t, sc.Deref(&rec))
+		if n := string(rec.Get("name").Str); len(names) == 0 || names[len(names)-1] != n {
+			names = append(names, n)
+		}
+	}
+	sc.Close()
+	is.Equal(t, []string{"n7", "n6", "n5", "n4", "n3", "n2"}, names)
+	r.db.Abort(tx)
+
+	// Min and Max stop at the first row in the order of a descending column
+	is.Nil(t, r.db.CreateIndexDesc(ctx, "events", []string{"time"}, []bool{true}, false))
+	at := func(tm int64) Record { return *(&Record{}).AddInt64("time", tm) }
+	tx = r.begin()
+	for _, sc := range []*Scanner{
+		{Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE, Key1: at(80), Key2: at(20)},
+		{Cmp1: btree_iter.CMP_LE, Cmp2: btree_iter.CMP_GE, Key1: at(20), Key2: at(80)},
+	} {
+		v, ok, err := tx.Min("events", "time", sc)
+		is.Nil(t, err)
+		is.True(t, ok)
+		is.Equal(t, int64(20), v.I64)
+		v, ok, err = tx.Max("events", "time", sc)
+		is.Nil(t, err)
+		is.True(t, ok)
+		is.Equal(t, int64(80), v.I64)
+	}
+	r.db.Abort(tx)
+	is.Nil(t, r.db.Check())
+}
+
+func TestTableDebugDump(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	r.create(&TableDef{
+		Name:    "tbl_test",
+		Cols:    []string{"k", "v"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"k"}, {"v"}},
+	})
+	tx := r.begin()
+	for i := 0; i < 100; i++ {
+		rec := (&Record{}).AddInt64("k", int64(i)).AddStr("v", []byte(fmt.Sprintf("v%02d", i)))
+		_, err := tx.Insert("tbl_test", rec)
+		is.Nil(t, err)
+	}
+	r.commit(tx)
+
+	out := &bytes.Buffer{}
+	is.Nil(t, r.db.DebugDump(out, DumpOptions{}))
+	dump := out.String()
+	is.True(t, strings.Contains(dump, "tbl_test (k=42), value "))
+	is.True(t, strings.Contains(dump, `tbl_test index 1 (v="v42", k=42), value 0 bytes`))
+	is.True(t, strings.Contains(dump, "@table (name="))
+	is.False(t, strings.Contains(dump, "BAD"))
+
+	// the keys of the index only
+	tx = r.begin()
+	tdef, err := getTableDef(tx, "tbl_test")
+	is.Nil(t, err)
+	r.db.Abort(tx)
+	out.Reset()
+	is.Nil(t, r.db.DebugDump(out, DumpOptions{Prefix: tdef.Prefixes[1]}))
+	dump = out.String()
+	is.True(t, strings.Contains(dump, `tbl_test index 1 (v="v00", k=0)`))
+	is.False(t, strings.Contains(dump, "tbl_test (k="))
+	is.False(t, strings.Contains(dump, "@table"))
+	is.True(t, strings.Contains(dump, "free list:"))
+}
+
+func TestTableVersion(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	tdef := &TableDef{
+		Name:    "tbl_test",
+		Cols:    []string{"k", "v", "ver"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES, TYPE_INT64},
+		Indexes: [][]string{{"k"}},
+		Version: "v",
+	}
+	tx := r.begin()
+	is.ErrorContains(t, tx.TableNew(tdef), "version column is not INT64: v")
+	tdef.Version = "k"
+	is.ErrorContains(t, tx.TableNew(tdef), "version column in the primary key: k")
+	r.db.Abort(tx)
+	tdef.Version = "ver"
+	r.create(tdef)
+
+	get := func(k int64) Record {
+		tx := r.begin()
+		defer r.db.Abort(tx)
+		rec := (&Record{}).AddInt64("k", k)
+		ok, err := tx.Get("tbl_test", rec)
+		is.Nil(t, err)
+		is.True(t, ok)
+		return *rec
+	}
+	write := func(rec *Record, partial bool) error {
+		tx := r.begin()
+		_, err := tx.Set("tbl_test", &DBUpdateReq{Record: *rec, Partial: partial})
+		if err != nil {
+			r.db.Abort(tx)
+			return err
+		}
+		return r.db.Commit(tx)
+	}
+
+	// inserts start at 1
+	tx = r.begin()
+	_, err := tx.Insert("tbl_test", (&Record{}).AddInt64("k", 1).AddStr("v", []byte("a")))
+	is.Nil(t, err)
+	_, err = tx.InsertBatch("tbl_test", []Record{*(&Record{}).AddInt64("k", 2).AddStr("v", []byte("b"))})
+	is.Nil(t, err)
+	r.commit(tx)
+	is.Equal(t, int64(1), get(1).Get("ver").I64)
+	is.Equal(t, int64(1), get(2).Get("ver").I64)
+
+	// 2 readers of the same version; the 2nd write is rejected
+	rec1, rec2 := get(1), get(1)
+	rec1.Get("v").Str = []byte("first")
+	rec2.Get("v").Str = []byte("second")
+	is.Nil(t, write(&rec1, false))
+	err = write(&rec2, false)
+	is.ErrorIs(t, err, ErrVersionMismatch)
+	verr := (*VersionError)(nil)
+	is.ErrorAs(t, err, &verr)
+	is.Equal(t, int64(1), verr.Expected)
+	is.Equal(t, int64(2), verr.Current)
+	is.Equal(t, "first", string(get(1).Get("v").Str))
+
+	// once read again
+	rec2 = get(1)
+	rec2.Get("v").Str = []byte("second")
+	is.Nil(t, write(&rec2, false))
+	is.Equal(t, int64(3), get(1).Get("ver").I64)
+
+	// partial updates, with and without the version
+	is.ErrorIs(t, write((&Record{}).AddInt64("k", 1).AddInt64("ver", 2), true), ErrVersionMismatch)
+	is.Nil(t, write((&Record{}).AddInt64("k", 1).AddInt64("ver", 3).AddStr("v", []byte("c")), true))
+	is.Nil(t, write((&Record{}).AddInt64("k", 1).AddStr("v", []byte("d")), true))
+	rec1 = get(1)
+	is.Equal(t, int64(5), rec1.Get("ver").I64)
+	is.Equal(t, "d", string(rec1.Get("v").Str))
+
+	// a missing row is at version 0
+	err = write((&Record{}).AddInt64("k", 3).AddStr("v", []byte("e")).AddInt64("ver", 1), false)
+	is.ErrorAs(t, err, &verr)
+	is.Equal(t, int64(0), verr.Current)
+	is.Nil(t, write((&Record{}).AddInt64("k", 3).AddStr("v", []byte("e")).AddInt64("ver", 0), false))
+	is.Equal(t, int64(1), get(3).Get("ver").I64)
+
+	// deletes with the version are checked
+	tx = r.begin()
+	_, err = tx.Delete("tbl_test", *(&Record{}).AddInt64("k", 1).AddInt64("ver", 4))
+	is.ErrorIs(t, err, ErrVersionMismatch)
+	deleted, err := tx.Delete("tbl_test", *(&Record{}).AddInt64("k", 1).AddInt64("ver", 5))
+	is.Nil(t, err)
+	is.True(t, deleted)
+	deleted, err = tx.Delete("tbl_test", *(&Record{}).AddInt64("k", 2))
+	is.Nil(t, err)
+	is.True(t, deleted)
+
+	// copies keep the version
+	rec := (&Record{}).AddInt64("k", 4).AddStr("v", []byte("f")).AddInt64("ver", 10)
+	_, err = tx.Set("tbl_test", &DBUpdateReq{Record: *rec, KeepVersion: true})
+	is.Nil(t, err)
+	r.commit(tx)
+	is.Equal(t, int64(10), get(4).Get("ver").I64)
+}
+
+func TestTableComputedIndex(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	lower := func(args []Value) Value {
+		return Value{Type: TYPE_BYTES, Str: bytes.ToLower(args[0].Str)}
+	}
+	is.Nil(t, r.db.RegisterIndexFunc("lower", TYPE_BYTES, lower))
+	is.ErrorContains(t, r.db.RegisterIndexFunc("lower", TYPE_BYTES, lower), "index function exists")
+
+	tdef := &TableDef{
+		Name:    "users",
+		Cols:    []string{"id", "email"},
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES},
+		Indexes: [][]string{{"id"}},
+	}
+	r.create(tdef)
+	tx := r.begin()
+	for i, email := range []string{"Ann@X", "bob@x", "CAROL@x"} {
+		_, err := tx.Insert("users", (&Record{}).AddInt64("id", int64(i)).AddStr("email", []byte(email)))
+		is.Nil(t, err)
+	}
+	r.commit(tx)
+
+	ctx := context.Background()
+	is.ErrorContains(t, r.db.CreateIndexFunc(ctx, "users", "upper", []string{"email"}, true), "unknown index function")
+	is.Nil(t, r.db.CreateIndexFunc(ctx, "users", "lower", []string{"email"}, true))
+	is.Nil(t, r.db.Check())
+
+	getEmail := func(db *DB, email string) (int64, error) {
+		tx := DBTX{}
+		db.Begin(&tx)
+		defer db.Abort(&tx)
+		rec := Record{}
+		args := *(&Record{}).AddStr("email", []byte(email))
+		ok, err := tx.GetByComputed("users", "lower", args, &rec)
+		if err != nil || !ok {
+			return -1, err
+		}
+		return rec.Get("id").I64, nil
+	}
+	id, err := getEmail(&r.db, "ann@x")
+	is.Nil(t, err)
+	is.Equal(t, int64(0), id)
+	id, err = getEmail(&r.db, "Carol@X")
+	is.Nil(t, err)
+	is.Equal(t, int64(2), id)
+	id, err = getEmail(&r.db, "dave@x")
+	is.Nil(t, err)
+	is.Equal(t, int64(-1), id)
+
+	// a range of the values of the function
+	tx = r.begin()
+	sc := Scanner{
+		Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LT,
+		Key1: *(&Record{}).AddStr("email", []byte("B")),
+		Key2: *(&Record{}).AddStr("email", []byte("D")),
+	}
+	is.Nil(t, tx.ScanComputed("users", "lower", &sc))
+	got := []int64{}
+	for ; sc.Valid(); sc.Next() {
+		rec := Record{}
+		is.Nil(t, sc.Deref(&rec))
+		got = append(got, rec.Get("id").I64)
+	}
+	is.Nil(t, sc.Err())
+	sc.Close()
+	is.Equal(t, []int64{1, 2}, got)
+	// not a scan by the columns
+	sc = Scanner{
+		Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE,
+		Key1: *(&Record{}).AddStr("email", []byte("bob@x")),
+		Key2: *(&Record{}).AddStr("email", []byte("bob@x")),
+	}
+	is.ErrorIs(t, tx.Scan("users", &sc), ErrBadRange)
+
+	// unique by the value of the function
+	_, err = tx.Insert("users", (&Record{}).AddInt64("id", 3).AddStr("email", []byte("BOB@X")))
+	is.ErrorIs(t, err, ErrUniqueViolation)
+	_, err = tx.Update("users", *(&Record{}).AddInt64("id", 1).AddStr("email", []byte("Bob@y")))
+	is.Nil(t, err)
+	r.commit(tx)
+	id, err = getEmail(&r.db, "bob@y")
+	is.Nil(t, err)
+	is.Equal(t, int64(1), id)
+	is.Nil(t, r.db.Check())
+
+	// opened without the function, the index can't be used or written
+	r.db.Close()
+	r.db = DB{Path: r.db.Path}
+	is.Nil(t, r.db.Open())
+	_, err = getEmail(&r.db, "ann@x")
+	is.ErrorContains(t, err, "unknown index function: lower")
+	tx = r.begin()
+	_, err = tx.Insert("users", (&Record{}).AddInt64("id", 4).AddStr("email", []byte("e@x")))
+	is.ErrorContains(t, err, "unknown index function: lower")
+	r.db.Abort(tx)
+	is.Nil(t, r.db.RegisterIndexFunc("lower", TYPE_BYTES, lower))
+	id, err = getEmail(&r.db, "ANN@X")
+	is.Nil(t, err)
+	is.Equal(t, int64(0), id)
+}
+
+func TestTableJSON(t *testing.T) {
+	r := newR()
+	defer r.dispose()
+	tdef := &TableDef{
+		Name:    "docs",
+		Cols:    []string{"id", "payload"},
+		Types:   []uint32{TYPE_INT64, TYPE_JSON},
+		Indexes: [][]string{{"id"}, {"payload"}},
+	}
+	tx := r.begin()
+	is.ErrorContains(t, tx.TableNew(tdef), "JSON column cannot be indexed: payload")
+	r.db.Abort(tx)
+	tdef.Indexes = tdef.Indexes[:1]
+	r.create(tdef)
+
+	docs := []string{
+		`{ "user": {"id": 42, "name": "ann"}, "tags": ["a", "b"], "score": 1.5 }`,
+		`{"user": {"id": 9007199254740993}, "score": 2.0, "ok": true}`,
+		`{"user": {"id": 7.0}, "score": 1e3, "ok": false, "extra": null}`,
+		`[1, 2, 3]`,
+		`"just a string"`,
+	}
+	tx = r.begin()
+	for i, doc := range docs {
+		_, err := tx.Insert("docs", (&Record{}).AddInt64("id", int64(i)).AddJSON("payload", []byte(doc)))
+		is.Nil(t, err)
+	}
+	// invalid documents are rejected
+	for _, doc := range []string{`{"a": }`, ``, `{"a": 1} x`, "\"\xff\""} {
+		_, err := tx.Insert("docs", (&Record{}).AddInt64("id", 99).AddJSON("payload", []byte(doc)))
+		is.ErrorIs(t, err, ErrInvalidJSON, doc)
+		verr := (*ValidationError)(nil)
+		is.ErrorAs(t, err, &verr)
+		is.Equal(t, "payload", verr.Col)
+	}
+	r.commit(tx)
+
+	get := func(id int64) Value {
+		tx := r.begin()
+		defer r.db.Abort(tx)
+		rec := (&Record{}).AddInt64("id", id)
+		ok, err := tx.Get("docs", rec)
+		is.Nil(t, err)
+		is.True(t, ok)
+		return *rec.Get("payload")
+	}
+	// stored compacted
+	doc := get(0)
+	is.Equal(t, `{"user":{"id":42,"name":"ann"},"tags":["a","b"],"score":1.5}`, string(doc.Str))
+
+	// the types of the fields; the integers are exact
+	for path, want := range map[string]Value{
+		"user.id":   {Type: TYPE_INT64, I64: 42},
+		"user.name": {Type: TYPE_BYTES, Str: []byte("ann")},
+		"tags.1":    {Type: TYPE_BYTES, Str: []byte("b")},
+		"tags":      {Type: TYPE_JSON, Str: []byte(`["a","b"]`)},
+		"score":     {Type: TYPE_FLOAT64, F64: 1.5},
+	} {
+		got, ok := doc.JSONGet(path)
+		is.True(t, ok, path)
+		is.Equal(t, want, got, path)
+	}
+	for _, path := range []string{"nope", "user.id.x", "tags.2", "tags.x", "user..id"} {
+		_, ok := doc.JSONGet(path)
+		is.False(t, ok, path)
+	}
+	doc = get(1)
+	v, _ := doc.JSONGet("user.id")
+	is.Equal(t, Value{Type: TYPE_INT64, I64: 9007199254740993}, v)
+	v, _ = doc.JSONGet("score")
+	is.Equal(t, Value{Type: TYPE_FLOAT64, F64: 2}, v)
+	v, _ = doc.JSONGet("ok")
+	is.Equal(t, Value{Type: TYPE_BOOL, I64: 1}, v)
+	doc = get(2)
+	v, _ = doc.JSONGet("score")
+	is.Equal(t, Value{Type: TYPE_FLOAT64, F64: 1000}, v)
+	v, ok := doc.JSONGet("extra")
+	is.True(t, ok)
+	is.Equal(t, uint32(TYPE_NULL), v.Type)
+	doc = get(3)
+	v, _ = doc.JSONGet("2")
+	is.Equal(t, Value{Type: TYPE_INT64, I64: 3}, v)
+	doc = get(4)
+	v, _ = doc.JSONGet("")
+	is.Equal(t, "just a string", string(v.Str))
+
+	// filters on the fields
+	scan := func(expr string) (got []int64) {
+		tx := r.begin()
+		defer r.db.Abort(tx)
+		sc := Scanner{Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE}
+		is.Nil(t, sc.SetFilterExpr(expr))
+		is.Nil(t, tx.Scan("docs", &sc))
+		for ; sc.Valid(); sc.Next() {
+			rec := Record{}
+			is.Nil(t, sc.Deref(&rec))
+			got = append(got, rec.Get("id").I64)
+		}
+		is.Nil(t, sc.Err())
+		return got
+	}
+	for expr, want := range map[string][]int64{
+		"payload.user.id = 42":               {0},
+		"payload.user.id = 9007199254740993": {1},
+		"payload.user.id = 7":                {2},
+		"payload.user.id > 10":               {0, 1},
+		"payload.score <= 2":                 {0, 1},
+		"payload.user.name = 'ann'":          {0},
+		"payload.tags.0 STARTS WITH 'a'":     {0},
+		"payload.ok = TRUE":                  {1},
+		"payload.user.id = NULL":             {3, 4},
+		"payload.extra = NULL":               {0, 1, 2, 3, 4},
+		"payload.1 = 2":                      {3},
+		"payload.user.name != 'bob'":         {0},
+		"payload.user.id != 'x'":             {0, 1, 2},
+	} {
+		is.Equal(t, want, scan(expr), expr)
+	}
+	sc := Scanner{Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE}
+	is.Nil(t, sc.SetFilterExpr("id.x = 1"))
+	tx = r.begin()
+	is.ErrorContains(t, tx.Scan("docs", &sc), "not a JSON column: id")
+	r.db.Abort(tx)
+	eerr := (*ExprError)(nil)
+	is.ErrorAs(t, sc.SetFilterExpr("payload. = 1"), &eerr)
+	is.Equal(t, 7, eerr.Pos)
+
+	// a large document goes to the overflow pages
+	big := fmt.Sprintf(`{"blob": %q, "n": 1}`, strings.Repeat("x", 100000))
+	tx = r.begin()
+	_, err := tx.Insert("docs", (&Record{}).AddInt64("id", 5).AddJSON("payload", []byte(big)))
+	is.Nil(t, err)
+	r.commit(tx)
+	doc = get(5)
+	v, _ = doc.JSONGet("n")
+	is.Equal(t, int64(1), v.I64)
+	is.Equal(t, len(big)-3, len(doc.Str)) // the spaces
+	is.Nil(t, r.db.Check())
+
+	// a path as an index, with a null for the documents without it
+	is.Nil(t, r.db.RegisterIndexFunc("user_id", TYPE_INT64, JSONIndexFunc("user.id", TYPE_INT64)))
+	is.Nil(t, r.db.CreateIndexFunc(context.Background(), "docs", "user_id", []string{"payload"}, true))
+	tx = r.begin()
+	rec := Record{}
+	key := *(&Record{}).AddJSON("payload", []byte(`{"user": {"id": 42}}`))
+	ok, err = tx.GetByComputed("docs", "user_id", key, &rec)
+	is.Nil(t, err)
+	is.True(t, ok)
+	is.Equal(t, int64(0), rec.Get("id").I64)
+	_, err = tx.Insert("docs", (&Record{}).AddInt64("id", 6).AddJSON("payload", []byte(`{"user": {"id": 42}}`)))
+	is.ErrorIs(t, err, ErrUniqueViolation)
+	_, err = tx.Insert("docs", (&Record{}).AddInt64("id", 6).AddJSON("payload", []byte(`{}`)))
+	is.Nil(t, err)
+	r.commit(tx)
+	is.Nil(t, r.db.Check())
+
+	// exported as documents, and imported back
+	buf := bytes.Buffer{}
+	is.Nil(t, r.db.ExportJSON("docs", &buf))
+	is.Contains(t, buf.String(), `{"id":0,"payload":{"user":{"id":42,"name":"ann"},"tags":["a","b"],"score":1.5}}`)
+	tx = r.begin()
+	_, err = tx.Delete("docs", *(&Record{}).AddInt64("id", 1))
+	is.Nil(t, err)
+	r.commit(tx)
+	n, err := r.db.ImportJSON("docs", &buf, ImportOptions{})
+	is.Nil(t, err)
+	is.Equal(t, 7, n)
+	doc = get(1)
+	v, _ = doc.JSONGet("user.id")
+	is.Equal(t, int64(9007199254740993), v.I64)
+}
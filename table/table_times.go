@@ -0,0 +1,84 @@
+package table
+
+import (
+	"fmt"
+	"slices"
+)
+
+/*
+columns of the write times, kept by the engine. TableDef.CreatedAt is set
+when a row is added and TableDef.UpdatedAt on every write that changes the
+row, partial updates included, with the time of DB.Clock in nanoseconds
+since the epoch. a write that changes nothing else keeps the old time, so
+it still reports the row as not updated.
+
+the values of the record for these columns are replaced, unless the
+write sets DBUpdateReq.KeepTimes, as imports, restores and SyncWith do to
+copy the rows as they are. a bulk Load also keeps them.
+*/
+
+func timesCheck(tdef *TableDef) error {
+	for _, col := range []string{tdef.CreatedAt, tdef.UpdatedAt} {
+		if col == "" {
+			continue
+		}
+		idx := slices.Index(tdef.Cols, col)
+		if idx < 0 {
+			return fmt.Errorf("unknown time column: %s", col)
+		}
+		if tp := tdef.Types[idx]; tp != TYPE_INT64 && tp != TYPE_TIMESTAMP {
+			return fmt.Errorf("time column is not INT64 or TIMESTAMP: %s", col)
+		}
+		if slices.Contains(tdef.Indexes[0], col) {
+			return fmt.Errorf("time column in the primary key: %s", col)
+		}
+	}
+	if tdef.CreatedAt != "" && tdef.CreatedAt == tdef.UpdatedAt {
+		return fmt.Errorf("the same column for both times: %s", tdef.CreatedAt)
+	}
+	return nil
+}
+
+// the time columns of a record take the time of the write
+func timesFill(tx *DBTX, tdef *TableDef, rec Record) Record {
+	if tdef.CreatedAt == "" && tdef.UpdatedAt == "" {
+		return rec
+	}
+	// don't modify the caller's slices
+	rec = Record{slices.Clone(rec.Cols), slices.Clone(rec.Vals)}
+	now := dbNow(tx.db).UnixNano()
+	for _, col := range []string{tdef.CreatedAt, tdef.UpdatedAt} {
+		if col != "" {
+			tp := tdef.Types[slices.Index(tdef.Cols, col)]
+			rec.Set(col, Value{Type: tp, I64: now})
+		}
+	}
+	return rec
+}
+
+// the times of an existing row that are kept: the creation, and the
+// update if nothing else changes
+func timesKeep(tx *DBTX, tdef *TableDef, rec Record) error {
+	if tdef.CreatedAt == "" && tdef.UpdatedAt == "" {
+		return nil
+	}
+	pk := tdef.Indexes[0]
+	old := Record{pk, slices.Clone(rec.Vals[:len(pk)])}
+	ok, err := dbGet(tx, tdef, &old)
+	if err != nil || !ok {
+		return err
+	}
+	if tdef.CreatedAt != "" {
+		*rec.Get(tdef.CreatedAt) = *old.Get(tdef.CreatedAt)
+	}
+	if tdef.UpdatedAt == "" {
+		return nil
+	}
+	for _, c := range tdef.Cols {
+		if c != tdef.UpdatedAt && !rec.Get(c).Equal(old.Get(c)) {
+			return nil
+		}
+	}
+	*rec.Get(tdef.UpdatedAt) = *old.Get(tdef.UpdatedAt)
+	return nil
+}
@@ -0,0 +1,87 @@
+package table
+
+import (
+	"fmt"
+
+	"github.com/Adit0507/AdiDB/internal/btree_iter"
+)
+
+/*
+emptying a table in one commit. the keys under the prefixes of the table,
+its rows and its secondary indexes, are deleted by KVTX.DeleteRange, which
+frees whole subtrees instead of deleting key by key. the schema stays; the
+auto-increment counter starts over, the row counters are zeroed, and the
+statistics of DB.Analyze are dropped.
+
+a table with Changes is emptied row by row instead, so that each delete is
+in the change feed. a table referenced by a foreign key is refused, like
+in TableDrop, since the rows of the other table would be left dangling.
+*/
+
+// delete all rows of a table; see the top. returns the number of rows,
+// as counted in @stats before the commit.
+func (db *DB) Truncate(table string) (int64, error) {
+	tx := DBTX{}
+	db.Begin(&tx)
+	count, err := tableTruncate(&tx, table)
+	if err != nil {
+		db.Abort(&tx)
+		return 0, err
+	}
+	if err := db.Commit(&tx); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func tableTruncate(tx *DBTX, name string) (int64, error) {
+	if _, ok := INTERNAL_TABLES[name]; ok {
+		return 0, fmt.Errorf("cannot truncate internal table: %s", name)
+	}
+	tdef, err := getTableDef(tx, name)
+	if err != nil {
+		return 0, err
+	}
+	if err := tableReferenced(tx, name); err != nil {
+		return 0, err
+	}
+
+	count := int64(0)
+	if tdef.Changes {
+		count, err = tx.DeleteRange(name, Record{}, Record{}, btree_iter.CMP_GE, btree_iter.CMP_LE)
+		if err != nil {
+			return 0, err
+		}
+	} else {
+		stats, err := tableStats(tx, tdef)
+		if err != nil {
+			return 0, err
+		}
+		count = stats.Rows
+		for _, prefix := range tdef.Prefixes {
+			start := encodeKey(nil, prefix, nil)
+			end := encodeKey(nil, prefix+1, nil)
+			if err := tx.kv.DeleteRange(start, end); err != nil {
+				return 0, err
+			}
+		}
+		// also adds the counters of a table created before them
+		zero := (&Record{}).AddInt64("prefix", int64(tdef.Prefixes[0])).
+			AddInt64("rows", 0).AddInt64("bytes", 0)
+		if _, err := dbUpdate(tx, TDEF_STATS, &DBUpdateReq{Record: *zero}); err != nil {
+			return 0, err
+		}
+	}
+
+	meta := (&Record{}).AddStr("key", autoIncKey(name))
+	if _, err := dbDelete(tx, TDEF_META, *meta); err != nil {
+		return 0, err
+	}
+	for _, prefix := range tdef.Prefixes {
+		meta := (&Record{}).AddStr("key", indexStatsKey(prefix))
+		if _, err := dbDelete(tx, TDEF_META, *meta); err != nil {
+			return 0, err
+		}
+	}
+	return count, nil
+}
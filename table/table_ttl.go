@@ -0,0 +1,236 @@
+package table
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/Adit0507/AdiDB/internal/btree_iter"
+	"github.com/Adit0507/AdiDB/internal/transactions"
+)
+
+/*
+row TTL. TableDef.TTL names an INT64 or TIMESTAMP column that holds the
+deadline of a row in nanoseconds since the epoch. once DB.Clock passes it,
+the row is absent: gets and scans skip it, a delete reports it missing, and
+an insert replaces it. a deadline of 0 or less, or NULL, never expires.
+
+expired rows stay in the file until they are deleted by ExpireSweep, or by a
+write to the same key or the same unique index values. until then they
+are counted in the table stats. a secondary index that starts with the TTL
+column makes the sweep a range scan instead of a full one.
+*/
+
+// rows deleted per table by each run of the sweeper
+const SWEEP_LIMIT = 1000
+
+// the clock of the TTL deadlines
+func dbNow(db *DB) time.Time {
+	if db == nil || db.Clock == nil {
+		return time.Now()
+	}
+	return db.Clock()
+}
+
+// the expiry cutoff of a scan; 0 for a table without TTL
+func ttlNow(tx *DBTX, tdef *TableDef) int64 {
+	if tdef == nil || tdef.TTL == "" {
+		return 0
+	}
+	return max(dbNow(tx.db).UnixNano(), 1)
+}
+
+func ttlCheck(tdef *TableDef) error {
+	if tdef.TTL == "" {
+		return nil
+	}
+	idx := slices.Index(tdef.Cols, tdef.TTL)
+	if idx < 0 {
+		return fmt.Errorf("unknown TTL column: %s", tdef.TTL)
+	}
+	if tp := tdef.Types[idx]; tp != TYPE_INT64 && tp != TYPE_TIMESTAMP {
+		return fmt.Errorf("TTL column is not INT64 or TIMESTAMP: %s", tdef.TTL)
+	}
+	return nil
+}
+
+// the deadline of the row is at or before `now`
+func rowExpired(tdef *TableDef, rec *Record, now int64) bool {
+	if tdef.TTL == "" {
+		return false
+	}
+	v := rec.Get(tdef.TTL)
+	return v != nil && v.Type != TYPE_NULL && v.I64 > 0 && v.I64 <= now
+}
+
+// the stored row of the primary key, if it's expired
+func ttlExpiredRow(tx *DBTX, tdef *TableDef, pk []Value) (*Record, error) {
+	now := ttlNow(tx, tdef)
+	if now == 0 {
+		return nil, nil
+	}
+	rec := &Record{tdef.Indexes[0], slices.Clone(pk)}
+	ok, err := dbGetRow(tx, tdef, rec, nil, true)
+	if err != nil || !ok || !rowExpired(tdef, rec, now) {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// delete the expired row of the primary key before a write to it
+func ttlPurge(tx *DBTX, tdef *TableDef, pk []Value) error {
+	rec, err := ttlExpiredRow(tx, tdef, pk)
+	if err != nil || rec == nil {
+		return err
+	}
+	_, err = dbDeleteRow(tx, tdef, *rec, nil)
+	return err
+}
+
+// the primary key of the row of an index key, if it's expired
+func ttlIndexKey(tx *DBTX, tdef *TableDef, index int, key []byte) (*Record, error) {
+	if tdef.TTL == "" {
+		return nil, nil
+	}
+	cols, types := indexKeyCols(tdef, index)
+	vals := make([]Value, len(types))
+	for i, tp := range types {
+		vals[i].Type = tp
+	}
+	ikey, err := indexKeyAsc(tdef, index, key)
+	if err == nil {
+		err = decodeKey(ikey, vals)
+	}
+	if err != nil {
+		return nil, rowCorrupt(tdef, key, err)
+	}
+	irec := Record{cols, vals}
+	pk := make([]Value, len(tdef.Indexes[0]))
+	for i, c := range tdef.Indexes[0] {
+		pk[i] = *irec.Get(c)
+	}
+	return ttlExpiredRow(tx, tdef, pk)
+}
+
+// delete up to `limit` expired rows of a table in a transaction; all of
+// them if `limit` is 0. returns the number deleted.
+func (db *DB) ExpireSweep(table string, limit int) (int, error) {
+	tx := DBTX{}
+	db.Begin(&tx)
+	n, err := expireSweep(&tx, table, limit)
+	if err != nil {
+		db.Abort(&tx)
+		return 0, err
+	}
+	return n, db.Commit(&tx)
+}
+
+func expireSweep(tx *DBTX, table string, limit int) (int, error) {
+	tdef, err := getTableDef(tx, table)
+	if err != nil {
+		return 0, err
+	}
+	if tdef.TTL == "" {
+		return 0, fmt.Errorf("table without TTL: %s", table)
+	}
+	now := ttlNow(tx, tdef)
+	sc := Scanner{
+		Cmp1: btree_iter.CMP_GE, Cmp2: btree_iter.CMP_LE,
+		Cols:   tdef.Indexes[0],
+		Limit:  limit,
+		Filter: func(rec *Record) bool { return rowExpired(tdef, rec, now) },
+		// the filter sees them
+		expired: true,
+	}
+	// the deadlines in (0, now] of an index on them
+	for _, index := range tdef.Indexes[1:] {
+		if index[0] == tdef.TTL {
+			tp := tdef.Types[slices.Index(tdef.Cols, tdef.TTL)]
+			sc.Cmp1 = btree_iter.CMP_GT
+			sc.Key1 = Record{[]string{tdef.TTL}, []Value{{Type: tp, I64: 0}}}
+			sc.Key2 = Record{[]string{tdef.TTL}, []Value{{Type: tp, I64: now}}}
+			break
+		}
+	}
+	if err := dbScan(tx, tdef, &sc); err != nil {
+		return 0, err
+	}
+	rows := []Record{}
+	for ; sc.Valid(); sc.Next() {
+		rec := Record{}
+		if err := sc.Deref(&rec); err != nil {
+			sc.Close()
+			return 0, err
+		}
+		rows = append(rows, rec)
+	}
+	sc.Close()
+	if err := sc.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, rec := range rows {
+		if _, err := dbDelete(tx, tdef, rec); err != nil {
+			return 0, err
+		}
+	}
+	return len(rows), nil
+}
+
+// run ExpireSweep on the tables with TTL every `interval`, up to
+// SWEEP_LIMIT rows each. a conflict with other writes is retried at the
+// next run. `stop` waits for a run in progress and returns the last
+// error; it must be called before Close.
+func (db *DB) StartSweeper(interval time.Duration) (stop func() error) {
+	done := make(chan struct{})
+	wg := sync.WaitGroup{}
+	var last error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := sweepAll(db); err != nil {
+					last = err
+				}
+			}
+		}
+	}()
+	return func() error {
+		close(done)
+		wg.Wait()
+		return last
+	}
+}
+
+func sweepAll(db *DB) error {
+	tx := DBTX{}
+	db.BeginRead(&tx)
+	tables := []string{}
+	names, err := tx.ListTables()
+	for i := 0; err == nil && i < len(names); i++ {
+		var tdef *TableDef
+		if tdef, err = getTableDef(&tx, names[i]); err == nil && tdef.TTL != "" {
+			tables = append(tables, names[i])
+		}
+	}
+	db.Abort(&tx)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range tables {
+		_, err := db.ExpireSweep(name, SWEEP_LIMIT)
+		if err != nil && !errors.Is(err, transactions.ErrorConflict) {
+			return err
+		}
+	}
+	return nil
+}
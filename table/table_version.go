@@ -0,0 +1,97 @@
+package table
+
+import (
+	"fmt"
+	"slices"
+)
+
+/*
+optimistic locking with a version column kept by the engine. the INT64
+column TableDef.Version of a row is 1 when it's added, and goes up by 1 on
+every write of the row, partial updates and writes that change nothing
+else included.
+
+a write whose record has the column is a compare-and-swap: the value is
+the version the caller read, and the write fails with a *VersionError if
+the row has another one, so of 2 writers that read the same version, the
+2nd one to write is rejected instead of overwriting the 1st. a missing row
+is at version 0. a record without the column writes unconditionally. a
+Delete is checked the same way when its record has the column.
+
+the writes that copy rows as they are, such as imports, restores and
+SyncWith, set DBUpdateReq.KeepVersion to take the version from the record
+without a check; a record without one gets the next version. a bulk Load
+also takes it from the rows.
+*/
+
+func versionCheck(tdef *TableDef) error {
+	if tdef.Version == "" {
+		return nil
+	}
+	idx := slices.Index(tdef.Cols, tdef.Version)
+	switch {
+	case idx < 0:
+		return fmt.Errorf("unknown version column: %s", tdef.Version)
+	case tdef.Types[idx] != TYPE_INT64:
+		return fmt.Errorf("version column is not INT64: %s", tdef.Version)
+	case slices.Contains(tdef.Indexes[0], tdef.Version):
+		return fmt.Errorf("version column in the primary key: %s", tdef.Version)
+	case slices.Contains([]string{tdef.TTL, tdef.CreatedAt, tdef.UpdatedAt}, tdef.Version):
+		return fmt.Errorf("version column is also a time column: %s", tdef.Version)
+	}
+	return nil
+}
+
+// the version of the record to compare with the row; false for none
+func versionExpected(tdef *TableDef, rec Record) (int64, bool) {
+	if tdef.Version == "" {
+		return 0, false
+	}
+	v := rec.Get(tdef.Version)
+	if v == nil || v.Type != TYPE_INT64 {
+		return 0, false
+	}
+	return v.I64, true
+}
+
+// the record has the version column, to be set by versionNext
+func versionFill(tdef *TableDef, rec Record) Record {
+	if tdef.Version == "" || rec.Get(tdef.Version) != nil {
+		return rec
+	}
+	// don't append to the caller's slices
+	rec.Cols = append(slices.Clip(rec.Cols), tdef.Version)
+	rec.Vals = append(slices.Clip(rec.Vals), Value{Type: TYPE_INT64})
+	return rec
+}
+
+// compare the version of the row with `expect`, and give the record the
+// next one
+func versionNext(tx *DBTX, tdef *TableDef, rec Record, expect int64, check bool) error {
+	if tdef.Version == "" {
+		return nil
+	}
+	pk := tdef.Indexes[0]
+	old := Record{pk, slices.Clone(rec.Vals[:len(pk)])}
+	ok, err := dbGet(tx, tdef, &old)
+	if err != nil {
+		return err
+	}
+	cur := int64(0)
+	if ok {
+		cur = versionOf(old.Get(tdef.Version))
+	}
+	if check && cur != expect {
+		return &VersionError{Table: tdef.Name, Expected: expect, Current: cur}
+	}
+	*rec.Get(tdef.Version) = Value{Type: TYPE_INT64, I64: cur + 1}
+	return nil
+}
+
+// the version of a stored row; a null is a row from before the column
+func versionOf(v *Value) int64 {
+	if v == nil || v.Type != TYPE_INT64 {
+		return 0
+	}
+	return v.I64
+}
@@ -0,0 +1,258 @@
+package table
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/Adit0507/AdiDB/internal/btree_iter"
+)
+
+/*
+push notifications of the committed writes of a table. DB.Watch takes a
+range of primary keys and returns a Watcher; each committed insert, update
+or delete of a row in the range is sent to Watcher.C as a ChangeEvent
+without Row, after the commit and in commit order. the table doesn't need
+TableDef.Changes.
+
+the events of a transaction are found by DB.Commit before the KV commit,
+from its pending updates and its DeleteRange ranges compared with its
+snapshot. they are sent by the KV commit while it holds the lock, so the
+events of 2 commits are never reordered, and a commit that fails sends
+nothing. a send never blocks the writer: a watcher with a full buffer is
+closed with ErrWatchOverflow instead, and the consumer resyncs, such as by
+ReadChanges after the last Seq it got.
+
+only the transactions of this DB are seen, not Load, ApplyChanges or
+another process. a watcher keeps the prefix of the table when it's
+created, so it gets nothing after the table is dropped.
+*/
+
+var ErrWatchOverflow = errors.New("watcher buffer is full")
+
+type WatchOptions struct {
+	Buffer int // events; 256 if 0
+}
+
+type Watcher struct {
+	// closed by Close, DB.Close, or an overflow; see Err
+	C <-chan ChangeEvent
+	// internals, guarded by DB.watch.mu
+	ch     chan ChangeEvent
+	db     *DB
+	tdef   *TableDef
+	start  []byte // the encoded range, both inclusive
+	end    []byte
+	closed bool
+	err    error
+}
+
+// the watchers of a DB
+type watchList struct {
+	mu   sync.Mutex
+	list []*Watcher
+}
+
+// watch the rows of a table with key1 <= primary key <= key2, where the
+// keys are leading columns of the primary key; empty for no bound
+func (db *DB) Watch(table string, key1 Record, key2 Record, opts WatchOptions) (*Watcher, error) {
+	if _, ok := INTERNAL_TABLES[table]; ok {
+		return nil, fmt.Errorf("cannot watch internal table: %s", table)
+	}
+	tx := DBTX{}
+	db.BeginRead(&tx)
+	tdef, err := getTableDef(&tx, table)
+	db.Abort(&tx)
+	if err != nil {
+		return nil, err
+	}
+	start, err := watchKey(tdef, key1, btree_iter.CMP_GE)
+	if err != nil {
+		return nil, err
+	}
+	end, err := watchKey(tdef, key2, btree_iter.CMP_LE)
+	if err != nil {
+		return nil, err
+	}
+
+	size := opts.Buffer
+	if size <= 0 {
+		size = 256
+	}
+	ch := make(chan ChangeEvent, size)
+	w := &Watcher{C: ch, ch: ch, db: db, tdef: tdef, start: start, end: end}
+	db.watch.mu.Lock()
+	db.watch.list = append(db.watch.list, w)
+	db.watch.mu.Unlock()
+	return w, nil
+}
+
+// a bound of the range, encoded like a scan of the primary key
+func watchKey(tdef *TableDef, key Record, cmp int) ([]byte, error) {
+	pk := tdef.Indexes[0]
+	if len(key.Cols) > len(pk) || !slices.Equal(key.Cols, pk[:len(key.Cols)]) {
+		return nil, fmt.Errorf("not a prefix of the primary key: %v", key.Cols)
+	}
+	if err := checkTypes(tdef, key); err != nil {
+		return nil, err
+	}
+	return encodeKeyPartial(nil, tdef.Prefixes[0], key.Vals, cmp), nil
+}
+
+// stop the events and close C. the events already in C stay.
+func (w *Watcher) Close() {
+	w.db.watch.mu.Lock()
+	defer w.db.watch.mu.Unlock()
+	watchStop(w, nil)
+}
+
+// why C is closed: ErrWatchOverflow, or nil by Close
+func (w *Watcher) Err() error {
+	w.db.watch.mu.Lock()
+	defer w.db.watch.mu.Unlock()
+	return w.err
+}
+
+// called with DB.watch.mu held
+func watchStop(w *Watcher, err error) {
+	if w.closed {
+		return
+	}
+	w.closed, w.err = true, err
+	close(w.ch)
+	list := &w.db.watch.list
+	*list = slices.DeleteFunc(*list, func(x *Watcher) bool { return x == w })
+}
+
+// called by DB.Close
+func watchCloseAll(db *DB) {
+	db.watch.mu.Lock()
+	defer db.watch.mu.Unlock()
+	for len(db.watch.list) > 0 {
+		watchStop(db.watch.list[0], nil)
+	}
+}
+
+type watchEvent struct {
+	w  *Watcher
+	ev ChangeEvent
+}
+
+// find the events of the transaction and send them on its commit; see the top
+func watchCommit(db *DB, tx *DBTX) {
+	db.watch.mu.Lock()
+	watchers := slices.Clone(db.watch.list)
+	db.watch.mu.Unlock()
+	if len(watchers) == 0 || tx.kv.readOnly {
+		return
+	}
+	events, err := watchEvents(tx, watchers)
+	if err == nil && len(events) == 0 {
+		return
+	}
+	tx.kv.onCommit = func(seq uint64) {
+		db.watch.mu.Lock()
+		defer db.watch.mu.Unlock()
+		if err != nil {
+			// the events are unknown
+			for _, w := range watchers {
+				watchStop(w, err)
+			}
+			return
+		}
+		for _, e := range events {
+			if e.w.closed {
+				continue
+			}
+			e.ev.Seq = seq
+			select {
+			case e.w.ch <- e.ev:
+			default:
+				watchStop(e.w, ErrWatchOverflow)
+			}
+		}
+	}
+}
+
+// the rows deleted by the DeleteRange ranges, then the rows written, in
+// the order of the keys
+func watchEvents(tx *DBTX, watchers []*Watcher) (out []watchEvent, err error) {
+	defer checksumRecover(&err)
+	add := func(w *Watcher, op int, key []byte) error {
+		pk, err := watchDecode(w.tdef, key)
+		if err != nil {
+			return err
+		}
+		out = append(out, watchEvent{w, ChangeEvent{Op: op, Key: pk}})
+		return nil
+	}
+	in := func(w *Watcher, key []byte) bool {
+		return bytes.Compare(w.start, key) <= 0 && bytes.Compare(key, w.end) <= 0
+	}
+
+	cuts := tx.kv.cuts
+	for i, cut := range cuts {
+		for _, w := range watchers {
+			start := cut.start
+			if bytes.Compare(start, w.start) < 0 {
+				start = w.start
+			}
+			for iter := tx.kv.snapshot.Seek(start, btree_iter.CMP_GE); iter.Valid(); iter.Next() {
+				key, _ := iter.Deref()
+				if bytes.Compare(key, cut.stop) >= 0 || !in(w, key) {
+					break
+				}
+				// written again, or deleted by an earlier range
+				if _, ok := tx.kv.pending.Get(key); ok || cutsHave(cuts[:i], key) {
+					continue
+				}
+				if err := add(w, CHANGE_DEL, key); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	for iter := tx.kv.pending.Seek(nil, btree_iter.CMP_GT); iter.Valid(); iter.Next() {
+		key, val := iter.Deref()
+		if !slices.ContainsFunc(watchers, func(w *Watcher) bool { return in(w, key) }) {
+			continue
+		}
+		old, had := tx.kv.snapshot.Get(key)
+		op := 0
+		switch {
+		case val[0] == FLAG_DELETED && had:
+			op = CHANGE_DEL
+		case val[0] == FLAG_UPDATED && !had:
+			op = CHANGE_ADD
+		case val[0] == FLAG_UPDATED && (cutsHave(cuts, key) || !bytes.Equal(old, val[1:])):
+			op = CHANGE_UPDATE
+		default:
+			continue
+		}
+		for _, w := range watchers {
+			if !in(w, key) {
+				continue
+			}
+			if err := add(w, op, key); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return out, nil
+}
+
+// the primary key of a row key
+func watchDecode(tdef *TableDef, key []byte) (Record, error) {
+	pk := tdef.Indexes[0]
+	vals := make([]Value, len(pk))
+	for i, c := range pk {
+		vals[i].Type = tdef.Types[slices.Index(tdef.Cols, c)]
+	}
+	if err := decodeKey(slices.Clone(key), vals); err != nil {
+		return Record{}, err
+	}
+	return Record{slices.Clone(pk), vals}, nil
+}